@@ -0,0 +1,216 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	accessLogCommon = "common"
+	accessLogJSON   = "json"
+
+	maxAccessLogRoutes = 32 // routes listed per websocket session
+)
+
+// AccessLogConf represents the configuration of the access log.
+type AccessLogConf struct {
+	File     string // file path, or "-" for stdout
+	Format   string // "common" (default) or "json"
+	Rotation Rotation
+}
+
+// AccessEntry represents an entry in the access log: an HTTP request, or a websocket session.
+type AccessEntry struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"` // "http" or "socket"
+	Addr      string    `json:"addr"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto,omitempty"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`              // bytes sent
+	Received  int64     `json:"received,omitempty"` // bytes received, for sessions
+	Duration  float64   `json:"duration"`           // seconds
+	Routes    []string  `json:"routes,omitempty"`   // routes watched or queried, for sessions
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// AccessLog logs HTTP requests and websocket sessions, in the Common Log Format or as JSON lines.
+type AccessLog struct {
+	sync.Mutex
+	w    io.Writer
+	json bool
+}
+
+var accessLog *AccessLog // nil if disabled
+
+func openAccessLog(conf AccessLogConf) (*AccessLog, error) {
+	var asJSON bool
+	switch conf.Format {
+	case "", accessLogCommon:
+	case accessLogJSON:
+		asJSON = true
+	default:
+		return nil, fmt.Errorf("unknown access log format %q: want %s or %s", conf.Format, accessLogCommon, accessLogJSON)
+	}
+	if conf.File == "-" {
+		return &AccessLog{w: os.Stdout, json: asJSON}, nil
+	}
+	f, err := openRotatingFile(conf.File, conf.Rotation)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening access log %s: %v", conf.File, err)
+	}
+	return &AccessLog{w: f, json: asJSON}, nil
+}
+
+// wrap logs requests served by a handler. Safe to call on a nil log.
+func (a *AccessLog) wrap(h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		aw := &accessLogWriter{ResponseWriter: w}
+		h.ServeHTTP(aw, r)
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+		user, _, _ := r.BasicAuth()
+		a.write(AccessEntry{
+			Time:      start,
+			Type:      "http",
+			Addr:      getRemoteAddr(r),
+			User:      user,
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Proto:     r.Proto,
+			Status:    aw.status,
+			Bytes:     aw.size,
+			Duration:  time.Since(start).Seconds(),
+			UserAgent: r.UserAgent(),
+		})
+	})
+}
+
+// session logs a websocket session once the client disconnects. Safe to call on a nil log.
+func (a *AccessLog) session(c *Client, stats *ClientStats) {
+	if a == nil {
+		return
+	}
+	var user string
+	if c.session != nil {
+		user = c.session.username
+	}
+	routes := make([]string, 0, len(stats.routes))
+	for route := range stats.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	a.write(AccessEntry{
+		Time:     stats.opened,
+		Type:     "socket",
+		Addr:     c.addr,
+		User:     user,
+		Path:     c.baseURL + "_s/",
+		Status:   http.StatusSwitchingProtocols,
+		Bytes:    stats.sentBytes(),
+		Received: stats.received,
+		Duration: time.Since(stats.opened).Seconds(),
+		Routes:   routes,
+	})
+}
+
+func (a *AccessLog) write(e AccessEntry) {
+	var line []byte
+	if a.json {
+		var err error
+		if line, err = json.Marshal(e); err != nil {
+			echoError(Log{"t": "access_log", "error": err.Error()})
+			return
+		}
+	} else {
+		line = []byte(e.common())
+	}
+	a.Lock()
+	defer a.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		echoError(Log{"t": "access_log", "error": err.Error()})
+	}
+}
+
+// common formats an entry in the Common Log Format. Sessions are logged as "WEBSOCKET path" requests,
+// followed by the bytes received, the duration in seconds, and the routes visited.
+func (e AccessEntry) common() string {
+	user := e.User
+	if len(user) == 0 {
+		user = "-"
+	}
+	t := e.Time.Format("02/Jan/2006:15:04:05 -0700")
+	if e.Type == "socket" {
+		return fmt.Sprintf("%s - %s [%s] \"WEBSOCKET %s\" %d %d %d %.3f %q", e.Addr, user, t, e.Path, e.Status, e.Bytes, e.Received, e.Duration, strings.Join(e.Routes, ","))
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d", e.Addr, user, t, e.Method, e.Path, e.Proto, e.Status, e.Bytes)
+}
+
+// accessLogWriter records the status and size of a response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands over the connection, e.g. for websocket upgrades.
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		w.status = http.StatusSwitchingProtocols
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("hijacking not supported")
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestAccessLog(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	})
+
+	var buf bytes.Buffer
+	a := &AccessLog{w: &buf}
+	r := httptest.NewRequest("GET", "/missing?x=1", nil)
+	r.SetBasicAuth("key-id", "secret")
+	a.wrap(h).ServeHTTP(httptest.NewRecorder(), r)
+	ok(regexp.MustCompile(`^192\.0\.2\.1 - key-id \[.+\] "GET /missing\?x=1 HTTP/1\.1" 404 10\n$`).Match(buf.Bytes()), buf.String())
+
+	buf.Reset()
+	a.json = true
+	a.wrap(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/x", nil))
+	var e AccessEntry
+	no(json.Unmarshal(buf.Bytes(), &e))
+	eq(e.Type, "http")
+	eq(e.Method, "POST")
+	eq(e.Status, http.StatusNotFound)
+	eq(e.Bytes, int64(10))
+
+	buf.Reset()
+	a.json = false
+	c := newClient("192.0.2.2", nil, anonymous, "", newBroker(newSite(), false, true, true), nil, false, false, false, browserProtocolVersion, "/")
+	c.stats.opened = time.Now().Add(-2 * time.Second)
+	c.stats.received, c.stats.sent = 12, 34
+	c.stats.visit("/b")
+	c.stats.visit("/a")
+	a.session(c, c.stats)
+	ok(regexp.MustCompile(`^192\.0\.2\.2 - `+anon+` \[.+\] "WEBSOCKET /_s/" 101 34 12 2\.\d{3} "/a,/b"\n$`).Match(buf.Bytes()), buf.String())
+
+	var nilLog *AccessLog
+	eq(nilLog.wrap(h) != nil, true)
+	_, err := openAccessLog(AccessLogConf{File: "-", Format: "xml"})
+	ok(err != nil, "unknown format")
+}
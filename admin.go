@@ -0,0 +1,507 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// AdminServer represents the administrative API, reachable via API access keys only.
+type AdminServer struct {
+	prefix         string
+	keychain       *keychain.Keychain
+	tenancy        *Tenancy
+	broker         *Broker
+	maxRequestSize int64
+	settings       []ConfigSetting
+}
+
+func newAdminServer(prefix string, keychain *keychain.Keychain, tenancy *Tenancy, broker *Broker, maxRequestSize int64, settings []ConfigSetting) *AdminServer {
+	return &AdminServer{prefix, keychain, tenancy, broker, maxRequestSize, settings}
+}
+
+func (s *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.keychain.Guard(w, r) {
+		return
+	}
+	if len(s.tenancy.ofKey(r)) > 0 { // keys scoped to tenants cannot administer the site
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	action, arg := s.parse(r.URL.Path)
+	switch action {
+	case "snapshot":
+		s.snapshot(w, r, arg)
+	case "history":
+		s.history(w, r, arg)
+	case "archive":
+		s.archive(w, r, arg)
+	case "edits":
+		s.edits(w, r, arg)
+	case "apps":
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if len(arg) > 0 {
+			info, ok := s.broker.routeInfo(arg)
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			writeJSON(w, info)
+			return
+		}
+		writeJSON(w, s.broker.appInfos())
+	case "schedules":
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.broker.scheduler.infos())
+	case "processes":
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.broker.supervisor.infos())
+	case "app-tokens":
+		s.appTokens(w, r, arg)
+	case "routes":
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, metrics.routes.infos(s.broker.subscriberCounts()))
+	case "config":
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		settings := s.settings
+		if settings == nil {
+			settings = []ConfigSetting{}
+		}
+		writeJSON(w, settings)
+	case "gc":
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.broker.site.stats())
+	case "uploads":
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.broker.uploads.snapshot())
+	case "clients":
+		s.clients(w, r, strings.TrimPrefix(arg, "/"))
+	case "maintenance":
+		s.maintenance(w, r)
+	case "announce":
+		s.announce(w, r, arg)
+	case "reload":
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if s.broker.reloader == nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if err := s.broker.reloader.reload(); err != nil {
+			echoError(Log{"t": "reload", "error": err.Error()})
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+// appTokens lists app tokens, or issues (rotates) or revokes the tokens of the app route.
+func (s *AdminServer) appTokens(w http.ResponseWriter, r *http.Request, route string) {
+	tokens := s.broker.appTokens
+	if tokens == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, tokens.infos())
+	case http.MethodPost:
+		if len(route) == 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		token, err := tokens.rotate(route)
+		if err != nil {
+			echoError(Log{"t": "app_token", "route": route, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		echo(Log{"t": "app_token_rotate", "route": route})
+		writeJSON(w, struct {
+			Route string `json:"route"`
+			Token string `json:"token"`
+		}{route, token})
+	case http.MethodDelete:
+		ok, err := tokens.revoke(route)
+		if err != nil {
+			echoError(Log{"t": "app_token", "route": route, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		echo(Log{"t": "app_token_revoke", "route": route})
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// clients lists (GET) connected clients, or disconnects (DELETE) the client with the given ID.
+func (s *AdminServer) clients(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		if len(id) > 0 {
+			for _, info := range s.broker.clientInfos() {
+				if info.ID == id {
+					writeJSON(w, info)
+					return
+				}
+			}
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, s.broker.clientInfos())
+	case http.MethodDelete:
+		client := s.broker.getClient(id)
+		if client == nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		client.disconnect()
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+var bannerTypes = map[string]bool{"info": true, "error": true, "warning": true, "success": true, "danger": true, "blocked": true}
+
+// announce shows (POST) a notice to all connected clients, or to the clients watching route, if set, of all tenants,
+// or of a tenant, if given, on all replicas.
+func (s *AdminServer) announce(w http.ResponseWriter, r *http.Request, route string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := readRequestWithLimit(w, r.Body, s.maxRequestSize)
+	if err != nil {
+		if isRequestTooLarge(err) {
+			writeRequestTooLarge(w, s.maxRequestSize)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	var req struct {
+		Text    string `json:"text"`
+		Type    string `json:"type"`
+		Timeout int    `json:"timeout"` // seconds
+		Tenant  string `json:"tenant"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil || len(req.Text) == 0 || req.Timeout < 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	banner := BannerD{Text: req.Text, Type: req.Type, Timeout: req.Timeout}
+	if len(banner.Type) == 0 {
+		banner.Type = "info"
+	}
+	if !bannerTypes[banner.Type] {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	data, err := json.Marshal(OpsD{N: &banner})
+	if err != nil {
+		echoError(Log{"t": "announce", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	echo(Log{"t": "announce", "route": route, "tenant": req.Tenant, "text": banner.Text})
+	s.broker.announceAll(Announce{req.Tenant, route, data})
+}
+
+// maintenance reports (GET), starts (POST) or stops (DELETE) maintenance mode.
+func (s *AdminServer) maintenance(w http.ResponseWriter, r *http.Request) {
+	if s.broker.maintenance == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var conf MaintenanceConf
+		b, err := readRequestWithLimit(w, r.Body, s.maxRequestSize)
+		if err != nil {
+			if isRequestTooLarge(err) {
+				writeRequestTooLarge(w, s.maxRequestSize)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &conf); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+		}
+		s.broker.startMaintenance(conf)
+	case http.MethodDelete:
+		s.broker.stopMaintenance()
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.broker.maintenance.info())
+}
+
+func (s *AdminServer) parse(url string) (string, string) {
+	p := strings.SplitN(strings.TrimPrefix(url, s.prefix), "/", 2) // "/_a/snapshot/foo/bar" -> "snapshot", "/foo/bar"
+	if len(p) == 2 {
+		return p[0], "/" + p[1]
+	}
+	return p[0], ""
+}
+
+// edits lists page edits from the edit audit log, for a route, or for all routes if none;
+// optionally filtered by actor, e.g. "user:<subject>", and by time, e.g. since=2021-06-01T00:00:00Z,
+// and limited to the most recent entries.
+func (s *AdminServer) edits(w http.ResponseWriter, r *http.Request, route string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if s.broker.edits == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	filter := EditFilter{Route: route, Actor: q.Get("actor")}
+	if v := q.Get("since"); len(v) > 0 {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		filter.Since = t
+	}
+	if v := q.Get("limit"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = n
+	}
+	records, err := s.broker.edits.query(filter)
+	if err == errEditAuditNotQueryable {
+		http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		echoError(Log{"t": "edit_audit", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, records)
+}
+
+var (
+	errSnapshotNoPage    = errors.New("bad page snapshot: no page")
+	errSnapshotBadRoute  = errors.New("bad page snapshot: route must start with /")
+	errSnapshotNoRoute   = errors.New("bad page snapshot: no route to import to")
+	errSnapshotNoVersion = fmt.Errorf("bad page snapshot: no version; want %d", pageSnapshotVersion)
+	errEditNotRecorded   = errors.New("edit audit log unavailable")
+)
+
+// newPageSnapshot returns a snapshot of the page at route, taken at t.
+func newPageSnapshot(route string, d *PageD, t time.Time) *PageSnapshot {
+	return &PageSnapshot{Version: pageSnapshotVersion, Route: route, Time: t, Page: d}
+}
+
+// parsePageSnapshot decodes a page snapshot, as exported via the admin API or in an archive, checking that it is
+// of a version this server understands.
+func parsePageSnapshot(b []byte) (*PageSnapshot, error) {
+	var s PageSnapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("bad page snapshot: %v", err)
+	}
+	if s.Version == 0 {
+		return nil, errSnapshotNoVersion
+	}
+	if s.Version != pageSnapshotVersion {
+		return nil, fmt.Errorf("unsupported page snapshot version %d; want %d", s.Version, pageSnapshotVersion)
+	}
+	if s.Page == nil {
+		return nil, errSnapshotNoPage
+	}
+	if len(s.Route) > 0 && !strings.HasPrefix(s.Route, "/") {
+		return nil, errSnapshotBadRoute
+	}
+	return &s, nil
+}
+
+// importSnapshot replaces the contents of the page at route, or the snapshot's own route if empty, with the
+// snapshot's, recording the edit.
+func (s *AdminServer) importSnapshot(r *http.Request, route string, snapshot *PageSnapshot) error {
+	if len(route) == 0 { // import onto the original route
+		route = snapshot.Route
+	}
+	if len(route) == 0 {
+		return errSnapshotNoRoute
+	}
+	data, err := json.Marshal(snapshot.Page.ops())
+	if err != nil {
+		return err
+	}
+	echo(Log{"t": "snapshot_import", "route": route, "source": snapshot.Route})
+	if err := s.broker.edits.record(route, keyActor(r), getRemoteAddr(r), data); err != nil { // logged
+		return errEditNotRecorded
+	}
+	return s.broker.patch(route, data, keyActor(r))
+}
+
+// snapshot exports (GET) or imports (PUT) a page snapshot.
+func (s *AdminServer) snapshot(w http.ResponseWriter, r *http.Request, route string) {
+	switch r.Method {
+	case http.MethodGet:
+		page := s.broker.site.at(route)
+		if page == nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		d, err := page.copy()
+		if err != nil {
+			echoError(Log{"t": "snapshot_export", "route": route, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, newPageSnapshot(route, d, time.Now().UTC()))
+	case http.MethodPut:
+		b, err := readRequestWithLimit(w, r.Body, s.maxRequestSize)
+		if err != nil {
+			echoError(Log{"t": "read snapshot request body", "error": err.Error()})
+			if isRequestTooLarge(err) {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		snapshot, err := parsePageSnapshot(b)
+		if err != nil {
+			echoError(Log{"t": "snapshot_import", "error": err.Error()})
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.importSnapshot(r, route, snapshot); err != nil {
+			if err == errEditNotRecorded {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			if err == errSnapshotNoRoute {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writePatchError(w, err)
+			return
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// history lists (GET) the revisions of a page, or rolls back (POST) a page to the revision specified by ?rollback=id.
+func (s *AdminServer) history(w http.ResponseWriter, r *http.Request, route string) {
+	switch r.Method {
+	case http.MethodGet:
+		revisions, ok := s.broker.site.revisions(route)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, revisions)
+	case http.MethodPost:
+		id, err := strconv.Atoi(r.URL.Query().Get("rollback"))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		d, err := s.broker.site.revision(route, id)
+		if err != nil {
+			echoError(Log{"t": "page_rollback", "route": route, "revision": strconv.Itoa(id), "error": err.Error()})
+			if err == errRevisionNotFound {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		data, err := json.Marshal(d.ops())
+		if err != nil {
+			echoError(Log{"t": "page_rollback", "route": route, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		echo(Log{"t": "page_rollback", "route": route, "revision": strconv.Itoa(id)})
+		if err := s.broker.edits.record(route, keyActor(r), getRemoteAddr(r), data); err != nil {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		// Recorded as a new revision, so rollbacks can be undone.
+		if err := s.broker.patch(route, data, keyActor(r)); err != nil {
+			writePatchError(w, err)
+			return
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		echoError(Log{"t": "json_marshal", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Write(b)
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	adminDashboardRoute    = "/_admin"
+	adminDashboardInterval = 5 * time.Second
+	adminDashboardRoutes   = 20 // busiest routes listed
+)
+
+// AdminDashboard publishes the server's live status as a page, viewable by admins only.
+type AdminDashboard struct {
+	broker *Broker
+	route  string
+	admins map[string]bool // subjects allowed to view the page
+	last   time.Time       // time of last update
+	recv   uint64          // messages received as of the last update
+	sent   uint64          // messages sent as of the last update
+}
+
+// newAdminDashboard creates a dashboard for the admins, by subject.
+func newAdminDashboard(broker *Broker, admins []string) *AdminDashboard {
+	d := &AdminDashboard{broker: broker, route: adminDashboardRoute, admins: make(map[string]bool)}
+	for _, admin := range admins {
+		d.admins[admin] = true
+	}
+	return d
+}
+
+// denies returns true if the route is the dashboard's, and the session is not an admin's. Admins are told apart by
+// subject only, since usernames are chosen by users at the identity provider. Safe to call on a nil dashboard.
+func (d *AdminDashboard) denies(route string, session *Session) bool {
+	if d == nil || route != d.route {
+		return false
+	}
+	return session == nil || session == anonymous || !d.admins[session.subject]
+}
+
+// run updates the dashboard periodically.
+func (d *AdminDashboard) run(interval time.Duration) {
+	d.update()
+	for range time.Tick(interval) {
+		d.update()
+	}
+}
+
+// update replaces the dashboard's page, and sends it to the admins watching it.
+// The page is not logged, stored externally, or recorded in the page history.
+func (d *AdminDashboard) update() {
+	page := d.render()
+	data, err := json.Marshal(OpsD{P: page})
+	if err != nil {
+		echoError(Log{"t": "admin_dashboard", "error": err.Error()})
+		return
+	}
+	if err := d.broker.site.set(d.route, data); err != nil {
+		echoError(Log{"t": "admin_dashboard", "error": err.Error()})
+		return
+	}
+	var puts []OpD // replace the cards in place, rather than the page, to avoid flicker
+	for k, c := range page.C {
+		puts = append(puts, OpD{K: k, D: c.D})
+	}
+	if data, err = json.Marshal(OpsD{D: puts}); err == nil {
+		d.broker.publish <- Pub{d.route, data, nil, nil}
+	}
+}
+
+func (d *AdminDashboard) render() *PageD {
+	b := d.broker
+	now := time.Now()
+
+	var recv uint64
+	metrics.received.Lock()
+	for _, n := range metrics.received.values {
+		recv += n
+	}
+	metrics.received.Unlock()
+	sent := atomic.LoadUint64(&metrics.sent)
+	var recvRate, sentRate float64
+	if elapsed := now.Sub(d.last).Seconds(); !d.last.IsZero() && elapsed > 0 {
+		recvRate, sentRate = float64(recv-d.recv)/elapsed, float64(sent-d.sent)/elapsed
+	}
+	d.last, d.recv, d.sent = now, recv, sent
+
+	clients := make(map[*Client]bool)
+	watchers := make(map[string]int)
+	b.clientsMux.RLock()
+	for route, cs := range b.clients {
+		watchers[route] = len(cs)
+		for c := range cs {
+			clients[c] = true
+		}
+	}
+	b.clientsMux.RUnlock()
+
+	var pages int
+	b.site.pages.each(func(string, *Page) { pages++ })
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var overview strings.Builder
+	overview.WriteString("| | |\n|---|---|\n")
+	for _, row := range [][2]string{
+		{"Clients", fmt.Sprint(len(clients))},
+		{"Routes watched", fmt.Sprint(len(watchers))},
+		{"Apps", fmt.Sprint(len(b.getApps()))},
+		{"Pages", fmt.Sprint(pages)},
+		{"Messages received/s", fmt.Sprintf("%.1f", recvRate)},
+		{"Messages sent/s", fmt.Sprintf("%.1f", sentRate)},
+		{"Messages dropped", fmt.Sprint(atomic.LoadUint64(&metrics.dropped))},
+		{"Goroutines", fmt.Sprint(runtime.NumGoroutine())},
+		{"Heap", fmt.Sprintf("%.1f MB", float64(mem.HeapAlloc)/(1<<20))},
+		{"Updated", now.UTC().Format(time.RFC3339)},
+	} {
+		fmt.Fprintf(&overview, "| %s | %s |\n", row[0], row[1])
+	}
+
+	routes := make([]string, 0, len(watchers))
+	for route := range watchers {
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if watchers[routes[i]] != watchers[routes[j]] {
+			return watchers[routes[i]] > watchers[routes[j]]
+		}
+		return routes[i] < routes[j]
+	})
+	if len(routes) > adminDashboardRoutes {
+		routes = routes[:adminDashboardRoutes]
+	}
+	var busiest strings.Builder
+	busiest.WriteString("| Route | Clients |\n|---|---|\n")
+	for _, route := range routes {
+		fmt.Fprintf(&busiest, "| %s | %d |\n", markdownCode(route), watchers[route])
+	}
+
+	var apps strings.Builder
+	apps.WriteString("| Route | Mode | Status | Instances | Accepted | Failed | Error rate |\n|---|---|---|---|---|---|---|\n")
+	for _, info := range b.appInfos() {
+		var accepted, failed int64
+		for _, x := range info.Instances {
+			accepted += x.Accepted
+			failed += x.Failed
+		}
+		fmt.Fprintf(&apps, "| %s | %s | %s | %d | %d | %d | %.1f%% |\n", markdownCode(info.Route), info.Mode, info.Status, info.Count, accepted, failed, 100*info.ErrorRate)
+	}
+
+	return &PageD{C: map[string]CardD{
+		"overview": {D: map[string]interface{}{"view": "markdown", "box": "1 1 4 6", "title": "Server", "content": overview.String()}},
+		"routes":   {D: map[string]interface{}{"view": "markdown", "box": "5 1 8 6", "title": "Busiest routes", "content": busiest.String()}},
+		"apps":     {D: map[string]interface{}{"view": "markdown", "box": "1 7 12 4", "title": "Apps", "content": apps.String()}},
+	}}
+}
+
+// markdownCode formats untrusted text, e.g. a route, as inline code in a markdown table cell.
+func markdownCode(s string) string {
+	return "`" + strings.NewReplacer("`", "", "|", `\|`, "\n", " ").Replace(s) + "`"
+}
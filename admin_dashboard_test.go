@@ -0,0 +1,79 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestAdminDashboard(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	broker := newBroker(newSite(), false, true, true)
+	d := newAdminDashboard(broker, []string{"alice"})
+
+	ok(d.denies(adminDashboardRoute, &Session{subject: "bob", username: "bob"}), "not an admin")
+	ok(d.denies(adminDashboardRoute, nil), "no session")
+	ok(d.denies(adminDashboardRoute, anonymous), "anonymous")
+	ok(!d.denies(adminDashboardRoute, &Session{subject: "alice", username: "123"}), "admin")
+	ok(d.denies(adminDashboardRoute, &Session{subject: "123", username: "alice"}), "username is not an identity")
+	ok(!d.denies("/foo", &Session{subject: "bob"}), "other route")
+	var none *AdminDashboard
+	ok(!none.denies(adminDashboardRoute, anonymous), "disabled")
+
+	c := newClient("192.0.2.1", nil, anonymous, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	broker.clients["/demo|one"] = map[*Client]interface{}{c: nil}
+	page := d.render()
+	eq(len(page.C), 3)
+	ok(strings.Contains(page.C["overview"].D["content"].(string), "| Clients | 1 |"), "clients")
+	ok(strings.Contains(page.C["routes"].D["content"].(string), "| `/demo\\|one` | 1 |"), "routes escaped")
+
+	go func() { // drain
+		for range broker.publish {
+		}
+	}()
+	d.update()
+	ok(broker.site.at(adminDashboardRoute) != nil, "page published")
+}
+
+func TestAdminDashboardJSON(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	broker := newBroker(newSite(), false, true, true)
+	broker.dashboard = newAdminDashboard(broker, []string{"alice"})
+	go func() { // drain
+		for range broker.publish {
+		}
+	}()
+	broker.dashboard.update()
+
+	s := &WebServer{site: broker.site, broker: broker, auth: newTestAuth("alice", "bob"), baseURL: "/"}
+	get := func(subject string) (bool, int) {
+		w := httptest.NewRecorder()
+		found := s.getJSON(w, asUser(httptest.NewRequest("GET", "/_admin.json", nil), subject))
+		return found, w.Code
+	}
+	found, code := get("alice")
+	ok(found, "admin")
+	eq(code, http.StatusOK)
+	found, _ = get("bob")
+	ok(!found, "not an admin")
+	found, code = get("")
+	ok(found, "not signed in")
+	eq(code, http.StatusUnauthorized)
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestAdminApps(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	admin, request := newTestAdmin(t)
+	broker := admin.broker
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	apps := func() []AppInfo {
+		w := request("GET", "/_a/apps", "")
+		eq(w.Code, http.StatusOK)
+		var infos []AppInfo
+		no(json.Unmarshal(w.Body.Bytes(), &infos))
+		return infos
+	}
+	app := func(route string) (AppInfo, int) {
+		w := request("GET", "/_a/apps"+route, "")
+		var info AppInfo
+		if w.Code == http.StatusOK {
+			no(json.Unmarshal(w.Body.Bytes(), &info))
+		}
+		return info, w.Code
+	}
+
+	eq(len(apps()), 0)
+	no(broker.addApp("", &RegisterApp{Route: "/demo", Routes: []string{"/demo/help"}, Address: server.URL, Version: "2.0"}))
+	demo := broker.getApp("/demo")
+	no(demo.forward(context.Background(), "/demo", "client", anonymous, []byte("{}"), nil))
+	atomic.AddInt64(&demo.failed, 1)
+
+	infos := apps()
+	eq(len(infos), 1) // once, despite serving two routes
+	info := infos[0]
+	eq(info.Route, "/demo")
+	eq(info.Routes, []string{"/demo/help"})
+	eq(info.Status, appAvailable)
+	eq(info.Count, 1)
+	eq(info.ErrorRate, 0.5)
+	eq(info.Instances[0].Address, server.URL)
+	eq(info.Instances[0].Version, "2.0")
+	eq(info.Instances[0].Accepted, int64(1))
+	eq(info.Instances[0].ErrorRate, 0.0)
+	ok(time.Since(info.Instances[0].LastSeen) < time.Minute, "seen")
+
+	info, code := app("/demo/help") // by any of the app's routes
+	eq(code, http.StatusOK)
+	eq(info.Route, "/demo")
+	_, code = app("/missing")
+	eq(code, http.StatusNotFound)
+	eq(request("POST", "/_a/apps", "").Code, http.StatusMethodNotAllowed)
+
+	broker.queries = newQueryBuffer(1, time.Hour)
+	broker.removeApp(demo)
+	eq(len(apps()), 0)
+	info, code = app("/demo")
+	eq(code, http.StatusOK)
+	eq(info.Status, appRestarting)
+	eq(len(info.Instances), 0)
+	broker.queries.close("/demo")
+	broker.queries.close("/demo/help")
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"strings"
+)
+
+// RouteAlias represents a route that is served by, or redirects to, another route.
+type RouteAlias struct {
+	Target   string // route to serve or redirect to
+	Redirect bool   // redirect to target instead of serving it
+}
+
+// RouteAliases maps routes to their aliases. A route ending with "/" aliases all its sub-routes,
+// e.g. "/old/" => "/new/" maps /old/foo to /new/foo.
+type RouteAliases map[string]RouteAlias
+
+// resolve returns the alias for route, if any, with the target mapped to the corresponding sub-route.
+// Exact routes take precedence over prefixes, and longer prefixes over shorter ones. Safe to call on a nil map.
+func (aliases RouteAliases) resolve(route string) (RouteAlias, bool) {
+	if alias, ok := aliases[route]; ok {
+		return alias, true
+	}
+	var (
+		match  string
+		target RouteAlias
+	)
+	for prefix, alias := range aliases {
+		if strings.HasSuffix(prefix, "/") && strings.HasPrefix(route, prefix) && len(prefix) > len(match) {
+			match, target = prefix, alias
+		}
+	}
+	if len(match) == 0 {
+		return RouteAlias{}, false
+	}
+	return RouteAlias{strings.TrimSuffix(target.Target, "/") + "/" + strings.TrimPrefix(route, match), target.Redirect}, true
+}
+
+// serve returns the route to be served in place of route: the target of a non-redirecting alias, else route.
+func (aliases RouteAliases) serve(route string) string {
+	if alias, ok := aliases.resolve(route); ok && !alias.Redirect {
+		return alias.Target
+	}
+	return route
+}
+
+// redirect returns the route to redirect to, if route is aliased by a redirect.
+func (aliases RouteAliases) redirect(route string) (string, bool) {
+	if alias, ok := aliases.resolve(route); ok && alias.Redirect {
+		return alias.Target, true
+	}
+	return "", false
+}
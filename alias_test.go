@@ -0,0 +1,82 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestRouteAliases(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	aliases := RouteAliases{
+		"/old":          {Target: "/new"},
+		"/old/":         {Target: "/new/"},
+		"/old/reports/": {Target: "/reports", Redirect: true},
+		"/legacy":       {Target: "/", Redirect: true},
+	}
+
+	eq(aliases.serve("/old"), "/new") // exact routes before prefixes
+	eq(aliases.serve("/old/foo"), "/new/foo")
+	eq(aliases.serve("/old/foo/bar"), "/new/foo/bar")
+	eq(aliases.serve("/older"), "/older")
+	eq(aliases.serve("/old/reports/q1"), "/old/reports/q1") // redirected, not served
+	eq(aliases.serve("/legacy"), "/legacy")
+
+	target, redirected := aliases.redirect("/old/reports/q1") // longer prefixes before shorter ones
+	ok(redirected, "redirected")
+	eq(target, "/reports/q1")
+	target, redirected = aliases.redirect("/legacy")
+	ok(redirected, "redirected")
+	eq(target, "/")
+	_, redirected = aliases.redirect("/old/foo")
+	ok(!redirected, "aliased, not redirected")
+
+	var none RouteAliases
+	eq(none.serve("/foo"), "/foo")
+	_, redirected = none.redirect("/foo")
+	ok(!redirected, "nil aliases")
+}
+
+func TestRouteAliasesServed(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	site := newSite()
+	broker := newBroker(site, false, false, true)
+	broker.configure(RouteAliases{"/old": {Target: "/new"}, "/moved/": {Target: "/new/", Redirect: true}}, nil)
+	no(broker.patch("/new", []byte(`{"d":[{"k":"x","d":{"view":"markdown","content":"Hi"}}]}`), ""))
+	s := &WebServer{site: site, broker: broker, auth: newTestAuth("alice"), fs: http.NotFoundHandler(), maxRequestSize: 1024, baseURL: "/app/"}
+	get := func(path string) *httptest.ResponseRecorder {
+		r := asUser(httptest.NewRequest(http.MethodGet, path, nil), "alice")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/app/old.json")
+	eq(w.Code, http.StatusOK)
+	eq(w.Body.String(), `{"p":{"c":{"x":{"d":{"content":"Hi","view":"markdown"}}}}}`)
+
+	w = get("/app/moved/foo?x=1")
+	eq(w.Code, http.StatusFound)
+	eq(w.Header().Get("Location"), "/app/new/foo?x=1")
+	w = get("/app/moved/foo.json")
+	eq(w.Code, http.StatusFound)
+	eq(w.Header().Get("Location"), "/app/new/foo.json")
+
+	eq(get("/app/other.json").Code, http.StatusNotFound)
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import "encoding/json"
+
+const announceStoreKey = "@announce" // page store relay key of announcements; not a page URL
+
+// Announce represents an announcement, i.e. ops (e.g. a notice) for the clients watching a route, or for all clients
+// if route is empty, of a tenant, if set, or of any tenant otherwise. Routes are matched without their tenant prefix,
+// so that an announcement to "/demo" reaches the browsers watching "/demo" across tenants.
+type Announce struct {
+	Tenant string          `json:"tenant,omitempty"`
+	Route  string          `json:"route,omitempty"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// reaches returns true if the announcement is for client, watching route.
+func (a Announce) reaches(client *Client, route string) bool {
+	if len(a.Tenant) > 0 && client.tenant != a.Tenant {
+		return false
+	}
+	if len(a.Route) == 0 {
+		return true
+	}
+	_, route = splitTenantRoute(route)
+	return route == a.Route
+}
+
+// announcees returns the clients an announcement is for. Must be called from the broker's run loop.
+func (b *Broker) announcees(a Announce) map[*Client]interface{} {
+	targets := make(map[*Client]interface{})
+	for route, clients := range b.clients {
+		for client := range clients {
+			if a.reaches(client, route) {
+				targets[client] = nil
+			}
+		}
+	}
+	return targets
+}
+
+// announceAll sends an announcement to its clients, on all replicas sharing a page store.
+func (b *Broker) announceAll(a Announce) {
+	b.announce <- a
+	if b.storage == nil {
+		return
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		echoError(Log{"t": "announce", "error": err.Error()})
+		return
+	}
+	b.storage.relayShared(announceStoreKey, data)
+}
+
+// announced sends an announcement relayed by another replica to its clients.
+func (b *Broker) announced(data []byte) {
+	var a Announce
+	if err := json.Unmarshal(data, &a); err != nil {
+		echoError(Log{"t": "announce", "error": err.Error()})
+		return
+	}
+	b.announce <- a
+}
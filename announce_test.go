@@ -0,0 +1,112 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+func TestAnnounce(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	id, secret, hash, err := keychain.CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+	broker := newBroker(newSite(), false, true, true)
+	go broker.run()
+	admin := newAdminServer("/_a/", kc, nil, broker, 1024, nil)
+
+	alice := newClient("test", nil, anonymous, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	bob := newClient("test", nil, anonymous, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	carol := newClient("test", nil, anonymous, "acme", broker, nil, false, false, false, browserProtocolVersion, "/")
+	alice.subscribe("/demo")
+	bob.subscribe("/other")
+	carol.subscribe(tenantRoute("acme", "/demo"))
+	for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+		broker.clientsMux.RLock()
+		subscribed = len(broker.clients["/demo"]) == 1 && len(broker.clients["/other"]) == 1 && len(broker.clients[tenantRoute("acme", "/demo")]) == 1
+		broker.clientsMux.RUnlock()
+	}
+	announce := func(path, body string) int {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		r.SetBasicAuth(id, secret)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w.Code
+	}
+	notice := func(c *Client) *BannerD {
+		var ops OpsD
+		select {
+		case data := <-c.data:
+			no(json.Unmarshal(data, &ops))
+		case <-time.After(time.Second):
+		}
+		return ops.N
+	}
+
+	eq(announce("/_a/announce", `{"text":"Maintenance in 10 minutes","type":"warning","timeout":60}`), http.StatusOK)
+	want := BannerD{Text: "Maintenance in 10 minutes", Type: "warning", Timeout: 60}
+	eq(*notice(alice), want)
+	eq(*notice(bob), want)
+	eq(*notice(carol), want)
+
+	eq(announce("/_a/announce/demo", `{"text":"New data"}`), http.StatusOK)
+	eq(*notice(alice), BannerD{Text: "New data", Type: "info"})
+	eq(*notice(carol), BannerD{Text: "New data", Type: "info"}) // of another tenant
+	ok(len(bob.data) == 0, "bob is not watching /demo")
+
+	eq(announce("/_a/announce", `{"text":"Hi, Acme","tenant":"acme"}`), http.StatusOK)
+	eq(notice(carol).Text, "Hi, Acme")
+	ok(len(alice.data) == 0 && len(bob.data) == 0, "not of tenant acme")
+
+	eq(announce("/_a/announce", `{"text":""}`), http.StatusBadRequest)
+	eq(announce("/_a/announce", `{"text":"Hi","type":"shout"}`), http.StatusBadRequest)
+}
+
+func TestAnnounceReplicas(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	store := &relayPageStore{memPageStore: &memPageStore{make(map[string][]byte)}}
+	a := newBroker(newSite(), false, true, true)
+	a.storage = newPageStorage(store, a.site)
+	go a.run()
+	b := newBroker(newSite(), false, true, true)
+	go b.run()
+	alice := newClient("test", nil, anonymous, "", b, nil, false, false, false, browserProtocolVersion, "/")
+	alice.subscribe("/demo")
+	for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+		b.clientsMux.RLock()
+		subscribed = len(b.clients["/demo"]) == 1
+		b.clientsMux.RUnlock()
+	}
+
+	a.announceAll(Announce{Route: "/demo", Data: []byte(`{"n":{"t":"Hi"}}`)})
+	eq(len(store.published), 1)
+	parts := strings.SplitN(string(store.published[0]), " ", 3)
+	eq(parts[1], announceStoreKey)
+	b.announced([]byte(parts[2])) // as relayed
+	var ops OpsD
+	no(json.Unmarshal(<-alice.data, &ops))
+	ok(ops.N != nil && ops.N.Text == "Hi", "relayed")
+}
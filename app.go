@@ -15,9 +15,48 @@
 package wave
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	minAppProtocolVersion = 1 // oldest app protocol version supported
+	appProtocolVersion    = 1 // current app protocol version
+
+	unixAddressPrefix = "unix://" // app address prefix for unix domain sockets
+
+	roundRobinBalancing       = "round-robin"
+	leastOutstandingBalancing = "least-outstanding"
+)
+
+var (
+	errAppUnavailable = errors.New("service unavailable")
+	errAppTimeout     = errors.New("app request timed out")
+	errAppCircuitOpen = errors.New("service temporarily unavailable")
+)
+
+const (
+	appAvailable   = "available"   // accepting queries
+	appUnavailable = "unavailable" // circuit open; queries fail fast
+	appRestarting  = "restarting"  // unregistered, with queries held until it registers again
 )
 
 // AppMode represents app modes.
@@ -29,15 +68,69 @@ const (
 	broadcastMode
 )
 
-// App represents an app
+// App represents an app, served by one or more app instances (e.g. replicas of an app server).
 type App struct {
+	sync.RWMutex
 	broker    *Broker
-	client    *http.Client
-	mode      AppMode // mode
-	route     string  // route
-	addr      string  // upstream address http://host:port
-	keyID     string  // access key ID
-	keySecret string  // access key secret
+	mode      AppMode        // mode; may be changed after registration (see setMode)
+	modes     []string       // modes supported by the app, if declared
+	route     string         // route
+	routes    []string       // all routes served by the app, including route
+	balancing string         // load balancing strategy across instances
+	instances []*AppInstance // app servers upstream
+	next      uint64         // round-robin counter; accessed atomically
+	accepted  int64          // queries accepted by any instance; accessed atomically
+	failed    int64          // queries failed, timed out or rejected by the circuit breaker; accessed atomically
+	circuit   *Circuit       // circuit breaker, if enabled
+	forwards  *ForwardPool   // bounds concurrent deliveries of queries to the app, if enabled
+	info      AppInfo        // registration metadata
+}
+
+// AppInstance represents a single app server serving an app.
+type AppInstance struct {
+	transport   AppTransport
+	addr        string // upstream address http://host:port
+	keyID       string // access key ID
+	keySecret   string // access key secret
+	outstanding int64  // queries in flight; accessed atomically
+	accepted    int64  // queries accepted; accessed atomically
+	failed      int64  // queries failed or timed out; accessed atomically
+	seen        int64  // time of registration or last accepted query, in Unix nanoseconds; accessed atomically
+	info        AppInstanceInfo
+}
+
+// AppInfo represents the registration details of an app, as reported by the admin API.
+type AppInfo struct {
+	Route     string            `json:"route"`
+	Routes    []string          `json:"routes,omitempty"` // additional routes
+	Mode      string            `json:"mode"`
+	Status    string            `json:"status"`
+	Instances []AppInstanceInfo `json:"instances"`
+	Count     int               `json:"instance_count"`
+	ErrorRate float64           `json:"error_rate"`        // fraction of queries failed, across instances, past and present
+	Circuit   *CircuitStats     `json:"circuit,omitempty"` // circuit breaker, if enabled
+}
+
+// AppInstanceInfo represents the registration details of an app instance, as reported by the admin API.
+type AppInstanceInfo struct {
+	Address         string    `json:"address"`
+	Transport       string    `json:"transport"`
+	Version         string    `json:"version,omitempty"`
+	ProtocolVersion int       `json:"protocol_version"`
+	Registered      time.Time `json:"registered"`
+	Outstanding     int64     `json:"outstanding"` // queries in flight
+	Accepted        int64     `json:"accepted"`
+	Failed          int64     `json:"failed"`     // failed or timed out
+	LastSeen        time.Time `json:"last_seen"`  // registration or last accepted query
+	ErrorRate       float64   `json:"error_rate"` // fraction of queries failed
+}
+
+// AppTransport represents a means of delivering queries to an app.
+type AppTransport interface {
+	// send delivers data to the app, giving up when ctx is done. Ops streamed by the app in reply, if any,
+	// are relayed to client, if not nil.
+	send(ctx context.Context, route, clientID string, session *Session, data []byte, client *Client) error
+	close()
 }
 
 func toAppMode(mode string) AppMode {
@@ -50,34 +143,491 @@ func toAppMode(mode string) AppMode {
 	return unicastMode
 }
 
-func newApp(broker *Broker, mode, route, addr, keyID, keySecret string) *App {
+// checkAppRegistration returns an error if the app cannot be served by this server.
+func checkAppRegistration(q *RegisterApp) error {
+	if v := q.protocolVersion(); v < minAppProtocolVersion || v > appProtocolVersion {
+		return fmt.Errorf("unsupported app protocol version %d: want %d to %d", v, minAppProtocolVersion, appProtocolVersion)
+	}
+	switch q.Mode {
+	case "", "unicast", "multicast", "broadcast":
+	default:
+		return fmt.Errorf("unsupported app mode: %s", q.Mode)
+	}
+	if len(q.Modes) > 0 && !hasString(q.Modes, q.mode()) {
+		return fmt.Errorf("app mode %s not in app's supported modes %s", q.mode(), strings.Join(q.Modes, ", "))
+	}
+	if !strings.HasPrefix(q.Route, "/") {
+		return fmt.Errorf("bad app route: %s", q.Route)
+	}
+	for _, route := range q.Routes {
+		if !strings.HasPrefix(route, "/") || route == q.Route {
+			return fmt.Errorf("bad app route: %s", route)
+		}
+	}
+	if err := checkAppSchedules(q.Schedules); err != nil {
+		return fmt.Errorf("bad app schedule: %v", err)
+	}
+	return nil
+}
+
+func (q *RegisterApp) mode() string {
+	if len(q.Mode) == 0 {
+		return "unicast"
+	}
+	return q.Mode
+}
+
+func (q *RegisterApp) protocolVersion() int {
+	if q.ProtocolVersion == 0 { // apps predating protocol versions
+		return 1
+	}
+	return q.ProtocolVersion
+}
+
+func hasString(xs []string, x string) bool {
+	for _, s := range xs {
+		if s == x {
+			return true
+		}
+	}
+	return false
+}
+
+// newApp creates an app serving the given routes on the site (see Tenancy), the first being the app's main route.
+func newApp(broker *Broker, routes []string, q *RegisterApp, instance *AppInstance, balancing string) *App {
 	return &App{
-		broker,
-		&http.Client{}, // TODO tune keep-alive and idle timeout
-		toAppMode(mode),
-		route,
-		addr,
-		keyID,
-		keySecret,
+		broker:    broker,
+		mode:      toAppMode(q.Mode),
+		modes:     q.Modes,
+		route:     routes[0],
+		routes:    routes,
+		balancing: balancing,
+		instances: []*AppInstance{instance},
+		circuit:   newCircuit(broker.appCircuit.Failures, broker.appCircuit.Cooldown),
+		forwards:  newForwardPool(broker.appWorkers),
+		info:      AppInfo{Route: q.Route, Routes: q.Routes, Mode: q.mode()},
+	}
+}
+
+func newAppInstance(q *RegisterApp) (*AppInstance, error) {
+	var t AppTransport
+	switch q.Transport {
+	case "", httpTransport:
+		t = newHTTPAppTransport(q.Address, q.authorization(), false)
+	case h2cTransport:
+		t = newHTTPAppTransport(q.Address, q.authorization(), true)
+	case grpcTransport:
+		var err error
+		if t, err = newGRPCAppTransport(q.Address, q.authorization()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported app transport: %s", q.Transport)
+	}
+	transport := q.Transport
+	if len(transport) == 0 {
+		transport = httpTransport
+	}
+	now := time.Now().UTC()
+	return &AppInstance{
+		transport: t,
+		addr:      q.Address,
+		keyID:     q.KeyID,
+		keySecret: q.KeySecret,
+		seen:      now.UnixNano(),
+		info:      AppInstanceInfo{q.Address, transport, q.Version, q.protocolVersion(), now, 0, 0, 0, now, 0},
+	}, nil
+}
+
+// authorization returns the authorization header value for queries to the app: its app token, if registered
+// with one, else its access key.
+func (q *RegisterApp) authorization() string {
+	if len(q.token) > 0 {
+		return "Bearer " + q.token
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(q.KeyID+":"+q.KeySecret))
+}
+
+// isLocalAppAddress returns true if an app address is a unix domain socket or a loopback address.
+func isLocalAppAddress(addr string) bool {
+	if strings.HasPrefix(addr, unixAddressPrefix) {
+		return true
+	}
+	var host string
+	if u, err := url.Parse(addr); err == nil && len(u.Host) > 0 { // http://host:port/...
+		host = u.Hostname()
+	} else if h, _, err := net.SplitHostPort(strings.TrimPrefix(addr, "grpc://")); err == nil { // host:port
+		host = h
 	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// accepts returns true if the registration is for another instance of this app, i.e. with the same mode and routes.
+func (app *App) accepts(routes []string, q *RegisterApp) bool {
+	if toAppMode(q.Mode) != app.getMode() || len(routes) != len(app.routes) {
+		return false
+	}
+	for i, route := range routes {
+		if route != app.routes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// addInstance adds an instance to the app, replacing any instance at the same address (e.g. a restarted app server),
+// in which case it returns true.
+func (app *App) addInstance(instance *AppInstance) bool {
+	app.Lock()
+	var prev *AppInstance
+	for i, x := range app.instances {
+		if x.addr == instance.addr {
+			prev, app.instances[i] = x, instance
+			break
+		}
+	}
+	if prev == nil {
+		app.instances = append(app.instances, instance)
+	}
+	app.Unlock()
+	if prev != nil {
+		prev.transport.close()
+	}
+	return prev != nil
 }
 
-func (app *App) forward(clientID string, session *Session, data []byte) {
-	if err := app.send(clientID, session, data); err != nil {
-		echo(Log{"t": "app", "route": app.route, "host": app.addr, "error": err.Error()})
-		app.broker.dropApp(app.route)
+// dropInstance removes the instance at addr, if any, and returns the number of instances remaining.
+func (app *App) dropInstance(addr string) int {
+	app.Lock()
+	var dropped *AppInstance
+	for i, x := range app.instances {
+		if x.addr == addr {
+			dropped = x
+			app.instances = append(app.instances[:i:i], app.instances[i+1:]...)
+			break
+		}
 	}
+	n := len(app.instances)
+	app.Unlock()
+	if dropped != nil {
+		dropped.transport.close()
+	}
+	return n
+}
+
+// getMode returns the app's current mode.
+func (app *App) getMode() AppMode {
+	app.RLock()
+	defer app.RUnlock()
+	return app.mode
 }
 
-func (app *App) send(clientID string, session *Session, data []byte) error {
-	req, err := http.NewRequest("POST", app.addr, bytes.NewReader(data))
+// setMode changes the app's mode, returning the previous mode.
+func (app *App) setMode(mode string) (AppMode, error) {
+	switch mode {
+	case "unicast", "multicast", "broadcast":
+	default:
+		return 0, fmt.Errorf("unsupported app mode: %s", mode)
+	}
+	app.Lock()
+	defer app.Unlock()
+	if len(app.modes) > 0 && !hasString(app.modes, mode) {
+		return 0, fmt.Errorf("app mode %s not in app's supported modes %s", mode, strings.Join(app.modes, ", "))
+	}
+	prev := app.mode
+	app.mode, app.info.Mode = toAppMode(mode), mode
+	return prev, nil
+}
+
+// affinity returns the key used to pin queries to instances: the client ID for unicast apps,
+// the user for multicast apps, and none for broadcast apps, which hold no per-client state.
+func (app *App) affinity(clientID string, session *Session) string {
+	switch app.getMode() {
+	case unicastMode:
+		return clientID
+	case multicastMode:
+		return session.subject
+	}
+	return ""
+}
+
+// pick returns the instance to send the next query to, skipping excluded instances, or nil if there are none.
+//
+// If key is set, the instance is picked by rendezvous hashing, so that the same key always lands on the same
+// instance, and only the keys pinned to an instance are re-pinned (spread over the rest) when that instance goes away.
+// Else, the instance is picked according to the app's load balancing strategy.
+func (app *App) pick(key string, exclude map[*AppInstance]bool) *AppInstance {
+	app.RLock()
+	defer app.RUnlock()
+	n := len(app.instances)
+	if n == 0 {
+		return nil
+	}
+	if len(key) > 0 {
+		var (
+			best  *AppInstance
+			score uint64
+		)
+		for _, x := range app.instances {
+			if exclude[x] {
+				continue
+			}
+			if h := rendezvousHash(key, x.addr); best == nil || h > score {
+				best, score = x, h
+			}
+		}
+		return best
+	}
+	start := int(atomic.AddUint64(&app.next, 1) % uint64(n))
+	var best *AppInstance
+	for i := 0; i < n; i++ {
+		x := app.instances[(start+i)%n]
+		if exclude[x] {
+			continue
+		}
+		if app.balancing != leastOutstandingBalancing {
+			return x
+		}
+		if best == nil || atomic.LoadInt64(&x.outstanding) < atomic.LoadInt64(&best.outstanding) {
+			best = x
+		}
+	}
+	return best
+}
+
+// close closes all the app's instances.
+func (app *App) close() {
+	app.Lock()
+	instances := app.instances
+	app.instances = nil
+	app.Unlock()
+	for _, x := range instances {
+		x.transport.close()
+	}
+}
+
+// stat returns the app's registration details.
+func (app *App) stat() AppInfo {
+	app.RLock()
+	defer app.RUnlock()
+	info := app.info
+	info.Status = appAvailable
+	info.Circuit = app.circuit.stats()
+	if info.Circuit != nil && info.Circuit.State == circuitOpen {
+		info.Status = appUnavailable
+	}
+	info.Instances = make([]AppInstanceInfo, len(app.instances))
+	info.Count = len(app.instances)
+	for i, x := range app.instances {
+		xi := &info.Instances[i]
+		*xi = x.info
+		xi.Outstanding = atomic.LoadInt64(&x.outstanding)
+		xi.Accepted, xi.Failed = atomic.LoadInt64(&x.accepted), atomic.LoadInt64(&x.failed)
+		xi.LastSeen = time.Unix(0, atomic.LoadInt64(&x.seen)).UTC()
+		xi.ErrorRate = errorRate(xi.Accepted, xi.Failed)
+	}
+	info.ErrorRate = errorRate(atomic.LoadInt64(&app.accepted), atomic.LoadInt64(&app.failed))
+	return info
+}
+
+func errorRate(accepted, failed int64) float64 {
+	if n := accepted + failed; n > 0 {
+		return float64(failed) / float64(n)
+	}
+	return 0
+}
+
+// forward sends data to one of the app's instances on behalf of a client, for the given route (as known to the app),
+// giving up when ctx is done. Fails fast if the app's circuit breaker is open.
+func (app *App) forward(ctx context.Context, route, clientID string, session *Session, data []byte, client *Client) error {
+	if !app.circuit.allow(time.Now()) {
+		atomic.AddInt64(&app.failed, 1)
+		return errAppCircuitOpen
+	}
+	ctx, span := startSpan(ctx, "wave.app.forward", spanClient)
+	span.set("wave.app", app.route)
+	span.set("wave.route", route)
+	start := time.Now()
+	err := app.deliver(ctx, route, clientID, session, data, client)
+	elapsed := time.Since(start)
+	metrics.appLatency.observe(app.route, elapsed)
+	metrics.routes.query(app.route, elapsed)
+	span.fail(err)
+	span.finish()
+	if err == context.Canceled {
+		app.circuit.release()
+		return err
+	}
+	if err == nil {
+		atomic.AddInt64(&app.accepted, 1)
+	} else {
+		atomic.AddInt64(&app.failed, 1)
+	}
+	if state, changed := app.circuit.record(err == nil, time.Now()); changed {
+		echo(Log{"t": "app_circuit", "route": app.route, "state": state})
+	}
+	return err
+}
+
+// checkSlow logs and counts a query the app instance took longer than the slow query threshold to accept.
+func (app *App) checkSlow(x *AppInstance, route, clientID string, size int, elapsed time.Duration, err error) {
+	if threshold := app.broker.appSlowQuery; threshold <= 0 || elapsed <= threshold {
+		return
+	}
+	metrics.slowQueries.inc(app.route)
+	m := Log{"t": "app_slow", "route": route, "app": app.route, "host": x.addr, "client": clientID, "bytes": strconv.Itoa(size), "duration": elapsed.String()}
+	if err != nil {
+		m["error"] = err.Error()
+	}
+	echoWarn(m)
+}
+
+// deliver sends data to one of the app's instances. Instances that fail are dropped, and the data is sent to
+// the next instance, if any.
+func (app *App) deliver(ctx context.Context, route, clientID string, session *Session, data []byte, client *Client) error {
+	key := app.affinity(clientID, session)
+	tried := make(map[*AppInstance]bool)
+	for {
+		x := app.pick(key, tried)
+		if x == nil {
+			return errAppUnavailable
+		}
+		tried[x] = true
+		start := time.Now()
+		err := x.send(ctx, route, clientID, session, data, client)
+		app.checkSlow(x, route, clientID, len(data), time.Since(start), err)
+		if err == nil {
+			return nil
+		}
+		switch ctx.Err() {
+		case context.DeadlineExceeded: // slow, but not necessarily dead
+			echoWarn(Log{"t": "app_timeout", "route": app.route, "host": x.addr, "client": clientID})
+			return errAppTimeout
+		case context.Canceled: // client went away
+			return ctx.Err()
+		}
+		echoError(Log{"t": "app", "route": app.route, "host": x.addr, "error": err.Error()})
+		if app.dropInstance(x.addr) == 0 {
+			app.broker.removeApp(app)
+			return errAppUnavailable
+		}
+	}
+}
+
+// broadcast sends data to all of the app's instances, e.g. to notify each of them of a logout.
+func (app *App) broadcast(route, clientID string, session *Session, data []byte) {
+	app.RLock()
+	instances := append([]*AppInstance(nil), app.instances...)
+	app.RUnlock()
+	for _, x := range instances {
+		ctx, cancel := app.broker.appContext(context.Background())
+		if err := x.send(ctx, route, clientID, session, data, nil); err != nil {
+			echoError(Log{"t": "app", "route": app.route, "host": x.addr, "error": err.Error()})
+		}
+		cancel()
+	}
+}
+
+func rendezvousHash(key, addr string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(addr))
+	x := h.Sum64() // FNV alone spreads similar inputs (e.g. addresses differing by port) poorly; mix.
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (x *AppInstance) send(ctx context.Context, route, clientID string, session *Session, data []byte, client *Client) error {
+	atomic.AddInt64(&x.outstanding, 1)
+	defer atomic.AddInt64(&x.outstanding, -1)
+	err := x.transport.send(ctx, route, clientID, session, data, client)
+	switch {
+	case err == nil:
+		atomic.AddInt64(&x.accepted, 1)
+		atomic.StoreInt64(&x.seen, time.Now().UnixNano())
+	case ctx.Err() != context.Canceled: // not the app's fault if the client went away
+		atomic.AddInt64(&x.failed, 1)
+	}
+	return err
+}
+
+// HTTPAppTransport delivers each query to an app as an HTTP POST request.
+type HTTPAppTransport struct {
+	client *http.Client
+	addr   string
+	auth   string // authorization header
+}
+
+// newHTTPAppTransport returns a transport to the app at addr. If h2c is set, queries are sent over HTTP/2 without TLS,
+// with prior knowledge, so that concurrent queries share a single connection instead of each needing its own.
+func newHTTPAppTransport(addr, auth string, h2c bool) *HTTPAppTransport {
+	client := &http.Client{} // TODO tune keep-alive and idle timeout
+	network, dialAddr := "tcp", ""
+	if strings.HasPrefix(addr, unixAddressPrefix) {
+		network, dialAddr = "unix", strings.TrimPrefix(addr, unixAddressPrefix)
+		addr = "http://unix/"
+	}
+	switch {
+	case h2c:
+		client.Transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(_, addr string, _ *tls.Config) (net.Conn, error) {
+				if len(dialAddr) > 0 {
+					addr = dialAddr
+				}
+				return net.Dial(network, addr)
+			},
+		}
+	case network == "unix":
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, dialAddr)
+			},
+		}
+	}
+	return &HTTPAppTransport{
+		client,
+		addr,
+		auth,
+	}
+}
+
+func (t *HTTPAppTransport) send(ctx context.Context, route, clientID string, session *Session, data []byte, client *Client) error {
+	// ctx bounds the wait for the app's response; a streamed response can outlive ctx, until the client disconnects.
+	reqCtx, cancel := context.WithCancel(client.context(ctx))
+	answered := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-answered:
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(reqCtx, "POST", t.addr, bytes.NewReader(data))
 	if err != nil {
+		close(answered)
+		cancel()
 		return fmt.Errorf("failed creating request: %v", err)
 	}
 
-	req.SetBasicAuth(app.keyID, app.keySecret)
+	req.Header.Set("Authorization", t.auth)
 
 	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Wave-Route", route)
+	if tp := traceParent(ctx); len(tp) > 0 {
+		req.Header.Set(traceParentHeader, tp)
+	}
 	if len(clientID) > 0 {
 		req.Header.Set("Wave-Client-ID", clientID)
 	}
@@ -89,16 +639,60 @@ func (app *App) send(clientID string, session *Session, data []byte) error {
 		req.Header.Set("Wave-Session-ID", session.id)
 	}
 
-	resp, err := app.client.Do(req)
+	resp, err := t.client.Do(req)
+	close(answered)
 	if err != nil {
+		cancel()
 		return fmt.Errorf("request failed: %v", err)
 	}
-	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		cancel()
 		return fmt.Errorf("request failed: %s", http.StatusText(resp.StatusCode))
 	}
-	if _, err := readWithLimit(resp.Body, 0); err != nil { // apps always return empty plain-text responses.
+	if client != nil && isAppStream(resp.Header.Get("Content-Type")) {
+		go func() {
+			defer cancel()
+			defer resp.Body.Close()
+			relayAppStream(resp.Body, client)
+		}()
+		return nil
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if _, err := readWithLimit(resp.Body, 0); err != nil { // unless streaming, apps return empty plain-text responses.
 		return fmt.Errorf("failed reading response: %v", err)
 	}
 	return nil
 }
+
+// isAppStream returns true if an app's response is a stream of ops, one JSON object per line.
+func isAppStream(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == contentTypeNDJSON
+}
+
+// relayAppStream relays ops streamed by an app to a client, until the stream ends or the client disconnects.
+func relayAppStream(r io.Reader, client *Client) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxMessageSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := client.relay(line); err != nil {
+			if err == errClientGone {
+				return
+			}
+			echoError(client.fields(Log{"t": "app_stream", "error": err.Error()}))
+		}
+	}
+	if err := scanner.Err(); err != nil && client.ctx.Err() == nil {
+		echoError(client.fields(Log{"t": "app_stream", "error": err.Error()}))
+	}
+}
+
+func (t *HTTPAppTransport) close() {
+	t.client.CloseIdleConnections()
+}
@@ -0,0 +1,216 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	httpTransport = "http"
+	h2cTransport  = "h2c" // HTTP/2 without TLS, multiplexing queries over one connection
+	grpcTransport = "grpc"
+
+	grpcAppStreamMethod = "/wave.App/Connect"
+
+	grpcTLSPrefix = "grpcs://" // address prefix of apps serving gRPC over TLS
+)
+
+var errAppStreamClosed = errors.New("app stream closed")
+
+var grpcAppStreamDesc = &grpc.StreamDesc{StreamName: "Connect", ServerStreams: true, ClientStreams: true}
+
+// grpcJSONCodec marshals gRPC messages as JSON, so that apps need no generated protobuf code.
+// Messages are sent with the content-type "application/grpc+json".
+type grpcJSONCodec struct{}
+
+func (grpcJSONCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (grpcJSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (grpcJSONCodec) Name() string                               { return "json" }
+
+// AppQueryD represents a query sent to an app over gRPC; the equivalent of the HTTP transport's request and headers.
+type AppQueryD struct {
+	Route        string          `json:"route"`
+	ClientID     string          `json:"client_id,omitempty"`
+	SubjectID    string          `json:"subject_id"`
+	Username     string          `json:"username"`
+	AccessToken  string          `json:"access_token,omitempty"`
+	RefreshToken string          `json:"refresh_token,omitempty"`
+	SessionID    string          `json:"session_id,omitempty"`
+	TraceParent  string          `json:"traceparent,omitempty"` // W3C trace context, if traced
+	Data         json.RawMessage `json:"data"`
+}
+
+// AppReplyD represents a message sent by an app over gRPC.
+type AppReplyD struct {
+	ClientID string          `json:"client_id,omitempty"` // client to relay ops to
+	Ops      json.RawMessage `json:"ops,omitempty"`       // ops streamed in reply to a query from the client
+	Error    string          `json:"error,omitempty"`
+}
+
+// GRPCAppTransport delivers queries to an app over a single, long-lived, bidirectional gRPC stream
+// (wave.App/Connect), avoiding the overhead of an HTTP request per query.
+// The stream is opened on the first query, and re-opened on the next query after it fails.
+type GRPCAppTransport struct {
+	sync.Mutex
+	conn    *grpc.ClientConn
+	auth    string // authorization metadata
+	stream  grpc.ClientStream
+	cancel  context.CancelFunc
+	clients map[string]*Client // client id => connected client that sent queries, for relaying ops
+}
+
+// newGRPCAppTransport returns a transport to the app at addr ("host:port" or "grpc://host:port" without TLS,
+// "grpcs://host:port" with TLS). Since queries carry the app's credentials and users' tokens, apps are reached
+// without TLS only at loopback addresses.
+func newGRPCAppTransport(addr, auth string) (*GRPCAppTransport, error) {
+	security := grpc.WithInsecure()
+	if strings.HasPrefix(addr, grpcTLSPrefix) {
+		security = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+	} else if !isLocalAppAddress(addr) {
+		return nil, fmt.Errorf("app address not local: %s; use %shost:port to reach the app over TLS", addr, grpcTLSPrefix)
+	}
+	conn, err := grpc.Dial(
+		strings.TrimPrefix(strings.TrimPrefix(addr, grpcTLSPrefix), "grpc://"),
+		security,
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcJSONCodec{})),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed dialing app: %v", err)
+	}
+	return &GRPCAppTransport{conn: conn, auth: auth, clients: make(map[string]*Client)}, nil
+}
+
+// open returns the current stream, opening one if necessary; must be called under lock.
+func (t *GRPCAppTransport) open() (grpc.ClientStream, error) {
+	if t.stream != nil {
+		return t.stream, nil
+	}
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(context.Background(), "authorization", t.auth))
+	stream, err := t.conn.NewStream(ctx, grpcAppStreamDesc, grpcAppStreamMethod)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed opening stream: %v", err)
+	}
+	t.stream, t.cancel = stream, cancel
+	go t.receive(stream)
+	return stream, nil
+}
+
+// receive reads replies from the app until the stream closes.
+func (t *GRPCAppTransport) receive(stream grpc.ClientStream) {
+	for {
+		var reply AppReplyD
+		if err := stream.RecvMsg(&reply); err != nil {
+			if err != io.EOF {
+				echoError(Log{"t": "app_stream", "error": err.Error()})
+			}
+			t.reset(stream)
+			return
+		}
+		if len(reply.Error) > 0 {
+			echoError(Log{"t": "app_stream", "error": reply.Error})
+		}
+		if len(reply.Ops) > 0 {
+			t.Lock()
+			client := t.clients[reply.ClientID]
+			t.Unlock()
+			if client == nil {
+				continue // disconnected
+			}
+			if err := client.relay(reply.Ops); err != nil && err != errClientGone {
+				echoError(Log{"t": "app_stream", "client": reply.ClientID, "error": err.Error()})
+			}
+		}
+	}
+}
+
+// track remembers a client that sent a query until the client disconnects, so that ops can be relayed to it;
+// must be called under lock.
+func (t *GRPCAppTransport) track(client *Client) {
+	if _, ok := t.clients[client.id]; ok {
+		return
+	}
+	t.clients[client.id] = client
+	go func() {
+		<-client.ctx.Done()
+		t.Lock()
+		delete(t.clients, client.id)
+		t.Unlock()
+	}()
+}
+
+// reset discards the stream, if current, so that the next query opens a new one.
+func (t *GRPCAppTransport) reset(stream grpc.ClientStream) {
+	t.Lock()
+	defer t.Unlock()
+	if t.stream == stream {
+		t.cancel()
+		t.stream, t.cancel = nil, nil
+	}
+}
+
+func (t *GRPCAppTransport) send(ctx context.Context, route, clientID string, session *Session, data []byte, client *Client) error {
+	if err := ctx.Err(); err != nil { // messages are written to the stream without blocking on the app
+		return err
+	}
+	q := AppQueryD{Route: route, ClientID: clientID, SubjectID: session.subject, Username: session.username, TraceParent: traceParent(ctx), Data: data}
+	if session.subject != anon {
+		q.AccessToken, q.RefreshToken, q.SessionID = session.token.AccessToken, session.token.RefreshToken, session.id
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if t.conn == nil {
+		return errAppStreamClosed
+	}
+	stream, err := t.open()
+	if err != nil {
+		return err
+	}
+	if client != nil {
+		t.track(client)
+	}
+	if err := stream.SendMsg(&q); err != nil {
+		t.cancel()
+		t.stream, t.cancel = nil, nil
+		return fmt.Errorf("failed sending query: %v", err)
+	}
+	return nil
+}
+
+func (t *GRPCAppTransport) close() {
+	t.Lock()
+	defer t.Unlock()
+	if t.cancel != nil {
+		t.cancel()
+		t.stream, t.cancel = nil, nil
+	}
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
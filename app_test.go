@@ -0,0 +1,337 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestAppAffinity(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	app := &App{mode: unicastMode}
+	for i := 0; i < 4; i++ {
+		app.instances = append(app.instances, &AppInstance{addr: "http://127.0.0.1:" + strconv.Itoa(8000+i)})
+	}
+
+	const clients = 1000
+	pins := make(map[string]*AppInstance)
+	counts := make(map[*AppInstance]int)
+	for i := 0; i < clients; i++ {
+		id := strconv.Itoa(i)
+		x := app.pick(id, nil)
+		pins[id] = x
+		counts[x]++
+		eq(app.pick(id, nil), x) // sticky
+	}
+	for _, x := range app.instances {
+		ok(counts[x] > clients/8) // roughly balanced
+	}
+
+	gone := app.instances[1]
+	app.instances = append(app.instances[:1:1], app.instances[2:]...)
+	for id, x := range pins {
+		y := app.pick(id, nil)
+		if x == gone {
+			ok(y != gone) // re-pinned
+		} else {
+			eq(y, x) // others unaffected
+		}
+	}
+
+	eq(app.affinity("client", &Session{subject: "user"}), "client")
+	app.mode = multicastMode
+	eq(app.affinity("client", &Session{subject: "user"}), "user")
+	app.mode = broadcastMode
+	eq(app.affinity("client", &Session{subject: "user"}), "")
+}
+
+func TestAppReregistration(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	broker := newBroker(newSite(), false, true, true)
+	register := func(addr string) {
+		no(broker.addApp("", &RegisterApp{Route: "/demo", Address: addr}))
+	}
+	resets := func() int {
+		n := 0
+		for {
+			select {
+			case pub := <-broker.publish:
+				if pub.route == "/demo" && string(pub.data) == string(resetMsg) {
+					n++
+				}
+			default:
+				return n
+			}
+		}
+	}
+
+	register("http://127.0.0.1:8000")
+	eq(resets(), 1) // browsers reload, to start over with the app
+	register("http://127.0.0.1:8001")
+	eq(resets(), 0) // another instance: clients served by the first are unaffected
+	eq(len(broker.getApp("/demo").instances), 2)
+	register("http://127.0.0.1:8000")
+	eq(resets(), 1) // restarted instance
+	eq(len(broker.getApp("/demo").instances), 2)
+	broker.dropApp("/demo")
+}
+
+func TestAppRegistration(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	for _, q := range []RegisterApp{
+		{Route: "/demo"},
+		{Route: "/demo", Mode: "broadcast", Modes: []string{"multicast", "broadcast"}},
+		{Route: "/demo", Modes: []string{"unicast"}, ProtocolVersion: appProtocolVersion},
+		{Route: "/demo", Routes: []string{"/demo/admin", "/other"}},
+	} {
+		no(checkAppRegistration(&q))
+	}
+	for _, q := range []RegisterApp{
+		{Route: "demo"},
+		{Route: "/demo", Mode: "anycast"},
+		{Route: "/demo", Modes: []string{"broadcast"}}, // defaults to unicast
+		{Route: "/demo", ProtocolVersion: appProtocolVersion + 1},
+		{Route: "/demo", Routes: []string{"other"}},
+		{Route: "/demo", Routes: []string{"/demo"}},
+	} {
+		ok(checkAppRegistration(&q) != nil, q)
+	}
+}
+
+func TestAppRoutes(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	broker := newBroker(newSite(), false, true, true)
+	routes := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes <- r.Header.Get("Wave-Route")
+	}))
+	defer server.Close()
+
+	no(broker.addApp("", &RegisterApp{Route: "/demo", Routes: []string{"/demo/admin", "/help"}, Address: server.URL, Mode: "multicast", Version: "1.2.0"}))
+	app := broker.getApp("/demo")
+	ok(broker.getApp("/demo/admin") == app, "additional route")
+	ok(broker.getApp("/help") == app, "additional route")
+	no(app.forward(context.Background(), "/demo/admin", "client", anonymous, []byte("{}"), nil))
+	eq(<-routes, "/demo/admin") // apps are told which of their routes a query is for
+
+	infos := broker.appInfos()
+	eq(len(infos), 1)
+	eq(infos[0].Route, "/demo")
+	eq(infos[0].Routes, []string{"/demo/admin", "/help"})
+	eq(infos[0].Mode, "multicast")
+	eq(len(infos[0].Instances), 1)
+	eq(infos[0].Instances[0].Transport, httpTransport)
+	eq(infos[0].Instances[0].Version, "1.2.0")
+	eq(infos[0].Instances[0].ProtocolVersion, 1)
+
+	no(broker.addApp("", &RegisterApp{Route: "/help", Address: "http://127.0.0.1:8001"})) // takes over a route
+	ok(broker.getApp("/help") != app, "taken over")
+	infos = broker.appInfos()
+	eq(len(infos), 2)
+	eq(infos[0].Routes, []string{"/demo/admin"})
+	eq(infos[1].Route, "/help")
+
+	no(broker.addApp("acme", &RegisterApp{Route: "/demo", Address: "http://127.0.0.1:8002"}))
+	ok(broker.getApp(tenantRoute("acme", "/demo")) != nil, "tenant's app")
+	ok(broker.getApp("/demo") == app, "other tenants unaffected")
+	ok(broker.addApp("", &RegisterApp{Route: "/bad", Mode: "anycast", Address: "http://127.0.0.1:8003"}) != nil, "refused")
+	ok(broker.getApp("/bad") == nil, "not registered")
+
+	for _, route := range []string{"/demo", "/help", tenantRoute("acme", "/demo")} {
+		broker.dropApp(route)
+	}
+}
+
+func TestAppTimeout(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	broker := newBroker(newSite(), false, true, true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Wave-Route") == "/slow" {
+			ioutil.ReadAll(r.Body) // else disconnects go unnoticed
+			<-r.Context().Done()   // until abandoned
+		}
+	}))
+	no(broker.addApp("", &RegisterApp{Route: "/demo", Address: server.URL}))
+	app := broker.getApp("/demo")
+	forward := func(ctx context.Context, route string) error {
+		return app.forward(ctx, route, "client", anonymous, []byte("{}"), nil)
+	}
+
+	ctx, cancel := broker.appContext(context.Background()) // no timeout
+	no(forward(ctx, "/demo"))
+	cancel()
+
+	broker.appTimeout = 50 * time.Millisecond
+	ctx, cancel = broker.appContext(context.Background())
+	eq(forward(ctx, "/slow"), errAppTimeout)
+	cancel()
+	ok(broker.getApp("/demo") == app, "slow apps are not dropped")
+
+	broker.appTimeout = 0
+	ctx, cancel = broker.appContext(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel) // client went away
+	eq(forward(ctx, "/slow"), context.Canceled)
+	ok(broker.getApp("/demo") == app, "not dropped")
+
+	broker.appTimeout = 50 * time.Millisecond
+	c := newClient("192.0.2.1", nil, anonymous, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	c.start()
+	c.forward(app, "/slow", []byte("{}"), nil)
+	select {
+	case msg := <-c.data:
+		eq(string(msg), `{"e":"app_timeout","x":"app request timed out"}`) // the page is left in place
+	case <-time.After(time.Second):
+		t.Fatal("timeout not reported")
+	}
+	app.circuit = newCircuit(1, time.Hour)
+	app.circuit.record(false, time.Now()) // trips
+	c.forward(app, "/demo", []byte("{}"), nil)
+	select {
+	case msg := <-c.data:
+		eq(string(msg), `{"e":"app_unavailable","x":"service temporarily unavailable"}`)
+	case <-time.After(time.Second):
+		t.Fatal("open circuit not reported")
+	}
+	app.circuit = nil
+	c.cancel()
+	broker.appTimeout = 0
+
+	server.Close()
+	ctx, cancel = broker.appContext(context.Background())
+	eq(forward(ctx, "/demo"), errAppUnavailable)
+	cancel()
+	ok(broker.getApp("/demo") == nil, "dead apps are dropped")
+}
+
+func TestAppStream(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	next, abandoned := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", contentTypeNDJSON+"; charset=utf-8")
+		w.Write([]byte(`{"e":"first"}` + "\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-next:
+		case <-r.Context().Done(): // client went away
+			close(abandoned)
+			return
+		}
+		w.Write([]byte("\nnot json\n" + `{"e":"second"}` + "\n"))
+	}))
+	defer server.Close()
+	broker := newBroker(newSite(), false, true, true)
+	c := newClient("192.0.2.1", nil, anonymous, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	x := newHTTPAppTransport(server.URL, "", false)
+	defer x.close()
+	received := func() string {
+		select {
+		case msg := <-c.data:
+			var ops OpsD
+			no(json.Unmarshal(msg, &ops))
+			return ops.E
+		case <-time.After(time.Second):
+			return "nothing"
+		}
+	}
+
+	no(x.send(context.Background(), "/demo", c.id, anonymous, []byte("{}"), c)) // returns once the app starts streaming
+	eq(received(), "first")
+	next <- struct{}{}
+	eq(received(), "second") // bad and blank lines skipped
+
+	no(x.send(context.Background(), "/demo", c.id, anonymous, []byte("{}"), c))
+	eq(received(), "first")
+	c.cancel() // abandons the stream
+	select {
+	case <-abandoned:
+	case <-time.After(time.Second):
+		t.Fatal("stream not abandoned")
+	}
+	ok(len(c.data) == 0, "nothing relayed after disconnecting")
+}
+
+func TestSlowQueries(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	broker := newBroker(newSite(), false, true, true)
+	app := &App{broker: broker, route: "/slow"}
+	x := &AppInstance{addr: "http://127.0.0.1:8000"}
+	count := func() uint64 {
+		metrics.slowQueries.Lock()
+		defer metrics.slowQueries.Unlock()
+		return metrics.slowQueries.values["/slow"]
+	}
+
+	app.checkSlow(x, "/slow", "client", 10, time.Second, nil) // disabled
+	eq(count(), uint64(0))
+
+	broker.appSlowQuery = 500 * time.Millisecond
+	app.checkSlow(x, "/slow", "client", 10, 100*time.Millisecond, nil)
+	eq(count(), uint64(0))
+	app.checkSlow(x, "/slow", "client", 10, time.Second, nil)
+	app.checkSlow(x, "/slow", "client", 10, time.Second, errAppTimeout)
+	eq(count(), uint64(2))
+	metrics.slowQueries.drop("/slow")
+}
+
+func TestGRPCAppAddress(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	for _, addr := range []string{"127.0.0.1:8000", "grpc://localhost:8000", "grpcs://10.0.0.1:8000"} {
+		x, err := newAppInstance(&RegisterApp{Address: addr, Transport: grpcTransport})
+		no(err)
+		x.transport.close()
+	}
+	_, err := newAppInstance(&RegisterApp{Address: "10.0.0.1:8000", Transport: grpcTransport})
+	ok(err != nil, "plaintext gRPC to a remote address")
+}
+
+func TestIsLocalAppAddress(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	ok(isLocalAppAddress("unix:///tmp/app.sock"))
+	ok(isLocalAppAddress("http://127.0.0.1:8000"))
+	ok(isLocalAppAddress("http://localhost:8000/"))
+	ok(isLocalAppAddress("http://[::1]:8000"))
+	ok(isLocalAppAddress("127.0.0.1:8000"))
+	ok(isLocalAppAddress("grpc://localhost:8000"))
+	ok(!isLocalAppAddress("http://10.0.0.1:8000"))
+	ok(!isLocalAppAddress("http://example.com"))
+	ok(!isLocalAppAddress("10.0.0.1:8000"))
+	ok(!isLocalAppAddress(""))
+}
+
+func TestH2CAppTransport(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	protos := make(chan int, 1)
+	app := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.ProtoMajor
+	}), &http2.Server{}))
+	defer app.Close()
+
+	x := newHTTPAppTransport(app.URL, "", true)
+	defer x.close()
+	no(x.send(context.Background(), "/demo", "client", anonymous, []byte("{}"), nil))
+	eq(<-protos, 2)
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"sync"
+	"time"
+)
+
+// QueryBuffer holds queries to routes whose apps have gone away, for a limited time, so that queries
+// sent while an app restarts (e.g. during a deploy) can be delivered once it registers again.
+type QueryBuffer struct {
+	sync.Mutex
+	size   int                       // max queries held per route
+	wait   time.Duration             // max time to wait for an app to register again
+	routes map[string]*BufferedRoute // route => pending queries
+}
+
+// BufferedRoute represents a route waiting for its app to register again.
+type BufferedRoute struct {
+	queries []BufferedQuery
+	timer   *time.Timer
+}
+
+// BufferedQuery represents a query held on behalf of a client.
+type BufferedQuery struct {
+	client *Client
+	data   []byte
+}
+
+// newQueryBuffer creates a query buffer, or nil (no buffering) if wait or size is 0.
+func newQueryBuffer(size int, wait time.Duration) *QueryBuffer {
+	if size <= 0 || wait <= 0 {
+		return nil
+	}
+	return &QueryBuffer{size: size, wait: wait, routes: make(map[string]*BufferedRoute)}
+}
+
+// open starts holding queries to route, calling expire if no app registers at route in time.
+// Safe to call on a nil buffer.
+func (qb *QueryBuffer) open(route string, expire func(dropped int)) {
+	if qb == nil {
+		return
+	}
+	qb.Lock()
+	defer qb.Unlock()
+	if _, ok := qb.routes[route]; ok {
+		return
+	}
+	br := &BufferedRoute{}
+	br.timer = time.AfterFunc(qb.wait, func() {
+		qb.Lock()
+		if qb.routes[route] != br { // app registered again
+			qb.Unlock()
+			return
+		}
+		delete(qb.routes, route)
+		qb.Unlock()
+		expire(len(br.queries))
+	})
+	qb.routes[route] = br
+}
+
+// waiting returns true if queries to route are being held. Safe to call on a nil buffer.
+func (qb *QueryBuffer) waiting(route string) bool {
+	if qb == nil {
+		return false
+	}
+	qb.Lock()
+	defer qb.Unlock()
+	_, ok := qb.routes[route]
+	return ok
+}
+
+// hold holds a query to route, returning false if route is not being held or its queue is full.
+// Safe to call on a nil buffer.
+func (qb *QueryBuffer) hold(route string, client *Client, data []byte) bool {
+	if qb == nil {
+		return false
+	}
+	qb.Lock()
+	defer qb.Unlock()
+	br, ok := qb.routes[route]
+	if !ok || len(br.queries) >= qb.size {
+		return false
+	}
+	br.queries = append(br.queries, BufferedQuery{client, data})
+	return true
+}
+
+// close stops holding queries to route, returning the queries held, in order, and true if route was being held.
+// Safe to call on a nil buffer.
+func (qb *QueryBuffer) close(route string) ([]BufferedQuery, bool) {
+	if qb == nil {
+		return nil, false
+	}
+	qb.Lock()
+	defer qb.Unlock()
+	br, ok := qb.routes[route]
+	if !ok {
+		return nil, false
+	}
+	br.timer.Stop()
+	delete(qb.routes, route)
+	return br.queries, true
+}
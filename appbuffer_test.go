@@ -0,0 +1,104 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestQueryBuffer(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	var none *QueryBuffer
+	ok(newQueryBuffer(0, time.Second) == nil, "disabled")
+	ok(newQueryBuffer(1, 0) == nil, "disabled")
+	none.open("/demo", func(int) {})
+	ok(!none.waiting("/demo"), "nil buffer")
+	ok(!none.hold("/demo", nil, []byte("a")), "nil buffer")
+
+	qb := newQueryBuffer(2, time.Hour)
+	ok(!qb.hold("/demo", nil, []byte("a")), "not waiting")
+	qb.open("/demo", func(int) { t.Error("expired") })
+	ok(qb.waiting("/demo"), "waiting")
+	ok(qb.hold("/demo", nil, []byte("a")), "held")
+	ok(qb.hold("/demo", nil, []byte("b")), "held")
+	ok(!qb.hold("/demo", nil, []byte("c")), "full")
+	queries, held := qb.close("/demo")
+	ok(held, "was waiting")
+	eq(len(queries), 2)
+	eq(string(queries[0].data), "a") // in order
+	eq(string(queries[1].data), "b")
+	ok(!qb.waiting("/demo"), "no longer waiting")
+	_, held = qb.close("/demo")
+	ok(!held, "already closed")
+
+	qb = newQueryBuffer(2, 10*time.Millisecond)
+	expired := make(chan int, 1)
+	qb.open("/demo", func(dropped int) { expired <- dropped })
+	qb.hold("/demo", nil, []byte("a"))
+	eq(<-expired, 1)
+	ok(!qb.waiting("/demo"), "gave up")
+}
+
+func TestQueriesHeldWhileAppRestarts(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	broker := newBroker(newSite(), false, true, true)
+	broker.queries = newQueryBuffer(8, time.Hour)
+	c := newClient("192.0.2.1", nil, anonymous, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	register := func() *App {
+		no(broker.addApp("", &RegisterApp{Route: "/demo", Address: "http://127.0.0.1:8000"}))
+		return broker.getApp("/demo")
+	}
+
+	reloads := func() int {
+		n := 0
+		for {
+			select {
+			case pub := <-broker.publish:
+				if pub.route == "/demo" {
+					n++
+				}
+			default:
+				return n
+			}
+		}
+	}
+
+	first := register()
+	eq(reloads(), 1)
+	broker.removeApp(first)
+	ok(broker.queries.waiting("/demo"), "waiting for the app to register again")
+	ok(broker.queries.hold("/demo", c, []byte("a")), "held")
+	ok(broker.queries.hold("/demo", c, []byte("b")), "held")
+	info, found := broker.routeInfo("/demo")
+	ok(found, "restarting apps are listed")
+	eq(info.Status, appRestarting)
+
+	app := register()
+	ok(!broker.queries.waiting("/demo"), "flushed")
+	for _, want := range []string{"a", "b"} {
+		select {
+		case q := <-c.queries:
+			ok(q.app == app, "delivered to the new app")
+			eq(string(q.data), want)
+		case <-time.After(time.Second):
+			t.Fatal("held query not delivered")
+		}
+	}
+	eq(reloads(), 0) // browsers carry on with the restarted app
+	broker.dropApp("/demo")
+}
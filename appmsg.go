@@ -0,0 +1,99 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+const anyRoute = "*"
+
+var (
+	errBadAppMessage    = errors.New("bad app message: want from and route")
+	errAppMessageDenied = errors.New("app message not allowed")
+	errNoSenderApp      = errors.New("no app registered at sender route")
+)
+
+// AppMessageACL lists the app routes each app route is allowed to send messages to.
+// "*" in lieu of a route matches any route.
+type AppMessageACL map[string]map[string]bool // sender route => target route => true
+
+// Allow allows the app at route from to send messages to the app at route to.
+func (acl AppMessageACL) Allow(from, to string) {
+	targets, ok := acl[from]
+	if !ok {
+		targets = make(map[string]bool)
+		acl[from] = targets
+	}
+	targets[to] = true
+}
+
+// allows returns true if the app at route from can send messages to the app at route to. Safe to call on a nil ACL.
+func (acl AppMessageACL) allows(from, to string) bool {
+	for _, sender := range []string{from, anyRoute} {
+		if targets, ok := acl[sender]; ok && (targets[to] || targets[anyRoute]) {
+			return true
+		}
+	}
+	return false
+}
+
+// AppMessageD represents a message from another app, as delivered to an app, as the "message" event
+// of the "@app" source, i.e. {"": {"@app": {"message": {"from": ..., "data": ...}}}}.
+type AppMessageD struct {
+	From string          `json:"from"` // sender app's route
+	Data json.RawMessage `json:"data"`
+}
+
+// sendApp delivers a message from one app to another, on behalf of a tenant, if any.
+// token is the sender's app token, which must belong to the sender's route: access keys are shared by apps,
+// so only app tokens tell apps apart.
+func (b *Broker) sendApp(tenant string, q *SendApp, token string) error {
+	if len(q.From) == 0 || len(q.Route) == 0 {
+		return errBadAppMessage
+	}
+	from := tenantRoute(tenant, q.From)
+	if err := b.appTokens.verify(from, token); err != nil {
+		return err
+	}
+	if !b.appMessageACL().allows(q.From, q.Route) {
+		return errAppMessageDenied
+	}
+	if b.maintenance.isOn() {
+		return errAppMaintenance
+	}
+	if b.getApp(from) == nil {
+		return errNoSenderApp
+	}
+	app := b.getApp(tenantRoute(tenant, q.Route))
+	if app == nil {
+		return errAppUnavailable
+	}
+
+	m := AppMessageD{q.From, q.Data}
+	if len(m.Data) == 0 {
+		m.Data = json.RawMessage("null")
+	}
+	data, err := json.Marshal(map[string]map[string]map[string]AppMessageD{"": {"@app": {"message": m}}})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := b.appContext(context.Background())
+	defer cancel()
+	return app.forward(ctx, q.Route, "", anonymous, data, nil)
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestAppMessageACL(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	var none AppMessageACL
+	ok(!none.allows("/a", "/b"), "nil ACL denies")
+
+	acl := AppMessageACL{}
+	acl.Allow("/a", "/b")
+	acl.Allow("/c", anyRoute)
+	acl.Allow(anyRoute, "/d")
+	ok(acl.allows("/a", "/b"), "allowed pair")
+	ok(!acl.allows("/b", "/a"), "pairs are one-way")
+	ok(!acl.allows("/a", "/c"), "unlisted recipient")
+	ok(acl.allows("/c", "/x"), "any recipient")
+	ok(acl.allows("/x", "/d"), "any sender")
+}
+
+func TestSendApp(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	received := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- string(b)
+	}))
+	defer srv.Close()
+
+	broker := newBroker(newSite(), false, false, false)
+	broker.configure(nil, AppMessageACL{"/a": {"/b": true, "/gone": true}, "/b": {"/a": true}})
+	register := func(route, token string) {
+		no(broker.addApp("", &RegisterApp{Route: route, Address: srv.URL, token: token}))
+	}
+	send := func(from, to, token string) error {
+		return broker.sendApp("", &SendApp{From: from, Route: to, Data: []byte(`{"x":1}`)}, token)
+	}
+
+	register("/a", "")
+	eq(send("/a", "/b", ""), errAppTokenRequired) // no app tokens, no senders
+
+	tokens, err := loadAppTokens(filepath.Join(t.TempDir(), "app-tokens.json"), time.Hour)
+	no(err)
+	broker.appTokens = tokens
+	ta, err := tokens.rotate("/a")
+	no(err)
+	tb, err := tokens.rotate("/b")
+	no(err)
+	register("/a", ta)
+	register("/b", tb)
+
+	eq(send("/a", "/b", ""), errAppTokenRequired)
+	eq(send("/a", "/b", tb), errBadAppToken) // /b posing as /a
+	eq(send("/b", "/x", tb), errAppMessageDenied)
+	eq(send("/a", "/gone", ta), errAppUnavailable)
+	eq(send("", "/b", ta), errBadAppMessage)
+
+	no(send("/a", "/b", ta))
+	select {
+	case body := <-received:
+		eq(body, `{"":{"@app":{"message":{"from":"/a","data":{"x":1}}}}}`)
+	case <-time.After(5 * time.Second):
+		ok(false, "message not delivered")
+	}
+
+	broker.dropApp("/a")
+	eq(send("/a", "/b", ta), errNoSenderApp)
+}
+
+func TestWebServerSendApp(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	broker := newBroker(newSite(), false, false, false)
+	broker.configure(nil, AppMessageACL{"/a": {anyRoute: true}})
+	tokens, err := loadAppTokens(filepath.Join(t.TempDir(), "app-tokens.json"), time.Hour)
+	no(err)
+	broker.appTokens = tokens
+	ta, err := tokens.rotate("/a")
+	no(err)
+	no(broker.addApp("", &RegisterApp{Route: "/a", Address: srv.URL, token: ta}))
+	no(broker.addApp("", &RegisterApp{Route: "/b", Address: srv.URL}))
+
+	s := &WebServer{broker: broker, maxRequestSize: 1 << 20}
+	post := func(body, token string) int {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentTypeJSON)
+		if len(token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		s.post(w, r)
+		return w.Code
+	}
+	eq(post(`{"send_app":{"from":"/a","route":"/b"}}`, ta), http.StatusOK)
+	eq(post(`{"send_app":{"from":"/a","route":"/b"}}`, ""), http.StatusUnauthorized)
+	eq(post(`{"send_app":{"from":"/a","route":"/b"}}`, "bogus"), http.StatusUnauthorized)
+	eq(post(`{"send_app":{"from":"/a","route":"/none"}}`, ta), http.StatusServiceUnavailable)
+	eq(post(`{"send_app":{"route":"/b"}}`, ta), http.StatusBadRequest)
+
+	broker.configure(nil, nil)
+	eq(post(`{"send_app":{"from":"/a","route":"/b"}}`, ta), http.StatusForbidden)
+}
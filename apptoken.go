@@ -0,0 +1,222 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errAppTokenRequired = errors.New("app token required")
+	errBadAppToken      = errors.New("invalid app token")
+)
+
+// AppTokens represents per-app authentication tokens, each scoped to an app's route.
+//
+// An app whose route has tokens can be registered (and unregistered) only by presenting one of the route's tokens,
+// in lieu of an API access key. Queries forwarded to the app then carry the same token, so that the app can tell
+// the Wave server apart from anybody else. Rotating a route's tokens issues a new token, and keeps the older ones
+// valid for a grace period, so that app instances can be redeployed with the new token without downtime.
+type AppTokens struct {
+	sync.RWMutex
+	path   string                // file to persist tokens to
+	grace  time.Duration         // time rotated tokens remain valid
+	routes map[string][]AppToken // route => tokens, newest first
+}
+
+// AppToken represents a hashed app token.
+type AppToken struct {
+	Hash    string     `json:"hash"`              // hex-encoded SHA-256 hash of the token
+	Issued  time.Time  `json:"issued"`            // when issued
+	Expires *time.Time `json:"expires,omitempty"` // when the token stops being valid; nil if current
+}
+
+// AppTokenInfo represents a route's app tokens, as reported by the admin API.
+type AppTokenInfo struct {
+	Route  string     `json:"route"`
+	Tokens []AppToken `json:"tokens"`
+}
+
+// loadAppTokens loads app tokens from path, if present.
+func loadAppTokens(path string, grace time.Duration) (*AppTokens, error) {
+	t := &AppTokens{path: path, grace: grace, routes: make(map[string][]AppToken)}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, fmt.Errorf("failed reading app tokens: %v", err)
+	}
+	if err := json.Unmarshal(b, &t.routes); err != nil {
+		return nil, fmt.Errorf("failed parsing app tokens %s: %v", path, err)
+	}
+	return t, nil
+}
+
+// save persists tokens; must be called under lock.
+func (t *AppTokens) save() error {
+	b, err := json.MarshalIndent(t.routes, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("failed writing app tokens: %v", err)
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		return fmt.Errorf("failed writing app tokens: %v", err)
+	}
+	return nil
+}
+
+func hashAppToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// rotate issues a new token for route, keeping the route's current token valid for the grace period.
+func (t *AppTokens) rotate(route string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed generating app token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now().UTC()
+	t.Lock()
+	defer t.Unlock()
+	expires := now.Add(t.grace)
+	tokens := []AppToken{{hashAppToken(token), now, nil}}
+	for _, x := range t.routes[route] {
+		if x.Expires == nil {
+			x.Expires = &expires
+		}
+		if x.Expires.After(now) {
+			tokens = append(tokens, x)
+		}
+	}
+	prev := t.routes[route]
+	t.routes[route] = tokens
+	if err := t.save(); err != nil {
+		t.routes[route] = prev
+		return "", err
+	}
+	return token, nil
+}
+
+// revoke invalidates all of route's tokens, effective immediately, returning false if route had none.
+func (t *AppTokens) revoke(route string) (bool, error) {
+	t.Lock()
+	defer t.Unlock()
+	prev, ok := t.routes[route]
+	if !ok {
+		return false, nil
+	}
+	delete(t.routes, route)
+	if err := t.save(); err != nil {
+		t.routes[route] = prev
+		return false, err
+	}
+	return true, nil
+}
+
+// valid returns true if token is one of route's unexpired tokens; must be called under lock.
+func (t *AppTokens) valid(route, token string, now time.Time) bool {
+	h := []byte(hashAppToken(token))
+	for _, x := range t.routes[route] {
+		if (x.Expires == nil || x.Expires.After(now)) && subtle.ConstantTimeCompare(h, []byte(x.Hash)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error unless token (empty if none) authorizes an app to register at routes: if present,
+// the token must belong to the first (primary) route, and routes protected by tokens require a token.
+// Safe to call on nil tokens.
+func (t *AppTokens) check(routes []string, token string) error {
+	if t == nil {
+		if len(token) > 0 {
+			return errBadAppToken
+		}
+		return nil
+	}
+	now := time.Now()
+	t.RLock()
+	defer t.RUnlock()
+	if len(token) > 0 && !t.valid(routes[0], token, now) {
+		return errBadAppToken
+	}
+	for _, route := range routes {
+		if _, ok := t.routes[route]; ok {
+			if len(token) == 0 {
+				return errAppTokenRequired
+			}
+			if !t.valid(route, token, now) {
+				return errBadAppToken
+			}
+		}
+	}
+	return nil
+}
+
+// verify returns an error unless token is one of route's tokens, authenticating the holder as the app at route.
+// Safe to call on nil tokens: without app tokens, no app can be authenticated.
+func (t *AppTokens) verify(route, token string) error {
+	if t == nil || len(token) == 0 {
+		return errAppTokenRequired
+	}
+	t.RLock()
+	defer t.RUnlock()
+	if !t.valid(route, token, time.Now()) {
+		return errBadAppToken
+	}
+	return nil
+}
+
+// infos returns the hashed tokens of all routes, sorted by route.
+func (t *AppTokens) infos() []AppTokenInfo {
+	t.RLock()
+	defer t.RUnlock()
+	infos := []AppTokenInfo{}
+	for route, tokens := range t.routes {
+		infos = append(infos, AppTokenInfo{route, tokens})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Route < infos[j].Route })
+	return infos
+}
+
+// bearerToken returns the bearer token in the request's Authorization header, if any.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	if h := r.Header.Get("Authorization"); len(h) > len(prefix) && strings.EqualFold(h[:len(prefix)], prefix) {
+		return h[len(prefix):]
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestAppTokens(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	path := filepath.Join(t.TempDir(), "app-tokens.json")
+	tokens, err := loadAppTokens(path, time.Hour)
+	no(err)
+
+	no(tokens.check([]string{"/foo"}, "")) // unprotected
+	eq(errBadAppToken, tokens.check([]string{"/foo"}, "bogus"))
+
+	t1, err := tokens.rotate("/foo")
+	no(err)
+	eq(errAppTokenRequired, tokens.check([]string{"/foo"}, ""))
+	no(tokens.check([]string{"/foo"}, t1))
+	no(tokens.check([]string{"/foo", "/bar"}, t1))
+	eq(errBadAppToken, tokens.check([]string{"/bar"}, t1))
+	eq(errAppTokenRequired, tokens.check([]string{"/bar", "/foo"}, ""))
+
+	t2, err := tokens.rotate("/foo")
+	no(err)
+	no(tokens.check([]string{"/foo"}, t1)) // grace period
+	no(tokens.check([]string{"/foo"}, t2))
+
+	tokens, err = loadAppTokens(path, 0) // reload
+	no(err)
+	no(tokens.check([]string{"/foo"}, t2))
+	t3, err := tokens.rotate("/foo")
+	no(err)
+	eq(errBadAppToken, tokens.check([]string{"/foo"}, t2)) // no grace period
+	no(tokens.check([]string{"/foo"}, t3))
+	no(tokens.check([]string{"/foo"}, t1)) // still within its own grace period
+	eq(2, len(tokens.infos()[0].Tokens))
+
+	revoked, err := tokens.revoke("/foo")
+	no(err)
+	ok(revoked)
+	no(tokens.check([]string{"/foo"}, ""))
+}
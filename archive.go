@@ -0,0 +1,160 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const archiveDir = "pages"
+
+var (
+	errArchiveEntryTooLarge = errors.New("archive entry too large")
+	errBadArchiveEntry      = errors.New("bad page snapshot")
+)
+
+// ArchiveResult represents the result of restoring an archive.
+type ArchiveResult struct {
+	Restored int      `json:"restored"`
+	Failed   []string `json:"failed,omitempty"` // archive entries that could not be restored
+}
+
+// archiveName returns the name of the archive entry for the page at route.
+func archiveName(route string) string {
+	if route == "/" {
+		return archiveDir + "/_root.json"
+	}
+	return archiveDir + route + ".json"
+}
+
+// archive streams (GET) a tar.gz of page snapshots for all pages, or only those in the route prefix, if specified;
+// or restores (PUT) pages from such an archive.
+func (s *AdminServer) archive(w http.ResponseWriter, r *http.Request, prefix string) {
+	switch r.Method {
+	case http.MethodGet:
+		s.exportArchive(w, prefix)
+	case http.MethodPut:
+		s.importArchive(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *AdminServer) exportArchive(w http.ResponseWriter, prefix string) {
+	now := time.Now().UTC()
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="wave-pages-`+now.Format("20060102-150405")+`.tar.gz"`)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	n := 0
+	for _, route := range s.broker.site.urls() {
+		if len(prefix) > 0 && !matchRoutePrefix(prefix, route) {
+			continue
+		}
+		page, ok := s.broker.site.pages.get(route) // avoid touching pages
+		if !ok {
+			continue
+		}
+		d, err := page.copy()
+		if err != nil {
+			echoError(Log{"t": "archive_export", "route": route, "error": err.Error()})
+			continue
+		}
+		b, err := json.Marshal(newPageSnapshot(route, d, now))
+		if err != nil {
+			echoError(Log{"t": "archive_export", "route": route, "error": err.Error()})
+			continue
+		}
+		hdr := &tar.Header{Name: archiveName(route), Mode: 0600, Size: int64(len(b)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			echoError(Log{"t": "archive_export", "error": err.Error()})
+			return // client went away; response is unusable anyway
+		}
+		if _, err := tw.Write(b); err != nil {
+			echoError(Log{"t": "archive_export", "error": err.Error()})
+			return
+		}
+		n++
+	}
+	if err := tw.Close(); err != nil {
+		echoError(Log{"t": "archive_export", "error": err.Error()})
+		return
+	}
+	gz.Close()
+	echo(Log{"t": "archive_export", "prefix": prefix, "pages": strconv.Itoa(n)})
+}
+
+func (s *AdminServer) importArchive(w http.ResponseWriter, r *http.Request) {
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		echoError(Log{"t": "archive_import", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	defer gz.Close()
+
+	var result ArchiveResult
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			echoError(Log{"t": "archive_import", "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(hdr.Name, ".json") {
+			continue
+		}
+		if err := s.restorePage(r, io.LimitReader(tr, s.maxRequestSize+1)); err != nil {
+			echoError(Log{"t": "archive_import", "entry": hdr.Name, "error": err.Error()})
+			result.Failed = append(result.Failed, hdr.Name)
+			continue
+		}
+		result.Restored++
+	}
+	echo(Log{"t": "archive_import", "restored": strconv.Itoa(result.Restored), "failed": strconv.Itoa(len(result.Failed))})
+	writeJSON(w, &result)
+}
+
+func (s *AdminServer) restorePage(r *http.Request, entry io.Reader) error {
+	b, err := ioutil.ReadAll(entry)
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) > s.maxRequestSize {
+		return errArchiveEntryTooLarge
+	}
+	snapshot, err := parsePageSnapshot(b)
+	if err != nil {
+		return err
+	}
+	if len(snapshot.Route) == 0 {
+		return errBadArchiveEntry
+	}
+	return s.importSnapshot(r, "", snapshot)
+}
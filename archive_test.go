@@ -0,0 +1,125 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+// readArchive returns the entries of a tar.gz archive, by name.
+func readArchive(t *testing.T, b []byte) map[string][]byte {
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = data
+	}
+}
+
+// writeArchive returns a tar.gz archive of entries, by name.
+func writeArchive(t *testing.T, entries map[string]string) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, data := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	return buf.String()
+}
+
+func TestPageArchive(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	admin, request := newTestAdmin(t)
+	for _, route := range []string{"/", "/sales/q1", "/sales/q2", "/salesforce"} {
+		no(admin.broker.patch(route, []byte(`{"d":[{"k":"x","d":{"view":"markdown","content":"`+route+`"}}]}`), ""))
+	}
+
+	w := request("GET", "/_a/archive", "")
+	eq(w.Code, http.StatusOK)
+	eq(w.Header().Get("Content-Type"), "application/gzip")
+	all := readArchive(t, w.Body.Bytes())
+	eq(len(all), 4)
+	ok(all["pages/_root.json"] != nil, "root page archived")
+	var snapshot PageSnapshot
+	no(json.Unmarshal(all["pages/sales/q1.json"], &snapshot))
+	eq(snapshot.Version, pageSnapshotVersion)
+	eq(snapshot.Route, "/sales/q1")
+	eq(snapshot.Page.C["x"].D["content"], "/sales/q1")
+
+	w = request("GET", "/_a/archive/sales", "")
+	eq(w.Code, http.StatusOK)
+	sales := readArchive(t, w.Body.Bytes())
+	eq(len(sales), 2) // not /salesforce
+	ok(sales["pages/sales/q2.json"] != nil, "q2 archived")
+
+	restored, restore := newTestAdmin(t)
+	w = restore("PUT", "/_a/archive", w.Body.String())
+	eq(w.Code, http.StatusOK)
+	var result ArchiveResult
+	no(json.Unmarshal(w.Body.Bytes(), &result))
+	eq(result, ArchiveResult{Restored: 2})
+	d, err := restored.broker.site.at("/sales/q2").copy()
+	no(err)
+	eq(d.C["x"].D["content"], "/sales/q2")
+	ok(restored.broker.site.at("/salesforce") == nil, "not restored")
+
+	w = restore("PUT", "/_a/archive", writeArchive(t, map[string]string{
+		"pages/good.json":    `{"version":1,"route":"/good","page":{"c":{}}}`,
+		"pages/noroute.json": `{"version":1,"page":{"c":{}}}`,
+		"pages/bad.json":     `not json`,
+		"README":             `skipped`,
+	}))
+	eq(w.Code, http.StatusOK)
+	result = ArchiveResult{}
+	no(json.Unmarshal(w.Body.Bytes(), &result))
+	eq(result.Restored, 1)
+	eq(len(result.Failed), 2)
+	ok(restored.broker.site.at("/good") != nil, "good entry restored")
+
+	eq(restore("PUT", "/_a/archive", "not gzip").Code, http.StatusBadRequest)
+	eq(restore("POST", "/_a/archive", "").Code, http.StatusMethodNotAllowed)
+}
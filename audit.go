@@ -0,0 +1,226 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditLogin          = "login"
+	auditLogout         = "logout"
+	auditRefresh        = "refresh"
+	auditRefreshFailure = "refresh_failure"
+	auditExpiry         = "expiry"
+	auditLockout        = "lockout"
+
+	auditSuccess = "success"
+	auditFailure = "failure"
+
+	defaultAuditQueueSize = 1024 // events
+)
+
+// AuditEvent represents an entry in the audit log.
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Subject  string    `json:"subject,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Addr     string    `json:"addr,omitempty"`
+	Provider string    `json:"provider,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// AuditSink represents a destination for audit log entries.
+type AuditSink interface {
+	// write appends a single marshaled audit event to the sink; remote sinks may queue it instead.
+	write(entry []byte) error
+	close() error
+}
+
+// AuditLog represents an append-only audit log, written asynchronously to one or more sinks.
+type AuditLog struct {
+	sinks  []AuditSink
+	events chan AuditEvent
+	wg     sync.WaitGroup
+}
+
+// newAuditLog returns an audit log writing to sinks, queueing up to queueSize events (defaultAuditQueueSize if not
+// positive) while they are written; events recorded while the queue is full are dropped.
+func newAuditLog(sinks []AuditSink, queueSize int) *AuditLog {
+	if queueSize <= 0 {
+		queueSize = defaultAuditQueueSize
+	}
+	a := &AuditLog{sinks: sinks, events: make(chan AuditEvent, queueSize)}
+	a.wg.Add(1)
+	go a.run()
+	return a
+}
+
+// openAuditLog creates an audit log from sink specs, one of:
+// "syslog" or "syslog:tag", "http://..." or "https://..." (webhook), or a file path; see newAuditLog for queueSize.
+func openAuditLog(specs []string, queueSize int) (*AuditLog, error) {
+	var sinks []AuditSink
+	for _, spec := range specs {
+		sink, err := openAuditSink(spec)
+		if err != nil {
+			for _, s := range sinks {
+				s.close()
+			}
+			return nil, fmt.Errorf("failed opening audit log %s: %v", spec, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return newAuditLog(sinks, queueSize), nil
+}
+
+func openAuditSink(spec string) (AuditSink, error) {
+	switch {
+	case spec == "syslog":
+		return newSyslogAuditSink("wave")
+	case strings.HasPrefix(spec, "syslog:"):
+		return newSyslogAuditSink(strings.TrimPrefix(spec, "syslog:"))
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return newWebhookAuditSink(spec), nil
+	}
+	return newFileAuditSink(strings.TrimPrefix(spec, "file:"))
+}
+
+// record appends an event to the audit log. Safe to call on a nil log.
+func (a *AuditLog) record(e AuditEvent) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	select {
+	case a.events <- e:
+	default:
+		echoError(Log{"t": "audit", "type": e.Type, "subject": e.Subject, "error": "audit queue full; event dropped"})
+	}
+}
+
+func (a *AuditLog) run() {
+	defer a.wg.Done()
+	for e := range a.events {
+		entry, err := json.Marshal(e)
+		if err != nil {
+			echoError(Log{"t": "audit_marshal", "error": err.Error()})
+			continue
+		}
+		for _, sink := range a.sinks {
+			if err := sink.write(entry); err != nil {
+				echoError(Log{"t": "audit_write", "error": err.Error()})
+			}
+		}
+	}
+}
+
+// close flushes pending events and closes all sinks.
+func (a *AuditLog) close() {
+	if a == nil {
+		return
+	}
+	close(a.events)
+	a.wg.Wait()
+	for _, sink := range a.sinks {
+		sink.close()
+	}
+}
+
+// FileAuditSink appends audit events to a file, one JSON object per line.
+type FileAuditSink struct {
+	file *os.File
+}
+
+func newFileAuditSink(path string) (*FileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{f}, nil
+}
+
+func (s *FileAuditSink) write(entry []byte) error {
+	_, err := s.file.Write(append(entry, '\n'))
+	return err
+}
+
+func (s *FileAuditSink) close() error {
+	return s.file.Close()
+}
+
+var errAuditQueueFull = errors.New("audit webhook queue full")
+
+// WebhookAuditSink posts audit events as JSON to a URL, asynchronously, as Webhooks do, so that a slow or failing
+// webhook does not hold up the other sinks, or the edits recorded by EditAudit. Writes fail if the queue is full.
+type WebhookAuditSink struct {
+	queue  *webhookQueue
+	client *http.Client
+	done   chan struct{} // closed once queued events are posted, after close
+}
+
+func newWebhookAuditSink(url string) *WebhookAuditSink {
+	s := &WebhookAuditSink{&webhookQueue{url, make(chan webhookPost, webhookQueueSize)}, &http.Client{Timeout: 10 * time.Second}, make(chan struct{})}
+	go s.run()
+	return s
+}
+
+func (s *WebhookAuditSink) write(entry []byte) error {
+	select {
+	case s.queue.events <- webhookPost{body: entry}:
+		return nil
+	default:
+		return errAuditQueueFull
+	}
+}
+
+func (s *WebhookAuditSink) run() {
+	defer close(s.done)
+	for p := range s.queue.events {
+		if err := s.post(p.body); err != nil {
+			echoError(Log{"t": "audit_write", "url": s.queue.url, "error": err.Error()})
+		}
+	}
+}
+
+func (s *WebhookAuditSink) post(entry []byte) error {
+	resp, err := s.client.Post(s.queue.url, contentTypeJSON, bytes.NewReader(entry))
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook request failed: %s", http.StatusText(resp.StatusCode))
+	}
+	return nil
+}
+
+// close posts the queued events, then stops.
+func (s *WebhookAuditSink) close() error {
+	close(s.queue.events)
+	<-s.done
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package wave
+
+import (
+	"log/syslog"
+)
+
+// SyslogAuditSink writes audit events to the system logger.
+type SyslogAuditSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogAuditSink(tag string) (AuditSink, error) {
+	w, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogAuditSink{w}, nil
+}
+
+func (s *SyslogAuditSink) write(entry []byte) error {
+	return s.w.Info(string(entry))
+}
+
+func (s *SyslogAuditSink) close() error {
+	return s.w.Close()
+}
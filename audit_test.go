@@ -0,0 +1,128 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+// blockingWebhook returns a webhook that holds each request until released, and the bodies it received.
+func blockingWebhook(t *testing.T) (*httptest.Server, chan struct{}, chan []byte) {
+	release, received := make(chan struct{}), make(chan []byte, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		b, _ := ioutil.ReadAll(r.Body)
+		select {
+		case received <- b:
+		default:
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, release, received
+}
+
+func TestAuditLogWebhook(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	srv, release, received := blockingWebhook(t)
+	file := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog([]string{srv.URL, file}, 0)
+	no(err)
+
+	a.record(AuditEvent{Type: auditLogin, Subject: "alice", Outcome: auditSuccess})
+	deadline := time.Now().Add(5 * time.Second)
+	for { // written to the file while the webhook is stuck
+		b, _ := ioutil.ReadFile(file)
+		if strings.Contains(string(b), `"subject":"alice"`) {
+			break
+		}
+		ok(time.Now().Before(deadline), "file sink held up by webhook")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	a.close() // posts queued events
+	var e AuditEvent
+	no(json.Unmarshal(<-received, &e))
+	eq(e.Subject, "alice")
+}
+
+// stalledAuditSink represents an audit sink whose writes wait until released.
+type stalledAuditSink struct {
+	writing chan struct{} // signaled as each write starts
+	release chan struct{}
+	written int
+}
+
+func (s *stalledAuditSink) write(entry []byte) error {
+	s.writing <- struct{}{}
+	<-s.release
+	s.written++
+	return nil
+}
+func (s *stalledAuditSink) close() error { return nil }
+
+func TestAuditLogQueueSize(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	a := newAuditLog(nil, 0)
+	eq(cap(a.events), defaultAuditQueueSize)
+	a.close()
+
+	sink := &stalledAuditSink{make(chan struct{}, 8), make(chan struct{}), 0}
+	a = newAuditLog([]AuditSink{sink}, 2)
+	a.record(AuditEvent{Type: auditLogin})
+	<-sink.writing // being written
+	for i := 0; i < 3; i++ {
+		a.record(AuditEvent{Type: auditLogin}) // two queued, one dropped
+	}
+	close(sink.release)
+	a.close()
+	eq(sink.written, 3)
+}
+
+func TestWebhookAuditSinkQueueFull(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	srv, release, _ := blockingWebhook(t)
+	s := newWebhookAuditSink(srv.URL)
+
+	var err error
+	for i := 0; i <= webhookQueueSize+1 && err == nil; i++ { // one in flight, the rest queued
+		err = s.write([]byte(`{}`))
+	}
+	eq(err, errAuditQueueFull)
+	close(release)
+	no(s.close())
+}
+
+func TestEditAuditWebhook(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	srv, release, received := blockingWebhook(t)
+	a, err := openEditAudit(srv.URL)
+	no(err)
+
+	start := time.Now()
+	no(a.record("/foo", "user:alice", "192.0.2.1", []byte(`{}`))) // queued, not waiting on the webhook
+	ok(time.Since(start) < time.Second, "edit held up by webhook")
+	close(release)
+	ok(strings.Contains(string(<-received), `"route":"/foo"`), "entry posted")
+}
@@ -22,6 +22,8 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -63,13 +65,16 @@ type Session struct {
 	nonce      string
 	subject    string
 	username   string
+	tenant     string // see Tenancy
 	successURL string
 	token      *oauth2.Token
-	expiry     time.Time
+	lastSeen   time.Time // time of last activity
 }
 
 var errInactivityTimeout = errors.New("timed out due to inactivity")
 
+// touch records activity on the session, failing if the session has been inactive for longer than timeout.
+// A zero timeout never expires the session.
 func (s *Session) touch(timeout time.Duration) error {
 	if s == anonymous {
 		return nil
@@ -78,7 +83,7 @@ func (s *Session) touch(timeout time.Duration) error {
 	now := time.Now()
 
 	s.RLock()
-	expired := s.expiry.Before(now)
+	expired := timeout > 0 && now.Sub(s.lastSeen) > timeout
 	s.RUnlock()
 
 	if expired {
@@ -86,7 +91,7 @@ func (s *Session) touch(timeout time.Duration) error {
 	}
 
 	s.Lock()
-	s.expiry = now.Add(timeout)
+	s.lastSeen = now
 	s.Unlock()
 
 	return nil
@@ -100,7 +105,7 @@ var anonymous = &Session{
 	subject:  anon,
 	username: anon,
 	token:    &oauth2.Token{},
-	expiry:   time.Now().Add(365 * 24 * time.Hour),
+	lastSeen: time.Now(),
 }
 
 // Auth holds authenticated end-user sessions
@@ -109,12 +114,14 @@ type Auth struct {
 	conf     *AuthConf
 	oauth    *oauth2.Config
 	sessions map[string]*Session
+	audit    *AuditLog
+	throttle *Throttle
 	baseURL  string
 	initURL  string
 	loginURL string
 }
 
-func newAuth(conf *AuthConf, baseURL, initURL, loginURL string) (*Auth, error) {
+func newAuth(conf *AuthConf, audit *AuditLog, baseURL, initURL, loginURL string) (*Auth, error) {
 	oauth, err := connectToProvider(conf)
 	if err != nil {
 		return nil, err
@@ -123,12 +130,135 @@ func newAuth(conf *AuthConf, baseURL, initURL, loginURL string) (*Auth, error) {
 		conf:     conf,
 		oauth:    oauth,
 		sessions: make(map[string]*Session),
+		audit:    audit,
+		throttle: newThrottle(conf.MaxLoginAttempts, conf.LoginAttemptWindow, conf.LoginLockout),
 		baseURL:  baseURL,
 		initURL:  initURL,
 		loginURL: loginURL,
 	}, nil
 }
 
+// oauthConfig returns the current OAuth2 configuration.
+func (auth *Auth) oauthConfig() *oauth2.Config {
+	auth.RLock()
+	defer auth.RUnlock()
+	return auth.oauth
+}
+
+// setClientSecret replaces the OIDC client secret, e.g. when it is rotated.
+func (auth *Auth) setClientSecret(secret string) {
+	auth.Lock()
+	c := *auth.oauth
+	c.ClientSecret = secret
+	auth.oauth = &c
+	auth.Unlock()
+}
+
+// inactivityTimeout returns the inactivity timeout for a route, using the longest matching route override, if any.
+func (auth *Auth) inactivityTimeout(route string) time.Duration {
+	timeout, n := auth.conf.InactivityTimeout, -1
+	for prefix, t := range auth.conf.RouteInactivityTimeouts {
+		if len(prefix) > n && matchRoutePrefix(prefix, route) {
+			timeout, n = t, len(prefix)
+		}
+	}
+	return timeout
+}
+
+// matchRoutePrefix returns true if route is prefix, or a sub-route of prefix.
+func matchRoutePrefix(prefix, route string) bool {
+	if route == prefix || strings.HasSuffix(prefix, "/") && strings.HasPrefix(route, prefix) {
+		return true
+	}
+	return strings.HasPrefix(route, prefix+"/")
+}
+
+// record writes an auth event to the audit log; an empty err indicates success.
+func (auth *Auth) record(kind string, session *Session, addr, err string) {
+	if auth.audit == nil {
+		return
+	}
+	e := AuditEvent{Type: kind, Addr: addr, Provider: auth.conf.ProviderURL, Outcome: auditSuccess, Error: err}
+	if session != nil {
+		e.Subject, e.Username = session.subject, session.username
+	}
+	if len(err) > 0 {
+		e.Outcome = auditFailure
+	}
+	auth.audit.record(e)
+}
+
+// loginFailed records a failed login attempt. Only attempts rejected for their credentials or state, e.g. a forged
+// or replayed callback, are counted against the client address, and could lock it out; failures of the provider
+// or of the network are not, so that an outage of the provider does not lock out every user.
+func (auth *Auth) loginFailed(session *Session, addr, err string, rejected bool) {
+	auth.record(auditLogin, session, addr, err)
+	if rejected && auth.throttle.fail("ip:"+addr) {
+		echoWarn(Log{"t": "login_lockout", "addr": addr})
+		auth.record(auditLockout, nil, addr, "too many failed login attempts from address")
+	}
+}
+
+// accountFailed is like loginFailed, for an attempt rejected once the provider has identified the user, e.g. with
+// a mismatched nonce, which is also counted against the user's account (the ID token's subject), so that the
+// account can be locked out whichever addresses the attempts come from.
+func (auth *Auth) accountFailed(session *Session, subject, addr, err string) {
+	auth.loginFailed(session, addr, err, true)
+	if auth.throttle.fail("account:" + subject) {
+		echoWarn(Log{"t": "login_lockout", "subject": subject})
+		auth.record(auditLockout, &Session{subject: subject}, addr, "too many failed login attempts for account")
+	}
+}
+
+// loginLocked returns true if the client address is locked out, failing the request with a 429 response.
+// Accounts are not known until the provider has identified the user; see accountLocked.
+func (auth *Auth) loginLocked(w http.ResponseWriter, addr string) bool {
+	locked, remaining := auth.throttle.locked("ip:" + addr)
+	if !locked {
+		return false
+	}
+	echoWarn(Log{"t": "login_locked", "addr": addr})
+	refuseLockedOut(w, remaining)
+	return true
+}
+
+// accountLocked returns true if the account identified by the provider is locked out, failing the request with a
+// 429 response.
+func (auth *Auth) accountLocked(w http.ResponseWriter, subject, addr string) bool {
+	locked, remaining := auth.throttle.locked("account:" + subject)
+	if !locked {
+		return false
+	}
+	echoWarn(Log{"t": "login_locked", "addr": addr, "subject": subject})
+	refuseLockedOut(w, remaining)
+	return true
+}
+
+func refuseLockedOut(w http.ResponseWriter, remaining time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// isRejectedLogin returns true if an error reported by the provider in a login callback means that the login was
+// refused, e.g. "access_denied", rather than that the provider failed.
+func isRejectedLogin(err string) bool {
+	switch err {
+	case "server_error", "temporarily_unavailable":
+		return false
+	}
+	return true
+}
+
+// isRejectedExchange returns true if the provider refused to exchange an authorization code for a token, e.g. an
+// invalid or replayed code, rather than the exchange failing, e.g. if the provider is unreachable.
+func isRejectedExchange(err error) bool {
+	var rerr *oauth2.RetrieveError
+	if errors.As(err, &rerr) && rerr.Response != nil {
+		return rerr.Response.StatusCode >= 400 && rerr.Response.StatusCode < 500
+	}
+	return false
+}
+
 func (auth *Auth) get(key string) (*Session, bool) {
 	auth.RLock()
 	defer auth.RUnlock()
@@ -148,34 +278,44 @@ func (auth *Auth) remove(key string) {
 	delete(auth.sessions, key)
 }
 
+// identify returns the session of the user making a request, if valid, recording activity on it for the route
+// requested, with the route's inactivity timeout (see inactivityTimeout).
 func (auth *Auth) identify(r *http.Request) *Session {
+	return auth.identifyAt(r, resolveURL(r.URL.Path, auth.baseURL))
+}
+
+// identifyAt is like identify, for a request made on behalf of a route, e.g. a socket opened for a page.
+func (auth *Auth) identifyAt(r *http.Request, route string) *Session {
 	cookie, err := r.Cookie(authCookieName)
 	if err != nil {
-		echo(Log{"t": "oauth2_cookie_read", "warning": err.Error()})
+		echoWarn(Log{"t": "oauth2_cookie_read", "error": err.Error()})
 		return nil
 	}
 
 	sessionID := cookie.Value
 	session, ok := auth.get(sessionID)
 	if !ok {
-		echo(Log{"t": "oauth2_session", "error": "invalid session", "session_id": sessionID})
+		echoError(Log{"t": "oauth2_session", "error": "invalid session", "session_id": sessionID})
 		return nil
 	}
 
-	if err := session.touch(auth.conf.InactivityTimeout); err != nil {
+	if err := session.touch(auth.inactivityTimeout(route)); err != nil {
 		echo(Log{"t": "inactivity_timeout", "subject": session.subject})
+		auth.record(auditExpiry, session, getRemoteAddr(r), err.Error())
 		return nil
 	}
 
 	token, err := auth.ensureValidOAuth2Token(r.Context(), session.token)
 	if err != nil {
-		echo(Log{"t": "oauth2_token_refresh", "error": err.Error(), "subject": session.subject})
+		echoError(Log{"t": "oauth2_token_refresh", "error": err.Error(), "subject": session.subject})
+		auth.record(auditRefreshFailure, session, getRemoteAddr(r), err.Error())
 		return nil
 	}
 
 	if session.token != token {
 		session.token = token
 		auth.set(session)
+		auth.record(auditRefresh, session, getRemoteAddr(r), "")
 	}
 
 	return session
@@ -211,7 +351,7 @@ func (auth *Auth) wrap(h http.Handler) http.Handler {
 }
 
 func (auth *Auth) ensureValidOAuth2Token(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
-	return auth.oauth.TokenSource(ctx, token).Token()
+	return auth.oauthConfig().TokenSource(ctx, token).Token()
 }
 
 func (auth *Auth) redirectToLogin(w http.ResponseWriter, r *http.Request) {
@@ -258,7 +398,7 @@ func (h *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// `state` is to protect from CSRF (OAuth2 part).
 	state, err := generateRandomKey(4)
 	if err != nil {
-		echo(Log{"t": "oidc_random_state_key", "error": err.Error()})
+		echoError(Log{"t": "oidc_random_state_key", "error": err.Error()})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -266,7 +406,7 @@ func (h *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// `nonce` is to protect from replay attacks (OpenID part).
 	nonce, err := generateRandomKey(4)
 	if err != nil {
-		echo(Log{"t": "oidc_random_nonce_key", "error": err.Error()})
+		echoError(Log{"t": "oidc_random_nonce_key", "error": err.Error()})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -276,11 +416,21 @@ func (h *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		successURL = nextValues[0]
 	}
 
+	// With host-based tenancy, the session is valid only on the host it was started on (see Tenancy).
+	var tenant string
+	if h.auth.conf.TenantHost {
+		if tenant = hostTenant(r.Host); !isTenantName(tenant) {
+			echoError(Log{"t": "oidc_tenant", "host": r.Host, "error": errNoTenant.Error()})
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
 	// Session ID stored in cookie.
 	sessionID := uuid.New().String()
 
-	h.auth.set(&Session{id: sessionID, state: state, nonce: nonce, successURL: successURL, expiry: time.Now().Add(h.auth.conf.InactivityTimeout)})
-	cookie := http.Cookie{Name: authCookieName, Value: sessionID, Path: h.auth.baseURL, Expires: time.Now().Add(h.auth.conf.SessionExpiry)}
+	h.auth.set(&Session{id: sessionID, state: state, nonce: nonce, tenant: tenant, successURL: successURL, lastSeen: time.Now()})
+	cookie := http.Cookie{Name: authCookieName, Value: sessionID, Path: h.auth.baseURL, Expires: time.Now().Add(h.auth.conf.SessionExpiry), HttpOnly: true, SameSite: http.SameSiteLaxMode}
 	http.SetCookie(w, &cookie)
 
 	var options []oauth2.AuthCodeOption
@@ -288,7 +438,7 @@ func (h *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	for _, param := range h.auth.conf.URLParameters {
 		options = append(options, oauth2.SetAuthURLParam(param[0], param[1]))
 	}
-	http.Redirect(w, r, h.auth.oauth.AuthCodeURL(state, options...), http.StatusFound)
+	http.Redirect(w, r, h.auth.oauthConfig().AuthCodeURL(state, options...), http.StatusFound)
 }
 
 // AuthHandler handles OAuth2 requests
@@ -301,10 +451,15 @@ func newAuthHandler(auth *Auth) http.Handler {
 }
 
 func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	addr := getRemoteAddr(r)
+	if h.auth.loginLocked(w, addr) {
+		return
+	}
+
 	// Retrieve saved session.
 	cookie, err := r.Cookie(authCookieName)
 	if err != nil {
-		echo(Log{"t": "oauth2_cookie", "error": err.Error()})
+		echoError(Log{"t": "oauth2_cookie", "error": err.Error()})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -312,7 +467,7 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	sessionID := cookie.Value
 	session, ok := h.auth.get(sessionID)
 	if !ok {
-		echo(Log{"t": "oauth2_session", "error": "not found"})
+		echoError(Log{"t": "oauth2_session", "error": "not found"})
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -320,7 +475,8 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Handle errors from provider.
 	if err := r.URL.Query().Get("error"); err != "" {
 		errorDescription := r.URL.Query().Get("error_description")
-		echo(Log{"t": "oauth2_callback", "error": err, "description": errorDescription})
+		echoError(Log{"t": "oauth2_callback", "error": err, "description": errorDescription})
+		h.auth.loginFailed(session, addr, err, isRejectedLogin(err))
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -328,36 +484,41 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Compare to stored state.
 	responseState := r.URL.Query().Get("state")
 	if session.state != responseState {
-		echo(Log{"t": "oauth2_state", "error": "failed matching state"})
+		echoError(Log{"t": "oauth2_state", "error": "failed matching state"})
+		h.auth.loginFailed(session, addr, "failed matching state", true)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
 	oAuth2Provider, err := oidc.NewProvider(r.Context(), h.auth.conf.ProviderURL)
 	if err != nil {
-		echo(Log{"t": "oauth2_oidc_provider", "error": err.Error()})
+		echoError(Log{"t": "oauth2_oidc_provider", "error": err.Error()})
+		h.auth.loginFailed(session, addr, err.Error(), false)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	oauth2Token, err := h.auth.oauth.Exchange(r.Context(), r.URL.Query().Get("code"))
+	oauth2Token, err := h.auth.oauthConfig().Exchange(r.Context(), r.URL.Query().Get("code"))
 	if err != nil {
-		echo(Log{"t": "oauth2_exchange", "error": err.Error()})
+		echoError(Log{"t": "oauth2_exchange", "error": err.Error()})
+		h.auth.loginFailed(session, addr, err.Error(), isRejectedExchange(err))
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
 	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
 	if !ok {
-		echo(Log{"t": "oauth2_exchange", "error": "failed reading id_token"})
+		echoError(Log{"t": "oauth2_exchange", "error": "failed reading id_token"})
+		h.auth.loginFailed(session, addr, "failed reading id_token", false)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	oidcVerifier := oAuth2Provider.Verifier(&oidc.Config{ClientID: h.auth.oauth.ClientID})
+	oidcVerifier := oAuth2Provider.Verifier(&oidc.Config{ClientID: h.auth.oauthConfig().ClientID})
 	idToken, err := oidcVerifier.Verify(r.Context(), rawIDToken)
 	if err != nil {
-		echo(Log{"t": "oauth2_oidc_verifier", "error": "failed verifying id_token"})
+		echoError(Log{"t": "oauth2_oidc_verifier", "error": "failed verifying id_token"})
+		h.auth.loginFailed(session, addr, "failed verifying id_token", true)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -368,25 +529,50 @@ func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	err = idToken.Claims(&claims)
 	if err != nil {
-		echo(Log{"t": "oauth2_claim", "error": "failed parsing token claims"})
+		echoError(Log{"t": "oauth2_claim", "error": "failed parsing token claims"})
+		h.auth.loginFailed(session, addr, "failed parsing token claims", false)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
+	// The provider has identified the user: from here on, attempts are also counted against the account.
+	if h.auth.accountLocked(w, idToken.Subject, addr) {
+		return
+	}
+
 	// Compare to stored nonce.
 	if session.nonce != claims.Nonce {
 		if !ok {
-			echo(Log{"t": "oauth2_nonce", "error": "failed matching nonce"})
+			echoError(Log{"t": "oauth2_nonce", "error": "failed matching nonce"})
+			h.auth.accountFailed(session, idToken.Subject, addr, "failed matching nonce")
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 	}
 
+	tenant := session.tenant // bound at login, if by host name
+	if claim := h.auth.conf.TenantClaim; len(claim) > 0 {
+		var extra map[string]interface{}
+		if err := idToken.Claims(&extra); err == nil {
+			tenant, _ = extra[claim].(string)
+		}
+		if !isTenantName(tenant) {
+			echoError(Log{"t": "oauth2_claim", "subject": idToken.Subject, "error": "missing or invalid tenant claim " + claim})
+			h.auth.loginFailed(session, addr, "missing or invalid tenant claim", false)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
 	session.token = oauth2Token
 	session.subject = idToken.Subject
 	session.username = claims.PreferredUsername
+	session.tenant = tenant
 
 	echo(Log{"t": "login", "subject": session.subject, "username": session.username})
+	h.auth.throttle.reset("ip:" + addr)
+	h.auth.throttle.reset("account:" + session.subject)
+	h.auth.record(auditLogin, session, addr, "")
 
 	h.auth.set(session)
 
@@ -409,7 +595,7 @@ func (h *LogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Retrieve saved session.
 	cookie, err := r.Cookie(authCookieName)
 	if err != nil {
-		echo(Log{"t": "logout_cookie", "error": "not found"})
+		echoError(Log{"t": "logout_cookie", "error": "not found"})
 		h.redirect(w, r, idToken)
 		return
 	}
@@ -425,6 +611,8 @@ func (h *LogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.auth.remove(sessionID)
 
 	if ok {
+		h.auth.record(auditLogout, session, getRemoteAddr(r), "")
+
 		// Reload all of this user's browser tabs
 		h.broker.resetClients(session)
 
@@ -445,7 +633,7 @@ func (h *LogoutHandler) redirect(w http.ResponseWriter, r *http.Request, idToken
 
 	redirectURL, err := url.Parse(h.auth.conf.EndSessionURL)
 	if err != nil {
-		echo(Log{"t": "logout_redirect_parse", "error": err.Error()})
+		echoError(Log{"t": "logout_redirect_parse", "error": err.Error()})
 		return
 	}
 
@@ -484,7 +672,7 @@ func (h *RefreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	session, ok := h.auth.get(sessionID)
 
 	if !ok {
-		echo(Log{"t": "refresh_session", "error": "session unavailable"})
+		echoError(Log{"t": "refresh_session", "error": "session unavailable"})
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
@@ -492,13 +680,15 @@ func (h *RefreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	token, err := h.auth.ensureValidOAuth2Token(r.Context(), session.token)
 	if err != nil {
 		// Purge session and reload clients if refresh not successful?
-		echo(Log{"t": "refresh_session", "error": err.Error()})
+		echoError(Log{"t": "refresh_session", "error": err.Error()})
+		h.auth.record(auditRefreshFailure, session, getRemoteAddr(r), err.Error())
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
 	session.token = token
 	h.auth.set(session)
+	h.auth.record(auditRefresh, session, getRemoteAddr(r), "")
 
 	w.Header().Set("Wave-Access-Token", token.AccessToken)
 	w.Header().Set("Wave-Refresh-Token", token.RefreshToken)
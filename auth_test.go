@@ -0,0 +1,106 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestRouteInactivityTimeout(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	auth := &Auth{conf: &AuthConf{
+		InactivityTimeout: 30 * time.Minute,
+		RouteInactivityTimeouts: map[string]time.Duration{
+			"/kiosk":       0,
+			"/admin":       5 * time.Minute,
+			"/admin/audit": time.Minute,
+		},
+	}}
+	eq(auth.inactivityTimeout("/"), 30*time.Minute)
+	eq(auth.inactivityTimeout("/kiosk"), time.Duration(0))
+	eq(auth.inactivityTimeout("/kiosk/lobby"), time.Duration(0))
+	eq(auth.inactivityTimeout("/kiosks"), 30*time.Minute)
+	eq(auth.inactivityTimeout("/admin/users"), 5*time.Minute)
+	eq(auth.inactivityTimeout("/admin/audit/today"), time.Minute)
+}
+
+func TestRouteInactivityTimeoutReconnect(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	auth := newTestAuth("alice", "bob")
+	auth.baseURL = "/"
+	auth.conf.InactivityTimeout = 30 * time.Minute
+	auth.conf.RouteInactivityTimeouts = map[string]time.Duration{"/kiosk": 0}
+	for _, subject := range []string{"alice", "bob"} {
+		session, _ := auth.get(subject)
+		session.lastSeen = time.Now().Add(-time.Hour) // idle for longer than the global timeout
+	}
+	sockets := newSocketServer(newBroker(newSite(), false, true, true), auth, nil, false, "/", nil)
+	connect := func(path, subject string) int {
+		w := httptest.NewRecorder()
+		sockets.ServeHTTP(w, asUser(httptest.NewRequest("GET", path, nil), subject))
+		return w.Code
+	}
+
+	ok(auth.identify(asUser(httptest.NewRequest("GET", "/kiosk/lobby", nil), "alice")) != nil, "page reloaded")
+	eq(connect("/_s/?v=2&route=%2Fkiosk%2Flobby", "alice"), http.StatusBadRequest) // identified; not a websocket request
+	eq(connect("/_s/?v=2&route=%2Fdashboard", "bob"), http.StatusUnauthorized)
+}
+
+func TestSessionTouch(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	s := &Session{lastSeen: time.Now().Add(-time.Hour)}
+	no(s.touch(0))
+	ok(s.touch(time.Minute) == nil, "touched session is active")
+	s.lastSeen = time.Now().Add(-time.Hour)
+	ok(s.touch(time.Minute) == errInactivityTimeout, "inactive session times out")
+}
+
+func TestLoginFailed(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	auth := &Auth{conf: &AuthConf{}, throttle: newThrottle(2, time.Minute, time.Hour)}
+	locked := func(addr string) bool {
+		l, _ := auth.throttle.locked("ip:" + addr)
+		return l
+	}
+	for i := 0; i < 5; i++ {
+		auth.loginFailed(nil, "1.2.3.4", "provider unreachable", false)
+	}
+	ok(!locked("1.2.3.4"), "provider failures are not counted")
+	auth.loginFailed(nil, "1.2.3.4", "failed matching state", true)
+	auth.loginFailed(nil, "1.2.3.4", "failed matching state", true)
+	ok(locked("1.2.3.4"), "rejected logins are counted")
+	ok(!locked("5.6.7.8"), "other addresses unaffected")
+
+	auth.accountFailed(nil, "alice", "5.6.7.8", "failed matching nonce")
+	auth.accountFailed(nil, "alice", "9.10.11.12", "failed matching nonce")
+	w := httptest.NewRecorder()
+	ok(auth.accountLocked(w, "alice", "13.14.15.16"), "account locked out, from any address")
+	ok(w.Code == http.StatusTooManyRequests && len(w.Header().Get("Retry-After")) > 0, "refused")
+	ok(!auth.accountLocked(httptest.NewRecorder(), "bob", "5.6.7.8"), "other accounts unaffected")
+	ok(!locked("13.14.15.16"), "address not locked out")
+
+	ok(isRejectedLogin("access_denied"), "refused by provider")
+	ok(!isRejectedLogin("temporarily_unavailable"), "provider failure")
+	ok(isRejectedExchange(&oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest}}), "invalid code")
+	ok(!isRejectedExchange(&oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadGateway}}), "provider failure")
+	ok(!isRejectedExchange(errors.New("connection refused")), "network failure")
+}
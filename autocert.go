@@ -0,0 +1,57 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"errors"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// AutocertConf represents the configuration for obtaining and renewing TLS certificates automatically via ACME,
+// e.g. from Let's Encrypt.
+type AutocertConf struct {
+	Hosts        []string // host names allowed to get certificates
+	CacheDir     string   // directory to cache certificates and account keys in
+	Email        string   // contact email for the ACME account; optional
+	DirectoryURL string   // ACME directory URL; Let's Encrypt if empty
+	HTTPListen   string   // address to answer HTTP-01 challenges and redirect to HTTPS on, e.g. ":80"; "" to disable
+}
+
+var errNoAutocertHosts = errors.New("autocert: want at least one host name")
+
+// newAutocertManager returns an ACME certificate manager. Certificates are requested for the allowed hosts only,
+// so that clients cannot make the server request certificates for arbitrary names via SNI.
+func newAutocertManager(conf AutocertConf, dataDir string) (*autocert.Manager, error) {
+	if len(conf.Hosts) == 0 {
+		return nil, errNoAutocertHosts
+	}
+	cacheDir := conf.CacheDir
+	if len(cacheDir) == 0 {
+		cacheDir = filepath.Join(dataDir, "autocert")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(conf.Hosts...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      conf.Email,
+	}
+	if len(conf.DirectoryURL) > 0 {
+		m.Client = &acme.Client{DirectoryURL: conf.DirectoryURL}
+	}
+	return m, nil
+}
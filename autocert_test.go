@@ -0,0 +1,33 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestAutocertManager(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	_, err := newAutocertManager(AutocertConf{}, t.TempDir())
+	ok(err == errNoAutocertHosts, "hosts required")
+
+	m, err := newAutocertManager(AutocertConf{Hosts: []string{"wave.example.com"}}, t.TempDir())
+	no(err)
+	no(m.HostPolicy(context.Background(), "wave.example.com"))
+	ok(m.HostPolicy(context.Background(), "other.example.com") != nil, "unlisted host rejected")
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// backpressureInterval is how often throttled clients are checked for having caught up.
+const backpressureInterval = time.Second
+
+// BackpressurePolicy represents when clients falling behind on updates are throttled.
+type BackpressurePolicy struct {
+	Depth int           // messages queued for a client at or above which the client is falling behind; 0 disables throttling
+	After time.Duration // how long a client can stay behind before being throttled
+}
+
+func (p BackpressurePolicy) enabled() bool {
+	return p.Depth > 0
+}
+
+// Backpressure represents the throttling state of a client; accessed only by the broker's run loop.
+type Backpressure struct {
+	behind    time.Time       // when the client started falling behind; zero if keeping up
+	throttled bool            // are minor updates being skipped?
+	stale     map[string]bool // routes with updates skipped, to be resent in full once the client catches up
+}
+
+// BackpressureD represents a backpressure event, as delivered to an app on behalf of a client:
+// {"": {"@system": {"backpressure": {...}}}}.
+type BackpressureD struct {
+	Throttled bool `json:"throttled"` // true when the client starts falling behind; false once it has caught up
+	Queued    int  `json:"queued"`    // messages queued for the client
+}
+
+// throttle returns true if pub should be skipped for a client, throttling the client if it has been falling behind
+// for longer than the policy allows. Only minor updates are skipped (see isMinorPatch); the pages they were meant
+// for are resent in full once the client catches up. minor caches whether pub is minor across clients; 0 if unknown.
+func (b *Broker) throttle(client *Client, pub Pub, minor *int) bool {
+	p := b.backpressure
+	if !p.enabled() || len(pub.route) == 0 {
+		return false
+	}
+	t := &client.throttle
+	queued := len(client.data)
+	if !t.throttled {
+		if queued < p.Depth {
+			t.behind = time.Time{}
+			return false
+		}
+		now := time.Now()
+		if t.behind.IsZero() {
+			t.behind = now
+		}
+		if now.Sub(t.behind) < p.After {
+			return false
+		}
+		t.throttled, t.stale = true, make(map[string]bool)
+		b.throttled[client] = true
+		atomic.AddInt64(&metrics.throttled, 1)
+		echoWarn(client.fields(Log{"t": "client_throttled", "queued": strconv.Itoa(queued), "behind": now.Sub(t.behind).String()}))
+		b.signalBackpressure(client, true, queued)
+	}
+	if *minor == 0 {
+		*minor = -1
+		if isMinorPatch(pub.data) {
+			*minor = 1
+		}
+	}
+	if *minor < 0 {
+		return false
+	}
+	t.stale[pub.route] = true
+	atomic.AddUint64(&metrics.skipped, 1)
+	return true
+}
+
+// unthrottle resends stale pages to throttled clients that have caught up, and stops throttling them once all
+// their stale pages have been resent. Clients that fall behind again while being resent pages stay throttled,
+// and are resent the remaining pages later.
+func (b *Broker) unthrottle() {
+	for client := range b.throttled {
+		queued := len(client.data)
+		if queued >= b.backpressure.Depth/2 {
+			continue
+		}
+		stale := client.throttle.stale
+		if b.resend(client, stale) {
+			echo(client.fields(Log{"t": "client_unthrottled"}))
+			b.signalBackpressure(client, false, queued)
+			b.unthrottled(client)
+		}
+	}
+}
+
+// resend sends the stale pages to a throttled client, in full, forgetting each once sent. Returns false if the client
+// fell behind again, with pages left to resend.
+func (b *Broker) resend(client *Client, stale map[string]bool) bool {
+	for route := range stale {
+		if _, ok := b.clients[route][client]; ok { // still watching
+			data := b.missingPage(route)
+			if page := b.site.at(route); page != nil {
+				data = page.marshal()
+			}
+			if !client.send(data) {
+				return false
+			}
+		}
+		delete(stale, route)
+	}
+	return true
+}
+
+// unthrottled stops tracking the throttling state of a client, e.g. once it has caught up, or gone away.
+func (b *Broker) unthrottled(client *Client) {
+	if !client.throttle.throttled {
+		return
+	}
+	client.throttle = Backpressure{}
+	delete(b.throttled, client)
+	atomic.AddInt64(&metrics.throttled, -1)
+}
+
+// signalBackpressure tells the apps serving the routes a client watches that the client is falling behind,
+// or has caught up, so that they can publish less often. Apps are not told about event streams, on behalf of which
+// no queries are sent (see getEvents).
+func (b *Broker) signalBackpressure(client *Client, throttled bool, queued int) {
+	if client.conn == nil || b.maintenance.isOn() {
+		return
+	}
+	data, err := json.Marshal(map[string]map[string]map[string]BackpressureD{"": {"@system": {"backpressure": {throttled, queued}}}})
+	if err != nil {
+		return
+	}
+	seen := make(map[*App]bool)
+	for _, route := range client.routes {
+		if app := b.getApp(route); app != nil && !seen[app] {
+			seen[app] = true
+			client.forward(app, route, data, nil)
+		}
+	}
+}
+
+// isMinorPatch returns true if data only sets buffer entries, or their fields, i.e. keys "card data N" or
+// "card data N field", as apps publishing at high frequency do; N is -1 to append to list buffers. Such updates can
+// be skipped for clients falling behind, as long as the pages they were meant for are resent in full later.
+func isMinorPatch(data []byte) bool {
+	var ops map[string]json.RawMessage
+	if err := json.Unmarshal(data, &ops); err != nil || len(ops) != 1 || ops["d"] == nil {
+		return false
+	}
+	var deltas []struct {
+		K string          `json:"k"`
+		C json.RawMessage `json:"c"`
+		F json.RawMessage `json:"f"`
+		M json.RawMessage `json:"m"`
+		D json.RawMessage `json:"d"`
+		B json.RawMessage `json:"b"`
+	}
+	if err := json.Unmarshal(ops["d"], &deltas); err != nil || len(deltas) == 0 {
+		return false
+	}
+	for _, op := range deltas {
+		if op.C != nil || op.F != nil || op.M != nil || op.D != nil || op.B != nil || !isBufferEntryKey(op.K) {
+			return false
+		}
+	}
+	return true
+}
+
+// isBufferEntryKey returns true if k is "card data N" or "card data N field", for an integer N >= -1.
+func isBufferEntryKey(k string) bool {
+	parts := strings.Split(k, keySeparator)
+	if len(parts) != 3 && len(parts) != 4 || parts[1] != "data" {
+		return false
+	}
+	i, err := strconv.Atoi(parts[2])
+	return err == nil && i >= -1
+}
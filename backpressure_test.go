@@ -0,0 +1,113 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestThrottleClient(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	broker := newBroker(newSite(), false, false, true)
+	broker.backpressure = BackpressurePolicy{Depth: 2}
+	alice := newClient("test", nil, anonymous, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	broker.addClient("/ticker", alice)
+	no(broker.site.patch("/ticker", benchmarkPatch))
+
+	clients := broker.clients["/ticker"]
+	minor := Pub{"/ticker", []byte(`{"d":[{"k":"card data -1","v":[1,2]}]}`), nil, nil}
+	major := Pub{"/ticker", []byte(`{"d":[{"k":"card title","v":"Title"}]}`), nil, nil}
+	broker.sendAll(clients, minor)
+	broker.sendAll(clients, minor)
+	ok(!alice.throttle.throttled, "keeping up")
+	broker.sendAll(clients, minor) // falling behind
+	ok(alice.throttle.throttled, "throttled")
+	eq(len(alice.data), 2)
+	broker.sendAll(clients, major) // not skipped
+	eq(len(alice.data), 3)
+
+	broker.unthrottle()
+	ok(alice.throttle.throttled, "still behind")
+	for len(alice.data) > 0 {
+		<-alice.data
+	}
+	broker.unthrottle()
+	ok(!alice.throttle.throttled, "caught up")
+	eq(len(broker.throttled), 0)
+	eq(string(<-alice.data), string(broker.site.at("/ticker").marshal())) // stale page resent in full
+}
+
+func TestIsMinorPatch(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	ok(isMinorPatch([]byte(`{"d":[{"k":"card data -1","v":[1,2]},{"k":"card data 3 price","v":1}]}`)), "buffer entries")
+	ok(!isMinorPatch([]byte(`{"d":[{"k":"card title","v":"Title"}]}`)), "attribute")
+	ok(!isMinorPatch([]byte(`{"d":[{"k":"card items 0 label","v":"x"}]}`)), "nested attribute")
+	ok(!isMinorPatch([]byte(`{"d":[{"k":"card data x","v":[1]}]}`)), "not an index")
+	ok(!isMinorPatch([]byte(`{"d":[{"k":"card data -2","v":[1]}]}`)), "bad index")
+	ok(!isMinorPatch([]byte(`{"d":[{"k":"card data 0 price extra","v":1}]}`)), "too deep")
+	ok(!isMinorPatch([]byte(`{"d":[{"k":"card data -1","v":[1,2]},{"k":"card"}]}`)), "card deleted")
+	ok(!isMinorPatch([]byte(`{"d":[{"k":"card data","c":{"f":["x"],"d":[],"n":10,"i":0}}]}`)), "buffer replaced")
+	ok(!isMinorPatch([]byte(`{"p":{"c":{}}}`)), "page")
+	ok(!isMinorPatch([]byte(`{"d":[]}`)), "empty")
+}
+
+func TestUnthrottlePartially(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	broker := newBroker(newSite(), false, false, true)
+	broker.backpressure = BackpressurePolicy{Depth: 2}
+	alice := newClient("test", nil, anonymous, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	alice.data = make(chan []byte, 1)
+	broker.addClient("/a", alice)
+	broker.addClient("/b", alice)
+	broker.apps["/a"] = newApp(broker, []string{"/a"}, &RegisterApp{Route: "/a"}, &AppInstance{}, roundRobinBalancing)
+	alice.throttle = Backpressure{throttled: true, stale: map[string]bool{"/a": true, "/b": true}}
+	broker.throttled[alice] = true
+	atomic.AddInt64(&metrics.throttled, 1)
+
+	broker.unthrottle() // room for one page only
+	ok(alice.throttle.throttled, "still throttled")
+	eq(len(alice.throttle.stale), 1)
+	<-alice.data
+	broker.unthrottle()
+	ok(!alice.throttle.throttled, "caught up")
+	eq(len(alice.data), 1)
+	eq(len(alice.queries), 0) // streams are not signaled
+}
+
+func TestEvictedClientDisconnects(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	broker := newBroker(newSite(), false, false, true)
+	go broker.run()
+	alice := newClient("test", nil, anonymous, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	stop := alice.start() // as when the websocket opens
+	alice.subscribe("/ticker")
+	for !watching(broker, "/ticker") {
+		time.Sleep(time.Millisecond)
+	}
+	for watching(broker, "/ticker") { // never reads; evicted once its queue fills up
+		no(broker.patch("/ticker", benchmarkPatch, "test"))
+	}
+	ok(!alice.send([]byte("{}")), "no sends to evicted clients")
+
+	stop() // websocket closes
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	no(broker.ping(ctx))
+}
@@ -16,10 +16,14 @@ package wave
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"sort"
+	"strconv"
 	"sync"
+	"time"
 )
 
 // MsgT represents message types.
@@ -52,6 +56,8 @@ var (
 type Pub struct {
 	route string
 	data  []byte
+	delta []byte // data reduced to card deltas, for clients that accept them; nil if same as data
+	span  *Span  // traces the broadcast, if sampled
 }
 
 // Sub represents a subscription.
@@ -60,21 +66,60 @@ type Sub struct {
 	client *Client
 }
 
+// Rewire represents a change of an app's mode, requiring clients watching the app to watch other routes.
+type Rewire struct {
+	app  *App
+	from AppMode
+	to   AppMode
+}
+
 // Broker represents a message broker.
 type Broker struct {
-	site        *Site
-	editable    bool
-	noStore     bool
-	noLog       bool
-	clients     map[string]map[*Client]interface{} // route => client-set
-	publish     chan Pub
-	subscribe   chan Sub
-	unsubscribe chan *Client
-	logout      chan Pub
-	apps        map[string]*App // route => app
-	appsMux     sync.RWMutex    // mutex for tracking apps
-	unicasts    map[string]bool // "/client_id" => true
-	unicastsMux sync.RWMutex    // mutex for tracking unicast routes
+	site         *Site
+	editable     bool
+	noStore      bool
+	noLog        bool
+	clients      map[string]map[*Client]interface{} // route => client-set
+	clientsMux   sync.RWMutex                       // mutex for reading clients outside of run(); written only by run()
+	publish      chan Pub
+	subscribe    chan Sub
+	unsubscribe  chan *Client
+	logout       chan Pub
+	rewire       chan Rewire
+	notices      chan Notice
+	announce     chan Announce   // messages for all clients, or those watching a route
+	apps         map[string]*App // route => app
+	dropped      map[string]bool // routes served by apps since dropped; guarded by appsMux
+	appsMux      sync.RWMutex    // mutex for tracking apps
+	unicasts     map[string]bool // "/client_id" => true
+	unicastsMux  sync.RWMutex    // mutex for tracking unicast routes
+	hooks        *Webhooks       // page lifecycle webhooks, if any
+	clientHooks  *Webhooks       // client connect, disconnect and watch webhooks, if any
+	storage      *PageStorage    // external page storage, if any
+	uploads      *UploadIndex    // uploaded files, if tracked
+	aliases      RouteAliases    // route aliases and redirects, if any
+	settingsMux  sync.RWMutex    // guards aliases and appMessages, which can be reloaded at runtime
+	appBalancing string          // load balancing strategy across app instances
+	appTimeout   time.Duration   // deadline for delivering each query to an app; 0 for none
+	appSlowQuery time.Duration   // queries apps take longer than this to accept are logged; 0 to disable
+	appCircuit   CircuitPolicy   // circuit breaker configuration for apps
+	appLocal     bool            // accept only apps at unix domain sockets or loopback addresses?
+	appTokens    *AppTokens      // per-app authentication tokens, if enabled
+	appMessages  AppMessageACL   // routes each app route can send messages to
+	scheduler    *Scheduler      // cron schedules for timer queries to apps
+	supervisor   *Supervisor     // app processes launched by the server, if any
+	queries      *QueryBuffer    // queries held while apps restart, if enabled
+	reloader     *Reloader       // reloads settings at runtime, if enabled
+	errorPages   *ErrorPages     // custom error output, if any
+	edits        *EditAudit      // audit log of page edits made by people, if enabled
+	dashboard    *AdminDashboard // the server's status page, if enabled
+	maintenance  *Maintenance    // maintenance mode, if enabled
+	coalescer    *Coalescer      // merges high-frequency patches, if enabled
+	appWorkers   int             // max queries delivered to each app at the same time; 0 for no limit
+	frameLimits  FrameLimits     // limits on the frames messages to clients are coalesced into
+	backpressure BackpressurePolicy
+	throttled    map[*Client]bool // clients falling behind, with minor updates skipped; accessed only by the run loop
+	pings        chan chan struct{}
 }
 
 func newBroker(site *Site, editable, noStore, noLog bool) *Broker {
@@ -84,28 +129,138 @@ func newBroker(site *Site, editable, noStore, noLog bool) *Broker {
 		noStore,
 		noLog,
 		make(map[string]map[*Client]interface{}),
+		sync.RWMutex{},
 		make(chan Pub, 1024),     // TODO tune
 		make(chan Sub, 1024),     // TODO tune
 		make(chan *Client, 1024), // TODO tune
 		make(chan Pub, 1024),     // TODO tune
+		make(chan Rewire, 16),
+		make(chan Notice, 1024), // TODO tune
+		make(chan Announce, 16),
 		make(map[string]*App),
+		make(map[string]bool),
 		sync.RWMutex{},
 		make(map[string]bool),
 		sync.RWMutex{},
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		sync.RWMutex{},
+		roundRobinBalancing,
+		0,
+		0,
+		CircuitPolicy{},
+		false,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		0,
+		FrameLimits{},
+		BackpressurePolicy{},
+		make(map[*Client]bool),
+		make(chan chan struct{}),
+	}
+}
+
+// appContext returns a context for delivering a query to an app, with the app request timeout, if any.
+func (b *Broker) appContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if b.appTimeout > 0 {
+		return context.WithTimeout(parent, b.appTimeout)
 	}
+	return context.WithCancel(parent)
 }
 
-func (b *Broker) addApp(mode, route, addr, keyID, keySecret string) {
-	s := newApp(b, mode, route, addr, keyID, keySecret)
+// addApp registers an app on behalf of a tenant, if any, replacing any apps previously registered at the same routes.
+func (b *Broker) addApp(tenant string, q *RegisterApp) error {
+	return b.addAppInstance(tenant, q, newAppInstance)
+}
 
+// addAppInstance registers an app like addApp, with newInstance creating the instance serving the app.
+func (b *Broker) addAppInstance(tenant string, q *RegisterApp, newInstance func(*RegisterApp) (*AppInstance, error)) error {
+	if err := checkAppRegistration(q); err != nil {
+		return err
+	}
+	if b.appLocal && !isLocalAppAddress(q.Address) {
+		return fmt.Errorf("app address not local: %s", q.Address)
+	}
+	routes := []string{tenantRoute(tenant, q.Route)}
+	for _, route := range q.Routes {
+		routes = append(routes, tenantRoute(tenant, route))
+	}
+	if err := b.appTokens.check(routes, q.token); err != nil {
+		return err
+	}
+	instance, err := newInstance(q)
+	if err != nil {
+		return err
+	}
+	if app := b.getApp(routes[0]); app != nil && app.accepts(routes, q) { // another instance
+		replaced := app.addInstance(instance)
+		echo(Log{"t": "app_add", "route": app.route, "host": q.Address, "transport": instance.info.Transport, "version": q.Version})
+		if replaced { // restarted, having lost the state of the clients it served; reload them, as for a lone instance
+			for _, route := range routes {
+				b.resetSubscribers(route)
+			}
+		}
+		return nil
+	}
+
+	s := newApp(b, routes, q, instance, b.appBalancing)
+
+	var orphans []*App // replaced apps no longer serving any route
 	b.appsMux.Lock()
-	b.apps[route] = s
+	for _, route := range routes {
+		delete(b.dropped, route)
+		if prev, ok := b.apps[route]; ok {
+			b.apps[route] = s
+			if !b.serves(prev) {
+				orphans = append(orphans, prev)
+			}
+			continue
+		}
+		b.apps[route] = s
+	}
 	b.appsMux.Unlock()
 
-	echo(Log{"t": "app_add", "route": route, "host": addr})
+	for _, app := range orphans {
+		app.close()
+	}
 
-	// Force-reload all browsers listening to this app
-	b.resetSubscribers(route)
+	echo(Log{"t": "app_add", "route": s.route, "host": q.Address, "transport": s.instances[0].info.Transport, "version": q.Version})
+	b.scheduler.setApp(s.route, q.Schedules)
+
+	for _, route := range routes {
+		if queries, ok := b.queries.close(route); ok { // restarted; deliver held queries instead of reloading browsers
+			go b.flush(s, route, queries)
+			continue
+		}
+		// Force-reload all browsers listening to this app
+		b.resetSubscribers(route)
+	}
+	return nil
+}
+
+// flush delivers queries held while an app restarted.
+func (b *Broker) flush(app *App, route string, queries []BufferedQuery) {
+	if len(queries) > 0 {
+		echo(Log{"t": "app_flush", "route": route, "queries": strconv.Itoa(len(queries))})
+	}
+	for _, q := range queries {
+		if b.maintenance.hold(route, q.client, q.data) { // delivered once maintenance ends
+			continue
+		}
+		q.client.forward(app, route, q.data, nil)
+	}
 }
 
 func (b *Broker) getApp(route string) *App {
@@ -118,21 +273,122 @@ func (b *Broker) getApps() []*App {
 	b.appsMux.RLock()
 	defer b.appsMux.RUnlock()
 	var apps []*App
-	for _, app := range b.apps {
-		apps = append(apps, app)
+	for route, app := range b.apps {
+		if route == app.route { // skip additional routes
+			apps = append(apps, app)
+		}
 	}
 	return apps
 }
 
+// serves returns true if app serves any route; must be called under lock.
+func (b *Broker) serves(app *App) bool {
+	for _, route := range app.routes {
+		if b.apps[route] == app {
+			return true
+		}
+	}
+	return false
+}
+
+// appInfos returns the registration details of all apps, sorted by route.
+func (b *Broker) appInfos() []AppInfo {
+	b.appsMux.RLock()
+	infos := []AppInfo{}
+	for route, app := range b.apps {
+		if route != app.route { // skip additional routes
+			continue
+		}
+		infos = append(infos, b.appInfo(app))
+	}
+	b.appsMux.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Route < infos[j].Route })
+	return infos
+}
+
+// appInfo returns the registration details of an app. Must be called with appsMux held.
+func (b *Broker) appInfo(app *App) AppInfo {
+	info := app.stat()
+	info.Route, info.Routes = app.route, nil // include tenant, if any
+	for _, r := range app.routes[1:] {
+		if b.apps[r] == app { // not since taken over by another app
+			info.Routes = append(info.Routes, r)
+		}
+	}
+	return info
+}
+
+// routeInfo returns the details of the app serving route, if any, or of the app's restart, if it is restarting.
+func (b *Broker) routeInfo(route string) (AppInfo, bool) {
+	b.appsMux.RLock()
+	app, ok := b.apps[route]
+	if ok {
+		info := b.appInfo(app)
+		b.appsMux.RUnlock()
+		return info, true
+	}
+	b.appsMux.RUnlock()
+	if b.queries.waiting(route) {
+		return AppInfo{Route: route, Status: appRestarting, Instances: []AppInstanceInfo{}}, true
+	}
+	return AppInfo{}, false
+}
+
+// dropApp unregisters the app at route.
 func (b *Broker) dropApp(route string) {
+	if app := b.getApp(route); app != nil {
+		b.removeApp(app)
+	}
+}
+
+// dropAppInstance unregisters the instance at addr of the app at route, and the app itself if no instances remain.
+func (b *Broker) dropAppInstance(route, addr string) {
+	if app := b.getApp(route); app != nil {
+		if app.dropInstance(addr) == 0 {
+			b.removeApp(app)
+			return
+		}
+		echo(Log{"t": "app_drop", "route": route, "host": addr})
+	}
+}
+
+// removeApp unregisters an app from all the routes it serves, unless since replaced by another app.
+func (b *Broker) removeApp(app *App) {
+	var routes []string
 	b.appsMux.Lock()
-	delete(b.apps, route)
+	for _, route := range app.routes {
+		if b.apps[route] == app {
+			delete(b.apps, route)
+			b.dropped[route] = true
+			routes = append(routes, route)
+		}
+	}
 	b.appsMux.Unlock()
 
-	echo(Log{"t": "app_drop", "route": route})
+	app.close()
+
+	if len(routes) == 0 { // already removed
+		return
+	}
 
-	// Force-reload all browsers listening to this app
-	b.resetSubscribers(route)
+	echo(Log{"t": "app_drop", "route": app.route})
+	if b.getApp(app.route) == nil {
+		b.scheduler.dropApp(app.route)
+		metrics.appLatency.drop(app.route)
+		metrics.slowQueries.drop(app.route)
+	}
+
+	for _, route := range routes {
+		if b.queries != nil { // hold queries in case the app is restarting
+			route := route
+			b.queries.open(route, func(dropped int) {
+				echoError(Log{"t": "app_wait", "route": route, "dropped": strconv.Itoa(dropped), "error": "app did not register again in time"})
+				b.appGone(route)
+			})
+			continue
+		}
+		b.appGone(route)
+	}
 }
 
 func parseMsgT(s []byte) MsgT {
@@ -151,18 +407,80 @@ func parseMsgT(s []byte) MsgT {
 	return badMsgT
 }
 
-func parseMsg(s []byte) Msg {
+// MsgError represents a message from a browser that could not be parsed.
+type MsgError struct {
+	Code   string // one of msgBadType, msgOversized, msgMalformed
+	Detail string
+}
+
+const (
+	msgBadType   = "bad_type"
+	msgOversized = "oversized"
+	msgMalformed = "malformed"
+)
+
+func (e *MsgError) Error() string {
+	return e.Code + ": " + e.Detail
+}
+
+// reply returns the error op sent back to the browser.
+func (e *MsgError) reply() []byte {
+	msg, _ := json.Marshal(OpsD{E: e.Code, X: e.Detail})
+	return msg
+}
+
+// parseMsg parses a message sent by a browser. Fails on unknown types, messages larger than maxMessageSize,
+// missing routes, and patches or queries that are not JSON objects.
+func parseMsg(s []byte) (Msg, error) {
+	if len(s) > maxMessageSize {
+		return invalidMsg, &MsgError{msgOversized, fmt.Sprintf("message size %d exceeds limit %d", len(s), maxMessageSize)}
+	}
 	// protocol: t<sep>addr<sep>data
-	parts := bytes.SplitN(s, msgSep, 3)
-	if len(parts) == 3 {
-		t, addr, data := parts[0], parts[1], parts[2]
-		action := parseMsgT(t)
-		if action == badMsgT {
-			return invalidMsg
+	t, rest, found := cutMsg(s)
+	if !found {
+		return invalidMsg, &MsgError{msgMalformed, "want type, route and data separated by spaces"}
+	}
+	addr, data, found := cutMsg(rest)
+	if !found {
+		return invalidMsg, &MsgError{msgMalformed, "want type, route and data separated by spaces"}
+	}
+	action := parseMsgT(t)
+	switch action {
+	case badMsgT:
+		return invalidMsg, &MsgError{msgBadType, fmt.Sprintf("unknown message type %.16q", t)}
+	case noopMsgT:
+		return Msg{action, string(addr), data}, nil
+	}
+	if len(addr) == 0 {
+		return invalidMsg, &MsgError{msgMalformed, "missing route"}
+	}
+	if action == patchMsgT || action == queryMsgT {
+		if err := checkJSONObject(data); err != nil {
+			return invalidMsg, &MsgError{msgMalformed, err.Error()}
 		}
-		return Msg{action, string(addr), data}
 	}
-	return invalidMsg
+	return Msg{action, string(addr), data}, nil
+}
+
+// cutMsg slices s around the first separator, without allocating.
+func cutMsg(s []byte) (before, after []byte, found bool) {
+	if i := bytes.Index(s, msgSep); i >= 0 {
+		return s[:i], s[i+len(msgSep):], true
+	}
+	return s, nil, false
+}
+
+func checkJSONObject(b []byte) error {
+	if !json.Valid(b) { // unmarshal only to explain why; json.Valid does not allocate
+		var raw json.RawMessage
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return err
+		}
+	}
+	if b = bytes.TrimLeft(b, " \t\r\n"); len(b) == 0 || b[0] != '{' {
+		return errors.New("want JSON object")
+	}
+	return nil
 }
 
 func (b *Broker) isUnicast(route string) bool {
@@ -172,25 +490,112 @@ func (b *Broker) isUnicast(route string) bool {
 	return ok
 }
 
-// patch broadcasts changes to clients and patches site data.
-func (b *Broker) patch(route string, data []byte) {
-	b.publish <- Pub{route, data}
+// patch patches site data on behalf of actor (see PageEvent), and broadcasts changes to clients.
+// Fails only if the patch would exceed the page's quota, in which case the patch is discarded.
+func (b *Broker) patch(route string, data []byte, actor string) error {
+	return b.tracePatch(context.Background(), route, data, actor)
+}
+
+// tracePatch is like patch, tracing the broadcast as a child of the span in ctx, if any.
+func (b *Broker) tracePatch(ctx context.Context, route string, data []byte, actor string) error {
+	var (
+		delta    []byte
+		deltas   []OpD
+		coalesce = b.coalescer.window(route) > 0
+	)
+
+	b.uploads.reference(data, time.Now()) // including unicast pages, which are not stored
+
+	kind := pagePatched
+	if bytes.Equal(data, dropPageMsg) {
+		kind = pageDeleted
+	}
+
+	// Skip writes if storage is disabled or unicast apps without -editable
+	if !b.noStore && (b.editable || !b.isUnicast(route)) {
+		if kind == pagePatched && b.site.at(route) == nil {
+			kind = pageCreated
+		}
+		var err error
+		deltas, err = b.site.update(route, data, true, actor)
+		if err != nil {
+			if qerr, ok := err.(*QuotaError); ok {
+				echoError(Log{"t": "broker_patch", "route": route, "error": qerr.Error()})
+				return qerr
+			}
+			if err == errPageUnavailable { // nothing changed; don't tell clients otherwise
+				echoError(Log{"t": "broker_patch", "route": route, "error": err.Error()})
+				return err
+			}
+			echoError(Log{"t": "broker_patch", "error": err.Error()})
+		} else {
+			b.storage.mark(route)
+			b.storage.relay(route, data)
+			if len(deltas) > 0 && !coalesce && b.isWatched(route) { // no point marshaling deltas nobody will receive
+				if d, err := marshalOps(OpsD{D: deltas}); err == nil && len(d) < len(data) {
+					delta = d
+				}
+			}
+		}
+	}
+
+	var span *Span
+	if spanFrom(ctx) != nil {
+		_, span = startSpan(ctx, "wave.broadcast", spanInternal)
+		span.set("wave.route", route)
+	}
+	if !coalesce || !b.coalescer.add(route, data, deltas) {
+		b.publish <- Pub{route, data, delta, span}
+	} else { // broadcast later, in a batch
+		span.set("wave.coalesced", "true")
+		span.finish()
+	}
 
 	if !b.noLog {
 		// Write AOF entry with patch marker "*" as-is to log file.
 		// FIXME bufio.Scanner.Scan() is not reliable if line length > 65536 chars,
 		// so reading back in is unreliable.
-		log.Println("*", route, string(data))
+		logAOF(patchMarker, route, data)
 	}
 
-	// Skip writes if storage is disabled or unicast apps without -editable
-	if b.noStore || (!b.editable && b.isUnicast(route)) {
+	b.hooks.firePage(kind, route, actor)
+	return nil
+}
+
+// relayed applies a patch received from another replica, and broadcasts it to clients.
+func (b *Broker) relayed(route string, data []byte) {
+	if err := b.site.patch(route, data); err != nil {
+		echoError(Log{"t": "broker_relayed", "route": route, "error": err.Error()})
 		return
 	}
+	b.publish <- Pub{route, data, nil, nil}
+}
 
-	if err := b.site.patch(route, data); err != nil {
-		echo(Log{"t": "broker_patch", "error": err.Error()})
+// resynced replaces the page at url with a copy read back from the page store, with the patches of other replicas
+// this replica missed, and sends it to the page's watchers; removes the page if no longer stored.
+func (b *Broker) resynced(url string, data []byte) {
+	if data == nil {
+		b.site.del(url)
+		b.publish <- Pub{url, b.missingPage(url), nil, nil}
+		return
 	}
+	if err := b.site.set(url, data); err != nil {
+		echoError(Log{"t": "page_store_resync", "url": url, "error": err.Error()})
+		return
+	}
+	b.publish <- Pub{url, data, nil, nil}
+}
+
+// deletePage removes the page at url, and tells its watchers the page is gone.
+func (b *Broker) deletePage(url, actor string) {
+	b.coalescer.flush(url) // so that patches batched earlier are not broadcast after the page is gone
+	b.site.del(url)
+	b.storage.remove(url)
+	if !b.noLog {
+		logAOF(patchMarker, url, dropPageMsg)
+	}
+	b.publish <- Pub{url, b.missingPage(url), nil, nil}
+	b.hooks.firePage(pageDeleted, url, actor)
 }
 
 func init() {
@@ -201,21 +606,42 @@ func init() {
 }
 
 func (b *Broker) resetSubscribers(route string) {
-	b.publish <- Pub{route, resetMsg}
+	b.publish <- Pub{route, resetMsg, nil, nil}
 }
 
 func (b *Broker) resetClients(session *Session) {
-	b.logout <- Pub{session.subject, resetMsg}
+	b.logout <- Pub{session.subject, resetMsg, nil, nil}
 	apps := b.getApps()
 	for _, app := range apps {
 		go func(app *App) {
-			app.forward("", session, logoutMsg)
+			app.broadcast(app.info.Route, "", session, logoutMsg)
 		}(app)
 	}
 }
 
+// isWatched returns true if any client is watching a route.
+func (b *Broker) isWatched(route string) bool {
+	b.clientsMux.RLock()
+	defer b.clientsMux.RUnlock()
+	return len(b.clients[route]) > 0
+}
+
+// marshalOps marshals ops for broadcast. Ops are marshaled once per route, and the same slice is fanned out to
+// every client watching the route, so the slice must not be modified once published.
+// Ops are marshaled with encoding/json: the fan-out, not the encoding, dominates a broadcast (see BenchmarkMarshalOps
+// and BenchmarkBroadcast).
+func marshalOps(ops OpsD) ([]byte, error) {
+	return json.Marshal(ops)
+}
+
 // run starts i/o between the broker and clients.
 func (b *Broker) run() {
+	var unthrottle <-chan time.Time
+	if b.backpressure.enabled() {
+		ticker := time.NewTicker(backpressureInterval)
+		defer ticker.Stop()
+		unthrottle = ticker.C
+	}
 	for {
 		select {
 		case sub := <-b.subscribe:
@@ -224,8 +650,12 @@ func (b *Broker) run() {
 			b.dropClient(client)
 		case pub := <-b.publish:
 			if clients, ok := b.clients[pub.route]; ok {
-				b.sendAll(clients, pub.data)
+				n := b.sendAll(clients, pub)
+				metrics.routes.broadcast(b.statsRoute(pub.route), n)
+				pub.span.set("wave.clients", strconv.Itoa(len(clients)))
+				pub.span.set("wave.bytes", strconv.Itoa(n))
 			}
+			pub.span.finish()
 		case pub := <-b.logout:
 			targets := make(map[*Client]interface{})
 			// TODO speed up using another map?
@@ -236,37 +666,217 @@ func (b *Broker) run() {
 					}
 				}
 			}
-			b.sendAll(targets, pub.data)
+			b.sendAll(targets, pub)
+		case r := <-b.rewire:
+			b.rewireClients(r)
+		case n := <-b.notices:
+			b.notifyClient(n)
+		case a := <-b.announce:
+			b.sendAll(b.announcees(a), Pub{data: a.Data})
+		case <-unthrottle:
+			b.unthrottle()
+		case pong := <-b.pings:
+			close(pong)
+		}
+	}
+}
+
+// notifyClient sends a notice to the client it is meant for, if still connected.
+func (b *Broker) notifyClient(n Notice) {
+	for _, clients := range b.clients {
+		for client := range clients {
+			if client.id == n.client && client.progress && client.session.subject == n.subject {
+				if !client.send(n.data) {
+					b.dropClient(client)
+				}
+				return
+			}
 		}
 	}
 }
 
-func (b *Broker) sendAll(clients map[*Client]interface{}, data []byte) {
+// sendAll sends a message to clients, returning the number of bytes sent. Clients share pub's slices, as is, without
+// copying.
+func (b *Broker) sendAll(clients map[*Client]interface{}, pub Pub) int {
+	n, minor := 0, 0
 	for client := range clients {
-		if !client.send(data) {
+		if b.throttle(client, pub, &minor) {
+			continue
+		}
+		data := pub.data
+		if pub.delta != nil && client.deltas {
+			data = pub.delta
+		}
+		if client.send(data) {
+			n += len(data)
+		} else {
 			b.dropClient(client)
 		}
 	}
+	return n
+}
+
+// statsRoute returns the route to record traffic on route against; the routes of unicast clients are lumped together.
+func (b *Broker) statsRoute(route string) string {
+	if b.isUnicast(route) {
+		return unicastStatsRoute
+	}
+	return route
+}
+
+// subscriberCounts returns the number of clients watching each route, by stats route (see statsRoute).
+func (b *Broker) subscriberCounts() map[string]int {
+	watchers := make(map[string]int)
+	b.clientsMux.RLock()
+	for route, clients := range b.clients {
+		watchers[route] = len(clients)
+	}
+	b.clientsMux.RUnlock()
+	counts := make(map[string]int)
+	for route, n := range watchers {
+		counts[b.statsRoute(route)] += n
+	}
+	return counts
+}
+
+// forwardStats returns the state of the apps' forward pools, summed across apps.
+func (b *Broker) forwardStats() ForwardStats {
+	stats := ForwardStats{Workers: b.appWorkers}
+	for _, app := range b.getApps() {
+		s := app.forwards.stats()
+		stats.Busy += s.Busy
+		stats.Waiting += s.Waiting
+	}
+	return stats
+}
+
+// clientInfos returns the details of all connected clients, oldest first.
+func (b *Broker) clientInfos() []ClientInfo {
+	routes := make(map[*Client][]string)
+	b.clientsMux.RLock()
+	for route, clients := range b.clients {
+		for client := range clients {
+			routes[client] = append(routes[client], route)
+		}
+	}
+	b.clientsMux.RUnlock()
+	infos := []ClientInfo{}
+	for client, rs := range routes {
+		infos = append(infos, client.info(rs))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Connected.Before(infos[j].Connected) })
+	return infos
+}
+
+// getClient returns the connected client with the given ID, if any.
+func (b *Broker) getClient(id string) *Client {
+	b.clientsMux.RLock()
+	defer b.clientsMux.RUnlock()
+	for _, clients := range b.clients {
+		for client := range clients {
+			if client.id == id {
+				return client
+			}
+		}
+	}
+	return nil
 }
 
 func (b *Broker) addClient(route string, client *Client) {
+	b.clientsMux.Lock()
 	clients, ok := b.clients[route]
 	if !ok {
 		clients = make(map[*Client]interface{})
 		b.clients[route] = clients
 	}
 	clients[client] = nil
+	client.routes = append(client.routes, route)
+	b.clientsMux.Unlock()
 
 	b.unicastsMux.Lock()
-	b.unicasts["/"+client.id] = true
+	b.unicasts[client.route()] = true
 	b.unicastsMux.Unlock()
 
-	echo(Log{"t": "ui_add", "addr": client.addr, "route": route})
+	echo(client.fields(Log{"t": "ui_add", "route": route}))
+}
+
+// removeClient stops sending the client changes to route.
+func (b *Broker) removeClient(route string, client *Client) {
+	b.clientsMux.Lock()
+	if clients, ok := b.clients[route]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(b.clients, route)
+		}
+	}
+	routes := client.routes[:0]
+	for _, r := range client.routes {
+		if r != route {
+			routes = append(routes, r)
+		}
+	}
+	client.routes = routes
+	b.clientsMux.Unlock()
+
+	echo(client.fields(Log{"t": "ui_remove", "route": route}))
+}
+
+// rewireClients moves clients watching an app from the routes its previous mode writes pages to,
+// to the routes its current mode writes pages to, without reconnecting them.
+func (b *Broker) rewireClients(r Rewire) {
+	watching := make(map[*Client]interface{})
+	for _, route := range r.app.routes {
+		for client := range b.clients[route] {
+			watching[client] = nil
+		}
+	}
+	for client := range watching {
+		if route := client.modeRoute(r.from); len(route) > 0 && !b.watchesOther(client, r.app, r.from) {
+			b.removeClient(route, client)
+		}
+		if route := client.modeRoute(r.to); len(route) > 0 {
+			b.addClient(route, client)
+		}
+	}
+}
+
+// watchesOther returns true if the client watches an app other than app in the given mode,
+// i.e. one still writing pages to the same client- or user-level route.
+func (b *Broker) watchesOther(client *Client, app *App, mode AppMode) bool {
+	for _, route := range client.routes {
+		if other := b.getApp(route); other != nil && other != app && other.getMode() == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// setAppMode changes the mode of a registered app, on behalf of a tenant, if any.
+// token is the app's app token, if it authenticated with one.
+func (b *Broker) setAppMode(tenant string, q *SetAppMode, token string) error {
+	route := tenantRoute(tenant, q.Route)
+	if err := b.appTokens.check([]string{route}, token); err != nil {
+		return err
+	}
+	app := b.getApp(route)
+	if app == nil {
+		return errAppUnavailable
+	}
+	from, err := app.setMode(q.Mode)
+	if err != nil {
+		return err
+	}
+	echo(Log{"t": "app_mode", "route": app.route, "mode": q.Mode})
+	if to := toAppMode(q.Mode); to != from {
+		b.rewire <- Rewire{app, from, to}
+	}
+	return nil
 }
 
 func (b *Broker) dropClient(client *Client) {
 	var gc []string
 
+	b.clientsMux.Lock()
 	for _, route := range client.routes {
 		if clients, ok := b.clients[route]; ok {
 			delete(clients, client)
@@ -276,20 +886,24 @@ func (b *Broker) dropClient(client *Client) {
 		}
 	}
 
-	client.quit()
-
 	for _, route := range gc {
 		delete(b.clients, route)
 	}
+	b.clientsMux.Unlock()
+
+	if !client.quit() { // already dropped, e.g. for falling behind
+		return
+	}
+	b.unthrottled(client)
 
 	// FIXME leak: this is not captured in the AOF logging; page will be recreated on hydration
-	b.site.del(client.id) // delete transient page, if any.
+	b.site.del(client.route()) // delete transient page, if any.
 
 	b.unicastsMux.Lock()
-	delete(b.unicasts, "/"+client.id)
+	delete(b.unicasts, client.route())
 	b.unicastsMux.Unlock()
 
-	echo(Log{"t": "ui_drop", "addr": client.addr})
+	echo(client.fields(Log{"t": "ui_drop"}))
 }
 
 // routes returns a sorted slice of routes managed by this broker.
@@ -0,0 +1,53 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package wave
+
+import (
+	"testing"
+)
+
+func FuzzParseMsg(f *testing.F) {
+	f.Add([]byte(`@ /foo {"bar":true}`))
+	f.Add([]byte(`+ /foo section-2`))
+	f.Add([]byte(`* /foo {"d":[{"k":"a b","v":1}]}`))
+	f.Add([]byte(`# `))
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		m, err := parseMsg(msg)
+		if err != nil {
+			merr, ok := err.(*MsgError)
+			if !ok {
+				t.Fatalf("want *MsgError, got %T", err)
+			}
+			switch merr.Code {
+			case msgBadType, msgOversized, msgMalformed:
+			default:
+				t.Fatalf("unknown error code %q", merr.Code)
+			}
+			if m.t != badMsgT {
+				t.Fatalf("want invalid message on error, got %v", m)
+			}
+			return
+		}
+		if m.t == badMsgT {
+			t.Fatalf("want error for invalid message %q", msg)
+		}
+		if (m.t == patchMsgT || m.t == queryMsgT) && checkJSONObject(m.data) != nil {
+			t.Fatalf("accepted %q without a JSON object", msg)
+		}
+	})
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestParseMsg(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+
+	m, err := parseMsg([]byte(`@ /foo {"bar":true}`))
+	no(err)
+	eq(m, Msg{queryMsgT, "/foo", []byte(`{"bar":true}`)})
+
+	m, err = parseMsg([]byte(`+ /foo `))
+	no(err)
+	eq(m.t, watchMsgT)
+	eq(m.addr, "/foo")
+
+	m, err = parseMsg([]byte(`+ /foo section-2`))
+	no(err)
+	eq(string(m.data), "section-2")
+
+	m, err = parseMsg([]byte(`* /foo {"d":[{"k":"a b","v":1}]}`))
+	no(err)
+	eq(m.t, patchMsgT)
+
+	bad := []struct {
+		msg  string
+		code string
+	}{
+		{``, msgMalformed},
+		{`+ /foo`, msgMalformed},
+		{`!  /foo {}`, msgBadType},
+		{`++ /foo {}`, msgBadType},
+		{`@  {}`, msgMalformed},
+		{`@ /foo `, msgMalformed},
+		{`@ /foo {"bar":`, msgMalformed},
+		{`@ /foo [1,2]`, msgMalformed},
+		{`* /foo "d"`, msgMalformed},
+		{`* /foo {} {}`, msgMalformed},
+		{`@ /foo {` + string(make([]byte, maxMessageSize)) + `}`, msgOversized},
+	}
+	for _, b := range bad {
+		m, err := parseMsg([]byte(b.msg))
+		merr, isMsgError := err.(*MsgError)
+		ok(isMsgError, b.msg)
+		eq(merr.Code, b.code)
+		eq(m, invalidMsg)
+	}
+}
+
+var benchmarkQuery = []byte(`@ /demo {"":{"#":"menu"},"form":{"name":"Alice","subscribe":true,"tags":["a","b","c"]},"submit":true}`)
+
+func BenchmarkParseMsg(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parseMsg(benchmarkQuery)
+	}
+}
+
+func BenchmarkParseMsgPatch(b *testing.B) {
+	msg := append([]byte("* /demo "), benchmarkPatch...)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parseMsg(msg)
+	}
+}
+
+var benchmarkDeltas = []OpD{{K: "card.content", V: "More content"}, {K: "card.items.0.value", V: 42.0}, {K: "plot.data.3", V: []interface{}{"x", 1.0, 2.0}}}
+
+// BenchmarkMarshalOps measures marshaling deltas for broadcast, the only JSON encoding on the path of a patch.
+func BenchmarkMarshalOps(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		marshalOps(OpsD{D: benchmarkDeltas})
+	}
+}
+
+func TestClientInfos(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	broker := newBroker(newSite(), false, false, true)
+	go broker.run()
+	alice := newClient("192.0.2.1", nil, &Session{subject: "123", username: "alice"}, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	alice.subscribe("/foo")
+	alice.subscribe("/bar")
+	for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+		broker.clientsMux.RLock()
+		subscribed = len(broker.clients["/bar"]) == 1
+		broker.clientsMux.RUnlock()
+	}
+	alice.send([]byte("{}"))
+
+	infos := broker.clientInfos()
+	eq(len(infos), 1)
+	info := infos[0]
+	eq(info.ID, alice.id)
+	eq(info.Addr, "192.0.2.1")
+	eq(info.Subject, "123")
+	eq(info.Routes, []string{"/bar", "/foo"})
+	eq(info.Queue, 1)
+	ok(broker.getClient(alice.id) == alice, "found")
+	ok(broker.getClient("nobody") == nil, "not found")
+}
+
+const benchmarkSubscribers = 10000
+
+var benchmarkDelta = []byte(`{"d":[{"k":"card.content","v":"More content"}]}`)
+
+// BenchmarkBroadcast fans out patches to many clients watching the same route.
+func BenchmarkBroadcast(b *testing.B) {
+	broker := newBroker(newSite(), false, false, true)
+	go broker.run()
+	broker.patch("/demo", benchmarkPatch, "")
+	for i := 0; i < benchmarkSubscribers; i++ {
+		c := newClient("192.0.2.1", nil, anonymous, "", broker, nil, false, true, false, browserProtocolVersion, "/")
+		go func() {
+			for range c.data {
+			}
+		}()
+		c.subscribe("/demo")
+	}
+	broker.ping(context.Background())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		broker.patch("/demo", benchmarkDelta, "")
+	}
+	broker.ping(context.Background())
+}
+
+func TestAppModeSwitch(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	broker := newBroker(newSite(), false, true, true)
+	no(broker.addApp("", &RegisterApp{Route: "/demo", Address: "http://127.0.0.1:8000", Modes: []string{"unicast", "multicast"}}))
+	app := broker.getApp("/demo")
+	alice := newClient("192.0.2.1", nil, &Session{subject: "alice"}, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	broker.addClient("/demo", alice)
+	broker.addClient(alice.route(), alice) // as when watching a unicast app
+	watching := func(route string) bool {
+		_, ok := broker.clients[route][alice]
+		return ok
+	}
+
+	ok(broker.setAppMode("", &SetAppMode{Route: "/missing", Mode: "multicast"}, "") == errAppUnavailable, "no app")
+	ok(broker.setAppMode("", &SetAppMode{Route: "/demo", Mode: "anycast"}, "") != nil, "bad mode")
+	ok(broker.setAppMode("", &SetAppMode{Route: "/demo", Mode: "broadcast"}, "") != nil, "mode not supported by the app")
+	eq(broker.setAppMode("", &SetAppMode{Route: "/demo", Mode: "multicast"}, "token"), errBadAppToken)
+	eq(app.getMode(), unicastMode)
+
+	no(broker.setAppMode("", &SetAppMode{Route: "/demo", Mode: "multicast"}, ""))
+	eq(app.getMode(), multicastMode)
+	eq(broker.appInfos()[0].Mode, "multicast")
+	broker.rewireClients(<-broker.rewire)
+	ok(!watching(alice.route()), "client-level route dropped")
+	ok(watching("/alice"), "user-level route watched")
+	ok(watching("/demo"), "app route still watched")
+
+	no(broker.setAppMode("", &SetAppMode{Route: "/demo", Mode: "multicast"}, "")) // unchanged
+	select {
+	case <-broker.rewire:
+		t.Fatal("rewired without a change of mode")
+	default:
+	}
+
+	app.modes = nil
+	no(broker.setAppMode("", &SetAppMode{Route: "/demo", Mode: "broadcast"}, ""))
+	broker.rewireClients(<-broker.rewire)
+	ok(!watching("/alice"), "user-level route dropped")
+	eq(alice.routes, []string{"/demo"})
+	broker.dropApp("/demo")
+}
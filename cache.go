@@ -29,19 +29,21 @@ type Shard struct {
 	items map[string][]byte
 }
 
-// Cache represents a collection of shards.
+// Cache represents a collection of shards. With tenancy, each tenant has its own shards.
 type Cache struct {
 	sync.RWMutex
 	prefix         string
 	keychain       *keychain.Keychain
-	shards         map[string]*Shard
+	tenancy        *Tenancy
+	shards         map[string]*Shard // tenant route of shard => shard
 	maxRequestSize int64
 }
 
-func newCache(prefix string, keychain *keychain.Keychain, maxRequestSize int64) *Cache {
+func newCache(prefix string, keychain *keychain.Keychain, tenancy *Tenancy, maxRequestSize int64) *Cache {
 	return &Cache{
 		prefix:         prefix,
 		keychain:       keychain,
+		tenancy:        tenancy,
 		shards:         make(map[string]*Shard),
 		maxRequestSize: maxRequestSize,
 	}
@@ -53,6 +55,7 @@ func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s, k := c.parse(r.URL.Path)
+	s = tenantRoute(c.tenancy.ofKey(r), "/"+s)
 	switch r.Method {
 	case http.MethodGet:
 		if len(k) > 0 {
@@ -70,7 +73,7 @@ func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPut:
 		v, err := readRequestWithLimit(w, r.Body, c.maxRequestSize)
 		if err != nil {
-			echo(Log{"t": "read cache request body", "error": err.Error()})
+			echoError(Log{"t": "read cache request body", "error": err.Error()})
 			if isRequestTooLarge(err) {
 				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
 				return
@@ -0,0 +1,88 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// CacheRule represents the Cache-Control header to send for static files matching a pattern.
+// Patterns ending with "/" match files in a directory and its subdirectories, e.g. "wave-static/"; patterns without
+// a "/" match file names anywhere, e.g. "*.woff2"; other patterns match file paths, e.g. "assets/*.png".
+// Paths are relative to the web root.
+type CacheRule struct {
+	Pattern string
+	Value   string
+}
+
+// CachePolicy represents the Cache-Control rules for static files, in order of precedence.
+type CachePolicy []CacheRule
+
+// defaultCachePolicy lets browsers and CDNs keep the UI's bundles, which are content-hashed, indefinitely.
+var defaultCachePolicy = CachePolicy{
+	{"wave-static/", "public, max-age=31536000, immutable"},
+}
+
+// validate returns an error if any pattern is malformed.
+func (p CachePolicy) validate() error {
+	for _, rule := range p {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("bad cache-control pattern %q: %v", rule.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// match returns the Cache-Control value for a file, or false if no rule matches.
+func (p CachePolicy) match(name string) (string, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	for _, rule := range p {
+		if rule.matches(name) {
+			return rule.Value, true
+		}
+	}
+	return "", false
+}
+
+func (rule CacheRule) matches(name string) bool {
+	pattern := rule.Pattern
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(name, strings.TrimPrefix(pattern, "/"))
+	}
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+	ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), name)
+	return ok
+}
+
+// wrap returns a handler that sets the Cache-Control header for files in root served by h.
+// Missing files are left alone, so that errors are not cached.
+func (p CachePolicy) wrap(root http.FileSystem, h http.Handler) http.Handler {
+	if len(p) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if value, ok := p.match(r.URL.Path); ok {
+			if _, exists := fileETag(root, r.URL.Path); exists {
+				w.Header().Set("Cache-Control", value)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestCachePolicy(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	no(os.MkdirAll(filepath.Join(dir, "wave-static", "fonts"), 0o700))
+	for _, name := range []string{"index.html", "favicon.ico", "wave-static/index-abc123.js", "wave-static/fonts/x.woff2"} {
+		no(ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0o600))
+	}
+	policy := append(CachePolicy{{"*.ico", "public, max-age=60"}}, defaultCachePolicy...)
+	no(policy.validate())
+
+	root := http.Dir(dir)
+	h := policy.wrap(root, http.FileServer(root))
+	cacheControl := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Header().Get("Cache-Control")
+	}
+
+	code, value := cacheControl("/wave-static/index-abc123.js")
+	eq(code, http.StatusOK)
+	eq(value, "public, max-age=31536000, immutable")
+	_, value = cacheControl("/wave-static/fonts/x.woff2")
+	eq(value, "public, max-age=31536000, immutable")
+	_, value = cacheControl("/favicon.ico")
+	eq(value, "public, max-age=60")
+	code, value = cacheControl("/wave-static/missing.js")
+	eq(code, http.StatusNotFound)
+	eq(value, "") // errors are not cached
+	_, found := policy.match("index.html")
+	ok(!found, "no rule for index.html")
+
+	ok(CachePolicy{{"[", "no-cache"}}.validate() != nil, "bad pattern")
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	circuitClosed   = "closed"    // queries flow normally
+	circuitOpen     = "open"      // queries fail fast
+	circuitHalfOpen = "half-open" // a single probe query is allowed through
+)
+
+// Circuit represents a circuit breaker guarding an app.
+//
+// The circuit trips (opens) after a number of consecutive failed queries, failing further queries fast instead
+// of piling them up on an unhealthy app. After a cool-down period, the next query is let through as a probe:
+// if it succeeds, the circuit closes; if not, the circuit opens again for another cool-down period.
+type Circuit struct {
+	sync.Mutex
+	threshold int           // consecutive failures to trip the circuit
+	cooldown  time.Duration // time to wait before probing
+	state     string
+	failures  int       // consecutive failures
+	opened    time.Time // when last opened
+	probing   bool      // probe in flight?
+	trips     int       // times opened
+}
+
+// CircuitPolicy represents the configuration of app circuit breakers.
+type CircuitPolicy struct {
+	Failures int           // consecutive failures to trip the circuit; 0 disables circuit breakers
+	Cooldown time.Duration // time to wait before probing
+}
+
+// CircuitStats represents the state of a circuit breaker, as reported by the admin API.
+type CircuitStats struct {
+	State string `json:"state"`
+	Trips int    `json:"trips"`
+}
+
+// newCircuit creates a circuit breaker, or nil (always closed) if threshold is 0.
+func newCircuit(threshold int, cooldown time.Duration) *Circuit {
+	if threshold <= 0 {
+		return nil
+	}
+	return &Circuit{threshold: threshold, cooldown: cooldown, state: circuitClosed}
+}
+
+// allow returns true if a query can be sent now. Safe to call on a nil circuit.
+func (c *Circuit) allow(now time.Time) bool {
+	if c == nil {
+		return true
+	}
+	c.Lock()
+	defer c.Unlock()
+	switch c.state {
+	case circuitOpen:
+		if now.Sub(c.opened) < c.cooldown {
+			return false
+		}
+		c.state, c.probing = circuitHalfOpen, true
+		return true
+	case circuitHalfOpen:
+		if c.probing {
+			return false
+		}
+		c.probing = true
+		return true
+	}
+	return true
+}
+
+// record records the outcome of a query allowed by allow(), and returns the new state if the state changed.
+// A query that was abandoned (e.g. because the client disconnected) should be recorded via release() instead.
+// Safe to call on a nil circuit.
+func (c *Circuit) record(ok bool, now time.Time) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.Lock()
+	defer c.Unlock()
+	prev := c.state
+	c.probing = false
+	if ok {
+		c.failures = 0
+		c.state = circuitClosed
+	} else {
+		c.failures++
+		if c.state == circuitHalfOpen || c.failures >= c.threshold {
+			if c.state != circuitOpen {
+				c.trips++
+			}
+			c.state, c.opened = circuitOpen, now
+		}
+	}
+	return c.state, c.state != prev
+}
+
+// release abandons a query allowed by allow(), without counting it for or against the app. Safe to call on a nil circuit.
+func (c *Circuit) release() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	c.probing = false
+	c.Unlock()
+}
+
+// stats returns the circuit's state, or nil if the circuit is disabled.
+func (c *Circuit) stats() *CircuitStats {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	return &CircuitStats{c.state, c.trips}
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestCircuit(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	now := time.Now()
+	c := newCircuit(2, time.Second)
+
+	ok(c.allow(now))
+	_, changed := c.record(false, now)
+	ok(!changed)
+	ok(c.allow(now))
+	state, changed := c.record(false, now)
+	ok(changed)
+	eq(circuitOpen, state)
+
+	ok(!c.allow(now.Add(500 * time.Millisecond))) // cooling down
+
+	later := now.Add(time.Second)
+	ok(c.allow(later))  // probe
+	ok(!c.allow(later)) // one probe at a time
+	state, _ = c.record(false, later)
+	eq(circuitOpen, state)
+	ok(!c.allow(later))
+
+	later = later.Add(time.Second)
+	ok(c.allow(later))
+	c.release() // abandoned probe
+	ok(c.allow(later))
+	state, changed = c.record(true, later)
+	ok(changed)
+	eq(circuitClosed, state)
+	ok(c.allow(later))
+	eq(2, c.stats().Trips)
+
+	disabled := newCircuit(0, time.Second)
+	ok(disabled == nil)
+	ok(disabled.allow(now))
+	_, changed = disabled.record(false, now)
+	ok(!changed)
+	ok(disabled.stats() == nil)
+}
@@ -17,6 +17,13 @@ package wave
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -35,17 +42,41 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 1 * 1024 * 1024 // bytes
+
+	// Maximum message size read from peer. Messages larger than maxMessageSize are rejected with an error reply;
+	// messages larger than this close the socket.
+	maxFrameSize = 2 * maxMessageSize
 )
 
+var errClientGone = errors.New("client disconnected")
+
+// queryErrorCodes maps errors delivering a query to an app to the error codes reported to the browser.
+var queryErrorCodes = map[error]string{
+	errAppTimeout:     "app_timeout",
+	errAppCircuitOpen: "app_unavailable",
+}
+
 var (
 	newline     = []byte{'\n'}
 	notFoundMsg = []byte(`{"e":"not_found"}`)
 	upgrader    = websocket.Upgrader{
-		ReadBufferSize:  1024, // TODO review
-		WriteBufferSize: 1024, // TODO review
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,         // frames larger than this are streamed in fragments
+		WriteBufferPool: &sync.Pool{}, // share write buffers between idle connections
 	}
 )
 
+// FrameLimits represents limits on the frames queued messages are coalesced into before being written to a client.
+type FrameLimits struct {
+	Size     int // max bytes per frame; a lone message larger than this is written as is; 0 for no limit
+	Messages int // max messages per frame; 0 for no limit
+}
+
+// fits returns true if a message of the given size can be appended to a frame of the given size and message count.
+func (l FrameLimits) fits(size, count, next int) bool {
+	return (l.Messages <= 0 || count < l.Messages) && (l.Size <= 0 || size+len(newline)+next <= l.Size)
+}
+
 // Boot represents the initial message sent to an app when a client first connects to it
 type Boot struct {
 	Hash string `json:"#,omitempty"` // location hash
@@ -55,18 +86,112 @@ type Boot struct {
 type Client struct {
 	id       string          // unique id
 	auth     *Auth           // auth provider, might be nil
-	addr     string          // remote IP:port, used for logging only
+	addr     string          // remote IP, used for logging only
 	session  *Session        // end-user session
+	tenant   string          // tenant, if any
 	broker   *Broker         // broker
 	conn     *websocket.Conn // connection
-	routes   []string        // watched routes
+	routes   []string        // watched routes; accessed only by the broker's run loop
 	data     chan []byte     // send data
 	editable bool            // allow editing? // TODO move to user; tie to role
+	deltas   bool            // accepts card deltas in lieu of whole cards?
+	progress bool            // wants upload progress events?
+	version  int             // browser protocol version
 	baseURL  string
+	queries  chan appQuery      // queries to be forwarded to apps, in order
+	ctx      context.Context    // canceled when the client disconnects
+	cancel   context.CancelFunc // cancels ctx
+	relayMux sync.RWMutex       // guards relaying ops from apps against the client disconnecting
+	stats    *ClientStats       // traffic, for the access log
+	throttle Backpressure       // throttling state, if falling behind; accessed only by the broker's run loop
+	dataMux  sync.RWMutex       // guards sending data against closing it
+	closed   bool               // data closed; guarded by dataMux
+}
+
+// ClientStats represents the traffic of a websocket session.
+type ClientStats struct {
+	sent     int64           // bytes sent; accessed atomically
+	received int64           // bytes received; accessed only by the client's listen loop
+	opened   time.Time       // when the session started
+	routes   map[string]bool // routes watched or queried; accessed only by the client's listen loop
+}
+
+// visit records a route watched or queried by the client, up to a limit.
+func (s *ClientStats) visit(route string) {
+	if len(s.routes) < maxAccessLogRoutes {
+		s.routes[route] = true
+	}
+}
+
+func (s *ClientStats) sentBytes() int64 {
+	return atomic.LoadInt64(&s.sent)
+}
+
+// ClientInfo represents a connected client, as reported by the admin API.
+type ClientInfo struct {
+	ID        string    `json:"id"`
+	Addr      string    `json:"addr"`
+	Subject   string    `json:"subject,omitempty"` // end-user, if signed in
+	Tenant    string    `json:"tenant,omitempty"`
+	Routes    []string  `json:"routes"`    // routes watched, sorted
+	Queue     int       `json:"queue"`     // messages waiting to be sent to the client
+	Queries   int       `json:"queries"`   // queries waiting to be forwarded to apps
+	Sent      int64     `json:"sent"`      // bytes sent
+	Connected time.Time `json:"connected"` // when the client connected
 }
 
-func newClient(addr string, auth *Auth, session *Session, broker *Broker, conn *websocket.Conn, editable bool, baseURL string) *Client {
-	return &Client{uuid.New().String(), auth, addr, session, broker, conn, nil, make(chan []byte, 256), editable, baseURL}
+// info returns the details of the client, watching routes.
+func (c *Client) info(routes []string) ClientInfo {
+	sort.Strings(routes)
+	info := ClientInfo{
+		ID:        c.id,
+		Addr:      c.addr,
+		Tenant:    c.tenant,
+		Routes:    routes,
+		Queue:     len(c.data),
+		Queries:   len(c.queries),
+		Sent:      c.stats.sentBytes(),
+		Connected: c.stats.opened,
+	}
+	if c.session != nil {
+		info.Subject = c.session.subject
+	}
+	return info
+}
+
+// disconnect closes the client's socket, which ends the client's session.
+func (c *Client) disconnect() {
+	echo(c.fields(Log{"t": "client_disconnect"}))
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// appQuery represents a message from a client pending delivery to an app.
+type appQuery struct {
+	app   *App
+	route string
+	data  []byte
+	span  *Span // traces the query, if sampled
+}
+
+func newClient(addr string, auth *Auth, session *Session, tenant string, broker *Broker, conn *websocket.Conn, editable, deltas, progress bool, version int, baseURL string) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{uuid.New().String(), auth, addr, session, tenant, broker, conn, nil, make(chan []byte, 256), editable, deltas, progress, version, baseURL, make(chan appQuery, maxClientQueries), ctx, cancel, sync.RWMutex{}, &ClientStats{opened: time.Now(), routes: make(map[string]bool)}, Backpressure{}, sync.RWMutex{}, false}
+}
+
+// fields adds the client's ID, remote address and end-user's subject to a log message.
+func (c *Client) fields(m Log) Log {
+	m["client"], m["addr"] = c.id, c.addr
+	if c.session != nil && len(c.session.subject) > 0 {
+		m["subject"] = c.session.subject
+	}
+	return m
+}
+
+// route returns the client-level (unicast) route.
+func (c *Client) route() string {
+	return tenantRoute(c.tenant, "/"+c.id)
 }
 
 func (c *Client) refreshToken() error {
@@ -77,19 +202,46 @@ func (c *Client) refreshToken() error {
 
 		token, err := c.auth.ensureValidOAuth2Token(ctx, c.session.token)
 		if err != nil {
+			c.auth.record(auditRefreshFailure, c.session, c.addr, err.Error())
 			return err
 		}
+		if c.session.token != token {
+			c.auth.record(auditRefresh, c.session, c.addr, "")
+		}
 		c.session.token = token
 	}
 	return nil
 }
 
+// start starts delivering the client's queries to apps, returning a function that stops delivery, and
+// unsubscribes the client.
+func (c *Client) start() func() {
+	dispatched := make(chan struct{})
+	go func() {
+		c.dispatch()
+		close(dispatched)
+	}()
+	return func() {
+		c.cancel()        // abandon queries in flight
+		c.relayMux.Lock() // wait for ops being relayed from apps
+		c.relayMux.Unlock()
+		<-dispatched // stop sending before the broker closes the client
+		c.broker.unsubscribe <- c
+	}
+}
+
 func (c *Client) listen() {
+	atomic.AddInt64(&metrics.connections, 1)
+	stop := c.start()
 	defer func() {
-		c.broker.unsubscribe <- c
+		stop()
 		c.conn.Close()
+		atomic.AddInt64(&metrics.connections, -1)
+		accessLog.session(c, c.stats)
+		c.broker.clientHooks.fireClient(clientDisconnected, c, "")
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
+	c.broker.clientHooks.fireClient(clientConnected, c, "")
+	c.conn.SetReadLimit(maxFrameSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -99,88 +251,283 @@ func (c *Client) listen() {
 		_, msg, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				echo(Log{"t": "socket_read", "client": c.addr, "err": err.Error()})
+				echoWarn(c.fields(Log{"t": "socket_read", "error": err.Error()}))
 			}
 			break
 		}
+		c.stats.received += int64(len(msg))
+		c.handle(msg)
+	}
+}
+
+// handle processes a message from the client.
+func (c *Client) handle(msg []byte) {
+	if err := c.refreshToken(); err != nil {
+		// token refresh failed, this is not fatal err, try next time
+		// TODO kick user out?
+		echoWarn(c.fields(Log{"t": "refresh_oauth2_token", "error": err.Error()}))
+	}
 
-		if err := c.refreshToken(); err != nil {
-			// token refresh failed, this is not fatal err, try next time
-			// TODO kick user out?
-			echo(Log{"t": "refresh_oauth2_token", "client": c.addr, "err": err.Error()})
+	m, err := parseMsg(msg)
+	metrics.received.inc(msgTypeNames[m.t])
+	if err != nil {
+		echoWarn(c.fields(Log{"t": "bad_message", "error": err.Error()}))
+		if merr, ok := err.(*MsgError); ok && c.version >= 2 { // older browsers treat all errors as fatal
+			c.send(merr.reply())
 		}
+		return
+	}
+	route := resolveURL(m.addr, c.baseURL)
+	if target, ok := c.broker.routeAliases().redirect(route); ok && m.t == watchMsgT {
+		u := c.baseURL + strings.TrimPrefix(target, "/")
+		if len(m.data) > 0 { // location hash
+			u += "#" + string(m.data)
+		}
+		if msg, err := json.Marshal(OpsD{U: u}); err == nil {
+			c.send(msg)
+		}
+		return
+	}
+	m.addr = tenantRoute(c.tenant, c.broker.routeAliases().serve(route))
 
-		if c.session != nil && c.auth != nil {
-			if err := c.session.touch(c.auth.conf.InactivityTimeout); err != nil {
-				if msg, err := json.Marshal(OpsD{U: c.baseURL + "_auth/logout"}); err == nil {
-					c.send(msg)
-				}
-				continue
+	if c.session != nil && c.auth != nil {
+		if err := c.session.touch(c.auth.inactivityTimeout(m.addr)); err != nil {
+			c.auth.record(auditExpiry, c.session, c.addr, err.Error())
+			if msg, err := json.Marshal(OpsD{U: c.baseURL + "_auth/logout"}); err == nil {
+				c.send(msg)
 			}
+			return
+		}
+	}
+
+	if c.broker.dashboard.denies(m.addr, c.session) {
+		echoWarn(c.fields(Log{"t": "admin_dashboard", "route": m.addr, "error": "not an admin"}))
+		if m.t == watchMsgT {
+			c.send(notFoundMsg)
 		}
+		return
+	}
 
-		m := parseMsg(msg)
-		m.addr = resolveURL(m.addr, c.baseURL)
-		switch m.t {
-		case patchMsgT:
-			if c.editable { // allow only if editing is enabled
-				c.broker.patch(m.addr, m.data)
+	switch m.t {
+	case patchMsgT:
+		if c.editable { // allow only if editing is enabled
+			actor := "user:" + c.session.subject
+			if err := c.broker.edits.record(m.addr, actor, c.addr, m.data); err != nil {
+				if msg, err := json.Marshal(OpsD{E: "edit_not_recorded"}); err == nil {
+					c.send(msg)
+				}
+				return
 			}
-		case queryMsgT:
-			app := c.broker.getApp(m.addr)
-			if app == nil {
-				echo(Log{"t": "query", "client": c.addr, "route": m.addr, "error": "service unavailable"})
-				continue
+			if err := c.broker.patch(m.addr, m.data, actor); err != nil {
+				ops := OpsD{E: err.Error()}
+				if _, ok := err.(*QuotaError); ok { // rejected in its entirety; the page is still valid
+					ops = OpsD{E: "quota_exceeded", X: err.Error()}
+				}
+				if msg, err := json.Marshal(ops); err == nil {
+					c.send(msg)
+				}
+				return
+			}
+		}
+	case queryMsgT:
+		c.stats.visit(m.addr)
+		_, span := startSpan(context.Background(), "wave.query", spanServer)
+		span.set("wave.route", m.addr)
+		span.set("wave.client", c.id)
+		if c.broker.maintenance.hold(m.addr, c, m.data) {
+			span.set("wave.held", "true")
+			span.finish()
+			return
+		}
+		app := c.broker.getApp(m.addr)
+		if app == nil {
+			if c.broker.queries.hold(m.addr, c, m.data) { // app restarting
+				span.set("wave.held", "true")
+				span.finish()
+				return
 			}
-			app.forward(c.id, c.session, m.data)
-		case watchMsgT:
-			c.subscribe(m.addr) // subscribe even if page is currently NA
+			span.fail(errAppUnavailable)
+			span.finish()
+			echoError(c.fields(Log{"t": "query", "route": m.addr, "error": "service unavailable"}))
+			return
+		}
+		echoDebug(c.fields(Log{"t": "query", "route": m.addr}))
+		c.forward(app, m.addr, m.data, span)
+	case watchMsgT:
+		c.stats.visit(m.addr)
+		c.broker.clientHooks.fireClient(clientWatched, c, m.addr)
+		c.subscribe(m.addr) // subscribe even if page is currently NA
+		if notice := c.broker.maintenance.getNotice(); notice != nil {
+			c.send(notice)
+		}
 
-			if app := c.broker.getApp(m.addr); app != nil { // do we have an app handling this route?
-				switch app.mode {
-				case unicastMode:
-					c.subscribe("/" + c.id) // client-level
-				case multicastMode:
-					c.subscribe("/" + c.session.subject) // user-level
-				}
+		if app := c.broker.getApp(m.addr); app != nil { // do we have an app handling this route?
+			if route := c.modeRoute(app.getMode()); len(route) > 0 {
+				c.subscribe(route)
+			}
 
-				boot := emptyJSON
-				if len(m.data) > 0 { // location hash
-					if j, err := json.Marshal(Boot{Hash: string(m.data)}); err == nil {
-						boot = j
-					}
+			boot := emptyJSON
+			if len(m.data) > 0 { // location hash
+				if j, err := json.Marshal(Boot{Hash: string(m.data)}); err == nil {
+					boot = j
 				}
+			}
 
-				app.forward(c.id, c.session, boot)
-				continue
+			_, span := startSpan(context.Background(), "wave.watch", spanServer)
+			span.set("wave.route", m.addr)
+			span.set("wave.client", c.id)
+			if c.broker.maintenance.hold(m.addr, c, boot) {
+				span.set("wave.held", "true")
+				span.finish()
+				return
 			}
+			c.forward(app, m.addr, boot, span)
+			return
+		}
+
+		if headers, err := json.Marshal(OpsD{M: &Meta{Username: c.session.username, Editor: c.editable, Version: browserProtocolVersion}}); err == nil {
+			c.send(headers)
+		}
 
-			if headers, err := json.Marshal(OpsD{M: &Meta{Username: c.session.username, Editor: c.editable}}); err == nil {
-				c.send(headers)
+		if page := c.broker.site.at(m.addr); page != nil { // is page?
+			if data := page.marshal(); data != nil {
+				c.send(data)
+				return
 			}
+		}
+
+		c.send(c.broker.missingPage(m.addr))
+	}
+}
+
+// forward queues data to be sent to an app on behalf of the client. Queries are delivered in order, without
+// blocking the client's socket unless maxClientQueries are already waiting, and are abandoned if the client
+// disconnects. The span, if any, is finished once the query is delivered.
+func (c *Client) forward(app *App, route string, data []byte, span *Span) {
+	if c.ctx.Err() != nil {
+		span.fail(errClientGone)
+		span.finish()
+		return
+	}
+	atomic.AddInt64(&metrics.pendingQueries, 1)
+	select {
+	case c.queries <- appQuery{app, c.appRoute(route), data, span}:
+	case <-c.ctx.Done():
+		atomic.AddInt64(&metrics.pendingQueries, -1)
+		span.fail(errClientGone)
+		span.finish()
+	}
+}
 
-			if page := c.broker.site.at(m.addr); page != nil { // is page?
-				if data := page.marshal(); data != nil {
-					c.send(data)
-					continue
+// abandon drops the queries still queued once the client has disconnected.
+func (c *Client) abandon() {
+	for {
+		select {
+		case q := <-c.queries:
+			atomic.AddInt64(&metrics.pendingQueries, -1)
+			q.span.fail(errClientGone)
+			q.span.finish()
+		default:
+			return
+		}
+	}
+}
+
+// dispatch delivers queued queries to apps until the client disconnects.
+func (c *Client) dispatch() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			c.abandon()
+			return
+		case q := <-c.queries:
+			atomic.AddInt64(&metrics.pendingQueries, -1)
+			if !q.app.forwards.acquire(c.ctx) {
+				q.span.fail(errClientGone)
+				q.span.finish()
+				c.abandon()
+				return
+			}
+			ctx, cancel := c.broker.appContext(withSpan(c.ctx, q.span))
+			err := q.app.forward(ctx, q.route, c.id, c.session, q.data, c)
+			cancel()
+			q.app.forwards.release()
+			q.span.fail(err)
+			q.span.finish()
+			if err == errAppUnavailable && c.broker.queries.hold(tenantRoute(c.tenant, q.route), c, q.data) { // app restarting
+				continue
+			}
+			if code, ok := queryErrorCodes[err]; ok { // the page is still valid; let the browser say so
+				if msg, err := json.Marshal(OpsD{E: code, X: err.Error()}); err == nil {
+					c.send(msg)
 				}
 			}
-
-			c.send(notFoundMsg)
 		}
 	}
 }
 
+// relay sends ops streamed by an app in reply to a query from the client.
+func (c *Client) relay(data []byte) error {
+	var ops OpsD
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return fmt.Errorf("bad ops: %v", err)
+	}
+	msg, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	c.relayMux.RLock()
+	defer c.relayMux.RUnlock()
+	if c.ctx.Err() != nil {
+		return errClientGone
+	}
+	c.send(msg)
+	return nil
+}
+
+// context returns the client's context, which is canceled when the client disconnects, or parent if the client is nil.
+func (c *Client) context(parent context.Context) context.Context {
+	if c == nil {
+		return parent
+	}
+	return c.ctx
+}
+
+// appRoute returns a route on the site as known to the client's apps, i.e. without the client's tenant prefix.
+func (c *Client) appRoute(route string) string {
+	return strings.TrimPrefix(route, tenantRoute(c.tenant, ""))
+}
+
+// modeRoute returns the route the client watches for pages written by apps in the given mode:
+// client-level for unicast apps, user-level for multicast apps, and none for broadcast apps,
+// which write to their own routes.
+func (c *Client) modeRoute(mode AppMode) string {
+	switch mode {
+	case unicastMode:
+		return c.route()
+	case multicastMode:
+		return tenantRoute(c.tenant, "/"+c.session.subject)
+	}
+	return ""
+}
+
 func (c *Client) subscribe(route string) {
-	c.routes = append(c.routes, route)
 	c.broker.subscribe <- Sub{route, c}
 }
 
+// send queues data to be sent to the client, returning false if the client is not keeping up, or has been dropped.
 func (c *Client) send(data []byte) bool {
+	c.dataMux.RLock()
+	defer c.dataMux.RUnlock()
+	if c.closed {
+		return false
+	}
 	select {
 	case c.data <- data:
+		atomic.AddUint64(&metrics.sent, 1)
 		return true
 	default:
+		atomic.AddUint64(&metrics.dropped, 1)
 		return false
 	}
 }
@@ -201,22 +548,11 @@ func (c *Client) flush() {
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
+			size, err := writeBatch(c.conn, data, c.data, c.broker.frameLimits)
 			if err != nil {
 				return
 			}
-			w.Write(data)
-
-			// push queued messages, if any
-			n := len(c.data)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.data)
-			}
-
-			if err := w.Close(); err != nil {
-				return
-			}
+			atomic.AddInt64(&c.stats.sent, int64(size))
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -226,6 +562,55 @@ func (c *Client) flush() {
 	}
 }
 
-func (c *Client) quit() {
+// writeBatch writes data, followed by the messages queued so far, if any, as newline-delimited frames within limits,
+// returning the number of bytes written. Messages are streamed into the connection's write buffer, without being
+// copied into a frame first.
+func writeBatch(conn *websocket.Conn, data []byte, queue chan []byte, limits FrameLimits) (int, error) {
+	w, err := conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return 0, err
+	}
+	// Write errors are sticky, reported by Close.
+	w.Write(data)
+	sent, size, count := 0, len(data), 1
+	for i, n := 0, len(queue); i < n; i++ {
+		next := <-queue
+		if !limits.fits(size, count, len(next)) {
+			if err := closeFrame(w, count); err != nil {
+				return sent, err
+			}
+			sent += size
+			if w, err = conn.NextWriter(websocket.TextMessage); err != nil {
+				return sent, err
+			}
+			size, count = 0, 0
+		}
+		if count > 0 {
+			w.Write(newline)
+			size += len(newline)
+		}
+		w.Write(next)
+		size += len(next)
+		count++
+	}
+	return sent + size, closeFrame(w, count)
+}
+
+// closeFrame completes a frame of count newline-delimited messages, flushing it to the connection.
+func closeFrame(w io.WriteCloser, count int) error {
+	metrics.frameMessages.add("", float64(count))
+	return w.Close()
+}
+
+// quit closes the client's data channel, returning false if already closed: clients dropped by the broker for
+// falling behind are unsubscribed again when they disconnect.
+func (c *Client) quit() bool {
+	c.dataMux.Lock()
+	defer c.dataMux.Unlock()
+	if c.closed {
+		return false
+	}
+	c.closed = true
 	close(c.data)
+	return true
 }
@@ -0,0 +1,59 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"time"
+)
+
+const (
+	clientConnected    = "connect"
+	clientDisconnected = "disconnect"
+	clientWatched      = "watch"
+)
+
+// ClientEvent represents a browser connecting, disconnecting or watching a route, as posted to client webhooks.
+type ClientEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`   // connect, disconnect or watch
+	Client   string    `json:"client"` // client ID
+	Addr     string    `json:"addr"`
+	Subject  string    `json:"subject,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Route    string    `json:"route,omitempty"`    // route watched, for watch events
+	Duration float64   `json:"duration,omitempty"` // seconds connected, for disconnect events
+}
+
+func (e ClientEvent) kind() string { return e.Type }
+
+// newClientHooks returns webhooks posting client events, signed like page events (see Webhooks).
+func newClientHooks(urls []string, secret string, types []string) (*Webhooks, error) {
+	return newWebhooks("client_hook", urls, secret, types, []string{clientConnected, clientDisconnected, clientWatched})
+}
+
+// fireClient queues a client event. Safe to call on nil hooks.
+func (h *Webhooks) fireClient(kind string, c *Client, route string) {
+	if !h.wants(kind) {
+		return
+	}
+	e := ClientEvent{Time: time.Now().UTC(), Type: kind, Client: c.id, Addr: c.addr, Route: route}
+	if c.session != nil {
+		e.Subject, e.Username = c.session.subject, c.session.username
+	}
+	if kind == clientDisconnected {
+		e.Duration = time.Since(c.stats.opened).Seconds()
+	}
+	h.fire(e)
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestClientHooks(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	type post struct {
+		event     ClientEvent
+		kind      string
+		signature string
+	}
+	posts := make(chan post, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var e ClientEvent
+		json.Unmarshal(body, &e)
+		posts <- post{e, r.Header.Get(pageHookEventHeader), r.Header.Get(pageHookSignatureHeader)}
+	}))
+	defer srv.Close()
+
+	h, err := newClientHooks([]string{srv.URL}, "s3cr3t", []string{"watch", "disconnect"})
+	no(err)
+	c := newClient("192.0.2.1", nil, &Session{subject: "123", username: "alice"}, "", nil, nil, false, false, false, browserProtocolVersion, "/")
+	h.fireClient(clientConnected, c, "") // not subscribed
+	h.fireClient(clientWatched, c, "/demo")
+
+	select {
+	case p := <-posts:
+		eq(p.kind, "watch")
+		eq(p.event.Client, c.id)
+		eq(p.event.Subject, "123")
+		eq(p.event.Username, "alice")
+		eq(p.event.Route, "/demo")
+		body, err := json.Marshal(p.event)
+		no(err)
+		eq(p.signature, "sha256="+signPageEvent([]byte("s3cr3t"), body))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event posted")
+	}
+	var none *Webhooks
+	none.fireClient(clientConnected, c, "")
+
+	_, err = newClientHooks([]string{srv.URL}, "", []string{"watch", "connected"})
+	eq(err.Error(), `unknown client_hook event "connected": want one of connect, disconnect, watch`)
+}
+
+func TestWebhooksPerURL(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	stuck := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-stuck }))
+	defer slow.Close()
+	defer close(stuck)
+	posted := make(chan string, 4)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted <- r.Header.Get(pageHookEventHeader)
+	}))
+	defer fast.Close()
+
+	h, err := newPageHooks([]string{slow.URL, fast.URL}, "", nil)
+	no(err)
+	h.firePage(pageCreated, "/a", "gc")
+	h.firePage(pageDeleted, "/a", "gc")
+	for _, want := range []string{pageCreated, pageDeleted} { // not held up by the slow webhook
+		select {
+		case kind := <-posted:
+			eq(kind, want)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event posted")
+		}
+	}
+
+	for i := 0; i < webhookQueueSize+10; i++ { // overflow the slow webhook's queue
+		h.firePage(pagePatched, "/a", "gc")
+	}
+	ok(atomic.LoadInt64(&h.loggedAt) > 0, "first drop logged")
+	ok(atomic.LoadUint64(&h.dropped) > 0, "later drops counted, not logged")
+}
@@ -0,0 +1,36 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+func rotateAppToken(address, id, secret, route string) error {
+	b, err := adminRequest(http.MethodPost, address, id, secret, "app-tokens"+route, nil)
+	if err != nil {
+		return fmt.Errorf("failed rotating app token for %s: %v", route, err)
+	}
+	var reply struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(b, &reply); err != nil {
+		return fmt.Errorf("failed rotating app token for %s: %v", route, err)
+	}
+	fmt.Println(reply.Token)
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Command represents a subcommand, e.g. "keygen".
+type Command struct {
+	name  string
+	args  string // positional arguments, for usage
+	usage string
+}
+
+var commands = []Command{
+	{"serve", "", "run the server (default)"},
+	{"status", "", "print the status of the server at -address"},
+	{"config", "show", "print the effective configuration of the server at -address, and where each setting came from"},
+	{"loadtest", "[route...]", "open -loadtest-clients synthetic clients watching routes (default /loadtest) on the server at -address, while publishing patches, and report latencies"},
+	{"keygen", "", "generate and add a new API access key ID and secret pair to the keychain (like -create-access-key)"},
+	{"export", "<route>", "export the page at route from the server at -address as a JSON snapshot to stdout (like -export-page)"},
+	{"import", "<file> [route]", "import a page from a JSON snapshot file (\"-\" for stdin) to the server at -address, at route if set (like -import-page)"},
+}
+
+// parseCommand splits off the subcommand, if any, from the positional command line arguments.
+func parseCommand(args []string) (string, []string) {
+	if len(args) > 0 {
+		for _, c := range commands {
+			if args[0] == c.name {
+				return c.name, args[1:]
+			}
+		}
+	}
+	return "", args
+}
+
+// parseArgs parses flags interspersed with positional arguments, e.g. "export /foo -address ...",
+// returning the positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args) // exits on error
+		if fs.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// checkArgs exits with usage if the number of positional arguments passed to a command is not within [min, max].
+func checkArgs(command string, args []string, min, max int) {
+	if len(args) >= min && len(args) <= max {
+		return
+	}
+	if len(command) == 0 {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+	} else {
+		fmt.Fprintf(os.Stderr, "wrong number of arguments for %s\n", command)
+	}
+	flag.Usage()
+	os.Exit(2)
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-22s %s\n", c.name+" "+c.args, c.usage)
+	}
+	fmt.Fprintf(out, "\nFlags (before or after the command):\n")
+	flag.PrintDefaults()
+}
@@ -0,0 +1,353 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// loadTestMarker prefixes the publish time, in Unix nanoseconds, embedded in each patch published during a load
+	// test, so that clients can tell how long the patch took to reach them.
+	loadTestMarker = "loadtest:"
+	// loadTestQueryMarker prefixes the send time, in Unix nanoseconds, passed with each query as the loadtest argument,
+	// so that clients can tell which query a reply echoing it answers.
+	loadTestQueryMarker = "loadtest-query:"
+
+	loadTestRequestTimeout = 10 * time.Second // for patches
+	loadTestReplyWait      = 5 * time.Second  // for replies to the last queries, once done querying
+)
+
+var loadTestClient = &http.Client{Timeout: loadTestRequestTimeout}
+
+// LoadTest represents a load test: synthetic browsers watching routes and querying the apps at those routes, while a
+// publisher patches the pages at those routes.
+type LoadTest struct {
+	address       string
+	baseURL       string
+	id            string // API access key ID, for patching
+	secret        string
+	signingSecret string // for signing patches, if the server requires it
+	routes        []string
+	clients       int
+	duration      time.Duration
+	queryRate     float64  // queries per second, per client
+	patchRate     float64  // patches per second, per route
+	queries       [][]byte // scripted queries, sent in turn
+}
+
+// Latencies collects latency samples.
+type Latencies struct {
+	sync.Mutex
+	samples []time.Duration
+	errors  int
+}
+
+func (l *Latencies) add(d time.Duration) {
+	l.Lock()
+	l.samples = append(l.samples, d)
+	l.Unlock()
+}
+
+func (l *Latencies) fail() {
+	l.Lock()
+	l.errors++
+	l.Unlock()
+}
+
+// percentile returns the p-th percentile of sorted samples.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// loadQueries reads scripted queries from a JSON file holding an array of query objects, e.g. [{"submit":true}].
+func loadQueries(file string) ([][]byte, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading queries: %v", err)
+	}
+	var queries []json.RawMessage
+	if err := json.Unmarshal(b, &queries); err != nil {
+		return nil, fmt.Errorf("failed reading queries: want a JSON array of objects: %v", err)
+	}
+	script := make([][]byte, len(queries))
+	for i, q := range queries {
+		if len(q) == 0 || q[0] != '{' {
+			return nil, fmt.Errorf("failed reading queries: query %d is not a JSON object", i+1)
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, q); err != nil { // the protocol is line-oriented
+			return nil, fmt.Errorf("failed reading queries: %v", err)
+		}
+		script[i] = buf.Bytes()
+	}
+	return script, nil
+}
+
+// markedTimes returns the times following each occurrence of marker in msg.
+func markedTimes(msg []byte, marker string) []time.Time {
+	var times []time.Time
+	for {
+		i := bytes.Index(msg, []byte(marker))
+		if i < 0 {
+			return times
+		}
+		msg = msg[i+len(marker):]
+		n := 0
+		for n < len(msg) && msg[n] >= '0' && msg[n] <= '9' {
+			n++
+		}
+		if at, err := strconv.ParseInt(string(msg[:n]), 10, 64); err == nil {
+			times = append(times, time.Unix(0, at))
+		}
+	}
+}
+
+// tagQuery returns a query with the loadtest argument set to the time it is sent at, for the app to echo in its reply.
+func tagQuery(query []byte, at int64) []byte {
+	tag := fmt.Sprintf(`{"loadtest":"%s%d"`, loadTestQueryMarker, at)
+	if bytes.Equal(query, []byte("{}")) {
+		return []byte(tag + "}")
+	}
+	return append([]byte(tag+","), query[1:]...)
+}
+
+// run runs the load test, and prints latency percentiles for connecting, publishing patches, receiving patches,
+// and receiving replies to queries.
+func (t *LoadTest) run() error {
+	if len(t.routes) == 0 {
+		t.routes = []string{"/loadtest"}
+	}
+	u, err := url.Parse(t.address)
+	if err != nil {
+		return fmt.Errorf("bad address: %v", err)
+	}
+	pageURL := strings.TrimSuffix(t.address, "/") + strings.TrimSuffix(t.baseURL, "/")
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(t.baseURL, "/") + "/_s/"
+	u.RawQuery = "caps=deltas&v=2"
+	socketURL := u.String()
+
+	var (
+		connects, publishes, deliveries, replies Latencies
+		connected                                int64
+		wg                                       sync.WaitGroup
+	)
+	deadline := time.Now().Add(t.duration)
+	for _, route := range t.routes { // so that the page exists before clients watch it
+		if err := t.publish(pageURL, route); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < t.clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			route := t.routes[i%len(t.routes)]
+			start := time.Now()
+			conn, _, err := websocket.DefaultDialer.Dial(socketURL, nil)
+			if err != nil {
+				connects.fail()
+				return
+			}
+			connects.add(time.Since(start))
+			atomic.AddInt64(&connected, 1)
+			defer conn.Close()
+
+			var (
+				pending    = make(map[int64]bool) // send times of queries not answered yet
+				pendingMux sync.Mutex
+			)
+			go func() {
+				for {
+					_, b, err := conn.ReadMessage()
+					if err != nil {
+						return
+					}
+					now := time.Now()
+					for _, msg := range bytes.Split(b, []byte{'\n'}) {
+						if bytes.HasPrefix(msg, []byte(`{"p":`)) { // the page, on watching it
+							continue
+						}
+						for _, at := range markedTimes(msg, loadTestMarker) {
+							deliveries.add(now.Sub(at))
+						}
+						pendingMux.Lock()
+						for _, at := range markedTimes(msg, loadTestQueryMarker) {
+							if pending[at.UnixNano()] { // ours, answered for the first time
+								delete(pending, at.UnixNano())
+								replies.add(now.Sub(at))
+							}
+						}
+						pendingMux.Unlock()
+					}
+				}
+			}()
+
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("+ "+route+" ")); err != nil {
+				return
+			}
+			if t.queryRate <= 0 || len(t.queries) == 0 {
+				time.Sleep(time.Until(deadline))
+				return
+			}
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / t.queryRate))
+			defer ticker.Stop()
+			defer func() { // queries never answered
+				for wait := time.Now().Add(loadTestReplyWait); time.Now().Before(wait); time.Sleep(10 * time.Millisecond) {
+					pendingMux.Lock()
+					n := len(pending)
+					pendingMux.Unlock()
+					if n == 0 {
+						break
+					}
+				}
+				pendingMux.Lock()
+				for range pending {
+					replies.fail()
+				}
+				pending = nil
+				pendingMux.Unlock()
+			}()
+			for n := 0; time.Now().Before(deadline); n++ {
+				<-ticker.C
+				at := time.Now().UnixNano()
+				pendingMux.Lock()
+				pending[at] = true
+				pendingMux.Unlock()
+				if err := conn.WriteMessage(websocket.TextMessage, append([]byte("@ "+route+" "), tagQuery(t.queries[n%len(t.queries)], at)...)); err != nil {
+					return
+				}
+			}
+		}(i)
+	}
+
+	if t.patchRate > 0 {
+		interval := time.Duration(float64(time.Second) / t.patchRate)
+		for _, route := range t.routes {
+			wg.Add(1)
+			go func(route string) {
+				defer wg.Done()
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				for time.Now().Before(deadline) {
+					<-ticker.C
+					start := time.Now()
+					if err := t.publish(pageURL, route); err != nil {
+						publishes.fail()
+						continue
+					}
+					publishes.add(time.Since(start))
+				}
+			}(route)
+		}
+	}
+	wg.Wait()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "\tcount\terrors\tp50\tp90\tp99\tmax\t\n")
+	for _, l := range []struct {
+		name string
+		*Latencies
+	}{{"connect", &connects}, {"publish", &publishes}, {"delivery", &deliveries}, {"reply", &replies}} {
+		sort.Slice(l.samples, func(i, j int) bool { return l.samples[i] < l.samples[j] })
+		fmt.Fprintf(w, "%s\t%d\t%d\t%v\t%v\t%v\t%v\t\n", l.name, len(l.samples), l.errors,
+			percentile(l.samples, 50), percentile(l.samples, 90), percentile(l.samples, 99), percentile(l.samples, 100))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\n%d of %d clients connected, watching %d route(s), for %v\n", connected, t.clients, len(t.routes), t.duration)
+	return nil
+}
+
+// publish patches the page at route with a card holding the current time.
+func (t *LoadTest) publish(pageURL, route string) error {
+	body := []byte(fmt.Sprintf(`{"d":[{"k":"loadtest","d":{"view":"markdown","box":"1 1 2 2","title":"Load test","content":"%s%d"}}]}`, loadTestMarker, time.Now().UnixNano()))
+	req, err := http.NewRequest(http.MethodPatch, pageURL+route, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed creating request: %v", err)
+	}
+	req.SetBasicAuth(t.id, t.secret)
+	req.Header.Set("Content-Type", "application/json")
+	if len(t.signingSecret) > 0 {
+		signRequest(req, t.signingSecret, body)
+	}
+	resp, err := loadTestClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed patching %s: %v", route, err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed patching %s: %s: %s", route, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// signRequest signs a patch with secret, with a fresh timestamp and nonce, as servers started with
+// -request-signing-secret expect; see "Request signing" in the security docs.
+func signRequest(r *http.Request, secret string, body []byte) {
+	r.Header.Set("Wave-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	r.Header.Set("Wave-Nonce", uuid.New().String())
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", r.Method, r.URL.Path, r.URL.Query().Encode())
+	var names []string
+	for name := range r.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "wave-") && name != "wave-signature" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(mac, "%s:%s\n", name, strings.Join(r.Header.Values(name), ","))
+	}
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	r.Header.Set("Wave-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+}
@@ -32,6 +32,7 @@ import (
 	"time"
 
 	"github.com/h2oai/wave"
+	"github.com/h2oai/wave/pkg/config"
 	"github.com/h2oai/wave/pkg/keychain"
 )
 
@@ -64,12 +65,79 @@ func main() {
 		conf                 wave.ServerConf
 		auth                 wave.AuthConf
 		version              bool
+		configFile           string
+		autocertEnabled      bool
+		autocertConf         wave.AutocertConf
+		autocertHosts        string
+		noCompression        bool
+		compressMinSize      string
+		compressTypes        wave.Strings
+		corsConf             wave.CORSPolicy
+		corsOrigins          wave.Strings
+		listeners            wave.Strings
+		noSecurityHeaders    bool
+		errorPages           wave.Strings
+		cacheRules           wave.Strings
+		webRoots             wave.Strings
+		traceConf            wave.TraceConf
+		traceSampleRatio     string
+		adminUsers           string
+		accessLogConf        wave.AccessLogConf
+		accessLogMaxSize     string
+		accessLogInterval    string
+		accessLogMaxAge      string
+		logMaxSize           string
+		logInterval          string
+		logMaxAge            string
+		securityHeaders      wave.Strings
+		corsMethods          string
+		corsHeaders          string
+		corsExpose           string
+		corsMaxAge           string
+		rateLimit            string
+		secretRefresh        string
+		oidcClientSecret     string // source; see wave.LoadSecret
+		pageWebhookSecret    string // source
+		clientWebhookSecret  string // source
+		rateLimitBurst       int
 		maxRequestSize       string
+		maxHeaderSize        string
 		maxCacheRequestSize  string
 		maxProxyRequestSize  string
 		maxProxyResponseSize string
 		sessionExpiry        string
 		inactivityTimeout    string
+		routeTimeouts        string
+		coalesceWindows      string
+		logLevel             string
+		maxPageSize          string
+		routePageQuotas      string
+		appPageQuotas        string
+		tenancy              string
+		pageWebhookEvents    string
+		clientWebhookEvents  string
+		pageGCIdleTimeout    string
+		pageGCMaxSize        string
+		maxSiteMemory        string
+		maxFrameSize         string
+		maxUploadSize        string
+		maxUploadFileSize    string
+		uploadChunkSize      string
+		uploadExpiry         string
+		userUploadQuota      string
+		appUploadQuota       string
+		uploadGCIdleTimeout  string
+		fileStoreURLExpiry   string
+		tenantKeys           string
+		routeAliases         string
+		appTimeout           string
+		appSlowQuery         string
+		appCircuitCooldown   string
+		appRestartWait       string
+		clientThrottleAfter  string
+		routeRedirects       string
+		loginAttemptWindow   string
+		loginLockout         string
 		accessKeyID          string
 		accessKeySecret      string
 		accessKeyFile        string
@@ -77,44 +145,169 @@ func main() {
 		createAccessKey      bool
 		listAccessKeys       bool
 		removeAccessKeyID    string
+		accessKeyScope       string
+		requestSigningWindow string
 		rawAuthScopes        string
 		rawAuthURLParams     string
+		address              string
+		exportRoute          string
+		importFile           string
+		importRoute          string
+		exportArchivePrefix  string
+		importArchiveFile    string
+		rotateAppTokenRoute  string
+		status               bool
+		showConfig           bool
+		loadTest             bool
+		loadTestConf         LoadTest
+		loadTestDuration     string
+		loadTestQueries      string
+		appTokenGrace        string
+		appMessages          string
 	)
 
 	flag.BoolVar(&version, "version", false, "print version and exit")
+	stringVar(&configFile, "config", "", "read settings from this YAML (.yaml, .yml) or TOML (.toml) file; environment variables and flags take precedence")
 	stringVar(&conf.Listen, "listen", ":10101", "listen on this address")
 	stringVar(&conf.BaseURL, "base-url", "/", "the base URL (path prefix) to be used for resolving relative URLs (e.g. /foo/ or /foo/bar/, without the host)")
 	stringVar(&conf.WebDir, "web-dir", "./www", "directory to serve web assets from, hosted at /")
+	stringsVar(&webRoots, "web-root", "directory of files to serve in lieu of the web assets at the same paths, e.g. to rebrand the UI with a custom index.html, logo or fonts; multiple directories allowed, earlier ones take precedence")
 	stringVar(&conf.DataDir, "data-dir", "./data", "directory to store site data")
 	stringsVar(&conf.PublicDirs, "public-dir", "additional directory to serve files from, in the format \"[url-path]@[filesystem-path]\", e.g. \"/public/files/@/some/local/path\" will host /some/local/path/foo.txt at /public/files/foo.txt; multiple directory mappings allowed")
 	stringsVar(&conf.PrivateDirs, "private-dir", "additional directory to serve files from (authenticated users only), in the format \"[url-path]@[filesystem-path]\", e.g. \"/public/files/@/some/local/path\" will host /some/local/path/foo.txt at /public/files/foo.txt; multiple directory mappings allowed")
 	stringVar(&accessKeyID, "access-key-id", "access_key_id", "default API access key ID")
-	stringVar(&accessKeySecret, "access-key-secret", "access_key_secret", "default API access key secret")
+	stringVar(&accessKeySecret, "access-key-secret", "access_key_secret", "default API access key secret, or its source: \"file:path\", \"vault:path#field\", \"kms:ciphertext\" or \"cmd:command\"")
 	stringVar(&accessKeyFile, "access-keychain", ".wave-keychain", "path to file containing API access keys")
 	flag.BoolVar(&createAccessKey, "create-access-key", false, "generate and add a new API access key ID and secret pair to the keychain")
+	flag.StringVar(&accessKeyScope, "access-key-scope", "", "restrict the key generated by -create-access-key to reading (\"read\") or writing (\"write\") pages, and/or to route prefixes, comma-separated (e.g. \"read,/dashboards\"); full access if empty")
 	flag.BoolVar(&listAccessKeys, "list-access-keys", false, "list all the access key IDs in the keychain")
 	flag.StringVar(&removeAccessKeyID, "remove-access-key", "", "remove the specified API access key ID from the keychain")
+	stringVar(&address, "address", "http://127.0.0.1:10101", "address of the Wave server to export pages from or import pages to, or to print the status of")
+	flag.StringVar(&exportRoute, "export-page", "", "export the page at the specified route from the server at -address as a JSON snapshot to stdout")
+	flag.StringVar(&importFile, "import-page", "", "import a page from the specified JSON snapshot file (\"-\" for stdin) to the server at -address")
+	flag.StringVar(&importRoute, "import-route", "", "route to import the page snapshot to (defaults to the snapshot's original route)")
+	flag.StringVar(&exportArchivePrefix, "export-archive", "", "export all pages under the specified route prefix (\"/\" for all pages) from the server at -address as a tar.gz archive to stdout")
+	flag.StringVar(&importArchiveFile, "import-archive", "", "restore pages from the specified tar.gz archive (\"-\" for stdin) to the server at -address")
+	flag.StringVar(&rotateAppTokenRoute, "rotate-app-token", "", "issue a new app token for the app route specified, via the server at -address, and print it to stdout; the route's earlier token remains valid for the server's -app-token-grace")
 	stringVar(&conf.Init, "init", "", "initialize site content from AOF log")
+	flag.IntVar(&loadTestConf.clients, "loadtest-clients", 100, "number of synthetic clients opened by the loadtest command")
+	flag.StringVar(&loadTestDuration, "loadtest-duration", "30s", "how long the loadtest command runs for (e.g. 30s or 5m)")
+	flag.Float64Var(&loadTestConf.queryRate, "loadtest-query-rate", 1, "queries per second sent by each client during the loadtest command, if -loadtest-queries is set")
+	flag.StringVar(&loadTestQueries, "loadtest-queries", "", "JSON file holding an array of queries, e.g. [{\"submit\":true}], sent in turn by each client during the loadtest command (default no queries)")
+	flag.Float64Var(&loadTestConf.patchRate, "loadtest-patch-rate", 1, "patches per second published to each route during the loadtest command (0 disables publishing)")
 	flag.StringVar(&conf.Compact, "compact", "", "compact AOF log")
 	stringVar(&conf.CertFile, "tls-cert-file", "", "path to certificate file (TLS only)")
 	stringVar(&conf.KeyFile, "tls-key-file", "", "path to private key file (TLS only)")
+	boolVar(&autocertEnabled, "autocert", false, "obtain and renew TLS certificates automatically via ACME (e.g. Let's Encrypt) for the hosts in -autocert-hosts; the server must be reachable at port 443 of those hosts, or at -autocert-http-listen")
+	stringVar(&autocertHosts, "autocert-hosts", "", "host names to obtain TLS certificates for with -autocert, comma-separated, e.g. \"wave.example.com,www.example.com\"")
+	stringVar(&autocertConf.CacheDir, "autocert-cache-dir", "", "directory to cache TLS certificates and ACME account keys in (default \"<data-dir>/autocert\")")
+	stringVar(&autocertConf.Email, "autocert-email", "", "contact email for the ACME account, to be notified about certificate problems")
+	stringVar(&autocertConf.DirectoryURL, "autocert-directory-url", "", "ACME directory URL, e.g. a staging environment (default Let's Encrypt)")
+	stringVar(&autocertConf.HTTPListen, "autocert-http-listen", "", "address to answer ACME HTTP-01 challenges, and redirect plain HTTP requests to HTTPS on, e.g. \":80\" (default disabled)")
+	boolVar(&conf.H2C, "h2c", false, "accept HTTP/2 without TLS (h2c), e.g. from a reverse proxy that terminates TLS; HTTP/2 is always enabled with TLS")
+	boolVar(&noCompression, "no-compression", false, "do not compress responses")
+	stringVar(&compressMinSize, "compress-min-size", "1K", "minimum size of responses to compress (e.g. 1K or 1KB or 1KiB)")
+	stringsVar(&compressTypes, "compress-type", "media type of responses to compress, e.g. \"application/json\" or \"text/*\"; multiple types allowed (default text, JSON, JavaScript, XML, WebAssembly and SVG)")
 	boolVar(&conf.SkipCertVerification, "no-tls-verify", false, "do not verify TLS certificates during external communication - DO NOT USE IN PRODUCTION")
 	stringVar(&httpHeadersFile, "http-headers-file", "", "path to a MIME-formatted file containing additional HTTP headers to add to responses from the server")
 	boolVar(&conf.Editable, "editable", false, "allow users to edit web pages")
+	intVar(&conf.MaxConnections, "max-connections", 0, "maximum simultaneous websocket connections from browsers (0 for no limit)")
+	intVar(&conf.MaxUserConnections, "max-connections-per-user", 0, "maximum simultaneous websocket connections per signed-in user (0 for no limit)")
+	intVar(&conf.MaxAddrConnections, "max-connections-per-address", 0, "maximum simultaneous websocket connections per client address (0 for no limit)")
+	stringVar(&conf.RequestSigningSecret, "request-signing-secret", "", "require page and app API requests from apps to be signed (HMAC-SHA256) with this secret, or its source: \"file:path\", \"vault:path#field\", \"kms:ciphertext\" or \"cmd:command\"; set H2O_WAVE_REQUEST_SIGNING_SECRET for apps to sign requests")
+	stringVar(&requestSigningWindow, "request-signing-window", "5m", "how far off the timestamps of signed requests may be from the server's clock, and how long nonces are remembered to refuse replayed requests (e.g. 300s or 5m)")
 	stringVar(&maxRequestSize, "max-request-size", "5M", "maximum allowed size of HTTP requests to the server (e.g. 5M or 5MB or 5MiB)")
+	stringVar(&maxHeaderSize, "max-header-size", "1M", "maximum allowed size of the headers of HTTP requests to the server (e.g. 64K or 64KB or 64KiB)")
 	stringVar(&maxCacheRequestSize, "max-cache-request-size", "5M", "maximum allowed size of HTTP requests to the server cache (e.g. 5M or 5MB or 5MiB)")
 	boolVar(&conf.Proxy, "proxy", false, "enable HTTP proxy (for IDE / language server support only - not recommended for internet-facing websites)")
 	stringVar(&maxProxyRequestSize, "max-proxy-request-size", "5M", "maximum allowed size of proxied HTTP requests (e.g. 5M or 5MB or 5MiB)")
 	stringVar(&maxProxyResponseSize, "max-proxy-response-size", "5M", "maximum allowed size of proxied HTTP responses (e.g. 5M or 5MB or 5MiB)")
+	stringVar(&maxUploadSize, "max-upload-size", "", "maximum allowed size of a file upload request (e.g. 100M or 100MB or 100MiB; default no limit)")
+	stringVar(&maxUploadFileSize, "max-upload-file-size", "", "maximum allowed size of each uploaded file (e.g. 10M or 10MB or 10MiB; default no limit)")
+	stringsVar(&conf.Upload.AllowTypes, "upload-allow-type", "allow uploading only files of this type, e.g. \"application/pdf\" or \"image/*\"; multiple types allowed (default all types)")
+	stringVar(&uploadChunkSize, "upload-chunk-size", "", "maximum allowed size of each part of a resumable upload (e.g. 64M or 64MB or 64MiB; default no limit)")
+	stringVar(&uploadExpiry, "upload-expiry", "24h", "delete incomplete resumable uploads after this duration (e.g. 3600s or 60m or 1h; 0 disables)")
+	stringsVar(&conf.Upload.DenyTypes, "upload-deny-type", "deny uploading files of this type, e.g. \"application/x-msdownload\" or \"video/*\"; multiple types allowed")
+	stringVar(&conf.UploadScanner, "upload-scanner", "", "scan uploaded files for malware before storing them, rejecting infected files: \"clamd://host:port\" or \"clamd:///path/to/clamd.sock\" (ClamAV) or \"icap://host[:port]/service\" (ICAP)")
+	stringsVar(&conf.UploadImageSizes, "upload-image-size", "generate a downscaled variant of uploaded JPEG and PNG images that fits this size, served with ?size=..., e.g. \"256\" (256x256) or \"640x480\"; multiple sizes allowed")
+	boolVar(&conf.Upload.Quarantine, "upload-quarantine", false, "keep rejected infected files in the file store's _quarantine directory for inspection")
+	stringVar(&userUploadQuota, "user-upload-quota", "", "maximum total size of files each user may upload from the browser (e.g. 1G or 1GB or 1GiB; default no limit)")
+	stringVar(&appUploadQuota, "app-upload-quota", "", "maximum total size of files each API access key may upload (e.g. 10G or 10GB or 10GiB; default no limit)")
+	stringVar(&uploadGCIdleTimeout, "upload-gc-idle-timeout", "0", "delete uploaded files no page has referred to for this duration (e.g. 86400s or 1440m or 24h; 0 disables)")
+	boolVar(&conf.UploadGC.DryRun, "upload-gc-dry-run", false, "log uploaded files that would be deleted by -upload-gc-idle-timeout, but keep them")
+	stringVar(&conf.FileStore, "file-store", "", "store uploaded files in object storage instead of the data directory: \"s3://bucket[/prefix][?region=...][&endpoint=...]\", \"gs://bucket[/prefix]\" or \"azblob://account/container[/prefix]\"")
+	boolVar(&conf.FileStoreRedirect, "file-store-redirect", false, "redirect file downloads to signed object storage URLs instead of streaming them through the server")
+	boolVar(&conf.PrivateUploads, "private-uploads", false, "allow only the uploading user (and apps) to download files uploaded from the browser (default any signed-in user)")
+	stringVar(&conf.FileURLSecret, "file-url-secret", "", "secret key for signing expiring file URLs minted by apps, or its source: \"file:path\", \"vault:path#field\", \"kms:ciphertext\" or \"cmd:command\"; must be the same on all replicas (default random, invalidating signed URLs on restart)")
+	stringVar(&fileStoreURLExpiry, "file-store-url-expiry", "15m", "lifetime of signed object storage URLs for file downloads (e.g. 900s or 15m or 1h)")
 	stringVar(&sessionExpiry, "session-expiry", "720h", "session cookie lifetime duration (e.g. 1800s or 30m or 0.5h)")
 	stringVar(&inactivityTimeout, "session-inactivity-timeout", "30m", "session inactivity timeout duration (e.g. 1800s or 30m or 0.5h)")
+	stringVar(&routeTimeouts, "session-route-inactivity-timeouts", "", "per-route session inactivity timeouts, in the format \"route:duration\", comma-separated, e.g. \"/kiosk:0,/admin:5m\" (0 disables the timeout)")
 	boolVar(&conf.NoStore, "no-store", false, "disable storage (scripts and multicast/broadcast apps will not work)")
+	intVar(&conf.PageHistory, "page-history", 0, "number of revisions to keep per page for rollback (0 disables page history)")
+	boolVar(&conf.PageSearch, "page-search", false, "index the text of all cards for searching pages via /_search?q=terms")
+	stringVar(&conf.AppBalancing, "app-balancing", "round-robin", "strategy for load balancing queries across multiple instances of an app registered at the same route, one of \"round-robin\" or \"least-outstanding\"")
+	stringVar(&appSlowQuery, "app-slow-query", "0", "log and count queries that apps take longer than this to accept, e.g. 2s (0 disables the slow query log)")
+	stringVar(&appTimeout, "app-timeout", "10s", "maximum time allowed for an app to accept each query, after which the client is notified (e.g. 1800s or 30m or 0.5h; 0 disables the timeout)")
+	intVar(&conf.AppCircuit.Failures, "app-circuit-failures", 5, "consecutive failed or timed-out queries after which an app's circuit breaker trips, failing queries fast until the app recovers (0 disables circuit breakers)")
+	stringVar(&appCircuitCooldown, "app-circuit-cooldown", "30s", "time to wait after an app's circuit breaker trips before probing the app with a query (e.g. 1800s or 30m or 0.5h)")
+	boolVar(&conf.AppLocal, "app-local", false, "accept only apps listening on unix domain sockets (unix:///path) or loopback addresses")
+	stringVar(&conf.AppTokens, "app-tokens", "", "path to file for persisting per-app authentication tokens; enables app tokens, issued via -rotate-app-token")
+	stringVar(&appTokenGrace, "app-token-grace", "1h", "time an app token remains valid after being rotated (e.g. 1800s or 30m or 0.5h)")
+	stringVar(&appMessages, "app-messages", "", "app routes allowed to send messages to other app routes, in the format \"sender-route:recipient-route\" (\"*\" for any route), e.g. \"/orders:/billing,/orders:/shipping\"; multiple allowed, comma-separated; senders authenticate with -app-tokens")
+	stringVar(&conf.AppManifest, "app-manifest", "", "launch and supervise the app processes listed in this JSON file, restarting them if they exit")
+	stringsVar(&conf.AppSchedules, "app-schedule", "send timer queries to an app route on a cron schedule, in the format \"route cron-expression\", e.g. \"/reports 0 6 * * *\" or \"/feed @every 5m\"; multiple schedules allowed")
+	stringVar(&appRestartWait, "app-restart-wait", "0s", "time to hold queries to an app that went away, delivering them if the app registers again in time (e.g. 30s or 1m; 0 disables holding queries)")
+	intVar(&conf.AppForwardWorkers, "app-forward-workers", 1000, "maximum number of queries delivered to each app at the same time, across all clients; each client's queries are delivered in order (0 for no limit)")
+	intVar(&conf.AppRestartQueue, "app-restart-queue", 100, "maximum number of queries held per route while waiting for an app to register again")
+	intVar(&conf.MaintenanceQueue, "maintenance-queue", 1000, "maximum number of queries held in all during maintenance mode, if queueing")
+	stringVar(&routeAliases, "route-aliases", "", "routes to be served by other routes, in the format \"route:target\", comma-separated, e.g. \"/old:/new,/old-reports/:/reports/\" (a trailing slash aliases all sub-routes)")
+	stringVar(&routeRedirects, "route-redirects", "", "routes to be redirected to other routes, in the same format as -route-aliases")
+	intVar(&conf.Backpressure.Depth, "client-throttle-depth", 128, "number of messages queued for a client at or above which the client is falling behind; clients falling behind for longer than -client-throttle-after are sent only significant updates until they catch up (0 disables throttling)")
+	stringVar(&clientThrottleAfter, "client-throttle-after", "2s", "time a client can fall behind before being throttled (e.g. 500ms or 2s)")
+	stringVar(&maxFrameSize, "max-frame-size", "1M", "maximum size of a frame messages queued for a client are coalesced into before being sent (e.g. 512K or 1M or 1MiB); larger batches are split across frames (0B for no limit)")
+	intVar(&conf.FrameLimits.Messages, "max-frame-messages", 0, "maximum number of messages queued for a client coalesced into a single frame; larger batches are split across frames (0 for no limit)")
+	stringVar(&maxPageSize, "max-page-size", "", "maximum allowed size of a page (e.g. 1M or 1MB or 1MiB); patches exceeding this are rejected (default no limit)")
+	intVar(&conf.MaxPageCards, "max-page-cards", 0, "maximum allowed number of cards on a page; patches exceeding this are rejected (0 for no limit)")
+	stringVar(&coalesceWindows, "route-coalesce-windows", "", "per-route windows over which consecutive patches are merged into a single broadcast, for apps publishing at high frequency, in the format \"route:duration\", comma-separated, e.g. \"/ticker:50ms\" (default none)")
+	stringVar(&routePageQuotas, "route-page-quotas", "", "per-route page quotas, in the format \"route:size:cards\", comma-separated, e.g. \"/dashboards:2M:50,/kiosk::10\" (empty or 0 for no limit)")
+	stringVar(&appPageQuotas, "app-page-quotas", "", "per-app page quotas, applied to every page written with an API access key, on top of route quotas, in the format \"key-id:size:cards\", comma-separated, e.g. \"reports-app:2M:50\" (empty or 0 for no limit)")
+	stringVar(&pageGCIdleTimeout, "page-gc-idle-timeout", "0", "evict orphaned pages (no app or viewers) not accessed for this duration (e.g. 1800s or 30m or 0.5h; 0 disables)")
+	stringVar(&maxSiteMemory, "max-site-memory", "", "evict least-recently accessed pages no one is watching while all pages exceed this size (e.g. 1G or 1GB or 1GiB), saving them to -page-store first, if set, to be read back on demand, else dropping them (default no limit)")
+	stringVar(&pageGCMaxSize, "page-gc-max-size", "", "evict least-recently accessed orphaned pages while all pages exceed this size (e.g. 1G or 1GB or 1GiB; default no limit)")
+	stringVar(&conf.PageStore, "page-store", "", "store pages in, and share pages with other replicas via, an external store: \"redis://[:password@]host[:port][/db]\"")
+	stringVar(&conf.PageStorePassword, "page-store-password", "", "password for -page-store, overriding any in its URL, or its source: \"file:path\", \"vault:path#field\", \"kms:ciphertext\" or \"cmd:command\"")
+	stringsVar(&conf.PagePreload, "page-preload", "load only pages at (or under) this route from -page-store at startup, ready to be sent to clients, reading other pages back on demand (a trailing slash preloads all sub-routes, e.g. \"/dashboards/\"); multiple routes allowed (default all pages)")
+	stringsVar(&conf.PageStoreKeys, "page-store-key", "encrypt pages in the page store with AES-256-GCM using the key read from this source, either \"file:path\" or \"cmd:command\" (e.g. a KMS client printing a data key); multiple keys allowed, the first encrypts, all decrypt")
+	stringsVar(&conf.PageWebhooks, "page-webhook", "URL to post page lifecycle events (create, patch, delete) to; multiple webhooks allowed")
+	stringVar(&pageWebhookSecret, "page-webhook-secret", "", "secret used to sign page webhook requests (HMAC-SHA256, in the Wave-Signature header), or its source: \"file:path\", \"vault:path#field\", \"kms:ciphertext\" or \"cmd:command\"")
+	stringVar(&pageWebhookEvents, "page-webhook-events", "create,patch,delete", "page lifecycle events to post to webhooks, comma-separated")
+	stringsVar(&conf.ClientWebhooks, "client-webhook", "URL to post client events (connect, disconnect, watch) to; multiple webhooks allowed")
+	stringVar(&clientWebhookSecret, "client-webhook-secret", "", "secret used to sign client webhook requests (HMAC-SHA256, in the Wave-Signature header), or its source: \"file:path\", \"vault:path#field\", \"kms:ciphertext\" or \"cmd:command\"")
+	stringVar(&secretRefresh, "secret-refresh-interval", "0", "how often to re-read secrets from their sources, and the access keychain, to pick up rotated secrets and keys (e.g. 5m or 1h; 0 to never); should be under half the TTL of Vault tokens")
+	stringVar(&clientWebhookEvents, "client-webhook-events", "connect,disconnect,watch", "client events to post to webhooks, comma-separated")
+	stringVar(&tenancy, "tenancy", "", "enable multi-tenancy, deriving each user's tenant from the left-most label of the host name (\"host\"), or from an OIDC ID token claim (\"claim:name\")")
+	stringVar(&tenantKeys, "tenant-keys", "", "API access keys scoped to tenants, in the format \"key_id:tenant\", comma-separated (unscoped keys can access all tenants)")
+	intVar(&conf.TenantMaxPages, "tenant-max-pages", 0, "maximum number of pages per tenant; patches creating more are rejected (0 for no limit)")
 	boolVar(&conf.NoLog, "no-log", false, "disable AOF logging (connect/disconnect and diagnostic logging messages are not disabled)")
 	// TODO enable when IDE is released
 	// boolVar(&conf.IDE, "ide", false, "enable Wave IDE (experimental)")
-	boolVar(&conf.Debug, "debug", false, "enable debug mode (profiling, inspection, etc.)")
+	boolVar(&conf.Debug, "debug", false, "enable debug endpoints at /_d/, for clients with access keys: site profile, Go runtime profiles (pprof) and variables (expvar)")
+	stringVar(&conf.LogFile, "log-file", "", "log to this file instead of stderr")
+	stringVar(&logMaxSize, "log-max-size", "", "rotate the log file once it grows past this size, e.g. \"100M\" (default never)")
+	stringVar(&logInterval, "log-rotate-interval", "0", "rotate the log file once it has been written to for this long, e.g. 24h (0 disables time-based rotation)")
+	intVar(&conf.LogRotation.MaxBackups, "log-max-backups", 5, "rotated log files to keep")
+	stringVar(&logMaxAge, "log-max-age", "0", "delete rotated log files older than this, e.g. 168h (0 keeps them)")
+	stringVar(&conf.LogFormat, "log-format", "console", "log message format: console or json")
+	stringVar(&logLevel, "log-level", "info", "least severe level to log (debug, info, warn or error), optionally per subsystem, comma-separated, e.g. \"info,auth=debug,broker=warn\"")
+	stringVar(&traceConf.Endpoint, "otlp-traces-endpoint", "", "OpenTelemetry collector's OTLP/HTTP traces endpoint to export traces to, e.g. \"http://localhost:4318/v1/traces\" (default disabled)")
+	stringVar(&traceConf.ServiceName, "otlp-service-name", "wave", "service name to report traces under")
+	stringVar(&traceSampleRatio, "otlp-trace-sample-ratio", "1", "fraction of traces to record, from 0 to 1; traces started by callers follow the caller's decision")
+	boolVar(&conf.AdminDashboard, "admin-dashboard", false, "publish the server's live status (clients, routes, apps, throughput) as a page at /_admin, viewable by -admin-users; requires OIDC")
+	stringVar(&adminUsers, "admin-users", "", "OIDC subjects of the users allowed to view /_admin, comma-separated")
+	boolVar(&conf.Metrics, "metrics", false, "expose metrics for Prometheus at /metrics, for clients with access keys")
 	stringVar(&auth.ClientID, "oidc-client-id", "", "OIDC client ID")
-	stringVar(&auth.ClientSecret, "oidc-client-secret", "", "OIDC client secret")
+	stringVar(&oidcClientSecret, "oidc-client-secret", "", "OIDC client secret, or its source: \"file:path\", \"vault:path#field\", \"kms:ciphertext\" or \"cmd:command\"")
 	stringVar(&auth.ProviderURL, "oidc-provider-url", "", "OIDC provider URL")
 	stringVar(&auth.RedirectURL, "oidc-redirect-url", "", "OIDC redirect URL")
 	stringVar(&auth.EndSessionURL, "oidc-end-session-url", "", "OIDC end session URL")
@@ -122,8 +315,86 @@ func main() {
 	stringVar(&rawAuthScopes, "oidc-scopes", "", "OIDC scopes, comma-separated (default \"openid,profile\")")
 	stringVar(&rawAuthURLParams, "oidc-auth-url-params", "", "additional URL parameters to pass during OIDC authorization, in the format \"key:value\", comma-separated, e.g. \"foo:bar,qux:42\"")
 	boolVar(&auth.SkipLogin, "oidc-skip-login", false, "do not display the login form during OIDC authorization")
+	intVar(&auth.MaxLoginAttempts, "login-max-attempts", 10, "maximum rejected login attempts allowed per client address, and per account once identified by the OIDC provider, within the login attempt window, before locking out (0 disables lockouts)")
+	stringVar(&loginAttemptWindow, "login-attempt-window", "15m", "duration over which failed login attempts are counted (e.g. 1800s or 30m or 0.5h)")
+	stringVar(&loginLockout, "login-lockout-duration", "15m", "duration to lock out a client address or account after too many rejected login attempts (e.g. 1800s or 30m or 0.5h)")
+	stringsVar(&conf.TrustedOrigins, "trusted-origin", "additional origin (e.g. \"https://example.com\") allowed to initiate login, logout and file uploads from the browser; multiple origins allowed")
+	stringsVar(&corsOrigins, "cors-origin", "origin (e.g. \"https://example.com\") allowed to read pages and upload files from the browser via cross-origin requests (CORS), or \"*\" for any origin; multiple origins allowed")
+	stringVar(&corsMethods, "cors-methods", "GET,HEAD,POST,PATCH", "HTTP methods allowed in cross-origin requests, comma-separated")
+	stringVar(&corsHeaders, "cors-headers", "Authorization,Content-Type,Tus-Resumable,Upload-Length,Upload-Metadata,Upload-Offset", "request headers allowed in cross-origin requests, comma-separated")
+	stringVar(&corsExpose, "cors-expose-headers", "Location,Tus-Resumable,Upload-Length,Upload-Offset", "response headers exposed to cross-origin requests, comma-separated")
+	boolVar(&corsConf.Credentials, "cors-credentials", false, "allow cross-origin requests with cookies or HTTP authentication; requires explicit -cors-origin origins")
+	stringVar(&corsMaxAge, "cors-max-age", "10m", "how long browsers may cache the outcome of CORS preflight requests (e.g. 600s or 10m or 1h)")
+	stringVar(&rateLimit, "rate-limit", "0", "requests per second allowed per client address (or IPv6 /64) to the API, upload, websocket and auth endpoints, on average (0 disables rate limiting)")
+	intVar(&rateLimitBurst, "rate-limit-burst", 100, "requests allowed per client address in a burst, beyond -rate-limit")
+	boolVar(&noSecurityHeaders, "no-security-headers", false, "do not send security-related headers (CSP, HSTS, X-Frame-Options, Referrer-Policy, X-Content-Type-Options) with responses")
+	stringsVar(&securityHeaders, "security-header", "security-related header to send in lieu of the default, as \"Name: value\", e.g. \"Content-Security-Policy: default-src 'self'\", or \"Name:\" to not send it; multiple headers allowed")
+	stringsVar(&cacheRules, "cache-control", "Cache-Control header to send for UI assets matching a pattern, as \"pattern value\", e.g. \"*.woff2 public, max-age=86400\"; patterns ending with / match directories; multiple rules allowed, first match wins (default \"wave-static/ public, max-age=31536000, immutable\")")
+	stringsVar(&errorPages, "error-page", "HTML file to show browsers in lieu of an HTTP error message, as \"status=file\", e.g. \"404=www/404.html\"; multiple pages allowed")
+	stringVar(&conf.ErrorPages.NotFound, "not-found-cards", "", "JSON file of cards, keyed by card name, to show for routes with no page or app (default a \"not found\" message)")
+	stringVar(&conf.ErrorPages.AppUnavailable, "app-unavailable-cards", "", "JSON file of cards, keyed by card name, to show for routes whose app is no longer running (default same as -not-found-cards)")
+	stringsVar(&listeners, "listener", "additional address to serve some routes on, in lieu of -listen, as \"address roles [cert=file key=file client-ca=file keys=id,...]\", where roles is a comma-separated list of ui, api or admin, e.g. \"127.0.0.1:10102 admin\"; multiple listeners allowed")
+	stringsVar(&conf.TrustedProxies, "trusted-proxy", "IP address or CIDR range (e.g. \"10.0.0.0/8\") of a reverse proxy or load balancer trusted to report client addresses via the X-Forwarded-For or X-Real-IP headers; multiple proxies allowed")
+	stringsVar(&conf.UIAccess.Allow, "ui-allow", "IP address or CIDR range (e.g. \"10.0.0.0/8\") allowed to use the UI (pages, websockets, login, files); if set, all others are refused; multiple ranges allowed")
+	stringsVar(&conf.UIAccess.Deny, "ui-deny", "IP address or CIDR range refused access to the UI (pages, websockets, login, files), even if allowed; multiple ranges allowed")
+	stringsVar(&conf.APIAccess.Allow, "api-allow", "IP address or CIDR range (e.g. \"10.0.0.0/8\") allowed to use the page data and app APIs; if set, all others are refused; multiple ranges allowed")
+	stringsVar(&conf.APIAccess.Deny, "api-deny", "IP address or CIDR range refused access to the page data and app APIs, even if allowed; multiple ranges allowed")
+	stringsVar(&conf.AdminAccess.Allow, "admin-allow", "IP address or CIDR range (e.g. \"10.0.0.0/8\") allowed to use the admin, debug and metrics endpoints; if set, all others are refused; multiple ranges allowed")
+	stringsVar(&conf.AdminAccess.Deny, "admin-deny", "IP address or CIDR range refused access to the admin, debug and metrics endpoints, even if allowed; multiple ranges allowed")
+	stringVar(&accessLogConf.File, "access-log", "", "log HTTP requests and websocket sessions to this file, or \"-\" for stdout (default disabled)")
+	stringVar(&accessLogConf.Format, "access-log-format", "common", "access log format: common (Common Log Format) or json")
+	stringVar(&accessLogMaxSize, "access-log-max-size", "", "rotate the access log file once it grows past this size, e.g. \"100M\" (default never)")
+	stringVar(&accessLogInterval, "access-log-rotate-interval", "0", "rotate the access log file once it has been written to for this long, e.g. 24h (0 disables time-based rotation)")
+	intVar(&accessLogConf.Rotation.MaxBackups, "access-log-max-backups", 5, "rotated access log files to keep")
+	stringVar(&accessLogMaxAge, "access-log-max-age", "0", "delete rotated access log files older than this, e.g. 168h (0 keeps them)")
+	stringVar(&conf.EditAuditLog, "edit-audit-log", "", "record page edits made from the UI (with -editable) or via the admin API, rejecting edits that cannot be recorded: an append-only file, queryable via the admin API, \"syslog[:tag]\", or a webhook \"http(s)://...\" URL (default disabled)")
+	intVar(&conf.AuditQueueSize, "audit-queue-size", 1024, "maximum number of auth events waiting to be written to the audit log; events recorded while the queue is full are dropped, and logged as errors")
+	stringsVar(&conf.AuditLog, "audit-log", "record auth events (login, logout, token refresh, session expiry) to an audit log: a file path, \"syslog[:tag]\", or a webhook \"http(s)://...\" URL; multiple audit logs allowed")
 
-	flag.Parse()
+	flag.Usage = usage
+	command, args := parseCommand(parseArgs(flag.CommandLine, os.Args[1:])) // flags may come before or after the command
+	switch command {
+	case "", "serve":
+		checkArgs(command, args, 0, 0)
+	case "status":
+		checkArgs(command, args, 0, 0)
+		status = true
+	case "config":
+		checkArgs(command, args, 1, 1)
+		if args[0] != "show" {
+			fmt.Fprintf(os.Stderr, "unknown config command %q\n", args[0])
+			flag.Usage()
+			os.Exit(2)
+		}
+		showConfig = true
+	case "loadtest":
+		checkArgs(command, args, 0, len(args))
+		loadTest = true
+		loadTestConf.routes = args
+	case "keygen":
+		checkArgs(command, args, 0, 0)
+		createAccessKey = true
+	case "export":
+		checkArgs(command, args, 1, 1)
+		exportRoute = args[0]
+	case "import":
+		checkArgs(command, args, 1, 2)
+		importFile = args[0]
+		if len(args) > 1 {
+			importRoute = args[1]
+		}
+	}
+
+	cmdline := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { cmdline[f.Name] = true })
+	var fileSettings map[string]bool
+	if len(configFile) > 0 {
+		var err error
+		if fileSettings, err = applyConfig(configFile, cmdline); err != nil {
+			panic(err)
+		}
+	}
+	conf.Settings = effectiveSettings(cmdline, fileSettings)
 
 	auth.Scopes = strings.Split(rawAuthScopes, ",")
 	if len(rawAuthURLParams) > 0 {
@@ -149,6 +420,91 @@ func main() {
 		return
 	}
 
+	reloadable, err := parseReloadableConf(func(key string) string { return flag.Lookup(key).Value.String() }) // reads secrets from their sources
+	if err != nil {
+		panic(err)
+	}
+	accessKeySecret = reloadable.Secrets.AccessKeySecret
+	conf.FileURLSecret = reloadable.Secrets.FileURLSecret
+	conf.RequestSigningSecret = reloadable.Secrets.RequestSigningSecret
+	conf.PageStorePassword = reloadable.Secrets.PageStorePassword
+
+	if status {
+		if err := printStatus(address, accessKeyID, accessKeySecret); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if loadTest {
+		d, err := time.ParseDuration(loadTestDuration)
+		if err != nil {
+			panic(fmt.Errorf("failed parsing load test duration: %v", err))
+		}
+		loadTestConf.duration = d
+		if len(loadTestQueries) > 0 {
+			if loadTestConf.queries, err = loadQueries(loadTestQueries); err != nil {
+				panic(err)
+			}
+		}
+		loadTestConf.address, loadTestConf.baseURL = address, conf.BaseURL
+		loadTestConf.id, loadTestConf.secret, loadTestConf.signingSecret = accessKeyID, accessKeySecret, conf.RequestSigningSecret
+		if err := loadTestConf.run(); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if showConfig {
+		if err := printConfig(address, accessKeyID, accessKeySecret); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(exportRoute) > 0 {
+		if err := exportPage(address, accessKeyID, accessKeySecret, exportRoute); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(importFile) > 0 {
+		if err := importPage(address, accessKeyID, accessKeySecret, importFile, importRoute); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(exportArchivePrefix) > 0 {
+		if err := exportArchive(address, accessKeyID, accessKeySecret, exportArchivePrefix); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(importArchiveFile) > 0 {
+		if err := importArchive(address, accessKeyID, accessKeySecret, importArchiveFile); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(rotateAppTokenRoute) > 0 {
+		if err := rotateAppToken(address, accessKeyID, accessKeySecret, rotateAppTokenRoute); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(conf.Compact) > 0 {
 		wave.CompactSite(conf.Compact)
 		return
@@ -163,7 +519,11 @@ func main() {
 		keys := kc.IDs()
 		sort.Strings(keys)
 		for _, key := range keys {
-			fmt.Println(key)
+			if scope := kc.Scope(key); !scope.IsEmpty() {
+				fmt.Println(key, scope)
+			} else {
+				fmt.Println(key)
+			}
 		}
 		return
 	}
@@ -182,11 +542,15 @@ func main() {
 	}
 
 	if createAccessKey {
+		scope, err := keychain.ParseScope(accessKeyScope)
+		if err != nil {
+			panic(fmt.Errorf("bad access key scope: %v", err))
+		}
 		id, secret, hash, err := keychain.CreateAccessKey()
 		if err != nil {
 			panic(fmt.Errorf("failed generating access key: %v", err))
 		}
-		kc.Add(id, hash)
+		kc.AddScoped(id, hash, scope)
 		if err := kc.Save(); err != nil {
 			panic(fmt.Errorf("failed writing keychain: %v", err))
 		}
@@ -202,7 +566,8 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		kc.Add(accessKeyID, hash)
+		kc.SetDefault(accessKeyID, hash)
+		conf.AccessKeySecret = accessKeySecret
 	}
 
 	if len(httpHeadersFile) > 0 {
@@ -217,6 +582,12 @@ func main() {
 		panic(err)
 	}
 
+	headerSize, err := parseReadSize("max header size", maxHeaderSize)
+	if err != nil {
+		panic(err)
+	}
+	conf.MaxHeaderSize = int(headerSize)
+
 	if conf.MaxCacheRequestSize, err = parseReadSize("max cache request size", maxCacheRequestSize); err != nil {
 		panic(err)
 	}
@@ -229,6 +600,219 @@ func main() {
 		panic(err)
 	}
 
+	if len(maxUploadSize) > 0 {
+		if conf.Upload.MaxSize, err = parseReadSize("max upload size", maxUploadSize); err != nil {
+			panic(err)
+		}
+	}
+
+	if len(maxUploadFileSize) > 0 {
+		if conf.Upload.MaxFileSize, err = parseReadSize("max upload file size", maxUploadFileSize); err != nil {
+			panic(err)
+		}
+	}
+
+	if len(uploadChunkSize) > 0 {
+		if conf.Upload.ChunkSize, err = parseReadSize("upload chunk size", uploadChunkSize); err != nil {
+			panic(err)
+		}
+	}
+
+	if conf.Upload.Expiry, err = time.ParseDuration(uploadExpiry); err != nil {
+		panic(err)
+	}
+
+	if len(userUploadQuota) > 0 {
+		if conf.UploadQuotas.User, err = parseReadSize("user upload quota", userUploadQuota); err != nil {
+			panic(err)
+		}
+	}
+
+	if len(appUploadQuota) > 0 {
+		if conf.UploadQuotas.App, err = parseReadSize("app upload quota", appUploadQuota); err != nil {
+			panic(err)
+		}
+	}
+
+	if conf.UploadGC.IdleTimeout, err = time.ParseDuration(uploadGCIdleTimeout); err != nil {
+		panic(err)
+	}
+
+	if !noCompression {
+		minSize, err := parseReadSize("compress min size", compressMinSize)
+		if err != nil {
+			panic(err)
+		}
+		conf.Compression = &wave.CompressionPolicy{MinSize: int(minSize), Types: compressTypes}
+	}
+
+	if !noSecurityHeaders {
+		override := make(http.Header)
+		for _, spec := range securityHeaders {
+			kv := strings.SplitN(spec, ":", 2)
+			if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+				panic(fmt.Errorf("bad security header: want \"Name: value\", got %q", spec))
+			}
+			override.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		}
+		conf.SecurityHeaders = &wave.SecurityHeaders{Override: override}
+	}
+
+	if len(traceConf.Endpoint) > 0 {
+		if traceConf.SampleRatio, err = strconv.ParseFloat(traceSampleRatio, 64); err != nil || traceConf.SampleRatio < 0 || traceConf.SampleRatio > 1 {
+			panic(fmt.Errorf("bad trace sample ratio: want 0 to 1, got %q", traceSampleRatio))
+		}
+		conf.Tracing = &traceConf
+	}
+
+	conf.AdminUsers = splitList(adminUsers)
+
+	if len(accessLogConf.File) > 0 {
+		if err := parseRotation(&accessLogConf.Rotation, accessLogMaxSize, accessLogInterval, accessLogMaxAge); err != nil {
+			panic(fmt.Errorf("bad access log rotation: %v", err))
+		}
+		conf.AccessLog = &accessLogConf
+	}
+
+	if len(conf.LogFile) > 0 {
+		if err := parseRotation(&conf.LogRotation, logMaxSize, logInterval, logMaxAge); err != nil {
+			panic(fmt.Errorf("bad log rotation: %v", err))
+		}
+	}
+
+	for _, spec := range cacheRules {
+		kv := strings.SplitN(strings.TrimSpace(spec), " ", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[1])) == 0 {
+			panic(fmt.Errorf("bad cache-control rule: want \"pattern value\", got %q", spec))
+		}
+		conf.CachePolicy = append(conf.CachePolicy, wave.CacheRule{Pattern: kv[0], Value: strings.TrimSpace(kv[1])})
+	}
+
+	if len(errorPages) > 0 {
+		conf.ErrorPages.HTTP = make(map[int]string)
+		for _, spec := range errorPages {
+			kv := strings.SplitN(spec, "=", 2)
+			code, err := strconv.Atoi(kv[0])
+			if len(kv) != 2 || err != nil || len(kv[1]) == 0 {
+				panic(fmt.Errorf("bad error page: want \"status=file\", got %q", spec))
+			}
+			conf.ErrorPages.HTTP[code] = kv[1]
+		}
+	}
+
+	for _, spec := range listeners {
+		l, err := parseListenerConf(spec)
+		if err != nil {
+			panic(err)
+		}
+		conf.Listeners = append(conf.Listeners, l)
+	}
+
+	if len(corsOrigins) > 0 {
+		corsConf.Origins = corsOrigins
+		corsConf.Methods = splitList(corsMethods)
+		corsConf.Headers = splitList(corsHeaders)
+		corsConf.Expose = splitList(corsExpose)
+		if corsConf.MaxAge, err = time.ParseDuration(corsMaxAge); err != nil {
+			panic(err)
+		}
+		if corsConf.Credentials {
+			for _, o := range corsOrigins {
+				if o == "*" {
+					panic(fmt.Errorf("-cors-credentials cannot be used with -cors-origin \"*\": want explicit origins"))
+				}
+			}
+		}
+		conf.CORS = &corsConf
+	}
+
+	if rate, err := strconv.ParseFloat(rateLimit, 64); err != nil || rate < 0 {
+		panic(fmt.Errorf("bad rate limit: want requests per second, got %q", rateLimit))
+	} else if rate > 0 {
+		if rateLimitBurst < 1 {
+			panic(fmt.Errorf("bad rate limit burst: want at least 1, got %d", rateLimitBurst))
+		}
+		conf.RateLimit = &wave.RateLimitPolicy{Rate: rate, Burst: rateLimitBurst}
+	}
+
+	if conf.RequestSigningWindow, err = time.ParseDuration(requestSigningWindow); err != nil {
+		panic(err)
+	}
+
+	if conf.FileStoreURLExpiry, err = time.ParseDuration(fileStoreURLExpiry); err != nil {
+		panic(err)
+	}
+
+	if conf.PageGC.IdleTimeout, err = time.ParseDuration(pageGCIdleTimeout); err != nil {
+		panic(err)
+	}
+
+	if len(pageGCMaxSize) > 0 {
+		if conf.PageGC.MaxSize, err = parseReadSize("page gc max size", pageGCMaxSize); err != nil {
+			panic(err)
+		}
+	}
+
+	frameSize, err := parseReadSize("max frame size", maxFrameSize)
+	if err != nil {
+		panic(err)
+	}
+	conf.FrameLimits.Size = int(frameSize)
+
+	if len(maxSiteMemory) > 0 {
+		if conf.MaxSiteMemory, err = parseReadSize("max site memory", maxSiteMemory); err != nil {
+			panic(err)
+		}
+	}
+
+	conf.PageWebhookEvents = strings.Split(pageWebhookEvents, ",")
+	conf.ClientWebhookEvents = strings.Split(clientWebhookEvents, ",")
+
+	switch {
+	case len(tenancy) == 0:
+	case tenancy == "host":
+		conf.Tenancy = tenancy
+	case strings.HasPrefix(tenancy, "claim:") && len(tenancy) > len("claim:"):
+		conf.Tenancy = "claim"
+		auth.TenantClaim = strings.TrimPrefix(tenancy, "claim:")
+	default:
+		panic(fmt.Errorf("bad tenancy: want \"host\" or \"claim:name\", got %v", tenancy))
+	}
+
+	if conf.TenantKeys, err = parseTenantKeys(tenantKeys); err != nil {
+		panic(err)
+	}
+
+	switch conf.AppBalancing {
+	case "round-robin", "least-outstanding":
+	default:
+		panic(fmt.Errorf("bad app balancing strategy: want \"round-robin\" or \"least-outstanding\", got %v", conf.AppBalancing))
+	}
+
+	if conf.AppTimeout, err = time.ParseDuration(appTimeout); err != nil {
+		panic(err)
+	}
+
+	if conf.AppSlowQuery, err = time.ParseDuration(appSlowQuery); err != nil {
+		panic(err)
+	}
+
+	if conf.AppCircuit.Cooldown, err = time.ParseDuration(appCircuitCooldown); err != nil {
+		panic(err)
+	}
+
+	if conf.AppTokenGrace, err = time.ParseDuration(appTokenGrace); err != nil {
+		panic(err)
+	}
+
+	if conf.AppRestartWait, err = time.ParseDuration(appRestartWait); err != nil {
+		panic(err)
+	}
+
+	if conf.Backpressure.After, err = time.ParseDuration(clientThrottleAfter); err != nil {
+		panic(err)
+	}
+
 	if auth.SessionExpiry, err = time.ParseDuration(sessionExpiry); err != nil {
 		panic(err)
 	}
@@ -237,7 +821,38 @@ func main() {
 		panic(err)
 	}
 
+	if auth.RouteInactivityTimeouts, err = parseRouteDurations(routeTimeouts); err != nil {
+		panic(err)
+	}
+
+	if conf.RouteCoalesceWindows, err = parseRouteDurations(coalesceWindows); err != nil {
+		panic(err)
+	}
+
+	conf.RouteAliases = reloadable.RouteAliases
+	conf.AppMessages = reloadable.AppMessages
+	conf.MaxPageSize = reloadable.MaxPageSize
+	conf.RoutePageQuotas = reloadable.RoutePageQuotas
+	conf.AppPageQuotas = reloadable.AppPageQuotas
+	conf.LogLevels = reloadable.LogLevels
+	auth.LoginAttemptWindow = reloadable.LoginAttemptWindow
+	auth.LoginLockout = reloadable.LoginLockout
+	auth.ClientSecret = reloadable.Secrets.ClientSecret
+	conf.PageWebhookSecret = reloadable.Secrets.PageWebhookSecret
+	conf.ClientWebhookSecret = reloadable.Secrets.ClientWebhookSecret
+	conf.Reload = reloadConfig(configFile, cmdline)
+	if conf.SecretRefresh, err = time.ParseDuration(secretRefresh); err != nil {
+		panic(err)
+	}
+
 	conf.WebDir, _ = filepath.Abs(conf.WebDir)
+	for _, dir := range webRoots {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			panic(fmt.Errorf("bad web root: not a directory: %s", dir))
+		}
+		dir, _ = filepath.Abs(dir)
+		conf.WebRoots = append(conf.WebRoots, dir)
+	}
 	conf.DataDir, _ = filepath.Abs(conf.DataDir)
 
 	conf.Version = Version
@@ -245,6 +860,17 @@ func main() {
 
 	conf.Keychain = kc
 
+	if autocertEnabled {
+		if len(conf.CertFile) > 0 || len(conf.KeyFile) > 0 {
+			panic(fmt.Errorf("-autocert cannot be used with -tls-cert-file or -tls-key-file"))
+		}
+		autocertConf.Hosts = splitList(autocertHosts)
+		if len(autocertConf.Hosts) == 0 {
+			panic(fmt.Errorf("-autocert requires -autocert-hosts"))
+		}
+		conf.Autocert = &autocertConf
+	}
+
 	requiredEnvOIDC := map[string]string{
 		"oidc-client-id":     auth.ClientID,
 		"oidc-client-secret": auth.ClientSecret,
@@ -277,13 +903,173 @@ func getEmptyOIDCValues(requiredEnvOIDC map[string]string) []string {
 	return emptyRequiredOIDCParams
 }
 
+func envName(key string) string {
+	return "H2O_WAVE_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
 func getEnv(key, value string) string {
-	if v, ok := os.LookupEnv("H2O_WAVE_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))); ok {
+	if v, ok := os.LookupEnv(envName(key)); ok {
 		return v
 	}
 	return value
 }
 
+// applyConfig sets flags from the settings in a config file, except for settings that are set on the command line
+// or by environment variables, which take precedence, returning the settings applied.
+func applyConfig(file string, cmdline map[string]bool) (map[string]bool, error) {
+	settings, err := config.Load(file)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[string]bool)
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		f := flag.Lookup(key)
+		if f == nil || key == "config" || key == "version" {
+			return nil, fmt.Errorf("%s: unknown setting %q", file, key)
+		}
+		if _, ok := f.Value.(*wave.Strings); !ok && len(settings[key]) != 1 {
+			return nil, fmt.Errorf("%s: invalid %s: want a single value", file, key)
+		}
+		if _, ok := os.LookupEnv(envName(key)); ok || cmdline[key] {
+			continue
+		}
+		for _, v := range settings[key] {
+			if err := flag.Set(key, v); err != nil {
+				return nil, fmt.Errorf("%s: invalid %s: %v", file, key, err)
+			}
+		}
+		applied[key] = true
+	}
+	return applied, nil
+}
+
+// reloadConfig returns a function that reads the settings that can be changed while the server is running:
+// from the config file, if any, except for settings that are set on the command line or by environment variables,
+// which cannot change; settings missing from the file revert to their defaults.
+func reloadConfig(file string, cmdline map[string]bool) func() (wave.ReloadableConf, error) {
+	return func() (wave.ReloadableConf, error) {
+		var settings config.Settings
+		if len(file) > 0 {
+			var err error
+			if settings, err = config.Load(file); err != nil {
+				return wave.ReloadableConf{}, err
+			}
+		}
+		return parseReloadableConf(func(key string) string {
+			f := flag.Lookup(key)
+			if _, ok := os.LookupEnv(envName(key)); ok || cmdline[key] {
+				return f.Value.String()
+			}
+			if vs := settings[key]; len(vs) == 1 {
+				return vs[0]
+			}
+			return f.DefValue
+		})
+	}
+}
+
+// parseReloadableConf parses the settings that can be changed while the server is running, looking up each
+// setting's value by its flag name.
+func parseReloadableConf(setting func(key string) string) (wave.ReloadableConf, error) {
+	var (
+		c   wave.ReloadableConf
+		err error
+	)
+	if c.AppMessages, err = parseAppMessageACL(setting("app-messages")); err != nil {
+		return c, err
+	}
+	c.RouteAliases = make(wave.RouteAliases)
+	if err := parseRouteAliases(c.RouteAliases, setting("route-aliases"), false); err != nil {
+		return c, err
+	}
+	if err := parseRouteAliases(c.RouteAliases, setting("route-redirects"), true); err != nil {
+		return c, err
+	}
+	if v := setting("max-page-size"); len(v) > 0 {
+		if c.MaxPageSize, err = parseReadSize("max page size", v); err != nil {
+			return c, err
+		}
+	}
+	if c.MaxPageCards, err = strconv.Atoi(setting("max-page-cards")); err != nil {
+		return c, fmt.Errorf("bad max page cards: %v", err)
+	}
+	if c.RoutePageQuotas, err = parsePageQuotas("route", setting("route-page-quotas")); err != nil {
+		return c, err
+	}
+	if c.AppPageQuotas, err = parsePageQuotas("app", setting("app-page-quotas")); err != nil {
+		return c, err
+	}
+	if c.MaxLoginAttempts, err = strconv.Atoi(setting("login-max-attempts")); err != nil {
+		return c, fmt.Errorf("bad login max attempts: %v", err)
+	}
+	if c.LoginAttemptWindow, err = time.ParseDuration(setting("login-attempt-window")); err != nil {
+		return c, err
+	}
+	if c.LoginLockout, err = time.ParseDuration(setting("login-lockout-duration")); err != nil {
+		return c, err
+	}
+	c.CertFile = setting("tls-cert-file")
+	c.KeyFile = setting("tls-key-file")
+	if c.LogLevels, err = wave.ParseLogLevels(setting("log-level")); err != nil {
+		return c, err
+	}
+	if c.Secrets.ClientSecret, err = wave.LoadSecret(setting("oidc-client-secret")); err != nil {
+		return c, err
+	}
+	if c.Secrets.PageWebhookSecret, err = wave.LoadSecret(setting("page-webhook-secret")); err != nil {
+		return c, err
+	}
+	if c.Secrets.ClientWebhookSecret, err = wave.LoadSecret(setting("client-webhook-secret")); err != nil {
+		return c, err
+	}
+	if c.Secrets.AccessKeySecret, err = wave.LoadSecret(setting("access-key-secret")); err != nil {
+		return c, err
+	}
+	if c.Secrets.FileURLSecret, err = wave.LoadSecret(setting("file-url-secret")); err != nil {
+		return c, err
+	}
+	if c.Secrets.RequestSigningSecret, err = wave.LoadSecret(setting("request-signing-secret")); err != nil {
+		return c, err
+	}
+	if c.Secrets.PageStorePassword, err = wave.LoadSecret(setting("page-store-password")); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// parseRotation parses when a log file is rotated, and how long rotated files are kept.
+func parseRotation(r *wave.Rotation, maxSize, interval, maxAge string) error {
+	var err error
+	if len(maxSize) > 0 {
+		if r.MaxSize, err = parseReadSize("max size", maxSize); err != nil {
+			return err
+		}
+	}
+	if r.Interval, err = time.ParseDuration(interval); err != nil {
+		return err
+	}
+	if r.MaxAge, err = time.ParseDuration(maxAge); err != nil {
+		return err
+	}
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func boolVar(p *bool, key string, value bool, usage string) {
 	b := "0"
 	if value {
@@ -296,6 +1082,14 @@ func boolVar(p *bool, key string, value bool, usage string) {
 	flag.BoolVar(p, key, v, usage)
 }
 
+func intVar(p *int, key string, value int, usage string) {
+	v, err := strconv.Atoi(getEnv(key, strconv.Itoa(value)))
+	if err != nil {
+		v = value
+	}
+	flag.IntVar(p, key, v, usage)
+}
+
 func stringVar(p *string, key, value, usage string) {
 	flag.StringVar(p, key, getEnv(key, value), usage)
 }
@@ -324,6 +1118,142 @@ func parseReadSize(label, value string) (int64, error) {
 	return int64(n), nil
 }
 
+func parseRouteDurations(value string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	if len(value) == 0 {
+		return durations, nil
+	}
+	for _, rawPair := range strings.Split(value, ",") {
+		kv := strings.Split(rawPair, ":")
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return nil, fmt.Errorf("bad route duration: want \"route:duration\", got %v", rawPair)
+		}
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing duration for route %s: %v", kv[0], err)
+		}
+		durations[kv[0]] = d
+	}
+	return durations, nil
+}
+
+// parsePageQuotas parses per-route or per-app page quotas, as "name:size:cards", comma-separated; kind is "route"
+// or "app".
+func parsePageQuotas(kind, value string) (map[string]wave.Quota, error) {
+	quotas := make(map[string]wave.Quota)
+	if len(value) == 0 {
+		return quotas, nil
+	}
+	name := kind
+	if kind == "app" {
+		name = "key-id"
+	}
+	for _, rawQuota := range strings.Split(value, ",") {
+		kv := strings.Split(rawQuota, ":")
+		if len(kv) != 3 || len(kv[0]) == 0 {
+			return nil, fmt.Errorf("bad %s page quota: want \"%s:size:cards\", got %v", kind, name, rawQuota)
+		}
+		var (
+			q   wave.Quota
+			err error
+		)
+		if len(kv[1]) > 0 && kv[1] != "0" {
+			if q.MaxSize, err = parseReadSize("page size quota for "+kind+" "+kv[0], kv[1]); err != nil {
+				return nil, err
+			}
+		}
+		if len(kv[2]) > 0 {
+			if q.MaxCards, err = strconv.Atoi(kv[2]); err != nil {
+				return nil, fmt.Errorf("failed parsing page card quota for %s %s: %v", kind, kv[0], err)
+			}
+		}
+		quotas[kv[0]] = q
+	}
+	return quotas, nil
+}
+
+func parseListenerConf(spec string) (wave.ListenerConf, error) {
+	var l wave.ListenerConf
+	fields := strings.Fields(spec)
+	if len(fields) < 2 {
+		return l, fmt.Errorf("bad listener: want \"address roles [cert=file key=file client-ca=file keys=id,...]\", got %q", spec)
+	}
+	l.Address, l.Roles = fields[0], splitList(fields[1])
+	for _, option := range fields[2:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 || len(kv[1]) == 0 {
+			return l, fmt.Errorf("bad listener option: want \"name=value\", got %q", option)
+		}
+		switch kv[0] {
+		case "cert":
+			l.CertFile = kv[1]
+		case "key":
+			l.KeyFile = kv[1]
+		case "client-ca":
+			l.ClientCAFile = kv[1]
+		case "keys":
+			l.AccessKeys = splitList(kv[1])
+		default:
+			return l, fmt.Errorf("unknown listener option %q: want cert, key, client-ca or keys", kv[0])
+		}
+	}
+	if (len(l.CertFile) == 0) != (len(l.KeyFile) == 0) {
+		return l, fmt.Errorf("listener %s: cert and key must be set together", l.Address)
+	}
+	return l, nil
+}
+
+func parseTenantKeys(value string) (map[string]string, error) {
+	keys := make(map[string]string)
+	if len(value) == 0 {
+		return keys, nil
+	}
+	for _, rawPair := range strings.Split(value, ",") {
+		kv := strings.Split(rawPair, ":")
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return nil, fmt.Errorf("bad tenant key: want \"key_id:tenant\", got %v", rawPair)
+		}
+		keys[kv[0]] = kv[1]
+	}
+	return keys, nil
+}
+
+func parseRouteAliases(aliases wave.RouteAliases, value string, redirect bool) error {
+	if len(value) == 0 {
+		return nil
+	}
+	for _, rawPair := range strings.Split(value, ",") {
+		kv := strings.Split(rawPair, ":")
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "/") || !strings.HasPrefix(kv[1], "/") {
+			return fmt.Errorf("bad route alias: want \"route:target\", got %v", rawPair)
+		}
+		if kv[0] == kv[1] {
+			return fmt.Errorf("bad route alias: route aliases itself: %v", rawPair)
+		}
+		aliases[kv[0]] = wave.RouteAlias{Target: kv[1], Redirect: redirect}
+	}
+	return nil
+}
+
+func parseAppMessageACL(value string) (wave.AppMessageACL, error) {
+	acl := make(wave.AppMessageACL)
+	if len(value) == 0 {
+		return acl, nil
+	}
+	for _, rawPair := range strings.Split(value, ",") {
+		kv := strings.Split(rawPair, ":")
+		if len(kv) != 2 || !isACLRoute(kv[0]) || !isACLRoute(kv[1]) {
+			return nil, fmt.Errorf("bad app message rule: want \"sender-route:recipient-route\", got %v", rawPair)
+		}
+		acl.Allow(kv[0], kv[1])
+	}
+	return acl, nil
+}
+
+func isACLRoute(route string) bool {
+	return route == "*" || strings.HasPrefix(route, "/")
+}
+
 func parseHTTPHeaders(file string) (http.Header, error) {
 	b, err := os.ReadFile(file)
 	if err != nil {
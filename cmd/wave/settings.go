@@ -0,0 +1,105 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/h2oai/wave"
+)
+
+const redacted = "(redacted)"
+
+// effectiveSettings returns every setting, in alphabetical order, with its value, redacted, and its source: "flag" if
+// set on the command line, "env" if set by an environment variable, "file" if set by the config file, or "default".
+func effectiveSettings(cmdline, file map[string]bool) []wave.ConfigSetting {
+	var settings []wave.ConfigSetting
+	flag.VisitAll(func(f *flag.Flag) {
+		source := "default"
+		if cmdline[f.Name] {
+			source = "flag"
+		} else if _, ok := os.LookupEnv(envName(f.Name)); ok {
+			source = "env"
+		} else if file[f.Name] {
+			source = "file"
+		}
+		value := f.Value.String()
+		if vs, ok := f.Value.(*wave.Strings); ok {
+			redactedValues := make([]string, len(*vs))
+			for i, v := range *vs {
+				redactedValues[i] = redactSetting(f.Name, v)
+			}
+			value = strings.Join(redactedValues, string(os.PathListSeparator))
+		} else {
+			value = redactSetting(f.Name, value)
+		}
+		settings = append(settings, wave.ConfigSetting{Name: f.Name, Value: value, Source: source})
+	})
+	return settings
+}
+
+// webhookSettings are settings whose values may be webhook URLs, which often carry credentials in their paths
+// (e.g. Slack or Teams incoming webhooks) or queries (e.g. "?token=...").
+var webhookSettings = map[string]bool{"page-webhook": true, "client-webhook": true, "audit-log": true}
+
+// redactSetting hides secrets, except their sources, if files or Vault paths, passwords in URLs, and the paths and
+// queries of webhook URLs.
+func redactSetting(name, value string) string {
+	if len(value) == 0 {
+		return value
+	}
+	if strings.HasSuffix(name, "-secret") || strings.HasSuffix(name, "-password") || name == "page-store-key" {
+		if strings.HasPrefix(value, "file:") || strings.HasPrefix(value, "vault:") {
+			return value
+		}
+		return redacted
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+	if webhookSettings[name] && (u.Scheme == "http" || u.Scheme == "https") {
+		if len(u.Path) > 1 || len(u.RawQuery) > 0 {
+			u.Path, u.RawPath, u.RawQuery, u.Fragment = "", "", "", ""
+			return u.Redacted() + "/" + redacted
+		}
+	}
+	return u.Redacted()
+}
+
+// printConfig prints the effective configuration of the server at address.
+func printConfig(address, id, secret string) error {
+	b, err := adminRequest(http.MethodGet, address, id, secret, "config", nil)
+	if err != nil {
+		return fmt.Errorf("failed reading configuration: %v", err)
+	}
+	var settings []wave.ConfigSetting
+	if err := json.Unmarshal(b, &settings); err != nil {
+		return fmt.Errorf("failed reading configuration: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SETTING\tSOURCE\tVALUE")
+	for _, s := range settings {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Name, s.Source, s.Value)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// adminRequest makes a request to the server's admin API.
+func adminRequest(method, address, id, secret, path string, body io.Reader) ([]byte, error) {
+	resp, err := adminDo(method, address, id, secret, path, "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+// adminDo makes a request to the server's admin API, leaving the response body to the caller.
+func adminDo(method, address, id, secret, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(address, "/")+"/_a/"+strings.TrimPrefix(path, "/"), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating request: %v", err)
+	}
+	req.SetBasicAuth(id, secret)
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	return resp, nil
+}
+
+func exportPage(address, id, secret, route string) error {
+	b, err := adminRequest(http.MethodGet, address, id, secret, "snapshot"+route, nil)
+	if err != nil {
+		return fmt.Errorf("failed exporting page %s: %v", route, err)
+	}
+	_, err = os.Stdout.Write(append(b, '\n'))
+	return err
+}
+
+func importPage(address, id, secret, file, route string) error {
+	var (
+		b   []byte
+		err error
+	)
+	if file == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return fmt.Errorf("failed reading page snapshot: %v", err)
+	}
+	if _, err := adminRequest(http.MethodPut, address, id, secret, "snapshot"+route, bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("failed importing page snapshot: %v", err)
+	}
+	return nil
+}
+
+func exportArchive(address, id, secret, prefix string) error {
+	resp, err := adminDo(http.MethodGet, address, id, secret, "archive"+prefix, "application/gzip", nil)
+	if err != nil {
+		return fmt.Errorf("failed exporting archive: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed exporting archive: %s", resp.Status)
+	}
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		return fmt.Errorf("failed exporting archive: %v", err)
+	}
+	return nil
+}
+
+func importArchive(address, id, secret, file string) error {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return fmt.Errorf("failed reading archive: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	resp, err := adminDo(http.MethodPut, address, id, secret, "archive", "application/gzip", r)
+	if err != nil {
+		return fmt.Errorf("failed importing archive: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed importing archive: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed importing archive: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/h2oai/wave"
+)
+
+// printStatus prints a summary of the apps, clients and maintenance mode of the server at address.
+func printStatus(address, id, secret string) error {
+	var (
+		apps        []wave.AppInfo
+		clients     []wave.ClientInfo
+		maintenance wave.MaintenanceInfo
+	)
+	for _, q := range []struct {
+		path  string
+		reply interface{}
+	}{{"maintenance", &maintenance}, {"clients", &clients}, {"apps", &apps}} {
+		b, err := adminRequest(http.MethodGet, address, id, secret, q.path, nil)
+		if err != nil {
+			return fmt.Errorf("failed reading %s: %v", q.path, err)
+		}
+		if err := json.Unmarshal(b, q.reply); err != nil {
+			return fmt.Errorf("failed reading %s: %v", q.path, err)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Server:\t%s\n", address)
+	if maintenance.On {
+		fmt.Fprintf(w, "Maintenance:\ton since %s (%d queries held, %d refused)\n", maintenance.Since.Format(time.RFC3339), maintenance.Held, maintenance.Refused)
+	} else {
+		fmt.Fprintf(w, "Maintenance:\toff\n")
+	}
+	fmt.Fprintf(w, "Clients:\t%d\n", len(clients))
+	fmt.Fprintf(w, "Apps:\t%d\n", len(apps))
+	for _, app := range apps {
+		fmt.Fprintf(w, "  %s\t%s, %s, %d instance(s), %.1f%% errors\n", app.Route, app.Status, app.Mode, app.Count, app.ErrorRate*100)
+	}
+	return w.Flush()
+}
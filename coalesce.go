@@ -0,0 +1,159 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Coalescer merges consecutive patches to a route into a single broadcast, for routes with a coalescing window,
+// so that apps publishing at high frequency, e.g. tickers, do not cause a broadcast per patch.
+//
+// The first patch to a route opens its window; patches published to the route until the window closes are
+// broadcast together, as a single batch of ops, once it does. Patches are stored as they arrive, regardless.
+type Coalescer struct {
+	sync.Mutex
+	windows map[string]time.Duration // route (and sub-routes) => window
+	pending map[string]*PatchBatch   // route => patches not yet broadcast
+	publish chan Pub
+}
+
+// PatchBatch represents the patches to a route published during a coalescing window.
+type PatchBatch struct {
+	ops     []json.RawMessage
+	deltas  []OpD
+	deltaOK bool // do all patches have deltas?
+}
+
+// newCoalescer returns a coalescer that broadcasts via publish; nil if no route has a coalescing window.
+func newCoalescer(windows map[string]time.Duration, publish chan Pub) *Coalescer {
+	if len(windows) == 0 {
+		return nil
+	}
+	return &Coalescer{windows: windows, pending: make(map[string]*PatchBatch), publish: publish}
+}
+
+// window returns the coalescing window for a route, using the longest matching route, if any.
+// Safe to call on a nil coalescer.
+func (c *Coalescer) window(route string) time.Duration {
+	if c == nil {
+		return 0
+	}
+	window, n := time.Duration(0), -1
+	for prefix, w := range c.windows {
+		if len(prefix) > n && matchRoutePrefix(prefix, route) {
+			window, n = w, len(prefix)
+		}
+	}
+	return window
+}
+
+// add adds a patch, and the deltas equivalent to it, if any, to the route's batch, returning false if the route
+// has no coalescing window, or the patch cannot be merged with others, in which case the caller must publish it;
+// patches already batched are published first, to keep patches in order.
+// Safe to call on a nil coalescer.
+func (c *Coalescer) add(route string, data []byte, deltas []OpD) bool {
+	window := c.window(route)
+	if window <= 0 {
+		return false
+	}
+	ops, ok := patchOps(data)
+
+	c.Lock()
+	batch, pending := c.pending[route]
+	if !ok {
+		c.Unlock()
+		if pending {
+			c.flush(route)
+		}
+		return false
+	}
+	defer c.Unlock()
+	if !pending {
+		batch = &PatchBatch{deltaOK: true}
+		c.pending[route] = batch
+		time.AfterFunc(window, func() { c.flush(route) })
+	}
+	batch.ops = append(batch.ops, ops...)
+	if len(deltas) == 0 {
+		batch.deltaOK = false
+	}
+	if batch.deltaOK {
+		batch.deltas = append(batch.deltas, deltas...)
+	}
+	return true
+}
+
+// flush publishes the patches batched for a route, if any, e.g. before the page is deleted.
+// Safe to call on a nil coalescer.
+func (c *Coalescer) flush(route string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	pub, ok := c.take(route)
+	c.Unlock()
+	if ok {
+		c.publish <- pub // not under the lock, which patches to other routes would otherwise wait on
+	}
+}
+
+// take removes the patches batched for a route, if any, returning them merged. Must be called with the lock held.
+func (c *Coalescer) take(route string) (Pub, bool) {
+	batch, ok := c.pending[route]
+	if !ok {
+		return Pub{}, false
+	}
+	delete(c.pending, route)
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"d":[`)
+	for i, op := range batch.ops {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(op)
+	}
+	buf.WriteString(`]}`)
+	data := buf.Bytes()
+
+	var delta []byte
+	if batch.deltaOK {
+		if d, err := marshalOps(OpsD{D: batch.deltas}); err == nil && len(d) < len(data) {
+			delta = d
+		}
+	}
+	return Pub{route, data, delta, nil}, true
+}
+
+// patchOps returns the ops in a patch; false if the patch has anything but ops, and so cannot be merged with others.
+func patchOps(data []byte) ([]json.RawMessage, bool) {
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(data, &patch); err != nil || len(patch) != 1 {
+		return nil, false
+	}
+	d, ok := patch["d"]
+	if !ok {
+		return nil, false
+	}
+	var ops []json.RawMessage
+	if err := json.Unmarshal(d, &ops); err != nil {
+		return nil, false
+	}
+	return ops, true
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestCoalescer(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	ok(newCoalescer(nil, nil) == nil, "no windows disables coalescing")
+
+	broker := newBroker(newSite(), false, false, true)
+	broker.coalescer = newCoalescer(map[string]time.Duration{"/ticker": 20 * time.Millisecond}, broker.publish)
+	go broker.run()
+	eq(broker.coalescer.window("/ticker/eur"), 20*time.Millisecond)
+	eq(broker.coalescer.window("/tickers"), time.Duration(0))
+
+	alice := newClient("test", nil, anonymous, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	bob := newClient("test", nil, anonymous, "", broker, nil, false, true, false, browserProtocolVersion, "/")
+	alice.subscribe("/ticker")
+	bob.subscribe("/ticker")
+	alice.subscribe("/demo")
+	for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+		broker.clientsMux.RLock()
+		subscribed = len(broker.clients["/ticker"]) == 2 && len(broker.clients["/demo"]) == 1
+		broker.clientsMux.RUnlock()
+	}
+
+	broker.patch("/ticker", []byte(`{"d":[{"k":"price","d":{"view":"small_stat","box":"1 1 1 1","title":"EUR","value":"1.10"}}]}`), "")
+	broker.patch("/ticker", []byte(`{"d": [{"k": "price value", "v": "1.11"}]}`), "")
+	broker.patch("/ticker", []byte(`{"d":[{"k":"price value","v":"1.12"}]}`), "")
+	broker.patch("/demo", []byte(`{"d":[{"k":"a","d":{"view":"markdown"}}]}`), "")
+	broker.patch("/demo", []byte(`{"d":[{"k":"a content","v":"hi"}]}`), "")
+
+	eq(string(<-alice.data), `{"d":[{"k":"a","d":{"view":"markdown"}}]}`) // not coalesced
+	eq(string(<-alice.data), `{"d":[{"k":"a content","v":"hi"}]}`)
+	eq(string(<-alice.data), `{"d":[{"k":"price","d":{"view":"small_stat","box":"1 1 1 1","title":"EUR","value":"1.10"}},{"k": "price value", "v": "1.11"},{"k":"price value","v":"1.12"}]}`)
+	eq(len(bob.data), 1)
+	eq(len(alice.data), 0)
+	eq(broker.site.at("/ticker").cards["price"].data["value"], "1.12") // stored as patched
+
+	broker.patch("/ticker", []byte(`{"d":[{"k":"price value","v":"1.13"}]}`), "")
+	broker.patch("/ticker", []byte(`{"p":{"c":{}}}`), "") // not mergeable
+	eq(string(<-alice.data), `{"d":[{"k":"price value","v":"1.13"}]}`)
+	eq(string(<-alice.data), `{"p":{"c":{}}}`)
+	<-bob.data
+	<-bob.data
+	<-bob.data
+
+	broker.patch("/ticker", []byte(`{"d":[{"k":"price value","v":"1.14"}]}`), "")
+	broker.deletePage("/ticker", "")
+	eq(string(<-alice.data), `{"d":[{"k":"price value","v":"1.14"}]}`) // before the page is gone
+	eq(string(<-alice.data), string(broker.missingPage("/ticker")))
+	time.Sleep(40 * time.Millisecond) // window closed
+	eq(len(alice.data), 0)
+}
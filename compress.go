@@ -0,0 +1,262 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CompressionPolicy determines which HTTP responses are compressed, for clients that accept compressed responses.
+type CompressionPolicy struct {
+	MinSize int      // responses smaller than this many bytes are sent as is
+	Types   []string // media types to compress; "type/*" matches all subtypes
+}
+
+// defaultCompressionTypes lists the media types compressed by default: text, and text-like formats. Images, video,
+// archives and the like are already compressed.
+var defaultCompressionTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+var gzPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(ioutil.Discard)
+	},
+}
+
+// compressible returns true if responses with the given content type can be compressed.
+func (p *CompressionPolicy) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	types := p.Types
+	if len(types) == 0 {
+		types = defaultCompressionTypes
+	}
+	for _, t := range types {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap returns a handler that gzips h's responses, if the client accepts gzip, and the response is compressible and
+// large enough. Range requests are served as is. Safe to call on a nil policy, which disables compression.
+func (p *CompressionPolicy) wrap(h http.Handler) http.Handler {
+	if p == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || len(r.Header.Get("Range")) > 0 || !acceptsEncoding(r, "gzip") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, policy: p}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter buffers the start of a response until it knows whether the response is worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	policy  *CompressionPolicy
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.decided || w.status != 0 {
+		return
+	}
+	w.status = status
+	if status != http.StatusOK { // errors, redirects, not-modified, etc.
+		w.decide(false)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	if w.decided {
+		return w.ResponseWriter.Write(b)
+	}
+	if n, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil { // size known up front
+		w.decide(n >= w.policy.MinSize)
+		return w.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.policy.MinSize {
+		w.decide(true)
+	}
+	return len(b), nil
+}
+
+// decide writes the response header, and anything buffered so far, compressing the response if large enough and
+// compressible.
+func (w *compressWriter) decide(large bool) {
+	w.decided = true
+	h := w.Header()
+	if large && len(h.Get("Content-Encoding")) == 0 && w.policy.compressible(w.contentType()) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		if tag := h.Get("ETag"); len(tag) > 0 && !strings.HasPrefix(tag, "W/") { // no longer byte-for-byte identical
+			h.Set("ETag", "W/"+tag)
+		}
+		w.gz = gzPool.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if len(w.buf) > 0 {
+		if w.gz != nil {
+			w.gz.Write(w.buf)
+		} else {
+			w.ResponseWriter.Write(w.buf)
+		}
+		w.buf = nil
+	}
+}
+
+// contentType returns the response's content type, sniffing it from the buffered content if not set.
+func (w *compressWriter) contentType() string {
+	if ct := w.Header().Get("Content-Type"); len(ct) > 0 {
+		return ct
+	}
+	if len(w.buf) == 0 {
+		return ""
+	}
+	ct := http.DetectContentType(w.buf)
+	w.Header().Set("Content-Type", ct)
+	return ct
+}
+
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(len(w.buf) >= w.policy.MinSize)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) close() {
+	if !w.decided && w.status != 0 {
+		w.decide(false) // smaller than the minimum size
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		gzPool.Put(w.gz)
+		w.gz = nil
+	}
+}
+
+// acceptsEncoding returns true if the client accepts responses in the given content coding, per Accept-Encoding.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, spec := range strings.Split(v, ",") {
+			parts := strings.Split(spec, ";")
+			if name := strings.TrimSpace(parts[0]); name != coding && name != "*" {
+				continue
+			}
+			q := 1.0
+			for _, p := range parts[1:] {
+				if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+					if f, err := strconv.ParseFloat(strings.TrimPrefix(p, "q="), 64); err == nil {
+						q = f
+					}
+				}
+			}
+			return q > 0
+		}
+	}
+	return false
+}
+
+// precompressedEncodings lists the content codings of precompressed static files, in order of preference, with the
+// file name extension of each.
+var precompressedEncodings = []struct{ coding, ext string }{{"br", ".br"}, {"gzip", ".gz"}}
+
+// servePrecompressed returns a handler that serves a precompressed copy of a static file, e.g. app.js.br or app.js.gz
+// for app.js, if there is one and the client accepts its encoding, else passes the request on to h.
+// For overlays, copies are taken from the same layer as the file itself.
+// Brotli-compressed files are served this way only, typically produced at build time.
+func servePrecompressed(root http.FileSystem, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || strings.HasSuffix(r.URL.Path, "/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		name := path.Clean("/" + r.URL.Path)
+		layer := root
+		if o, ok := root.(OverlayFS); ok { // take the copies from the layer serving the file, lest they be of a hidden one
+			if l := o.layerOf(name); l != nil {
+				layer = l
+			}
+		}
+		for _, e := range precompressedEncodings {
+			if !acceptsEncoding(r, e.coding) {
+				continue
+			}
+			f, err := layer.Open(name + e.ext)
+			if err != nil {
+				continue
+			}
+			fi, err := f.Stat()
+			if err != nil || fi.IsDir() {
+				f.Close()
+				continue
+			}
+			header := w.Header()
+			header.Add("Vary", "Accept-Encoding")
+			header.Set("Content-Encoding", e.coding)
+			if ct := mime.TypeByExtension(path.Ext(name)); len(ct) > 0 {
+				header.Set("Content-Type", ct)
+			}
+			if tag, ok := fileETag(layer, name+e.ext); ok {
+				header.Set("ETag", tag)
+			}
+			http.ServeContent(w, r, name, fi.ModTime(), f)
+			f.Close()
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
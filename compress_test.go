@@ -0,0 +1,127 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestCompression(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	p := &CompressionPolicy{MinSize: 100}
+	body := strings.Repeat(`{"k":"v"}`, 100)
+	h := p.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Header().Set("ETag", `"x"`)
+		w.Write([]byte(body[:len(body)*len(r.URL.Query().Get("big"))]))
+		w.Write([]byte("{}"))
+	}))
+	get := func(url, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		if len(accept) > 0 {
+			r.Header.Set("Accept-Encoding", accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/?type=application/json&big=1", "gzip, br")
+	eq(w.Header().Get("Content-Encoding"), "gzip")
+	eq(w.Header().Get("ETag"), `W/"x"`)
+	eq(w.Header().Get("Vary"), "Accept-Encoding")
+	gz, err := gzip.NewReader(w.Body)
+	no(err)
+	b, err := ioutil.ReadAll(gz)
+	no(err)
+	eq(string(b), body+"{}")
+
+	w = get("/?type=application/json", "gzip")
+	eq(w.Header().Get("Content-Encoding"), "") // too small
+	eq(w.Body.String(), "{}")
+
+	w = get("/?type=image/png&big=1", "gzip")
+	eq(w.Header().Get("Content-Encoding"), "") // not compressible
+	eq(w.Body.Len(), len(body)+2)
+
+	w = get("/?type=text/css&big=1", "br, gzip;q=0")
+	eq(w.Header().Get("Content-Encoding"), "") // gzip not acceptable
+
+	ok(p.compressible("text/html; charset=utf-8"))
+	ok(!p.compressible("video/mp4"))
+}
+
+func TestServePrecompressed(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	no(ioutil.WriteFile(filepath.Join(dir, "app.js"), []byte("plain"), 0644))
+	no(ioutil.WriteFile(filepath.Join(dir, "app.js.br"), []byte("brotli"), 0644))
+	root := http.Dir(dir)
+	h := servePrecompressed(root, newETagFileServer(root))
+	get := func(accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/app.js", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("gzip, deflate, br")
+	eq(w.Header().Get("Content-Encoding"), "br")
+	ok(strings.Contains(w.Header().Get("Content-Type"), "javascript"))
+	eq(w.Body.String(), "brotli")
+
+	w = get("gzip")
+	eq(w.Header().Get("Content-Encoding"), "")
+	eq(w.Body.String(), "plain")
+
+	no(os.Remove(filepath.Join(dir, "app.js.br")))
+	eq(get("br").Body.String(), "plain")
+}
+
+func TestServePrecompressedOverlay(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	custom, stock := t.TempDir(), t.TempDir()
+	no(ioutil.WriteFile(filepath.Join(stock, "app.js"), []byte("stock"), 0644))
+	no(ioutil.WriteFile(filepath.Join(stock, "app.js.br"), []byte("stock brotli"), 0644))
+	no(ioutil.WriteFile(filepath.Join(stock, "lib.js"), []byte("lib"), 0644))
+	no(ioutil.WriteFile(filepath.Join(stock, "lib.js.br"), []byte("lib brotli"), 0644))
+	no(ioutil.WriteFile(filepath.Join(custom, "app.js"), []byte("custom"), 0644))
+	root := newOverlayFS(custom, stock)
+	h := servePrecompressed(root, newETagFileServer(root))
+	get := func(p string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", p, nil)
+		r.Header.Set("Accept-Encoding", "br")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/app.js") // overridden: the stock copy is stale
+	eq(w.Header().Get("Content-Encoding"), "")
+	eq(w.Body.String(), "custom")
+	w = get("/lib.js")
+	eq(w.Header().Get("Content-Encoding"), "br")
+	eq(w.Body.String(), "lib brotli")
+}
@@ -34,34 +34,155 @@ func (s *Strings) String() string {
 	return strings.Join(*s, string(os.PathListSeparator))
 }
 
+// ConfigSetting represents a setting of the server, as reported by the admin API.
+type ConfigSetting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`  // secrets redacted
+	Source string `json:"source"` // "flag", "env", "file" or "default"
+}
+
 // ServerConf represents Server configuration options.
 type ServerConf struct {
 	Version              string
 	BuildDate            string
+	Settings             []ConfigSetting // effective settings, as the server started
 	Listen               string
+	Listeners            []ListenerConf // additional listeners, each serving some routes in lieu of the main listener
 	BaseURL              string
 	WebDir               string
 	DataDir              string
 	PublicDirs           Strings
 	PrivateDirs          Strings
 	Keychain             *keychain.Keychain
+	AccessKeySecret      string // of the keychain's default key, if any
 	Init                 string
 	Compact              string
 	CertFile             string
 	SkipCertVerification bool
 	KeyFile              string
+	Autocert             *AutocertConf      // obtain TLS certificates automatically; nil to disable
+	H2C                  bool               // accept HTTP/2 without TLS?
+	Compression          *CompressionPolicy // compress responses; nil to disable
+	CORS                 *CORSPolicy        // allow cross-origin requests to data and upload endpoints; nil to disable
+	RateLimit            *RateLimitPolicy   // limit requests to data, upload and auth endpoints per client address; nil to disable
+	UIAccess             IPFilterConf       // client addresses allowed to use the UI
+	APIAccess            IPFilterConf       // client addresses allowed to use the page data and app APIs
+	AdminAccess          IPFilterConf       // client addresses allowed to use the admin, debug and metrics endpoints
+	SecurityHeaders      *SecurityHeaders   // security-related headers sent with every response; nil to disable
+	ErrorPages           ErrorPagesConf     // custom error output
 	Header               http.Header
+	WebRoots             []string    // directories of files served in lieu of the UI's files at the same paths
+	CachePolicy          CachePolicy // Cache-Control headers for UI assets; nil for defaults
 	Editable             bool
+	MaxConnections       int // websocket connections allowed in all; 0 for no limit
+	MaxUserConnections   int // websocket connections allowed per user; 0 for no limit
+	MaxAddrConnections   int // websocket connections allowed per client address; 0 for no limit
 	MaxRequestSize       int64
+	MaxHeaderSize        int           // maximum size of request headers, in bytes; 0 for the net/http default (1MB)
+	RequestSigningSecret string        // secret apps sign page and app API requests with; "" to not require signatures
+	RequestSigningWindow time.Duration // how far off signed requests' timestamps may be
 	MaxCacheRequestSize  int64
 	Proxy                bool
 	MaxProxyRequestSize  int64
 	MaxProxyResponseSize int64
+	Upload               UploadPolicy
+	UploadScanner        string        // "" (none), or a content scanner spec; see openUploadScanner
+	UploadImageSizes     Strings       // sizes of downscaled variants of uploaded images; see parseImageSize
+	FileStore            string        // "" (local), or an object storage URL; see openFileStore
+	FileStoreRedirect    bool          // redirect downloads to signed URLs instead of streaming them?
+	FileStoreURLExpiry   time.Duration // lifetime of signed download URLs
+	PrivateUploads       bool          // allow only the uploading user to download files uploaded from the browser?
+	UploadQuotas         UploadQuotas
+	UploadGC             UploadGCPolicy
+	FileURLSecret        string // key for signing file URLs; random if empty
 	NoStore              bool
 	NoLog                bool
+	PageHistory          int
+	PageSearch           bool
+	RouteAliases         RouteAliases
+	AppBalancing         string // "round-robin" or "least-outstanding"
+	AppTimeout           time.Duration
+	AppSlowQuery         time.Duration // log queries apps take longer than this to accept; 0 to disable
+	AppCircuit           CircuitPolicy
+	AppRestartWait       time.Duration
+	AppRestartQueue      int
+	AppForwardWorkers    int         // max queries delivered to each app at the same time; 0 for no limit
+	FrameLimits          FrameLimits // limits on the frames queued messages to clients are coalesced into
+	Backpressure         BackpressurePolicy
+	MaintenanceQueue     int // max queries held during maintenance mode
+	AppLocal             bool
+	AppTokens            string
+	AppTokenGrace        time.Duration
+	AppMessages          AppMessageACL
+	AppSchedules         Strings
+	AppManifest          string
+	MaxPageSize          int64
+	MaxPageCards         int
+	RoutePageQuotas      map[string]Quota
+	AppPageQuotas        map[string]Quota         // by API access key ID
+	RouteCoalesceWindows map[string]time.Duration // windows over which patches to routes (and sub-routes) are broadcast together
+	PageGC               GCPolicy
+	MaxSiteMemory        int64 // evict least-recently accessed pages while all pages exceed this size, in bytes; 0 disables
+	PageStore            string
+	PageStorePassword    string // overrides the password in the page store URL, if any
+	PageStoreKeys        Strings
+	PagePreload          Strings // routes (and sub-routes) whose pages are loaded from the page store at startup; all if empty
+	PageWebhooks         Strings
+	PageWebhookSecret    string
+	PageWebhookEvents    Strings
+	ClientWebhooks       Strings
+	ClientWebhookSecret  string
+	ClientWebhookEvents  Strings
+	Tenancy              string            // "" (disabled), "host" or "claim"; see Tenancy
+	TenantKeys           map[string]string // API access key ID => tenant
+	TenantMaxPages       int               // max pages per tenant; 0 for no limit
 	IDE                  bool
 	Debug                bool
+	LogFormat            string         // "console" (default) or "json"
+	LogLevels            LogLevels      // least severe level logged, overall and per subsystem
+	LogFile              string         // file to log to, instead of stderr
+	LogRotation          Rotation       // rotation of the log file
+	AccessLog            *AccessLogConf // log HTTP requests and websocket sessions; nil to disable
+	Metrics              bool           // expose metrics for Prometheus at /metrics
+	AdminDashboard       bool           // publish the server's status page at /_admin
+	AdminUsers           Strings        // subjects of users allowed to view the status page
+	Tracing              *TraceConf     // export traces to an OpenTelemetry collector; nil to disable
 	Auth                 *AuthConf
+	AuditLog             Strings
+	AuditQueueSize       int    // auth events queued while being written to the audit log; 0 for the default (1024)
+	EditAuditLog         string // audit sink to record page edits made by people to, as for AuditLog; "" to disable
+	TrustedOrigins       Strings
+	TrustedProxies       Strings                        // IP addresses or CIDR ranges of proxies trusted to forward client addresses
+	Reload               func() (ReloadableConf, error) // re-reads the options that can be changed at runtime; nil to keep them as is
+	SecretRefresh        time.Duration                  // how often to re-read secrets using Reload; 0 to never
+}
+
+// ReloadableConf represents the configuration options that can be changed while the server is running.
+type ReloadableConf struct {
+	RouteAliases       RouteAliases
+	AppMessages        AppMessageACL
+	MaxPageSize        int64
+	MaxPageCards       int
+	RoutePageQuotas    map[string]Quota
+	AppPageQuotas      map[string]Quota
+	MaxLoginAttempts   int
+	LoginAttemptWindow time.Duration
+	LoginLockout       time.Duration
+	CertFile           string
+	KeyFile            string
+	LogLevels          LogLevels
+	Secrets            Secrets
+}
+
+// Secrets represents the secrets that can be rotated while the server is running, e.g. by a secrets manager.
+type Secrets struct {
+	ClientSecret         string // OIDC client secret
+	PageWebhookSecret    string
+	ClientWebhookSecret  string
+	AccessKeySecret      string // of the default API access key; see keychain.SetDefault
+	FileURLSecret        string
+	RequestSigningSecret string
+	PageStorePassword    string
 }
 
 type AuthConf struct {
@@ -76,4 +197,11 @@ type AuthConf struct {
 	SkipLogin             bool
 	SessionExpiry         time.Duration
 	InactivityTimeout     time.Duration
+	// RouteInactivityTimeouts overrides InactivityTimeout for routes (and their sub-routes); 0 disables the timeout.
+	RouteInactivityTimeouts map[string]time.Duration
+	MaxLoginAttempts        int           // rejected login attempts allowed per address, and per account; 0 disables lockouts
+	LoginAttemptWindow      time.Duration // window over which failed login attempts are counted
+	LoginLockout            time.Duration // lockout duration after too many failed login attempts
+	TenantClaim             string        // ID token claim naming the user's tenant, if any
+	TenantHost              bool          // bind the tenant named by the host name to the session at login
 }
@@ -0,0 +1,89 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ConnLimits caps simultaneous websocket connections and event streams: in all, per user, and per client address, so that one runaway
+// client cannot exhaust the server.
+type ConnLimits struct {
+	sync.Mutex
+	max        int // connections allowed in all; 0 for no limit
+	perSubject int // connections allowed per user subject; 0 for no limit
+	perAddr    int // connections allowed per client address; 0 for no limit
+	total      int
+	subjects   map[string]int
+	addrs      map[string]int
+}
+
+// newConnLimits returns connection limits; nil if all are 0.
+func newConnLimits(max, perSubject, perAddr int) *ConnLimits {
+	if max <= 0 && perSubject <= 0 && perAddr <= 0 {
+		return nil
+	}
+	return &ConnLimits{
+		max:        max,
+		perSubject: perSubject,
+		perAddr:    perAddr,
+		subjects:   make(map[string]int),
+		addrs:      make(map[string]int),
+	}
+}
+
+// acquire counts a new connection for the session from addr, failing if that would exceed a limit.
+// Anonymous sessions are limited per address only. Safe to call on nil limits, which allow any connection.
+func (l *ConnLimits) acquire(session *Session, addr string) error {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.max > 0 && l.total >= l.max {
+		return fmt.Errorf("server has reached its limit of %d connections", l.max)
+	}
+	if l.perSubject > 0 && session != anonymous && l.subjects[session.subject] >= l.perSubject {
+		return fmt.Errorf("user has reached the limit of %d connections", l.perSubject)
+	}
+	if l.perAddr > 0 && l.addrs[addr] >= l.perAddr {
+		return fmt.Errorf("address has reached the limit of %d connections", l.perAddr)
+	}
+	l.total++
+	if session != anonymous {
+		l.subjects[session.subject]++
+	}
+	l.addrs[addr]++
+	return nil
+}
+
+// release uncounts a connection counted by acquire. Safe to call on nil limits.
+func (l *ConnLimits) release(session *Session, addr string) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.total--
+	if session != anonymous {
+		if l.subjects[session.subject]--; l.subjects[session.subject] <= 0 {
+			delete(l.subjects, session.subject)
+		}
+	}
+	if l.addrs[addr]--; l.addrs[addr] <= 0 {
+		delete(l.addrs, addr)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const anyOrigin = "*"
+
+// CORSPolicy determines which cross-origin requests browsers are allowed to make to the server's data and upload
+// endpoints, e.g. from web apps hosted elsewhere. See https://fetch.spec.whatwg.org/#http-cors-protocol
+type CORSPolicy struct {
+	Origins     []string      // allowed origins, as "scheme://host[:port]"; "*" for any origin
+	Methods     []string      // allowed methods
+	Headers     []string      // allowed request headers
+	Expose      []string      // response headers exposed to scripts, in addition to the CORS-safelisted ones
+	Credentials bool          // allow requests with cookies or HTTP authentication?
+	MaxAge      time.Duration // how long browsers may cache preflight responses
+}
+
+// allows returns true if requests from the origin are allowed.
+func (p *CORSPolicy) allows(origin string) bool {
+	for _, o := range p.Origins {
+		if o == anyOrigin || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap returns a handler that adds CORS headers to h's responses to allowed origins, and answers preflight requests.
+// Safe to call on a nil policy, which disables CORS.
+func (p *CORSPolicy) wrap(h http.Handler) http.Handler {
+	if p == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && len(r.Header.Get("Access-Control-Request-Method")) > 0
+		if !p.allows(origin) {
+			if preflight {
+				echoError(Log{"t": "cors", "path": r.URL.Path, "origin": origin, "error": "origin not allowed"})
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r) // without CORS headers, so that browsers withhold the response from the requesting page
+			return
+		}
+		if p.Credentials {
+			header.Set("Access-Control-Allow-Origin", origin)
+			header.Set("Access-Control-Allow-Credentials", "true")
+		} else if p.allows(anyOrigin) {
+			header.Set("Access-Control-Allow-Origin", anyOrigin)
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if preflight {
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+			header.Set("Access-Control-Allow-Methods", strings.Join(p.Methods, ", "))
+			if len(p.Headers) > 0 {
+				header.Set("Access-Control-Allow-Headers", strings.Join(p.Headers, ", "))
+			}
+			if p.MaxAge > 0 {
+				header.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if len(p.Expose) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(p.Expose, ", "))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
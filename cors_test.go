@@ -0,0 +1,96 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestCORSPolicy(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	served := 0
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		w.Write([]byte("ok"))
+	})
+	policy := &CORSPolicy{
+		Origins: []string{"https://app.example.com"},
+		Methods: []string{"GET", "POST"},
+		Headers: []string{"Authorization"},
+		Expose:  []string{"Location"},
+		MaxAge:  10 * time.Minute,
+	}
+
+	request := func(p *CORSPolicy, method, origin string, preflight bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/foo", nil)
+		if len(origin) > 0 {
+			r.Header.Set("Origin", origin)
+		}
+		if preflight {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		w := httptest.NewRecorder()
+		p.wrap(h).ServeHTTP(w, r)
+		return w
+	}
+
+	w := request(policy, "GET", "", false) // same-origin
+	eq(w.Code, http.StatusOK)
+	eq(w.Header().Get("Access-Control-Allow-Origin"), "")
+
+	w = request(policy, "GET", "https://app.example.com", false)
+	eq(w.Code, http.StatusOK)
+	eq(w.Header().Get("Access-Control-Allow-Origin"), "https://app.example.com")
+	eq(w.Header().Get("Access-Control-Allow-Credentials"), "")
+	eq(w.Header().Get("Access-Control-Expose-Headers"), "Location")
+	eq(w.Header().Get("Vary"), "Origin")
+
+	w = request(policy, "GET", "https://evil.example.com", false) // served, but unreadable by the page
+	eq(w.Code, http.StatusOK)
+	eq(w.Header().Get("Access-Control-Allow-Origin"), "")
+
+	served = 0
+	w = request(policy, "OPTIONS", "https://app.example.com", true)
+	eq(w.Code, http.StatusNoContent)
+	eq(served, 0)
+	eq(w.Header().Get("Access-Control-Allow-Methods"), "GET, POST")
+	eq(w.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+	eq(w.Header().Get("Access-Control-Max-Age"), "600")
+
+	w = request(policy, "OPTIONS", "https://evil.example.com", true)
+	eq(w.Code, http.StatusForbidden)
+	eq(served, 0)
+
+	w = request(policy, "OPTIONS", "https://app.example.com", false) // e.g. tus discovery
+	eq(w.Code, http.StatusOK)
+	eq(served, 1)
+
+	credentialed := &CORSPolicy{Origins: policy.Origins, Methods: policy.Methods, Credentials: true}
+	w = request(credentialed, "GET", "https://app.example.com", false)
+	eq(w.Header().Get("Access-Control-Allow-Origin"), "https://app.example.com")
+	eq(w.Header().Get("Access-Control-Allow-Credentials"), "true")
+
+	anyone := &CORSPolicy{Origins: []string{"*"}, Methods: policy.Methods}
+	w = request(anyone, "GET", "https://other.example.com", false)
+	eq(w.Header().Get("Access-Control-Allow-Origin"), "*")
+
+	w = request(nil, "GET", "https://app.example.com", false)
+	ok(len(w.Header().Get("Access-Control-Allow-Origin")) == 0, "nil policy disables CORS")
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var errCrossSiteRequest = errors.New("cross-site request rejected")
+
+// CSRFGuard rejects cross-site browser requests to state-changing endpoints.
+//
+// Browsers report the initiator of a request via the Sec-Fetch-Site header, or failing that,
+// the Origin and Referer headers. A request is allowed if it was initiated by the user (e.g. typed URL),
+// by a page served from the same origin, or by one of the trusted origins. Behind a trusted proxy (see ProxyList),
+// the origin is the host the proxy reports via X-Forwarded-Host.
+// Requests carrying none of these headers are not browser-initiated, and are allowed.
+type CSRFGuard struct {
+	trustedOrigins map[string]bool // "scheme://host[:port]" => true
+}
+
+func newCSRFGuard(trustedOrigins []string) *CSRFGuard {
+	origins := make(map[string]bool)
+	for _, o := range trustedOrigins {
+		origins[strings.TrimSuffix(strings.ToLower(o), "/")] = true
+	}
+	return &CSRFGuard{origins}
+}
+
+func (g *CSRFGuard) check(r *http.Request) error {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return nil
+	}
+
+	if origin := r.Header.Get("Origin"); len(origin) > 0 && origin != "null" {
+		if g.allowOrigin(r, origin) {
+			return nil
+		}
+		return errCrossSiteRequest
+	}
+
+	if referer := r.Header.Get("Referer"); len(referer) > 0 {
+		if g.allowOrigin(r, referer) {
+			return nil
+		}
+		return errCrossSiteRequest
+	}
+
+	if len(r.Header.Get("Sec-Fetch-Site")) > 0 { // cross-site or same-site, with origin stripped
+		return errCrossSiteRequest
+	}
+
+	return nil
+}
+
+func (g *CSRFGuard) allowOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || len(u.Host) == 0 {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if host := trustedProxies.forwardedHost(r); len(host) > 0 && strings.EqualFold(u.Host, host) {
+		return true
+	}
+	return g.trustedOrigins[strings.ToLower(u.Scheme+"://"+u.Host)]
+}
+
+// guard returns true if the request passes the CSRF check, else fails the request.
+func (g *CSRFGuard) guard(w http.ResponseWriter, r *http.Request) bool {
+	if err := g.check(r); err != nil {
+		echoError(Log{"t": "csrf", "path": r.URL.Path, "addr": getRemoteAddr(r), "origin": r.Header.Get("Origin"), "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (g *CSRFGuard) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.guard(w, r) {
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestCSRFGuard(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	g := newCSRFGuard([]string{"https://trusted.example.com/"})
+	req := func(headers ...string) error {
+		r := httptest.NewRequest("POST", "http://wave.example.com/_f/", nil)
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		return g.check(r)
+	}
+	ok(req() == nil, "non-browser request")
+	ok(req("Sec-Fetch-Site", "same-origin") == nil, "same-origin fetch")
+	ok(req("Sec-Fetch-Site", "none") == nil, "user-initiated navigation")
+	ok(req("Sec-Fetch-Site", "cross-site") != nil, "cross-site fetch")
+	ok(req("Sec-Fetch-Site", "cross-site", "Origin", "https://trusted.example.com") == nil, "trusted origin")
+	ok(req("Origin", "http://wave.example.com") == nil, "same origin")
+	ok(req("Origin", "http://evil.example.com") != nil, "foreign origin")
+	ok(req("Origin", "null", "Referer", "http://evil.example.com/x") != nil, "foreign referer")
+	ok(req("Referer", "http://wave.example.com/dashboard") == nil, "same referer")
+
+	ok(req("Origin", "https://evil.example.com", "X-Forwarded-Host", "evil.example.com") != nil, "forwarded host, untrusted")
+	defer func(proxies ProxyList) { trustedProxies = proxies }(trustedProxies)
+	trustedProxies, _ = parseProxyList([]string{"192.0.2.0/24"}) // httptest's remote address
+	ok(req("Origin", "https://wave.example.org", "X-Forwarded-Host", "wave.example.org") == nil, "forwarded host, trusted proxy")
+	ok(req("Origin", "https://evil.example.com", "X-Forwarded-Host", "wave.example.org") != nil, "foreign origin, trusted proxy")
+}
@@ -0,0 +1,268 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// DataServer represents the REST data API, for reading and writing pages and cards over plain HTTP, without
+// speaking the app protocol. Requests are authorized by API access keys, which can be scoped to routes.
+type DataServer struct {
+	prefix         string
+	keychain       *keychain.Keychain
+	tenancy        *Tenancy
+	broker         *Broker
+	maxRequestSize int64
+	spec           []byte // OpenAPI specification, pointing at this server
+}
+
+func newDataServer(prefix string, keychain *keychain.Keychain, tenancy *Tenancy, broker *Broker, maxRequestSize int64) (*DataServer, error) {
+	spec, err := dataAPISpecFor(strings.TrimSuffix(prefix, "/"))
+	if err != nil {
+		return nil, err
+	}
+	return &DataServer{prefix, keychain, tenancy, broker, maxRequestSize, spec}, nil
+}
+
+// dataAPISpecFor returns the OpenAPI specification of the data API, served at url.
+func dataAPISpecFor(url string) ([]byte, error) {
+	var spec map[string]interface{}
+	if err := json.Unmarshal([]byte(dataAPISpec), &spec); err != nil {
+		return nil, fmt.Errorf("failed unmarshaling data API specification: %v", err)
+	}
+	spec["servers"] = []map[string]string{{"url": url}}
+	return json.Marshal(spec)
+}
+
+func (s *DataServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, s.prefix)
+	switch {
+	case p == "openapi.json":
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		w.Write(s.spec)
+	case p == "pages":
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		s.pages(w, r)
+	case strings.HasPrefix(p, "pages/"):
+		route := "/" + strings.TrimPrefix(p, "pages/")
+		if s.guard(w, r, route) {
+			s.page(w, r, route, tenantRoute(s.tenancy.ofKey(r), route))
+		}
+	case strings.HasPrefix(p, "cards/"):
+		i := strings.IndexByte(p[len("cards/"):], '/')
+		if i <= 0 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		name, route := p[len("cards/"):len("cards/")+i], p[len("cards/")+i:]
+		if s.guard(w, r, route) {
+			s.card(w, r, name, tenantRoute(s.tenancy.ofKey(r), route))
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+// guard allows requests carrying a key with read access (GET), or write access (other methods) to route.
+func (s *DataServer) guard(w http.ResponseWriter, r *http.Request, route string) bool {
+	access := keychain.WriteAccess
+	if r.Method == http.MethodGet {
+		access = keychain.ReadAccess
+	}
+	return s.keychain.GuardRoute(w, r, access, route)
+}
+
+// pages lists the routes of the pages the key can read, sorted, except per-client pages.
+func (s *DataServer) pages(w http.ResponseWriter, r *http.Request) {
+	if !s.keychain.Verify(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	id, _, _ := r.BasicAuth()
+	scope, tenant := s.keychain.Scope(id), s.tenancy.ofKey(r)
+	routes := []string{}
+	s.broker.site.pages.each(func(url string, _ *Page) {
+		t, route := splitTenantRoute(url)
+		if t == tenant && scope.Allows(keychain.ReadAccess, route) && !s.broker.isUnicast(url) {
+			routes = append(routes, route)
+		}
+	})
+	sort.Strings(routes)
+	writeJSON(w, routes)
+}
+
+// page reads (GET), creates or replaces (PUT), patches (PATCH) or deletes (DELETE) the page at url.
+func (s *DataServer) page(w http.ResponseWriter, r *http.Request, route, url string) {
+	page := s.broker.site.at(url)
+	switch r.Method {
+	case http.MethodGet:
+		if page == nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		d, err := page.copy()
+		if err != nil {
+			echoError(Log{"t": "data_api", "route": route, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, d)
+	case http.MethodPut:
+		var d PageD
+		if !s.read(w, r, &d) {
+			return
+		}
+		if d.C == nil {
+			http.Error(w, "missing cards", http.StatusBadRequest)
+			return
+		}
+		s.write(w, r, url, d.ops(), page == nil)
+	case http.MethodPatch:
+		var ops OpsD
+		if !s.read(w, r, &ops) {
+			return
+		}
+		if len(ops.D) == 0 {
+			http.Error(w, "missing deltas", http.StatusBadRequest)
+			return
+		}
+		s.write(w, r, url, OpsD{D: ops.D}, page == nil)
+	case http.MethodDelete:
+		if page == nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		s.broker.deletePage(url, keyActor(r))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// card reads (GET), creates or replaces (PUT), changes the attributes of (PATCH) or deletes (DELETE) a card on the
+// page at url. Pages are created as needed.
+func (s *DataServer) card(w http.ResponseWriter, r *http.Request, name, url string) {
+	var (
+		card   CardD
+		exists bool
+	)
+	if page := s.broker.site.at(url); page != nil {
+		d, err := page.copy()
+		if err != nil {
+			echoError(Log{"t": "data_api", "route": url, "card": name, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		card, exists = d.C[name]
+	}
+	if !exists && r.Method != http.MethodPut {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, card)
+	case http.MethodPut:
+		var d CardD
+		if !s.read(w, r, &d) {
+			return
+		}
+		if d.D == nil {
+			http.Error(w, "missing card data", http.StatusBadRequest)
+			return
+		}
+		s.write(w, r, url, OpsD{D: []OpD{{K: name, D: d.D, B: d.B}}}, !exists)
+	case http.MethodPatch:
+		var attrs map[string]interface{}
+		if !s.read(w, r, &attrs) {
+			return
+		}
+		if len(attrs) == 0 {
+			http.Error(w, "missing attributes", http.StatusBadRequest)
+			return
+		}
+		keys := make([]string, 0, len(attrs))
+		for k := range attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		ops := make([]OpD, len(keys))
+		for i, k := range keys {
+			ops[i] = OpD{K: name + keySeparator + k, V: attrs[k]}
+		}
+		s.write(w, r, url, OpsD{D: ops}, false)
+	case http.MethodDelete:
+		s.write(w, r, url, OpsD{D: []OpD{{K: name}}}, false)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// read reads a request's JSON body into v, replying with an error if it cannot.
+func (s *DataServer) read(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.ContentLength > s.maxRequestSize { // don't bother reading
+		writeRequestTooLarge(w, s.maxRequestSize)
+		return false
+	}
+	b, err := readRequestWithLimit(w, r.Body, s.maxRequestSize)
+	if err != nil {
+		echoError(Log{"t": "read data api request body", "error": err.Error()})
+		if isRequestTooLarge(err) {
+			writeRequestTooLarge(w, s.maxRequestSize)
+			return false
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest) // tell the caller why
+		return false
+	}
+	return true
+}
+
+// write applies ops to the page at url, broadcasting the changes to clients, as if sent by an app.
+func (s *DataServer) write(w http.ResponseWriter, r *http.Request, url string, ops OpsD, created bool) {
+	data, err := json.Marshal(ops)
+	if err != nil {
+		echoError(Log{"t": "data_api", "route": url, "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := s.broker.patch(url, data, keyActor(r)); err != nil {
+		writePatchError(w, err)
+		return
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
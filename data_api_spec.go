@@ -0,0 +1,210 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+// dataAPISpec is the OpenAPI specification of the data API (see DataServer); servers are filled in when served.
+const dataAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Wave data API",
+    "description": "Read and write pages and cards on a Wave server over plain HTTP. Changes are broadcast to browsers watching the pages, just like changes made by apps.",
+    "version": "1"
+  },
+  "security": [{"accessKey": []}],
+  "paths": {
+    "/pages": {
+      "get": {
+        "summary": "List pages",
+        "description": "Lists the routes of the pages the access key can read, sorted. Per-client pages are not listed.",
+        "operationId": "listPages",
+        "responses": {
+          "200": {"description": "Routes of pages.", "content": {"application/json": {"schema": {"type": "array", "items": {"type": "string"}}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/pages/{route}": {
+      "parameters": [{"$ref": "#/components/parameters/route"}],
+      "get": {
+        "summary": "Read a page",
+        "operationId": "getPage",
+        "responses": {
+          "200": {"description": "The page.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Page"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "put": {
+        "summary": "Create or replace a page",
+        "operationId": "putPage",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Page"}}}},
+        "responses": {
+          "201": {"description": "Page created."},
+          "204": {"description": "Page replaced."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "413": {"$ref": "#/components/responses/TooLarge"}
+        }
+      },
+      "patch": {
+        "summary": "Patch a page",
+        "description": "Applies deltas to a page, as apps do, creating the page if needed.",
+        "operationId": "patchPage",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Patch"}}}},
+        "responses": {
+          "201": {"description": "Page created."},
+          "204": {"description": "Page patched."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "413": {"$ref": "#/components/responses/TooLarge"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a page",
+        "operationId": "deletePage",
+        "responses": {
+          "204": {"description": "Page deleted."},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/cards/{card}/{route}": {
+      "parameters": [
+        {"name": "card", "in": "path", "required": true, "description": "Name of the card on the page.", "schema": {"type": "string"}},
+        {"$ref": "#/components/parameters/route"}
+      ],
+      "get": {
+        "summary": "Read a card",
+        "operationId": "getCard",
+        "responses": {
+          "200": {"description": "The card.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Card"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "put": {
+        "summary": "Create or replace a card",
+        "description": "Creates the page too, if needed.",
+        "operationId": "putCard",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Card"}}}},
+        "responses": {
+          "201": {"description": "Card created."},
+          "204": {"description": "Card replaced."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "413": {"$ref": "#/components/responses/TooLarge"}
+        }
+      },
+      "patch": {
+        "summary": "Change a card's attributes",
+        "description": "Sets the given attributes of a card, leaving others as they are. Keys are attribute names, or space-separated paths into attributes, e.g. \"items 0 label\", or into data buffers, e.g. \"data 3\" or \"data -1\" to append to a cyclic buffer; null removes an attribute.",
+        "operationId": "patchCard",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "object", "additionalProperties": true}, "example": {"title": "Sales", "data -1": ["2021-06-01", 42]}}}},
+        "responses": {
+          "204": {"description": "Card changed."},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "413": {"$ref": "#/components/responses/TooLarge"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a card",
+        "operationId": "deleteCard",
+        "responses": {
+          "204": {"description": "Card deleted."},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "accessKey": {"type": "http", "scheme": "basic", "description": "API access key ID and secret. Keys scoped to routes can read (GET) or write (other methods) only pages at those routes."}
+    },
+    "parameters": {
+      "route": {"name": "route", "in": "path", "required": true, "description": "Route of the page, without the leading slash, e.g. dashboards/sales; may contain slashes.", "schema": {"type": "string"}}
+    },
+    "schemas": {
+      "Page": {
+        "type": "object",
+        "required": ["c"],
+        "properties": {
+          "c": {"type": "object", "description": "Cards, by name.", "additionalProperties": {"$ref": "#/components/schemas/Card"}}
+        },
+        "example": {"c": {"hello": {"d": {"view": "markdown", "box": "1 1 2 2", "title": "Hello", "content": "World"}}}}
+      },
+      "Card": {
+        "type": "object",
+        "required": ["d"],
+        "properties": {
+          "d": {"type": "object", "description": "Attributes, including \"view\" and \"box\". An attribute named \"~name\" holding an index into the buffers makes that buffer attribute \"name\".", "additionalProperties": true},
+          "b": {"type": "array", "description": "Data buffers.", "items": {"$ref": "#/components/schemas/Buffer"}}
+        }
+      },
+      "Buffer": {
+        "type": "object",
+        "description": "A data buffer: cyclic (c), fixed-size (f) or keyed (m); exactly one is set.",
+        "properties": {
+          "c": {"type": "object", "properties": {"f": {"type": "array", "items": {"type": "string"}}, "d": {"type": "array", "items": {"type": "array", "items": {}}}, "n": {"type": "integer"}, "i": {"type": "integer"}}},
+          "f": {"type": "object", "properties": {"f": {"type": "array", "items": {"type": "string"}}, "d": {"type": "array", "items": {"type": "array", "items": {}}}, "n": {"type": "integer"}}},
+          "m": {"type": "object", "properties": {"f": {"type": "array", "items": {"type": "string"}}, "d": {"type": "object", "additionalProperties": {"type": "array", "items": {}}}}}
+        }
+      },
+      "Patch": {
+        "type": "object",
+        "required": ["d"],
+        "properties": {
+          "d": {"type": "array", "description": "Deltas, applied in order.", "items": {"$ref": "#/components/schemas/Delta"}}
+        },
+        "example": {"d": [{"k": "hello content", "v": "Wave"}]}
+      },
+      "Delta": {
+        "type": "object",
+        "description": "A change to a page. With k alone, deletes a card (or the whole page, if k is empty). With d (and b), puts a card. With v, sets a card attribute, or an entry of a buffer.",
+        "properties": {
+          "k": {"type": "string", "description": "Card name, optionally followed by a space-separated path into the card, e.g. \"hello title\"."},
+          "v": {"description": "Value to set."},
+          "d": {"type": "object", "description": "Card attributes, to put a card.", "additionalProperties": true},
+          "b": {"type": "array", "description": "Card data buffers, to put a card.", "items": {"$ref": "#/components/schemas/Buffer"}},
+          "c": {"$ref": "#/components/schemas/Buffer/properties/c"},
+          "f": {"$ref": "#/components/schemas/Buffer/properties/f"},
+          "m": {"$ref": "#/components/schemas/Buffer/properties/m"}
+        }
+      },
+      "QuotaError": {
+        "type": "object",
+        "properties": {"error": {"type": "string", "example": "quota_exceeded"}, "quota": {"type": "object"}}
+      }
+    },
+    "responses": {
+      "BadRequest": {"description": "Malformed request body.", "content": {"text/plain": {"schema": {"type": "string"}}}},
+      "Unauthorized": {"description": "Missing or invalid access key."},
+      "Forbidden": {"description": "The access key is not allowed this access to the route."},
+      "NotFound": {"description": "No such page or card."},
+      "TooLarge": {"description": "Request too large, or the change would make the page exceed its quota.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/QuotaError"}}}}
+    }
+  }
+}`
@@ -0,0 +1,92 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+func TestDataServer(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	id, secret, hash, err := keychain.CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+	reader, readerSecret, hash, err := keychain.CreateAccessKey()
+	no(err)
+	scope, err := keychain.ParseScope("read,/dashboards")
+	no(err)
+	kc.AddScoped(reader, hash, scope)
+
+	broker := newBroker(newSite(), false, false, true)
+	s, err := newDataServer("/_api/", kc, nil, broker, 1024)
+	no(err)
+	call := func(method, path, body, id, secret string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.SetBasicAuth(id, secret)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		return call(method, path, body, id, secret)
+	}
+
+	w := do("GET", "/_api/openapi.json", "")
+	eq(w.Code, http.StatusOK)
+	var spec map[string]interface{}
+	no(json.Unmarshal(w.Body.Bytes(), &spec))
+	eq(spec["servers"], []interface{}{map[string]interface{}{"url": "/_api"}})
+
+	eq(do("GET", "/_api/pages/dashboards/sales", "").Code, http.StatusNotFound)
+	eq(do("PUT", "/_api/pages/dashboards/sales", `{"c":{"total":{"d":{"view":"small_stat","title":"Total","value":"1"}}}}`).Code, http.StatusCreated)
+	eq(do("PUT", "/_api/pages/dashboards/sales", `{"c":{"total":{"d":{"view":"small_stat","title":"Total","value":"2"}}}}`).Code, http.StatusNoContent)
+	eq(do("PUT", "/_api/pages/dashboards/sales", `{"c":`).Code, http.StatusBadRequest)
+	eq(do("PATCH", "/_api/pages/dashboards/sales", `{"d":[{"k":"total title","v":"Sales"}]}`).Code, http.StatusNoContent)
+	eq(broker.site.at("/dashboards/sales").cards["total"].data["title"], "Sales")
+
+	w = do("GET", "/_api/pages/dashboards/sales", "")
+	eq(w.Code, http.StatusOK)
+	eq(w.Body.String(), `{"c":{"total":{"d":{"title":"Sales","value":"2","view":"small_stat"}}}}`)
+
+	eq(do("PUT", "/_api/cards/notes/dashboards/sales", `{"d":{"view":"markdown","content":"Hi"}}`).Code, http.StatusCreated)
+	eq(do("PATCH", "/_api/cards/notes/dashboards/sales", `{"content":"Hello","title":"Notes"}`).Code, http.StatusNoContent)
+	eq(do("PATCH", "/_api/cards/missing/dashboards/sales", `{"content":"Hello"}`).Code, http.StatusNotFound)
+	w = do("GET", "/_api/cards/notes/dashboards/sales", "")
+	eq(w.Code, http.StatusOK)
+	eq(w.Body.String(), `{"d":{"content":"Hello","title":"Notes","view":"markdown"}}`)
+	eq(do("DELETE", "/_api/cards/notes/dashboards/sales", "").Code, http.StatusNoContent)
+	eq(do("GET", "/_api/cards/notes/dashboards/sales", "").Code, http.StatusNotFound)
+
+	eq(do("PUT", "/_api/pages/home", `{"c":{}}`).Code, http.StatusCreated)
+	eq(do("GET", "/_api/pages", "").Body.String(), `["/dashboards/sales","/home"]`)
+	eq(call("GET", "/_api/pages", "", reader, readerSecret).Body.String(), `["/dashboards/sales"]`)
+	eq(call("GET", "/_api/pages/home", "", reader, readerSecret).Code, http.StatusForbidden)
+	eq(call("PATCH", "/_api/pages/dashboards/sales", `{"d":[{"k":"total"}]}`, reader, readerSecret).Code, http.StatusForbidden)
+	eq(call("GET", "/_api/pages", "", id, "wrong").Code, http.StatusUnauthorized)
+
+	eq(do("DELETE", "/_api/pages/home", "").Code, http.StatusNoContent)
+	ok(broker.site.at("/home") == nil, "deleted")
+	eq(do("DELETE", "/_api/pages/home", "").Code, http.StatusNotFound)
+}
@@ -15,8 +15,13 @@
 package wave
 
 import (
+	"expvar"
 	"net/http"
+	"net/http/pprof"
+	"strings"
 	"text/template"
+
+	"github.com/h2oai/wave/pkg/keychain"
 )
 
 const siteTemplate = `
@@ -57,3 +62,43 @@ func (h *DebugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	h.siteTemplate.Execute(w, data)
 }
+
+// DebugServer serves the debug endpoints, for clients with access keys: the site profile at /site, Go runtime
+// profiles (see net/http/pprof) at /pprof/, and runtime variables (see expvar) at /vars.
+type DebugServer struct {
+	keychain *keychain.Keychain
+	mux      *http.ServeMux
+}
+
+func newDebugServer(broker *Broker, keychain *keychain.Keychain) *DebugServer {
+	mux := http.NewServeMux()
+	mux.Handle("/site", newDebugHandler(broker))
+	mux.HandleFunc("/pprof/", serveProfile)
+	mux.Handle("/vars", expvar.Handler())
+	return &DebugServer{keychain, mux}
+}
+
+func (s *DebugServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.keychain.Guard(w, r) {
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// serveProfile serves a runtime profile by name, e.g. /pprof/heap, or lists the available profiles.
+func serveProfile(w http.ResponseWriter, r *http.Request) {
+	switch name := strings.TrimPrefix(r.URL.Path, "/pprof/"); name {
+	case "":
+		pprof.Index(w, r)
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Handler(name).ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+func TestDebugServer(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	id, secret, hash, err := keychain.CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+	h := http.StripPrefix("/_d", newDebugServer(newBroker(newSite(), false, true, true), kc))
+
+	get := func(url string, key bool) (int, string) {
+		r := httptest.NewRequest("GET", url, nil)
+		if key {
+			r.SetBasicAuth(id, secret)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	code, _ := get("/_d/pprof/goroutine?debug=1", false)
+	eq(code, http.StatusUnauthorized)
+
+	code, body := get("/_d/pprof/goroutine?debug=1", true)
+	eq(code, http.StatusOK)
+	ok(strings.Contains(body, "goroutine profile:"), "goroutine profile")
+
+	code, body = get("/_d/pprof/", true)
+	eq(code, http.StatusOK)
+	ok(strings.Contains(body, "heap"), "profile index")
+
+	code, body = get("/_d/vars", true)
+	eq(code, http.StatusOK)
+	ok(strings.Contains(body, `"memstats"`), "runtime variables")
+
+	code, body = get("/_d/site", true)
+	eq(code, http.StatusOK)
+	ok(strings.Contains(body, "No apps."), "site profile")
+}
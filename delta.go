@@ -0,0 +1,131 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// capDeltas is the capability advertised by clients that accept card deltas in lieu of whole cards.
+const capDeltas = "deltas"
+
+// diffCard returns the set operations that transform card prev at key k into card next,
+// or false if the difference cannot be expressed as set operations, in which case the whole card must be put.
+//
+// Attributes are compared by value. Fixed-size and map buffers are compared row-by-row, provided their
+// fields (and for fixed-size buffers, sizes) are unchanged. Cyclic buffers must be identical, or the card is put.
+func diffCard(k string, prev, next *Card) ([]OpD, bool) {
+	for f, pv := range prev.data {
+		if _, ok := next.data[f]; !ok {
+			if _, ok := pv.(Buf); ok { // buffers cannot be deleted via set
+				return nil, false
+			}
+		}
+	}
+
+	fs := make([]string, 0, len(prev.data)+len(next.data))
+	for f := range next.data {
+		fs = append(fs, f)
+	}
+	for f := range prev.data {
+		if _, ok := next.data[f]; !ok {
+			fs = append(fs, f)
+		}
+	}
+	sort.Strings(fs) // for deterministic output
+
+	var ops []OpD
+	for _, f := range fs {
+		if strings.Contains(f, keySeparator) {
+			return nil, false
+		}
+		key := k + keySeparator + f
+		pv, nv := prev.data[f], next.data[f]
+		pb, pIsBuf := pv.(Buf)
+		nb, nIsBuf := nv.(Buf)
+		switch {
+		case !pIsBuf && !nIsBuf:
+			if !reflect.DeepEqual(pv, nv) {
+				ops = append(ops, OpD{K: key, V: nv})
+			}
+		case pIsBuf && nIsBuf:
+			d, ok := diffBuf(key, pb, nb)
+			if !ok {
+				return nil, false
+			}
+			ops = append(ops, d...)
+		default: // attribute replaced by buffer, or vice versa
+			return nil, false
+		}
+	}
+	return ops, true
+}
+
+func diffBuf(k string, prev, next Buf) ([]OpD, bool) {
+	switch n := next.(type) {
+	case *FixBuf:
+		p, ok := prev.(*FixBuf)
+		if !ok || len(p.tups) != len(n.tups) || !reflect.DeepEqual(p.t.f, n.t.f) {
+			return nil, false
+		}
+		var ops []OpD
+		for i, tup := range n.tups {
+			if !reflect.DeepEqual(p.tups[i], tup) {
+				ops = append(ops, OpD{K: k + keySeparator + strconv.Itoa(i), V: tupValue(tup)})
+			}
+		}
+		return ops, true
+	case *MapBuf:
+		p, ok := prev.(*MapBuf)
+		if !ok || !reflect.DeepEqual(p.t.f, n.t.f) {
+			return nil, false
+		}
+		keys := make([]string, 0, len(p.tups)+len(n.tups))
+		for key := range n.tups {
+			keys = append(keys, key)
+		}
+		for key := range p.tups {
+			if _, ok := n.tups[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		var ops []OpD
+		for _, key := range keys {
+			if strings.Contains(key, keySeparator) {
+				return nil, false
+			}
+			if tup := n.tups[key]; !reflect.DeepEqual(p.tups[key], tup) {
+				ops = append(ops, OpD{K: k + keySeparator + key, V: tupValue(tup)})
+			}
+		}
+		return ops, true
+	}
+	if reflect.DeepEqual(prev.dump(), next.dump()) {
+		return nil, true
+	}
+	return nil, false
+}
+
+// tupValue returns a tuple as a set value; a nil tuple must be sent as an untyped nil to clear the row.
+func tupValue(tup []interface{}) interface{} {
+	if tup == nil {
+		return nil
+	}
+	return tup
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestSiteUpdateDeltas(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	site := newSite()
+	update := func(data string) string {
+		deltas, err := site.update("/foo", []byte(data), true, "")
+		no(err)
+		b, err := json.Marshal(OpsD{D: deltas})
+		no(err)
+		return string(b)
+	}
+
+	card := `{"d":[{"k":"c","d":{"title":"s","view":"v","~data":0},"b":[{"f":{"f":["x"],"d":[[1],[2]],"n":2}}]}]}`
+
+	eq(update(card), card) // new card
+
+	eq(update(`{"d":[{"k":"c","d":{"title":"t","view":"v","~data":0},"b":[{"f":{"f":["x"],"d":[[1],[3]],"n":2}}]}]}`),
+		`{"d":[{"k":"c data 1","v":[3]},{"k":"c title","v":"t"}]}`) // changed row and attribute
+
+	eq(update(`{"d":[{"k":"c","d":{"view":"v","~data":0},"b":[{"f":{"f":["x"],"d":[[1],[3]],"n":2}}]}]}`),
+		`{"d":[{"k":"c title"}]}`) // deleted attribute
+
+	changed := `{"d":[{"k":"c","d":{"view":"v","~data":0},"b":[{"f":{"f":["y"],"d":[[1],[3]],"n":2}}]}]}`
+	eq(update(changed), changed) // changed buffer fields
+}
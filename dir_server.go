@@ -31,7 +31,7 @@ func newDirServer(dir string, keychain *keychain.Keychain, auth *Auth) http.Hand
 	return &DirServer{
 		keychain,
 		auth,
-		http.FileServer(http.Dir(dir)),
+		newETagFileServer(http.Dir(dir)),
 	}
 }
 
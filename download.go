@@ -0,0 +1,260 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/h2oai/wave/pkg/blob"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+const defaultDownloadExpiry = time.Hour
+
+// downloadResponseHeaders are the download sources' response headers passed on to browsers.
+var downloadResponseHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Content-Encoding", "Content-Disposition", "Accept-Ranges", "ETag", "Last-Modified"}
+
+// DownloadRequest represents a request from an app to register a download.
+type DownloadRequest struct {
+	URL      string            `json:"url"`                // source: an http(s) URL, or an object storage URL, e.g. "s3://bucket/key"
+	Filename string            `json:"filename,omitempty"` // name to save the download as; defaults to the source's name
+	Headers  map[string]string `json:"headers,omitempty"`  // sent to http(s) sources, e.g. Authorization
+	Owner    string            `json:"owner,omitempty"`    // subject of the only user allowed to download; any signed-in user if empty
+	Public   bool              `json:"public,omitempty"`   // allow anyone to download, even if not signed in?
+	Expiry   int               `json:"expiry,omitempty"`   // seconds; defaults to one hour
+	Once     bool              `json:"once,omitempty"`     // allow only one download?
+}
+
+// DownloadResponse represents the response to a download registration.
+type DownloadResponse struct {
+	Path string `json:"path"`
+}
+
+// Download represents a registered download.
+type Download struct {
+	source   func(r *http.Request) (*http.Response, error)
+	filename string
+	access   *FileAccess
+	expires  time.Time
+	once     bool
+}
+
+// DownloadServer streams downloads registered by apps from their source to browsers, without buffering them,
+// e.g. large exports generated on the fly by apps, or objects in object storage.
+// Registered downloads are kept in memory, and are lost if the server restarts.
+type DownloadServer struct {
+	sync.Mutex
+	prefix    string
+	keychain  *keychain.Keychain
+	auth      *Auth
+	client    *http.Client
+	downloads map[string]*Download // id => download
+}
+
+func newDownloadServer(prefix string, keychain *keychain.Keychain, auth *Auth) *DownloadServer {
+	return &DownloadServer{
+		prefix:    prefix,
+		keychain:  keychain,
+		auth:      auth,
+		client:    &http.Client{}, // no timeout; downloads take as long as they take
+		downloads: make(map[string]*Download),
+	}
+}
+
+var errDownloadSource = errors.New("want http(s), s3, gs or azblob download URL")
+
+func (s *DownloadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		if !s.keychain.Guard(w, r) { // API only
+			return
+		}
+		s.register(w, r)
+	case http.MethodGet, http.MethodHead:
+		s.serve(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *DownloadServer) register(w http.ResponseWriter, r *http.Request) {
+	var req DownloadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Expiry < 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	source, name, err := s.openSource(req.URL, req.Headers)
+	if err != nil {
+		echoError(Log{"t": "download_register", "error": err.Error()})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Filename) > 0 {
+		name = path.Base(path.Clean("/" + req.Filename))
+	}
+	if name == "/" || name == "." {
+		name = "download"
+	}
+	expiry := defaultDownloadExpiry
+	if req.Expiry > 0 {
+		expiry = time.Duration(req.Expiry) * time.Second
+	}
+
+	id := uuid.New().String()
+	now := time.Now()
+	s.Lock()
+	for id, d := range s.downloads {
+		if now.After(d.expires) {
+			delete(s.downloads, id)
+		}
+	}
+	s.downloads[id] = &Download{source, name, &FileAccess{Owner: req.Owner, Public: req.Public}, now.Add(expiry), req.Once}
+	s.Unlock()
+
+	echo(Log{"t": "download_register", "id": id, "file": name, "expiry": expiry.String()})
+	writeJSON(w, DownloadResponse{s.prefix + id + "/" + url.PathEscape(name)})
+}
+
+// openSource returns a function that opens a download's source, and the source's name.
+func (s *DownloadServer) openSource(rawURL string, headers map[string]string) (func(r *http.Request) (*http.Response, error), string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", errDownloadSource
+	}
+	name := path.Base(u.Path)
+	switch u.Scheme {
+	case "http", "https":
+		return func(r *http.Request) (*http.Response, error) {
+			req, err := http.NewRequestWithContext(r.Context(), r.Method, rawURL, nil)
+			if err != nil {
+				return nil, err
+			}
+			for k, v := range headers {
+				req.Header.Set(k, v)
+			}
+			passHeaders(req.Header, r.Header, blobRequestHeaders)
+			return s.client.Do(req)
+		}, name, nil
+	case "s3", "gs", "azblob":
+		p := strings.TrimPrefix(u.Path, "/")
+		if u.Scheme == "azblob" { // azblob://account/container/key
+			i := strings.IndexByte(p, '/')
+			if i < 0 {
+				return nil, "", errDownloadSource
+			}
+			u.Path, p = "/"+p[:i], p[i+1:]
+		} else {
+			u.Path = ""
+		}
+		if len(p) == 0 {
+			return nil, "", errDownloadSource
+		}
+		store, err := blob.Open(u.String())
+		if err != nil {
+			return nil, "", err
+		}
+		return func(r *http.Request) (*http.Response, error) {
+			header := make(http.Header)
+			passHeaders(header, r.Header, blobRequestHeaders)
+			return store.Get(r.Context(), p, header)
+		}, name, nil
+	}
+	return nil, "", errDownloadSource
+}
+
+// get returns the download at p ("/id/filename"), if any; once-only downloads are removed if consumed.
+func (s *DownloadServer) get(p string, session *Session, consume bool) (*Download, int) {
+	tokens := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+	s.Lock()
+	defer s.Unlock()
+	d, ok := s.downloads[tokens[0]]
+	if !ok || time.Now().After(d.expires) {
+		return nil, http.StatusNotFound
+	}
+	if s.auth != nil && !d.access.allows(session) {
+		if session == nil {
+			return nil, http.StatusUnauthorized
+		}
+		return nil, http.StatusForbidden
+	}
+	if d.once && consume {
+		delete(s.downloads, tokens[0])
+	}
+	return d, http.StatusOK
+}
+
+func (s *DownloadServer) serve(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, s.prefix)
+	var session *Session
+	if s.auth != nil {
+		session = s.auth.identify(r)
+	}
+	d, status := s.get(p, session, r.Method == http.MethodGet) // HEAD requests, e.g. link previews, leave once-only downloads in place
+	if d == nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	res, err := d.source(r)
+	if err != nil {
+		echoError(Log{"t": "download", "path": r.URL.Path, "error": err.Error()})
+		if err == blob.ErrNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 && res.StatusCode != http.StatusRequestedRangeNotSatisfiable && res.StatusCode != http.StatusPreconditionFailed {
+		echoError(Log{"t": "download", "path": r.URL.Path, "error": fmt.Sprintf("source replied %d", res.StatusCode)})
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	passHeaders(w.Header(), res.Header, downloadResponseHeaders)
+	if len(w.Header().Get("Content-Disposition")) == 0 {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": d.filename}))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(res.StatusCode)
+	n, err := io.Copy(w, res.Body)
+	if err != nil {
+		echoError(Log{"t": "download", "path": r.URL.Path, "bytes": strconv.FormatInt(n, 10), "error": err.Error()})
+		return
+	}
+	echo(Log{"t": "download", "path": r.URL.Path, "bytes": strconv.FormatInt(n, 10)})
+}
+
+// passHeaders copies the given headers from src to dst, if present.
+func passHeaders(dst, src http.Header, keys []string) {
+	for _, k := range keys {
+		if v := src.Get(k); len(v) > 0 {
+			dst.Set(k, v)
+		}
+	}
+}
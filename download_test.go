@@ -0,0 +1,100 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+func TestDownloadServer(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write([]byte(strings.Repeat("a,b\n", 1000)))
+	}))
+	defer app.Close()
+
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	id, secret, hash, err := keychain.CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+	s := newDownloadServer("/_dl/", kc, newTestAuth("alice", "bob"))
+
+	register := func(req DownloadRequest) (int, string) {
+		b, _ := json.Marshal(req)
+		r := httptest.NewRequest("POST", "/_dl/", strings.NewReader(string(b)))
+		r.SetBasicAuth(id, secret)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		var res DownloadResponse
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res.Path
+	}
+	request := func(method, p, subject string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, asUser(httptest.NewRequest(method, p, nil), subject))
+		return w
+	}
+	download := func(p, subject string) *httptest.ResponseRecorder {
+		return request("GET", p, subject)
+	}
+
+	code, p := register(DownloadRequest{URL: app.URL + "/export", Filename: "data.csv", Headers: map[string]string{"Authorization": "Bearer token"}, Owner: "alice", Once: true})
+	eq(code, http.StatusOK)
+	ok(strings.HasPrefix(p, "/_dl/"))
+	ok(strings.HasSuffix(p, "/data.csv"))
+
+	eq(download(p, "").Code, http.StatusUnauthorized)
+	eq(download(p, "bob").Code, http.StatusForbidden)
+	eq(request("HEAD", p, "alice").Code, http.StatusOK) // does not consume
+	w := download(p, "alice")
+	eq(w.Code, http.StatusOK)
+	eq(w.Body.Len(), 4000)
+	eq(w.Header().Get("Content-Type"), "text/csv")
+	eq(w.Header().Get("Content-Disposition"), `attachment; filename=data.csv`)
+	eq(download(p, "alice").Code, http.StatusNotFound) // once only
+
+	_, p = register(DownloadRequest{URL: app.URL + "/export", Filename: `résumé "final".csv`, Headers: map[string]string{"Authorization": "Bearer token"}})
+	w = download(p, "alice")
+	eq(w.Code, http.StatusOK)
+	_, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+	no(err)
+	eq(params["filename"], `résumé "final".csv`)
+
+	_, p = register(DownloadRequest{URL: app.URL + "/export"}) // source refuses
+	eq(download(p, "alice").Code, http.StatusBadGateway)
+
+	code, _ = register(DownloadRequest{URL: "file:///etc/passwd"})
+	eq(code, http.StatusBadRequest)
+
+	r := httptest.NewRequest("POST", "/_dl/", strings.NewReader(`{"url":"https://example.com/a"}`))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	eq(w.Code, http.StatusUnauthorized)
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// EditRecord represents an entry in the edit audit log: a change made to a page by a person, rather than an app.
+type EditRecord struct {
+	Time   time.Time `json:"time"`
+	Route  string    `json:"route"`
+	Actor  string    `json:"actor"` // "user:<subject>" for edits from the UI, "key:<access key id>" for rollbacks
+	Addr   string    `json:"addr,omitempty"`
+	Digest string    `json:"digest"` // SHA-256 of the change, hex-encoded
+	Size   int       `json:"size"`   // size of the change, in bytes
+}
+
+// EditFilter represents the criteria for querying the edit audit log; zero values match all entries.
+type EditFilter struct {
+	Route string
+	Actor string
+	Since time.Time
+	Limit int // most recent entries to return
+}
+
+func (f EditFilter) match(e EditRecord) bool {
+	return (len(f.Route) == 0 || e.Route == f.Route) &&
+		(len(f.Actor) == 0 || e.Actor == f.Actor) &&
+		!e.Time.Before(f.Since)
+}
+
+// EditAudit represents an append-only log of page edits, one JSON object per line, written to an audit sink (see
+// AuditLog). Unlike AuditLog, entries are written synchronously, before the edit is applied, so that no edit goes
+// unrecorded: if an entry cannot be written, the edit is rejected. Webhook entries are queued instead, lest edits wait on
+// the webhook; the edit is rejected if the queue is full, but not if the entry later fails to post.
+type EditAudit struct {
+	sink AuditSink
+	path string // file the sink appends to, for queries; "" if not a file
+}
+
+var errEditAuditNotQueryable = errors.New("edit audit log is not a file")
+
+// openEditAudit opens an edit audit log from a sink spec, as for AuditLog. Only file logs can be queried.
+func openEditAudit(spec string) (*EditAudit, error) {
+	sink, err := openAuditSink(spec)
+	if err != nil {
+		return nil, err
+	}
+	var path string
+	if f, ok := sink.(*FileAuditSink); ok {
+		path = f.file.Name()
+	}
+	return &EditAudit{sink, path}, nil
+}
+
+// record appends an edit of a route to the log, returning an error if the edit must be rejected.
+// Safe to call on a nil log.
+func (a *EditAudit) record(route, actor, addr string, data []byte) error {
+	if a == nil {
+		return nil
+	}
+	digest := sha256.Sum256(data)
+	entry, err := json.Marshal(EditRecord{time.Now().UTC(), route, actor, addr, hex.EncodeToString(digest[:]), len(data)})
+	if err != nil {
+		return err
+	}
+	if err := a.sink.write(entry); err != nil {
+		echoError(Log{"t": "edit_audit", "route": route, "actor": actor, "error": err.Error()})
+		return err
+	}
+	return nil
+}
+
+// query returns the entries matching a filter, oldest first. Entries are written in one go, so reading does not
+// block edits; a line still being written is skipped.
+func (a *EditAudit) query(filter EditFilter) ([]EditRecord, error) {
+	if len(a.path) == 0 {
+		return nil, errEditAuditNotQueryable
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []EditRecord{}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF { // partial, if any
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e EditRecord
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, err
+		}
+		if !filter.match(e) {
+			continue
+		}
+		records = append(records, e)
+		if filter.Limit > 0 && len(records) > filter.Limit {
+			records = records[1:]
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+func TestEditAudit(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	a, err := openEditAudit(filepath.Join(t.TempDir(), "edits.log"))
+	no(err)
+	start := time.Now().UTC().Add(-time.Second)
+	no(a.record("/foo", "user:alice", "192.0.2.1", []byte(`{"d":[{"k":"x.content","v":"a"}]}`)))
+	no(a.record("/bar", "user:bob", "192.0.2.2", []byte(`{"d":[{"k":"y.content","v":"b"}]}`)))
+	no(a.record("/foo", "user:bob", "192.0.2.2", []byte(`{"d":[{"k":"x.content","v":"c"}]}`)))
+	a.sink.(*FileAuditSink).file.Write([]byte(`{"time":`)) // being written
+
+	records, err := a.query(EditFilter{Route: "/foo"})
+	no(err)
+	eq(len(records), 2)
+	eq(records[0].Actor, "user:alice")
+	eq(records[0].Size, 33)
+	eq(len(records[0].Digest), 64)
+	eq(records[1].Actor, "user:bob")
+
+	records, err = a.query(EditFilter{Actor: "user:bob", Limit: 1})
+	no(err)
+	eq(len(records), 1)
+	eq(records[0].Route, "/foo")
+
+	records, err = a.query(EditFilter{Since: start.Add(time.Hour)})
+	no(err)
+	eq(len(records), 0)
+
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	id, secret, hash, err := keychain.CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+	broker := newBroker(newSite(), false, true, true)
+	broker.edits = a
+	admin := newAdminServer("/_a/", kc, nil, broker, 1024, nil)
+
+	r := httptest.NewRequest("GET", "/_a/edits/bar", nil)
+	r.SetBasicAuth(id, secret)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	eq(w.Code, http.StatusOK)
+	no(json.Unmarshal(w.Body.Bytes(), &records))
+	eq(len(records), 1)
+	eq(records[0].Addr, "192.0.2.2")
+
+	r = httptest.NewRequest("GET", "/_a/edits?since=yesterday", nil)
+	r.SetBasicAuth(id, secret)
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	eq(w.Code, http.StatusBadRequest)
+}
+
+// failingAuditSink represents an audit sink that cannot be written to.
+type failingAuditSink struct{}
+
+func (failingAuditSink) write(entry []byte) error { return errors.New("disk full") }
+func (failingAuditSink) close() error             { return nil }
+
+func TestEditAuditFailClosed(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	id, secret, hash, err := keychain.CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+	broker := newBroker(newSite(), false, true, true)
+	broker.edits = &EditAudit{sink: failingAuditSink{}}
+	admin := newAdminServer("/_a/", kc, nil, broker, 1024, nil)
+
+	snapshot := `{"version":1,"route":"/foo","page":{"c":{"x":{"d":{"view":"markdown"}}}}}`
+	r := httptest.NewRequest("PUT", "/_a/snapshot/foo", strings.NewReader(snapshot))
+	r.SetBasicAuth(id, secret)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	eq(w.Code, http.StatusServiceUnavailable)
+	ok(broker.site.at("/foo") == nil, "edit rejected")
+
+	r = httptest.NewRequest("GET", "/_a/edits", nil)
+	r.SetBasicAuth(id, secret)
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	eq(w.Code, http.StatusNotImplemented)
+
+	broker.editable = true
+	c := newClient("192.0.2.1", nil, anonymous, "", broker, nil, true, false, false, browserProtocolVersion, "/")
+	c.handle([]byte(`* /foo {"d":[{"k":"x","d":{"view":"markdown"}}]}`))
+	eq(string(<-c.data), `{"e":"edit_not_recorded"}`) // sink errors are not disclosed
+	ok(broker.site.at("/foo") == nil, "edit rejected")
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrorPagesConf represents the configuration for custom, e.g. branded, error output.
+type ErrorPagesConf struct {
+	HTTP           map[int]string // HTML files shown to browsers in lieu of HTTP error messages, by status code
+	NotFound       string         // JSON file of cards shown for routes with no page or app
+	AppUnavailable string         // JSON file of cards shown for routes whose app is no longer registered
+}
+
+// ErrorPages represents custom error output.
+type ErrorPages struct {
+	http        map[int][]byte // HTML by status code
+	notFound    []byte         // ops replacing the not-found reply; nil for default
+	unavailable []byte         // ops shown for routes of apps since dropped; nil for notFound
+}
+
+// loadErrorPages reads the custom error output, if any is configured; nil otherwise.
+func loadErrorPages(conf ErrorPagesConf) (*ErrorPages, error) {
+	if len(conf.HTTP) == 0 && len(conf.NotFound) == 0 && len(conf.AppUnavailable) == 0 {
+		return nil, nil
+	}
+	p := &ErrorPages{http: make(map[int][]byte)}
+	for code, file := range conf.HTTP {
+		if code < 400 || code > 599 {
+			return nil, fmt.Errorf("bad error page status %d: want 400 to 599", code)
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading %d error page: %v", code, err)
+		}
+		p.http[code] = b
+	}
+	var err error
+	if p.notFound, err = loadErrorCards(conf.NotFound); err != nil {
+		return nil, fmt.Errorf("bad not-found cards: %v", err)
+	}
+	if p.unavailable, err = loadErrorCards(conf.AppUnavailable); err != nil {
+		return nil, fmt.Errorf("bad app-unavailable cards: %v", err)
+	}
+	return p, nil
+}
+
+// loadErrorCards reads a JSON object of cards keyed by name, e.g. {"error": {"view": "markdown", ...}}, and returns
+// the ops replacing a page's contents with those cards; nil if file is empty.
+func loadErrorCards(file string) ([]byte, error) {
+	if len(file) == 0 {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cards map[string]map[string]interface{}
+	if err := json.Unmarshal(b, &cards); err != nil {
+		return nil, err
+	}
+	if len(cards) == 0 {
+		return nil, errors.New("no cards")
+	}
+	page := &PageD{C: make(map[string]CardD)}
+	for name, data := range cards {
+		if _, ok := data["view"]; !ok {
+			return nil, fmt.Errorf("card %s: missing view", name)
+		}
+		page.C[name] = CardD{D: data}
+	}
+	return json.Marshal(page.ops())
+}
+
+// wrap returns a handler that replaces h's plain-text error messages with the HTML error pages, for browsers.
+// Safe to call on nil, which leaves errors as is.
+func (p *ErrorPages) wrap(h http.Handler) http.Handler {
+	if p == nil || len(p.http) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), "text/html") { // API clients get errors as is
+			h.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(&errorPageWriter{ResponseWriter: w, pages: p.http}, r)
+	})
+}
+
+// errorPageWriter writes an error page in lieu of a plain-text error message.
+type errorPageWriter struct {
+	http.ResponseWriter
+	pages    map[int][]byte
+	replaced bool // error page written; discard the original message
+}
+
+func (w *errorPageWriter) WriteHeader(code int) {
+	if page, ok := w.pages[code]; ok && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") { // see http.Error
+		header := w.Header()
+		header.Set("Content-Type", contentTypeHTML)
+		header.Set("Content-Length", strconv.Itoa(len(page)))
+		w.ResponseWriter.WriteHeader(code)
+		w.ResponseWriter.Write(page)
+		w.replaced = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *errorPageWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *errorPageWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands over the connection, e.g. for websocket upgrades.
+func (w *errorPageWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("hijacking not supported")
+}
+
+// missingPage returns the reply to clients watching a route with no page or app.
+func (b *Broker) missingPage(route string) []byte {
+	if p := b.errorPages; p != nil {
+		if p.unavailable != nil && b.wasApp(route) {
+			return p.unavailable
+		}
+		if p.notFound != nil {
+			return p.notFound
+		}
+	}
+	return notFoundMsg
+}
+
+// appGone tells the clients watching a route that its app was dropped: shows them the app-unavailable cards,
+// if configured, else force-reloads them. Clients are reloaded again once the app registers.
+func (b *Broker) appGone(route string) {
+	if p := b.errorPages; p != nil && p.unavailable != nil {
+		b.publish <- Pub{route, p.unavailable, nil, nil}
+		return
+	}
+	b.resetSubscribers(route)
+}
+
+// wasApp returns true if the route was served by an app that has since been dropped.
+func (b *Broker) wasApp(route string) bool {
+	b.appsMux.RLock()
+	defer b.appsMux.RUnlock()
+	return b.dropped[route]
+}
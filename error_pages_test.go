@@ -0,0 +1,96 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestErrorPages(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		no(ioutil.WriteFile(file, []byte(content), 0o600))
+		return file
+	}
+	pages, err := loadErrorPages(ErrorPagesConf{
+		HTTP:           map[int]string{404: write("404.html", "<h1>Lost?</h1>")},
+		NotFound:       write("not_found.json", `{"error": {"view": "markdown", "box": "1 1 2 2", "content": "Nothing here."}}`),
+		AppUnavailable: write("unavailable.json", `{"error": {"view": "markdown", "box": "1 1 2 2", "content": "Back soon."}}`),
+	})
+	no(err)
+
+	h := pages.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}))
+	serve := func(accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/missing.png", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	w := serve("text/html,application/xhtml+xml")
+	eq(w.Code, http.StatusNotFound)
+	eq(w.Header().Get("Content-Type"), contentTypeHTML)
+	eq(w.Body.String(), "<h1>Lost?</h1>")
+	w = serve("application/json") // API clients get errors as is
+	eq(w.Code, http.StatusNotFound)
+	eq(w.Body.String(), "Not Found\n")
+
+	broker := newBroker(newSite(), false, true, true)
+	broker.errorPages = pages
+	var ops OpsD
+	no(json.Unmarshal(broker.missingPage("/foo"), &ops))
+	eq(len(ops.D), 2) // drop page, put card
+	eq(ops.D[1].D["content"], "Nothing here.")
+	broker.dropped["/foo"] = true
+	no(json.Unmarshal(broker.missingPage("/foo"), &ops))
+	eq(ops.D[1].D["content"], "Back soon.")
+
+	broker.errorPages = nil
+	eq(string(broker.missingPage("/foo")), string(notFoundMsg))
+
+	_, err = loadErrorPages(ErrorPagesConf{NotFound: write("bad.json", `{"error": {"content": "no view"}}`)})
+	ok(err != nil, "card without view")
+	_, err = loadErrorPages(ErrorPagesConf{HTTP: map[int]string{200: write("ok.html", "ok")}})
+	ok(err != nil, "not an error status")
+}
+
+func TestAppUnavailablePushed(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	file := filepath.Join(t.TempDir(), "unavailable.json")
+	no(ioutil.WriteFile(file, []byte(`{"error": {"view": "markdown", "box": "1 1 2 2", "content": "Back soon."}}`), 0o600))
+	pages, err := loadErrorPages(ErrorPagesConf{AppUnavailable: file})
+	no(err)
+
+	broker := newBroker(newSite(), false, true, true)
+	broker.errorPages = pages
+	no(broker.addApp("", &RegisterApp{Route: "/demo", Address: "http://127.0.0.1:8000"}))
+	eq(string((<-broker.publish).data), string(resetMsg)) // browsers reload, to start over with the app
+
+	broker.dropApp("/demo")
+	pub := <-broker.publish // current watchers see the cards, without waiting for a reload
+	eq(pub.route, "/demo")
+	eq(string(pub.data), string(pages.unavailable))
+}
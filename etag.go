@@ -0,0 +1,56 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+)
+
+// ETagFileServer represents a file server that tags files with entity tags, derived from their modification times
+// and sizes, to support If-None-Match and If-Range requests in addition to the Range, If-Modified-Since and
+// Last-Modified semantics of http.FileServer.
+type ETagFileServer struct {
+	root    http.FileSystem
+	handler http.Handler
+}
+
+func newETagFileServer(root http.FileSystem) http.Handler {
+	return &ETagFileServer{root, http.FileServer(root)}
+}
+
+func (s *ETagFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if tag, ok := fileETag(s.root, r.URL.Path); ok {
+			w.Header().Set("ETag", tag)
+		}
+	}
+	s.handler.ServeHTTP(w, r)
+}
+
+// fileETag returns a strong entity tag for a file, or false if not a file.
+func fileETag(root http.FileSystem, name string) (string, bool) {
+	f, err := root.Open(path.Clean("/" + name))
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return "", false
+	}
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()), true
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestETagFileServer(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	no(ioutil.WriteFile(filepath.Join(dir, "a.csv"), []byte("0123456789"), 0600))
+	s := newETagFileServer(http.Dir(dir))
+
+	get := func(headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/a.csv", nil)
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get()
+	eq(w.Code, http.StatusOK)
+	tag := w.Header().Get("ETag")
+	ok(len(tag) > 2 && tag[0] == '"', tag)
+	ok(len(w.Header().Get("Last-Modified")) > 0)
+	eq(w.Header().Get("Accept-Ranges"), "bytes")
+
+	eq(get("If-None-Match", tag).Code, http.StatusNotModified)
+	eq(get("If-None-Match", `"other"`).Code, http.StatusOK)
+	eq(get("If-Modified-Since", w.Header().Get("Last-Modified")).Code, http.StatusNotModified)
+
+	w = get("Range", "bytes=2-4")
+	eq(w.Code, http.StatusPartialContent)
+	eq(w.Body.String(), "234")
+	eq(w.Header().Get("Content-Range"), "bytes 2-4/10")
+
+	eq(get("Range", "bytes=2-4", "If-Range", tag).Code, http.StatusPartialContent)
+	w = get("Range", "bytes=2-4", "If-Range", `"stale"`) // file changed: send it all
+	eq(w.Code, http.StatusOK)
+	eq(w.Body.String(), "0123456789")
+}
@@ -0,0 +1,194 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const pageEvictInterval = 10 * time.Second
+
+var errPageUnavailable = errors.New("page unavailable: failed reading page back from page store")
+
+// PageLoader reads back a page saved to the page store; nil if not stored.
+type PageLoader func(url string) ([]byte, error)
+
+// EvictionStats represents cumulative memory budget statistics.
+type EvictionStats struct {
+	Evictions    uint64 // pages evicted
+	EvictedBytes uint64 // size of pages evicted, marshaled
+	Reloads      uint64 // evicted pages read back on demand
+	Failures     uint64 // pages that could not be saved, and so were kept, or could not be read back
+}
+
+// isEvicted returns true if the page at url was evicted to the page store, and not read back since.
+func (site *Site) isEvicted(url string) bool {
+	site.RLock()
+	defer site.RUnlock()
+	return site.evicted[url]
+}
+
+// evictedCount returns the number of pages evicted to the page store, and not read back since.
+func (site *Site) evictedCount() int {
+	site.RLock()
+	defer site.RUnlock()
+	return len(site.evicted)
+}
+
+// reload reads back a page evicted to the page store; nil if the page was not evicted, or is no longer stored.
+// Fails if the page could not be read back, e.g. if the store is unreachable, in which case the page stays evicted,
+// to be read back on the next attempt.
+func (site *Site) reload(url string) (*Page, error) {
+	if !site.isEvicted(url) {
+		return nil, nil
+	}
+	site.reloadMux.Lock()
+	defer site.reloadMux.Unlock()
+	if p, ok := site.pages.get(url); ok { // read back by a concurrent caller while we waited for the lock
+		return p, nil
+	}
+	if !site.isEvicted(url) {
+		return nil, nil
+	}
+
+	data, err := site.loader(url)
+	if err == nil && data != nil {
+		err = site.set(url, data)
+	}
+	if err != nil {
+		atomic.AddUint64(&site.evictStats.Failures, 1)
+		echoError(Log{"t": "page_reload", "route": url, "error": err.Error()})
+		return nil, errPageUnavailable
+	}
+	site.Lock()
+	delete(site.evicted, url)
+	site.Unlock()
+	if data == nil { // removed from the store since, e.g. by another replica
+		echoError(Log{"t": "page_reload", "route": url, "error": "page not found in page store"})
+		return nil, nil
+	}
+	atomic.AddUint64(&site.evictStats.Reloads, 1)
+	echoDebug(Log{"t": "page_reload", "route": url})
+	p, _ := site.pages.get(url)
+	return p, nil
+}
+
+// evict evicts the least-recently accessed pages not being watched while all pages exceed maxSize bytes, returning
+// their urls. Pages are saved first, if save is set, to be read back on demand; pages that cannot be saved are kept.
+func (site *Site) evict(maxSize int64, watched func(url string) bool, save func(url string, data []byte) error) []string {
+	pages := make(map[string]*Page)
+	site.pages.each(func(url string, page *Page) {
+		pages[url] = page
+	})
+
+	var (
+		total      int64
+		candidates []gcCandidate
+		evict      []string
+	)
+	for url, page := range pages {
+		size := page.bytes()
+		total += size
+		if !watched(url) {
+			candidates = append(candidates, gcCandidate{url, atomic.LoadInt64(&page.touched), size})
+		}
+	}
+	if total <= maxSize {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].touched < candidates[j].touched })
+	for _, c := range candidates {
+		if total <= maxSize {
+			break
+		}
+		retired, err := site.retire(c.url, pages[c.url], save)
+		if err != nil {
+			atomic.AddUint64(&site.evictStats.Failures, 1)
+			echoError(Log{"t": "page_evict", "route": c.url, "error": err.Error()})
+			continue
+		}
+		if !retired {
+			continue
+		}
+		evict = append(evict, c.url)
+		total -= c.size
+		atomic.AddUint64(&site.evictStats.Evictions, 1)
+		atomic.AddUint64(&site.evictStats.EvictedBytes, uint64(c.size))
+	}
+	return evict
+}
+
+// retire drops a page from memory, saving it first, if save is set, to be read back on demand. Returns false if the
+// page was replaced or removed since it was picked, or could not be saved, in which case it is kept.
+func (site *Site) retire(url string, page *Page, save func(url string, data []byte) error) (bool, error) {
+	page.Lock() // so that the page cannot change between saving and retiring it
+	if !site.pages.has(url, page) {
+		page.Unlock()
+		return false, nil
+	}
+	if save != nil {
+		data, err := json.Marshal(OpsD{P: page.dump()})
+		if err == nil {
+			err = save(url, data)
+		}
+		if err != nil {
+			page.Unlock()
+			return false, err
+		}
+	}
+	site.Lock()
+	site.pages.del(url)
+	if save != nil {
+		site.evicted[url] = true
+	} else {
+		delete(site.expiries, url)
+	}
+	site.Unlock()
+	page.Unlock()
+	site.dropHistory(url)
+	if save == nil { // else still searchable, being read back on demand
+		site.index.drop(url)
+	}
+	return true, nil
+}
+
+// evictPages periodically evicts pages to stay within maxSize bytes, saving them first to the page store, if any,
+// in which case they are read back on demand; else they are dropped.
+func (b *Broker) evictPages(maxSize int64, interval time.Duration) {
+	var save func(url string, data []byte) error
+	if b.storage != nil {
+		save = b.storage.store.save
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, url := range b.site.evict(maxSize, b.isWatched, save) {
+			if save != nil {
+				echoDebug(Log{"t": "page_evict", "route": url})
+				continue
+			}
+			echo(Log{"t": "page_evict", "route": url})
+			if !b.noLog {
+				logAOF(patchMarker, url, dropPageMsg)
+			}
+			b.hooks.firePage(pageDeleted, url, "evict")
+		}
+	}
+}
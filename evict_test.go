@@ -0,0 +1,95 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestEvict(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	site := newSite()
+	site.index = newSearchIndex()
+	store := &memPageStore{make(map[string][]byte)}
+	site.loader = store.read
+	for _, url := range []string{"/old", "/watched", "/new"} {
+		no(site.patch(url, benchmarkPatch))
+		site.at(url).marshal() // measure
+		time.Sleep(time.Millisecond)
+	}
+	size := int64(len(site.at("/new").marshal()))
+	watched := func(url string) bool { return url == "/watched" }
+
+	eq(len(site.evict(3*size, watched, store.save)), 0)
+	eq(site.evict(2*size, watched, store.save), []string{"/old"})
+	ok(site.isEvicted("/old"), "evicted")
+	_, inMemory := site.pages.get("/old")
+	ok(!inMemory, "not in memory")
+	ok(store.pages["/old"] != nil, "saved")
+	eq(len(site.index.search("title", func(string) bool { return true })), 3) // still searchable
+
+	page := site.at("/old") // read back on demand
+	ok(page != nil, "reloaded")
+	eq(page.cards["card"].data["title"], "Title")
+	ok(!site.isEvicted("/old"), "not evicted")
+	eq(site.evictStats.Reloads, uint64(1))
+
+	no(site.patch("/old", []byte(`{"d":[{"k":"card title","v":"Patched"}]}`)))
+	eq(site.evict(size, watched, store.save), []string{"/new", "/old"})
+	no(site.patch("/old", []byte(`{"d":[{"k":"card content","v":"Patched"}]}`))) // reloaded before patching
+	eq(site.at("/old").cards["card"].data["title"], "Patched")
+	eq(site.at("/old").cards["card"].data["content"], "Patched")
+
+	eq(site.evict(size, watched, nil), []string{"/old"}) // no store: dropped
+	ok(site.at("/old") == nil, "dropped")
+	eq(len(site.index.search("title", func(string) bool { return true })), 2)
+	ok(site.at("/watched") != nil, "watched pages are kept")
+	eq(site.evictStats.Evictions, uint64(4))
+}
+
+func TestReloadFailure(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	site := newSite()
+	store := &memPageStore{make(map[string][]byte)}
+	no(site.patch("/foo", benchmarkPatch))
+	eq(site.evict(0, func(string) bool { return false }, store.save), []string{"/foo"})
+
+	site.loader = func(string) ([]byte, error) { return nil, errors.New("store unreachable") }
+	ok(site.at("/foo") == nil, "not read back")
+	ok(site.isEvicted("/foo"), "still evicted")
+	eq(site.patch("/foo", []byte(`{"d":[{"k":"card title","v":"Patched"}]}`)), errPageUnavailable)
+	_, inMemory := site.pages.get("/foo")
+	ok(!inMemory, "no empty page minted")
+
+	site.loader = store.read
+	no(site.patch("/foo", []byte(`{"d":[{"k":"card title","v":"Patched"}]}`)))
+	eq(site.at("/foo").cards["card"].data["content"], "Content")
+	eq(site.at("/foo").cards["card"].data["title"], "Patched")
+}
+
+func TestPageBytes(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	site := newSite()
+	no(site.patch("/foo", benchmarkPatch))
+	page := site.at("/foo")
+	ok(page.bytes() >= int64(len(page.marshal())), "upper bound before marshaling")
+	eq(page.bytes(), int64(len(page.marshal())))
+	no(site.patch("/foo", []byte(`{"d":[{"k":"card title","v":"A longer title"}]}`)))
+	ok(page.bytes() >= int64(len(page.marshal())), "upper bound after patching")
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+)
+
+// fileAccessDir is the file store directory holding access records, one per upload directory.
+const fileAccessDir = "_access"
+
+// appUploaderPrefix prefixes the API access key ID of apps uploading files.
+const appUploaderPrefix = "app:"
+
+// FileAccess represents who may download a directory of uploaded files, in addition to apps, and who uploaded them.
+// Files without an access record may be downloaded by any signed-in user.
+type FileAccess struct {
+	Owner    string    `json:"owner,omitempty"`    // subject of the only user allowed to download; any signed-in user if empty
+	Public   bool      `json:"public,omitempty"`   // allow anyone to download, even if not signed in?
+	Uploader string    `json:"uploader,omitempty"` // subject of the uploading user, or "app:" + access key ID; empty if unknown
+	Tenant   string    `json:"tenant,omitempty"`   // tenant the files were uploaded by, if any; see Tenancy
+	Size     int64     `json:"size,omitempty"`     // bytes uploaded
+	Time     time.Time `json:"time,omitempty"`     // when uploaded
+}
+
+// allows returns true if the session's user may download the files; session is nil if the user is not signed in.
+func (a *FileAccess) allows(session *Session) bool {
+	if a != nil && a.Public {
+		return true
+	}
+	if session == nil {
+		return false
+	}
+	return a == nil || len(a.Owner) == 0 || a.Owner == session.subject
+}
+
+// inTenant returns true if the files belong to the tenant; files without an access record belong to no tenant.
+func (a *FileAccess) inTenant(tenant string) bool {
+	if a == nil {
+		return len(tenant) == 0
+	}
+	return a.Tenant == tenant
+}
+
+func fileAccessKey(dir string) string {
+	return path.Join(fileAccessDir, dir, "access.json")
+}
+
+// FileAccessList represents the access records of uploaded files, cached in memory.
+// Records are written once, before the upload's paths are handed out, and never changed, so are safe to cache.
+type FileAccessList struct {
+	sync.Mutex
+	store   FileStore
+	records map[string]*FileAccess // dir => access; nil if none
+}
+
+const maxCachedFileAccess = 4096
+
+func newFileAccessList(store FileStore) *FileAccessList {
+	return &FileAccessList{store: store, records: make(map[string]*FileAccess)}
+}
+
+// put records who may download, and who uploaded, the files in an upload directory.
+func (l *FileAccessList) put(dir string, a *FileAccess) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	key := fileAccessKey(dir)
+	if err := l.store.write(key, bytes.NewReader(b), int64(len(b)), "application/json"); err != nil {
+		return fmt.Errorf("failed recording file access for %s: %v", dir, err)
+	}
+	l.Lock()
+	delete(l.records, dir) // in case a download was attempted before the record was written
+	l.Unlock()
+	return nil
+}
+
+// get returns who may download the files in an upload directory, or nil if unrestricted.
+func (l *FileAccessList) get(dir string) (*FileAccess, error) {
+	l.Lock()
+	a, ok := l.records[dir]
+	l.Unlock()
+	if ok {
+		return a, nil
+	}
+
+	b, err := l.store.read(fileAccessKey(dir))
+	if err != nil && err != errFileNotFound {
+		return nil, err
+	}
+	if err == nil {
+		a = &FileAccess{}
+		if err := json.Unmarshal(b, a); err != nil {
+			return nil, fmt.Errorf("failed reading file access for %s: %v", dir, err)
+		}
+	}
+
+	l.Lock()
+	if len(l.records) >= maxCachedFileAccess {
+		l.records = make(map[string]*FileAccess)
+	}
+	l.records[dir] = a
+	l.Unlock()
+	return a, nil
+}
+
+// remove deletes the access record of an upload directory.
+func (l *FileAccessList) remove(dir string) error {
+	l.Lock()
+	delete(l.records, dir)
+	l.Unlock()
+	return l.store.remove(path.Join(fileAccessDir, dir))
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"golang.org/x/oauth2"
+)
+
+func newTestAuth(subjects ...string) *Auth {
+	auth := &Auth{conf: &AuthConf{}, oauth: &oauth2.Config{}, sessions: make(map[string]*Session)}
+	for _, s := range subjects {
+		auth.set(&Session{id: s, subject: s, token: &oauth2.Token{AccessToken: s}, lastSeen: time.Now()})
+	}
+	return auth
+}
+
+func asUser(r *http.Request, subject string) *http.Request {
+	if len(subject) > 0 {
+		r.AddCookie(&http.Cookie{Name: authCookieName, Value: subject})
+	}
+	return r
+}
+
+func TestFileAccess(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	dir := t.TempDir()
+	auth := newTestAuth("alice", "bob")
+
+	for _, private := range []bool{false, true} {
+		store := newDiskFileStore(dir)
+		fs := newFileServer(dir, store, newUploadIndex(store, UploadQuotas{}), nil, auth, nil, newCSRFGuard(nil), "/_f", UploadPolicy{}, private, newFileURLSigner(nil), nil)
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, asUser(newUploadRequest(t, map[string]string{"a.txt": "hello"}, ""), "alice"))
+		eq(w.Code, http.StatusOK)
+		var res UploadResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		download := func(subject string) int {
+			w := httptest.NewRecorder()
+			fs.ServeHTTP(w, asUser(httptest.NewRequest("GET", res.Files[0], nil), subject))
+			return w.Code
+		}
+		eq(download("alice"), http.StatusOK)
+		eq(download(""), http.StatusUnauthorized)
+		if private {
+			eq(download("bob"), http.StatusForbidden)
+		} else {
+			eq(download("bob"), http.StatusOK)
+		}
+
+		id := strings.Split(res.Files[0], "/")[2]
+		w = httptest.NewRecorder()
+		fs.ServeHTTP(w, httptest.NewRequest("GET", "/_f/"+path.Join(fileAccessDir, id, "access.json"), nil))
+		eq(w.Code, http.StatusNotFound)
+	}
+
+	store := newDiskFileStore(dir)
+	fs := newFileServer(dir, store, newUploadIndex(store, UploadQuotas{}), nil, auth, nil, newCSRFGuard(nil), "/_f", UploadPolicy{}, true, newFileURLSigner(nil), nil)
+	eq(newDiskFileStore(dir).write("public/a.txt", strings.NewReader("hello"), 5, "text/plain"), nil)
+	eq(fs.uploads.access.put("public", &FileAccess{Public: true}), nil)
+	w := httptest.NewRecorder()
+	fs.ServeHTTP(w, httptest.NewRequest("GET", "/_f/public/a.txt", nil))
+	eq(w.Code, http.StatusOK)
+
+	// Only the owner may resume a resumable upload.
+	w = serveTus(fs, asUser(tusRequest("POST", "/_f/", "", "Upload-Length", "4"), "alice"))
+	eq(w.Code, http.StatusCreated)
+	u := w.Header().Get("Location")
+	eq(serveTus(fs, asUser(tusRequest("HEAD", u, ""), "bob")).Code, http.StatusNotFound)
+	w = serveTus(fs, asUser(tusRequest("PATCH", u, "data", "Upload-Offset", "0", "Content-Type", "application/offset+octet-stream"), "alice"))
+	eq(w.Code, http.StatusNoContent)
+	p := w.Header().Get("Wave-File-Path")
+	w = httptest.NewRecorder()
+	fs.ServeHTTP(w, asUser(httptest.NewRequest("GET", p, nil), "bob"))
+	eq(w.Code, http.StatusForbidden)
+}
+
+func TestFileAccessRecordedBeforeStore(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	store := newDiskFileStore(t.TempDir())
+	access := newFileAccessList(store)
+
+	// A download attempted before the record is written must not leave the files unrestricted.
+	a, err := access.get("d")
+	eq(err, nil)
+	eq(a == nil, true)
+	eq(access.put("d", &FileAccess{Owner: "alice"}), nil)
+	a, err = access.get("d")
+	eq(err, nil)
+	eq(a.Owner, "alice")
+}
@@ -18,11 +18,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"mime"
 	"mime/multipart"
 	"net/http"
-	"os"
 	"path"
 	"path/filepath"
 	"strings"
@@ -36,17 +34,37 @@ type FileServer struct {
 	dir      string
 	keychain *keychain.Keychain
 	auth     *Auth
-	handler  http.Handler
+	tenancy  *Tenancy
+	csrf     *CSRFGuard
+	store    FileStore
+	uploads  *UploadIndex
+	private  bool // allow only the uploading user to download files uploaded from the browser?
+	signer   *FileURLSigner
 	baseURL  string
+	policy   UploadPolicy
+	tus      *TusUploads
+	progress *UploadProgress
+	images   *ImageVariants
 }
 
-func newFileServer(dir string, keychain *keychain.Keychain, auth *Auth, baseURL string) http.Handler {
+func newFileServer(dir string, store FileStore, uploads *UploadIndex, keychain *keychain.Keychain, auth *Auth, tenancy *Tenancy, csrf *CSRFGuard, baseURL string, policy UploadPolicy, private bool, signer *FileURLSigner, progress *UploadProgress) *FileServer {
+	images := newImageVariants(store, policy.ImageSizes) // shared, so that downscaling is bounded across upload kinds
+	tus := newTusUploads(dir, store, uploads, baseURL, policy, auth, progress, images)
 	return &FileServer{
 		dir,
 		keychain,
 		auth,
-		http.FileServer(http.Dir(dir)),
+		tenancy,
+		csrf,
+		store,
+		uploads,
+		private,
+		signer,
 		baseURL,
+		policy,
+		tus,
+		progress,
+		images,
 	}
 }
 
@@ -60,48 +78,82 @@ type UploadResponse struct {
 }
 
 func (fs *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		// Disallow if:
-		// - unauthorized api call
-		// - auth enabled and unauthorized
-		if !fs.keychain.Allow(r) && (fs.auth != nil && !fs.auth.allow(r)) { // API or UI
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	if p := strings.TrimPrefix(r.URL.Path, fs.baseURL); isTus(r, p) {
+		if r.Method == http.MethodOptions || fs.allowUpload(w, r) {
+			fs.tus.ServeHTTP(w, r, p, fs.uploadAccess(r))
+		}
+		return
+	}
+
+	if p := strings.TrimPrefix(r.URL.Path, fs.baseURL); p == fileSignPath {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 			return
 		}
+		if !fs.keychain.Guard(w, r) { // Allow APIs only
+			return
+		}
+		fs.signer.serveSign(w, r, fs.allowSign(r))
+		return
+	}
 
-		trimmedPrefix := strings.TrimPrefix(r.URL.Path, fs.baseURL)
-		fsDirPath := path.Join(fs.dir, trimmedPrefix)
-		// Ignore requests for directories and non-existent / unaccessible files.
-		if fileInfo, err := os.Stat(filepath.FromSlash(fsDirPath)); err != nil || fileInfo.IsDir() {
-			echo(Log{"t": "file_download", "path": r.URL.Path, "error": "not found"})
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		p := r.URL.Path
+		key := strings.TrimPrefix(path.Clean(strings.TrimPrefix(p, fs.baseURL)), "/")
+		if strings.HasPrefix(key, "_") { // internal, e.g. access records and incomplete uploads
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
+		if isSigned(r) {
+			if err := fs.signer.verify(r); err != nil {
+				echoError(Log{"t": "file_download", "path": p, "error": err.Error()})
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		} else if !fs.allowDownload(w, r, key) {
+			return
+		}
+		if size := r.URL.Query().Get("size"); len(size) > 0 {
+			variant, ok := fs.images.variant(key, size)
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			key = variant
+		}
 
-		echo(Log{"t": "file_download", "path": r.URL.Path})
-		r.URL.Path = trimmedPrefix // public
-		fs.handler.ServeHTTP(w, r)
+		if err := fs.store.serve(w, r, key); err != nil {
+			echoError(Log{"t": "file_download", "path": p, "error": err.Error()})
+			if err == errFileNotFound {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		echo(Log{"t": "file_download", "path": p})
 
 	case http.MethodPost:
-		// Disallow if:
-		// - unauthorized api call
-		// - auth enabled and unauthorized
-		if !fs.keychain.Allow(r) && (fs.auth != nil && !fs.auth.allow(r)) { // API or UI
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		if !fs.allowUpload(w, r) {
 			return
 		}
 
-		files, err := fs.acceptFiles(r)
+		r.Body = fs.progress.meter(r, fs.auth, "", 0, r.ContentLength)
+		files, err := fs.acceptFiles(r, fs.uploadAccess(r))
 		if err != nil {
-			echo(Log{"t": "file_upload", "error": err.Error()})
+			echoError(Log{"t": "file_upload", "error": err.Error()})
+			if uerr, ok := err.(*UploadError); ok {
+				writeUploadError(w, uerr)
+				return
+			}
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
 		res, err := json.Marshal(UploadResponse{Files: files})
 		if err != nil {
-			echo(Log{"t": "file_upload", "error": err.Error()})
+			echoError(Log{"t": "file_upload", "error": err.Error()})
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
@@ -115,21 +167,125 @@ func (fs *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := fs.deleteFile(r.URL.Path, fs.baseURL); err != nil {
-			echo(Log{"t": "file_unload", "path": r.URL.Path, "error": err.Error()})
+		if err := fs.deleteFile(r.URL.Path, fs.baseURL, fs.tenancy.ofKey(r)); err != nil {
+			echoError(Log{"t": "file_unload", "path": r.URL.Path, "error": err.Error()})
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
 		echo(Log{"t": "file_unload", "path": r.URL.Path})
 
 	default:
-		echo(Log{"t": "file_download", "method": r.Method, "path": r.URL.Path, "error": "method not allowed"})
+		echoError(Log{"t": "file_download", "method": r.Method, "path": r.URL.Path, "error": "method not allowed"})
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
 
-func (fs *FileServer) acceptFiles(r *http.Request) ([]string, error) {
+// allowDownload returns true if the request may download the file at key, else fails the request.
+// With tenancy, only the tenant that uploaded the files (or an unscoped API access key) may download them,
+// unless they are public.
+func (fs *FileServer) allowDownload(w http.ResponseWriter, r *http.Request, key string) bool {
+	keyed := fs.keychain.Allow(r)
+	if keyed && len(fs.tenancy.ofKey(r)) == 0 { // API, entire site
+		return true
+	}
+	dir := strings.SplitN(key, "/", 2)[0]
+	access, err := fs.uploads.access.get(dir)
+	if err != nil {
+		echoError(Log{"t": "file_download", "path": r.URL.Path, "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	if fs.tenancy != nil && !(access != nil && access.Public) {
+		if tenant, err := fs.tenancy.of(r, keyed, fs.auth); err != nil || !access.inTenant(tenant) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound) // don't reveal other tenants' files
+			return false
+		}
+	}
+	if keyed {
+		return true
+	}
+	if fs.auth == nil { // no users to tell apart
+		return true
+	}
+	session := fs.auth.identify(r)
+	if !access.allows(session) {
+		if session == nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return false
+		}
+		echoError(Log{"t": "file_download", "path": r.URL.Path, "subject": session.subject, "error": "forbidden"})
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// uploadAccess returns who may download the files being uploaded by the request, and who is uploading them.
+// Apps choose via the Wave-File-Owner and Wave-File-Public headers; files uploaded by users from the browser
+// may be downloaded by any signed-in user, unless uploads are private to the user. Files belong to the uploader's tenant, if any.
+func (fs *FileServer) uploadAccess(r *http.Request) *FileAccess {
+	keyed := fs.keychain.Allow(r)
+	tenant, _ := fs.tenancy.of(r, keyed, fs.auth) // checked by allowUpload
+	if keyed {                                    // API
+		id, _, _ := r.BasicAuth()
+		return &FileAccess{Owner: r.Header.Get("Wave-File-Owner"), Public: r.Header.Get("Wave-File-Public") == "True", Uploader: appUploaderPrefix + id, Tenant: tenant}
+	}
+	if fs.auth != nil {
+		if session := fs.auth.identify(r); session != nil {
+			if fs.private {
+				return &FileAccess{Owner: session.subject, Uploader: session.subject, Tenant: tenant}
+			}
+			return &FileAccess{Uploader: session.subject, Tenant: tenant}
+		}
+	}
+	return &FileAccess{Tenant: tenant}
+}
+
+// allowSign returns a check for whether the files at the paths an app asks to sign belong to its tenant, if any.
+func (fs *FileServer) allowSign(r *http.Request) func(p string) bool {
+	tenant := fs.tenancy.ofKey(r)
+	return func(p string) bool {
+		if len(tenant) == 0 {
+			return true
+		}
+		key := strings.TrimPrefix(path.Clean(strings.TrimPrefix(p, fs.baseURL)), "/")
+		access, err := fs.uploads.access.get(strings.SplitN(key, "/", 2)[0])
+		return err == nil && access.inTenant(tenant)
+	}
+}
+
+// allowUpload returns true if the request may upload files, else fails the request.
+func (fs *FileServer) allowUpload(w http.ResponseWriter, r *http.Request) bool {
+	// Disallow if:
+	// - unauthorized api call
+	// - auth enabled and unauthorized
+	if !fs.keychain.Allow(r) && (fs.auth != nil && !fs.auth.allow(r)) { // API or UI
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+
+	// Browser uploads must originate from the same site.
+	if !fs.keychain.Allow(r) && !fs.csrf.guard(w, r) {
+		return false
+	}
+
+	// With tenancy, users must belong to a tenant.
+	if _, err := fs.tenancy.of(r, fs.keychain.Allow(r), fs.auth); err != nil {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (fs *FileServer) acceptFiles(r *http.Request, access *FileAccess) ([]string, error) {
+	if fs.policy.MaxSize > 0 && r.ContentLength > fs.policy.MaxSize {
+		return nil, &UploadError{Code: uploadTooLarge, Limit: fs.policy.MaxSize}
+	}
+	exceeded := fs.policy.limit(r)
 	if err := r.ParseMultipartForm(32 << 20); err != nil { // 32 MB
+		if exceeded() {
+			return nil, &UploadError{Code: uploadTooLarge, Limit: fs.policy.MaxSize}
+		}
 		return nil, fmt.Errorf("failed parsing upload form from request: %v", err)
 	}
 
@@ -139,15 +295,32 @@ func (fs *FileServer) acceptFiles(r *http.Request) ([]string, error) {
 		return nil, errors.New("want 'files' field in upload form, got none")
 	}
 
+	if err := fs.policy.check(files); err != nil {
+		return nil, err
+	}
+
+	var size int64
+	for _, file := range files {
+		size += file.Size
+	}
+	if err := fs.uploads.allow(access, size); err != nil {
+		return nil, err
+	}
+
+	if err := fs.policy.scan(fs.store, files); err != nil {
+		return nil, err
+	}
+
 	isDirectoryUpload := r.Header.Get("Wave-Directory-Upload")
 	if isDirectoryUpload == "True" {
-		return fs.storeFilesInSingleDir(files)
+		return fs.storeFilesInSingleDir(files, access)
 	}
 
-	return fs.storeFilesInSeparateDirs(files)
+	return fs.storeFilesInSeparateDirs(files, access)
 }
 
-func (fs *FileServer) deleteFile(url, baseURL string) error {
+// deleteFile deletes the uploaded files at url, if they belong to the tenant, if any.
+func (fs *FileServer) deleteFile(url, baseURL, tenant string) error {
 	// Remove baseURL portion if specified.
 	cleanURL := strings.Replace(path.Clean(url), baseURL, "/_f", 1)
 	tokens := strings.Split(cleanURL, "/")
@@ -158,11 +331,20 @@ func (fs *FileServer) deleteFile(url, baseURL string) error {
 		return errInvalidUnloadPath
 	}
 
-	dirpath := filepath.Join(fs.dir, tokens[2])
-	return os.RemoveAll(dirpath)
+	if len(tenant) > 0 {
+		access, err := fs.uploads.access.get(tokens[2])
+		if err != nil {
+			return err
+		}
+		if !access.inTenant(tenant) {
+			return errInvalidUnloadPath
+		}
+	}
+
+	return fs.uploads.remove(tokens[2])
 }
 
-func (fs *FileServer) storeFilesInSingleDir(files []*multipart.FileHeader) ([]string, error) {
+func (fs *FileServer) storeFilesInSingleDir(files []*multipart.FileHeader, access *FileAccess) ([]string, error) {
 
 	id, err := uuid.NewRandom()
 	if err != nil {
@@ -170,15 +352,21 @@ func (fs *FileServer) storeFilesInSingleDir(files []*multipart.FileHeader) ([]st
 	}
 
 	dirID := id.String()
-	uploadDir := filepath.Join(fs.dir, dirID)
 
-	if err := os.MkdirAll(uploadDir, 0700); err != nil {
-		return nil, fmt.Errorf("failed creating upload dir %s: %v", uploadDir, err)
+	// Record who may download the files before storing them, so that they are never served unrestricted.
+	var size int64
+	for _, file := range files {
+		size += file.Size
+	}
+	if err := fs.uploads.put(dirID, access, size); err != nil {
+		return nil, err
 	}
 
-	for _, file := range files {
+	keys := make([]string, len(files))
+	for i, file := range files {
 		src, err := file.Open()
 		if err != nil {
+			fs.uploads.discard(dirID)
 			return nil, fmt.Errorf("failed opening uploaded file: %v", err)
 		}
 		defer src.Close()
@@ -191,29 +379,19 @@ func (fs *FileServer) storeFilesInSingleDir(files []*multipart.FileHeader) ([]st
 			filename = file.Filename
 		}
 
-		dir, file := filepath.Split(filename)
-		uploadPath := filepath.Join(uploadDir, dir)
-
-		if err := os.MkdirAll(uploadPath, 0700); err != nil {
-			return nil, fmt.Errorf("failed creating dir structure %s: %v", uploadDir, err)
-		}
-
-		uploadPath = filepath.Join(uploadPath, file)
-		dst, err := os.Create(uploadPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed writing uploaded file %s: %v", uploadPath, err)
-		}
-		defer dst.Close()
-
-		if _, err = io.Copy(dst, src); err != nil {
-			return nil, fmt.Errorf("failed copying uploaded file %s: %v", uploadPath, err)
+		key := path.Join(dirID, path.Clean("/"+filepath.ToSlash(filename)))
+		if err := fs.store.write(key, src, file.Size, contentTypeOf(key)); err != nil {
+			fs.uploads.discard(dirID)
+			return nil, err
 		}
+		keys[i] = key
 	}
+	fs.images.deriveAll(keys)
 
 	return []string{path.Join(fs.baseURL, dirID)}, nil
 }
 
-func (fs *FileServer) storeFilesInSeparateDirs(files []*multipart.FileHeader) ([]string, error) {
+func (fs *FileServer) storeFilesInSeparateDirs(files []*multipart.FileHeader, access *FileAccess) ([]string, error) {
 	uploadPaths := make([]string, len(files))
 	for i, file := range files {
 
@@ -229,24 +407,16 @@ func (fs *FileServer) storeFilesInSeparateDirs(files []*multipart.FileHeader) ([
 		defer src.Close()
 
 		fileID := id.String()
-		uploadDir := filepath.Join(fs.dir, fileID)
-
-		if err := os.MkdirAll(uploadDir, 0700); err != nil {
-			return nil, fmt.Errorf("failed creating upload dir %s: %v", uploadDir, err)
-		}
-
 		basename := filepath.Base(file.Filename)
-		uploadPath := filepath.Join(uploadDir, basename)
-
-		dst, err := os.Create(uploadPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed writing uploaded file %s: %v", uploadPath, err)
+		key := path.Join(fileID, basename)
+		if err := fs.uploads.put(fileID, access, file.Size); err != nil {
+			return nil, err
 		}
-		defer dst.Close()
-
-		if _, err = io.Copy(dst, src); err != nil {
-			return nil, fmt.Errorf("failed copying uploaded file %s: %v", uploadPath, err)
+		if err := fs.store.write(key, src, file.Size, contentTypeOf(key)); err != nil {
+			fs.uploads.discard(fileID)
+			return nil, err
 		}
+		fs.images.deriveAll([]string{key})
 
 		uploadPaths[i] = path.Join(fs.baseURL, fileID, basename)
 	}
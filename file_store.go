@@ -0,0 +1,281 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/h2oai/wave/pkg/blob"
+)
+
+var errFileNotFound = errors.New("file not found")
+
+// FileStore represents a destination for uploaded files, addressed by slash-separated keys of the form
+// "dir/name" or "dir/sub/name", where dir is unique to an upload.
+type FileStore interface {
+	// write stores a file.
+	write(key string, r io.Reader, size int64, contentType string) error
+	// move stores a file from a local path, removing the local copy.
+	move(key, src string) error
+	// read returns the contents of a small file, or errFileNotFound.
+	read(key string) ([]byte, error)
+	// exists returns true if a file exists, without reading it.
+	exists(key string) (bool, error)
+	// serve writes a file to an HTTP response, or returns an error if nothing was written.
+	serve(w http.ResponseWriter, r *http.Request, key string) error
+	// list returns the names of the files and directories in a directory; "" for the top-level directory.
+	list(dir string) ([]string, error)
+	// remove deletes a directory of files.
+	remove(dir string) error
+}
+
+// openFileStore opens an uploaded file store from a spec: empty for the local filesystem (dir), or an object
+// storage URL, one of "s3://bucket[/prefix]", "gs://bucket[/prefix]" or "azblob://account/container[/prefix]".
+func openFileStore(spec, dir string, redirect bool, expiry time.Duration) (FileStore, error) {
+	if len(spec) == 0 {
+		return newDiskFileStore(dir), nil
+	}
+	store, err := blob.Open(spec)
+	if err != nil {
+		return nil, err
+	}
+	return newBlobFileStore(store, redirect, expiry), nil
+}
+
+// DiskFileStore represents an uploaded file store on the local filesystem.
+type DiskFileStore struct {
+	dir     string
+	handler http.Handler
+}
+
+func newDiskFileStore(dir string) *DiskFileStore {
+	return &DiskFileStore{dir, newETagFileServer(http.Dir(dir))}
+}
+
+func (s *DiskFileStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s *DiskFileStore) write(key string, r io.Reader, size int64, contentType string) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return fmt.Errorf("failed creating upload dir %s: %v", filepath.Dir(p), err)
+	}
+	dst, err := os.Create(p)
+	if err != nil {
+		return fmt.Errorf("failed writing uploaded file %s: %v", p, err)
+	}
+	defer dst.Close()
+	if _, err = io.Copy(dst, r); err != nil {
+		return fmt.Errorf("failed copying uploaded file %s: %v", p, err)
+	}
+	return nil
+}
+
+func (s *DiskFileStore) move(key, src string) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return fmt.Errorf("failed creating upload dir %s: %v", filepath.Dir(p), err)
+	}
+	return os.Rename(src, p)
+}
+
+func (s *DiskFileStore) read(key string) ([]byte, error) {
+	b, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, errFileNotFound
+	}
+	return b, err
+}
+
+func (s *DiskFileStore) exists(key string) (bool, error) {
+	fileInfo, err := os.Stat(s.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return !fileInfo.IsDir(), nil
+}
+
+func (s *DiskFileStore) serve(w http.ResponseWriter, r *http.Request, key string) error {
+	// Ignore requests for directories and non-existent / unaccessible files.
+	if fileInfo, err := os.Stat(s.path(key)); err != nil || fileInfo.IsDir() {
+		return errFileNotFound
+	}
+	r.URL.Path = "/" + key
+	s.handler.ServeHTTP(w, r)
+	return nil
+}
+
+func (s *DiskFileStore) list(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(s.path(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	return names, nil
+}
+
+func (s *DiskFileStore) remove(dir string) error {
+	return os.RemoveAll(s.path(dir))
+}
+
+// contentTypeOf returns the content type of a stored file, as served by DiskFileStore: by extension.
+func contentTypeOf(key string) string {
+	if t := mime.TypeByExtension(path.Ext(key)); len(t) > 0 {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// Headers passed between clients and blob stores when streaming downloads.
+var (
+	blobRequestHeaders  = []string{"Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"}
+	blobResponseHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"}
+)
+
+// BlobFileStore represents an uploaded file store backed by object storage.
+// Downloads are either streamed through the server, or redirected to short-lived signed URLs.
+type BlobFileStore struct {
+	store    blob.Store
+	redirect bool          // redirect downloads to signed URLs?
+	expiry   time.Duration // signed URL lifetime
+}
+
+func newBlobFileStore(store blob.Store, redirect bool, expiry time.Duration) *BlobFileStore {
+	return &BlobFileStore{store, redirect, expiry}
+}
+
+func (s *BlobFileStore) write(key string, r io.Reader, size int64, contentType string) error {
+	if err := s.store.Put(context.Background(), key, r, size, contentType); err != nil {
+		return fmt.Errorf("failed storing uploaded file %s: %v", key, err)
+	}
+	return nil
+}
+
+func (s *BlobFileStore) move(key, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := s.write(key, f, info.Size(), contentTypeOf(key)); err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(src)
+}
+
+func (s *BlobFileStore) read(key string) ([]byte, error) {
+	res, err := s.store.Get(context.Background(), key, nil)
+	if err != nil {
+		if err == blob.ErrNotFound {
+			return nil, errFileNotFound
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+func (s *BlobFileStore) exists(key string) (bool, error) {
+	if err := s.store.Head(context.Background(), key); err != nil {
+		if err == blob.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *BlobFileStore) serve(w http.ResponseWriter, r *http.Request, key string) error {
+	if s.redirect {
+		u, err := s.store.SignedURL(key, s.expiry)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Cache-Control", "no-store") // signed URLs expire
+		http.Redirect(w, r, u, http.StatusFound)
+		return nil
+	}
+
+	header := make(http.Header)
+	for _, k := range blobRequestHeaders {
+		if v := r.Header.Get(k); len(v) > 0 {
+			header.Set(k, v)
+		}
+	}
+	res, err := s.store.Get(r.Context(), key, header)
+	if err != nil {
+		if err == blob.ErrNotFound {
+			return errFileNotFound
+		}
+		return err
+	}
+	defer res.Body.Close()
+	for _, k := range blobResponseHeaders {
+		if v := res.Header.Get(k); len(v) > 0 {
+			w.Header().Set(k, v)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	if r.Method != http.MethodHead {
+		io.Copy(w, res.Body)
+	}
+	return nil
+}
+
+func (s *BlobFileStore) list(dir string) ([]string, error) {
+	prefix := ""
+	if len(dir) > 0 {
+		prefix = dir + "/"
+	}
+	keys, err := s.store.List(context.Background(), prefix)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = strings.TrimSuffix(strings.TrimPrefix(k, prefix), "/")
+	}
+	return names, nil
+}
+
+func (s *BlobFileStore) remove(dir string) error {
+	return s.store.Delete(context.Background(), dir+"/")
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/blob"
+)
+
+// memBlobStore represents an in-memory blob store.
+type memBlobStore struct {
+	sync.Mutex
+	objects map[string]string
+	types   map[string]string
+	ranges  []string // Range headers received
+}
+
+func newMemBlobStore() *memBlobStore {
+	return &memBlobStore{objects: make(map[string]string), types: make(map[string]string)}
+}
+
+func (s *memBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.objects[key], s.types[key] = string(b), contentType
+	return nil
+}
+
+func (s *memBlobStore) Get(ctx context.Context, key string, header http.Header) (*http.Response, error) {
+	s.Lock()
+	defer s.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, blob.ErrNotFound
+	}
+	res := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: ioutil.NopCloser(strings.NewReader(data))}
+	res.Header.Set("Content-Type", s.types[key])
+	res.Header.Set("ETag", `"1"`)
+	if r := header.Get("Range"); len(r) > 0 {
+		s.ranges = append(s.ranges, r)
+		res.StatusCode = http.StatusPartialContent
+	}
+	return res, nil
+}
+
+func (s *memBlobStore) Head(ctx context.Context, key string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.objects[key]; !ok {
+		return blob.ErrNotFound
+	}
+	return nil
+}
+
+func (s *memBlobStore) Delete(ctx context.Context, prefix string) error {
+	s.Lock()
+	defer s.Unlock()
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) {
+			delete(s.objects, k)
+		}
+	}
+	return nil
+}
+
+func (s *memBlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	seen := make(map[string]bool)
+	var keys []string
+	for k := range s.objects {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if i := strings.Index(k[len(prefix):], "/"); i >= 0 {
+			k = k[:len(prefix)+i+1]
+		}
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *memBlobStore) SignedURL(key string, expiry time.Duration) (string, error) {
+	return "https://bucket.example.com/" + key + "?expires=" + expiry.String(), nil
+}
+
+func TestBlobFileStore(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	store := newMemBlobStore()
+	files := newBlobFileStore(store, false, 0)
+	fs := newFileServer(t.TempDir(), files, newUploadIndex(files, UploadQuotas{}), nil, nil, nil, newCSRFGuard(nil), "/_f", UploadPolicy{}, false, newFileURLSigner(nil), nil)
+
+	w := httptest.NewRecorder()
+	fs.ServeHTTP(w, newUploadRequest(t, map[string]string{"a.txt": "hello"}, ""))
+	eq(w.Code, http.StatusOK)
+	var res UploadResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	eq(len(store.objects), 2) // file and upload record
+
+	w = httptest.NewRecorder()
+	fs.ServeHTTP(w, httptest.NewRequest("GET", res.Files[0], nil))
+	eq(w.Code, http.StatusOK)
+	eq(w.Body.String(), "hello")
+	eq(w.Header().Get("Content-Type"), "text/plain; charset=utf-8")
+	eq(w.Header().Get("ETag"), `"1"`)
+
+	r := httptest.NewRequest("GET", res.Files[0], nil)
+	r.Header.Set("Range", "bytes=0-1")
+	w = httptest.NewRecorder()
+	fs.ServeHTTP(w, r)
+	eq(w.Code, http.StatusPartialContent)
+	eq(store.ranges, []string{"bytes=0-1"})
+
+	w = httptest.NewRecorder()
+	fs.ServeHTTP(w, httptest.NewRequest("GET", "/_f/missing/a.txt", nil))
+	eq(w.Code, http.StatusNotFound)
+
+	fs.store = newBlobFileStore(store, true, 15*time.Minute)
+	w = httptest.NewRecorder()
+	fs.ServeHTTP(w, httptest.NewRequest("GET", res.Files[0], nil))
+	eq(w.Code, http.StatusFound)
+	eq(w.Header().Get("Location"), "https://bucket.example.com"+strings.TrimPrefix(res.Files[0], "/_f")+"?expires=15m0s")
+
+	eq(fs.deleteFile(res.Files[0], "/_f", ""), nil)
+	eq(len(store.objects), 0)
+}
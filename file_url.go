@@ -0,0 +1,139 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	fileSignPath         = "/_sign"
+	defaultFileURLExpiry = time.Hour
+)
+
+var (
+	errFileURLExpired   = errors.New("signed URL expired")
+	errFileURLSignature = errors.New("invalid URL signature")
+)
+
+// FileURLSigner mints and verifies expiring, HMAC-signed URLs for uploaded files. Anyone holding a signed URL
+// can download the file until the URL expires, without signing in.
+type FileURLSigner struct {
+	key *SecretKey
+	now func() time.Time
+}
+
+// newFileURLSigner creates a signer; with a random key if key is empty, so that URLs signed by one server (or
+// replica) are valid only on the same server until it restarts.
+func newFileURLSigner(key []byte) *FileURLSigner {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(fmt.Errorf("failed generating file URL key: %v", err))
+		}
+	}
+	return &FileURLSigner{newSecretKey(key), time.Now}
+}
+
+func (s *FileURLSigner) signature(p string, expires int64) string {
+	mac := hmac.New(sha256.New, s.key.get())
+	mac.Write([]byte(p))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sign returns a URL for the file at path p that is valid until expires.
+func (s *FileURLSigner) sign(p string, expires time.Time) string {
+	e := expires.Unix()
+	q := url.Values{"expires": {strconv.FormatInt(e, 10)}, "signature": {s.signature(p, e)}}
+	u := url.URL{Path: p, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// isSigned returns true if the request's URL carries a signature.
+func isSigned(r *http.Request) bool {
+	return len(r.URL.Query().Get("signature")) > 0
+}
+
+// verify checks the signature of the request's URL.
+func (s *FileURLSigner) verify(r *http.Request) error {
+	q := r.URL.Query()
+	e, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return errFileURLSignature
+	}
+	if !hmac.Equal([]byte(q.Get("signature")), []byte(s.signature(r.URL.Path, e))) {
+		return errFileURLSignature
+	}
+	if s.now().Unix() > e {
+		return errFileURLExpired
+	}
+	return nil
+}
+
+// SignFilesRequest represents a request from an app to sign URLs for files.
+type SignFilesRequest struct {
+	Files  []string `json:"files"`            // file paths, as returned by uploads, e.g. /_f/<id>/report.pdf
+	Expiry int      `json:"expiry,omitempty"` // lifetime of the URLs, in seconds; one hour if zero
+}
+
+// SignFilesResponse represents the signed URLs for files, in order.
+type SignFilesResponse struct {
+	Files []string `json:"files"`
+}
+
+func (s *FileURLSigner) serveSign(w http.ResponseWriter, r *http.Request, allow func(p string) bool) {
+	var req SignFilesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Expiry < 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	for _, p := range req.Files {
+		if !allow(p) {
+			echoError(Log{"t": "file_sign", "path": p, "error": "forbidden"})
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+	expiry := defaultFileURLExpiry
+	if req.Expiry > 0 {
+		expiry = time.Duration(req.Expiry) * time.Second
+	}
+	expires := s.now().Add(expiry)
+	files := make([]string, len(req.Files))
+	for i, p := range req.Files {
+		files[i] = s.sign(p, expires)
+	}
+	b, err := json.Marshal(SignFilesResponse{files})
+	if err != nil {
+		echoError(Log{"t": "file_sign", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	echo(Log{"t": "file_sign", "files": strconv.Itoa(len(files)), "expiry": expiry.String()})
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Write(b)
+}
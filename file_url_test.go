@@ -0,0 +1,85 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+func TestFileURLSigner(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	now := time.Unix(1600000000, 0)
+	s := newFileURLSigner([]byte("secret"))
+	s.now = func() time.Time { return now }
+
+	u := s.sign("/_f/abc/a b.txt", now.Add(time.Hour))
+	eq(u, "/_f/abc/a%20b.txt?expires=1600003600&signature=1b6v4zTN1JDcuQsM9Iial7Sd7joyVeomTFuQ7OZ6oHk")
+	eq(s.verify(httptest.NewRequest("GET", u, nil)), nil)
+	eq(s.verify(httptest.NewRequest("GET", strings.Replace(u, "abc", "abd", 1), nil)), errFileURLSignature)
+	eq(s.verify(httptest.NewRequest("GET", strings.Replace(u, "1600003600", "1600007200", 1), nil)), errFileURLSignature)
+	eq(newFileURLSigner([]byte("other")).verify(httptest.NewRequest("GET", u, nil)), errFileURLSignature)
+
+	now = now.Add(2 * time.Hour)
+	eq(s.verify(httptest.NewRequest("GET", u, nil)), errFileURLExpired)
+}
+
+func TestSignedFileDownload(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	dir := t.TempDir()
+	kc, err := keychain.LoadKeychain(filepath.Join(dir, "keychain"))
+	no(err)
+	id, secret, hash, err := keychain.CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+	store := newDiskFileStore(dir)
+	no(store.write("abc/a.txt", strings.NewReader("hello"), 5, "text/plain"))
+	fs := newFileServer(dir, store, newUploadIndex(store, UploadQuotas{}), kc, newTestAuth("alice"), nil, newCSRFGuard(nil), "/_f", UploadPolicy{}, false, newFileURLSigner(nil), nil)
+
+	download := func(u string) int {
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+		return w.Code
+	}
+	eq(download("/_f/abc/a.txt"), http.StatusUnauthorized)
+
+	sign := func(authorize bool) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(SignFilesRequest{Files: []string{"/_f/abc/a.txt"}, Expiry: 60})
+		r := httptest.NewRequest("POST", "/_f/_sign", bytes.NewReader(body))
+		if authorize {
+			r.SetBasicAuth(id, secret)
+		}
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, r)
+		return w
+	}
+	eq(sign(false).Code, http.StatusUnauthorized)
+	w := sign(true)
+	eq(w.Code, http.StatusOK)
+	var res SignFilesResponse
+	no(json.Unmarshal(w.Body.Bytes(), &res))
+	eq(len(res.Files), 1)
+	eq(download(res.Files[0]), http.StatusOK)
+	eq(download(res.Files[0]+"x"), http.StatusForbidden)
+}
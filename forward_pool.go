@@ -0,0 +1,80 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// maxClientQueries is the number of queries a client can have waiting to be delivered to apps; further input from
+// the client waits until the client's earlier queries are delivered.
+const maxClientQueries = 64
+
+// ForwardPool bounds the number of queries delivered to an app at the same time, across all clients.
+// Each app has its own pool, so that an app that stops responding holds up only queries to itself.
+// Each client delivers its own queries, one at a time, in order, so that a slow app holds up only the queries
+// sent after the slow one by the same client; clients take turns at the pool's workers.
+type ForwardPool struct {
+	workers chan struct{} // one per worker delivering a query
+	waiting int64         // queries waiting for a worker; accessed atomically
+}
+
+// newForwardPool returns a pool of size workers; nil if size is 0, which places no bound on deliveries.
+func newForwardPool(size int) *ForwardPool {
+	if size <= 0 {
+		return nil
+	}
+	return &ForwardPool{workers: make(chan struct{}, size)}
+}
+
+// acquire waits for a worker to deliver a query, returning false if ctx is done first.
+// Safe to call on a nil pool, which has as many workers as needed.
+func (p *ForwardPool) acquire(ctx context.Context) bool {
+	if p == nil {
+		return true
+	}
+	atomic.AddInt64(&p.waiting, 1)
+	defer atomic.AddInt64(&p.waiting, -1)
+	select {
+	case p.workers <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release frees the worker acquired by acquire. Safe to call on a nil pool.
+func (p *ForwardPool) release() {
+	if p == nil {
+		return
+	}
+	<-p.workers
+}
+
+// ForwardStats represents the state of the pool.
+type ForwardStats struct {
+	Workers int   // workers in the pool; 0 if unbounded
+	Busy    int   // workers delivering queries
+	Waiting int64 // queries waiting for a worker
+}
+
+// stats returns the state of the pool. Safe to call on a nil pool.
+func (p *ForwardPool) stats() ForwardStats {
+	if p == nil {
+		return ForwardStats{}
+	}
+	return ForwardStats{cap(p.workers), len(p.workers), atomic.LoadInt64(&p.waiting)}
+}
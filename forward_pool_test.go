@@ -0,0 +1,77 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestForwardPool(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	var unbounded *ForwardPool
+	ok(unbounded.acquire(context.Background()), "unbounded")
+	unbounded.release()
+	ok(newForwardPool(0) == nil, "no limit")
+
+	p := newForwardPool(1)
+	ok(p.acquire(context.Background()), "acquired")
+	eq(p.stats(), ForwardStats{Workers: 1, Busy: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ok(!p.acquire(ctx), "all workers busy")
+	p.release()
+	ok(p.acquire(context.Background()), "acquired once released")
+	p.release()
+
+	broker := newBroker(newSite(), false, true, true)
+	broker.appWorkers = 1
+	hung := newApp(broker, []string{"/hung"}, &RegisterApp{Route: "/hung"}, &AppInstance{}, roundRobinBalancing)
+	other := newApp(broker, []string{"/other"}, &RegisterApp{Route: "/other"}, &AppInstance{}, roundRobinBalancing)
+	broker.apps["/hung"], broker.apps["/other"] = hung, other
+	ok(hung.forwards.acquire(context.Background()), "acquired")
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ok(other.forwards.acquire(ctx), "other apps unaffected")
+	eq(broker.forwardStats(), ForwardStats{Workers: 1, Busy: 2})
+
+	c := newClient("192.0.2.1", nil, anonymous, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	queued := atomic.LoadInt64(&metrics.pendingQueries)
+	for i := 0; i < maxClientQueries; i++ {
+		c.forward(nil, "/app", []byte(`{}`), nil)
+	}
+	eq(atomic.LoadInt64(&metrics.pendingQueries)-queued, int64(maxClientQueries))
+	done := make(chan struct{})
+	go func() {
+		c.forward(nil, "/app", []byte(`{}`), nil) // waits for room
+		close(done)
+	}()
+	select {
+	case <-done:
+		ok(false, "queue full, but query queued")
+	case <-time.After(10 * time.Millisecond):
+	}
+	eq(len(c.data), 0) // no notice
+
+	c.cancel()
+	<-done
+	c.abandon()
+	eq(len(c.queries), 0)
+	eq(atomic.LoadInt64(&metrics.pendingQueries), queued)
+}
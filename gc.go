@@ -0,0 +1,187 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pagePinHeader  = "Wave-Page-Pin"
+	pageGCInterval = 30 * time.Second
+)
+
+// GCPolicy determines when orphaned pages are evicted from the site.
+// A page is orphaned if no app is registered at its route, and no clients are watching it.
+type GCPolicy struct {
+	IdleTimeout time.Duration // evict orphaned pages not accessed for this long; 0 disables
+	MaxSize     int64         // evict least-recently accessed orphaned pages while the site is larger than this, in bytes; 0 disables
+}
+
+func (p GCPolicy) enabled() bool {
+	return p.IdleTimeout > 0 || p.MaxSize > 0
+}
+
+// GCStats represents cumulative page garbage collection statistics.
+type GCStats struct {
+	Runs          uint64 `json:"runs"`
+	IdleEvictions uint64 `json:"idle_evictions"`
+	SizeEvictions uint64 `json:"size_evictions"`
+	EvictedBytes  uint64 `json:"evicted_bytes"`
+	SiteSize      int64  `json:"site_size"` // as of the last run, if MaxSize is set
+}
+
+// pin exempts (or un-exempts) the page at url from garbage collection.
+func (site *Site) pin(url string, pinned bool) {
+	site.Lock()
+	defer site.Unlock()
+	if pinned {
+		site.pins[url] = true
+		return
+	}
+	delete(site.pins, url)
+}
+
+type gcCandidate struct {
+	url     string
+	touched int64
+	size    int64
+}
+
+// collect evicts orphaned pages as per policy, and returns their urls. Pages are saved first, if save is set, to be
+// read back on demand, so that pages shared with other replicas via the page store are dropped only from memory;
+// pages that cannot be saved are kept.
+func (site *Site) collect(policy GCPolicy, orphaned func(url string) bool, save func(url string, data []byte) error, now time.Time) []string {
+	pages := make(map[string]*Page)
+	site.pages.each(func(url string, page *Page) {
+		pages[url] = page
+	})
+	site.RLock()
+	pinned := make(map[string]bool, len(site.pins))
+	for url := range site.pins {
+		pinned[url] = true
+	}
+	site.RUnlock()
+
+	var (
+		total      int64
+		candidates []gcCandidate
+		evict      []string
+	)
+	if policy.MaxSize > 0 {
+		for _, page := range pages {
+			total += page.bytes()
+		}
+	}
+
+	idleSince := now.Add(-policy.IdleTimeout).UnixNano()
+	for url, page := range pages {
+		if pinned[url] || !orphaned(url) {
+			continue
+		}
+		touched := atomic.LoadInt64(&page.touched)
+		if policy.IdleTimeout > 0 && touched < idleSince {
+			c := gcCandidate{url, touched, page.bytes()}
+			if site.gcRetire(c, pages[url], save, &site.gcStats.IdleEvictions) {
+				evict = append(evict, url)
+				total -= c.size
+			}
+			continue
+		}
+		if policy.MaxSize > 0 {
+			candidates = append(candidates, gcCandidate{url, touched, page.bytes()})
+		}
+	}
+
+	if policy.MaxSize > 0 && total > policy.MaxSize {
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].touched < candidates[j].touched })
+		for _, c := range candidates {
+			if total <= policy.MaxSize {
+				break
+			}
+			if site.gcRetire(c, pages[c.url], save, &site.gcStats.SizeEvictions) {
+				evict = append(evict, c.url)
+				total -= c.size
+			}
+		}
+	}
+
+	atomic.AddUint64(&site.gcStats.Runs, 1)
+	if policy.MaxSize > 0 {
+		atomic.StoreInt64(&site.gcStats.SiteSize, total)
+	}
+	return evict
+}
+
+// gcRetire retires a page picked for garbage collection, counting it on success.
+func (site *Site) gcRetire(c gcCandidate, page *Page, save func(url string, data []byte) error, evictions *uint64) bool {
+	retired, err := site.retire(c.url, page, save)
+	if err != nil {
+		echoError(Log{"t": "page_evict", "route": c.url, "error": err.Error()})
+		return false
+	}
+	if retired {
+		atomic.AddUint64(evictions, 1)
+		atomic.AddUint64(&site.gcStats.EvictedBytes, uint64(c.size))
+	}
+	return retired
+}
+
+// stats returns a snapshot of garbage collection statistics.
+func (site *Site) stats() GCStats {
+	return GCStats{
+		Runs:          atomic.LoadUint64(&site.gcStats.Runs),
+		IdleEvictions: atomic.LoadUint64(&site.gcStats.IdleEvictions),
+		SizeEvictions: atomic.LoadUint64(&site.gcStats.SizeEvictions),
+		EvictedBytes:  atomic.LoadUint64(&site.gcStats.EvictedBytes),
+		SiteSize:      atomic.LoadInt64(&site.gcStats.SiteSize),
+	}
+}
+
+// collectPages periodically evicts orphaned pages as per policy. With a page store, pages are evicted from memory
+// only, and read back on demand, since other replicas may still be using them; else they are dropped.
+func (b *Broker) collectPages(policy GCPolicy, interval time.Duration) {
+	var save func(url string, data []byte) error
+	if b.storage != nil {
+		save = b.storage.store.save
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, url := range b.site.collect(policy, b.isOrphaned, save, now) {
+			if save != nil {
+				echoDebug(Log{"t": "page_evict", "route": url})
+				continue
+			}
+			echo(Log{"t": "page_evict", "route": url})
+			if !b.noLog {
+				logAOF(patchMarker, url, dropPageMsg)
+			}
+			b.hooks.firePage(pageDeleted, url, "gc")
+		}
+	}
+}
+
+// isOrphaned returns true if there are no apps or clients at a route.
+func (b *Broker) isOrphaned(route string) bool {
+	if b.getApp(route) != nil {
+		return false
+	}
+	b.clientsMux.RLock()
+	defer b.clientsMux.RUnlock()
+	return len(b.clients[route]) == 0
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestCollectPages(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	site := newSite()
+	now := time.Now()
+	for i, url := range []string{"/old", "/pinned", "/watched", "/older", "/new"} {
+		no(site.patch(url, benchmarkPatch))
+		atomic.StoreInt64(&site.at(url).touched, now.Add(-time.Duration(5-i)*time.Minute).UnixNano())
+	}
+	atomic.StoreInt64(&site.at("/older").touched, now.Add(-time.Hour).UnixNano())
+	site.pin("/pinned", true)
+	size := site.at("/new").bytes()
+	orphaned := func(url string) bool { return url != "/watched" }
+
+	eq(len(site.collect(GCPolicy{IdleTimeout: 2 * time.Hour}, orphaned, nil, now)), 0)
+	eq(site.collect(GCPolicy{IdleTimeout: 30 * time.Minute}, orphaned, nil, now), []string{"/older"})
+	ok(site.at("/older") == nil, "idle page dropped")
+
+	// least recently accessed orphans go first; pinned and watched pages are never evicted
+	eq(site.collect(GCPolicy{MaxSize: 3 * size}, orphaned, nil, now), []string{"/old"})
+	eq(site.collect(GCPolicy{MaxSize: size}, orphaned, nil, now), []string{"/new"})
+	ok(site.at("/pinned") != nil, "pinned page kept")
+	ok(site.at("/watched") != nil, "watched page kept")
+
+	site.pin("/pinned", false)
+	store := &memPageStore{make(map[string][]byte)}
+	site.loader = store.read
+	eq(site.collect(GCPolicy{MaxSize: size}, orphaned, store.save, now), []string{"/pinned"})
+	ok(site.isEvicted("/pinned"), "saved pages are evicted, not dropped")
+	ok(store.pages["/pinned"] != nil, "saved")
+	ok(site.at("/pinned") != nil, "read back on demand")
+
+	stats := site.stats()
+	eq(stats.Runs, uint64(5))
+	eq(stats.IdleEvictions, uint64(1))
+	eq(stats.SizeEvictions, uint64(3))
+	eq(stats.EvictedBytes, uint64(4*size))
+	eq(stats.SiteSize, size) // just /watched left
+}
+
+func TestPagePin(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	site := newSite()
+	s := &WebServer{site: site, broker: newBroker(site, false, false, true), maxRequestSize: 1024, baseURL: "/"}
+	patch := func(pin string) int {
+		r := httptest.NewRequest(http.MethodPatch, "/foo", strings.NewReader(`{"d":[{"k":"card","d":{"view":"markdown"}}]}`))
+		if len(pin) > 0 {
+			r.Header.Set(pagePinHeader, pin)
+		}
+		w := httptest.NewRecorder()
+		s.patch(w, r)
+		return w.Code
+	}
+	pinned := func() bool {
+		site.RLock()
+		defer site.RUnlock()
+		return site.pins["/foo"]
+	}
+
+	eq(patch("maybe"), http.StatusBadRequest)
+	ok(!pinned(), "not pinned")
+	eq(patch("true"), http.StatusOK)
+	ok(pinned(), "pinned")
+	eq(patch(""), http.StatusOK)
+	ok(pinned(), "still pinned")
+	eq(patch("false"), http.StatusOK)
+	ok(!pinned(), "unpinned")
+}
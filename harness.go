@@ -0,0 +1,184 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const harnessTransport = "harness"
+
+// Harness runs a broker in-process, with browser tabs and apps attached without sockets, for integration tests.
+// See pkg/wavetest for a friendlier interface.
+type Harness struct {
+	broker *Broker
+}
+
+// NewHarness creates a harness around a broker with an empty site.
+func NewHarness(editable bool) *Harness {
+	broker := newBroker(newSite(), editable, false, true)
+	go broker.run()
+	return &Harness{broker}
+}
+
+// HarnessClient represents a browser tab attached to a harness.
+type HarnessClient struct {
+	client *Client
+	stop   func()
+}
+
+// Connect attaches a browser tab for user; anonymous if user is empty.
+func (h *Harness) Connect(user string) *HarnessClient {
+	session := anonymous
+	if len(user) > 0 {
+		session = &Session{subject: user, username: user, token: &oauth2.Token{}, lastSeen: time.Now()}
+	}
+	c := newClient("harness", nil, session, "", h.broker, nil, h.broker.editable, false, false, browserProtocolVersion, "/")
+	return &HarnessClient{c, c.start()}
+}
+
+// ID returns the tab's client ID.
+func (c *HarnessClient) ID() string {
+	return c.client.id
+}
+
+// Send processes a message as if sent by the tab over its socket, e.g. "+ /foo " to watch /foo.
+func (c *HarnessClient) Send(msg []byte) {
+	c.client.handle(msg)
+}
+
+// Receive returns the next message sent to the tab, waiting up to timeout. Returns false on timeout,
+// or if the tab was disconnected.
+func (c *HarnessClient) Receive(timeout time.Duration) ([]byte, bool) {
+	select {
+	case msg, ok := <-c.client.data:
+		return msg, ok
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+// Close detaches the tab.
+func (c *HarnessClient) Close() {
+	c.stop()
+}
+
+// HarnessRequest represents a query delivered to a harness app.
+type HarnessRequest struct {
+	Route    string // route, as known to the app
+	ClientID string // empty if not made by a browser tab
+	Subject  string
+	Username string
+	Data     []byte // query body
+	client   *Client
+}
+
+// Relay sends ops to the tab that made the request, as if streamed by the app in reply.
+func (r *HarnessRequest) Relay(ops []byte) error {
+	if r.client == nil {
+		return errClientGone
+	}
+	return r.client.relay(ops)
+}
+
+// HarnessHandler processes a query delivered to a harness app. Returning an error fails the delivery,
+// as if the app were unreachable.
+type HarnessHandler func(r *HarnessRequest) error
+
+// HarnessAppTransport delivers queries to a handler.
+type HarnessAppTransport struct {
+	handle HarnessHandler
+}
+
+func (t *HarnessAppTransport) send(ctx context.Context, route, clientID string, session *Session, data []byte, client *Client) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- t.handle(&HarnessRequest{route, clientID, session.subject, session.username, data, client})
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *HarnessAppTransport) close() {}
+
+// RegisterApp registers an app at route, in mode ("unicast", "multicast" or "broadcast"), served by handle.
+// Registering again at the same route adds an instance, named by addr.
+func (h *Harness) RegisterApp(route, mode, addr string, handle HarnessHandler) error {
+	q := &RegisterApp{Mode: mode, Route: route, Address: addr, Transport: harnessTransport}
+	defer h.settle() // tabs already watching the route are reset
+	return h.broker.addAppInstance("", q, func(q *RegisterApp) (*AppInstance, error) {
+		now := time.Now().UTC()
+		return &AppInstance{
+			transport: &HarnessAppTransport{handle},
+			addr:      q.Address,
+			seen:      now.UnixNano(),
+			info:      AppInstanceInfo{q.Address, harnessTransport, "", q.protocolVersion(), now, 0, 0, 0, now, 0},
+		}, nil
+	})
+}
+
+// UnregisterApp unregisters the app at route.
+func (h *Harness) UnregisterApp(route string) {
+	h.broker.dropApp(route)
+	h.settle()
+}
+
+// Patch applies ops to the page at route, as if sent by an app, e.g. {"d":[{"k":"foo","d":{"view":"markdown"}}]},
+// and waits for the changes to be sent to tabs watching the page.
+func (h *Harness) Patch(route string, ops []byte) error {
+	h.settle()
+	if err := h.broker.patch(route, ops, "harness"); err != nil {
+		return err
+	}
+	h.settle()
+	return nil
+}
+
+// settle waits for the broker to process pending subscriptions and patches. The broker otherwise processes
+// subscriptions and patches in no particular order, e.g. a tab could miss a patch made right after it started
+// watching a page, or see a patch made right before.
+func (h *Harness) settle() {
+	barrier := newClient("harness", nil, anonymous, "", h.broker, nil, false, false, false, browserProtocolVersion, "/")
+	route := "/" + barrier.id
+	h.broker.subscribe <- Sub{route, barrier}
+	for !h.watching(route) {
+		time.Sleep(time.Millisecond)
+	}
+	h.broker.publish <- Pub{route, emptyJSON, nil, nil}
+	<-barrier.data
+	h.broker.unsubscribe <- barrier
+}
+
+func (h *Harness) watching(route string) bool {
+	h.broker.clientsMux.RLock()
+	defer h.broker.clientsMux.RUnlock()
+	_, ok := h.broker.clients[route]
+	return ok
+}
+
+// Page returns the page at route, marshaled as sent to browsers, or nil if there is no such page.
+func (h *Harness) Page(route string) []byte {
+	if page := h.broker.site.at(route); page != nil {
+		return page.marshal()
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+
+	healthCheckTimeout = 5 * time.Second
+	healthCacheTTL     = 3 * time.Second // how long readiness results are reused, so that probes cannot flood dependencies
+	healthCheckKey     = "_health/check" // file store key that never exists, read to check that the store is reachable
+)
+
+// HealthCheck checks whether a subsystem the server depends on is working.
+type HealthCheck struct {
+	Name  string
+	check func(ctx context.Context) error
+}
+
+// HealthStatus represents the outcome of health checks, as reported by the health endpoints.
+type HealthStatus struct {
+	Status string            `json:"status"`
+	Checks []SubsystemHealth `json:"checks,omitempty"`
+}
+
+// SubsystemHealth represents the outcome of a subsystem's health check.
+type SubsystemHealth struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"` // why the check failed; reported to API access keys only
+}
+
+// HealthServer serves liveness (healthz) and readiness (readyz) probes, e.g. for Kubernetes or load balancers.
+// The server is live if it responds at all, and ready if all the subsystems it depends on pass their checks.
+// Checks run at most once per healthCacheTTL; concurrent probes wait for, and share, the same run.
+type HealthServer struct {
+	keychain  *keychain.Keychain
+	checks    []HealthCheck
+	ready     bool // readiness probe?
+	mu        sync.Mutex
+	status    HealthStatus // as of the last run
+	checkedAt time.Time
+	now       func() time.Time
+}
+
+func newHealthServer(keychain *keychain.Keychain, checks []HealthCheck, ready bool) *HealthServer {
+	return &HealthServer{keychain: keychain, checks: checks, ready: ready, now: time.Now}
+}
+
+// check returns the outcome of the checks, running them if the last outcome is stale.
+func (s *HealthServer) check() HealthStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now := s.now(); s.checkedAt.IsZero() || now.Sub(s.checkedAt) >= healthCacheTTL {
+		s.status, s.checkedAt = runHealthChecks(context.Background(), s.checks), now // not the request's: shared by waiting probes
+	}
+	status := s.status
+	status.Checks = append([]SubsystemHealth(nil), s.status.Checks...)
+	return status
+}
+
+func (s *HealthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	status := HealthStatus{Status: healthOK}
+	if s.ready {
+		status = s.check()
+		if !s.keychain.Allow(r) { // failure reasons can reveal internal addresses
+			for i := range status.Checks {
+				status.Checks[i].Reason = ""
+			}
+		}
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		echoError(Log{"t": "json_marshal", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	if status.Status != healthOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
+
+// runHealthChecks runs health checks concurrently, each bounded by healthCheckTimeout.
+func runHealthChecks(ctx context.Context, checks []HealthCheck) HealthStatus {
+	status := HealthStatus{Status: healthOK, Checks: make([]SubsystemHealth, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c HealthCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+			h := SubsystemHealth{Name: c.Name, Status: healthOK}
+			if err := c.check(ctx); err != nil {
+				h.Status, h.Reason = healthFail, err.Error()
+			}
+			status.Checks[i] = h
+		}(i, c)
+	}
+	wg.Wait()
+	for _, h := range status.Checks {
+		if h.Status != healthOK {
+			status.Status = healthFail
+			echoError(Log{"t": "health", "check": h.Name, "error": h.Reason})
+		}
+	}
+	return status
+}
+
+// ping checks that the broker's run loop is responsive.
+func (b *Broker) ping(ctx context.Context) error {
+	pong := make(chan struct{})
+	select {
+	case b.pings <- pong:
+	case <-ctx.Done():
+		return errors.New("broker not responding")
+	}
+	<-pong
+	return nil
+}
+
+// checkFileStore checks that a file store is reachable, by reading a file that does not exist.
+func checkFileStore(store FileStore) func(context.Context) error {
+	return func(ctx context.Context) error {
+		errs := make(chan error, 1)
+		go func() {
+			_, err := store.read(healthCheckKey)
+			errs <- err
+		}()
+		select {
+		case err := <-errs:
+			if err == errFileNotFound {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// checkPageStore checks that an external page store is reachable.
+func checkPageStore(store PageStore) func(context.Context) error {
+	return func(ctx context.Context) error {
+		errs := make(chan error, 1)
+		go func() { errs <- store.ping() }()
+		select {
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// checkAuthProvider checks that the OpenID Connect provider is reachable, by fetching its discovery document.
+func checkAuthProvider(providerURL string) func(context.Context) error {
+	u := strings.TrimSuffix(providerURL, "/") + "/.well-known/openid-configuration"
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("provider discovery failed: %s", resp.Status)
+		}
+		return nil
+	}
+}
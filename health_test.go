@@ -0,0 +1,82 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+func TestHealthServer(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	id, secret, hash, err := keychain.CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+
+	broker := newBroker(newSite(), false, true, true)
+	go broker.run()
+	var storeErr error
+	checks := []HealthCheck{
+		{"broker", broker.ping},
+		{"page_store", func(context.Context) error { return storeErr }},
+	}
+
+	probe := func(s *HealthServer, key bool) (int, HealthStatus) {
+		r := httptest.NewRequest("GET", "/readyz", nil)
+		if key {
+			r.SetBasicAuth(id, secret)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		var status HealthStatus
+		no(json.Unmarshal(w.Body.Bytes(), &status))
+		return w.Code, status
+	}
+
+	code, status := probe(newHealthServer(kc, nil, false), false)
+	eq(code, 200)
+	eq(status.Status, healthOK)
+
+	ready := newHealthServer(kc, checks, true)
+	now := time.Now()
+	ready.now = func() time.Time { return now }
+	code, status = probe(ready, false)
+	eq(code, 200)
+	eq(len(status.Checks), 2)
+
+	storeErr = errors.New("dial tcp 10.0.0.5:6379: connection refused")
+	code, _ = probe(ready, false)
+	eq(code, 200) // cached
+
+	now = now.Add(healthCacheTTL)
+	code, status = probe(ready, false)
+	eq(code, 503)
+	eq(status.Status, healthFail)
+	eq(status.Checks[0].Status, healthOK)
+	eq(status.Checks[1], SubsystemHealth{"page_store", healthFail, ""})
+
+	_, status = probe(ready, true)
+	eq(status.Checks[1].Reason, storeErr.Error()) // not redacted in the cached status
+}
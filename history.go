@@ -0,0 +1,178 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var errRevisionNotFound = errors.New("revision not found")
+
+// Revision represents a single revision of a page, i.e. an applied patch.
+type Revision struct {
+	ID   int       `json:"id"`
+	Time time.Time `json:"time"`
+	Size int       `json:"size"` // size of patch, in bytes
+	data []byte    // patch
+}
+
+// History represents a bounded history of revisions of a page.
+// The history is stored as a base page plus the patches applied on top of it;
+// once the history is full, the oldest patch is folded into the base.
+type History struct {
+	sync.Mutex
+	ns        *Namespace
+	base      *Page // page contents prior to the oldest revision
+	revisions []Revision
+	size      int // max revisions
+	next      int // next revision ID
+}
+
+func newHistory(ns *Namespace, base *Page, size int) *History {
+	return &History{ns: ns, base: base, size: size, next: 1}
+}
+
+// add records a revision; must be called under lock.
+func (h *History) add(data []byte) {
+	if len(h.revisions) >= h.size {
+		if err := h.base.patch(h.ns, h.revisions[0].data); err != nil {
+			echoError(Log{"t": "page_history", "error": err.Error()})
+		}
+		h.revisions = h.revisions[1:]
+	}
+	h.revisions = append(h.revisions, Revision{ID: h.next, Time: time.Now().UTC(), Size: len(data), data: data})
+	h.next++
+}
+
+// list returns all available revisions, oldest first.
+func (h *History) list() []Revision {
+	h.Lock()
+	defer h.Unlock()
+	revisions := make([]Revision, len(h.revisions))
+	copy(revisions, h.revisions)
+	return revisions
+}
+
+// at returns the page contents as of (i.e. immediately after) the given revision.
+func (h *History) at(id int) (*PageD, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	n := -1
+	for i, r := range h.revisions {
+		if r.ID == id {
+			n = i
+			break
+		}
+	}
+	if n < 0 {
+		return nil, errRevisionNotFound
+	}
+
+	d, err := h.base.copy()
+	if err != nil {
+		return nil, err
+	}
+	page := loadPage(h.ns, d)
+	for _, r := range h.revisions[:n+1] {
+		if err := page.patch(h.ns, r.data); err != nil {
+			return nil, err
+		}
+	}
+	return page.dump(), nil
+}
+
+// copy returns a deep copy of the page's contents.
+func (p *Page) copy() (*PageD, error) {
+	p.RLock()
+	b, err := json.Marshal(p.dump())
+	p.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed marshaling page: %v", err)
+	}
+	var d PageD
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, fmt.Errorf("failed unmarshaling page: %v", err)
+	}
+	return &d, nil
+}
+
+// patch applies changes to a standalone page, i.e. a page not managed by a site.
+func (p *Page) patch(ns *Namespace, data []byte) error {
+	var ops OpsD
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return fmt.Errorf("failed unmarshaling data: %v", err)
+	}
+	for _, op := range ops.D {
+		if len(op.K) > 0 {
+			p.apply(ns, op)
+		} else { // drop page
+			p.cards = make(map[string]*Card)
+		}
+	}
+	return nil
+}
+
+// history returns the history for url, creating one if necessary.
+func (site *Site) history(url string) *History {
+	site.historyMux.Lock()
+	defer site.historyMux.Unlock()
+	if h, ok := site.histories[url]; ok {
+		return h
+	}
+	base := newPage()
+	if p := site.at(url); p != nil {
+		if d, err := p.copy(); err == nil {
+			base = loadPage(site.ns, d)
+		} else {
+			echoError(Log{"t": "page_history", "url": url, "error": err.Error()})
+		}
+	}
+	h := newHistory(site.ns, base, site.historySize)
+	site.histories[url] = h
+	return h
+}
+
+// revisions returns the revisions tracked for url, if any.
+func (site *Site) revisions(url string) ([]Revision, bool) {
+	site.historyMux.Lock()
+	h, ok := site.histories[url]
+	site.historyMux.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return h.list(), true
+}
+
+// revision returns the contents of the page at url as of the given revision.
+func (site *Site) revision(url string, id int) (*PageD, error) {
+	site.historyMux.Lock()
+	h, ok := site.histories[url]
+	site.historyMux.Unlock()
+	if !ok {
+		return nil, errRevisionNotFound
+	}
+	return h.at(id)
+}
+
+func (site *Site) dropHistory(url string) {
+	site.historyMux.Lock()
+	delete(site.histories, url)
+	site.historyMux.Unlock()
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestPageHistory(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	admin, request := newTestAdmin(t)
+	site := admin.broker.site
+	site.historySize = 2
+	content := func(d *PageD) interface{} { return d.C["x"].D["content"] }
+	set := func(v string) {
+		no(admin.broker.patch("/foo", []byte(`{"d":[{"k":"x","d":{"view":"markdown","content":"`+v+`"}}]}`), ""))
+	}
+	set("a")
+	set("b")
+	set("c")
+
+	w := request("GET", "/_a/history/foo", "")
+	eq(w.Code, http.StatusOK)
+	var revisions []Revision
+	no(json.Unmarshal(w.Body.Bytes(), &revisions))
+	eq(len(revisions), 2) // oldest folded into the base
+	eq(revisions[0].ID, 2)
+	eq(revisions[1].ID, 3)
+	eq(request("GET", "/_a/history/bar", "").Code, http.StatusNotFound)
+
+	d, err := site.revision("/foo", 2)
+	no(err)
+	eq(content(d), "b")
+	_, err = site.revision("/foo", 1)
+	eq(err, errRevisionNotFound)
+
+	eq(request("POST", "/_a/history/foo?rollback=2", "").Code, http.StatusOK)
+	d, err = site.at("/foo").copy()
+	no(err)
+	eq(content(d), "b")
+	revisions, _ = site.revisions("/foo")
+	eq(revisions[len(revisions)-1].ID, 4) // a rollback is a revision, too, so can be undone
+	eq(request("POST", "/_a/history/foo?rollback=3", "").Code, http.StatusOK)
+	d, err = site.at("/foo").copy()
+	no(err)
+	eq(content(d), "c")
+
+	eq(request("POST", "/_a/history/foo?rollback=1", "").Code, http.StatusNotFound)
+	eq(request("POST", "/_a/history/foo?rollback=latest", "").Code, http.StatusBadRequest)
+
+	site.del("/foo")
+	_, ok := site.revisions("/foo")
+	eq(ok, false) // deleted with the page
+}
+
+func TestPageHistoryDisabled(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	admin, request := newTestAdmin(t)
+	no(admin.broker.patch("/foo", []byte(`{"d":[{"k":"x","d":{"view":"markdown"}}]}`), ""))
+	eq(request("GET", "/_a/history/foo", "").Code, http.StatusNotFound)
+}
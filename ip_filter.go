@@ -0,0 +1,126 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// IPFilterConf represents rules restricting access to a group of endpoints by client address,
+// each rule an IP address or a CIDR range, e.g. "10.0.0.0/8".
+type IPFilterConf struct {
+	Allow Strings // if not empty, only these addresses are allowed
+	Deny  Strings // these addresses are refused, even if allowed
+}
+
+// IPFilter allows or refuses requests by client address (as reported by trusted proxies).
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newIPFilter returns a filter enforcing the rules; nil if there are none.
+func newIPFilter(kind string, conf IPFilterConf) (*IPFilter, error) {
+	if len(conf.Allow) == 0 && len(conf.Deny) == 0 {
+		return nil, nil
+	}
+	allow, err := parseNetworks(kind+" allow rule", conf.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseNetworks(kind+" deny rule", conf.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &IPFilter{allow, deny}, nil
+}
+
+// allows returns true if requests from the address are allowed. Safe to call on a nil filter, which allows all.
+func (f *IPFilter) allows(addr string) bool {
+	if f == nil {
+		return true
+	}
+	if containsIP(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, addr)
+}
+
+// guardIP returns a handler that refuses requests from client addresses not allowed by a filter picked per request,
+// before h gets to authenticate them.
+func guardIP(pick func(r *http.Request) []*IPFilter, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := getRemoteAddr(r)
+		for _, f := range pick(r) {
+			if f.allows(addr) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		echoDebug(Log{"t": "ip_denied", "addr": addr, "path": r.URL.Path})
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	})
+}
+
+// wrap returns a handler that refuses requests from client addresses the filter does not allow.
+// Safe to call on a nil filter, which allows all requests.
+func (f *IPFilter) wrap(h http.Handler) http.Handler {
+	if f == nil {
+		return h
+	}
+	filters := []*IPFilter{f}
+	return guardIP(func(*http.Request) []*IPFilter { return filters }, h)
+}
+
+// wrapEither returns a handler that serves requests from client addresses allowed by either filter, for endpoints
+// shared by browsers and apps. Safe to call with nil filters; if only one filter is set, it alone is enforced.
+func wrapEither(a, b *IPFilter, h http.Handler) http.Handler {
+	if a == nil {
+		return b.wrap(h)
+	}
+	if b == nil {
+		return a.wrap(h)
+	}
+	filters := []*IPFilter{a, b}
+	return guardIP(func(*http.Request) []*IPFilter { return filters }, h)
+}
+
+// wrapWeb returns a handler that filters requests for the UI with ui, and requests for page data and app APIs with api.
+func wrapWeb(ui, api *IPFilter, h http.Handler) http.Handler {
+	if ui == nil && api == nil {
+		return h
+	}
+	uiFilters, apiFilters := []*IPFilter{ui}, []*IPFilter{api}
+	return guardIP(func(r *http.Request) []*IPFilter {
+		if isDataRequest(r) {
+			return apiFilters
+		}
+		return uiFilters
+	}, h)
+}
+
+// isDataRequest returns true if a request to the web server is for page data or app APIs, rather than the UI,
+// including pages read as JSON (<route>.json) or as events (<route>/events); see WebServer.ServeHTTP.
+func isDataRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return r.Header.Get("Content-Type") == contentTypeJSON ||
+			strings.HasSuffix(r.URL.Path, pageJSONExt) ||
+			(strings.HasSuffix(r.URL.Path, pageEventsSuffix) && acceptsEvents(r))
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestIPFilter(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+
+	f, err := newIPFilter("UI", IPFilterConf{})
+	no(err)
+	ok(f == nil, "no rules")
+	ok(f.allows("1.2.3.4"), "nil filter allows all")
+
+	_, err = newIPFilter("UI", IPFilterConf{Allow: Strings{"10.0.0.0/33"}})
+	ok(err != nil, "bad rule")
+
+	f, err = newIPFilter("UI", IPFilterConf{Allow: Strings{"10.0.0.0/8"}, Deny: Strings{"10.1.0.0/16"}})
+	no(err)
+	ok(f.allows("10.2.3.4"), "allowed")
+	ok(!f.allows("10.1.2.3"), "denied, even if allowed")
+	ok(!f.allows("192.168.1.1"), "not allowed")
+
+	deny, err := newIPFilter("API", IPFilterConf{Deny: Strings{"192.168.1.1"}})
+	no(err)
+	ok(deny.allows("10.2.3.4"), "allowed unless denied")
+	ok(!deny.allows("192.168.1.1"), "denied")
+
+	serve := func(h http.Handler, r *http.Request) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	requestPath := func(method, path, addr string, data bool) *http.Request {
+		r := httptest.NewRequest(method, path, nil)
+		r.RemoteAddr = addr + ":1234"
+		if data {
+			r.Header.Set("Content-Type", contentTypeJSON)
+		}
+		return r
+	}
+	request := func(method, addr string, data bool) *http.Request {
+		return requestPath(method, "/foo", addr, data)
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	eq(serve(f.wrap(h), request("GET", "10.2.3.4", false)), http.StatusOK)
+	eq(serve(f.wrap(h), request("GET", "192.168.1.1", false)), http.StatusForbidden)
+
+	either := wrapEither(f, deny, h)
+	eq(serve(either, request("GET", "10.1.2.3", false)), http.StatusOK) // refused by f, but not by deny
+	eq(serve(either, request("GET", "192.168.1.1", false)), http.StatusForbidden)
+
+	either = wrapEither(f, nil, h) // only one filter set
+	eq(serve(either, request("GET", "10.2.3.4", false)), http.StatusOK)
+	eq(serve(either, request("GET", "192.168.1.1", false)), http.StatusForbidden)
+	either = wrapEither(nil, deny, h)
+	eq(serve(either, request("GET", "192.168.1.1", false)), http.StatusForbidden)
+
+	web := wrapWeb(f, deny, h)
+	eq(serve(web, request("GET", "192.168.2.2", false)), http.StatusForbidden) // UI
+	eq(serve(web, request("GET", "192.168.2.2", true)), http.StatusOK)         // page data
+	eq(serve(web, request("PATCH", "192.168.2.2", false)), http.StatusOK)      // page data
+	eq(serve(web, request("POST", "192.168.1.1", false)), http.StatusForbidden)
+	eq(serve(web, requestPath("GET", "/foo.json", "192.168.2.2", false)), http.StatusOK) // page as JSON
+	events := requestPath("GET", "/foo/events", "192.168.2.2", false)
+	events.Header.Set("Accept", contentTypeEventStream)
+	eq(serve(web, events), http.StatusOK) // page as events
+	eq(serve(web, requestPath("GET", "/foo/events", "192.168.2.2", false)), http.StatusForbidden)
+}
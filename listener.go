@@ -0,0 +1,229 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Listener roles, i.e. groups of routes a listener can serve.
+const (
+	uiRole    = "ui"    // UI, websockets, login, IDE, public and private dirs
+	apiRole   = "api"   // page API, app registration, files, downloads, cache, multipart, proxy and search
+	adminRole = "admin" // admin API, metrics and debug endpoints
+)
+
+var listenerRoles = []string{uiRole, apiRole, adminRole}
+
+// ListenerConf represents the configuration for an additional address the server listens on.
+type ListenerConf struct {
+	Address      string   // address to listen on, e.g. "127.0.0.1:10102"
+	Roles        []string // roles served; routes for these roles are no longer served by the main listener
+	CertFile     string   // TLS certificate; plain HTTP if empty
+	KeyFile      string   // TLS key
+	ClientCAFile string   // if set, require client certificates signed by the CAs in this file (mutual TLS)
+	AccessKeys   []string // if set, accept only requests authenticated with these access key IDs
+}
+
+// Listener represents an address the server listens on, and the routes it serves.
+type Listener struct {
+	address string
+	roles   []string
+	tls     *tls.Config     // nil for plain HTTP
+	keys    map[string]bool // access key IDs accepted; any if empty
+	mux     *http.ServeMux
+	ln      net.Listener // bound socket
+}
+
+func newListener(address string, roles []string, tlsConfig *tls.Config, keys []string) *Listener {
+	accepted := make(map[string]bool)
+	for _, id := range keys {
+		accepted[id] = true
+	}
+	return &Listener{address, roles, tlsConfig, accepted, http.NewServeMux(), nil}
+}
+
+// listen binds the listener's address, or claims its socket if passed by systemd. If fallback is set,
+// the listener claims any unclaimed socket passed by systemd in lieu of binding its address.
+func (l *Listener) listen(sockets *ActivatedSockets, fallback bool) error {
+	if isSystemdAddress(l.address) {
+		name := strings.TrimPrefix(l.address, systemdAddress)
+		if l.ln = sockets.take(name); l.ln == nil {
+			return fmt.Errorf("listener %s: no socket named %q passed by systemd", l.address, name)
+		}
+		return nil
+	}
+	if fallback {
+		if l.ln = sockets.take(""); l.ln != nil {
+			l.address = l.ln.Addr().String()
+			return nil
+		}
+	}
+	ln, err := net.Listen("tcp", l.address)
+	if err != nil {
+		return fmt.Errorf("listener %s: %v", l.address, err)
+	}
+	l.ln = ln
+	return nil
+}
+
+// serves returns true if the listener serves any of the roles.
+func (l *Listener) serves(roles []string) bool {
+	for _, r := range roles {
+		for _, lr := range l.roles {
+			if r == lr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restrict wraps handler to reject requests not authenticated with one of the listener's access keys.
+// The handler still verifies the key's secret.
+func (l *Listener) restrict(handler http.Handler) http.Handler {
+	if len(l.keys) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, _, ok := r.BasicAuth(); !ok || !l.keys[id] {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// serve accepts connections, handling requests to the listener's routes with handler, until listening fails.
+func (l *Listener) serve(handler http.Handler, allowH2C bool, maxHeaderSize int) {
+	echo(Log{"t": "listen", "address": l.address, "roles": strings.Join(l.roles, ","), "tls": fmt.Sprint(l.tls != nil)})
+	server := &http.Server{Addr: l.address, Handler: handler, TLSConfig: l.tls, MaxHeaderBytes: maxHeaderSize}
+	if l.tls != nil {
+		if err := server.ServeTLS(l.ln, "", ""); err != nil {
+			echoError(Log{"t": "listen_tls", "address": l.address, "error": err.Error()})
+		}
+		return
+	}
+	if allowH2C {
+		server.Handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	if err := server.Serve(l.ln); err != nil {
+		echoError(Log{"t": "listen_no_tls", "address": l.address, "error": err.Error()})
+	}
+}
+
+// tlsConfig returns the TLS configuration for the listener, or nil for plain HTTP.
+func (c ListenerConf) tlsConfig() (*tls.Config, error) {
+	if len(c.CertFile) == 0 && len(c.KeyFile) == 0 {
+		if len(c.ClientCAFile) > 0 {
+			return nil, fmt.Errorf("listener %s: client certificates require TLS", c.Address)
+		}
+		return nil, nil
+	}
+	cert := &Certificate{}
+	if err := cert.load(c.CertFile, c.KeyFile); err != nil {
+		return nil, fmt.Errorf("listener %s: %v", c.Address, err)
+	}
+	config := &tls.Config{GetCertificate: cert.get}
+	if len(c.ClientCAFile) > 0 {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: failed reading client CAs: %v", c.Address, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("listener %s: no certificates found in %s", c.Address, c.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// newListeners returns the additional listeners, and the roles left to the main listener.
+func newListeners(confs []ListenerConf) ([]*Listener, []string, error) {
+	claimed := make(map[string]bool)
+	var listeners []*Listener
+	for _, c := range confs {
+		if len(c.Roles) == 0 {
+			return nil, nil, fmt.Errorf("listener %s: no roles: want any of %s", c.Address, strings.Join(listenerRoles, ", "))
+		}
+		for _, r := range c.Roles {
+			if !isListenerRole(r) {
+				return nil, nil, fmt.Errorf("listener %s: unknown role %q: want any of %s", c.Address, r, strings.Join(listenerRoles, ", "))
+			}
+			claimed[r] = true
+		}
+		if len(c.AccessKeys) > 0 && isListenerRoleIn(uiRole, c.Roles) {
+			return nil, nil, fmt.Errorf("listener %s: access keys cannot be required on a %s listener: browsers do not send them", c.Address, uiRole)
+		}
+		config, err := c.tlsConfig()
+		if err != nil {
+			return nil, nil, err
+		}
+		listeners = append(listeners, newListener(c.Address, c.Roles, config, c.AccessKeys))
+	}
+	var remaining []string
+	for _, r := range listenerRoles {
+		if !claimed[r] {
+			remaining = append(remaining, r)
+		}
+	}
+	return listeners, remaining, nil
+}
+
+func isListenerRole(role string) bool {
+	return isListenerRoleIn(role, listenerRoles)
+}
+
+func isListenerRoleIn(role string, roles []string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// isHealthRoute returns true if the route is a health endpoint, which is served on every listener
+// without requiring the listener's access keys, so that probes need not be configured per listener.
+func isHealthRoute(pattern string) bool {
+	return pattern == "healthz" || pattern == "readyz"
+}
+
+// routeRoles returns the roles a route belongs to, given its pattern relative to the base URL.
+func routeRoles(pattern string) []string {
+	switch {
+	case isHealthRoute(pattern):
+		return listenerRoles
+	case pattern == "", pattern == "_f/", pattern == "_dl/", pattern == "_search":
+		// browsers and apps both read pages and files; apps register downloads browsers fetch; both search
+		return []string{uiRole, apiRole}
+	case strings.HasPrefix(pattern, "_a/"), strings.HasPrefix(pattern, "_d/"), pattern == "metrics":
+		return []string{adminRole}
+	case pattern == "_c/", pattern == "_m/", pattern == "_p/", pattern == "_api/":
+		return []string{apiRole}
+	}
+	return []string{uiRole}
+}
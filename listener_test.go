@@ -0,0 +1,114 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestListeners(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	listeners, roles, err := newListeners([]ListenerConf{{Address: "127.0.0.1:10102", Roles: []string{adminRole}}})
+	no(err)
+	eq(roles, []string{uiRole, apiRole})
+	primary := newListener(":10101", roles, nil, nil)
+	admin := listeners[0]
+
+	handle := handleWithBaseURL("/", []*Listener{primary, admin})
+	for _, pattern := range []string{"", "_s/", "_m/", "_a/", "healthz"} {
+		handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	}
+
+	status := func(l *Listener, path string) int {
+		w := httptest.NewRecorder()
+		l.mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	eq(status(primary, "/foo"), http.StatusOK)
+	eq(status(primary, "/_s/"), http.StatusOK)
+	eq(status(primary, "/_m/foo"), http.StatusOK)
+	eq(status(primary, "/_a/snapshot/foo"), http.StatusNotFound)
+	eq(status(admin, "/_a/snapshot/foo"), http.StatusOK)
+	eq(status(admin, "/healthz"), http.StatusOK)
+	eq(status(admin, "/foo"), http.StatusNotFound)
+	eq(status(admin, "/_s/"), http.StatusNotFound)
+
+	_, _, err = newListeners([]ListenerConf{{Address: ":10102", Roles: []string{uiRole, apiRole}, AccessKeys: []string{"app"}}})
+	ok(err != nil, "access keys on a ui listener")
+	_, _, err = newListeners([]ListenerConf{{Address: ":10102", Roles: []string{"metrics"}}})
+	ok(err != nil, "unknown role")
+	_, _, err = newListeners([]ListenerConf{{Address: ":10102"}})
+	ok(err != nil, "no roles")
+	_, _, err = newListeners([]ListenerConf{{Address: ":10102", Roles: []string{apiRole}, ClientCAFile: "ca.pem"}})
+	ok(err != nil, "client certificates without TLS")
+}
+
+func TestListenerAccessKeys(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	listeners, _, err := newListeners([]ListenerConf{{Address: "127.0.0.1:10102", Roles: []string{adminRole}, AccessKeys: []string{"ops"}}})
+	no(err)
+	admin := listeners[0]
+
+	handle := handleWithBaseURL("/", listeners)
+	for _, pattern := range []string{"_a/", "healthz"} {
+		handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	}
+
+	status := func(path, id string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if len(id) > 0 {
+			r.SetBasicAuth(id, "secret")
+		}
+		admin.mux.ServeHTTP(w, r)
+		return w.Code
+	}
+	eq(status("/_a/snapshot/foo", ""), http.StatusUnauthorized)
+	eq(status("/_a/snapshot/foo", "app"), http.StatusUnauthorized)
+	eq(status("/_a/snapshot/foo", "ops"), http.StatusOK)
+	eq(status("/healthz", ""), http.StatusOK)
+}
+
+func TestListenersSplit(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	listeners, roles, err := newListeners([]ListenerConf{{Address: "127.0.0.1:10102", Roles: []string{apiRole}}})
+	no(err)
+	eq(roles, []string{uiRole, adminRole})
+	primary := newListener(":10101", roles, nil, nil)
+	api := listeners[0]
+
+	handle := handleWithBaseURL("/", []*Listener{primary, api})
+	for _, pattern := range []string{"", "_s/", "_f/", "_dl/", "_search", "_c/"} {
+		handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	}
+
+	status := func(l *Listener, path string) int {
+		w := httptest.NewRecorder()
+		l.mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	for _, path := range []string{"/foo", "/_f/a.txt", "/_dl/token", "/_search?q=foo"} { // browsers and apps
+		eq(status(primary, path), http.StatusOK)
+		eq(status(api, path), http.StatusOK)
+	}
+	eq(status(primary, "/_s/"), http.StatusOK)
+	eq(status(api, "/_s/"), http.StatusNotFound)
+	eq(status(primary, "/_c/shard"), http.StatusNotFound)
+	eq(status(api, "/_c/shard"), http.StatusOK)
+}
@@ -0,0 +1,222 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel represents the severity of a log message.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota - 1
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LogDebug || l > LogError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return logLevelNames[l+1]
+}
+
+func parseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i - 1), nil
+		}
+	}
+	return LogInfo, fmt.Errorf("unknown log level %q: want one of %s", s, strings.Join(logLevelNames[:], ", "))
+}
+
+// LogLevels represents the least severe level logged, overall and per subsystem; info by default.
+type LogLevels struct {
+	Default    LogLevel
+	Subsystems map[string]LogLevel // subsystem, e.g. "auth" or "broker" => level
+}
+
+// ParseLogLevels parses a comma-separated list of log levels, e.g. "info,auth=debug,broker=warn".
+// A level without a subsystem sets the default, which is info if absent.
+func ParseLogLevels(s string) (LogLevels, error) {
+	levels := LogLevels{LogInfo, make(map[string]LogLevel)}
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if len(spec) == 0 {
+			continue
+		}
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) == 1 {
+			level, err := parseLogLevel(kv[0])
+			if err != nil {
+				return levels, err
+			}
+			levels.Default = level
+			continue
+		}
+		subsystem := strings.TrimSpace(kv[0])
+		if len(subsystem) == 0 {
+			return levels, fmt.Errorf("bad log level %q: want subsystem=level", spec)
+		}
+		level, err := parseLogLevel(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return levels, err
+		}
+		levels.Subsystems[subsystem] = level
+	}
+	return levels, nil
+}
+
+// of returns the least severe level logged for a subsystem.
+func (levels LogLevels) of(subsystem string) LogLevel {
+	if level, ok := levels.Subsystems[subsystem]; ok {
+		return level
+	}
+	return levels.Default
+}
+
+const (
+	logConsole = "console"
+	logJSON    = "json"
+)
+
+// Logger writes structured, leveled log messages, either as JSON lines, or in the console format: "# {...}"
+// following the standard logger's timestamp.
+type Logger struct {
+	sync.RWMutex
+	json   bool
+	levels LogLevels
+	least  LogLevel // least severe level logged by any subsystem
+}
+
+var logger = &Logger{}
+
+// setFormat switches between the "console" and "json" formats.
+func (l *Logger) setFormat(format string) error {
+	switch format {
+	case "", logConsole:
+		l.Lock()
+		l.json = false
+		l.Unlock()
+	case logJSON:
+		l.Lock()
+		l.json = true
+		l.Unlock()
+	default:
+		return fmt.Errorf("unknown log format %q: want %s or %s", format, logConsole, logJSON)
+	}
+	return nil
+}
+
+// configure replaces the log levels, e.g. when settings are reloaded.
+func (l *Logger) configure(levels LogLevels) {
+	least := levels.Default
+	for _, level := range levels.Subsystems {
+		if level < least {
+			least = level
+		}
+	}
+	l.Lock()
+	l.levels, l.least = levels, least
+	l.Unlock()
+}
+
+func (l *Logger) jsonFormat() bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.json
+}
+
+// write logs a message from the subsystem depth frames up the stack, if its level is enabled.
+// The caller is looked up only if needed: to tell its subsystem's level, or to log its subsystem as JSON.
+func (l *Logger) write(level LogLevel, depth int, m Log) {
+	l.RLock()
+	asJSON, levels, least := l.json, l.levels, l.least
+	l.RUnlock()
+	if level < least {
+		return
+	}
+	subsystem := "wave"
+	if varies := len(levels.Subsystems) > 0; varies || asJSON {
+		if _, file, _, ok := runtime.Caller(depth + 1); ok {
+			subsystem = logSubsystem(file)
+		}
+		if varies && level < levels.of(subsystem) {
+			return
+		}
+	}
+	e := make(map[string]string, len(m)+4)
+	for k, v := range m {
+		e[k] = v
+	}
+	e["level"] = level.String()
+	if asJSON {
+		e["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+		e["subsystem"] = subsystem
+		if j, err := json.Marshal(e); err == nil {
+			fmt.Fprintln(log.Writer(), string(j))
+		}
+		return
+	}
+	if j, err := json.Marshal(e); err == nil {
+		log.Println("#", string(j))
+	}
+}
+
+// logSubsystem returns the subsystem a source file belongs to: its name, up to the first underscore,
+// e.g. "auth" for auth.go, or "app" for app_grpc.go.
+func logSubsystem(file string) string {
+	name := strings.TrimSuffix(filepath.Base(file), ".go")
+	if i := strings.IndexByte(name, '_'); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// Log represents key-value data for a log message.
+// By convention, "t" is the message type, "client" a client's ID, "addr" its remote address,
+// "subject" the end-user's subject, "route" the page or app route, and "error" a failure.
+type Log map[string]string
+
+// echo logs a message at the info level.
+func echo(m Log) {
+	logger.write(LogInfo, 1, m)
+}
+
+// echoError logs a message at the error level.
+func echoError(m Log) {
+	logger.write(LogError, 1, m)
+}
+
+// echoDebug logs a message at the debug level.
+func echoDebug(m Log) {
+	logger.write(LogDebug, 1, m)
+}
+
+// echoWarn logs a message at the warn level.
+func echoWarn(m Log) {
+	logger.write(LogWarn, 1, m)
+}
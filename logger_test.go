@@ -0,0 +1,97 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestLogger(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+
+	levels, err := ParseLogLevels("warn, auth=debug,logger=error")
+	no(err)
+	eq(levels.of("broker"), LogWarn)
+	eq(levels.of("auth"), LogDebug)
+	_, err = ParseLogLevels("info,auth=verbose")
+	ok(err != nil, "unknown level")
+	_, err = ParseLogLevels("=debug")
+	ok(err != nil, "missing subsystem")
+
+	eq(logSubsystem("/src/wave/auth.go"), "auth")
+	eq(logSubsystem("app_grpc.go"), "app")
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		logger.setFormat(logConsole)
+		logger.configure(LogLevels{})
+	}()
+
+	logger.configure(LogLevels{LogInfo, map[string]LogLevel{"logger": LogWarn}})
+	echo(Log{"t": "skipped"})
+	echoWarn(Log{"t": "kept"})
+	ok(!strings.Contains(buf.String(), "skipped"), "below subsystem level")
+	ok(strings.Contains(buf.String(), `# {"level":"warn","t":"kept"}`), "console format")
+
+	buf.Reset()
+	no(logger.setFormat(logJSON))
+	echoError(Log{"t": "failed", "error": "boom", "level": "ignored"})
+	var e map[string]string
+	no(json.Unmarshal(buf.Bytes(), &e))
+	eq(e["level"], "error")
+	eq(e["subsystem"], "logger")
+	eq(e["error"], "boom")
+	ok(len(e["time"]) > 0, "time")
+
+	ok(logger.setFormat("xml") != nil, "unknown format")
+}
+
+func TestLogAOF(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		logger.setFormat(logConsole)
+	}()
+
+	no(logger.setFormat(logJSON))
+	logAOF(patchMarker, "/foo", []byte(`{"d":[{"k":"x","d":{"view":"markdown"}}]}`))
+	echo(Log{"t": "other"})
+	logAOF(patchMarker, "/foo", []byte(`{"d":[{"k":"x view","v":"text"}]}`))
+	var e map[string]string
+	no(json.Unmarshal(bytes.SplitN(buf.Bytes(), []byte("\n"), 2)[0], &e))
+	eq(e["marker"], "*")
+
+	p := filepath.Join(t.TempDir(), "wave.log")
+	no(ioutil.WriteFile(p, buf.Bytes(), 0600))
+	log.SetOutput(ioutil.Discard)
+	site := newSite()
+	initSite(site, p)
+	page := site.at("/foo")
+	ok(page != nil, "restored from JSON log")
+	eq(string(page.marshal()), `{"p":{"c":{"x":{"d":{"view":"text"}}}}}`)
+}
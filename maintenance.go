@@ -0,0 +1,235 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaintenanceMessage = "This app is undergoing maintenance, and will be back shortly."
+	maintenanceStoreKey       = "@maintenance" // page store key of the shared maintenance state; not a page URL
+)
+
+var errAppMaintenance = errors.New("apps under maintenance")
+
+// Maintenance represents the server's maintenance mode, during which nothing is delivered to apps (queries,
+// app messages or timers), and browsers are shown a notice, so that planned app upgrades don't look like outages.
+// Queries sent during maintenance are held, up to a limit, and delivered once maintenance ends, or refused.
+// With a page store, maintenance mode is shared by all replicas; each holds the queries sent to it.
+type Maintenance struct {
+	sync.Mutex
+	size    int // max queries held
+	on      bool
+	since   time.Time
+	message string
+	queue   bool        // hold queries, or refuse them?
+	queries []HeldQuery // queries held, in order
+	notice  []byte      // ops showing the notice
+	refused int         // queries refused
+}
+
+// HeldQuery represents a query to a route, held during maintenance.
+type HeldQuery struct {
+	route string
+	BufferedQuery
+}
+
+// MaintenanceConf represents the settings of a maintenance window.
+type MaintenanceConf struct {
+	Message string `json:"message"` // notice shown to users; a default if empty
+	Queue   bool   `json:"queue"`   // hold queries until maintenance ends, instead of refusing them?
+}
+
+// SharedMaintenance represents the state of maintenance mode, as shared with other replicas via the page store.
+type SharedMaintenance struct {
+	On    bool      `json:"on"`
+	Since time.Time `json:"since"`
+	MaintenanceConf
+}
+
+// MaintenanceInfo represents the state of maintenance mode.
+type MaintenanceInfo struct {
+	On      bool       `json:"on"`
+	Since   *time.Time `json:"since,omitempty"`
+	Message string     `json:"message,omitempty"`
+	Queue   bool       `json:"queue"`
+	Held    int        `json:"held"`    // queries held
+	Refused int        `json:"refused"` // queries refused
+}
+
+func newMaintenance(size int) *Maintenance {
+	return &Maintenance{size: size}
+}
+
+// start enters maintenance mode as of since, or changes its settings if already on, returning the ops showing
+// the notice.
+func (m *Maintenance) start(conf MaintenanceConf, since time.Time) []byte {
+	if len(conf.Message) == 0 {
+		conf.Message = defaultMaintenanceMessage
+	}
+	notice, _ := json.Marshal(OpsD{N: &BannerD{Text: conf.Message, Type: "warning"}})
+	m.Lock()
+	defer m.Unlock()
+	if !m.on {
+		m.on, m.since, m.refused = true, since, 0
+	}
+	m.message, m.queue, m.notice = conf.Message, conf.Queue, notice
+	echo(Log{"t": "maintenance_start", "message": conf.Message, "queue": strconv.FormatBool(conf.Queue)})
+	return notice
+}
+
+// stop leaves maintenance mode, returning the queries held, in order. Safe to call on a nil maintenance.
+func (m *Maintenance) stop() ([]HeldQuery, bool) {
+	if m == nil {
+		return nil, false
+	}
+	m.Lock()
+	defer m.Unlock()
+	if !m.on {
+		return nil, false
+	}
+	queries := m.queries
+	echo(Log{"t": "maintenance_stop", "held": strconv.Itoa(len(queries)), "refused": strconv.Itoa(m.refused)})
+	m.on, m.message, m.queries, m.notice = false, "", nil, nil
+	return queries, true
+}
+
+// hold holds a query to route on behalf of client, if maintenance is on, returning false otherwise. Queries beyond
+// the limit, or all queries if not queueing, are refused, and the client is reminded of the notice instead.
+// Safe to call on a nil maintenance.
+func (m *Maintenance) hold(route string, client *Client, data []byte) bool {
+	if m == nil {
+		return false
+	}
+	m.Lock()
+	defer m.Unlock()
+	if !m.on {
+		return false
+	}
+	if m.queue && len(m.queries) < m.size {
+		m.queries = append(m.queries, HeldQuery{route, BufferedQuery{client, data}})
+		return true
+	}
+	m.refused++
+	client.send(m.notice) // so that the UI no longer waits for a reply
+	return true
+}
+
+// isOn returns true if maintenance is on. Safe to call on a nil maintenance.
+func (m *Maintenance) isOn() bool {
+	if m == nil {
+		return false
+	}
+	m.Lock()
+	defer m.Unlock()
+	return m.on
+}
+
+// getNotice returns the ops showing the notice, or nil if maintenance is off. Safe to call on a nil maintenance.
+func (m *Maintenance) getNotice() []byte {
+	if m == nil {
+		return nil
+	}
+	m.Lock()
+	defer m.Unlock()
+	return m.notice
+}
+
+// info returns the state of maintenance mode. Safe to call on a nil maintenance.
+func (m *Maintenance) info() MaintenanceInfo {
+	if m == nil {
+		return MaintenanceInfo{}
+	}
+	m.Lock()
+	defer m.Unlock()
+	info := MaintenanceInfo{On: m.on, Message: m.message, Queue: m.queue, Held: len(m.queries), Refused: m.refused}
+	if m.on {
+		since := m.since
+		info.Since = &since
+	}
+	return info
+}
+
+// startMaintenance enters maintenance mode, showing the notice to all connected browsers, on all replicas.
+func (b *Broker) startMaintenance(conf MaintenanceConf) {
+	b.announce <- Announce{Data: b.maintenance.start(conf, time.Now())}
+	b.shareMaintenance()
+}
+
+// stopMaintenance leaves maintenance mode on all replicas.
+func (b *Broker) stopMaintenance() {
+	b.endMaintenance()
+	b.shareMaintenance()
+}
+
+// shareMaintenance tells other replicas, and replicas started later, the state of maintenance mode.
+func (b *Broker) shareMaintenance() {
+	if b.storage == nil {
+		return
+	}
+	info := b.maintenance.info()
+	state := SharedMaintenance{On: info.On, MaintenanceConf: MaintenanceConf{info.Message, info.Queue}}
+	if info.Since != nil {
+		state.Since = *info.Since
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		echoError(Log{"t": "maintenance_share", "error": err.Error()})
+		return
+	}
+	b.storage.share(maintenanceStoreKey, data)
+}
+
+// maintenanceChanged applies the state of maintenance mode shared by another replica, or read from the page store.
+func (b *Broker) maintenanceChanged(data []byte) {
+	if b.maintenance == nil {
+		return
+	}
+	var state SharedMaintenance
+	if err := json.Unmarshal(data, &state); err != nil {
+		echoError(Log{"t": "maintenance_share", "error": err.Error()})
+		return
+	}
+	if state.On {
+		b.announce <- Announce{Data: b.maintenance.start(state.MaintenanceConf, state.Since)}
+		return
+	}
+	b.endMaintenance()
+}
+
+// endMaintenance leaves maintenance mode, hiding the notice, and delivers the queries held meanwhile to their apps.
+func (b *Broker) endMaintenance() {
+	queries, ok := b.maintenance.stop()
+	if !ok {
+		return
+	}
+	if notice, err := json.Marshal(OpsD{N: &BannerD{}}); err == nil {
+		b.announce <- Announce{Data: notice}
+	}
+	go func() {
+		for _, q := range queries {
+			if app := b.getApp(q.route); app != nil {
+				q.client.forward(app, q.route, q.data, nil)
+			} else if !b.queries.hold(q.route, q.client, q.data) { // app still restarting, perhaps
+				echoError(Log{"t": "query", "route": q.route, "client": q.client.id, "error": "service unavailable"})
+			}
+		}
+	}()
+}
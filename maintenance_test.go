@@ -0,0 +1,95 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestMaintenance(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	broker := newBroker(newSite(), false, false, true)
+	broker.maintenance = newMaintenance(1)
+	go broker.run()
+	alice := newClient("test", nil, anonymous, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	alice.subscribe("/demo")
+	for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+		broker.clientsMux.RLock()
+		subscribed = len(broker.clients["/demo"]) == 1
+		broker.clientsMux.RUnlock()
+	}
+	notice := func() *BannerD {
+		var ops OpsD
+		no(json.Unmarshal(<-alice.data, &ops))
+		return ops.N
+	}
+
+	ok(!broker.maintenance.hold("/app", alice, []byte("{}")), "not in maintenance")
+
+	broker.startMaintenance(MaintenanceConf{Message: "Upgrading", Queue: true})
+	eq(*notice(), BannerD{Text: "Upgrading", Type: "warning"})
+	ok(broker.maintenance.hold("/app", alice, []byte(`{"a":1}`)), "held")
+	ok(broker.maintenance.hold("/app", alice, []byte(`{"a":2}`)), "refused")
+	eq(notice().Text, "Upgrading") // reminded instead of held
+	info := broker.maintenance.info()
+	ok(info.On && info.Since != nil, "on")
+	eq(info.Held, 1)
+	eq(info.Refused, 1)
+
+	broker.stopMaintenance()
+	eq(*notice(), BannerD{}) // hidden
+	ok(!broker.maintenance.hold("/app", alice, []byte("{}")), "maintenance over")
+	ok(broker.maintenance.getNotice() == nil, "no notice")
+	eq(broker.maintenance.info().On, false)
+}
+
+func TestSharedMaintenance(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	store := &memPageStore{make(map[string][]byte)}
+	replica := func() *Broker {
+		site := newSite()
+		broker := newBroker(site, false, false, true)
+		broker.maintenance = newMaintenance(10)
+		broker.storage = newPageStorage(store, site)
+		go broker.run()
+		return broker
+	}
+	a, b := replica(), replica()
+
+	a.startMaintenance(MaintenanceConf{Message: "Upgrading", Queue: true})
+	ok(store.pages[maintenanceStoreKey] != nil, "shared")
+	b.storage.loadShared(b) // as if started later
+	info := b.maintenance.info()
+	ok(info.On, "on")
+	eq(info.Message, "Upgrading")
+	ok(info.Since.Equal(*a.maintenance.info().Since), "same since")
+	no(b.storage.restore(nil))
+	_, isPage := b.site.pages.get(maintenanceStoreKey)
+	ok(!isPage, "not a page")
+
+	// Queries buffered while an app restarted are held, and timers and app messages are not delivered.
+	alice := newClient("test", nil, anonymous, "", b, nil, false, false, false, browserProtocolVersion, "/")
+	b.flush(nil, "/app", []BufferedQuery{{alice, []byte("{}")}})
+	eq(b.maintenance.info().Held, 1)
+	eq(newScheduler(b).deliver("/app", TimerD{}), errAppMaintenance)
+
+	a.stopMaintenance()
+	b.maintenanceChanged(store.pages[maintenanceStoreKey]) // as if relayed
+	ok(!b.maintenance.info().On, "off")
+}
@@ -0,0 +1,300 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+const contentTypePrometheus = "text/plain; version=0.0.4; charset=utf-8"
+
+// latencyBuckets are the upper bounds of latency histogram buckets, in seconds.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// frameBuckets are the upper bounds of messages-per-frame histogram buckets.
+var frameBuckets = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256}
+
+var msgTypeNames = map[MsgT]string{
+	badMsgT:   "bad",
+	noopMsgT:  "noop",
+	patchMsgT: "patch",
+	queryMsgT: "query",
+	watchMsgT: "watch",
+}
+
+// Metrics represents the server's operational metrics.
+type Metrics struct {
+	connections    int64         // open websockets; accessed atomically
+	sent           uint64        // messages sent to clients; accessed atomically
+	dropped        uint64        // messages dropped because a client's buffer was full; accessed atomically
+	pendingQueries int64         // queries queued by clients for delivery to apps; accessed atomically
+	throttled      int64         // clients falling behind, with minor updates skipped; accessed atomically
+	skipped        uint64        // minor updates skipped for clients falling behind; accessed atomically
+	received       *CounterVec   // messages received from clients, by type
+	appLatency     *HistogramVec // time taken to forward queries to apps, by app route
+	slowQueries    *CounterVec   // queries apps took longer than the slow query threshold to accept, by app route
+	frameMessages  *HistogramVec // messages coalesced into each websocket write; unlabeled
+	routes         *RouteStats   // traffic, by route
+}
+
+var metrics = newMetrics()
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		received:      newCounterVec("wave_messages_received_total", "Messages received from clients, by type.", "type"),
+		appLatency:    newHistogramVec("wave_app_forward_duration_seconds", "Time taken to forward queries to apps, by app route.", "route", latencyBuckets),
+		slowQueries:   newCounterVec("wave_app_slow_queries_total", "Queries apps took longer than the slow query threshold to accept, by app route.", "route"),
+		frameMessages: newHistogramVec("wave_socket_messages_per_write", "Messages coalesced into each websocket write to clients.", "", frameBuckets),
+		routes:        newRouteStats(),
+	}
+}
+
+// CounterVec represents a set of counters, one per label value.
+type CounterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	label  string
+	values map[string]uint64
+}
+
+func newCounterVec(name, help, label string) *CounterVec {
+	return &CounterVec{name: name, help: help, label: label, values: make(map[string]uint64)}
+}
+
+func (c *CounterVec) inc(value string) {
+	c.Lock()
+	c.values[value]++
+	c.Unlock()
+}
+
+// drop forgets the counter for a label value, e.g. when an app goes away.
+func (c *CounterVec) drop(value string) {
+	c.Lock()
+	delete(c.values, value)
+	c.Unlock()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	writeMetricHeader(w, c.name, c.help, "counter")
+	for _, v := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", c.name, c.label, quoteLabel(v), c.values[v])
+	}
+}
+
+// Histogram represents a distribution of observations.
+type Histogram struct {
+	counts []uint64 // per bucket, non-cumulative; the last is for +Inf
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec represents a set of histograms, one per label value.
+type HistogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	values  map[string]*Histogram
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	return &HistogramVec{name: name, help: help, label: label, buckets: buckets, values: make(map[string]*Histogram)}
+}
+
+func (h *HistogramVec) observe(value string, d time.Duration) {
+	h.add(value, d.Seconds())
+}
+
+// add records an observation for a label value; "" if the histogram is unlabeled.
+func (h *HistogramVec) add(value string, s float64) {
+	i := sort.SearchFloat64s(h.buckets, s) // first bucket with upper bound >= s
+	h.Lock()
+	x, ok := h.values[value]
+	if !ok {
+		x = &Histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[value] = x
+	}
+	x.counts[i]++
+	x.sum += s
+	x.count++
+	h.Unlock()
+}
+
+// drop forgets the histogram for a label value, e.g. when an app goes away.
+func (h *HistogramVec) drop(value string) {
+	h.Lock()
+	delete(h.values, value)
+	h.Unlock()
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		x, label, labels := h.values[k], "", ""
+		if len(h.label) > 0 {
+			label = h.label + "=" + quoteLabel(k)
+			labels = "{" + label + "}"
+			label += ","
+		}
+		var n uint64
+		for i, le := range h.buckets {
+			n += x.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, label, formatFloat(le), n)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, label, x.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(x.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, x.count)
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	writeMetricHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func writeCounter(w io.Writer, name, help string, value uint64) {
+	writeMetricHeader(w, name, help, "counter")
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MetricsServer exposes metrics in the Prometheus text format.
+// See https://prometheus.io/docs/instrumenting/exposition_formats/
+type MetricsServer struct {
+	keychain *keychain.Keychain
+	broker   *Broker
+	metrics  *Metrics
+}
+
+func newMetricsServer(keychain *keychain.Keychain, broker *Broker, metrics *Metrics) *MetricsServer {
+	return &MetricsServer{keychain, broker, metrics}
+}
+
+func (s *MetricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.keychain.Guard(w, r) {
+		return
+	}
+	var b bytes.Buffer
+	s.write(&b)
+	w.Header().Set("Content-Type", contentTypePrometheus)
+	w.Write(b.Bytes())
+}
+
+func (s *MetricsServer) write(w io.Writer) {
+	m, b := s.metrics, s.broker
+
+	writeGauge(w, "wave_connections", "Open websocket connections.", float64(atomic.LoadInt64(&m.connections)))
+	m.received.write(w)
+	writeCounter(w, "wave_messages_sent_total", "Messages sent to clients.", atomic.LoadUint64(&m.sent))
+	writeCounter(w, "wave_messages_dropped_total", "Messages dropped because a client was not keeping up.", atomic.LoadUint64(&m.dropped))
+
+	writeMetricHeader(w, "wave_broker_queue_length", "Messages waiting to be processed by the broker, by queue.", "gauge")
+	for _, q := range []struct {
+		name   string
+		length int
+	}{
+		{"publish", len(b.publish)},
+		{"subscribe", len(b.subscribe)},
+		{"unsubscribe", len(b.unsubscribe)},
+		{"logout", len(b.logout)},
+		{"notices", len(b.notices)},
+	} {
+		fmt.Fprintf(w, "wave_broker_queue_length{queue=%s} %d\n", quoteLabel(q.name), q.length)
+	}
+
+	writeGauge(w, "wave_apps", "Registered apps.", float64(len(b.getApps())))
+	forwards := b.forwardStats()
+	writeGauge(w, "wave_app_forward_workers", "Workers delivering queries to each app; 0 if unbounded.", float64(forwards.Workers))
+	writeGauge(w, "wave_app_forward_busy", "Workers busy delivering queries to apps, across apps.", float64(forwards.Busy))
+	writeGauge(w, "wave_app_forward_waiting", "Queries waiting for a worker to deliver them to apps, across apps.", float64(forwards.Waiting))
+	writeGauge(w, "wave_app_forward_queued", "Queries queued by clients for delivery to apps.", float64(atomic.LoadInt64(&m.pendingQueries)))
+	m.appLatency.write(w)
+	m.slowQueries.write(w)
+	m.frameMessages.write(w)
+	writeGauge(w, "wave_clients_throttled", "Clients falling behind, with minor updates skipped until they catch up.", float64(atomic.LoadInt64(&m.throttled)))
+	writeCounter(w, "wave_messages_skipped_total", "Minor updates skipped for clients falling behind.", atomic.LoadUint64(&m.skipped))
+	m.routes.write(w, b.subscriberCounts())
+
+	var count, size int64
+	b.site.pages.each(func(url string, p *Page) {
+		count++
+		size += p.bytes() // as tracked by patches, rather than marshaling every page per scrape
+	})
+	writeGauge(w, "wave_pages", "Pages on the site.", float64(count))
+	writeGauge(w, "wave_page_bytes", "Size of pages on the site, marshaled, in bytes, as tracked for -max-site-memory; an upper bound between marshals.", float64(size))
+	writeGauge(w, "wave_pages_evicted", "Pages evicted to the page store to stay within -max-site-memory, or not preloaded, not read back since.", float64(b.site.evictedCount()))
+	writeCounter(w, "wave_page_evictions_total", "Pages evicted to stay within -max-site-memory.", atomic.LoadUint64(&b.site.evictStats.Evictions))
+	writeCounter(w, "wave_page_evicted_bytes_total", "Size of pages evicted to stay within -max-site-memory, marshaled, in bytes.", atomic.LoadUint64(&b.site.evictStats.EvictedBytes))
+	writeCounter(w, "wave_page_reloads_total", "Evicted pages read back from the page store on demand.", atomic.LoadUint64(&b.site.evictStats.Reloads))
+	writeCounter(w, "wave_page_eviction_failures_total", "Pages that could not be saved to the page store on eviction, or read back.", atomic.LoadUint64(&b.site.evictStats.Failures))
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	writeGauge(w, "go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	writeGauge(w, "go_memstats_heap_alloc_bytes", "Number of heap bytes allocated and still in use.", float64(mem.HeapAlloc))
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+func TestMetricsServer(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	id, secret, hash, err := keychain.CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+
+	site := newSite()
+	no(site.set("/foo", []byte(`{"p":{"c":{"x":{"d":{"view":"markdown"}}}}}`)))
+	broker := newBroker(site, false, true, true)
+	m := newMetrics()
+	m.received.inc("watch")
+	m.received.inc("watch")
+	m.received.inc("query")
+	m.appLatency.observe("/demo", 30*time.Millisecond)
+	m.appLatency.observe("/demo", 3*time.Second)
+
+	scrape := func(key bool) (int, string) {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if key {
+			r.SetBasicAuth(id, secret)
+		}
+		w := httptest.NewRecorder()
+		newMetricsServer(kc, broker, m).ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	code, _ := scrape(false)
+	eq(code, http.StatusUnauthorized)
+
+	code, text := scrape(true)
+	eq(code, http.StatusOK)
+	for _, line := range []string{
+		"# TYPE wave_messages_received_total counter",
+		`wave_messages_received_total{type="watch"} 2`,
+		`wave_messages_received_total{type="query"} 1`,
+		`wave_app_forward_duration_seconds_bucket{route="/demo",le="0.025"} 0`,
+		`wave_app_forward_duration_seconds_bucket{route="/demo",le="0.05"} 1`,
+		`wave_app_forward_duration_seconds_bucket{route="/demo",le="+Inf"} 2`,
+		`wave_app_forward_duration_seconds_count{route="/demo"} 2`,
+		`wave_broker_queue_length{queue="publish"} 0`,
+		"wave_pages 1",
+		"wave_page_bytes 43", // as set, not marshaled
+	} {
+		ok(strings.Contains(text, line+"\n"), "missing: "+line)
+	}
+	eq(quoteLabel("a\"b\\c\n"), `"a\"b\\c\n"`)
+}
@@ -46,15 +46,17 @@ type MultipartServer struct {
 	prefix         string
 	keychain       *keychain.Keychain
 	auth           *Auth
+	tenancy        *Tenancy
 	maxRequestSize int64
-	sources        map[string]*MultipartSource
+	sources        map[string]*MultipartSource // tenant route of source => source
 }
 
-func newMultipartServer(prefix string, keychain *keychain.Keychain, auth *Auth, maxRequestSize int64) *MultipartServer {
+func newMultipartServer(prefix string, keychain *keychain.Keychain, auth *Auth, tenancy *Tenancy, maxRequestSize int64) *MultipartServer {
 	return &MultipartServer{
 		prefix:         prefix,
 		keychain:       keychain,
 		auth:           auth,
+		tenancy:        tenancy,
 		maxRequestSize: maxRequestSize,
 		sources:        make(map[string]*MultipartSource),
 	}
@@ -70,13 +72,19 @@ func randomBoundary() string {
 }
 
 func (s *MultipartServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	key := strings.TrimPrefix(r.URL.Path, s.prefix)
+	key := "/" + strings.TrimPrefix(r.URL.Path, s.prefix)
 	switch r.Method {
 	case http.MethodGet:
 		if s.auth != nil && !s.auth.allow(r) {
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
+		tenant, err := s.tenancy.of(r, s.keychain.Allow(r), s.auth)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		key = tenantRoute(tenant, key)
 
 		s.RLock()
 		source, ok := s.sources[key]
@@ -105,6 +113,7 @@ func (s *MultipartServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if !s.keychain.Guard(w, r) {
 			return
 		}
+		key = tenantRoute(s.tenancy.ofKey(r), key)
 
 		s.RLock()
 		source, ok := s.sources[key]
@@ -118,7 +127,7 @@ func (s *MultipartServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		mr, err := r.MultipartReader()
 		if err != nil {
-			echo(Log{"t": "multipart_read", "error": err.Error()})
+			echoError(Log{"t": "multipart_read", "error": err.Error()})
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
@@ -129,7 +138,7 @@ func (s *MultipartServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		data, err := ioutil.ReadAll(io.LimitReader(part, s.maxRequestSize))
 		if err != nil {
-			echo(Log{"t": "multipart_read", "error": err.Error()})
+			echoError(Log{"t": "multipart_read", "error": err.Error()})
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
@@ -145,6 +154,7 @@ func (s *MultipartServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if !s.keychain.Guard(w, r) {
 			return
 		}
+		key = tenantRoute(s.tenancy.ofKey(r), key)
 
 		s.RLock()
 		source, ok := s.sources[key]
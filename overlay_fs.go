@@ -0,0 +1,72 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// OverlayFS represents a stack of file systems: files in earlier file systems hide those at the same paths in later
+// ones, e.g. to rebrand the UI by overriding some of its files.
+type OverlayFS []http.FileSystem
+
+// newOverlayFS returns a file system serving files from dirs, in order of precedence.
+func newOverlayFS(dirs ...string) OverlayFS {
+	fs := make(OverlayFS, len(dirs))
+	for i, dir := range dirs {
+		fs[i] = http.Dir(dir)
+	}
+	return fs
+}
+
+func (fs OverlayFS) Open(name string) (http.File, error) {
+	var first error
+	for _, layer := range fs {
+		f, err := layer.Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if first == nil || !os.IsNotExist(err) { // report errors other than missing files
+			first = err
+		}
+	}
+	if first == nil {
+		first = os.ErrNotExist
+	}
+	return nil, first
+}
+
+// layerOf returns the file system serving name, i.e. the first one containing it; nil if none.
+func (fs OverlayFS) layerOf(name string) http.FileSystem {
+	for _, layer := range fs {
+		if f, err := layer.Open(name); err == nil {
+			f.Close()
+			return layer
+		}
+	}
+	return nil
+}
+
+// readFile returns the contents of a file from the first file system containing it.
+func (fs OverlayFS) readFile(name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestOverlayFS(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	brand, ui := t.TempDir(), t.TempDir()
+	write := func(dir, name, content string) {
+		no(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+	}
+	write(ui, "index.html", "<body>Wave</body>")
+	write(ui, "logo.svg", "wave")
+	write(ui, "app.js", "app")
+	write(brand, "index.html", "<body>Acme</body>")
+	write(brand, "logo.svg", "acme")
+
+	fs := newOverlayFS(brand, ui)
+	b, err := fs.readFile("/index.html")
+	no(err)
+	eq(string(b), "<body>Acme</body>")
+
+	h := http.FileServer(fs)
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+	code, body := get("/logo.svg")
+	eq(code, http.StatusOK)
+	eq(body, "acme")
+	_, body = get("/app.js")
+	eq(body, "app")
+	code, _ = get("/missing.js")
+	eq(code, http.StatusNotFound)
+
+	_, err = fs.Open("/missing.js")
+	ok(err != nil, "missing file")
+}
@@ -18,17 +18,31 @@ import (
 	"encoding/json"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Page represents a web page.
 type Page struct {
 	sync.RWMutex
-	cards map[string]*Card
-	cache []byte
+	cards   map[string]*Card
+	cache   []byte
+	size    int64 // marshaled size, in bytes: measured when last marshaled, plus an upper-bound estimate of the growth due to patches since; accessed atomically.
+	touched int64 // unix time of last access, in nanoseconds; accessed atomically.
 }
 
 func newPage() *Page {
-	return &Page{cards: make(map[string]*Card)}
+	return &Page{cards: make(map[string]*Card), touched: time.Now().UnixNano()}
+}
+
+// bytes returns the page's marshaled size, as tracked (see size).
+func (p *Page) bytes() int64 {
+	return atomic.LoadInt64(&p.size)
+}
+
+// touch records an access to the page.
+func (p *Page) touch() {
+	atomic.StoreInt64(&p.touched, time.Now().UnixNano())
 }
 
 func (p *Page) read() []byte {
@@ -49,6 +63,21 @@ func (p *Page) set(k string, v interface{}) {
 	}
 }
 
+// apply applies a delta (other than drop page) to the page; must be called under write-lock.
+func (p *Page) apply(ns *Namespace, op OpD) {
+	if op.C != nil {
+		p.set(op.K, loadCycBuf(ns, op.C))
+	} else if op.F != nil {
+		p.set(op.K, loadFixBuf(ns, op.F))
+	} else if op.M != nil {
+		p.set(op.K, loadMapBuf(ns, op.M))
+	} else if op.D != nil {
+		p.cards[op.K] = loadCard(ns, CardD{op.D, op.B})
+	} else {
+		p.set(op.K, op.V)
+	}
+}
+
 func (p *Page) dump() *PageD {
 	c := make(map[string]CardD)
 	for k, v := range p.cards {
@@ -57,6 +86,8 @@ func (p *Page) dump() *PageD {
 	return &PageD{c}
 }
 
+// marshal returns the page's content as a full-page delta, marshaling it at most once
+// until the next change to the page, no matter how many clients join at the same time.
 func (p *Page) marshal() []byte {
 	if cache := p.read(); cache != nil {
 		return cache
@@ -65,12 +96,17 @@ func (p *Page) marshal() []byte {
 	p.Lock()
 	defer p.Unlock()
 
+	if p.cache != nil { // marshaled by a concurrent caller while we waited for the lock
+		return p.cache
+	}
+
 	cache, err := json.Marshal(OpsD{P: p.dump()})
 	if err != nil {
-		echo(Log{"t": "page_marshal", "error": err.Error()})
+		echoError(Log{"t": "page_marshal", "error": err.Error()})
 		return nil
 	}
 	p.cache = cache // invalidated by site exec() under write-lock
+	atomic.StoreInt64(&p.size, int64(len(cache)))
 	return cache
 }
 
@@ -79,5 +115,5 @@ func loadPage(ns *Namespace, d *PageD) *Page {
 	for k, v := range d.C {
 		cards[k] = loadCard(ns, v)
 	}
-	return &Page{cards: cards}
+	return &Page{cards: cards, touched: time.Now().UnixNano()}
 }
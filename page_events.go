@@ -0,0 +1,172 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+const (
+	contentTypeEventStream = "text/event-stream"
+
+	pageEventsSuffix = "/events"
+)
+
+var (
+	eventData = []byte("data: ")
+	eventEnd  = []byte("\n\n")
+	eventPing = []byte(": ping\n\n")
+)
+
+// acceptsEvents returns true if a request asks for a stream of server-sent events, as sent by EventSource.
+func acceptsEvents(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), contentTypeEventStream)
+}
+
+// getEvents streams the page at the route the request's path is a suffix of, as server-sent events: the page,
+// followed by its changes, as sent to browsers over websockets, one message per event.
+// Streams are read-only; no queries are sent to apps on behalf of the stream. Streams count against the same
+// connection limits as websockets. Returns false if the request is not
+// for events, e.g. for a static file named "events".
+func (s *WebServer) getEvents(w http.ResponseWriter, r *http.Request) bool {
+	if !acceptsEvents(r) {
+		return false
+	}
+	route := strings.TrimSuffix(resolveURL(r.URL.Path, s.baseURL), pageEventsSuffix)
+	if len(route) == 0 {
+		route = "/"
+	}
+	route = s.broker.routeAliases().serve(route)
+	keyed := s.keychain.AllowRoute(r, keychain.ReadAccess, route)
+
+	session := anonymous
+	if !keyed {
+		session = nil
+		if s.auth != nil {
+			session = s.auth.identify(r)
+		}
+		if session == nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return true
+		}
+	}
+
+	var tenant string
+	if s.tenancy != nil {
+		if keyed {
+			tenant = s.tenancy.ofKey(r)
+		} else {
+			t, err := s.tenancy.ofUser(r, session)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return true
+			}
+			tenant = t
+		}
+	}
+	url := tenantRoute(tenant, route)
+
+	if !keyed && (s.broker.isUnicast(url) || s.broker.dashboard.denies(url, session)) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return true
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+		return true
+	}
+
+	addr := getRemoteAddr(r)
+	if err := s.limits.acquire(session, addr); err != nil {
+		echoWarn(Log{"t": "events_limit", "addr": addr, "subject": session.subject, "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return true
+	}
+	defer s.limits.release(session, addr)
+
+	client := newClient(addr, s.auth, session, tenant, s.broker, nil, false, false, false, browserProtocolVersion, s.baseURL)
+	stop := client.start()
+	defer func() {
+		stop()
+		accessLog.session(client, client.stats)
+	}()
+	client.stats.visit(url)
+	client.subscribe(url)
+	echo(client.fields(Log{"t": "events_watch", "route": url}))
+
+	h := w.Header()
+	h.Set("Content-Type", contentTypeEventStream)
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // don't let nginx buffer the stream
+	w.WriteHeader(http.StatusOK)
+
+	if page := s.site.at(url); page != nil {
+		if data := page.marshal(); data != nil {
+			client.send(data)
+		}
+	} else {
+		client.send(s.broker.missingPage(url))
+	}
+
+	ticker := time.NewTicker(pingPeriod) // keep proxies from timing out idle streams
+	defer ticker.Stop()
+	for {
+		select {
+		case data, ok := <-client.data:
+			if !ok { // broker dropped the client, e.g. for falling behind
+				return true
+			}
+			n, err := writeEvents(w, data)
+			if err != nil {
+				return true
+			}
+			atomic.AddInt64(&client.stats.sent, int64(n))
+			flusher.Flush()
+		case <-ticker.C:
+			if _, err := w.Write(eventPing); err != nil {
+				return true
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return true
+		}
+	}
+}
+
+// writeEvents writes newline-delimited messages as server-sent events, one event per message, returning the number
+// of bytes of messages written.
+func writeEvents(w io.Writer, data []byte) (int, error) {
+	n := 0
+	for _, msg := range bytes.Split(data, newline) {
+		if len(msg) == 0 {
+			continue
+		}
+		for _, b := range [][]byte{eventData, msg, eventEnd} {
+			if _, err := w.Write(b); err != nil {
+				return n, err
+			}
+		}
+		n += len(msg)
+	}
+	return n, nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+func TestGetEvents(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	id, secret, hash, err := keychain.CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+
+	site := newSite()
+	broker := newBroker(site, false, false, true)
+	go broker.run()
+	no(broker.patch("/foo", []byte(`{"d":[{"k":"x","d":{"view":"markdown","content":"a"}}]}`), "test"))
+	s := &WebServer{site: site, broker: broker, keychain: kc, baseURL: "/"}
+	h := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok(s.getEvents(w, r), "events request")
+	}))
+	defer h.Close()
+
+	get := func(id, secret string) *http.Response {
+		r, err := http.NewRequest(http.MethodGet, h.URL+"/foo/events", nil)
+		no(err)
+		r.Header.Set("Accept", contentTypeEventStream)
+		r.SetBasicAuth(id, secret)
+		res, err := http.DefaultClient.Do(r)
+		no(err)
+		return res
+	}
+
+	res := get(id, "bad")
+	res.Body.Close()
+	eq(res.StatusCode, http.StatusUnauthorized)
+
+	res = get(id, secret)
+	defer res.Body.Close()
+	eq(res.StatusCode, http.StatusOK)
+	eq(res.Header.Get("Content-Type"), contentTypeEventStream)
+	events := bufio.NewScanner(res.Body)
+	next := func() string {
+		for events.Scan() {
+			if line := events.Text(); strings.HasPrefix(line, "data: ") {
+				return strings.TrimPrefix(line, "data: ")
+			}
+		}
+		return ""
+	}
+	eq(next(), `{"p":{"c":{"x":{"d":{"content":"a","view":"markdown"}}}}}`)
+
+	for !watching(broker, "/foo") {
+		time.Sleep(time.Millisecond)
+	}
+	no(broker.patch("/foo", []byte(`{"d":[{"k":"x content","v":"b"}]}`), "test"))
+	eq(next(), `{"d":[{"k":"x content","v":"b"}]}`)
+
+	r := httptest.NewRequest(http.MethodGet, "/foo/events", nil)
+	ok(!s.getEvents(httptest.NewRecorder(), r), "not an events request")
+}
+
+func watching(b *Broker, route string) bool {
+	b.clientsMux.RLock()
+	defer b.clientsMux.RUnlock()
+	return len(b.clients[route]) > 0
+}
+
+func TestGetEventsLimits(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	id, secret, hash, err := keychain.CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+	site := newSite()
+	broker := newBroker(site, false, false, true)
+	limits := newConnLimits(0, 0, 1)
+	s := &WebServer{site: site, broker: broker, keychain: kc, baseURL: "/", limits: limits}
+
+	r := httptest.NewRequest(http.MethodGet, "/foo/events", nil)
+	eq(limits.acquire(anonymous, getRemoteAddr(r)), nil) // e.g. a websocket
+	r.Header.Set("Accept", contentTypeEventStream)
+	r.SetBasicAuth(id, secret)
+	w := httptest.NewRecorder()
+	s.getEvents(w, r)
+	eq(w.Code, http.StatusTooManyRequests)
+}
+
+// stalledEventWriter is a response writer for event streams that blocks writes until released.
+type stalledEventWriter struct {
+	*httptest.ResponseRecorder
+	released chan struct{}
+}
+
+func (w *stalledEventWriter) Write(b []byte) (int, error) {
+	<-w.released
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestGetEventsLagging(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	id, secret, hash, err := keychain.CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+	site := newSite()
+	broker := newBroker(site, false, false, true)
+	go broker.run()
+	no(broker.patch("/foo", []byte(`{"d":[{"k":"x","d":{"view":"markdown","content":"a"}}]}`), "test"))
+	s := &WebServer{site: site, broker: broker, keychain: kc, baseURL: "/"}
+
+	r := httptest.NewRequest(http.MethodGet, "/foo/events", nil)
+	r.Header.Set("Accept", contentTypeEventStream)
+	r.SetBasicAuth(id, secret)
+	w := &stalledEventWriter{httptest.NewRecorder(), make(chan struct{})}
+	done := make(chan bool)
+	go func() { done <- s.getEvents(w, r) }()
+	for !watching(broker, "/foo") {
+		time.Sleep(time.Millisecond)
+	}
+	for watching(broker, "/foo") { // fall behind, until dropped by the broker
+		no(broker.patch("/foo", []byte(`{"d":[{"k":"x content","v":"b"}]}`), "test"))
+	}
+	close(w.released)
+	ok(<-done, "events request")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	no(broker.ping(ctx)) // unsubscribed again on returning, without taking down the broker
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+func TestPageJSON(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	id, secret, hash, err := keychain.CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+	scopedID, scopedSecret, scopedHash, err := keychain.CreateAccessKey()
+	no(err)
+	scope, err := keychain.ParseScope("read,/dashboards")
+	no(err)
+	kc.AddScoped(scopedID, scopedHash, scope)
+
+	site := newSite()
+	broker := newBroker(site, false, false, true)
+	static := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("static")) })
+	s := &WebServer{site: site, broker: broker, fs: static, auth: newTestAuth("alice"), keychain: kc, maxRequestSize: 1024, baseURL: "/"}
+	no(broker.patch("/demo", []byte(`{"d":[{"k":"notes","d":{"view":"markdown","content":"Hi"}}]}`), ""))
+	no(broker.patch("/client", []byte(`{"d":[{"k":"notes","d":{"view":"markdown","content":"Hi"}}]}`), ""))
+	no(broker.patch("/dashboards/sales", []byte(`{"d":[{"k":"notes","d":{"view":"markdown","content":"Hi"}}]}`), ""))
+	broker.unicasts["/client"] = true
+
+	get := func(path, subject string, keyed bool) *httptest.ResponseRecorder {
+		r := asUser(httptest.NewRequest(http.MethodGet, path, nil), subject)
+		if keyed {
+			r.SetBasicAuth(id, secret)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, w := range []*httptest.ResponseRecorder{get("/demo.json", "", true), get("/demo.json", "alice", false)} {
+		eq(w.Code, http.StatusOK)
+		eq(w.Header().Get("Content-Type"), contentTypeJSON)
+		eq(w.Header().Get("Cache-Control"), "no-cache")
+		eq(w.Body.String(), `{"p":{"c":{"notes":{"d":{"content":"Hi","view":"markdown"}}}}}`)
+	}
+
+	eq(get("/demo.json", "", false).Code, http.StatusUnauthorized)
+	eq(get("/demo.json", "mallory", false).Code, http.StatusUnauthorized)
+	eq(get("/client.json", "alice", false).Code, http.StatusUnauthorized) // unicast pages are per-client
+	eq(get("/client.json", "", true).Code, http.StatusOK)
+
+	getScoped := func(path string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.SetBasicAuth(scopedID, scopedSecret)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	eq(getScoped("/dashboards/sales.json"), http.StatusOK)
+	eq(getScoped("/demo.json"), http.StatusUnauthorized) // out of scope
+
+	w := get("/missing.json", "alice", false) // not a page: falls through to static assets
+	eq(w.Code, http.StatusOK)
+	eq(w.Body.String(), "static")
+}
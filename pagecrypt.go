@@ -0,0 +1,262 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	pageCipherVersion = 1 // leading byte of encrypted blobs; plaintext pages start with '{'
+	pageKeyIDSize     = 4
+	pageKeySize       = 32 // AES-256
+)
+
+var errUnknownPageKey = errors.New("page encrypted with unknown key")
+
+// PageKey represents a data key used to encrypt pages at rest.
+type PageKey struct {
+	id   [pageKeyIDSize]byte // first bytes of the key's SHA-256 hash, to pick the key when decrypting
+	aead cipher.AEAD
+}
+
+func newPageKey(key []byte) (*PageKey, error) {
+	if len(key) != pageKeySize {
+		return nil, fmt.Errorf("want %d-byte key, got %d bytes", pageKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k := &PageKey{aead: aead}
+	h := sha256.Sum256(key)
+	copy(k.id[:], h[:])
+	return k, nil
+}
+
+// loadPageKey reads a key given its source, one of "file:path" (or just a path), or "cmd:command" to read the key
+// from the output of a shell command, e.g. a KMS client decrypting a data key.
+// Keys are 32 bytes, either raw, or encoded as hex or base64.
+func loadPageKey(spec string) (*PageKey, error) {
+	var (
+		b   []byte
+		err error
+	)
+	if strings.HasPrefix(spec, "cmd:") {
+		cmd := exec.Command("sh", "-c", strings.TrimPrefix(spec, "cmd:"))
+		cmd.Stderr = os.Stderr
+		b, err = cmd.Output()
+	} else {
+		b, err = os.ReadFile(strings.TrimPrefix(spec, "file:"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading page key: %v", err)
+	}
+	key, err := decodePageKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("bad page key: %v", err)
+	}
+	return newPageKey(key)
+}
+
+func decodePageKey(b []byte) ([]byte, error) {
+	if len(b) == pageKeySize {
+		return b, nil
+	}
+	s := strings.TrimSpace(string(b))
+	if len(s) == hex.EncodedLen(pageKeySize) {
+		return hex.DecodeString(s)
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("want %d bytes, raw or hex- or base64-encoded", pageKeySize)
+}
+
+// EncryptedPageStore encrypts pages and relayed patches with AES-256-GCM before passing them to the underlying store.
+//
+// Blobs are encrypted with the first key, and decrypted with whichever key they were encrypted with,
+// so that keys can be rotated by prepending a new key. Pages encrypted with older keys, or not encrypted at all
+// (e.g. stored before encryption was enabled), are re-encrypted with the first key when loaded.
+type EncryptedPageStore struct {
+	store PageStore
+	keys  []*PageKey
+}
+
+func newEncryptedPageStore(store PageStore, keys []*PageKey) *EncryptedPageStore {
+	return &EncryptedPageStore{store, keys}
+}
+
+// encrypt returns version | key id | nonce | ciphertext.
+func (s *EncryptedPageStore) encrypt(data []byte) ([]byte, error) {
+	key := s.keys[0]
+	n := key.aead.NonceSize()
+	blob := make([]byte, 1+pageKeyIDSize+n, 1+pageKeyIDSize+n+len(data)+key.aead.Overhead())
+	blob[0] = pageCipherVersion
+	copy(blob[1:], key.id[:])
+	nonce := blob[1+pageKeyIDSize:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return key.aead.Seal(blob, nonce, data, blob[:1+pageKeyIDSize]), nil
+}
+
+func (s *EncryptedPageStore) decrypt(blob []byte) ([]byte, error) {
+	if len(blob) == 0 || blob[0] != pageCipherVersion {
+		return nil, fmt.Errorf("unsupported page encryption version")
+	}
+	if len(blob) < 1+pageKeyIDSize {
+		return nil, fmt.Errorf("truncated page")
+	}
+	header := blob[:1+pageKeyIDSize]
+	for _, key := range s.keys {
+		if !bytes.Equal(key.id[:], header[1:]) {
+			continue
+		}
+		n := key.aead.NonceSize()
+		if len(blob) < len(header)+n {
+			return nil, fmt.Errorf("truncated page")
+		}
+		return key.aead.Open(nil, blob[len(header):len(header)+n], blob[len(header)+n:], header)
+	}
+	return nil, errUnknownPageKey
+}
+
+func (s *EncryptedPageStore) load() (map[string][]byte, error) {
+	blobs, err := s.store.load()
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[string][]byte, len(blobs))
+	var stale []string
+	for url, blob := range blobs {
+		if len(blob) > 0 && blob[0] == '{' { // not encrypted
+			pages[url] = blob
+			stale = append(stale, url)
+			continue
+		}
+		data, err := s.decrypt(blob)
+		if err != nil { // fail fast instead of silently dropping pages, e.g. if the key is wrong.
+			return nil, fmt.Errorf("failed decrypting page %s: %v", url, err)
+		}
+		pages[url] = data
+		if !bytes.Equal(blob[1:1+pageKeyIDSize], s.keys[0].id[:]) {
+			stale = append(stale, url)
+		}
+	}
+	for _, url := range stale {
+		if err := s.save(url, pages[url]); err != nil {
+			return nil, fmt.Errorf("failed re-encrypting page %s: %v", url, err)
+		}
+	}
+	if len(stale) > 0 {
+		echo(Log{"t": "page_store_encrypt", "pages": fmt.Sprint(len(stale))})
+	}
+	return pages, nil
+}
+
+// urls returns the urls of all stored pages. While keys are being rotated, all pages are read, to be re-encrypted
+// with the new key, even if only some are loaded at startup.
+func (s *EncryptedPageStore) urls() ([]string, error) {
+	if len(s.keys) == 1 {
+		return s.store.urls()
+	}
+	pages, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]string, 0, len(pages))
+	for url := range pages {
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
+
+func (s *EncryptedPageStore) save(url string, data []byte) error {
+	blob, err := s.encrypt(data)
+	if err != nil {
+		return err
+	}
+	return s.store.save(url, blob)
+}
+
+func (s *EncryptedPageStore) remove(url string) error {
+	return s.store.remove(url)
+}
+
+func (s *EncryptedPageStore) publish(msg []byte) error {
+	blob, err := s.encrypt(msg)
+	if err != nil {
+		return err
+	}
+	return s.store.publish(blob)
+}
+
+func (s *EncryptedPageStore) subscribe(f func(msg []byte), subscribed func()) error {
+	return s.store.subscribe(func(blob []byte) {
+		msg, err := s.decrypt(blob)
+		if err != nil {
+			echoError(Log{"t": "page_store_decrypt", "error": err.Error()})
+			return
+		}
+		f(msg)
+	}, subscribed)
+}
+
+func (s *EncryptedPageStore) read(url string) ([]byte, error) {
+	blob, err := s.store.read(url)
+	if err != nil || len(blob) == 0 {
+		return blob, err
+	}
+	if blob[0] == '{' { // not encrypted, e.g. stored before encryption was enabled, and not loaded at startup since
+		if err := s.save(url, blob); err != nil {
+			return nil, fmt.Errorf("failed encrypting page %s: %v", url, err)
+		}
+		return blob, nil
+	}
+	data, err := s.decrypt(blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed decrypting page %s: %v", url, err)
+	}
+	return data, nil
+}
+
+func (s *EncryptedPageStore) ping() error {
+	return s.store.ping()
+}
+
+func (s *EncryptedPageStore) setPassword(password string) {
+	s.store.setPassword(password)
+}
+
+func (s *EncryptedPageStore) close() error {
+	return s.store.close()
+}
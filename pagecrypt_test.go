@@ -0,0 +1,93 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+type memPageStore struct {
+	pages map[string][]byte
+}
+
+func (s *memPageStore) load() (map[string][]byte, error) {
+	pages := make(map[string][]byte, len(s.pages))
+	for url, data := range s.pages {
+		pages[url] = data
+	}
+	return pages, nil
+}
+
+func (s *memPageStore) urls() ([]string, error) {
+	urls := make([]string, 0, len(s.pages))
+	for url := range s.pages {
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
+
+func (s *memPageStore) read(url string) ([]byte, error)      { return s.pages[url], nil }
+func (s *memPageStore) save(url string, data []byte) error   { s.pages[url] = data; return nil }
+func (s *memPageStore) remove(url string) error              { delete(s.pages, url); return nil }
+func (s *memPageStore) publish(msg []byte) error             { return nil }
+func (s *memPageStore) subscribe(func([]byte), func()) error { return nil }
+func (s *memPageStore) ping() error                          { return nil }
+func (s *memPageStore) setPassword(string)                   {}
+func (s *memPageStore) close() error                         { return nil }
+
+func TestEncryptedPageStore(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	newKey := func(b byte) *PageKey {
+		k, err := newPageKey(bytes.Repeat([]byte{b}, pageKeySize))
+		no(err)
+		return k
+	}
+	k1, k2 := newKey(1), newKey(2)
+	page := []byte(`{"p":{"c":{}}}`)
+
+	mem := &memPageStore{map[string][]byte{"/plain": page}}
+	store := newEncryptedPageStore(mem, []*PageKey{k1})
+	no(store.save("/foo", page))
+	ok(!bytes.Contains(mem.pages["/foo"], page))
+
+	pages, err := store.load()
+	no(err)
+	eq(string(pages["/foo"]), string(page))
+	eq(string(pages["/plain"]), string(page))
+	ok(mem.pages["/plain"][0] == pageCipherVersion) // encrypted on load
+
+	rotated := newEncryptedPageStore(mem, []*PageKey{k2, k1})
+	pages, err = rotated.load()
+	no(err)
+	eq(string(pages["/foo"]), string(page))
+
+	_, err = newEncryptedPageStore(mem, []*PageKey{k2}).load() // re-encrypted with k2 on load
+	no(err)
+	_, err = newEncryptedPageStore(mem, []*PageKey{k1}).load()
+	ok(err != nil)
+
+	mem.pages["/lazy"] = page
+	data, err := store.read("/lazy")
+	no(err)
+	eq(string(data), string(page))
+	ok(mem.pages["/lazy"][0] == pageCipherVersion) // encrypted on read
+
+	mem.pages["/foo"][len(mem.pages["/foo"])-1] ^= 1 // tampered
+	_, err = rotated.load()
+	ok(err != nil)
+}
@@ -0,0 +1,202 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pageCreated = "create"
+	pagePatched = "patch"
+	pageDeleted = "delete"
+
+	pageHookSignatureHeader = "Wave-Signature"
+	pageHookEventHeader     = "Wave-Event"
+)
+
+// PageEvent represents a change to a page, as posted to page webhooks.
+type PageEvent struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`  // create, patch or delete
+	Route string    `json:"route"` // page route
+	Actor string    `json:"actor"` // "key:<access key id>", "user:<subject>", "ttl" or "gc"
+}
+
+func (e PageEvent) kind() string { return e.Type }
+
+// WebhookEvent represents an event posted to webhooks, e.g. a PageEvent or a ClientEvent.
+type WebhookEvent interface {
+	kind() string // event type, sent in the Wave-Event header
+}
+
+const (
+	webhookQueueSize       = 1024             // events queued per webhook URL
+	webhookDropLogInterval = 10 * time.Second // least time between logs of dropped events
+)
+
+// Webhooks posts events to webhooks, asynchronously. Each URL has a queue of its own, so that a slow or failing
+// webhook does not hold up the others; events are dropped for a URL whose queue is full.
+//
+// If a secret is configured, each request carries the hex-encoded HMAC-SHA256 of its body,
+// keyed by the secret, in the Wave-Signature header, formatted as "sha256=<hmac>".
+type Webhooks struct {
+	name     string // for logs, e.g. "page_hook"
+	secret   *SecretKey
+	types    map[string]bool // event types to post; all if empty
+	queues   []*webhookQueue
+	client   *http.Client
+	dropped  uint64 // events dropped since last logged; accessed atomically
+	loggedAt int64  // unix time dropped events were last logged, in nanoseconds; accessed atomically
+}
+
+type webhookQueue struct {
+	url    string
+	events chan webhookPost
+}
+
+type webhookPost struct {
+	kind string
+	body []byte
+}
+
+// newWebhooks returns webhooks posting events of the given types, all if none, to urls; types must be known.
+func newWebhooks(name string, urls []string, secret string, types, known []string) (*Webhooks, error) {
+	valid := make(map[string]bool)
+	for _, k := range known {
+		valid[k] = true
+	}
+	t := make(map[string]bool)
+	for _, s := range types {
+		if s = strings.TrimSpace(s); len(s) > 0 {
+			if !valid[s] {
+				return nil, fmt.Errorf("unknown %s event %q: want one of %s", name, s, strings.Join(known, ", "))
+			}
+			t[s] = true
+		}
+	}
+	h := &Webhooks{
+		name:   name,
+		secret: newSecretKey([]byte(secret)),
+		types:  t,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, url := range urls {
+		q := &webhookQueue{url, make(chan webhookPost, webhookQueueSize)}
+		h.queues = append(h.queues, q)
+		go h.run(q)
+	}
+	return h, nil
+}
+
+func newPageHooks(urls []string, secret string, types []string) (*Webhooks, error) {
+	return newWebhooks("page_hook", urls, secret, types, []string{pageCreated, pagePatched, pageDeleted})
+}
+
+// wants returns true if events of a type are posted. Safe to call on nil hooks.
+func (h *Webhooks) wants(kind string) bool {
+	return h != nil && (len(h.types) == 0 || h.types[kind])
+}
+
+// fire queues an event for each URL. Safe to call on nil hooks.
+func (h *Webhooks) fire(e WebhookEvent) {
+	if !h.wants(e.kind()) {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		echoError(Log{"t": h.name + "_marshal", "error": err.Error()})
+		return
+	}
+	for _, q := range h.queues {
+		select {
+		case q.events <- webhookPost{e.kind(), body}:
+		default:
+			h.drop()
+		}
+	}
+}
+
+// firePage queues a page event. Safe to call on nil hooks.
+func (h *Webhooks) firePage(kind, route, actor string) {
+	if h.wants(kind) {
+		h.fire(PageEvent{time.Now().UTC(), kind, route, actor})
+	}
+}
+
+// drop counts an event dropped for a full queue, logging the count at most once per webhookDropLogInterval.
+func (h *Webhooks) drop() {
+	atomic.AddUint64(&h.dropped, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&h.loggedAt)
+	if now-last < int64(webhookDropLogInterval) || !atomic.CompareAndSwapInt64(&h.loggedAt, last, now) {
+		return
+	}
+	n := atomic.SwapUint64(&h.dropped, 0)
+	echoError(Log{"t": h.name, "dropped": strconv.FormatUint(n, 10), "error": "webhook queue full; events dropped"})
+}
+
+// setSecret replaces the secret used to sign requests, e.g. when it is rotated. Safe to call on nil hooks.
+func (h *Webhooks) setSecret(secret string) {
+	if h == nil {
+		return
+	}
+	h.secret.set([]byte(secret))
+}
+
+func (h *Webhooks) run(q *webhookQueue) {
+	for p := range q.events {
+		if err := h.post(q.url, p.kind, p.body); err != nil {
+			echoError(Log{"t": h.name, "url": q.url, "type": p.kind, "error": err.Error()})
+		}
+	}
+}
+
+func (h *Webhooks) post(url, kind string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	req.Header.Set(pageHookEventHeader, kind)
+	if secret := h.secret.get(); len(secret) > 0 {
+		req.Header.Set(pageHookSignatureHeader, "sha256="+signPageEvent(secret, body))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook request failed: %s", http.StatusText(resp.StatusCode))
+	}
+	return nil
+}
+
+func signPageEvent(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"sync"
+)
+
+const pageMapShards = 64 // must be a power of 2
+
+// PageMap represents a concurrent url => page map, sharded by url to reduce lock contention
+// between unrelated routes.
+type PageMap struct {
+	shards [pageMapShards]pageMapShard
+}
+
+type pageMapShard struct {
+	sync.RWMutex
+	pages map[string]*Page
+}
+
+func newPageMap() *PageMap {
+	m := &PageMap{}
+	for i := range m.shards {
+		m.shards[i].pages = make(map[string]*Page)
+	}
+	return m
+}
+
+// shard returns the shard for a url, using FNV-1a.
+func (m *PageMap) shard(url string) *pageMapShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(url); i++ {
+		h ^= uint32(url[i])
+		h *= 16777619
+	}
+	return &m.shards[h&(pageMapShards-1)]
+}
+
+func (m *PageMap) get(url string) (*Page, bool) {
+	s := m.shard(url)
+	s.RLock()
+	p, ok := s.pages[url]
+	s.RUnlock()
+	return p, ok
+}
+
+// has returns true if p is the page at url.
+func (m *PageMap) has(url string, p *Page) bool {
+	q, ok := m.get(url)
+	return ok && q == p
+}
+
+// mint returns the page at url, else adds and returns a new page.
+func (m *PageMap) mint(url string) *Page {
+	if p, ok := m.get(url); ok {
+		return p
+	}
+	s := m.shard(url)
+	s.Lock()
+	defer s.Unlock()
+	if p, ok := s.pages[url]; ok { // added since lookup
+		return p
+	}
+	p := newPage()
+	s.pages[url] = p
+	return p
+}
+
+func (m *PageMap) set(url string, p *Page) {
+	s := m.shard(url)
+	s.Lock()
+	s.pages[url] = p
+	s.Unlock()
+}
+
+func (m *PageMap) del(url string) {
+	s := m.shard(url)
+	s.Lock()
+	delete(s.pages, url)
+	s.Unlock()
+}
+
+// each calls f for each page in the map; f must neither modify the map nor lock pages.
+func (m *PageMap) each(f func(url string, p *Page)) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		for url, p := range s.pages {
+			f(url, p)
+		}
+		s.RUnlock()
+	}
+}
+
+func (m *PageMap) len() int {
+	n := 0
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		n += len(s.pages)
+		s.RUnlock()
+	}
+	return n
+}
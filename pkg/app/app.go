@@ -0,0 +1,373 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package app lets Go programs serve Wave apps.
+//
+// An app handles queries (user events) forwarded by the Wave server for one or more routes, and responds by
+// updating pages on the server:
+//
+//	a := app.New(app.ConfigFromEnv())
+//	a.Handle("/hello", func(q *app.Query) {
+//		q.Page.Put("example", client.Card{"view": "markdown", "box": "1 1 2 2", "content": "Hello!"})
+//		q.Page.Patch(q.Context())
+//	})
+//	a.Run(ctx)
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/client"
+)
+
+// Modes an app can run in, which determine where the app's pages live (see Query.Page).
+const (
+	Unicast   = "unicast"   // a page per browser tab
+	Multicast = "multicast" // a page per user
+	Broadcast = "broadcast" // a page per route, shared by all users
+)
+
+const unixAddressPrefix = "unix://"
+
+var errNoHandlers = errors.New("app has no handlers")
+
+// Handler processes a query. Handlers run concurrently, each in its own goroutine.
+type Handler func(q *Query)
+
+// Config represents the configuration of an app.
+type Config struct {
+	ServerAddress      string        // Wave server address, e.g. "http://127.0.0.1:10101"
+	BaseURL            string        // Wave server base URL, e.g. "/"
+	AccessKeyID        string        // access key ID for the Wave server
+	AccessKeySecret    string        // access key secret for the Wave server
+	AppToken           string        // app token to register with, if any, instead of the access key
+	AppAccessKeyID     string        // access key ID the Wave server sends with queries; random if empty
+	AppAccessKeySecret string        // access key secret the Wave server sends with queries; random if empty
+	Address            string        // address to listen on, e.g. "http://127.0.0.1:8000" or "unix:///tmp/app.sock"
+	ExternalAddress    string        // address the Wave server reaches the app at; defaults to Address
+	Mode               string        // Unicast (default), Multicast or Broadcast
+	ConnectionTimeout  time.Duration // how long to retry registering while the Wave server is unreachable
+}
+
+// ConfigFromEnv returns the configuration set by the H2O_WAVE_* environment variables, the same ones
+// used by Python apps.
+func ConfigFromEnv() Config {
+	internal := env("INTERNAL_ADDRESS", "http://127.0.0.1:8000")
+	timeout, _ := strconv.Atoi(env("CONNECTION_TIMEOUT", "0"))
+	return Config{
+		ServerAddress:      env("ADDRESS", "http://127.0.0.1:10101"),
+		BaseURL:            env("BASE_URL", "/"),
+		AccessKeyID:        env("ACCESS_KEY_ID", "access_key_id"),
+		AccessKeySecret:    env("ACCESS_KEY_SECRET", "access_key_secret"),
+		AppToken:           env("APP_TOKEN", ""),
+		AppAccessKeyID:     env("APP_ACCESS_KEY_ID", ""),
+		AppAccessKeySecret: env("APP_ACCESS_KEY_SECRET", ""),
+		Address:            internal,
+		ExternalAddress:    env("APP_ADDRESS", env("EXTERNAL_ADDRESS", internal)),
+		Mode:               env("APP_MODE", Unicast),
+		ConnectionTimeout:  time.Duration(timeout) * time.Second,
+	}
+}
+
+func env(key, value string) string {
+	if v, ok := os.LookupEnv("H2O_WAVE_" + key); ok {
+		return v
+	}
+	return value
+}
+
+// App represents a Wave app, serving one or more routes.
+type App struct {
+	conf      Config
+	keyID     string // credentials the Wave server sends with queries
+	keySecret string
+	client    *http.Client
+	site      *client.Site
+	mu        sync.RWMutex
+	routes    []string           // in order of registration
+	handlers  map[string]Handler // route => handler
+}
+
+// New creates an app.
+func New(conf Config) *App {
+	if len(conf.Mode) == 0 {
+		conf.Mode = Unicast
+	}
+	if len(conf.BaseURL) == 0 {
+		conf.BaseURL = "/"
+	}
+	if len(conf.ExternalAddress) == 0 {
+		conf.ExternalAddress = conf.Address
+	}
+	if len(conf.AppAccessKeyID) == 0 {
+		conf.AppAccessKeyID = randomKey()
+	}
+	if len(conf.AppAccessKeySecret) == 0 {
+		conf.AppAccessKeySecret = randomKey()
+	}
+	return &App{
+		conf:      conf,
+		keyID:     conf.AppAccessKeyID,
+		keySecret: conf.AppAccessKeySecret,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		site:      client.NewSite(client.Config{Address: conf.ServerAddress, BaseURL: conf.BaseURL, AccessKeyID: conf.AccessKeyID, AccessKeySecret: conf.AccessKeySecret}),
+		handlers:  make(map[string]Handler),
+	}
+}
+
+func randomKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("failed generating app access key: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// Handle registers the handler for route. The first route handled is the app's main route; the rest are
+// registered as its additional routes. Routes must be handled before Run.
+func (a *App) Handle(route string, h Handler) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.handlers[route]; !ok {
+		a.routes = append(a.routes, route)
+	}
+	a.handlers[route] = h
+}
+
+// Site returns the Wave server's site, to read and write pages outside of queries.
+func (a *App) Site() *client.Site {
+	return a.site
+}
+
+// Run serves the app, and registers it with the Wave server. When ctx is done, it unregisters the app
+// and stops serving.
+func (a *App) Run(ctx context.Context) error {
+	a.mu.RLock()
+	n := len(a.routes)
+	a.mu.RUnlock()
+	if n == 0 {
+		return errNoHandlers
+	}
+
+	ln, err := listen(a.conf.Address)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: a}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	if err := a.register(ctx); err != nil {
+		srv.Close()
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+	case err := <-served:
+		return err
+	}
+
+	unregisterCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = a.unregister(unregisterCtx)
+	srv.Shutdown(unregisterCtx)
+	return err
+}
+
+func listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, unixAddressPrefix) {
+		path := strings.TrimPrefix(address, unixAddressPrefix)
+		os.Remove(path) // stale socket from an earlier run, if any
+		return net.Listen("unix", path)
+	}
+	u, err := url.Parse(address)
+	if err != nil || len(u.Host) == 0 {
+		return nil, fmt.Errorf("bad app address: %s", address)
+	}
+	return net.Listen("tcp", u.Host)
+}
+
+// register registers the app with the Wave server, retrying for up to the connection timeout
+// while the server is unreachable.
+func (a *App) register(ctx context.Context) error {
+	a.mu.RLock()
+	q := map[string]interface{}{
+		"mode":       a.conf.Mode,
+		"route":      a.routes[0],
+		"address":    a.conf.ExternalAddress,
+		"key_id":     a.keyID,
+		"key_secret": a.keySecret,
+	}
+	if len(a.routes) > 1 {
+		q["routes"] = a.routes[1:]
+	}
+	a.mu.RUnlock()
+
+	deadline := time.Now().Add(a.conf.ConnectionTimeout)
+	for {
+		err := a.call(ctx, "register_app", q)
+		if _, unreachable := err.(*url.Error); !unreachable || time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (a *App) unregister(ctx context.Context) error {
+	a.mu.RLock()
+	route := a.routes[0]
+	a.mu.RUnlock()
+	return a.call(ctx, "unregister_app", map[string]interface{}{"route": route, "address": a.conf.ExternalAddress})
+}
+
+// SetMode changes the app's mode, without re-registering it.
+func (a *App) SetMode(ctx context.Context, mode string) error {
+	a.mu.Lock()
+	a.conf.Mode = mode
+	route := a.routes[0]
+	a.mu.Unlock()
+	return a.call(ctx, "set_app_mode", map[string]interface{}{"route": route, "mode": mode})
+}
+
+func (a *App) mode() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.conf.Mode
+}
+
+// call sends a request to the Wave server's app API.
+func (a *App) call(ctx context.Context, method string, args interface{}) error {
+	b, err := json.Marshal(map[string]interface{}{method: args})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.site.URL(""), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if len(a.conf.AppToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+a.conf.AppToken)
+	} else {
+		req.SetBasicAuth(a.conf.AccessKeyID, a.conf.AccessKeySecret)
+	}
+	return a.do(req)
+}
+
+// do sends a request to the Wave server.
+func (a *App) do(req *http.Request) error {
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if msg := strings.TrimSpace(string(b)); len(msg) > 0 {
+			return fmt.Errorf("request failed (%d): %s", resp.StatusCode, msg)
+		}
+		return fmt.Errorf("request failed (%d)", resp.StatusCode)
+	}
+	return nil
+}
+
+// ServeHTTP accepts queries forwarded by the Wave server, and processes them in the background.
+func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	q, err := a.parse(r.Header, b)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	a.mu.RLock()
+	h, ok := a.handlers[q.Route]
+	if !ok && len(a.routes) > 0 && len(q.Route) == 0 { // servers predating Wave-Route
+		q.Route = a.routes[0]
+		h, ok = a.handlers[q.Route]
+	}
+	a.mu.RUnlock()
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if route := q.pageRoute(a.mode()); len(route) > 0 {
+		q.Page = a.site.Page(route)
+	}
+	w.WriteHeader(http.StatusOK)
+	go h(q)
+}
+
+// authorized returns true if the request carries the credentials the app registered with.
+func (a *App) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if len(a.conf.AppToken) > 0 {
+		return len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") && equal(strings.TrimSpace(auth[7:]), a.conf.AppToken)
+	}
+	if len(auth) <= 6 || !strings.EqualFold(auth[:6], "Basic ") {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[6:])
+	if err != nil {
+		return false
+	}
+	id, secret := string(b), ""
+	if i := strings.IndexByte(id, ':'); i >= 0 {
+		id, secret = id[:i], id[i+1:]
+	}
+	return equal(id, a.keyID) && equal(secret, a.keySecret)
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
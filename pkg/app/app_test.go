@@ -0,0 +1,159 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/client"
+)
+
+// fakeServer records requests made to a Wave server.
+type fakeServer struct {
+	sync.Mutex
+	requests []string // "METHOD path body"
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	s.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path+" "+string(b))
+	s.Unlock()
+	if r.Method == http.MethodGet {
+		w.Write([]byte(`{"p":{"c":{"example":{"d":{"view":"markdown"}}}}}`))
+	}
+}
+
+func (s *fakeServer) calls() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func TestApp(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+
+	fake := &fakeServer{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	a := New(Config{ServerAddress: srv.URL, AccessKeyID: "id", AccessKeySecret: "secret"})
+	done := make(chan *Query, 1)
+	a.Handle("/demo", func(q *Query) {
+		q.Page.Put("example", client.Card{"view": "markdown", "content": q.String("name")})
+		q.Page.Set("example title", "Hello")
+		no(q.Page.Patch(q.Context()))
+		done <- q
+	})
+
+	post := func(auth, route, body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("Authorization", auth)
+		r.Header.Set("Wave-Route", route)
+		r.Header.Set("Wave-Client-ID", "c1")
+		r.Header.Set("Wave-Subject-ID", "u1")
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		return w.Code
+	}
+	basic := func(id, secret string) string {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth(id, secret)
+		return r.Header.Get("Authorization")
+	}
+
+	eq(http.StatusUnauthorized, post("", "/demo", `{}`))
+	eq(http.StatusUnauthorized, post(basic(a.keyID, "nope"), "/demo", `{}`))
+	eq(http.StatusNotFound, post(basic(a.keyID, a.keySecret), "/nope", `{}`))
+	eq(http.StatusBadRequest, post(basic(a.keyID, a.keySecret), "/demo", `[`))
+	eq(http.StatusOK, post(basic(a.keyID, a.keySecret), "/demo", `{"name":"Wave","":{"@system":{"timer":{"name":"t"}}}}`))
+
+	q := <-done
+	eq("/demo", q.Route)
+	eq("c1", q.ClientID)
+	eq("u1", q.Auth.Subject)
+	eq("/c1", q.Page.Route())
+	ok(q.Has("name"))
+	ok(!q.Has(""))
+	var timer struct{ Name string }
+	ok(q.Event("@system", "timer", &timer))
+	eq("t", timer.Name)
+	ok(!q.Event("@system", "nope", &timer))
+
+	calls := fake.calls()
+	eq(1, len(calls))
+	eq(`PATCH /c1 {"d":[{"k":"example","d":{"content":"Wave","view":"markdown"}},{"k":"example title","v":"Hello"}]}`, calls[0])
+
+	page := a.Site().Page("/c1")
+	no(page.Load(context.Background()))
+	eq("markdown", page.Card("example")["view"])
+}
+
+func TestPageRoute(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	q := &Query{Route: "/demo", ClientID: "c1", Auth: Auth{Subject: "u1"}}
+	eq("/c1", q.pageRoute(Unicast))
+	eq("/u1", q.pageRoute(Multicast))
+	eq("/demo", q.pageRoute(Broadcast))
+	eq("", (&Query{Route: "/demo"}).pageRoute(Unicast))
+}
+
+func TestRun(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+
+	fake := &fakeServer{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	a := New(Config{ServerAddress: srv.URL, BaseURL: "/wave/", Address: "http://127.0.0.1:0", ExternalAddress: "http://app:8000"})
+	eq(errNoHandlers, a.Run(context.Background()))
+
+	a.Handle("/a", func(q *Query) {})
+	a.Handle("/b", func(q *Query) {})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { // unregister as soon as registered
+		for len(fake.calls()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	no(a.Run(ctx))
+
+	calls := fake.calls()
+	eq(2, len(calls))
+	var reg struct {
+		RegisterApp struct {
+			Mode    string   `json:"mode"`
+			Route   string   `json:"route"`
+			Routes  []string `json:"routes"`
+			Address string   `json:"address"`
+		} `json:"register_app"`
+	}
+	no(json.Unmarshal([]byte(strings.TrimPrefix(calls[0], "POST /wave/ ")), &reg))
+	eq(Unicast, reg.RegisterApp.Mode)
+	eq("/a", reg.RegisterApp.Route)
+	eq([]string{"/b"}, reg.RegisterApp.Routes)
+	eq("http://app:8000", reg.RegisterApp.Address)
+	eq(`POST /wave/ {"unregister_app":{"address":"http://app:8000","route":"/a"}}`, calls[1])
+}
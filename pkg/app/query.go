@@ -0,0 +1,131 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/h2oai/wave/pkg/client"
+)
+
+// Auth represents the user who made a query.
+type Auth struct {
+	Subject      string // OIDC subject ID; unique per user
+	Username     string // OIDC preferred username
+	AccessToken  string // OIDC access token, if logged in
+	RefreshToken string // OIDC refresh token, if logged in
+	SessionID    string
+}
+
+// Query represents a query forwarded by the Wave server, e.g. a user clicking a button.
+type Query struct {
+	Route    string                                // route the query was made on
+	ClientID string                                // browser tab; empty for requests not made by a browser tab
+	Auth     Auth                                  // user
+	Args     map[string]json.RawMessage            // arguments, e.g. "button_name" => true
+	Events   map[string]map[string]json.RawMessage // events, by source and event name, e.g. "@system" => "timer" => {...}
+	Page     *client.Page                          // page for the app's mode: the tab's, the user's, or the route's; nil if none
+	ctx      context.Context
+}
+
+func (a *App) parse(h http.Header, body []byte) (*Query, error) {
+	var args map[string]json.RawMessage
+	if err := json.Unmarshal(body, &args); err != nil {
+		return nil, err
+	}
+	q := &Query{
+		Route:    h.Get("Wave-Route"),
+		ClientID: h.Get("Wave-Client-ID"),
+		Auth: Auth{
+			h.Get("Wave-Subject-ID"),
+			h.Get("Wave-Username"),
+			h.Get("Wave-Access-Token"),
+			h.Get("Wave-Refresh-Token"),
+			h.Get("Wave-Session-ID"),
+		},
+		Args: args,
+		ctx:  context.Background(),
+	}
+	if events, ok := args[""]; ok {
+		if err := json.Unmarshal(events, &q.Events); err != nil {
+			return nil, err
+		}
+		delete(args, "")
+	}
+	return q, nil
+}
+
+// pageRoute returns the route of the page to update in reply to the query.
+func (q *Query) pageRoute(mode string) string {
+	id := q.ClientID
+	switch mode {
+	case Broadcast:
+		return q.Route
+	case Multicast:
+		id = q.Auth.Subject
+	}
+	if len(id) == 0 {
+		return ""
+	}
+	return "/" + id
+}
+
+// Context returns the query's context.
+func (q *Query) Context() context.Context {
+	return q.ctx
+}
+
+// Has returns true if the query has the named argument.
+func (q *Query) Has(name string) bool {
+	_, ok := q.Args[name]
+	return ok
+}
+
+// Arg decodes the named argument into v, returning false if the query has no such argument,
+// or it cannot be decoded into v.
+func (q *Query) Arg(name string, v interface{}) bool {
+	b, ok := q.Args[name]
+	return ok && json.Unmarshal(b, v) == nil
+}
+
+// String returns the named argument if it is a string, else "".
+func (q *Query) String(name string) string {
+	var s string
+	q.Arg(name, &s)
+	return s
+}
+
+// Bool returns the named argument if it is a boolean, else false.
+func (q *Query) Bool(name string) bool {
+	var b bool
+	q.Arg(name, &b)
+	return b
+}
+
+// Float returns the named argument if it is a number, else 0.
+func (q *Query) Float(name string) float64 {
+	var f float64
+	q.Arg(name, &f)
+	return f
+}
+
+// Event decodes the value of the named event from source into v, returning false if the query has no such event,
+// or its value cannot be decoded into v.
+func (q *Query) Event(source, name string, v interface{}) bool {
+	b, ok := q.Events[source][name]
+	return ok && json.Unmarshal(b, v) == nil
+}
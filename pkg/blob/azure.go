@@ -0,0 +1,330 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	azureVersion    = "2019-12-12"
+	azureMaxPutSize = 5000 << 20 // largest blob written in a single request
+	azureBlockSize  = 512 << 20  // size of each block of larger blobs
+)
+
+// Azure represents a container in Azure Blob Storage, accessed with the storage account's shared key.
+type Azure struct {
+	endpoint  *url.URL
+	account   string
+	container string
+	prefix    string
+	key       []byte
+	now       func() time.Time // for tests
+}
+
+// NewAzure creates an Azure Blob Storage store. key is the base64-encoded storage account key.
+func NewAzure(endpoint, account, container, prefix, key string) (*Azure, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || len(u.Host) == 0 {
+		return nil, fmt.Errorf("blob: invalid endpoint %q", endpoint)
+	}
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(k) == 0 {
+		return nil, fmt.Errorf("blob: missing or invalid account key for %s", account)
+	}
+	return &Azure{u, account, container, prefix, k, time.Now}, nil
+}
+
+// url returns the URL of the blob at key (relative to the store's prefix), or of the container if key is empty.
+func (s *Azure) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.RawPath = "/" + escape(s.container)
+	if len(key) > 0 {
+		u.RawPath += "/" + escapePath(s.prefix+key)
+	}
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+func (s *Azure) do(ctx context.Context, method string, u *url.URL, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, s.now())
+	return client.Do(req)
+}
+
+func (s *Azure) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if size > azureMaxPutSize {
+		return s.putBlocks(ctx, key, r, size, contentType)
+	}
+	h := http.Header{"X-Ms-Blob-Type": {"BlockBlob"}}
+	if len(contentType) > 0 {
+		h.Set("X-Ms-Blob-Content-Type", contentType)
+	}
+	res, err := s.do(ctx, http.MethodPut, s.url(key, nil), r, size, h)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusCreated {
+		return readError(res)
+	}
+	res.Body.Close()
+	return nil
+}
+
+type azureBlockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string `xml:"Latest"`
+}
+
+// putBlocks writes a large blob in blocks.
+func (s *Azure) putBlocks(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	var list azureBlockList
+	for n, left := 0, size; left > 0; n++ {
+		block := int64(azureBlockSize)
+		if left < block {
+			block = left
+		}
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", n)))
+		q := url.Values{"comp": {"block"}, "blockid": {id}}
+		res, err := s.do(ctx, http.MethodPut, s.url(key, q), io.LimitReader(r, block), block, nil)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusCreated {
+			return readError(res)
+		}
+		res.Body.Close()
+		list.Latest = append(list.Latest, id)
+		left -= block
+	}
+	b, err := xml.Marshal(list)
+	if err != nil {
+		return err
+	}
+	h := http.Header{}
+	if len(contentType) > 0 {
+		h.Set("X-Ms-Blob-Content-Type", contentType)
+	}
+	res, err := s.do(ctx, http.MethodPut, s.url(key, url.Values{"comp": {"blocklist"}}), strings.NewReader(string(b)), int64(len(b)), h)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusCreated {
+		return readError(res)
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *Azure) Get(ctx context.Context, key string, header http.Header) (*http.Response, error) {
+	res, err := s.do(ctx, http.MethodGet, s.url(key, nil), nil, 0, header)
+	if err != nil {
+		return nil, err
+	}
+	if isFailed(res) {
+		return nil, readError(res)
+	}
+	return res, nil
+}
+
+func (s *Azure) Head(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodHead, s.url(key, nil), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	if isFailed(res) {
+		return readError(res)
+	}
+	res.Body.Close()
+	return nil
+}
+
+type azureList struct {
+	Blobs []struct {
+		Name string `xml:"Name"`
+	} `xml:"Blobs>Blob"`
+	Prefixes []struct {
+		Name string `xml:"Name"`
+	} `xml:"Blobs>BlobPrefix"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (s *Azure) list(ctx context.Context, q url.Values) (*azureList, error) {
+	res, err := s.do(ctx, http.MethodGet, s.url("", q), nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, readError(res)
+	}
+	defer res.Body.Close()
+	var list azureList
+	if err := xml.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("blob: bad list reply: %v", err)
+	}
+	return &list, nil
+}
+
+func (s *Azure) List(ctx context.Context, prefix string) ([]string, error) {
+	q := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {s.prefix + prefix}, "delimiter": {"/"}}
+	var keys []string
+	for {
+		list, err := s.list(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range list.Blobs {
+			keys = append(keys, strings.TrimPrefix(b.Name, s.prefix))
+		}
+		for _, p := range list.Prefixes {
+			keys = append(keys, strings.TrimPrefix(p.Name, s.prefix))
+		}
+		if len(list.NextMarker) == 0 {
+			return keys, nil
+		}
+		q.Set("marker", list.NextMarker)
+	}
+}
+
+func (s *Azure) Delete(ctx context.Context, prefix string) error {
+	q := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {s.prefix + prefix}}
+	for {
+		list, err := s.list(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, b := range list.Blobs {
+			res, err := s.do(ctx, http.MethodDelete, s.url(strings.TrimPrefix(b.Name, s.prefix), nil), nil, 0, nil)
+			if err != nil {
+				return err
+			}
+			if res.StatusCode != http.StatusAccepted {
+				return readError(res)
+			}
+			res.Body.Close()
+		}
+		if len(list.NextMarker) == 0 {
+			return nil
+		}
+		q.Set("marker", list.NextMarker)
+	}
+}
+
+// SignedURL returns a URL with a read-only service shared access signature (SAS),
+// per https://docs.microsoft.com/en-us/rest/api/storageservices/create-service-sas
+func (s *Azure) SignedURL(key string, expiry time.Duration) (string, error) {
+	u := s.url(key, nil)
+	se := s.now().UTC().Add(expiry).Format("2006-01-02T15:04:05Z")
+	resource := "/blob/" + s.account + u.Path
+	toSign := strings.Join([]string{
+		"r",                // signedPermissions
+		"",                 // signedStart
+		se,                 // signedExpiry
+		resource,           // canonicalizedResource
+		"",                 // signedIdentifier
+		"",                 // signedIP
+		"https",            // signedProtocol
+		azureVersion,       // signedVersion
+		"b",                // signedResource
+		"",                 // signedSnapshotTime
+		"", "", "", "", "", // rscc, rscd, rsce, rscl, rsct
+	}, "\n")
+	q := url.Values{
+		"sv":  {azureVersion},
+		"sr":  {"b"},
+		"sp":  {"r"},
+		"se":  {se},
+		"spr": {"https"},
+		"sig": {base64.StdEncoding.EncodeToString(hmacSHA256(s.key, toSign))},
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// sign signs a request with the shared key,
+// per https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (s *Azure) sign(req *http.Request, t time.Time) {
+	req.Header.Set("X-Ms-Date", t.UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureVersion)
+
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	h := req.Header
+	lines := []string{
+		req.Method,
+		h.Get("Content-Encoding"),
+		h.Get("Content-Language"),
+		length,
+		h.Get("Content-MD5"),
+		h.Get("Content-Type"),
+		"", // Date; x-ms-date is used instead
+		h.Get("If-Modified-Since"),
+		h.Get("If-Match"),
+		h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"),
+		h.Get("Range"),
+	}
+
+	var names []string
+	for k := range h {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		lines = append(lines, k+":"+strings.TrimSpace(h.Get(k)))
+	}
+
+	resource := "/" + s.account + req.URL.EscapedPath()
+	q := req.URL.Query()
+	params := make([]string, 0, len(q))
+	for k := range q {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		vs := append([]string{}, q[k]...)
+		sort.Strings(vs)
+		resource += "\n" + strings.ToLower(k) + ":" + strings.Join(vs, ",")
+	}
+	lines = append(lines, resource)
+
+	sig := base64.StdEncoding.EncodeToString(hmacSHA256(s.key, strings.Join(lines, "\n")))
+	req.Header.Set("Authorization", "SharedKey "+s.account+":"+sig)
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package blob implements minimal clients for object storage services: Amazon S3 and compatible services
+// (e.g. MinIO), Google Cloud Storage (via its S3-compatible API), and Azure Blob Storage, sufficient for
+// storing and serving files uploaded to Wave.
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when an object does not exist.
+var ErrNotFound = errors.New("blob: not found")
+
+// Store represents a bucket (or container) of objects, optionally scoped to a key prefix.
+type Store interface {
+	// Put writes an object of the given size, replacing any existing object.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get reads an object. The request headers, if any, are passed on, e.g. Range or If-None-Match.
+	// The caller must close the response body. Returns ErrNotFound if there is no such object. Unmet preconditions
+	// and unsatisfiable ranges are not errors: the response carries the status, e.g. 304, 412 or 416.
+	Get(ctx context.Context, key string, header http.Header) (*http.Response, error)
+	// Head checks that an object exists, without reading it. Returns ErrNotFound if there is no such object.
+	Head(ctx context.Context, key string) error
+	// List returns the keys of objects directly under prefix, and the prefixes (ending with "/") of objects further
+	// below, as if keys were slash-separated paths.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete deletes all objects whose keys start with prefix.
+	Delete(ctx context.Context, prefix string) error
+	// SignedURL returns a URL that grants read access to an object until it expires.
+	SignedURL(key string, expiry time.Duration) (string, error)
+}
+
+// Open opens a store from a URL, one of:
+//
+//	s3://bucket[/prefix][?region=us-east-1][&endpoint=https://host:port]
+//	gs://bucket[/prefix]
+//	azblob://account/container[/prefix]
+//
+// Credentials are read from the environment: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN (s3);
+// GCS_HMAC_ACCESS_KEY_ID and GCS_HMAC_SECRET (gs); AZURE_STORAGE_KEY (azblob).
+func Open(s string) (Store, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("blob: invalid store URL: %v", err)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	switch u.Scheme {
+	case "s3":
+		region := u.Query().Get("region")
+		if len(region) == 0 {
+			region = os.Getenv("AWS_REGION")
+		}
+		if len(region) == 0 {
+			region = "us-east-1"
+		}
+		creds := Credentials{os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")}
+		if endpoint := u.Query().Get("endpoint"); len(endpoint) > 0 {
+			return NewS3(endpoint, u.Host, prefix, region, creds, true)
+		}
+		return NewS3("https://s3."+region+".amazonaws.com", u.Host, prefix, region, creds, false)
+	case "gs":
+		creds := Credentials{os.Getenv("GCS_HMAC_ACCESS_KEY_ID"), os.Getenv("GCS_HMAC_SECRET"), ""}
+		return NewS3("https://storage.googleapis.com", u.Host, prefix, "auto", creds, true)
+	case "azblob":
+		parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+		if len(parts[0]) == 0 {
+			return nil, errors.New("blob: want azblob://account/container[/prefix]")
+		}
+		prefix = ""
+		if len(parts) == 2 && len(parts[1]) > 0 {
+			prefix = strings.Trim(parts[1], "/") + "/"
+		}
+		return NewAzure("https://"+u.Host+".blob.core.windows.net", u.Host, parts[0], prefix, os.Getenv("AZURE_STORAGE_KEY"))
+	}
+	return nil, fmt.Errorf("blob: unsupported store %q: want s3, gs or azblob", u.Scheme)
+}
+
+var client = &http.Client{Timeout: 0} // large objects; requests are bounded by their contexts
+
+// isFailed returns true if a read failed, other than via an unmet precondition or an unsatisfiable range.
+func isFailed(res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusPreconditionFailed, http.StatusRequestedRangeNotSatisfiable:
+		return false
+	}
+	return res.StatusCode >= 400
+}
+
+// readError returns an error describing a failed response, and closes its body.
+func readError(res *http.Response) error {
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("blob: %s: %s", res.Status, strings.TrimSpace(string(b)))
+}
+
+// escapePath percent-encodes an object key, preserving slashes.
+func escapePath(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = escape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// escape percent-encodes all but unreserved characters, per RFC 3986.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
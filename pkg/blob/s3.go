@@ -0,0 +1,410 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blob
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	emptySHA256     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	s3MaxPutSize    = 5 << 30   // largest object written in a single request
+	s3PartSize      = 512 << 20 // size of each part of larger objects
+)
+
+// Credentials represents access keys for S3 or a compatible service.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // if using temporary credentials
+}
+
+// S3 represents a bucket in Amazon S3 or a compatible service, accessed with AWS Signature Version 4.
+type S3 struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	creds     Credentials
+	pathStyle bool             // bucket in path (endpoint/bucket/key) instead of host (bucket.endpoint/key)?
+	now       func() time.Time // for tests
+}
+
+// NewS3 creates an S3 store.
+func NewS3(endpoint, bucket, prefix, region string, creds Credentials, pathStyle bool) (*S3, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || len(u.Host) == 0 {
+		return nil, fmt.Errorf("blob: invalid endpoint %q", endpoint)
+	}
+	if len(bucket) == 0 {
+		return nil, fmt.Errorf("blob: missing bucket")
+	}
+	if len(creds.AccessKeyID) == 0 || len(creds.SecretAccessKey) == 0 {
+		return nil, fmt.Errorf("blob: missing access keys for bucket %s", bucket)
+	}
+	return &S3{u, bucket, prefix, region, creds, pathStyle, time.Now}, nil
+}
+
+// url returns the URL of the object at key (relative to the store's prefix), or of the bucket if key is empty.
+func (s *S3) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	p := "/" + escapePath(key)
+	if len(key) > 0 {
+		p = "/" + escapePath(s.prefix+key)
+	}
+	if s.pathStyle {
+		u.RawPath = "/" + escape(s.bucket) + p
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.RawPath = p
+	}
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func (s *S3) do(ctx context.Context, method string, u *url.URL, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	payload := emptySHA256
+	if body != nil {
+		req.ContentLength = size
+		payload = unsignedPayload
+	}
+	s.sign(req, payload, s.now())
+	return client.Do(req)
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if size > s3MaxPutSize {
+		return s.putParts(ctx, key, r, size, contentType)
+	}
+	h := http.Header{}
+	if len(contentType) > 0 {
+		h.Set("Content-Type", contentType)
+	}
+	res, err := s.do(ctx, http.MethodPut, s.url(key, nil), r, size, h)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return readError(res)
+	}
+	res.Body.Close()
+	return nil
+}
+
+type s3Upload struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+// putParts writes a large object using a multipart upload.
+func (s *S3) putParts(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	h := http.Header{}
+	if len(contentType) > 0 {
+		h.Set("Content-Type", contentType)
+	}
+	res, err := s.do(ctx, http.MethodPost, s.url(key, url.Values{"uploads": {""}}), nil, 0, h)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return readError(res)
+	}
+	var upload s3Upload
+	err = xml.NewDecoder(res.Body).Decode(&upload)
+	res.Body.Close()
+	if err != nil {
+		return fmt.Errorf("blob: bad multipart upload reply: %v", err)
+	}
+
+	abort := func(err error) error {
+		if res, aerr := s.do(context.Background(), http.MethodDelete, s.url(key, url.Values{"uploadId": {upload.UploadID}}), nil, 0, nil); aerr == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	var done s3CompleteUpload
+	for n, left := 1, size; left > 0; n++ {
+		part := int64(s3PartSize)
+		if left < part {
+			part = left
+		}
+		q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {upload.UploadID}}
+		res, err := s.do(ctx, http.MethodPut, s.url(key, q), io.LimitReader(r, part), part, nil)
+		if err != nil {
+			return abort(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			return abort(readError(res))
+		}
+		res.Body.Close()
+		done.Parts = append(done.Parts, s3Part{n, res.Header.Get("ETag")})
+		left -= part
+	}
+
+	b, err := xml.Marshal(done)
+	if err != nil {
+		return abort(err)
+	}
+	q := url.Values{"uploadId": {upload.UploadID}}
+	res, err = s.do(ctx, http.MethodPost, s.url(key, q), strings.NewReader(string(b)), int64(len(b)), nil)
+	if err != nil {
+		return abort(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return abort(readError(res))
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string, header http.Header) (*http.Response, error) {
+	res, err := s.do(ctx, http.MethodGet, s.url(key, nil), nil, 0, header)
+	if err != nil {
+		return nil, err
+	}
+	if isFailed(res) {
+		return nil, readError(res)
+	}
+	return res, nil
+}
+
+func (s *S3) Head(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodHead, s.url(key, nil), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	if isFailed(res) {
+		return readError(res)
+	}
+	res.Body.Close()
+	return nil
+}
+
+type s3List struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3) list(ctx context.Context, q url.Values) (*s3List, error) {
+	res, err := s.do(ctx, http.MethodGet, s.url("", q), nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, readError(res)
+	}
+	defer res.Body.Close()
+	var list s3List
+	if err := xml.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("blob: bad list reply: %v", err)
+	}
+	return &list, nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	q := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}, "delimiter": {"/"}}
+	var keys []string
+	for {
+		list, err := s.list(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range list.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, s.prefix))
+		}
+		for _, p := range list.CommonPrefixes {
+			keys = append(keys, strings.TrimPrefix(p.Prefix, s.prefix))
+		}
+		if !list.IsTruncated {
+			return keys, nil
+		}
+		q.Set("continuation-token", list.NextContinuationToken)
+	}
+}
+
+func (s *S3) Delete(ctx context.Context, prefix string) error {
+	q := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+	for {
+		list, err := s.list(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, c := range list.Contents {
+			res, err := s.do(ctx, http.MethodDelete, s.url(strings.TrimPrefix(c.Key, s.prefix), nil), nil, 0, nil)
+			if err != nil {
+				return err
+			}
+			if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+				return readError(res)
+			}
+			res.Body.Close()
+		}
+		if !list.IsTruncated {
+			return nil
+		}
+		q.Set("continuation-token", list.NextContinuationToken)
+	}
+}
+
+func (s *S3) SignedURL(key string, expiry time.Duration) (string, error) {
+	t := s.now().UTC()
+	u := s.url(key, nil)
+	q := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.creds.AccessKeyID + "/" + s.scope(t)},
+		"X-Amz-Date":          {t.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {strconv.Itoa(int(expiry / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if len(s.creds.SessionToken) > 0 {
+		q.Set("X-Amz-Security-Token", s.creds.SessionToken)
+	}
+	u.RawQuery = canonicalQuery(q)
+	req := canonicalRequest("GET", u, "host:"+u.Host+"\n", "host", unsignedPayload)
+	return u.String() + "&X-Amz-Signature=" + s.signature(t, req), nil
+}
+
+// sign signs a request, per https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3) sign(req *http.Request, payload string, t time.Time) {
+	signV4(req, payload, s.region, "s3", s.creds, t)
+}
+
+func (s *S3) scope(t time.Time) string {
+	return v4Scope(t, s.region, "s3")
+}
+
+func (s *S3) signature(t time.Time, canonicalRequest string) string {
+	return v4Signature(t, canonicalRequest, s.region, "s3", s.creds)
+}
+
+// SignV4 signs a request to an AWS service in a region with AWS Signature Version 4, given its body, e.g. for
+// services other than S3.
+func SignV4(req *http.Request, body []byte, region, service string, creds Credentials, t time.Time) {
+	h := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(h[:]), region, service, creds, t)
+}
+
+func signV4(req *http.Request, payload, region, service string, creds Credentials, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if len(creds.SessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "content-type" || k == "range" {
+			headers[k] = strings.TrimSpace(strings.Join(vs, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	creq := canonicalRequest(req.Method, req.URL, canonical.String(), signed, payload)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, v4Scope(t, region, service), signed, v4Signature(t, creq, region, service, creds)))
+}
+
+func v4Scope(t time.Time, region, service string) string {
+	return t.Format("20060102") + "/" + region + "/" + service + "/aws4_request"
+}
+
+func v4Signature(t time.Time, canonicalRequest, region, service string, creds Credentials) string {
+	h := sha256.Sum256([]byte(canonicalRequest))
+	toSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + v4Scope(t, region, service) + "\n" + hex.EncodeToString(h[:])
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), t.Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func canonicalRequest(method string, u *url.URL, headers, signed, payload string) string {
+	p := u.EscapedPath()
+	if len(p) == 0 {
+		p = "/"
+	}
+	return method + "\n" + p + "\n" + u.RawQuery + "\n" + headers + "\n" + signed + "\n" + payload
+}
+
+// canonicalQuery encodes query parameters sorted by name, with names and values percent-encoded per RFC 3986.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			params = append(params, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client reads and writes pages on a Wave server, e.g. to publish dashboards from batch jobs:
+//
+//	site := client.NewSite(client.ConfigFromEnv())
+//	page := site.Page("/dashboard")
+//	page.Put("sales", client.Card{"view": "markdown", "box": "1 1 2 2", "title": "Sales", "content": "Up 12%"})
+//	err := page.Save(ctx)
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config represents the Wave server to connect to.
+type Config struct {
+	Address         string // Wave server address, e.g. "http://127.0.0.1:10101"
+	BaseURL         string // Wave server base URL, e.g. "/"
+	AccessKeyID     string // API access key ID
+	AccessKeySecret string // API access key secret
+}
+
+// ConfigFromEnv returns the configuration set by the H2O_WAVE_* environment variables, the same ones
+// used by Python scripts.
+func ConfigFromEnv() Config {
+	return Config{
+		Address:         env("ADDRESS", "http://127.0.0.1:10101"),
+		BaseURL:         env("BASE_URL", "/"),
+		AccessKeyID:     env("ACCESS_KEY_ID", "access_key_id"),
+		AccessKeySecret: env("ACCESS_KEY_SECRET", "access_key_secret"),
+	}
+}
+
+func env(key, value string) string {
+	if v, ok := os.LookupEnv("H2O_WAVE_" + key); ok {
+		return v
+	}
+	return value
+}
+
+// Site represents the pages on a Wave server.
+type Site struct {
+	conf   Config
+	client *http.Client
+}
+
+// NewSite creates a client for the site served by a Wave server.
+func NewSite(conf Config) *Site {
+	return &Site{conf, &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Page returns the page at route. The page is empty until loaded.
+func (s *Site) Page(route string) *Page {
+	return &Page{site: s, route: route, cards: make(map[string]Card)}
+}
+
+// URL returns the Wave server URL for route.
+func (s *Site) URL(route string) string {
+	base := strings.Trim(s.conf.BaseURL, "/")
+	if len(base) > 0 {
+		base += "/"
+	}
+	return strings.TrimSuffix(s.conf.Address, "/") + "/" + base + strings.TrimPrefix(route, "/")
+}
+
+// request sends a request for route, authenticated with the site's access key, decoding the JSON response
+// into v, if not nil.
+func (s *Site) request(ctx context.Context, method, route string, body []byte, v interface{}) error {
+	req, err := http.NewRequest(method, s.URL(route), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(s.conf.AccessKeyID, s.conf.AccessKeySecret)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		if msg := strings.TrimSpace(string(b)); len(msg) > 0 {
+			return fmt.Errorf("request failed (%d): %s", resp.StatusCode, msg)
+		}
+		return fmt.Errorf("request failed (%d)", resp.StatusCode)
+	}
+	if v != nil {
+		return json.Unmarshal(b, v)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestURL(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	eq("http://localhost:10101/foo", NewSite(Config{Address: "http://localhost:10101", BaseURL: "/"}).URL("/foo"))
+	eq("http://localhost:10101/wave/foo", NewSite(Config{Address: "http://localhost:10101/", BaseURL: "/wave/"}).URL("/foo"))
+	eq("http://localhost:10101/wave/", NewSite(Config{Address: "http://localhost:10101", BaseURL: "/wave/"}).URL(""))
+}
+
+func TestPage(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+
+	var patches []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "id" || secret != "secret" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodPatch:
+			b, _ := ioutil.ReadAll(r.Body)
+			patches = append(patches, r.URL.Path+" "+string(b))
+		case http.MethodGet:
+			if r.URL.Path != "/sales" {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"p":{"c":{"plot":{"d":{"view":"plot","~data":0},"b":[{"f":{"f":["x","y"],"d":[[1,2],[3,4]],"n":2}}]}}}}`))
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	site := NewSite(Config{Address: srv.URL, AccessKeyID: "id", AccessKeySecret: "secret"})
+
+	page := site.Page("/sales")
+	no(page.Load(ctx))
+	eq([]string{"plot"}, page.Names())
+	data, isBuffer := page.Card("plot")["data"].(*Buffer)
+	ok(isBuffer)
+	eq(FixedBuffer, data.Type)
+	eq([]string{"x", "y"}, data.Fields)
+	eq(2, len(data.Rows))
+
+	page.Set("plot title", "Sales")
+	eq("Sales", page.Card("plot")["title"])
+	page.Put("note", Card{"view": "markdown", "content": "Hi"})
+	page.Del("plot data")
+	_, hasData := page.Card("plot")["data"]
+	ok(!hasData)
+	no(page.Patch(ctx))
+	no(page.Patch(ctx)) // nothing to send
+	eq(1, len(patches))
+	eq(`/sales {"d":[{"k":"plot title","v":"Sales"},{"k":"note","d":{"content":"Hi","view":"markdown"}},{"k":"plot data"}]}`, patches[0])
+
+	page = site.Page("/new")
+	page.Put("live", Card{"view": "plot", "data": &Buffer{Type: CyclicBuffer, Fields: []string{"t"}, Size: 10}})
+	no(page.Save(ctx))
+	eq(`/new {"d":[{},{"k":"live","d":{"view":"plot","~data":0},"b":[{"c":{"f":["t"],"d":null,"n":10}}]}]}`, patches[1])
+	eq(ErrNotFound, page.Load(ctx))
+
+	bad := NewSite(Config{Address: srv.URL, AccessKeyID: "id", AccessKeySecret: "nope"})
+	ok(bad.Page("/sales").Load(ctx) != nil)
+}
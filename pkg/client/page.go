@@ -0,0 +1,277 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ErrNotFound is returned when loading a page that does not exist.
+var ErrNotFound = errors.New("page not found")
+
+const (
+	keySeparator = " "
+	bufferPrefix = "~" // marks card attributes that refer to buffers
+)
+
+// Card represents a card's attributes, e.g. Card{"view": "markdown", "box": "1 1 2 2", "content": "Hello!"}.
+// Attributes holding data buffers, e.g. the rows plotted by a plot card, are *Buffer.
+type Card map[string]interface{}
+
+// BufferType represents the kind of a data buffer.
+type BufferType int
+
+const (
+	// FixedBuffer holds a fixed number of rows.
+	FixedBuffer BufferType = iota
+	// CyclicBuffer holds a fixed number of rows, overwriting the oldest row when full.
+	CyclicBuffer
+	// MapBuffer holds any number of rows, by key.
+	MapBuffer
+)
+
+// Buffer represents a data buffer in a card.
+type Buffer struct {
+	Type   BufferType
+	Fields []string                 // field (column) names
+	Rows   [][]interface{}          // rows, for fixed and cyclic buffers
+	Keyed  map[string][]interface{} // rows by key, for map buffers
+	Size   int                      // number of rows to allocate, for fixed and cyclic buffers without rows
+	Index  int                      // next row to overwrite, for cyclic buffers
+}
+
+type listBufD struct {
+	F []string        `json:"f"`
+	D [][]interface{} `json:"d"`
+	N int             `json:"n"`
+	I int             `json:"i,omitempty"`
+}
+
+type mapBufD struct {
+	F []string                 `json:"f"`
+	D map[string][]interface{} `json:"d"`
+}
+
+type bufD struct {
+	C *listBufD `json:"c,omitempty"`
+	F *listBufD `json:"f,omitempty"`
+	M *mapBufD  `json:"m,omitempty"`
+}
+
+type cardD struct {
+	D map[string]interface{} `json:"d"`
+	B []bufD                 `json:"b,omitempty"`
+}
+
+type pageD struct {
+	P *struct {
+		C map[string]cardD `json:"c"`
+	} `json:"p"`
+}
+
+type op struct {
+	K string                 `json:"k,omitempty"`
+	V interface{}            `json:"v,omitempty"`
+	C *listBufD              `json:"c,omitempty"`
+	F *listBufD              `json:"f,omitempty"`
+	M *mapBufD               `json:"m,omitempty"`
+	D map[string]interface{} `json:"d,omitempty"`
+	B []bufD                 `json:"b,omitempty"`
+}
+
+func (b *Buffer) dump() bufD {
+	n := b.Size
+	if len(b.Rows) > 0 {
+		n = len(b.Rows)
+	}
+	switch b.Type {
+	case CyclicBuffer:
+		return bufD{C: &listBufD{b.Fields, b.Rows, n, b.Index}}
+	case MapBuffer:
+		return bufD{M: &mapBufD{b.Fields, b.Keyed}}
+	}
+	return bufD{F: &listBufD{b.Fields, b.Rows, n, 0}}
+}
+
+func loadBuffer(b bufD) *Buffer {
+	switch {
+	case b.C != nil:
+		return &Buffer{Type: CyclicBuffer, Fields: b.C.F, Rows: b.C.D, Size: b.C.N, Index: b.C.I}
+	case b.M != nil:
+		return &Buffer{Type: MapBuffer, Fields: b.M.F, Keyed: b.M.D}
+	case b.F != nil:
+		return &Buffer{Type: FixedBuffer, Fields: b.F.F, Rows: b.F.D, Size: b.F.N}
+	}
+	return nil
+}
+
+func (c Card) dump() (map[string]interface{}, []bufD) {
+	data := make(map[string]interface{}, len(c))
+	var bufs []bufD
+	for k, v := range c {
+		if b, ok := v.(*Buffer); ok {
+			data[bufferPrefix+k] = len(bufs)
+			bufs = append(bufs, b.dump())
+			continue
+		}
+		data[k] = v
+	}
+	return data, bufs
+}
+
+func loadCard(d cardD) Card {
+	c := make(Card, len(d.D))
+	for k, v := range d.D {
+		if strings.HasPrefix(k, bufferPrefix) {
+			if i, ok := v.(float64); ok && int(i) >= 0 && int(i) < len(d.B) {
+				if b := loadBuffer(d.B[int(i)]); b != nil {
+					c[strings.TrimPrefix(k, bufferPrefix)] = b
+					continue
+				}
+			}
+		}
+		c[k] = v
+	}
+	return c
+}
+
+// Page represents a page on a Wave server. The page keeps a local copy of its cards, as of the last
+// Load, plus changes made since. Changes are sent to the server on Patch or Save.
+type Page struct {
+	site  *Site
+	route string
+	cards map[string]Card
+	ops   []op
+}
+
+// Route returns the page's route.
+func (p *Page) Route() string {
+	return p.route
+}
+
+// Card returns the local copy of the named card, or nil if there is no such card.
+func (p *Page) Card(name string) Card {
+	return p.cards[name]
+}
+
+// Names returns the names of the page's cards, sorted.
+func (p *Page) Names() []string {
+	names := make([]string, 0, len(p.cards))
+	for name := range p.cards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Put adds or replaces the named card.
+func (p *Page) Put(name string, c Card) {
+	p.cards[name] = c
+	d, b := c.dump()
+	p.ops = append(p.ops, op{K: name, D: d, B: b})
+}
+
+// Set sets the value at path, a space-separated key, e.g. "sales content" for the content of the card "sales",
+// or "sales data 0" for the first row of its data buffer. The local copy of the card reflects changes to
+// its attributes, but not to values nested within its attributes.
+func (p *Page) Set(path string, value interface{}) {
+	o := op{K: path}
+	if b, ok := value.(*Buffer); ok {
+		d := b.dump()
+		o.C, o.F, o.M = d.C, d.F, d.M
+	} else {
+		o.V = value
+	}
+	p.ops = append(p.ops, o)
+	if ks := strings.Split(path, keySeparator); len(ks) == 2 {
+		if c, ok := p.cards[ks[0]]; ok {
+			c[ks[1]] = value
+		}
+	}
+}
+
+// Del deletes the card or value at path, e.g. "sales" for the card "sales".
+func (p *Page) Del(path string) {
+	p.ops = append(p.ops, op{K: path})
+	switch ks := strings.Split(path, keySeparator); len(ks) {
+	case 1:
+		delete(p.cards, path)
+	case 2:
+		if c, ok := p.cards[ks[0]]; ok {
+			delete(c, ks[1])
+		}
+	}
+}
+
+// Drop deletes the page.
+func (p *Page) Drop() {
+	p.cards = make(map[string]Card)
+	p.ops = append(p.ops, op{})
+}
+
+// Patch sends changes made since the last Load, Patch or Save to the server.
+func (p *Page) Patch(ctx context.Context) error {
+	if len(p.ops) == 0 {
+		return nil
+	}
+	if err := p.send(ctx, p.ops); err != nil {
+		return err
+	}
+	p.ops = nil
+	return nil
+}
+
+// Save replaces the page on the server with the local copy.
+func (p *Page) Save(ctx context.Context) error {
+	ops := []op{{}}
+	for _, name := range p.Names() {
+		d, b := p.cards[name].dump()
+		ops = append(ops, op{K: name, D: d, B: b})
+	}
+	if err := p.send(ctx, ops); err != nil {
+		return err
+	}
+	p.ops = nil
+	return nil
+}
+
+func (p *Page) send(ctx context.Context, ops []op) error {
+	b, err := json.Marshal(map[string][]op{"d": ops})
+	if err != nil {
+		return err
+	}
+	return p.site.request(ctx, http.MethodPatch, p.route, b, nil)
+}
+
+// Load replaces the local copy with the page's cards on the server, discarding unsent changes.
+func (p *Page) Load(ctx context.Context) error {
+	var d pageD
+	if err := p.site.request(ctx, http.MethodGet, p.route, nil, &d); err != nil {
+		return err
+	}
+	cards := make(map[string]Card)
+	if d.P != nil {
+		for name, c := range d.P.C {
+			cards[name] = loadCard(c)
+		}
+	}
+	p.cards, p.ops = cards, nil
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config reads Wave server settings from YAML or TOML configuration files.
+//
+// Settings are nested mappings (tables) of scalars and lists of scalars. Nested keys are joined with dashes, so that
+//
+//	[oidc]
+//	client-id = "wave"
+//
+// and
+//
+//	oidc:
+//	  client_id: wave
+//
+// both set "oidc-client-id". Underscores in keys are read as dashes.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Settings represents the values of settings, by name. Scalars are read as single-valued lists.
+type Settings map[string][]string
+
+func (s Settings) set(key string, values []string) error {
+	key = strings.ReplaceAll(key, "_", "-")
+	if _, ok := s[key]; ok {
+		return fmt.Errorf("duplicate setting %q", key)
+	}
+	s[key] = values
+	return nil
+}
+
+func join(prefix, key string) string {
+	if len(prefix) == 0 {
+		return key
+	}
+	return prefix + "-" + key
+}
+
+// Load reads settings from a file, in YAML (.yaml, .yml) or TOML (.toml) format, as per the file's extension.
+func Load(file string) (Settings, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var s Settings
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		s, err = ParseYAML(b)
+	case ".toml":
+		s, err = ParseTOML(b)
+	default:
+		return nil, fmt.Errorf("unsupported config file format %q: want .yaml, .yml or .toml", filepath.Ext(file))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s: %v", file, err)
+	}
+	return s, nil
+}
+
+// ParseTOML reads settings from TOML (v0.4.0). Arrays of tables, and arrays of arrays or tables, are not settings.
+func ParseTOML(b []byte) (Settings, error) {
+	var doc map[string]interface{}
+	if _, err := toml.Decode(string(b), &doc); err != nil {
+		return nil, err
+	}
+	settings := make(Settings)
+	if err := settings.readTOML("", doc); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (s Settings) readTOML(prefix string, table map[string]interface{}) error {
+	for k, v := range table {
+		key := join(prefix, k)
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if err := s.readTOML(key, v); err != nil {
+				return err
+			}
+			continue
+		case []interface{}:
+			values := make([]string, len(v))
+			for i, x := range v {
+				value, ok := tomlScalar(x)
+				if !ok {
+					return fmt.Errorf("%s: want a list of scalars", key)
+				}
+				values[i] = value
+			}
+			if err := s.set(key, values); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := tomlScalar(v)
+		if !ok {
+			return fmt.Errorf("%s: want a scalar, a list of scalars, or a table", key)
+		}
+		if err := s.set(key, []string{value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tomlScalar(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case time.Time:
+		return v.Format(time.RFC3339Nano), true
+	}
+	return "", false
+}
+
+// ParseYAML reads settings from a YAML document. Null values are skipped, as if unset. Plain (unquoted) scalars
+// yes, no, on and off are read as booleans, as in YAML 1.1, since flags want true or false.
+func ParseYAML(b []byte) (Settings, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	settings := make(Settings)
+	if len(doc.Content) == 0 { // empty
+		return settings, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: want a mapping of settings", root.Line)
+	}
+	if err := settings.readYAML("", root); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (s Settings) readYAML(prefix string, m *yaml.Node) error {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		k, v := m.Content[i], resolveYAML(m.Content[i+1])
+		if k.Kind != yaml.ScalarNode {
+			return fmt.Errorf("line %d: want a scalar key", k.Line)
+		}
+		key := join(prefix, k.Value)
+		switch v.Kind {
+		case yaml.MappingNode:
+			if err := s.readYAML(key, v); err != nil {
+				return err
+			}
+			continue
+		case yaml.SequenceNode:
+			values := make([]string, len(v.Content))
+			for j, x := range v.Content {
+				x = resolveYAML(x)
+				if x.Kind != yaml.ScalarNode || x.Tag == "!!null" {
+					return fmt.Errorf("line %d: %s: want a list of scalars", x.Line, key)
+				}
+				values[j] = yamlScalar(x)
+			}
+			if err := s.set(key, values); err != nil {
+				return fmt.Errorf("line %d: %v", k.Line, err)
+			}
+			continue
+		}
+		if v.Tag == "!!null" {
+			continue
+		}
+		if err := s.set(key, []string{yamlScalar(v)}); err != nil {
+			return fmt.Errorf("line %d: %v", k.Line, err)
+		}
+	}
+	return nil
+}
+
+// resolveYAML returns the node an alias refers to.
+func resolveYAML(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+func yamlScalar(n *yaml.Node) string {
+	if n.Tag == "!!bool" {
+		var b bool
+		if n.Decode(&b) == nil {
+			return strconv.FormatBool(b)
+		}
+	}
+	if n.Style == 0 { // plain
+		switch strings.ToLower(n.Value) {
+		case "yes", "on":
+			return "true"
+		case "no", "off":
+			return "false"
+		}
+	}
+	return n.Value
+}
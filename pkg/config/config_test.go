@@ -0,0 +1,141 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+var want = Settings{
+	"listen":           {":10101"},
+	"base-url":         {"/wave/"},
+	"editable":         {"true"},
+	"max-request-size": {"5M"},
+	"app-timeout":      {"30s"},
+	"oidc-client-id":   {"wave"},
+	"oidc-scopes":      {"openid", "profile"},
+	"private-dir":      {"/a@/srv/a", "/b@/srv/b # not a comment"},
+}
+
+func TestParseTOML(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	s, err := ParseTOML([]byte(`
+# Wave server
+listen = ":10101" # comment
+base_url = '/wave/'
+editable = true
+max-request-size = "5M"
+private-dir = [
+  "/a@/srv/a",
+  "/b@/srv/b # not a comment", # comment
+]
+
+[app]
+timeout = "30s"
+
+[oidc]
+client-id = "wave"
+scopes = ["openid", "profile"]
+`))
+	no(err)
+	eq(s, want)
+
+	for _, bad := range []string{
+		`listen = :10101`,
+		`listen = "a" "b"`,
+		`listen = "unterminated`,
+		`listen`,
+		`[[apps]]`,
+		`a = [[1]]`,
+		"a = 1\na = 2",
+		"a-b = 1\na_b = 2",
+		"a-b = 1\n[a]\nb = 2",
+	} {
+		if _, err := ParseTOML([]byte(bad)); err == nil {
+			t.Errorf("want error for %q", bad)
+		}
+	}
+	s, err = ParseTOML([]byte(`port = 10_101` + "\n" + `s = "tab\tquote\"\u00e9"`))
+	no(err)
+	eq(s, Settings{"port": {"10101"}, "s": {"tab\tquote\"é"}})
+	s, err = ParseTOML([]byte("a = {b = 1.5, c = false}\nd = \"\"\"\nmulti\"\"\""))
+	no(err)
+	eq(s, Settings{"a-b": {"1.5"}, "a-c": {"false"}, "d": {"multi"}})
+}
+
+func TestParseYAML(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	s, err := ParseYAML([]byte(`
+---
+# Wave server
+listen: ":10101" # comment
+base_url: '/wave/'
+editable: yes
+max-request-size: 5M
+app:
+  timeout: 30s
+  mode: ~
+private-dir:
+- /a@/srv/a
+- "/b@/srv/b # not a comment"
+oidc:
+  client_id: wave
+  scopes: [openid, "profile"]
+`))
+	no(err)
+	eq(s, want)
+
+	for _, bad := range []string{
+		"a:\n  - b: 1",
+		"a: [[1]]",
+		"a: [~]",
+		"a-b: 1\na_b: 2",
+		"a: 1\n  b: 2",
+		"a: 1\na: 2",
+		"\ta: 1",
+		"- a",
+		"a",
+	} {
+		if _, err := ParseYAML([]byte(bad)); err == nil {
+			t.Errorf("want error for %q", bad)
+		}
+	}
+	s, err = ParseYAML([]byte("a: {b: 1, c: off}\nd: &x |\n  multi\ne: *x\nf: 'yes'\ng: True"))
+	no(err)
+	eq(s, Settings{"a-b": {"1"}, "a-c": {"false"}, "d": {"multi\n"}, "e": {"multi\n"}, "f": {"yes"}, "g": {"true"}})
+	s, err = ParseYAML(nil)
+	no(err)
+	eq(s, Settings{})
+}
+
+func TestLoad(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	dir := t.TempDir()
+	for name, content := range map[string]string{"wave.yaml": "listen: :1", "wave.toml": `listen = ":1"`} {
+		file := filepath.Join(dir, name)
+		no(ioutil.WriteFile(file, []byte(content), 0600))
+		s, err := Load(file)
+		no(err)
+		eq(s, Settings{"listen": {":1"}})
+	}
+	file := filepath.Join(dir, "wave.json")
+	no(ioutil.WriteFile(file, []byte(`{}`), 0600))
+	_, err := Load(file)
+	eq(err != nil, true)
+}
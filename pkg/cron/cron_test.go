@@ -0,0 +1,78 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func at(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestNext(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	for _, c := range []struct {
+		expr, from, next string
+	}{
+		{"* * * * *", "2021-03-04 05:06", "2021-03-04 05:07"},
+		{"*/15 * * * *", "2021-03-04 05:06", "2021-03-04 05:15"},
+		{"0 * * * *", "2021-03-04 05:06", "2021-03-04 06:00"},
+		{"30 9 * * 1-5", "2021-03-05 10:00", "2021-03-08 09:30"}, // Fri -> Mon
+		{"0 0 1 * *", "2021-12-15 00:00", "2022-01-01 00:00"},
+		{"0 12 * jan,jul sun", "2021-03-04 00:00", "2021-07-04 12:00"},
+		{"0 0 29 2 *", "2021-01-01 00:00", "2024-02-29 00:00"},
+		{"0 0 13 * 5", "2021-03-04 00:00", "2021-03-05 00:00"}, // 13th or Friday
+		{"0 0 * * 7", "2021-03-04 00:00", "2021-03-07 00:00"},  // 7 is Sunday
+		{"@daily", "2021-03-04 05:06", "2021-03-05 00:00"},
+		{"@every 90s", "2021-03-04 05:06", "2021-03-04 05:07"}, // plus 30s
+	} {
+		s, err := Parse(c.expr)
+		no(err)
+		want := at(c.next)
+		if c.expr == "@every 90s" {
+			want = want.Add(30 * time.Second)
+		}
+		eq(want, s.Next(at(c.from)))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"@every nope",
+		"@every 10ms",
+		"@sometimes",
+	} {
+		_, err := Parse(expr)
+		ok(err != nil, expr)
+	}
+}
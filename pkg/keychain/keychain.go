@@ -24,6 +24,8 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru"
 	"golang.org/x/crypto/bcrypt"
@@ -71,11 +73,17 @@ func HashSecret(secret string) ([]byte, error) {
 	return h, nil
 }
 
-// Keychain represents a collection of access keys that are allowed to use the API
+// Keychain represents a collection of access keys that are allowed to use the API.
+// Safe for concurrent use, so that it can be reloaded while serving requests.
 type Keychain struct {
-	Name  string
-	keys  map[string][]byte
-	cache *lru.Cache
+	Name        string
+	mu          sync.RWMutex
+	keys        map[string][]byte
+	scopes      map[string]Scope // scopes of scoped keys; keys missing here have full access
+	cache       *lru.Cache
+	modTime     time.Time // of the file, when last read
+	defaultID   string    // default key, used while the file has no keys; see SetDefault
+	defaultHash []byte
 }
 
 func CreateAccessKey() (id, secret string, hash []byte, err error) {
@@ -90,11 +98,64 @@ func CreateAccessKey() (id, secret string, hash []byte, err error) {
 }
 
 func (kc *Keychain) Add(id string, hash []byte) {
+	kc.AddScoped(id, hash, Scope{})
+}
+
+// AddScoped adds a key restricted to a scope; with full access if the scope is empty.
+func (kc *Keychain) AddScoped(id string, hash []byte, scope Scope) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
 	kc.keys[id] = hash
+	if scope.IsEmpty() {
+		delete(kc.scopes, id)
+	} else {
+		kc.scopes[id] = scope
+	}
+	kc.cache.Purge() // forget secrets verified against a replaced hash
+}
+
+// SetDefault sets the default key, which has full access, and is used only while the keychain file has no keys.
+// Calling it again replaces the key, e.g. when its secret is rotated.
+func (kc *Keychain) SetDefault(id string, hash []byte) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	if kc.usesDefault() {
+		kc.keys, kc.scopes = map[string][]byte{id: hash}, make(map[string]Scope)
+		kc.cache.Purge()
+	}
+	kc.defaultID, kc.defaultHash = id, hash
+}
+
+// DefaultID returns the ID of the default key; empty if not set.
+func (kc *Keychain) DefaultID() string {
+	kc.mu.RLock()
+	defer kc.mu.RUnlock()
+	return kc.defaultID
+}
+
+// usesDefault returns true if the keychain has no keys but the default one. Must be called with the lock held.
+func (kc *Keychain) usesDefault() bool {
+	if len(kc.keys) == 0 {
+		return true
+	}
+	if len(kc.keys) > 1 || len(kc.defaultID) == 0 {
+		return false
+	}
+	hash, ok := kc.keys[kc.defaultID]
+	return ok && bytes.Equal(hash, kc.defaultHash)
+}
+
+// Scope returns the scope of a key; empty if the key has full access.
+func (kc *Keychain) Scope(id string) Scope {
+	kc.mu.RLock()
+	defer kc.mu.RUnlock()
+	return kc.scopes[id]
 }
 
 func (kc *Keychain) verify(id, secret string) bool {
+	kc.mu.RLock()
 	hash, ok := kc.keys[id]
+	kc.mu.RUnlock()
 	if !ok {
 		return false
 	}
@@ -112,14 +173,20 @@ func (kc *Keychain) verify(id, secret string) bool {
 }
 
 func (kc *Keychain) Remove(id string) bool {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
 	if _, ok := kc.keys[id]; ok {
 		delete(kc.keys, id)
+		delete(kc.scopes, id)
+		kc.cache.Purge()
 		return true
 	}
 	return false
 }
 
 func (kc *Keychain) IDs() []string {
+	kc.mu.RLock()
+	defer kc.mu.RUnlock()
 	ids := make([]string, len(kc.keys))
 	i := 0
 	for id := range kc.keys {
@@ -130,6 +197,8 @@ func (kc *Keychain) IDs() []string {
 }
 
 func (kc *Keychain) Len() int {
+	kc.mu.RLock()
+	defer kc.mu.RUnlock()
 	return len(kc.keys)
 }
 
@@ -145,58 +214,113 @@ func newLruCache(size int) (*lru.Cache, error) {
 }
 
 func LoadKeychain(name string) (*Keychain, error) {
-	keys := make(map[string][]byte)
-
-	if _, err := os.Stat(name); os.IsNotExist(err) {
-		cache, err := newLruCache(128)
-		if err != nil {
+	kc := &Keychain{Name: name, keys: make(map[string][]byte), scopes: make(map[string]Scope)}
+	info, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		if kc.cache, err = newLruCache(128); err != nil {
 			return nil, err
 		}
-		return &Keychain{name, keys, cache}, nil
+		return kc, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed opening %s: %v", name, err)
+	}
+	if kc.keys, kc.scopes, err = readKeychain(name); err != nil {
+		return nil, err
+	}
+	kc.modTime = info.ModTime()
+	if kc.cache, err = newLruCache(len(kc.keys)); err != nil {
+		return nil, err
+	}
+	return kc, nil
+}
+
+// Reload re-reads the keychain file if it changed since it was last read, e.g. when keys are added, removed or
+// rotated by another process, returning true if it did. The keys are kept as is if the file is missing or invalid.
+func (kc *Keychain) Reload() (bool, error) {
+	info, err := os.Stat(kc.Name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed opening %s: %v", kc.Name, err)
 	}
+	kc.mu.RLock()
+	unchanged := info.ModTime().Equal(kc.modTime)
+	kc.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	keys, scopes, err := readKeychain(kc.Name)
+	if err != nil {
+		return false, err
+	}
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	if len(keys) == 0 && len(kc.defaultID) > 0 {
+		keys[kc.defaultID] = kc.defaultHash
+	}
+	kc.keys, kc.scopes, kc.modTime = keys, scopes, info.ModTime()
+	kc.cache.Purge()
+	return true, nil
+}
+
+// readKeychain reads the keys and scopes in a keychain file.
+func readKeychain(name string) (map[string][]byte, map[string]Scope, error) {
+	keys := make(map[string][]byte)
+	scopes := make(map[string]Scope)
 
 	file, err := os.Open(name)
 	if err != nil {
-		return nil, fmt.Errorf("failed opening %s: %v", name, err)
+		return nil, nil, fmt.Errorf("failed opening %s: %v", name, err)
 	}
 	defer file.Close()
 
 	all, err := io.ReadAll(file)
 	if err != nil {
-		return nil, fmt.Errorf("failed reading %s: %v", name, err)
+		return nil, nil, fmt.Errorf("failed reading %s: %v", name, err)
 	}
 
 	for _, line := range bytes.Split(all, newline) {
 		if len(line) == 0 {
 			continue
 		}
-		tokens := bytes.SplitN(line, colon, 2)
-		if len(tokens) != 2 {
-			return nil, errInvalidKeychainEntry
+		tokens := bytes.SplitN(line, colon, 3) // id:hash[:scope]; bcrypt hashes contain no colons
+		if len(tokens) < 2 {
+			return nil, nil, errInvalidKeychainEntry
 		}
 		id, hash := tokens[0], tokens[1]
 		if len(id) == 0 || len(hash) == 0 {
-			return nil, errInvalidKeychainEntry
+			return nil, nil, errInvalidKeychainEntry
 		}
 		keys[string(id)] = hash
+		if len(tokens) == 3 {
+			scope, err := ParseScope(string(tokens[2]))
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid scope for access key %s: %v", id, err)
+			}
+			if !scope.IsEmpty() {
+				scopes[string(id)] = scope
+			}
+		}
 	}
-
-	cache, err := newLruCache(len(keys))
-	if err != nil {
-		return nil, err
-	}
-
-	return &Keychain{name, keys, cache}, nil
+	return keys, scopes, nil
 }
 
 func (kc *Keychain) Save() error {
+	kc.mu.RLock()
 	var sb bytes.Buffer
 	for id, hash := range kc.keys {
 		sb.WriteString(id)
 		sb.Write(colon)
 		sb.Write(hash)
+		if scope, ok := kc.scopes[id]; ok {
+			sb.Write(colon)
+			sb.WriteString(scope.String())
+		}
 		sb.Write(newline)
 	}
+	kc.mu.RUnlock()
 
 	if err := os.WriteFile(kc.Name, sb.Bytes(), 0600); err != nil {
 		return fmt.Errorf("failed writing %s: %v", kc.Name, err)
@@ -205,11 +329,24 @@ func (kc *Keychain) Save() error {
 	return nil
 }
 
+// Allow returns true if the request carries a valid key with full access; scoped keys are allowed only by AllowRoute.
 func (kc *Keychain) Allow(r *http.Request) bool {
+	id, secret, ok := r.BasicAuth()
+	return ok && kc.verify(id, secret) && kc.Scope(id).IsEmpty()
+}
+
+// Verify returns true if the request carries a valid key, whatever its scope.
+func (kc *Keychain) Verify(r *http.Request) bool {
 	id, secret, ok := r.BasicAuth()
 	return ok && kc.verify(id, secret)
 }
 
+// AllowRoute returns true if the request carries a valid key allowed the access ("read" or "write") to a route.
+func (kc *Keychain) AllowRoute(r *http.Request, access, route string) bool {
+	id, secret, ok := r.BasicAuth()
+	return ok && kc.verify(id, secret) && kc.Scope(id).Allows(access, route)
+}
+
 func (kc *Keychain) Guard(w http.ResponseWriter, r *http.Request) bool {
 	if !kc.Allow(r) {
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
@@ -217,3 +354,17 @@ func (kc *Keychain) Guard(w http.ResponseWriter, r *http.Request) bool {
 	}
 	return true
 }
+
+// GuardRoute is like Guard, but allows keys scoped to the access to a route (see AllowRoute). Valid keys out of scope
+// are refused with a 403 response.
+func (kc *Keychain) GuardRoute(w http.ResponseWriter, r *http.Request, access, route string) bool {
+	if kc.AllowRoute(r, access, route) {
+		return true
+	}
+	if id, secret, ok := r.BasicAuth(); ok && kc.verify(id, secret) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return false
+}
@@ -16,7 +16,12 @@ package keychain
 
 import (
 	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/h2oai/wave/pkg/assert"
 )
@@ -104,3 +109,104 @@ func TestKeychainManagement(t *testing.T) {
 	// should be empty now
 	eq(0, kc.Len())
 }
+
+func TestKeychainScopes(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+
+	_, err := ParseScope("read,write")
+	ok(err != nil, "read and write")
+	_, err = ParseScope("admin")
+	ok(err != nil, "unknown term")
+	scope, err := ParseScope("write, /dashboards, /reports/")
+	no(err)
+	eq(scope.String(), "write,/dashboards,/reports/")
+	ok(scope.Allows(WriteAccess, "/dashboards"), "prefix")
+	ok(scope.Allows(WriteAccess, "/dashboards/sales"), "sub-route")
+	ok(scope.Allows(WriteAccess, "/reports/q1"), "sub-route")
+	ok(!scope.Allows(WriteAccess, "/dashboardsx"), "not a sub-route")
+	ok(!scope.Allows(ReadAccess, "/dashboards"), "write only")
+	ok(Scope{}.Allows(ReadAccess, "/any"), "empty scope")
+
+	name := filepath.Join(t.TempDir(), "keychain")
+	kc, err := LoadKeychain(name)
+	no(err)
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	kc.AddScoped(id, hash, scope)
+	no(kc.Save())
+	kc, err = LoadKeychain(name)
+	no(err)
+	eq(kc.Scope(id).String(), scope.String())
+
+	r := httptest.NewRequest("PATCH", "/dashboards/sales", nil)
+	r.SetBasicAuth(id, secret)
+	ok(!kc.Allow(r), "scoped keys need AllowRoute")
+	ok(kc.AllowRoute(r, WriteAccess, "/dashboards/sales"), "in scope")
+	w := httptest.NewRecorder()
+	ok(!kc.GuardRoute(w, r, ReadAccess, "/dashboards/sales"), "out of scope")
+	eq(w.Code, http.StatusForbidden)
+}
+
+func TestKeychainDefault(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kc, err := LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	hash, err := HashSecret("old")
+	no(err)
+	kc.SetDefault("default", hash)
+	eq(kc.DefaultID(), "default")
+	ok(kc.verify("default", "old"), "default key in use")
+
+	hash, err = HashSecret("new")
+	no(err)
+	kc.SetDefault("default", hash) // rotated
+	ok(!kc.verify("default", "old"), "old secret forgotten, though cached")
+	ok(kc.verify("default", "new"), "new secret")
+
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	kc.Add(id, hash)
+	hash, err = HashSecret("newer")
+	no(err)
+	kc.SetDefault("default", hash) // keychain has other keys now
+	ok(kc.verify("default", "new"), "default key in use kept as is")
+	ok(kc.verify(id, secret), "added key")
+}
+
+func TestKeychainReload(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	name := filepath.Join(t.TempDir(), "keychain")
+	kc, err := LoadKeychain(name)
+	no(err)
+	hash, err := HashSecret("secret")
+	no(err)
+	kc.SetDefault("default", hash)
+	changed, err := kc.Reload()
+	no(err)
+	ok(!changed, "no file")
+
+	other, err := LoadKeychain(name)
+	no(err)
+	id, secret, hash, err := CreateAccessKey()
+	no(err)
+	other.Add(id, hash)
+	no(other.Save())
+	changed, err = kc.Reload()
+	no(err)
+	ok(changed, "file written")
+	ok(kc.verify(id, secret), "key added by another process")
+	ok(!kc.verify("default", "secret"), "default key not used with keys in the file")
+	changed, err = kc.Reload()
+	no(err)
+	ok(!changed, "file unchanged")
+
+	other.Remove(id)
+	no(other.Save())
+	no(os.Chtimes(name, time.Now(), time.Now().Add(time.Second))) // in case of coarse timestamps
+	changed, err = kc.Reload()
+	no(err)
+	ok(changed, "file rewritten")
+	ok(!kc.verify(id, secret), "key removed by another process")
+	ok(kc.verify("default", "secret"), "default key used again")
+	eq(kc.Len(), 1)
+}
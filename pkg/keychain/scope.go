@@ -0,0 +1,90 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keychain
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	ReadAccess  = "read"  // read pages
+	WriteAccess = "write" // write pages
+)
+
+// Scope restricts what an access key may do. The empty scope allows everything.
+type Scope struct {
+	Access string   // ReadAccess, WriteAccess, or "" for both
+	Routes []string // route prefixes the key may access; any route if empty
+}
+
+// ParseScope parses a scope given as comma-separated terms: "read" (read-only) or "write" (publish-only), and route
+// prefixes, e.g. "read,/dashboards,/reports/".
+func ParseScope(spec string) (Scope, error) {
+	var s Scope
+	for _, term := range strings.Split(spec, ",") {
+		term = strings.TrimSpace(term)
+		switch {
+		case len(term) == 0:
+		case term == ReadAccess || term == WriteAccess:
+			if len(s.Access) > 0 && s.Access != term {
+				return s, fmt.Errorf("want %q or %q, not both", ReadAccess, WriteAccess)
+			}
+			s.Access = term
+		case strings.HasPrefix(term, "/"):
+			s.Routes = append(s.Routes, term)
+		default:
+			return s, fmt.Errorf("want %q, %q or a route prefix, got %q", ReadAccess, WriteAccess, term)
+		}
+	}
+	return s, nil
+}
+
+// IsEmpty returns true if the scope allows everything.
+func (s Scope) IsEmpty() bool {
+	return len(s.Access) == 0 && len(s.Routes) == 0
+}
+
+// Allows returns true if the scope allows the access to a route.
+func (s Scope) Allows(access, route string) bool {
+	if len(s.Access) > 0 && s.Access != access {
+		return false
+	}
+	if len(s.Routes) == 0 {
+		return true
+	}
+	for _, prefix := range s.Routes {
+		if matchPrefix(prefix, route) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Scope) String() string {
+	var terms []string
+	if len(s.Access) > 0 {
+		terms = append(terms, s.Access)
+	}
+	return strings.Join(append(terms, s.Routes...), ",")
+}
+
+// matchPrefix returns true if route is prefix, or a sub-route of prefix.
+func matchPrefix(prefix, route string) bool {
+	if route == prefix || strings.HasSuffix(prefix, "/") && strings.HasPrefix(route, prefix) {
+		return true
+	}
+	return strings.HasPrefix(route, prefix+"/")
+}
@@ -0,0 +1,263 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redis implements a minimal Redis client, sufficient for storing and relaying Wave pages.
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dialTimeout = 10 * time.Second
+
+// Error represents an error reply from the server.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+var errBadReply = errors.New("redis: malformed reply")
+
+// Options represents connection options.
+type Options struct {
+	Addr     string // host:port
+	Password string
+	DB       int
+}
+
+// ParseURL parses a URL of the form redis://[:password@]host[:port][/db].
+func ParseURL(s string) (Options, error) {
+	var o Options
+	u, err := url.Parse(s)
+	if err != nil {
+		return o, err
+	}
+	if u.Scheme != "redis" {
+		return o, fmt.Errorf("redis: unsupported scheme %q", u.Scheme)
+	}
+	o.Addr = u.Host
+	if len(u.Port()) == 0 {
+		o.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		o.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); len(db) > 0 {
+		if o.DB, err = strconv.Atoi(db); err != nil {
+			return o, fmt.Errorf("redis: bad database %q", db)
+		}
+	}
+	return o, nil
+}
+
+// Conn represents a connection to a Redis server. Safe for concurrent use; commands are serialized.
+// The connection is re-established on the next command if it fails.
+type Conn struct {
+	sync.Mutex
+	opts Options
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// Dial connects to a Redis server.
+func Dial(opts Options) (*Conn, error) {
+	c := &Conn{opts: opts}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conn) connect() error {
+	conn, err := net.DialTimeout("tcp", c.opts.Addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	c.conn, c.r, c.w = conn, bufio.NewReader(conn), bufio.NewWriter(conn)
+	if len(c.opts.Password) > 0 {
+		if _, err := c.do("AUTH", c.opts.Password); err != nil {
+			c.reset()
+			return err
+		}
+	}
+	if c.opts.DB != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(c.opts.DB)); err != nil {
+			c.reset()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Conn) reset() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// Do sends a command and returns its reply: a string, int64, []interface{}, nil, or an Error.
+func (c *Conn) Do(args ...string) (interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.do(args...)
+	if err != nil {
+		if _, ok := err.(Error); !ok { // i/o or protocol error; reconnect next time
+			c.reset()
+		}
+	}
+	return reply, err
+}
+
+func (c *Conn) do(args ...string) (interface{}, error) {
+	if err := write(c.w, args); err != nil {
+		return nil, err
+	}
+	reply, err := read(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(Error); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+// SetPassword changes the password used when the connection is next established, e.g. when it is rotated.
+// The current connection, already authenticated, is kept.
+func (c *Conn) SetPassword(password string) {
+	c.Lock()
+	c.opts.Password = password
+	c.Unlock()
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	c.reset()
+	return nil
+}
+
+// Subscribe subscribes to a channel on a dedicated connection, calling f for each message received,
+// until the connection fails or is closed via the returned io.Closer.
+func Subscribe(opts Options, channel string, f func(msg []byte)) (io.Closer, <-chan error, error) {
+	c := &Conn{opts: opts}
+	if err := c.connect(); err != nil {
+		return nil, nil, err
+	}
+	if err := write(c.w, []string{"SUBSCRIBE", channel}); err != nil {
+		c.reset()
+		return nil, nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		for {
+			reply, err := read(c.r)
+			if err != nil {
+				done <- err
+				return
+			}
+			if m, ok := reply.([]interface{}); ok && len(m) == 3 && m[0] == "message" {
+				if s, ok := m[2].(string); ok {
+					f([]byte(s))
+				}
+			}
+		}
+	}()
+	return c.conn, done, nil
+}
+
+func write(w *bufio.Writer, args []string) error {
+	w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		w.WriteString(arg)
+		w.WriteString("\r\n")
+	}
+	return w.Flush()
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", errBadReply
+	}
+	return line[:len(line)-2], nil
+}
+
+func read(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, errBadReply
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errBadReply
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errBadReply
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		xs := make([]interface{}, n)
+		for i := range xs {
+			if xs[i], err = read(r); err != nil {
+				return nil, err
+			}
+		}
+		return xs, nil
+	}
+	return nil, errBadReply
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestParseURL(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	o, err := ParseURL("redis://:secret@example.com/2")
+	no(err)
+	eq(o, Options{"example.com:6379", "secret", 2})
+	o, err = ParseURL("redis://localhost:6380")
+	no(err)
+	eq(o, Options{"localhost:6380", "", 0})
+	_, err = ParseURL("http://localhost")
+	eq(err != nil, true)
+}
+
+func TestWrite(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	var b bytes.Buffer
+	no(write(bufio.NewWriter(&b), []string{"HSET", "k", "/foo bar"}))
+	eq(b.String(), "*3\r\n$4\r\nHSET\r\n$1\r\nk\r\n$8\r\n/foo bar\r\n")
+}
+
+func TestRead(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	r := bufio.NewReader(strings.NewReader("+OK\r\n-ERR bad\r\n:42\r\n$5\r\nhe\r\no\r\n$-1\r\n*2\r\n$1\r\na\r\n:1\r\n"))
+	for _, want := range []interface{}{"OK", Error("ERR bad"), int64(42), "he\r\no", nil, []interface{}{"a", int64(1)}} {
+		got, err := read(r)
+		no(err)
+		eq(got, want)
+	}
+	_, err := read(bufio.NewReader(strings.NewReader("?\r\n")))
+	eq(err, errBadReply)
+}
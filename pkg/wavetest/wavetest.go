@@ -0,0 +1,329 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wavetest runs a Wave broker in-process, with browser tabs and apps attached without sockets,
+// for integration tests of watch, query and broadcast flows:
+//
+//	s := wavetest.New(t)
+//	app := s.App("/counter", "unicast").Handle(func(q *wavetest.Query) {
+//		q.Put("count", map[string]interface{}{"view": "markdown", "content": "0"})
+//	})
+//	tab := s.Connect("alice")
+//	tab.Watch("/counter")
+//	app.Next()                         // boot query
+//	m := tab.Receive()                 // page update
+package wavetest
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave"
+)
+
+// Timeout is how long to wait for messages and queries before failing the test.
+var Timeout = 2 * time.Second
+
+// Server represents an in-process Wave server.
+type Server struct {
+	t       testing.TB
+	harness *wave.Harness
+}
+
+// New creates a server with an empty site.
+func New(t testing.TB) *Server {
+	return &Server{t, wave.NewHarness(false)}
+}
+
+// NewEditable creates a server with an empty site, where browser tabs can edit pages.
+func NewEditable(t testing.TB) *Server {
+	return &Server{t, wave.NewHarness(true)}
+}
+
+// Patch applies ops to the page at route, e.g. `{"d":[{"k":"foo","d":{"view":"markdown"}}]}`.
+func (s *Server) Patch(route string, ops string) {
+	s.t.Helper()
+	if err := s.harness.Patch(route, []byte(ops)); err != nil {
+		s.t.Fatalf("patch %s: %v", route, err)
+	}
+}
+
+// Put adds or replaces a card on the page at route.
+func (s *Server) Put(route, card string, attrs map[string]interface{}) {
+	s.t.Helper()
+	s.Patch(route, marshalOps(s.t, map[string]interface{}{"k": card, "d": attrs}))
+}
+
+// Page returns the cards on the page at route, or nil if there is no such page.
+func (s *Server) Page(route string) map[string]interface{} {
+	s.t.Helper()
+	data := s.harness.Page(route)
+	if data == nil {
+		return nil
+	}
+	m := parseMessage(s.t, data)
+	return m.Cards
+}
+
+func marshalOps(t testing.TB, ops ...map[string]interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(map[string]interface{}{"d": ops})
+	if err != nil {
+		t.Fatalf("marshal ops: %v", err)
+	}
+	return string(b)
+}
+
+// Message represents a message sent to a browser tab.
+type Message struct {
+	Raw      []byte                   // as sent
+	Cards    map[string]interface{}   // cards, if a whole page was sent
+	Ops      []map[string]interface{} // changes to the page, if any
+	Error    string                   // error, if any
+	Redirect string                   // location to redirect to, if any
+	Reset    bool                     // reload requested?
+	Meta     *Meta                    // session details, if sent
+}
+
+// Meta represents session details sent to a browser tab before a page.
+type Meta struct {
+	Username string
+	Editor   bool
+}
+
+// NotFound returns true if the message reports that the requested page does not exist.
+func (m *Message) NotFound() bool {
+	return m.Error == "not_found"
+}
+
+func parseMessage(t testing.TB, data []byte) *Message {
+	t.Helper()
+	var d struct {
+		P *struct {
+			C map[string]interface{} `json:"c"`
+		} `json:"p"`
+		D []map[string]interface{} `json:"d"`
+		E string                   `json:"e"`
+		U string                   `json:"u"`
+		R int                      `json:"r"`
+		M *struct {
+			U string `json:"u"`
+			E bool   `json:"e"`
+		} `json:"m"`
+	}
+	if err := json.Unmarshal(data, &d); err != nil {
+		t.Fatalf("bad message %s: %v", data, err)
+	}
+	m := &Message{Raw: data, Ops: d.D, Error: d.E, Redirect: d.U, Reset: d.R != 0}
+	if d.P != nil {
+		m.Cards = d.P.C
+	}
+	if d.M != nil {
+		m.Meta = &Meta{d.M.U, d.M.E}
+	}
+	return m
+}
+
+// Client represents a browser tab.
+type Client struct {
+	t      testing.TB
+	client *wave.HarnessClient
+}
+
+// Connect attaches a browser tab for user; anonymous if user is empty. The tab is closed when the test ends.
+func (s *Server) Connect(user string) *Client {
+	c := &Client{s.t, s.harness.Connect(user)}
+	s.t.Cleanup(c.Close)
+	return c
+}
+
+// ID returns the tab's client ID.
+func (c *Client) ID() string {
+	return c.client.ID()
+}
+
+// Watch navigates the tab to route.
+func (c *Client) Watch(route string) {
+	c.client.Send([]byte("+ " + route + " "))
+}
+
+// Query sends a query to the app at route, e.g. a button click, with args {"button_name": true}.
+func (c *Client) Query(route string, args map[string]interface{}) {
+	c.t.Helper()
+	b, err := json.Marshal(args)
+	if err != nil {
+		c.t.Fatalf("marshal query: %v", err)
+	}
+	c.client.Send([]byte("@ " + route + " " + string(b)))
+}
+
+// Edit sends ops to the page at route, as if edited in the browser. Requires a server created with NewEditable.
+func (c *Client) Edit(route string, ops string) {
+	c.client.Send([]byte("* " + route + " " + ops))
+}
+
+// Receive returns the next message sent to the tab, failing the test if none arrives in time.
+func (c *Client) Receive() *Message {
+	c.t.Helper()
+	data, ok := c.client.Receive(Timeout)
+	if !ok {
+		c.t.Fatalf("client %s: no message received", c.ID())
+	}
+	return parseMessage(c.t, data)
+}
+
+// Quiet fails the test if the tab receives a message within d.
+func (c *Client) Quiet(d time.Duration) {
+	c.t.Helper()
+	if data, ok := c.client.Receive(d); ok {
+		c.t.Fatalf("client %s: unexpected message %s", c.ID(), data)
+	}
+}
+
+// Close detaches the tab. Safe to call more than once.
+func (c *Client) Close() {
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+// App represents a scriptable app.
+type App struct {
+	t       testing.TB
+	server  *Server
+	route   string
+	mode    string
+	mu      sync.Mutex
+	handle  func(q *Query)
+	err     error
+	queries chan *Query
+}
+
+// App registers an app at route, in mode ("unicast", "multicast" or "broadcast"). The app records every query
+// it receives (see Next), and passes each to its handler, if any (see Handle).
+func (s *Server) App(route, mode string) *App {
+	s.t.Helper()
+	a := &App{t: s.t, server: s, route: route, mode: mode, queries: make(chan *Query, 256)}
+	if err := s.harness.RegisterApp(route, mode, "harness:"+route, a.receive); err != nil {
+		s.t.Fatalf("register app %s: %v", route, err)
+	}
+	return a
+}
+
+// Handle sets the handler for queries.
+func (a *App) Handle(h func(q *Query)) *App {
+	a.mu.Lock()
+	a.handle = h
+	a.mu.Unlock()
+	return a
+}
+
+// Fail makes the app fail to accept queries with err, as if unreachable, or accept them again if err is nil.
+// An app failing to accept a query is unregistered by the server.
+func (a *App) Fail(err error) {
+	a.mu.Lock()
+	a.err = err
+	a.mu.Unlock()
+}
+
+// Unregister unregisters the app.
+func (a *App) Unregister() {
+	a.server.harness.UnregisterApp(a.route)
+}
+
+func (a *App) receive(r *wave.HarnessRequest) error {
+	a.mu.Lock()
+	h, err := a.handle, a.err
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	q := &Query{Route: r.Route, ClientID: r.ClientID, Subject: r.Subject, Username: r.Username, app: a, request: r}
+	if err := json.Unmarshal(r.Data, &q.Args); err != nil {
+		return err
+	}
+	if events, ok := q.Args[""]; ok {
+		if err := json.Unmarshal(events, &q.Events); err != nil {
+			return err
+		}
+		delete(q.Args, "")
+	}
+	select {
+	case a.queries <- q:
+	default: // not being inspected
+	}
+	if h != nil {
+		h(q)
+	}
+	return nil
+}
+
+// Next returns the next query received by the app, failing the test if none arrives in time.
+func (a *App) Next() *Query {
+	a.t.Helper()
+	select {
+	case q := <-a.queries:
+		return q
+	case <-time.After(Timeout):
+		a.t.Fatalf("app %s: no query received", a.route)
+		return nil
+	}
+}
+
+// Query represents a query received by an app.
+type Query struct {
+	Route    string
+	ClientID string
+	Subject  string
+	Username string
+	Args     map[string]json.RawMessage
+	Events   map[string]map[string]json.RawMessage // by source and event name
+	app      *App
+	request  *wave.HarnessRequest
+}
+
+// Arg decodes the named argument into v, returning false if there is no such argument.
+func (q *Query) Arg(name string, v interface{}) bool {
+	b, ok := q.Args[name]
+	return ok && json.Unmarshal(b, v) == nil
+}
+
+// PageRoute returns the route of the page the app writes to in reply, per its mode.
+func (q *Query) PageRoute() string {
+	switch q.app.mode {
+	case "broadcast":
+		return q.app.route
+	case "multicast":
+		return "/" + q.Subject
+	}
+	return "/" + q.ClientID
+}
+
+// Put adds or replaces a card on the query's page.
+func (q *Query) Put(card string, attrs map[string]interface{}) {
+	q.app.server.Put(q.PageRoute(), card, attrs)
+}
+
+// Set sets the value at path, a space-separated key, on the query's page, e.g. "count content".
+func (q *Query) Set(path string, value interface{}) {
+	q.app.server.Patch(q.PageRoute(), marshalOps(q.app.t, map[string]interface{}{"k": path, "v": value}))
+}
+
+// Relay streams ops to the tab that made the query, e.g. `{"d":[{"k":"progress value","v":0.5}]}`.
+func (q *Query) Relay(ops string) error {
+	return q.request.Relay([]byte(ops))
+}
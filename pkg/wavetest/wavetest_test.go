@@ -0,0 +1,128 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wavetest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestWatchPage(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	s := New(t)
+	s.Put("/demo", "foo", map[string]interface{}{"view": "markdown", "content": "hello"})
+
+	tab := s.Connect("alice")
+	tab.Watch("/demo")
+	m := tab.Receive()
+	ok(m.Meta != nil)
+	eq("alice", m.Meta.Username)
+	m = tab.Receive()
+	ok(m.Cards != nil)
+	eq(1, len(m.Cards))
+
+	s.Patch("/demo", `{"d":[{"k":"foo content","v":"world"}]}`)
+	m = tab.Receive()
+	eq(1, len(m.Ops))
+	eq("foo content", m.Ops[0]["k"])
+	eq("world", m.Ops[0]["v"])
+
+	tab.Watch("/missing")
+	tab.Receive() // meta
+	ok(tab.Receive().NotFound())
+}
+
+func TestUnicastApp(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	s := New(t)
+	app := s.App("/counter", "unicast").Handle(func(q *Query) {
+		var clicked bool
+		if q.Arg("increment", &clicked) && clicked {
+			q.Set("count content", "1")
+			return
+		}
+		q.Put("count", map[string]interface{}{"view": "markdown", "content": "0"})
+	})
+
+	alice, bob := s.Connect("alice"), s.Connect("bob")
+	alice.Watch("/counter")
+	q := app.Next()
+	eq("/counter", q.Route)
+	eq(alice.ID(), q.ClientID)
+	eq("alice", q.Username)
+	m := alice.Receive()
+	eq("count", m.Ops[0]["k"])
+
+	alice.Query("/counter", map[string]interface{}{"increment": true})
+	q = app.Next()
+	var clicked bool
+	ok(q.Arg("increment", &clicked))
+	ok(clicked)
+	m = alice.Receive()
+	eq("count content", m.Ops[0]["k"])
+
+	bob.Quiet(100 * time.Millisecond)
+}
+
+func TestBroadcastApp(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	s := New(t)
+	app := s.App("/chat", "broadcast")
+
+	alice, bob := s.Connect("alice"), s.Connect("bob")
+	alice.Watch("/chat")
+	app.Next()
+	bob.Watch("/chat")
+	app.Next()
+
+	alice.Query("/chat", map[string]interface{}{"message": "hi"})
+	q := app.Next()
+	eq("/chat", q.PageRoute())
+	q.Put("log", map[string]interface{}{"view": "markdown", "content": "hi"})
+	eq(1, len(alice.Receive().Ops))
+	eq(1, len(bob.Receive().Ops))
+	ok(s.Page("/chat") != nil)
+}
+
+func TestRelay(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	s := New(t)
+	app := s.App("/job", "unicast")
+
+	tab := s.Connect("")
+	tab.Query("/job", map[string]interface{}{"start": true})
+	no(app.Next().Relay(`{"d":[{"k":"progress value","v":0.5}]}`))
+	m := tab.Receive()
+	eq("progress value", m.Ops[0]["k"])
+	eq(0.5, m.Ops[0]["v"])
+}
+
+func TestAppFailure(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	s := New(t)
+	app := s.App("/flaky", "unicast")
+	app.Fail(errors.New("unreachable"))
+
+	tab := s.Connect("")
+	tab.Query("/flaky", map[string]interface{}{})
+	time.Sleep(100 * time.Millisecond) // failed app is dropped
+
+	tab.Watch("/flaky")
+	tab.Receive() // meta
+	ok(tab.Receive().NotFound())
+}
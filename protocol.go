@@ -14,20 +14,44 @@
 
 package wave
 
+import (
+	"encoding/json"
+	"time"
+)
+
 // OpsD represents the set of changes to be applied to a Page. This is a discriminated union.
 type OpsD struct {
-	P *PageD `json:"p,omitempty"` // page
-	D []OpD  `json:"d,omitempty"` // deltas
-	R int    `json:"r,omitempty"` // reset
-	U string `json:"u,omitempty"` // redirect
-	E string `json:"e,omitempty"` // error
-	M *Meta  `json:"m,omitempty"` // metadata
+	P *PageD           `json:"p,omitempty"` // page
+	D []OpD            `json:"d,omitempty"` // deltas
+	R int              `json:"r,omitempty"` // reset
+	U string           `json:"u,omitempty"` // redirect
+	E string           `json:"e,omitempty"` // error
+	X string           `json:"x,omitempty"` // error details
+	M *Meta            `json:"m,omitempty"` // metadata
+	F *UploadProgressD `json:"f,omitempty"` // upload progress
+	N *BannerD         `json:"n,omitempty"` // notice
+}
+
+// BannerD represents a notice shown to users across pages, e.g. of maintenance, or an announcement.
+type BannerD struct {
+	Text    string `json:"t"`           // markdown; "" hides the notice
+	Type    string `json:"y,omitempty"` // "info", "warning", etc.
+	Timeout int    `json:"s,omitempty"` // seconds to show the notice for; 0 until dismissed
 }
 
 // Meta represents metadata unrelated to commands
 type Meta struct {
-	Username string `json:"u"` // active user's username
-	Editor   bool   `json:"e"` // can the user edit pages?
+	Username string `json:"u"`           // active user's username
+	Editor   bool   `json:"e"`           // can the user edit pages?
+	Version  int    `json:"v,omitempty"` // browser protocol version spoken by the server
+	Client   string `json:"c,omitempty"` // client ID, for clients that want upload progress
+}
+
+// UploadProgressD represents the progress of a file upload.
+type UploadProgressD struct {
+	ID       string `json:"i"` // upload ID
+	Received int64  `json:"r"` // bytes received
+	Total    int64  `json:"t"` // bytes expected; 0 if unknown
 }
 
 // OpD represents a delta operation (effector)
@@ -47,6 +71,25 @@ type PageD struct {
 	C map[string]CardD `json:"c"` // cards
 }
 
+const pageSnapshotVersion = 1
+
+// PageSnapshot represents a self-contained, portable copy of a page.
+type PageSnapshot struct {
+	Version int       `json:"version"`
+	Route   string    `json:"route"`
+	Time    time.Time `json:"time"`
+	Page    *PageD    `json:"page"`
+}
+
+// ops returns the deltas required to replace a page's contents with this page.
+func (d *PageD) ops() OpsD {
+	ops := []OpD{{}} // drop page
+	for k, c := range d.C {
+		ops = append(ops, OpD{K: k, D: c.D, B: c.B})
+	}
+	return OpsD{D: ops}
+}
+
 // CardD represents the marshaled data for a Card.
 type CardD struct {
 	D map[string]interface{} `json:"d"`           // data
@@ -85,6 +128,21 @@ type CycBufD struct {
 type AppRequest struct {
 	RegisterApp   *RegisterApp   `json:"register_app,omitempty"`
 	UnregisterApp *UnregisterApp `json:"unregister_app,omitempty"`
+	SendApp       *SendApp       `json:"send_app,omitempty"`
+	SetAppMode    *SetAppMode    `json:"set_app_mode,omitempty"`
+}
+
+// SetAppMode represents a request to change the mode of a registered app.
+type SetAppMode struct {
+	Route string `json:"route"`
+	Mode  string `json:"mode"` // "unicast", "multicast" or "broadcast"
+}
+
+// SendApp represents a request from an app to send a message to another app.
+type SendApp struct {
+	From  string          `json:"from"`  // sender app's route
+	Route string          `json:"route"` // recipient app's route
+	Data  json.RawMessage `json:"data"`  // message
 }
 
 // RegisterApp represents a request to register an app.
@@ -94,9 +152,26 @@ type RegisterApp struct {
 	Address   string `json:"address"`
 	KeyID     string `json:"key_id"`
 	KeySecret string `json:"key_secret"`
+	Transport string `json:"transport,omitempty"` // "http" (default) or "grpc"
+	// Optional metadata
+
+	Version         string        `json:"version,omitempty"`          // app version
+	ProtocolVersion int           `json:"protocol_version,omitempty"` // app protocol version implemented by the app; 0 for 1
+	Modes           []string      `json:"modes,omitempty"`            // modes supported by the app; mode must be one of these
+	Routes          []string      `json:"routes,omitempty"`           // additional routes served by the app
+	Schedules       []AppSchedule `json:"schedules,omitempty"`        // cron schedules for timer queries to the app
+
+	token string // app token the app registered with, if any
+}
+
+// AppSchedule represents a cron schedule on which an app wants to receive timer queries.
+type AppSchedule struct {
+	Name string `json:"name,omitempty"` // name, to tell schedules apart; defaults to the cron expression
+	Cron string `json:"cron"`           // cron expression, e.g. "*/15 * * * *"
 }
 
 // UnregisterApp represents a request to unregister an app.
 type UnregisterApp struct {
-	Route string `json:"route"`
+	Route   string `json:"route"`
+	Address string `json:"address,omitempty"` // if set, unregister only the app instance at this address
 }
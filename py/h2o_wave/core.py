@@ -14,23 +14,34 @@
 
 from io import BufferedReader
 import asyncio
+import base64
+import hashlib
+import hmac
 import ipaddress
 import json
 import platform
 import secrets
 import shutil
 import subprocess
-from urllib.parse import urlparse
+from urllib.parse import urlparse, unquote, parse_qsl, urlencode
 from uuid import uuid4
 import warnings
 import logging
 import os
 import os.path
 import sys
+import time
 from typing import List, Dict, Union, Tuple, Any, Optional, IO
 
 import httpx
 
+try:
+    import contextvars  # Python 3.7+ only.
+
+    _trace_parent = contextvars.ContextVar('traceparent', default=None)
+except ImportError:
+    _trace_parent = None
+
 logger = logging.getLogger(__name__)
 
 Primitive = Union[bool, str, int, float, None]
@@ -42,6 +53,12 @@ MULTICAST = 'multicast'
 BROADCAST = 'broadcast'
 
 
+def _trace_headers() -> dict:
+    # The W3C trace context of the query being handled, if traced, so that the Wave server can tie page updates to it.
+    trace_parent = _trace_parent.get() if _trace_parent else None
+    return {'traceparent': trace_parent} if trace_parent else {}
+
+
 def _get_env(key: str, value: Any):
     return os.environ.get(f'H2O_WAVE_{key}', value)
 
@@ -63,10 +80,49 @@ class _Config:
         self.hub_access_key_secret: str = _get_env('ACCESS_KEY_SECRET', 'access_key_secret')
         self.app_access_key_id: str = _get_env('APP_ACCESS_KEY_ID', None) or secrets.token_urlsafe(16)
         self.app_access_key_secret: str = _get_env('APP_ACCESS_KEY_SECRET', None) or secrets.token_urlsafe(16)
+        self.app_token: Optional[str] = _get_env('APP_TOKEN', None)
+        self.request_signing_secret: Optional[str] = _get_env('REQUEST_SIGNING_SECRET', None)
 
 
 _config = _Config()
 
+
+def _signing_headers(method: str, url: str, headers: httpx.Headers, body: Union[str, bytes]) -> dict:
+    # Signs a request to the Wave server, if the server requires it, so that the server can verify it came from the app.
+    # The signature covers the method, path, query and Wave-* headers, in the canonical form described in the security
+    # docs, followed by the body.
+    if not _config.request_signing_secret:
+        return {}
+    timestamp, nonce = str(int(time.time())), secrets.token_hex(16)
+    if isinstance(body, str):
+        body = body.encode('utf-8')
+    signed = {k.lower(): ','.join(headers.get_list(k)) for k in headers.keys()
+              if k.lower().startswith('wave-') and k.lower() != 'wave-signature'}
+    signed.update({'wave-timestamp': timestamp, 'wave-nonce': nonce})
+    u = urlparse(url)
+    query = urlencode(sorted(parse_qsl(u.query, keep_blank_values=True), key=lambda kv: kv[0]))
+    canonical = f'{method}\n{unquote(u.path)}\n{query}\n' + ''.join(f'{k}:{signed[k]}\n' for k in sorted(signed)) + '\n'
+    message = canonical.encode('utf-8') + body
+    signature = hmac.new(_config.request_signing_secret.encode('utf-8'), message, hashlib.sha256).hexdigest()
+    return {'Wave-Timestamp': timestamp, 'Wave-Nonce': nonce, 'Wave-Signature': f'sha256={signature}'}
+
+
+class _Auth(httpx.Auth):
+    # Authenticates requests to the Wave server with the access key, unless authorized otherwise (e.g. with an app
+    # token), and signs writes (including file uploads), if the server requires it.
+    requires_request_body = True
+
+    def __init__(self):
+        credentials = f'{_config.hub_access_key_id}:{_config.hub_access_key_secret}'.encode('utf-8')
+        self._authorization = 'Basic ' + base64.b64encode(credentials).decode('ascii')
+
+    def auth_flow(self, request: httpx.Request):
+        if 'Authorization' not in request.headers:
+            request.headers['Authorization'] = self._authorization
+        if request.method in ('PATCH', 'POST', 'PUT', 'DELETE'):
+            request.headers.update(_signing_headers(request.method, str(request.url), request.headers, request.content))
+        yield request
+
 _key_sep = ' '
 _content_type_json = {'Content-type': 'application/json'}
 
@@ -623,7 +679,7 @@ class Site:
 
     def __init__(self):
         self._http = httpx.Client(
-            auth=(_config.hub_access_key_id, _config.hub_access_key_secret),
+            auth=_Auth(),
             verify=False,
         )
         self.cache = _ServerCache(self._http)
@@ -636,7 +692,8 @@ class Site:
         page.drop()
 
     def _save(self, url: str, patch: str):
-        res = self._http.patch(_rebase(_config.hub_address, url), content=patch)
+        url = _rebase(_config.hub_address, url)
+        res = self._http.patch(url, content=patch, headers=_trace_headers())
         if res.status_code != 200:
             raise ServiceError(f'Request failed (code={res.status_code}): {res.text}')
 
@@ -655,12 +712,14 @@ class Site:
             raise ServiceError(f'Request failed (code={res.status_code}): {res.text}')
         return res.json()
 
-    def upload(self, files: List[str]) -> List[str]:
+    def upload(self, files: List[str], owner: Optional[str] = None, public: bool = False) -> List[str]:
         """
         Upload local files to the site.
 
         Args:
             files: A list of file paths of the files to be uploaded..
+            owner: Subject of the only user allowed to download the files, e.g. `q.auth.subject`. Defaults to any signed-in user.
+            public: True to allow anyone to download the files, even if not signed in.
 
         Returns:
             A list of remote URLs for the uploaded files, in order.
@@ -675,7 +734,7 @@ class Site:
 
         # If we know the path of waved and running app on the same machine,
         # we can simply copy the files instead of making an HTTP request.
-        if _is_loopback_address() and not skip_local_upload and waved_dir and data_dir:
+        if _is_loopback_address() and not skip_local_upload and waved_dir and data_dir and not owner and not public:
             try:
                 uploaded_files = []
                 for f in files:
@@ -702,7 +761,7 @@ class Site:
         for f in files:
             uploaded_files.append(('files', (os.path.basename(f), open(f, 'rb'))))
 
-        res = self._http.post(f'{_config.hub_address}_f/', files=uploaded_files)
+        res = self._http.post(f'{_config.hub_address}_f/', headers=_file_access_headers(owner, public), files=uploaded_files)
 
         for _, f in uploaded_files:
             f[1].close()
@@ -711,13 +770,15 @@ class Site:
             return json.loads(res.text)['files']
         raise ServiceError(f'Upload failed (code={res.status_code}): {res.text}')
 
-    def upload_dir(self, directory: str) -> str:
+    def upload_dir(self, directory: str, owner: Optional[str] = None, public: bool = False) -> str:
         """
         WARNING: Experimental and subject to change.
         Upload whole directory to the site with directory structure preserved.
 
         Args:
             directory: Folder to be uploaded.
+            owner: Subject of the only user allowed to download the files, e.g. `q.auth.subject`. Defaults to any signed-in user.
+            public: True to allow anyone to download the files, even if not signed in.
 
         Returns:
             A list of remote URLs for the uploaded directory (always size of 1).
@@ -731,7 +792,7 @@ class Site:
 
         # If we know the path of waved and running app on the same machine,
         # we can simply copy the files instead of making an HTTP request.
-        if _is_loopback_address() and not skip_local_upload and waved_dir and data_dir:
+        if _is_loopback_address() and not skip_local_upload and waved_dir and data_dir and not owner and not public:
             try:
                 uuid = str(uuid4())
                 dst = os.path.join(waved_dir, data_dir, 'f', uuid)
@@ -754,7 +815,7 @@ class Site:
         for f in _get_files_in_directory(directory, []):
             upload_files.append(('files', (os.path.relpath(f, directory), open(f, 'rb'))))
 
-        res = self._http.post(f'{_config.hub_address}_f/', headers={'Wave-Directory-Upload': "True"}, files=upload_files)
+        res = self._http.post(f'{_config.hub_address}_f/', headers={'Wave-Directory-Upload': "True", **_file_access_headers(owner, public)}, files=upload_files)
 
         for _, f in upload_files:
             f[1].close()
@@ -789,6 +850,48 @@ class Site:
 
         return filepath
 
+    def sign(self, files: List[str], expiry: int = 3600) -> List[str]:
+        """
+        Create time-limited URLs for uploaded files, which anyone can download until the URLs expire, without signing in.
+        Useful for embedding downloadable artifacts in pages shared with users who cannot otherwise access the files.
+
+        Args:
+            files: A list of paths of uploaded files, as returned by `upload()`.
+            expiry: Lifetime of the URLs, in seconds. Defaults to one hour.
+
+        Returns:
+            A list of signed URLs for the files, in order.
+        """
+        req = dict(files=files, expiry=expiry)
+        res = self._http.post(f'{_config.hub_address}_f/_sign', headers=_content_type_json, content=marshal(req))
+        if res.status_code == 200:
+            return json.loads(res.text)['files']
+        raise ServiceError(f'Sign failed (code={res.status_code}): {res.text}')
+
+    def stream(self, url: str, filename: Optional[str] = None, headers: Optional[Dict[str, str]] = None,
+               owner: Optional[str] = None, public: bool = False, expiry: int = 3600, once: bool = False) -> str:
+        """
+        Register a download that the Wave server streams to the browser directly from its source, without buffering it,
+        e.g. a large export generated on the fly by an endpoint of the app, or an object in object storage.
+
+        Args:
+            url: The source: an http(s) URL reachable from the Wave server, or an object storage URL, e.g. "s3://bucket/key".
+            filename: The name to save the download as. Defaults to the last part of the URL's path.
+            headers: Headers to send to http(s) sources, e.g. Authorization.
+            owner: If set, only the user with this subject may download. Defaults to any signed-in user.
+            public: If True, anyone may download, even if not signed in.
+            expiry: Lifetime of the download, in seconds. Defaults to one hour.
+            once: If True, the download can be made only once.
+
+        Returns:
+            The path to download from.
+        """
+        req = dict(url=url, filename=filename, headers=headers, owner=owner, public=public, expiry=expiry, once=once)
+        res = self._http.post(f'{_config.hub_address}_dl/', headers=_content_type_json, content=marshal(req))
+        if res.status_code == 200:
+            return json.loads(res.text)['path']
+        raise ServiceError(f'Stream failed (code={res.status_code}): {res.text}')
+
     def unload(self, url: str):
         """
         Delete an uploaded file from the site.
@@ -855,7 +958,7 @@ class AsyncSite:
 
     def __init__(self):
         self._http = httpx.AsyncClient(
-            auth=(_config.hub_access_key_id, _config.hub_access_key_secret),
+            auth=_Auth(),
             verify=False,
         )
         self.cache = _AsyncServerCache(self._http)
@@ -868,7 +971,8 @@ class AsyncSite:
         page.drop()
 
     async def _save(self, url: str, patch: str):
-        res = await self._http.patch(_rebase(_config.hub_address, url), content=patch)
+        url = _rebase(_config.hub_address, url)
+        res = await self._http.patch(url, content=patch, headers=_trace_headers())
         if res.status_code != 200:
             raise ServiceError(f'Request failed (code={res.status_code}): {res.text}')
 
@@ -887,13 +991,15 @@ class AsyncSite:
             raise ServiceError(f'Request failed (code={res.status_code}): {res.text}')
         return res.json()
 
-    async def upload_dir(self, directory: str) -> str:
+    async def upload_dir(self, directory: str, owner: Optional[str] = None, public: bool = False) -> str:
         """
         WARNING: Experimental and subject to change.
         Upload whole directory to the site with directory structure preserved.
 
         Args:
             directory: Folder to be uploaded.
+            owner: Subject of the only user allowed to download the files, e.g. `q.auth.subject`. Defaults to any signed-in user.
+            public: True to allow anyone to download the files, even if not signed in.
 
         Returns:
             A list of remote URLs for the uploaded directory (always size of 1).
@@ -907,7 +1013,7 @@ class AsyncSite:
 
         # If we know the path of waved and running app on the same machine,
         # we can simply copy the files instead of making an HTTP request.
-        if _is_loopback_address() and not skip_local_upload and waved_dir and data_dir:
+        if _is_loopback_address() and not skip_local_upload and waved_dir and data_dir and not owner and not public:
             try:
                 uuid = str(uuid4())
                 dst = os.path.join(waved_dir, data_dir, 'f', uuid)
@@ -926,7 +1032,7 @@ class AsyncSite:
         for f in _get_files_in_directory(directory, []):
             upload_files.append(('files', (os.path.relpath(f, directory), open(f, 'rb'))))
 
-        res = await self._http.post(f'{_config.hub_address}_f/', headers={'Wave-Directory-Upload': "True"}, files=upload_files)
+        res = await self._http.post(f'{_config.hub_address}_f/', headers={'Wave-Directory-Upload': "True", **_file_access_headers(owner, public)}, files=upload_files)
 
         for _, f in upload_files:
             f[1].close()
@@ -935,12 +1041,14 @@ class AsyncSite:
             return json.loads(res.text)['files']
         raise ServiceError(f'Upload failed (code={res.status_code}): {res.text}')
 
-    async def upload(self, files: List[str]) -> List[str]:
+    async def upload(self, files: List[str], owner: Optional[str] = None, public: bool = False) -> List[str]:
         """
         Upload local files to the site.
 
         Args:
             files: A list of file paths of the files to be uploaded.
+            owner: Subject of the only user allowed to download the files, e.g. `q.auth.subject`. Defaults to any signed-in user.
+            public: True to allow anyone to download the files, even if not signed in.
 
         Returns:
             A list of remote URLs for the uploaded files, in order.
@@ -955,7 +1063,7 @@ class AsyncSite:
 
         # If we know the path of waved and running app on the same machine,
         # we can simply copy the files instead of making an HTTP request.
-        if _is_loopback_address() and not skip_local_upload and waved_dir and data_dir:
+        if _is_loopback_address() and not skip_local_upload and waved_dir and data_dir and not owner and not public:
             try:
                 tasks = []
                 for f in files:
@@ -982,7 +1090,7 @@ class AsyncSite:
             upload_files.append(('files', (os.path.basename(f), file_handle)))
             file_handles.append(file_handle)
 
-        res = await self._http.post(f'{_config.hub_address}_f/', files=upload_files)
+        res = await self._http.post(f'{_config.hub_address}_f/', headers=_file_access_headers(owner, public), files=upload_files)
 
         for h in file_handles:
             h.close()
@@ -1015,6 +1123,48 @@ class AsyncSite:
 
         return filepath
 
+    async def sign(self, files: List[str], expiry: int = 3600) -> List[str]:
+        """
+        Create time-limited URLs for uploaded files, which anyone can download until the URLs expire, without signing in.
+        Useful for embedding downloadable artifacts in pages shared with users who cannot otherwise access the files.
+
+        Args:
+            files: A list of paths of uploaded files, as returned by `upload()`.
+            expiry: Lifetime of the URLs, in seconds. Defaults to one hour.
+
+        Returns:
+            A list of signed URLs for the files, in order.
+        """
+        req = dict(files=files, expiry=expiry)
+        res = await self._http.post(f'{_config.hub_address}_f/_sign', headers=_content_type_json, content=marshal(req))
+        if res.status_code == 200:
+            return json.loads(res.text)['files']
+        raise ServiceError(f'Sign failed (code={res.status_code}): {res.text}')
+
+    async def stream(self, url: str, filename: Optional[str] = None, headers: Optional[Dict[str, str]] = None,
+                     owner: Optional[str] = None, public: bool = False, expiry: int = 3600, once: bool = False) -> str:
+        """
+        Register a download that the Wave server streams to the browser directly from its source, without buffering it,
+        e.g. a large export generated on the fly by an endpoint of the app, or an object in object storage.
+
+        Args:
+            url: The source: an http(s) URL reachable from the Wave server, or an object storage URL, e.g. "s3://bucket/key".
+            filename: The name to save the download as. Defaults to the last part of the URL's path.
+            headers: Headers to send to http(s) sources, e.g. Authorization.
+            owner: If set, only the user with this subject may download. Defaults to any signed-in user.
+            public: If True, anyone may download, even if not signed in.
+            expiry: Lifetime of the download, in seconds. Defaults to one hour.
+            once: If True, the download can be made only once.
+
+        Returns:
+            The path to download from.
+        """
+        req = dict(url=url, filename=filename, headers=headers, owner=owner, public=public, expiry=expiry, once=once)
+        res = await self._http.post(f'{_config.hub_address}_dl/', headers=_content_type_json, content=marshal(req))
+        if res.status_code == 200:
+            return json.loads(res.text)['path']
+        raise ServiceError(f'Stream failed (code={res.status_code}): {res.text}')
+
     async def unload(self, url: str):
         """
         Delete an uploaded file from the site.
@@ -1072,6 +1222,15 @@ class AsyncSite:
         raise ServiceError(f'Proxy request failed (code={res.status_code}): {res.text}')
 
 
+def _file_access_headers(owner: Optional[str], public: bool) -> Dict[str, str]:
+    headers = {}
+    if owner:
+        headers['Wave-File-Owner'] = owner
+    if public:
+        headers['Wave-File-Public'] = 'True'
+    return headers
+
+
 async def _copy_in_subprocess(args: List[str], uuid: str, f='') -> str:
     p = await asyncio.create_subprocess_exec(*args, stderr=subprocess.PIPE, stdout=subprocess.DEVNULL)
     _, err = await p.communicate()
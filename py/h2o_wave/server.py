@@ -29,6 +29,7 @@ import pickle
 import traceback
 import base64
 import binascii
+import secrets
 from typing import Dict, Tuple, Callable, Any, Awaitable, Optional
 from urllib.parse import urlparse
 
@@ -42,7 +43,7 @@ from starlette.responses import PlainTextResponse
 from starlette.background import BackgroundTask
 
 from .core import Expando, expando_to_dict, _config, marshal, _content_type_json, AsyncSite, _get_env, UNICAST, \
-    MULTICAST
+    MULTICAST, _trace_parent, _Auth
 from .ui import markdown_card
 
 logger = logging.getLogger(__name__)
@@ -208,15 +209,19 @@ WebAppState = Tuple[Expando, Dict[str, Expando], Dict[str, Expando]]
 class _Wave:
     def __init__(self):
         self._http = httpx.AsyncClient(
-            auth=(_config.hub_access_key_id, _config.hub_access_key_secret),
+            auth=_Auth(),
             verify=False,
         )
 
     async def call(self, method: str, **kwargs):
+        headers = _content_type_json
+        if _config.app_token:  # authenticate with the app token instead of the access key
+            headers = {**headers, 'Authorization': f'Bearer {_config.app_token}'}
+        content = marshal({method: kwargs})
         return await self._http.post(
             _config.hub_address,
-            headers=_content_type_json,
-            content=marshal({method: kwargs}),
+            headers=headers,
+            content=content,
         )
 
 
@@ -267,6 +272,7 @@ class _App:
                     address=app_address,
                     key_id=_config.app_access_key_id,
                     key_secret=_config.app_access_key_secret,
+                    transport=_get_env('APP_TRANSPORT', ''),
                 )
                 logger.debug('Register: success!')
                 break
@@ -283,7 +289,8 @@ class _App:
     async def _unregister(self):
         logger.debug(f'Unregistering app...')
         try:
-            await self._wave.call('unregister_app', route=self._route)
+            # Unregister only this instance, leaving other instances of the app, if any, serving the route.
+            await self._wave.call('unregister_app', route=self._route, address=_get_env('APP_ADDRESS', _config.app_address))
             logger.debug('Unregister: success!')
         # Happens during killing reloader process (dev mode) - server process killed before starlette on_shutdown hook.
         except httpx.ConnectError:
@@ -293,6 +300,11 @@ class _App:
         basic_auth = req.headers.get("Authorization")
         if basic_auth is None:
             return PlainTextResponse(content='Unauthorized', status_code=401)
+        if _config.app_token:  # registered with an app token, which the Wave server sends back
+            scheme, _, token = basic_auth.partition(' ')
+            if scheme.lower() != 'bearer' or not secrets.compare_digest(token.strip(), _config.app_token):
+                return PlainTextResponse(content='Unauthorized', status_code=401)
+            return await self._accept(req)
         try:
             scheme, credentials = basic_auth.split()
             if scheme.lower() != 'basic':
@@ -305,6 +317,9 @@ class _App:
         if key_id != _config.app_access_key_id or key_secret != _config.app_access_key_secret:
             return PlainTextResponse(content='Unauthorized', status_code=401)
 
+        return await self._accept(req)
+
+    async def _accept(self, req: Request):
         client_id = req.headers.get('Wave-Client-ID')
         subject = req.headers.get('Wave-Subject-ID')
         username = req.headers.get('Wave-Username')
@@ -312,11 +327,14 @@ class _App:
         refresh_token = req.headers.get('Wave-Refresh-Token')
         session_id = req.headers.get('Wave-Session-ID')
         auth = Auth(username, subject, access_token, refresh_token, session_id)
+        trace_parent = req.headers.get('traceparent')
         args = await req.json()
 
-        return PlainTextResponse('', background=BackgroundTask(self._process, client_id, auth, args))
+        return PlainTextResponse('', background=BackgroundTask(self._process, client_id, auth, args, trace_parent))
 
-    async def _process(self, client_id: str, auth: Auth, args: dict):
+    async def _process(self, client_id: str, auth: Auth, args: dict, trace_parent: Optional[str] = None):
+        if trace_parent and _trace_parent:
+            _trace_parent.set(trace_parent)
         logger.debug(f'user: {auth.username}, client: {client_id}')
         logger.debug(args)
         app_state, user_state, client_state = self._state
@@ -6,6 +6,7 @@ import unittest
 from .test_expando import *
 from .test_python_server import *
 from .test_python_server_async import *
+from .test_tracing import *
 
 if __name__ == '__main__':
     wave_server_process = None
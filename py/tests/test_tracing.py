@@ -0,0 +1,67 @@
+# Copyright 2020 H2O.ai, Inc.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+from h2o_wave.core import Site, AsyncSite, _trace_headers, _trace_parent
+import asyncio
+import contextvars
+import unittest
+from unittest import mock
+
+trace_parent = '00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01'
+
+
+def traced(f, *args):
+    # Run f in a fresh context, as the server does for each query, carrying the caller's trace context.
+    def run():
+        _trace_parent.set(trace_parent)
+        return f(*args)
+
+    return contextvars.copy_context().run(run)
+
+
+class TestTracing(unittest.TestCase):
+    def test_trace_headers_untraced(self):
+        assert contextvars.Context().run(_trace_headers) == {}
+
+
+    def test_trace_headers_traced(self):
+        assert traced(_trace_headers) == {'traceparent': trace_parent}
+
+
+    def test_trace_headers_do_not_leak(self):
+        traced(_trace_headers)
+        assert _trace_headers() == {}
+
+
+    def test_site_save_propagates_trace(self):
+        site = Site.__new__(Site)
+        site._http = mock.Mock()
+        site._http.patch.return_value = mock.Mock(status_code=200)
+        traced(site._save, '/test', '{}')
+        assert site._http.patch.call_args[1]['headers'] == {'traceparent': trace_parent}
+
+        site._save('/test', '{}')
+        assert site._http.patch.call_args[1]['headers'] == {}
+
+
+    def test_async_site_save_propagates_trace(self):
+        site = AsyncSite.__new__(AsyncSite)
+        site._http = mock.Mock()
+
+        async def patch(*args, **kwargs):
+            return mock.Mock(status_code=200)
+
+        site._http.patch = mock.Mock(side_effect=patch)
+        traced(lambda: asyncio.run(site._save('/test', '{}')))
+        assert site._http.patch.call_args[1]['headers'] == {'traceparent': trace_parent}
@@ -0,0 +1,305 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Quota represents limits on the contents of a page. Zero values indicate no limit.
+type Quota struct {
+	MaxSize  int64 // max marshaled size of page, in bytes
+	MaxCards int   // max cards on page
+}
+
+func (q Quota) enabled() bool {
+	return q.MaxSize > 0 || q.MaxCards > 0
+}
+
+// tighter returns the stricter of the limits of two quotas.
+func (q Quota) tighter(o Quota) Quota {
+	if o.MaxSize > 0 && (q.MaxSize <= 0 || o.MaxSize < q.MaxSize) {
+		q.MaxSize = o.MaxSize
+	}
+	if o.MaxCards > 0 && (q.MaxCards <= 0 || o.MaxCards < q.MaxCards) {
+		q.MaxCards = o.MaxCards
+	}
+	return q
+}
+
+// Quotas represents a default page quota, plus per-route overrides (applicable to routes and their sub-routes),
+// and per-app quotas, by API access key ID, applicable to the pages written with that key, wherever they are.
+type Quotas struct {
+	Default Quota
+	Routes  map[string]Quota
+	Apps    map[string]Quota
+}
+
+// newQuotas returns page quotas with the given default, per-route overrides and per-app quotas, or nil if there are
+// no quotas.
+func newQuotas(q Quota, routes, apps map[string]Quota) *Quotas {
+	if !q.enabled() && len(routes) == 0 && len(apps) == 0 {
+		return nil
+	}
+	return &Quotas{q, routes, apps}
+}
+
+// at returns the quota for a patch to a route by actor (see PageEvent): the longest matching route override, if any,
+// else the default, further limited by the quota of the app's access key, if the actor is one.
+func (qs *Quotas) at(route, actor string) Quota {
+	q, n := qs.Default, -1
+	for prefix, rq := range qs.Routes {
+		if len(prefix) > n && matchRoutePrefix(prefix, route) {
+			q, n = rq, len(prefix)
+		}
+	}
+	if strings.HasPrefix(actor, "key:") {
+		if aq, ok := qs.Apps[strings.TrimPrefix(actor, "key:")]; ok {
+			q = q.tighter(aq)
+		}
+	}
+	return q
+}
+
+// QuotaError indicates that a patch was rejected because it would exceed a page quota, or its tenant's page quota.
+type QuotaError struct {
+	Route string `json:"route"` // the tenant's route prefix, for tenant page quotas
+	Quota string `json:"quota"` // "size", "cards" or "pages"
+	Limit int64  `json:"limit"`
+	Value int64  `json:"value"`
+}
+
+func (e *QuotaError) Error() string {
+	if e.Quota == "pages" {
+		return fmt.Sprintf("tenant page quota exceeded for %s: want <= %d pages, got %d", e.Route, e.Limit, e.Value)
+	}
+	return fmt.Sprintf("page %s quota exceeded for %s: want <= %d, got %d", e.Quota, e.Route, e.Limit, e.Value)
+}
+
+// QuotaErrorD represents the error response for a rejected patch.
+type QuotaErrorD struct {
+	Error string      `json:"error"`
+	Quota *QuotaError `json:"quota"`
+}
+
+func writeQuotaError(w http.ResponseWriter, err *QuotaError) {
+	b, _ := json.Marshal(QuotaErrorD{Error: "quota_exceeded", Quota: err})
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write(b)
+}
+
+// writePatchError fails a request to patch a page: with details if over quota, or with a 503 response if the page
+// could not be read back from the page store, so that the request can be retried.
+func writePatchError(w http.ResponseWriter, err error) {
+	if qerr, ok := err.(*QuotaError); ok {
+		writeQuotaError(w, qerr)
+		return
+	}
+	if err == errPageUnavailable {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+const (
+	estimatedTupleSize = 8  // bytes; upper bound for an empty tuple, marshaled
+	estimatedCardSize  = 16 // bytes; upper bound for an empty card, marshaled, beyond its key and data
+)
+
+// checkQuota checks if applying ops of marshaled size n to page keeps it within quota, and
+// returns the page's estimated size after the patch. Must be called under the page's write-lock, so that the page
+// cannot change between checking and applying the patch.
+//
+// The page size is tracked as an upper-bound estimate, which is cheap to maintain: a patch cannot grow a page
+// by more than its own size, plus the space for any empty buffers it allocates. The page is measured only when the
+// estimate exceeds the quota.
+func (site *Site) checkQuota(url string, page *Page, q Quota, ops OpsD, data []byte) (int64, error) {
+	size := page.bytes()
+	cards := make(map[string]bool, len(page.cards))
+	for k := range page.cards {
+		cards[k] = true
+	}
+
+	for _, op := range ops.D {
+		if len(op.K) == 0 { // drop page
+			size = 0
+			cards = make(map[string]bool)
+			continue
+		}
+		if op.D != nil {
+			cards[op.K] = true
+		} else if op.C == nil && op.F == nil && op.V == nil && op.M == nil {
+			delete(cards, op.K) // no-op if K is not a card
+		}
+	}
+	growth := estimatedGrowth(ops, data)
+
+	if q.MaxCards > 0 && len(cards) > q.MaxCards {
+		return 0, &QuotaError{url, "cards", int64(q.MaxCards), int64(len(cards))}
+	}
+
+	size += growth
+	if q.MaxSize > 0 && size > q.MaxSize { // estimate exceeded; measure.
+		var err error
+		if size, err = site.measure(page, ops); err != nil {
+			return 0, err
+		}
+		if size > q.MaxSize {
+			return 0, &QuotaError{url, "size", q.MaxSize, size}
+		}
+	}
+	return size, nil
+}
+
+// checkTenantPages checks if a patch to url keeps the url's tenant, if any, within the tenant page quota, i.e. if the
+// patch updates or drops a page, or the tenant has fewer pages than the quota, counting pages evicted to the page store.
+// Pages are counted when created, without locking out concurrent patches, so that pages created concurrently may
+// briefly take a tenant over the quota.
+func (site *Site) checkTenantPages(url string, ops OpsD) error {
+	if site.tenantPages <= 0 || len(ops.D) == 1 && len(ops.D[0].K) == 0 {
+		return nil
+	}
+	tenant, _ := splitTenantRoute(url)
+	if len(tenant) == 0 {
+		return nil
+	}
+	if _, ok := site.pages.get(url); ok || site.isEvicted(url) {
+		return nil
+	}
+	prefix := tenantRoutePrefix + tenant
+	n := 0
+	site.pages.each(func(url string, _ *Page) {
+		if matchRoutePrefix(prefix, url) {
+			n++
+		}
+	})
+	site.RLock()
+	for url := range site.evicted {
+		if matchRoutePrefix(prefix, url) {
+			n++
+		}
+	}
+	site.RUnlock()
+	if n >= site.tenantPages {
+		return &QuotaError{prefix, "pages", int64(site.tenantPages), int64(n + 1)}
+	}
+	return nil
+}
+
+// emptyPageSize is the size of a page without cards, marshaled.
+var emptyPageSize = int64(len(`{"p":{"c":{}}}`))
+
+// measure returns the marshaled size of page after applying ops, without applying them: the page as marshaled now,
+// less the cards ops change, plus copies of those cards with ops applied. Must be called under the page's lock.
+func (site *Site) measure(page *Page, ops OpsD) (int64, error) {
+	start := 0 // ops after the page was last dropped, if at all
+	for i, op := range ops.D {
+		if len(op.K) == 0 {
+			start = i + 1
+		}
+	}
+	size, n := emptyPageSize, 0
+	if start == 0 {
+		if page.cache != nil {
+			size = int64(len(page.cache))
+		} else {
+			b, err := json.Marshal(OpsD{P: page.dump()})
+			if err != nil {
+				return 0, err
+			}
+			size = int64(len(b))
+		}
+		n = len(page.cards)
+	}
+	if n > 0 {
+		size++ // as if each card were followed by a comma
+	}
+
+	changed := newPage()
+	for _, op := range ops.D[start:] {
+		k := cardKey(op.K)
+		if _, ok := changed.cards[k]; ok {
+			continue
+		}
+		card, ok := page.cards[k]
+		if !ok || start > 0 {
+			continue
+		}
+		b, err := json.Marshal(card.dump())
+		if err != nil {
+			return 0, err
+		}
+		var d CardD
+		if err := json.Unmarshal(b, &d); err != nil {
+			return 0, err
+		}
+		changed.cards[k] = loadCard(site.ns, d)
+		size -= cardEntrySize(k, b)
+		n--
+	}
+	for _, op := range ops.D[start:] {
+		changed.apply(site.ns, op)
+	}
+	for k, card := range changed.cards {
+		b, err := json.Marshal(card.dump())
+		if err != nil {
+			return 0, err
+		}
+		size += cardEntrySize(k, b)
+		n++
+	}
+	if n > 0 {
+		size--
+	}
+	return size, nil
+}
+
+// cardEntrySize returns the size of a card marshaled as b, within a marshaled page, followed by a comma.
+func cardEntrySize(k string, b []byte) int64 {
+	key, _ := json.Marshal(k)
+	return int64(len(key) + 1 + len(b) + 1)
+}
+
+// estimatedGrowth returns an upper bound of how much applying ops of marshaled size n could grow a page by, in bytes:
+// a patch cannot grow a page by more than its own size, plus the space for any cards and empty buffers it allocates.
+func estimatedGrowth(ops OpsD, data []byte) int64 {
+	growth := int64(len(data))
+	for _, op := range ops.D {
+		if op.D != nil {
+			growth += estimatedCardSize
+			for _, b := range op.B {
+				growth += estimatedBufSize(b)
+			}
+		} else if op.C != nil || op.F != nil {
+			growth += estimatedBufSize(BufD{C: op.C, F: op.F})
+		}
+	}
+	return growth
+}
+
+func estimatedBufSize(b BufD) int64 {
+	if b.C != nil && len(b.C.D) == 0 {
+		return int64(b.C.N) * estimatedTupleSize
+	}
+	if b.F != nil && len(b.F.D) == 0 {
+		return int64(b.F.N) * estimatedTupleSize
+	}
+	return 0
+}
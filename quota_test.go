@@ -0,0 +1,138 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestQuotasAt(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	ok(newQuotas(Quota{}, nil, nil) == nil, "no quotas")
+	qs := newQuotas(Quota{MaxSize: 1000, MaxCards: 10}, map[string]Quota{
+		"/dashboards":       {MaxSize: 4000},
+		"/dashboards/kiosk": {MaxCards: 2},
+	}, map[string]Quota{
+		"reports": {MaxSize: 2000, MaxCards: 5},
+	})
+	eq(qs.at("/", ""), Quota{1000, 10})
+	eq(qs.at("/dashboards/sales", ""), Quota{4000, 0})
+	eq(qs.at("/dashboards/kiosk/1", ""), Quota{0, 2}) // longest match
+	eq(qs.at("/dashboards/sales", "key:reports"), Quota{2000, 5})
+	eq(qs.at("/dashboards/kiosk", "key:reports"), Quota{2000, 2}) // tighter of the two
+	eq(qs.at("/", "key:reports"), Quota{1000, 5})
+	eq(qs.at("/", "user:reports"), Quota{1000, 10}) // not an app
+	eq(qs.at("/", "key:other"), Quota{1000, 10})
+}
+
+func TestPageQuota(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	site := newSite()
+	site.setQuotas(newQuotas(Quota{}, map[string]Quota{"/kiosk": {MaxCards: 1}}, map[string]Quota{"tiny": {MaxSize: 64}}))
+
+	no(site.patch("/kiosk", []byte(`{"d":[{"k":"a","d":{"view":"markdown"}}]}`)))
+	err := site.patch("/kiosk", []byte(`{"d":[{"k":"b","d":{"view":"markdown"}}]}`))
+	eq(err, &QuotaError{"/kiosk", "cards", 1, 2})
+	eq(len(site.at("/kiosk").cards), 1)                                                     // rejected in its entirety
+	no(site.patch("/kiosk", []byte(`{"d":[{"k":"a"},{"k":"b","d":{"view":"markdown"}}]}`))) // replaced
+
+	_, err = site.update("/new", []byte(`{"d":[{"k":"a","d":{"content":"`+strings.Repeat("x", 100)+`"}}]}`), false, "key:tiny")
+	_, isQuotaErr := err.(*QuotaError)
+	ok(isQuotaErr, "over app quota")
+	ok(site.at("/new") == nil, "page not created")
+	_, err = site.update("/new", []byte(`{"d":[{"k":"a","d":{"content":"x"}}]}`), false, "key:tiny")
+	no(err)
+	_, err = site.update("/new", []byte(`{"d":[{"k":"b","d":{"content":"`+strings.Repeat("x", 100)+`"}}]}`), false, "key:other")
+	no(err) // other apps are not held to the quota
+}
+
+func TestPageQuotaMeasure(t *testing.T) {
+	_, ok, no := assert.Assert(t)
+	site := newSite()
+	no(site.patch("/foo", []byte(`{"d":[{"k":"a","d":{"view":"markdown","title":"A","content":"Hello"}},{"k":"b","d":{"view":"markdown","title":"B"}}]}`)))
+	site.at("/foo").marshal()
+
+	for _, data := range []string{
+		`{"d":[{"k":"a title","v":"A longer title"}]}`,
+		`{"d":[{"k":"c","d":{"view":"markdown","title":"C"}}]}`,
+		`{"d":[{"k":"a"}]}`,
+		`{"d":[{"k":"a"},{"k":"b"}]}`,
+		`{"d":[{"k":"a"},{"k":"a","d":{"view":"markdown"}}]}`,
+		`{"d":[{"k":"b title","v":"B2"},{"k":"c","d":{"view":"markdown"}},{"k":"c title","v":"C"}]}`,
+		`{"d":[{"k":"a"},{},{"k":"z","d":{"view":"markdown","title":"Z"}}]}`,
+		`{"d":[{}]}`,
+	} {
+		var ops OpsD
+		no(json.Unmarshal([]byte(data), &ops))
+		page := site.at("/foo")
+		page.Lock()
+		size, err := site.measure(page, ops)
+		page.Unlock()
+		no(err)
+
+		p := loadPage(site.ns, page.dump())
+		no(p.patch(site.ns, []byte(data)))
+		b, err := json.Marshal(OpsD{P: p.dump()})
+		no(err)
+		ok(size == int64(len(b)), data, size, len(b))
+	}
+}
+
+func TestPageQuotaConcurrent(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	site := newSite()
+	site.setQuotas(newQuotas(Quota{MaxCards: 5}, nil, nil))
+	var (
+		wg       sync.WaitGroup
+		mux      sync.Mutex
+		accepted int
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := site.patch("/foo", []byte(`{"d":[{"k":"c`+strconv.Itoa(i)+`","d":{"view":"markdown"}}]}`)); err == nil {
+				mux.Lock()
+				accepted++
+				mux.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	eq(accepted, 5) // checked and applied atomically
+	eq(len(site.at("/foo").cards), 5)
+}
+
+func TestPageQuotaEdit(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	site := newSite()
+	site.setQuotas(newQuotas(Quota{}, map[string]Quota{"/kiosk": {MaxCards: 1}}, nil))
+	broker := newBroker(site, true, false, true)
+	c := newClient("192.0.2.1", nil, anonymous, "", broker, nil, true, false, false, browserProtocolVersion, "/")
+
+	c.handle([]byte(`* /kiosk {"d":[{"k":"a","d":{"view":"markdown"}}]}`))
+	ok(len(c.data) == 0, "accepted")
+	c.handle([]byte(`* /kiosk {"d":[{"k":"b","d":{"view":"markdown"}}]}`))
+	var ops OpsD
+	no(json.Unmarshal(<-c.data, &ops))
+	eq(ops, OpsD{E: "quota_exceeded", X: "page cards quota exceeded for /kiosk: want <= 1, got 2"})
+	eq(len(site.at("/kiosk").cards), 1)
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const rateLimitPruneThreshold = 10000
+
+// RateLimitPolicy limits how often each client address may make requests, using a token bucket per address.
+type RateLimitPolicy struct {
+	Rate  float64 // requests allowed per second, on average
+	Burst int     // requests allowed in a burst
+}
+
+// RateLimiter throttles requests per client address (as reported by trusted proxies), to blunt scraping and
+// credential stuffing.
+type RateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens  float64   // tokens left
+	updated time.Time // time tokens was last updated
+	limited bool      // was the last request refused?
+}
+
+// newRateLimiter returns a limiter enforcing the policy; nil if the policy is nil.
+func newRateLimiter(p *RateLimitPolicy) *RateLimiter {
+	if p == nil || p.Rate <= 0 {
+		return nil
+	}
+	burst := p.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{rate: p.Rate, burst: float64(burst), buckets: make(map[string]*rateBucket)}
+}
+
+// allow takes a token from the key's bucket, and returns true if one was available; else false and the time
+// until one will be.
+func (l *RateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= rateLimitPruneThreshold {
+			l.prune(now)
+		}
+		b = &rateBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = false
+		return true, 0
+	}
+	if !b.limited {
+		b.limited = true
+		echoWarn(Log{"t": "rate_limit", "addr": key})
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// rateLimitKey returns the bucket key for a client address: the address itself for IPv4, and its /64 prefix for
+// IPv6, since a single host is typically handed a whole /64, and could otherwise dodge the limit by hopping addresses.
+func rateLimitKey(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		return addr
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// prune forgets buckets that have refilled, since they are no different from new ones.
+func (l *RateLimiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// wrap returns a handler that refuses requests from client addresses exceeding the limit. CORS preflight
+// (OPTIONS) requests are not counted, since browsers send them on their own ahead of the requests that are.
+// Safe to call on a nil limiter, which allows all requests.
+func (l *RateLimiter) wrap(h http.Handler) http.Handler {
+	return l.wrapIf(h, func(r *http.Request) bool { return r.Method != http.MethodOptions })
+}
+
+// wrapWrites is like wrap, but counts only writes (PATCH, POST, PUT and DELETE requests), for routes whose reads
+// are made by browsers loading the UI, e.g. pages, static files and downloads.
+func (l *RateLimiter) wrapWrites(h http.Handler) http.Handler {
+	return l.wrapIf(h, isWrite)
+}
+
+// wrapIf returns a handler that refuses requests matching limited from client addresses exceeding the limit.
+func (l *RateLimiter) wrapIf(h http.Handler, limited func(*http.Request) bool) http.Handler {
+	if l == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !limited(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := l.allow(rateLimitKey(getRemoteAddr(r)), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
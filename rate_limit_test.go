@@ -0,0 +1,84 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	ok(newRateLimiter(nil) == nil, "nil policy disables limits")
+	ok(newRateLimiter(&RateLimitPolicy{0, 10}) == nil, "zero rate disables limits")
+
+	l := newRateLimiter(&RateLimitPolicy{2, 3})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		allowed, _ := l.allow("a", now)
+		ok(allowed, "within burst")
+	}
+	allowed, wait := l.allow("a", now)
+	ok(!allowed, "burst exceeded")
+	eq(wait, 500*time.Millisecond)
+	allowed, _ = l.allow("b", now)
+	ok(allowed, "other addresses unaffected")
+	allowed, _ = l.allow("a", now.Add(500*time.Millisecond))
+	ok(allowed, "refilled")
+
+	l.prune(now.Add(time.Hour))
+	eq(len(l.buckets), 0)
+
+	h := newRateLimiter(&RateLimitPolicy{1, 1}).wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/foo", nil))
+		return w
+	}
+	eq(serve().Code, http.StatusOK)
+	w := serve()
+	eq(w.Code, http.StatusTooManyRequests)
+	eq(w.Header().Get("Retry-After"), "1")
+}
+
+func TestRateLimitScope(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	eq(rateLimitKey("10.0.0.1"), "10.0.0.1")
+	eq(rateLimitKey("2001:db8:1:2:aaaa::1"), "2001:db8:1:2::/64")
+	eq(rateLimitKey("2001:db8:1:2:bbbb::2"), "2001:db8:1:2::/64")
+	eq(rateLimitKey("2001:db8:1:3::1"), "2001:db8:1:3::/64")
+	eq(rateLimitKey("::ffff:10.0.0.1"), "::ffff:10.0.0.1")
+
+	l := newRateLimiter(&RateLimitPolicy{1, 1})
+	nop := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	all, writes := l.wrap(nop), l.wrapWrites(nop)
+	serve := func(h http.Handler, method, addr string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/foo", nil)
+		r.RemoteAddr = addr
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	eq(serve(all, http.MethodOptions, "[2001:db8::1]:1234"), http.StatusOK)
+	eq(serve(all, http.MethodGet, "[2001:db8::1]:1234"), http.StatusOK) // preflight not counted
+	eq(serve(all, http.MethodGet, "[2001:db8::2]:1234"), http.StatusTooManyRequests)
+	eq(serve(writes, http.MethodGet, "[2001:db8::3]:1234"), http.StatusOK)
+	eq(serve(writes, http.MethodPost, "[2001:db8::3]:1234"), http.StatusTooManyRequests)
+	eq(serve(writes, http.MethodPost, "10.0.0.1:1234"), http.StatusOK)
+}
@@ -0,0 +1,249 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+var errTLSRequired = errors.New("cannot disable TLS at runtime: want a certificate and key file")
+
+// Reloader applies configuration changes to the running server, e.g. on SIGHUP, without restarting it,
+// and so without dropping websocket connections.
+type Reloader struct {
+	sync.Mutex // serializes reloads
+	load       func() (ReloadableConf, error)
+	broker     *Broker
+	auth       *Auth        // nil if auth is disabled
+	cert       *Certificate // nil if TLS is disabled
+	keychain   *keychain.Keychain
+	fileURLs   *FileURLSigner
+	signing    *RequestVerifier // nil if requests need not be signed
+	secrets    Secrets          // secrets as of the last reload or refresh
+}
+
+func newReloader(load func() (ReloadableConf, error), broker *Broker, auth *Auth, cert *Certificate, kc *keychain.Keychain, fileURLs *FileURLSigner, signing *RequestVerifier, secrets Secrets) *Reloader {
+	return &Reloader{sync.Mutex{}, load, broker, auth, cert, kc, fileURLs, signing, secrets}
+}
+
+// reload reads the configuration, and applies it. Nothing is applied if any of it is invalid.
+func (r *Reloader) reload() error {
+	r.Lock()
+	defer r.Unlock()
+
+	c, err := r.load()
+	if err != nil {
+		return err
+	}
+	var cert tls.Certificate
+	if r.cert != nil {
+		if len(c.CertFile) == 0 || len(c.KeyFile) == 0 {
+			return errTLSRequired
+		}
+		if cert, err = tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+			return err
+		}
+	}
+
+	r.broker.configure(c.RouteAliases, c.AppMessages)
+	r.broker.site.setQuotas(newQuotas(Quota{c.MaxPageSize, c.MaxPageCards}, c.RoutePageQuotas, c.AppPageQuotas))
+	if r.auth != nil {
+		r.auth.throttle.configure(c.MaxLoginAttempts, c.LoginAttemptWindow, c.LoginLockout)
+	}
+	if r.cert != nil {
+		r.cert.set(&cert)
+	}
+	logger.configure(c.LogLevels)
+	r.setSecrets(c.Secrets)
+	r.reloadKeychain()
+	echo(Log{"t": "reload", "aliases": strconv.Itoa(len(c.RouteAliases)), "app_messages": strconv.Itoa(len(c.AppMessages)), "quotas": strconv.Itoa(len(c.RoutePageQuotas) + len(c.AppPageQuotas))})
+	return nil
+}
+
+// refreshSecrets re-reads secrets, and the keychain, periodically, to pick up secrets rotated at their sources
+// (see LoadSecret), leaving other settings as is.
+func (r *Reloader) refreshSecrets(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.Lock()
+		c, err := r.load()
+		if err == nil {
+			r.setSecrets(c.Secrets)
+			r.reloadKeychain()
+		}
+		r.Unlock()
+		if err != nil {
+			echoError(Log{"t": "secret_refresh", "error": err.Error()})
+		}
+	}
+}
+
+// setSecrets applies secrets that changed. Must be called with the lock held.
+func (r *Reloader) setSecrets(s Secrets) {
+	var changed []string
+	if s.ClientSecret != r.secrets.ClientSecret {
+		if r.auth != nil {
+			r.auth.setClientSecret(s.ClientSecret)
+		}
+		changed = append(changed, "oidc-client-secret")
+	}
+	if s.PageWebhookSecret != r.secrets.PageWebhookSecret {
+		r.broker.hooks.setSecret(s.PageWebhookSecret)
+		changed = append(changed, "page-webhook-secret")
+	}
+	if s.ClientWebhookSecret != r.secrets.ClientWebhookSecret {
+		r.broker.clientHooks.setSecret(s.ClientWebhookSecret)
+		changed = append(changed, "client-webhook-secret")
+	}
+	if s.AccessKeySecret != r.secrets.AccessKeySecret && r.keychain != nil {
+		if id := r.keychain.DefaultID(); len(id) > 0 {
+			hash, err := keychain.HashSecret(s.AccessKeySecret)
+			if err != nil || len(s.AccessKeySecret) == 0 {
+				echoError(Log{"t": "secret_refresh", "setting": "access-key-secret", "error": "bad secret; keeping the current one"})
+				s.AccessKeySecret = r.secrets.AccessKeySecret
+			} else {
+				r.keychain.SetDefault(id, hash)
+				changed = append(changed, "access-key-secret")
+			}
+		}
+	}
+	if s.FileURLSecret != r.secrets.FileURLSecret && r.fileURLs != nil {
+		if len(s.FileURLSecret) == 0 { // a random key is no use to other replicas
+			echoError(Log{"t": "secret_refresh", "setting": "file-url-secret", "error": "empty secret; keeping the current one"})
+			s.FileURLSecret = r.secrets.FileURLSecret
+		} else {
+			r.fileURLs.key.set([]byte(s.FileURLSecret))
+			changed = append(changed, "file-url-secret")
+		}
+	}
+	if s.RequestSigningSecret != r.secrets.RequestSigningSecret {
+		if r.signing == nil || len(s.RequestSigningSecret) == 0 {
+			echoError(Log{"t": "secret_refresh", "setting": "request-signing-secret", "error": "cannot enable or disable request signing at runtime"})
+			s.RequestSigningSecret = r.secrets.RequestSigningSecret
+		} else {
+			r.signing.secret.set([]byte(s.RequestSigningSecret))
+			changed = append(changed, "request-signing-secret")
+		}
+	}
+	if s.PageStorePassword != r.secrets.PageStorePassword && r.broker.storage != nil {
+		r.broker.storage.store.setPassword(s.PageStorePassword)
+		changed = append(changed, "page-store-password")
+	}
+	r.secrets = s
+	if len(changed) > 0 {
+		echo(Log{"t": "secret_refresh", "changed": strings.Join(changed, ",")})
+	}
+}
+
+// reloadKeychain re-reads the keychain file if it changed. Must be called with the lock held.
+func (r *Reloader) reloadKeychain() {
+	if r.keychain == nil {
+		return
+	}
+	changed, err := r.keychain.Reload()
+	if err != nil {
+		echoError(Log{"t": "keychain_reload", "error": err.Error()})
+		return
+	}
+	if changed {
+		echo(Log{"t": "keychain_reload", "keys": strconv.Itoa(r.keychain.Len())})
+	}
+}
+
+// watch reloads the configuration whenever the process receives SIGHUP.
+func (r *Reloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := r.reload(); err != nil {
+				echoError(Log{"t": "reload", "error": err.Error()})
+			}
+		}
+	}()
+}
+
+// Certificate holds the server's TLS certificate, which can be replaced while the server is running.
+type Certificate struct {
+	sync.RWMutex
+	cert *tls.Certificate
+}
+
+// load reads the certificate from a certificate and key file.
+func (c *Certificate) load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	c.set(&cert)
+	return nil
+}
+
+func (c *Certificate) set(cert *tls.Certificate) {
+	c.Lock()
+	c.cert = cert
+	c.Unlock()
+}
+
+// get returns the current certificate, for new TLS connections; see tls.Config.GetCertificate.
+func (c *Certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+// configure replaces the route aliases and app message ACL, e.g. when settings are reloaded.
+func (b *Broker) configure(aliases RouteAliases, acl AppMessageACL) {
+	b.settingsMux.Lock()
+	b.aliases, b.appMessages = aliases, acl
+	b.settingsMux.Unlock()
+}
+
+// routeAliases returns the current route aliases and redirects.
+func (b *Broker) routeAliases() RouteAliases {
+	b.settingsMux.RLock()
+	defer b.settingsMux.RUnlock()
+	return b.aliases
+}
+
+// appMessageACL returns the current app message ACL.
+func (b *Broker) appMessageACL() AppMessageACL {
+	b.settingsMux.RLock()
+	defer b.settingsMux.RUnlock()
+	return b.appMessages
+}
+
+// setQuotas replaces the page quotas, e.g. when settings are reloaded; nil disables quotas.
+func (site *Site) setQuotas(quotas *Quotas) {
+	site.Lock()
+	site.quotas = quotas
+	site.Unlock()
+}
+
+// pageQuotas returns the current page quotas, if any.
+func (site *Site) pageQuotas() *Quotas {
+	site.RLock()
+	defer site.RUnlock()
+	return site.quotas
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+func TestReload(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	broker := newBroker(newSite(), false, true, true)
+	broker.aliases = RouteAliases{"/old": {"/new", false}}
+
+	var (
+		conf ReloadableConf
+		err  error
+	)
+	r := newReloader(func() (ReloadableConf, error) { return conf, err }, broker, nil, nil, nil, nil, nil, Secrets{})
+
+	conf = ReloadableConf{
+		RouteAliases: RouteAliases{"/legacy": {"/current", true}},
+		AppMessages:  AppMessageACL{"/a": {"/b": true}},
+		MaxPageCards: 1,
+	}
+	no(r.reload())
+	eq(broker.routeAliases().serve("/old"), "/old")
+	target, redirect := broker.routeAliases().redirect("/legacy")
+	ok(redirect)
+	eq(target, "/current")
+	ok(broker.appMessageACL().allows("/a", "/b"))
+	ok(broker.site.patch("/p", []byte(`{"d":[{"k":"a","d":{"view":"x"}},{"k":"b","d":{"view":"x"}}]}`)) != nil, "quota applied")
+
+	err = errors.New("bad config")
+	ok(r.reload() != nil)
+	ok(broker.appMessageACL().allows("/a", "/b"), "failed reload keeps settings")
+
+	err = nil
+	conf = ReloadableConf{}
+	no(r.reload())
+	ok(broker.site.pageQuotas() == nil, "quotas removed")
+}
+
+func TestReloadTLS(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	broker := newBroker(newSite(), false, true, true)
+	r := newReloader(func() (ReloadableConf, error) { return ReloadableConf{}, nil }, broker, nil, &Certificate{}, nil, nil, nil, Secrets{})
+	ok(r.reload() == errTLSRequired, "cannot disable TLS")
+}
+
+func TestThrottleConfigure(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	th := newThrottle(0, time.Minute, time.Hour)
+	ok(!th.fail("a"))
+	th.configure(1, time.Minute, time.Hour)
+	ok(th.fail("a"), "new limit applies")
+}
+
+func TestReloadSecrets(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	broker := newBroker(newSite(), false, true, true)
+	hooks, err := newPageHooks(nil, "old", nil)
+	no(err)
+	broker.hooks = hooks
+	conf := ReloadableConf{Secrets: Secrets{PageWebhookSecret: "new"}}
+	r := newReloader(func() (ReloadableConf, error) { return conf, nil }, broker, nil, nil, nil, nil, nil, Secrets{PageWebhookSecret: "old"})
+	no(r.reload())
+	eq(string(broker.hooks.secret.get()), "new")
+	eq(r.secrets, conf.Secrets)
+}
+
+type passwordPageStore struct {
+	*memPageStore
+	password string
+}
+
+func (s *passwordPageStore) setPassword(password string) { s.password = password }
+
+func TestReloadRotatedSecrets(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	broker := newBroker(newSite(), false, true, true)
+	store := &passwordPageStore{memPageStore: &memPageStore{make(map[string][]byte)}}
+	broker.storage = newPageStorage(store, broker.site)
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	hash, err := keychain.HashSecret("old")
+	no(err)
+	kc.SetDefault("default", hash)
+	fileURLs := newFileURLSigner([]byte("old"))
+	verifier := newRequestVerifier("old", time.Minute)
+	old := Secrets{AccessKeySecret: "old", FileURLSecret: "old", RequestSigningSecret: "old", PageStorePassword: "old"}
+	conf := ReloadableConf{Secrets: Secrets{AccessKeySecret: "new", FileURLSecret: "new", RequestSigningSecret: "new", PageStorePassword: "new"}}
+	r := newReloader(func() (ReloadableConf, error) { return conf, nil }, broker, nil, nil, kc, fileURLs, verifier, old)
+	no(r.reload())
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("default", "new")
+	ok(kc.Allow(req), "access key secret rotated")
+	eq(string(fileURLs.key.get()), "new")
+	eq(string(verifier.secret.get()), "new")
+	eq(store.password, "new")
+	eq(r.secrets, conf.Secrets)
+
+	conf.Secrets.RequestSigningSecret, conf.Secrets.FileURLSecret = "", "" // cannot disable signing, or use a random key
+	no(r.reload())
+	eq(string(verifier.secret.get()), "new")
+	eq(string(fileURLs.key.get()), "new")
+	eq(r.secrets.RequestSigningSecret, "new")
+}
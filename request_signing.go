@@ -0,0 +1,251 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	requestTimestampHeader = "Wave-Timestamp" // Unix time, in seconds
+	requestNonceHeader     = "Wave-Nonce"
+	requestSignatureHeader = pageHookSignatureHeader
+	maxRequestNonceSize    = 128
+)
+
+var (
+	errRequestUnsigned  = errors.New("request not signed")
+	errRequestStale     = errors.New("request timestamp outside the allowed window")
+	errRequestReplayed  = errors.New("request nonce already used")
+	errRequestSignature = errors.New("bad request signature")
+)
+
+// RequestVerifier verifies that page and app API requests from apps are signed with a shared secret,
+// so that they are authentic even if TLS is terminated before the server, e.g. by a load balancer.
+//
+// Each request carries a timestamp (Wave-Timestamp, in Unix seconds), a random nonce (Wave-Nonce), and the
+// hex-encoded HMAC-SHA256 of its canonical form (see writeCanonicalRequest), keyed by the secret, in the
+// Wave-Signature header, formatted as "sha256=<hmac>". Requests are refused if their timestamp is off by more than
+// the window, or if their nonce was seen within the window, so that captured requests cannot be replayed.
+//
+// Nonces are remembered in memory, by each replica: with several replicas behind a load balancer, a captured
+// request can be replayed once against each of the other replicas, within the window.
+type RequestVerifier struct {
+	sync.Mutex
+	secret *SecretKey
+	window time.Duration
+	nonces map[string]time.Time // nonces seen, and when they can be forgotten
+	seen   []seenNonce          // nonces seen, oldest first
+}
+
+type seenNonce struct {
+	nonce  string
+	forget time.Time
+}
+
+// newRequestVerifier returns a verifier; nil if secret is empty.
+func newRequestVerifier(secret string, window time.Duration) *RequestVerifier {
+	if len(secret) == 0 {
+		return nil
+	}
+	return &RequestVerifier{secret: newSecretKey([]byte(secret)), window: window, nonces: make(map[string]time.Time)}
+}
+
+// writeCanonicalRequest writes the canonical form of a request, less its body, which is to follow:
+//
+//	<method>\n
+//	<path, unescaped>\n
+//	<query, with parameters sorted by name, as by url.Values.Encode>\n
+//	<header name, lowercase>:<values, comma-separated>\n, for each Wave-* header but Wave-Signature, sorted by name
+//	\n
+//
+// so that the signature covers the query, and the Wave-* headers that qualify requests (e.g. Wave-File-Owner,
+// Wave-Page-TTL), including Wave-Timestamp and Wave-Nonce.
+func writeCanonicalRequest(w io.Writer, r *http.Request) {
+	fmt.Fprintf(w, "%s\n%s\n%s\n", r.Method, r.URL.Path, r.URL.Query().Encode())
+	var names []string
+	for name := range r.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "wave-") && name != strings.ToLower(requestSignatureHeader) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s:%s\n", name, strings.Join(r.Header.Values(name), ","))
+	}
+	io.WriteString(w, "\n")
+}
+
+// newRequestMAC returns a MAC for a request, to which its body is to be written.
+func newRequestMAC(secret []byte, r *http.Request) hash.Hash {
+	mac := hmac.New(sha256.New, secret)
+	writeCanonicalRequest(mac, r)
+	return mac
+}
+
+// signRequest returns the signature of a request, given its body.
+func signRequest(secret []byte, r *http.Request, body []byte) string {
+	mac := newRequestMAC(secret, r)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks a request's signature, timestamp and nonce.
+func (v *RequestVerifier) verify(r *http.Request, body []byte, now time.Time) error {
+	return v.verifyStream(r, bytes.NewReader(body), ioutil.Discard, now)
+}
+
+// verifyStream checks a request's signature, timestamp and nonce, copying its body to w as it is read.
+func (v *RequestVerifier) verifyStream(r *http.Request, body io.Reader, w io.Writer, now time.Time) error {
+	timestamp, nonce := r.Header.Get(requestTimestampHeader), r.Header.Get(requestNonceHeader)
+	signature := strings.TrimPrefix(r.Header.Get(requestSignatureHeader), "sha256=")
+	if len(timestamp) == 0 || len(nonce) == 0 || len(signature) == 0 {
+		return errRequestUnsigned
+	}
+	if len(nonce) > maxRequestNonceSize {
+		return errRequestSignature
+	}
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errRequestSignature
+	}
+	if d := now.Sub(time.Unix(secs, 0)); d > v.window || d < -v.window {
+		return errRequestStale
+	}
+	mac := newRequestMAC(v.secret.get(), r)
+	if _, err := io.Copy(io.MultiWriter(mac, w), body); err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(signature), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return errRequestSignature
+	}
+	return v.remember(nonce, now)
+}
+
+// remember records a nonce, failing if it was seen before. Nonces are forgotten oldest first, a few at a time,
+// once requests bearing them would be stale anyway.
+func (v *RequestVerifier) remember(nonce string, now time.Time) error {
+	v.Lock()
+	defer v.Unlock()
+	for len(v.seen) > 0 && !now.Before(v.seen[0].forget) {
+		if n := v.seen[0]; v.nonces[n.nonce] == n.forget {
+			delete(v.nonces, n.nonce)
+		}
+		v.seen = v.seen[1:]
+	}
+	if _, ok := v.nonces[nonce]; ok {
+		return errRequestReplayed
+	}
+	forget := now.Add(2 * v.window) // timestamps can be up to a window ahead, and are stale a window later
+	v.nonces[nonce] = forget
+	v.seen = append(v.seen, seenNonce{nonce, forget})
+	return nil
+}
+
+func isRequestSignatureError(err error) bool {
+	return err == errRequestUnsigned || err == errRequestStale || err == errRequestReplayed || err == errRequestSignature
+}
+
+func isWrite(r *http.Request) bool {
+	return r.Method == http.MethodPatch || r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodDelete
+}
+
+func refuseRequest(w http.ResponseWriter, r *http.Request, err error) {
+	echoWarn(Log{"t": "request_signature", "addr": getRemoteAddr(r), "path": r.URL.Path, "error": err.Error()})
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// wrap returns a handler that refuses writes (PATCH, POST, PUT and DELETE requests) that are not signed,
+// reading bodies of up to maxSize bytes into memory to verify them.
+// Safe to call on a nil verifier, which allows all requests.
+func (v *RequestVerifier) wrap(h http.Handler, maxSize int64) http.Handler {
+	if v == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWrite(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		body, err := readRequestWithLimit(w, r.Body, maxSize)
+		if err != nil {
+			if isRequestTooLarge(err) {
+				writeRequestTooLarge(w, maxSize)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if err := v.verify(r, body, time.Now()); err != nil {
+			refuseRequest(w, r, err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.ServeHTTP(w, r)
+	})
+}
+
+// wrapUploads returns a handler that refuses writes made with credentials (i.e. by apps, not browsers) that are
+// not signed, spooling bodies of any size to a temporary file to verify them before they are handled.
+// Safe to call on a nil verifier, which allows all requests.
+func (v *RequestVerifier) wrapUploads(h http.Handler) http.Handler {
+	if v == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWrite(r) || len(r.Header.Get("Authorization")) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		f, err := ioutil.TempFile("", "wave-signed-")
+		if err != nil {
+			echoError(Log{"t": "request_signature", "path": r.URL.Path, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if err := v.verifyStream(r, r.Body, f, time.Now()); err != nil {
+			if isRequestSignatureError(err) {
+				refuseRequest(w, r, err)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			echoError(Log{"t": "request_signature", "path": r.URL.Path, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		r.Body = f
+		h.ServeHTTP(w, r)
+	})
+}
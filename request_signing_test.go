@@ -0,0 +1,162 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func signedRequest(secret, method, path, nonce, body string, at time.Time) *http.Request {
+	return signedRequestWith(secret, method, path, nonce, body, at, nil)
+}
+
+// signedRequestWith is like signedRequest, signing the given headers too.
+func signedRequestWith(secret, method, path, nonce, body string, at time.Time, header http.Header) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	r.Header.Set(requestTimestampHeader, strconv.FormatInt(at.Unix(), 10))
+	r.Header.Set(requestNonceHeader, nonce)
+	r.Header.Set(requestSignatureHeader, "sha256="+signRequest([]byte(secret), r, []byte(body)))
+	return r
+}
+
+func TestRequestVerifier(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	ok(newRequestVerifier("", time.Minute) == nil, "no secret disables signing")
+
+	v := newRequestVerifier("s3cret", time.Minute)
+	now := time.Now()
+	verify := func(r *http.Request) error {
+		return v.verify(r, []byte(`{"d":[]}`), now)
+	}
+	no(verify(signedRequest("s3cret", http.MethodPatch, "/foo", "n1", `{"d":[]}`, now)))
+	eq(verify(signedRequest("s3cret", http.MethodPatch, "/foo", "n1", `{"d":[]}`, now)), errRequestReplayed)
+	eq(verify(signedRequest("s3cret", http.MethodPatch, "/foo", "n2", `{"d":[]}`, now.Add(-2*time.Minute))), errRequestStale)
+	eq(verify(signedRequest("wrong", http.MethodPatch, "/foo", "n3", `{"d":[]}`, now)), errRequestSignature)
+	r := signedRequest("s3cret", http.MethodPatch, "/foo", "n4", `{"d":[]}`, now)
+	r.URL.Path = "/bar" // moved to another page
+	eq(verify(r), errRequestSignature)
+	eq(verify(httptest.NewRequest(http.MethodPatch, "/foo", nil)), errRequestUnsigned)
+
+	served := 0
+	h := v.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served++ }), 1024)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, signedRequest("s3cret", http.MethodPost, "/", "n5", `{}`, time.Now()))
+	eq(w.Code, http.StatusOK)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{}`)))
+	eq(w.Code, http.StatusUnauthorized)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/foo", nil))
+	eq(w.Code, http.StatusOK)
+	eq(served, 2)
+}
+
+func TestRequestVerifierTampering(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	v := newRequestVerifier("s3cret", time.Minute)
+	now := time.Now()
+	nonce := 0
+	sign := func() *http.Request {
+		nonce++
+		return signedRequestWith("s3cret", http.MethodPost, "/_f/?b=2&a=1&a=0", strconv.Itoa(nonce), "file", now, http.Header{
+			"Wave-File-Owner":  {"alice"},
+			"Wave-File-Public": {"false"},
+			"Content-Type":     {"text/plain"},
+		})
+	}
+	verify := func(r *http.Request) error {
+		return v.verify(r, []byte("file"), now)
+	}
+
+	no(verify(sign()))
+	r := sign()
+	r.URL.RawQuery = "a=1&a=0&b=2" // reordered parameters are equivalent
+	no(verify(r))
+	r = sign()
+	r.Header.Set("Content-Type", "application/octet-stream") // not covered
+	no(verify(r))
+
+	r = sign()
+	r.URL.RawQuery = "a=1&a=0&b=3"
+	eq(verify(r), errRequestSignature)
+	r = sign()
+	r.URL.RawQuery = "a=0&a=1&b=2" // values reordered
+	eq(verify(r), errRequestSignature)
+	r = sign()
+	r.Header.Set("Wave-File-Owner", "mallory")
+	eq(verify(r), errRequestSignature)
+	r = sign()
+	r.Header.Del("Wave-File-Public")
+	eq(verify(r), errRequestSignature)
+	r = sign()
+	r.Header.Set("Wave-Page-TTL", "1s") // added
+	eq(verify(r), errRequestSignature)
+	r = sign()
+	r.Header.Set(requestNonceHeader, "fresh") // to replay
+	eq(verify(r), errRequestSignature)
+}
+
+func TestRequestVerifierForgetsNonces(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	v := newRequestVerifier("s3cret", time.Minute)
+	now := time.Now()
+	no(v.remember("n1", now))
+	no(v.remember("n2", now.Add(time.Minute)))
+	eq(v.remember("n1", now.Add(time.Minute)), errRequestReplayed)
+	no(v.remember("n3", now.Add(2*time.Minute))) // n1 forgotten
+	eq(len(v.nonces), 2)
+	eq(len(v.seen), 2)
+	no(v.remember("n1", now.Add(2*time.Minute)))
+}
+
+func TestRequestVerifierUploads(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	v := newRequestVerifier("s3cret", time.Minute)
+	var bodies []string
+	h := v.wrapUploads(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+	}))
+	serve := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	upload := func(nonce, body string) *http.Request {
+		r := signedRequest("s3cret", http.MethodPost, "/_f/", nonce, body, time.Now())
+		r.SetBasicAuth("app", "secret")
+		return r
+	}
+	eq(serve(upload("n1", "file")), http.StatusOK)
+	r := upload("n2", "file")
+	r.Body = ioutil.NopCloser(strings.NewReader("forged"))
+	eq(serve(r), http.StatusUnauthorized)
+	r = httptest.NewRequest(http.MethodPost, "/_f/", strings.NewReader("file"))
+	r.SetBasicAuth("app", "secret")
+	eq(serve(r), http.StatusUnauthorized)
+	eq(serve(httptest.NewRequest(http.MethodPost, "/_f/", strings.NewReader("browser"))), http.StatusOK) // uploaded from the UI
+	eq(bodies, []string{"file", "browser"})
+}
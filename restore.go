@@ -17,8 +17,11 @@ package wave
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -29,7 +32,7 @@ var (
 func initSite(site *Site, aofPath string) {
 	file, err := os.Open(aofPath)
 	if err != nil {
-		log.Fatalln("#", "failed opening AOF file:", err)
+		panic(fmt.Errorf("failed opening AOF file: %v", err))
 	}
 	defer file.Close()
 
@@ -39,9 +42,16 @@ func initSite(site *Site, aofPath string) {
 	for scanner.Scan() { // FIXME not reliable if line length > 65536 chars
 		line++
 		data := scanner.Bytes()
+		if len(data) > 0 && data[0] == '{' { // -log-format json
+			if url, data, mark, ok := parseAOFEntry(data); ok {
+				applyAOF(site, mark, url, data)
+				used++
+			}
+			continue
+		}
 		tokens := bytes.SplitN(data, logSep, 4) // "date time marker entry"
 		if len(tokens) < 4 {
-			log.Println("#", "warning: want (date, time, marker, entry); skipped line", line)
+			echoWarn(Log{"t": "init", "line": strconv.Itoa(line), "error": "want (date, time, marker, entry); skipped line"})
 			continue
 		}
 
@@ -53,34 +63,80 @@ func initSite(site *Site, aofPath string) {
 			}
 			tokens = bytes.SplitN(entry, logSep, 2) // "url data"
 			if len(tokens) < 2 {
-				log.Println("#", "warning: want (url, data); skipped line", line)
+				echoWarn(Log{"t": "init", "line": strconv.Itoa(line), "error": "want (url, data); skipped line"})
 				continue
 			}
 			url, data := tokens[0], tokens[1]
-			switch mark {
-			case '*': // patch existing page
-				site.patch(string(url), data)
-				used++
-			case '=': // compacted page; overwrite
-				site.set(string(url), data)
+			if applyAOF(site, mark, string(url), data) {
 				used++
-			default:
-				log.Println("#", "warning: bad marker", marker, "on line", line)
+			} else {
+				echoWarn(Log{"t": "init", "line": strconv.Itoa(line), "error": "bad marker " + string(marker)})
 			}
 		}
 	}
 
-	log.Printf("# init: %d lines read, %d lines used, %s\n", line, used, time.Since(startTime))
+	echo(Log{"t": "init", "lines": strconv.Itoa(line), "used": strconv.Itoa(used), "duration": time.Since(startTime).String()})
 
 	if err := scanner.Err(); err != nil {
-		log.Fatalln("#", "failed scanning AOF file:", err)
+		panic(fmt.Errorf("failed scanning AOF file: %v", err))
+	}
+}
+
+const (
+	patchMarker     = '*' // patch existing page
+	compactedMarker = '=' // compacted page; overwrite
+)
+
+// applyAOF applies an AOF entry to the site, returning false if its marker is unknown.
+func applyAOF(site *Site, mark byte, url string, data []byte) bool {
+	switch mark {
+	case patchMarker:
+		site.patch(url, data)
+	case compactedMarker:
+		site.set(url, data)
+	default:
+		return false
 	}
+	return true
+}
+
+// AOFEntryD represents an AOF entry logged as JSON, with -log-format json.
+type AOFEntryD struct {
+	T      string `json:"t"` // always "aof"
+	Time   string `json:"time"`
+	Marker string `json:"marker"`
+	Route  string `json:"route"`
+	Data   string `json:"data"`
+}
+
+// logAOF writes an AOF entry to the log: "marker url data" following the standard logger's timestamp, or as a JSON
+// line with -log-format json. Entries are written regardless of log levels.
+func logAOF(mark byte, url string, data []byte) {
+	if logger.jsonFormat() {
+		j, err := json.Marshal(AOFEntryD{"aof", time.Now().UTC().Format(time.RFC3339Nano), string(mark), url, string(data)})
+		if err == nil {
+			fmt.Fprintln(log.Writer(), string(j))
+		}
+		return
+	}
+	log.Println(string(mark), url, string(data))
+}
+
+// parseAOFEntry parses an AOF entry logged as JSON; false if the line is some other log message.
+func parseAOFEntry(line []byte) (string, []byte, byte, bool) {
+	var e AOFEntryD
+	if err := json.Unmarshal(line, &e); err != nil || e.T != "aof" || len(e.Marker) != 1 {
+		return "", nil, 0, false
+	}
+	return e.Route, []byte(e.Data), e.Marker[0], true
 }
 
 func CompactSite(aofPath string) {
 	site := newSite()
 	initSite(site, aofPath)
-	for url, page := range site.pages {
-		log.Println("=", url, string(page.marshal()))
+	for _, url := range site.urls() {
+		if page := site.at(url); page != nil {
+			logAOF(compactedMarker, url, page.marshal())
+		}
 	}
 }
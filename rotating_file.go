@@ -0,0 +1,122 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Rotation represents when a log file is rotated, and which rotated files are kept.
+type Rotation struct {
+	MaxSize    int64         // rotate once the file grows past this many bytes; 0 to disable
+	Interval   time.Duration // rotate once the file has been written to for this long, e.g. 24h; 0 to disable
+	MaxBackups int           // rotated files to keep
+	MaxAge     time.Duration // delete rotated files last written to longer ago than this; 0 to keep them
+}
+
+// RotatingFile represents a log file that is rotated according to a rotation policy: the file is renamed to
+// file.1, file.1 to file.2, and so on, keeping up to a number of backups.
+type RotatingFile struct {
+	sync.Mutex
+	path     string
+	rotation Rotation
+	file     *os.File
+	size     int64
+	opened   time.Time
+}
+
+func openRotatingFile(path string, rotation Rotation) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, rotation: rotation}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.due(len(p)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// due returns true if the file should be rotated before writing n more bytes to it.
+func (f *RotatingFile) due(n int) bool {
+	if f.size == 0 {
+		return false
+	}
+	r := f.rotation
+	return (r.MaxSize > 0 && f.size+int64(n) > r.MaxSize) || (r.Interval > 0 && time.Since(f.opened) >= r.Interval)
+}
+
+// rotate shifts the backups along, dropping the oldest and the expired, and starts a new file.
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	backups := f.rotation.MaxBackups
+	if backups > 0 {
+		for i := backups - 1; i > 0; i-- {
+			os.Rename(backupName(f.path, i), backupName(f.path, i+1)) // missing backups are fine
+		}
+		if err := os.Rename(f.path, backupName(f.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	if maxAge := f.rotation.MaxAge; maxAge > 0 {
+		for i := 2; i <= backups; i++ { // the latest backup was written to just now
+			name := backupName(f.path, i)
+			if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > maxAge {
+				os.Remove(name)
+			}
+		}
+	}
+	return f.open()
+}
+
+func backupName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+func (f *RotatingFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestRotatingFile(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, Rotation{MaxSize: 10, MaxBackups: 2})
+	no(err)
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n"} {
+		_, err := f.Write([]byte(line))
+		no(err)
+	}
+	no(f.Close())
+
+	read := func(name string) string {
+		b, err := ioutil.ReadFile(name)
+		no(err)
+		return string(b)
+	}
+	eq(read(path), "six\n")
+	eq(read(path+".1"), "four\nfive\n")
+	eq(read(path+".2"), "three\n")
+	_, err = os.Stat(path + ".3")
+	ok(os.IsNotExist(err), "oldest backup dropped")
+
+	dir := t.TempDir()
+	path = filepath.Join(dir, "wave.log")
+	f, err = openRotatingFile(path, Rotation{Interval: time.Hour, MaxBackups: 3, MaxAge: 24 * time.Hour})
+	no(err)
+	_, err = f.Write([]byte("old\n"))
+	no(err)
+	f.opened = f.opened.Add(-2 * time.Hour)
+	_, err = f.Write([]byte("new\n")) // rotated by age
+	no(err)
+	eq(read(path), "new\n")
+	eq(read(path+".1"), "old\n")
+
+	no(ioutil.WriteFile(path+".2", []byte("stale\n"), 0644))
+	stale := time.Now().Add(-48 * time.Hour)
+	no(os.Chtimes(path+".2", stale, stale))
+	f.opened = f.opened.Add(-2 * time.Hour)
+	_, err = f.Write([]byte("newer\n"))
+	no(err)
+	no(f.Close())
+	eq(read(path+".1"), "new\n")
+	eq(read(path+".2"), "old\n")
+	_, err = os.Stat(path + ".3")
+	ok(os.IsNotExist(err), "expired backup deleted")
+}
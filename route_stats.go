@@ -0,0 +1,262 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	routeStatsInterval = 10 * time.Second
+	routeStatsTTL      = time.Hour   // how long to keep tracking routes without traffic
+	maxRouteStats      = 1000        // routes tracked or reported; the rest are folded into otherStatsRoute
+	unicastStatsRoute  = "(unicast)" // stands in for the per-client routes of unicast apps
+	otherStatsRoute    = "(other)"
+)
+
+// RouteStats aggregates traffic by route: queries forwarded to apps and how long they took, by app route,
+// and bytes broadcast to clients, by page route, to help tell which app is hogging the server.
+type RouteStats struct {
+	sync.Mutex
+	routes map[string]*RouteStat
+	last   time.Time // time of last tick
+}
+
+// RouteStat represents the traffic on a route.
+type RouteStat struct {
+	queries     uint64    // queries forwarded
+	bytes       uint64    // bytes broadcast
+	latency     []uint64  // forward latencies during the current interval, per latencyBuckets bucket; the last is for +Inf
+	prevLatency []uint64  // forward latencies during the previous interval
+	prevQueries uint64    // queries as of the last tick
+	prevBytes   uint64    // bytes as of the last tick
+	queryRate   float64   // queries/sec during the previous interval
+	byteRate    float64   // bytes/sec during the previous interval
+	active      time.Time // time of the last tick with traffic
+}
+
+// RouteStatInfo represents the traffic on a route, as reported by the admin API.
+type RouteStatInfo struct {
+	Route          string  `json:"route"`
+	Subscribers    int     `json:"subscribers"`
+	Queries        uint64  `json:"queries"`
+	QueryRate      float64 `json:"queries_per_sec"`
+	LatencyP50     float64 `json:"latency_p50"` // seconds
+	LatencyP95     float64 `json:"latency_p95"` // seconds
+	BroadcastBytes uint64  `json:"broadcast_bytes"`
+	BroadcastRate  float64 `json:"broadcast_bytes_per_sec"`
+}
+
+func newRouteStats() *RouteStats {
+	return &RouteStats{routes: make(map[string]*RouteStat), last: time.Now()}
+}
+
+// get returns the stats for a route, creating them if necessary. Must be called with the lock held.
+func (s *RouteStats) get(route string) *RouteStat {
+	if x, ok := s.routes[route]; ok {
+		return x
+	}
+	if len(s.routes) >= maxRouteStats {
+		route = otherStatsRoute
+		if x, ok := s.routes[route]; ok {
+			return x
+		}
+	}
+	x := &RouteStat{latency: make([]uint64, len(latencyBuckets)+1), active: s.last}
+	s.routes[route] = x
+	return x
+}
+
+// query records a query forwarded to the app at route, and how long it took.
+func (s *RouteStats) query(route string, d time.Duration) {
+	i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+	s.Lock()
+	x := s.get(route)
+	x.queries++
+	x.latency[i]++
+	s.Unlock()
+}
+
+// broadcast records n bytes sent to clients watching route.
+func (s *RouteStats) broadcast(route string, n int) {
+	if n == 0 {
+		return
+	}
+	s.Lock()
+	s.get(route).bytes += uint64(n)
+	s.Unlock()
+}
+
+// run computes rates and latencies periodically.
+func (s *RouteStats) run(interval time.Duration) {
+	for t := range time.Tick(interval) {
+		s.tick(t)
+	}
+}
+
+// tick computes rates and latencies for the interval ending now, and stops tracking routes without traffic
+// for routeStatsTTL, e.g. those of apps long gone.
+func (s *RouteStats) tick(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	elapsed := now.Sub(s.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	s.last = now
+	for route, x := range s.routes {
+		if x.queries != x.prevQueries || x.bytes != x.prevBytes {
+			x.active = now
+		} else if now.Sub(x.active) >= routeStatsTTL {
+			delete(s.routes, route)
+			continue
+		}
+		x.queryRate = float64(x.queries-x.prevQueries) / elapsed
+		x.byteRate = float64(x.bytes-x.prevBytes) / elapsed
+		x.prevQueries, x.prevBytes = x.queries, x.bytes
+		x.prevLatency, x.latency = x.latency, make([]uint64, len(latencyBuckets)+1)
+	}
+}
+
+// capSubscribers returns the number of clients watching each route, keeping the maxRouteStats most watched routes,
+// and folding the rest into otherStatsRoute.
+func capSubscribers(subscribers map[string]int) map[string]int {
+	if len(subscribers) <= maxRouteStats {
+		return subscribers
+	}
+	routes := make([]string, 0, len(subscribers))
+	for route := range subscribers {
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := subscribers[routes[i]], subscribers[routes[j]]
+		if a != b {
+			return a > b
+		}
+		return routes[i] < routes[j]
+	})
+	capped := make(map[string]int, maxRouteStats)
+	for i, route := range routes {
+		if i < maxRouteStats-1 {
+			capped[route] += subscribers[route]
+		} else {
+			capped[otherStatsRoute] += subscribers[route]
+		}
+	}
+	return capped
+}
+
+// infos returns the stats for all routes, busiest first, given the number of clients watching each route.
+func (s *RouteStats) infos(subscribers map[string]int) []RouteStatInfo {
+	subscribers = capSubscribers(subscribers)
+	s.Lock()
+	infos := make([]RouteStatInfo, 0, len(s.routes))
+	for route, x := range s.routes {
+		infos = append(infos, RouteStatInfo{
+			route,
+			subscribers[route],
+			x.queries,
+			x.queryRate,
+			quantile(x.prevLatency, .5),
+			quantile(x.prevLatency, .95),
+			x.bytes,
+			x.byteRate,
+		})
+	}
+	for route, n := range subscribers {
+		if _, ok := s.routes[route]; !ok {
+			infos = append(infos, RouteStatInfo{Route: route, Subscribers: n})
+		}
+	}
+	s.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		a, b := infos[i], infos[j]
+		if a.QueryRate != b.QueryRate {
+			return a.QueryRate > b.QueryRate
+		}
+		if a.BroadcastRate != b.BroadcastRate {
+			return a.BroadcastRate > b.BroadcastRate
+		}
+		return a.Route < b.Route
+	})
+	return infos
+}
+
+// write writes the stats in the Prometheus text format.
+func (s *RouteStats) write(w io.Writer, subscribers map[string]int) {
+	subscribers = capSubscribers(subscribers)
+	s.Lock()
+	defer s.Unlock()
+	routes := make([]string, 0, len(s.routes))
+	for route := range s.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	writeMetricHeader(w, "wave_route_queries_total", "Queries forwarded to apps, by app route.", "counter")
+	for _, route := range routes {
+		if n := s.routes[route].queries; n > 0 {
+			fmt.Fprintf(w, "wave_route_queries_total{route=%s} %d\n", quoteLabel(route), n)
+		}
+	}
+	writeMetricHeader(w, "wave_route_broadcast_bytes_total", "Bytes sent to clients, by page route.", "counter")
+	for _, route := range routes {
+		if n := s.routes[route].bytes; n > 0 {
+			fmt.Fprintf(w, "wave_route_broadcast_bytes_total{route=%s} %d\n", quoteLabel(route), n)
+		}
+	}
+
+	routes = routes[:0]
+	for route := range subscribers {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	writeMetricHeader(w, "wave_route_subscribers", "Clients watching pages, by page route.", "gauge")
+	for _, route := range routes {
+		fmt.Fprintf(w, "wave_route_subscribers{route=%s} %d\n", quoteLabel(route), subscribers[route])
+	}
+}
+
+// quantile estimates the q-quantile of the observations in latencyBuckets buckets, interpolating linearly
+// within the bucket it falls in, like Prometheus' histogram_quantile(). Returns 0 if there are no observations.
+func quantile(counts []uint64, q float64) float64 {
+	var total uint64
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank, seen := q*float64(total), 0.0
+	for i, n := range counts {
+		if n == 0 || seen+float64(n) < rank {
+			seen += float64(n)
+			continue
+		}
+		if i == len(latencyBuckets) { // +Inf bucket
+			return latencyBuckets[i-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+		return lower + (latencyBuckets[i]-lower)*(rank-seen)/float64(n)
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestRouteStats(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	s := newRouteStats()
+	start := s.last
+	for i := 0; i < 9; i++ {
+		s.query("/demo", 20*time.Millisecond)
+	}
+	s.query("/demo", 3*time.Second)
+	s.query("/quiet", time.Millisecond)
+	s.broadcast("/demo", 100)
+	s.broadcast("/demo", 400)
+	s.tick(start.Add(10 * time.Second))
+	s.query("/demo", time.Millisecond) // counted towards the next interval
+
+	infos := s.infos(map[string]int{"/demo": 3, "/idle": 1})
+	eq(len(infos), 3)
+	demo := infos[0]
+	eq(demo.Route, "/demo")
+	eq(demo.Subscribers, 3)
+	eq(demo.Queries, uint64(11))
+	eq(demo.QueryRate, 1.0)
+	eq(demo.BroadcastBytes, uint64(500))
+	eq(demo.BroadcastRate, 50.0)
+	ok(demo.LatencyP50 > .01 && demo.LatencyP50 <= .025, "p50")
+	ok(demo.LatencyP95 > 2.5 && demo.LatencyP95 <= 5, "p95")
+	eq(infos[1].Route, "/quiet")
+	eq(infos[2], RouteStatInfo{Route: "/idle", Subscribers: 1})
+
+	var b strings.Builder
+	s.write(&b, map[string]int{"/demo": 3})
+	for _, line := range []string{
+		`wave_route_queries_total{route="/demo"} 11`,
+		`wave_route_broadcast_bytes_total{route="/demo"} 500`,
+		`wave_route_subscribers{route="/demo"} 3`,
+	} {
+		ok(strings.Contains(b.String(), line+"\n"), "missing: "+line)
+	}
+	eq(quantile(make([]uint64, len(latencyBuckets)+1), .5), 0.0)
+}
+
+func TestRouteStatsEviction(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	s := newRouteStats()
+	now := s.last
+	s.query("/gone", time.Millisecond)
+	s.query("/busy", time.Millisecond)
+	for d := routeStatsInterval; d <= routeStatsTTL+routeStatsInterval; d += routeStatsInterval {
+		s.broadcast("/busy", 10)
+		s.tick(now.Add(d))
+	}
+	infos := s.infos(nil)
+	eq(len(infos), 1)
+	eq(infos[0].Route, "/busy")
+}
+
+func TestRouteStatsSubscriberLabels(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	subscribers := make(map[string]int)
+	for i := 0; i < maxRouteStats+10; i++ {
+		subscribers["/u/"+strconv.Itoa(i)] = 1
+	}
+	subscribers["/popular"] = 100
+	capped := capSubscribers(subscribers)
+	eq(len(capped), maxRouteStats)
+	eq(capped["/popular"], 100)
+	eq(capped[otherStatsRoute], 12) // 11 + 1 making room for (other)
+
+	var b strings.Builder
+	newRouteStats().write(&b, subscribers)
+	eq(strings.Count(b.String(), "wave_route_subscribers{"), maxRouteStats)
+	ok(strings.Contains(b.String(), `wave_route_subscribers{route="/popular"} 100`+"\n"), "most watched route kept")
+}
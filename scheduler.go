@@ -0,0 +1,204 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/cron"
+)
+
+const (
+	scheduledByServer = "server" // defined by the operator
+	scheduledByApp    = "app"    // defined by the app at registration
+)
+
+// Scheduler forwards synthetic "timer" queries to app routes on cron schedules, so that apps can run periodic jobs
+// (e.g. refreshing data) without an external scheduler. Schedules are defined by the operator, or by apps at registration.
+type Scheduler struct {
+	sync.Mutex
+	broker *Broker
+	jobs   map[string]*ScheduledJob // route + " " + name => job
+}
+
+// ScheduledJob represents a schedule for an app route.
+type ScheduledJob struct {
+	route    string // app route on the site
+	schedule *cron.Schedule
+	stop     chan struct{}
+	info     ScheduledJobInfo // guarded by the scheduler's lock
+}
+
+// ScheduledJobInfo represents the state of a scheduled job, as reported by the admin API.
+type ScheduledJobInfo struct {
+	Route  string     `json:"route"`
+	Name   string     `json:"name"`
+	Cron   string     `json:"cron"`
+	Source string     `json:"source"` // "server" or "app"
+	Next   *time.Time `json:"next,omitempty"`
+	Last   *time.Time `json:"last,omitempty"`
+	Error  string     `json:"error,omitempty"` // error from the last run, if any
+}
+
+// TimerD represents a timer event, as delivered to an app: {"": {"@system": {"timer": {...}}}}.
+type TimerD struct {
+	Name string    `json:"name"`
+	Cron string    `json:"cron"`
+	Time time.Time `json:"time"`
+}
+
+func newScheduler(broker *Broker) *Scheduler {
+	return &Scheduler{broker: broker, jobs: make(map[string]*ScheduledJob)}
+}
+
+// add schedules timer queries to the app at route, replacing any schedule of the same name.
+func (s *Scheduler) add(route, name, spec, source string) error {
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return err
+	}
+	if len(name) == 0 {
+		name = spec
+	}
+	job := &ScheduledJob{route, schedule, make(chan struct{}), ScheduledJobInfo{Route: route, Name: name, Cron: spec, Source: source}}
+	key := route + keySeparator + name
+	s.Lock()
+	if prev, ok := s.jobs[key]; ok {
+		close(prev.stop)
+	}
+	s.jobs[key] = job
+	s.Unlock()
+	go s.run(job)
+	return nil
+}
+
+// setApp replaces the schedules defined by the app at route. Safe to call on a nil scheduler.
+func (s *Scheduler) setApp(route string, schedules []AppSchedule) {
+	if s == nil {
+		return
+	}
+	s.dropApp(route)
+	for _, x := range schedules {
+		if err := s.add(route, x.Name, x.Cron, scheduledByApp); err != nil { // already validated at registration
+			echoError(Log{"t": "schedule", "route": route, "cron": x.Cron, "error": err.Error()})
+		}
+	}
+}
+
+// dropApp removes the schedules defined by the app at route. Safe to call on a nil scheduler.
+func (s *Scheduler) dropApp(route string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for key, job := range s.jobs {
+		if job.route == route && job.info.Source == scheduledByApp {
+			close(job.stop)
+			delete(s.jobs, key)
+		}
+	}
+}
+
+func (s *Scheduler) run(job *ScheduledJob) {
+	for {
+		next := job.schedule.Next(time.Now())
+		if next.IsZero() {
+			return
+		}
+		s.Lock()
+		job.info.Next = &next
+		s.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-job.stop:
+			timer.Stop()
+			return
+		case now := <-timer.C:
+			s.fire(job, now) // runs missed while firing are skipped, rather than piling up
+		}
+	}
+}
+
+func (s *Scheduler) fire(job *ScheduledJob, now time.Time) {
+	s.Lock()
+	name, spec := job.info.Name, job.info.Cron
+	s.Unlock()
+
+	err := s.deliver(job.route, TimerD{name, spec, now.UTC()})
+	if err != nil {
+		echoError(Log{"t": "schedule", "route": job.route, "name": name, "error": err.Error()})
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	job.info.Last, job.info.Error = &now, ""
+	if err != nil {
+		job.info.Error = err.Error()
+	}
+}
+
+func (s *Scheduler) deliver(route string, timer TimerD) error {
+	if s.broker.maintenance.isOn() { // skipped, like timers missed while the app is away
+		return errAppMaintenance
+	}
+	app := s.broker.getApp(route)
+	if app == nil {
+		return errAppUnavailable
+	}
+	data, err := json.Marshal(map[string]map[string]map[string]TimerD{"": {"@system": {"timer": timer}}})
+	if err != nil {
+		return err
+	}
+	_, appRoute := splitTenantRoute(route)
+	ctx, cancel := s.broker.appContext(context.Background())
+	defer cancel()
+	return app.forward(ctx, appRoute, "", anonymous, data, nil)
+}
+
+// infos returns the state of all scheduled jobs, sorted by route and name. Safe to call on a nil scheduler.
+func (s *Scheduler) infos() []ScheduledJobInfo {
+	infos := []ScheduledJobInfo{}
+	if s == nil {
+		return infos
+	}
+	s.Lock()
+	for _, job := range s.jobs {
+		infos = append(infos, job.info)
+	}
+	s.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Route == infos[j].Route {
+			return infos[i].Name < infos[j].Name
+		}
+		return infos[i].Route < infos[j].Route
+	})
+	return infos
+}
+
+// checkAppSchedules returns an error if any of an app's schedules is invalid.
+func checkAppSchedules(schedules []AppSchedule) error {
+	for _, x := range schedules {
+		if _, err := cron.Parse(x.Cron); err != nil {
+			return err
+		}
+	}
+	return nil
+}
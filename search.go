@@ -0,0 +1,268 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+const (
+	maxSearchResults = 100 // pages per search
+	maxSearchTerm    = 64  // longest indexed term, in bytes
+)
+
+// SearchResult represents a page matching a search query.
+type SearchResult struct {
+	Route string   `json:"route"`
+	Cards []string `json:"cards"` // keys of matching cards
+}
+
+type searchDoc struct {
+	route, card string
+}
+
+// SearchIndex represents an inverted index over the text attributes (titles, content, etc.) of cards on all pages.
+type SearchIndex struct {
+	sync.RWMutex
+	terms map[string]map[searchDoc]bool  // term => cards containing term
+	docs  map[string]map[string][]string // route => card => terms in card
+}
+
+func newSearchIndex() *SearchIndex {
+	return &SearchIndex{terms: make(map[string]map[searchDoc]bool), docs: make(map[string]map[string][]string)}
+}
+
+// tokenize splits text into lowercase terms, e.g. "**CPU** cpu_usage (%)" -> ["cpu", "cpu", "cpu_usage"].
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(c rune) bool {
+		return !(unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_')
+	})
+}
+
+// cardTerms returns the distinct terms in a card's text attributes.
+func cardTerms(card *Card) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for k, v := range card.data {
+		if k == "view" || k == "box" {
+			continue
+		}
+		if s, ok := v.(string); ok {
+			for _, t := range tokenize(s) {
+				if len(t) <= maxSearchTerm && !seen[t] {
+					seen[t] = true
+					terms = append(terms, t)
+				}
+			}
+		}
+	}
+	return terms
+}
+
+// put (re)indexes a card, or removes it from the index if card is nil. Safe to call on a nil index.
+func (x *SearchIndex) put(route, k string, card *Card) {
+	if x == nil {
+		return
+	}
+	var terms []string
+	if card != nil {
+		terms = cardTerms(card)
+	}
+	x.Lock()
+	defer x.Unlock()
+	x.remove(route, k)
+	if len(terms) == 0 {
+		return
+	}
+	cards, ok := x.docs[route]
+	if !ok {
+		cards = make(map[string][]string)
+		x.docs[route] = cards
+	}
+	cards[k] = terms
+	doc := searchDoc{route, k}
+	for _, t := range terms {
+		docs, ok := x.terms[t]
+		if !ok {
+			docs = make(map[searchDoc]bool)
+			x.terms[t] = docs
+		}
+		docs[doc] = true
+	}
+}
+
+// remove removes a card from the index; must be called under write-lock.
+func (x *SearchIndex) remove(route, k string) {
+	cards, ok := x.docs[route]
+	if !ok {
+		return
+	}
+	doc := searchDoc{route, k}
+	for _, t := range cards[k] {
+		if docs, ok := x.terms[t]; ok {
+			delete(docs, doc)
+			if len(docs) == 0 {
+				delete(x.terms, t)
+			}
+		}
+	}
+	delete(cards, k)
+	if len(cards) == 0 {
+		delete(x.docs, route)
+	}
+}
+
+// page reindexes all the cards on a page; must be called under the page's lock.
+func (x *SearchIndex) page(route string, page *Page) {
+	if x == nil {
+		return
+	}
+	x.drop(route)
+	for k, card := range page.cards {
+		x.put(route, k, card)
+	}
+}
+
+// drop removes all the cards on a page from the index. Safe to call on a nil index.
+func (x *SearchIndex) drop(route string) {
+	if x == nil {
+		return
+	}
+	x.Lock()
+	defer x.Unlock()
+	for k := range x.docs[route] {
+		x.remove(route, k)
+	}
+}
+
+// search returns the pages containing cards that match all the terms in query, sorted by route.
+// Only routes for which visible returns true are included.
+func (x *SearchIndex) search(query string, visible func(route string) bool) []SearchResult {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	x.RLock()
+	sets := make([]map[searchDoc]bool, len(terms))
+	for i, t := range terms {
+		docs, ok := x.terms[t]
+		if !ok {
+			x.RUnlock()
+			return nil
+		}
+		sets[i] = docs
+	}
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) }) // intersect smallest first
+	pages := make(map[string][]string)
+	for doc := range sets[0] {
+		if matchAll(sets[1:], doc) && visible(doc.route) {
+			pages[doc.route] = append(pages[doc.route], doc.card)
+		}
+	}
+	x.RUnlock()
+
+	results := make([]SearchResult, 0, len(pages))
+	for route, cards := range pages {
+		sort.Strings(cards)
+		results = append(results, SearchResult{route, cards})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Route < results[j].Route })
+	if len(results) > maxSearchResults {
+		results = results[:maxSearchResults]
+	}
+	return results
+}
+
+func matchAll(sets []map[searchDoc]bool, doc searchDoc) bool {
+	for _, docs := range sets {
+		if !docs[doc] {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchServer serves GET /_search?q=terms, listing the pages containing cards that match all the given terms.
+//
+// Requires an API access key, or if OIDC is enabled, a valid session. Sessions cannot see per-client pages.
+type SearchServer struct {
+	index    *SearchIndex
+	broker   *Broker
+	keychain *keychain.Keychain
+	auth     *Auth
+	tenancy  *Tenancy
+}
+
+func newSearchServer(index *SearchIndex, broker *Broker, keychain *keychain.Keychain, auth *Auth, tenancy *Tenancy) *SearchServer {
+	return &SearchServer{index, broker, keychain, auth, tenancy}
+}
+
+func (s *SearchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	keyed := s.keychain.Allow(r)
+	var session *Session
+	if !keyed {
+		if s.auth != nil {
+			session = s.auth.identify(r)
+		}
+		if session == nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var tenant string
+	if s.tenancy != nil {
+		if keyed {
+			tenant = s.tenancy.ofKey(r)
+		} else {
+			t, err := s.tenancy.ofUser(r, session)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			tenant = t
+		}
+	}
+	prefix := tenantRoute(tenant, "/")
+
+	results := s.index.search(r.URL.Query().Get("q"), func(route string) bool {
+		if len(tenant) > 0 && !strings.HasPrefix(route, prefix) {
+			return false
+		}
+		return keyed || !s.broker.isUnicast(route)
+	})
+	if results == nil {
+		results = []SearchResult{}
+	}
+	if len(tenant) > 0 { // address pages without the tenant's prefix
+		for i := range results {
+			results[i].Route = strings.TrimPrefix(results[i].Route, prefix[:len(prefix)-1])
+		}
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, results)
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestSiteSearch(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	site := newSite()
+	site.index = newSearchIndex()
+	patch := func(url, data string) {
+		no(site.patch(url, []byte(data)))
+	}
+	search := func(q string) string {
+		b, err := json.Marshal(site.index.search(q, func(string) bool { return true }))
+		no(err)
+		return string(b)
+	}
+
+	patch("/a", `{"d":[{"k":"x","d":{"view":"markdown","title":"CPU","content":"**cpu_usage** by host"}},{"k":"y","d":{"view":"markdown","title":"Memory"}}]}`)
+	patch("/b", `{"d":[{"k":"z","d":{"view":"small_stat","title":"cpu_usage","value":"42%"}}]}`)
+
+	eq(search("cpu_usage"), `[{"route":"/a","cards":["x"]},{"route":"/b","cards":["z"]}]`)
+	eq(search("CPU host"), `[{"route":"/a","cards":["x"]}]`) // all terms, case-insensitive
+	eq(search("markdown"), `null`)                           // views are not indexed
+
+	patch("/a", `{"d":[{"k":"x title","v":"Memory"},{"k":"x content"}]}`)
+	eq(search("cpu_usage"), `[{"route":"/b","cards":["z"]}]`) // changed attributes
+	eq(search("memory"), `[{"route":"/a","cards":["x","y"]}]`)
+
+	patch("/a", `{"d":[{"k":"y"}]}`)
+	eq(search("memory"), `[{"route":"/a","cards":["x"]}]`) // deleted card
+
+	patch("/a", `{"d":[{}]}`)
+	site.del("/b")
+	eq(search("memory"), `null`) // deleted pages
+	eq(search("cpu_usage"), `null`)
+	eq(len(site.index.docs), 0)
+	eq(len(site.index.terms), 0)
+}
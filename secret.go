@@ -0,0 +1,361 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2oai/wave/pkg/blob"
+)
+
+const (
+	vaultK8sTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kmsContentType    = "application/x-amz-json-1.1"
+)
+
+var (
+	vaultClient  = &http.Client{Timeout: 10 * time.Second}
+	kmsClient    = &http.Client{Timeout: 10 * time.Second}
+	vaultSession = &VaultSession{now: time.Now}
+)
+
+// LoadSecret resolves a secret given its source, so that secrets need not appear in process listings:
+// "file:path" reads the secret from a file, which must not be accessible by other users;
+// "vault:path#field" reads a field of a HashiCorp Vault secret (see VaultSession for how Wave logs in to Vault);
+// "kms:ciphertext" decrypts a base64-encoded ciphertext encrypted with AWS KMS, using the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and AWS_REGION environment variables (and optionally AWS_KMS_ENDPOINT);
+// "cmd:command" reads the secret from the output of a shell command, e.g. another KMS client decrypting it.
+// Anything else is the secret itself. Leading and trailing whitespace is trimmed from secrets read from sources.
+func LoadSecret(spec string) (string, error) {
+	var (
+		b   []byte
+		err error
+	)
+	switch {
+	case strings.HasPrefix(spec, "file:"):
+		b, err = readSecretFile(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "vault:"):
+		b, err = readVaultSecret(strings.TrimPrefix(spec, "vault:"))
+	case strings.HasPrefix(spec, "kms:"):
+		b, err = decryptKMSSecret(strings.TrimPrefix(spec, "kms:"))
+	case strings.HasPrefix(spec, "cmd:"):
+		cmd := exec.Command("sh", "-c", strings.TrimPrefix(spec, "cmd:"))
+		cmd.Stderr = os.Stderr
+		b, err = cmd.Output()
+	default:
+		return spec, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed reading secret from %s: %v", spec, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// SecretKey holds a key that can be replaced while in use, e.g. when rotated at its source.
+type SecretKey struct {
+	sync.RWMutex
+	key []byte
+}
+
+func newSecretKey(key []byte) *SecretKey {
+	return &SecretKey{key: key}
+}
+
+func (k *SecretKey) get() []byte {
+	k.RLock()
+	defer k.RUnlock()
+	return k.key
+}
+
+func (k *SecretKey) set(key []byte) {
+	k.Lock()
+	k.key = key
+	k.Unlock()
+}
+
+func readSecretFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("file is accessible by other users (mode %04o): want 0600 or 0400", info.Mode().Perm())
+	}
+	return ioutil.ReadFile(path)
+}
+
+// VaultSession holds the token used to read secrets from Vault at VAULT_ADDR (in VAULT_NAMESPACE, if set).
+// The token is VAULT_TOKEN if set; else obtained by logging in using the AppRole auth method if VAULT_ROLE_ID and
+// VAULT_SECRET_ID are set, or the Kubernetes auth method if VAULT_K8S_ROLE is set, with the pod's service account
+// token (or the one at VAULT_K8S_TOKEN_FILE), at the auth method's default path or VAULT_AUTH_PATH.
+// Tokens are renewed when used past half their TTL, or, if obtained by logging in, replaced by logging in again
+// if they cannot be renewed. Secrets should therefore be refreshed (see -secret-refresh) at least that often.
+type VaultSession struct {
+	sync.Mutex
+	token     string
+	ttl       time.Duration // 0 if the token does not expire
+	renewable bool
+	since     time.Time // when the token was obtained or last renewed
+	login     bool      // token obtained by logging in, so can be obtained again?
+	now       func() time.Time
+}
+
+// vaultAuth represents the token in the response to a login or renewal.
+type vaultAuth struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+// get returns a token valid for Vault at addr, logging in or renewing the token as needed.
+func (v *VaultSession) get(addr string) (string, error) {
+	v.Lock()
+	defer v.Unlock()
+	if len(v.token) == 0 {
+		if err := v.authenticate(addr); err != nil {
+			return "", err
+		}
+		return v.token, nil
+	}
+	age := v.now().Sub(v.since)
+	if v.ttl == 0 || age < v.ttl/2 {
+		return v.token, nil
+	}
+	err := errors.New("token not renewable")
+	if v.renewable {
+		err = v.renew(addr)
+	}
+	if err != nil && v.login {
+		err = v.authenticate(addr)
+	}
+	if err != nil {
+		if age >= v.ttl {
+			return "", fmt.Errorf("vault token expired: %v", err)
+		}
+		echoWarn(Log{"t": "vault_renew", "ttl": (v.ttl - age).String(), "error": err.Error()})
+	}
+	return v.token, nil
+}
+
+// reset forgets a token that was refused, so that the next request logs in again.
+func (v *VaultSession) reset() {
+	v.Lock()
+	v.token = ""
+	v.Unlock()
+}
+
+func (v *VaultSession) authenticate(addr string) error {
+	if token := os.Getenv("VAULT_TOKEN"); len(token) > 0 {
+		var self struct {
+			Data struct {
+				TTL       int  `json:"ttl"`
+				Renewable bool `json:"renewable"`
+			} `json:"data"`
+		}
+		if err := vaultDo(http.MethodGet, addr, "auth/token/lookup-self", token, nil, &self); err != nil {
+			// e.g. lookups not allowed by the token's policies: use the token as is, without renewing it
+			echoWarn(Log{"t": "vault_lookup", "error": err.Error()})
+		}
+		v.token, v.ttl, v.renewable, v.since, v.login = token, time.Duration(self.Data.TTL)*time.Second, self.Data.Renewable, v.now(), false
+		return nil
+	}
+	var (
+		method, path string
+		body         map[string]string
+	)
+	if roleID, secretID := os.Getenv("VAULT_ROLE_ID"), os.Getenv("VAULT_SECRET_ID"); len(roleID) > 0 && len(secretID) > 0 {
+		method, path, body = "approle", "approle", map[string]string{"role_id": roleID, "secret_id": secretID}
+	} else if role := os.Getenv("VAULT_K8S_ROLE"); len(role) > 0 {
+		file := os.Getenv("VAULT_K8S_TOKEN_FILE")
+		if len(file) == 0 {
+			file = vaultK8sTokenFile
+		}
+		jwt, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed reading service account token: %v", err)
+		}
+		method, path, body = "kubernetes", "kubernetes", map[string]string{"role": role, "jwt": strings.TrimSpace(string(jwt))}
+	} else {
+		return errors.New("VAULT_TOKEN, VAULT_ROLE_ID and VAULT_SECRET_ID, or VAULT_K8S_ROLE must be set")
+	}
+	if p := os.Getenv("VAULT_AUTH_PATH"); len(p) > 0 {
+		path = strings.Trim(p, "/")
+	}
+	var auth vaultAuth
+	if err := vaultDo(http.MethodPost, addr, "auth/"+path+"/login", "", body, &auth); err != nil {
+		return fmt.Errorf("vault %s login failed: %v", method, err)
+	}
+	if err := v.use(auth); err != nil {
+		return err
+	}
+	v.login = true
+	echo(Log{"t": "vault_login", "method": method, "ttl": v.ttl.String()})
+	return nil
+}
+
+func (v *VaultSession) renew(addr string) error {
+	var auth vaultAuth
+	if err := vaultDo(http.MethodPost, addr, "auth/token/renew-self", v.token, struct{}{}, &auth); err != nil {
+		return err
+	}
+	if err := v.use(auth); err != nil {
+		return err
+	}
+	echo(Log{"t": "vault_renew", "ttl": v.ttl.String()})
+	return nil
+}
+
+func (v *VaultSession) use(auth vaultAuth) error {
+	if len(auth.Auth.ClientToken) == 0 {
+		return errors.New("bad vault response: no token")
+	}
+	v.token, v.ttl, v.renewable, v.since = auth.Auth.ClientToken, time.Duration(auth.Auth.LeaseDuration)*time.Second, auth.Auth.Renewable, v.now()
+	return nil
+}
+
+// vaultDo sends a request to Vault's HTTP API, decoding the JSON response into out.
+func vaultDo(method, addr, path, token string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(addr, "/")+"/v1/"+path, body)
+	if err != nil {
+		return err
+	}
+	if len(token) > 0 {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if ns := os.Getenv("VAULT_NAMESPACE"); len(ns) > 0 {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return vaultError(resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("bad vault response: %v", err)
+	}
+	return nil
+}
+
+type vaultError int
+
+func (e vaultError) Error() string {
+	return "vault request failed: " + http.StatusText(int(e))
+}
+
+// readVaultSecret reads a field of a secret from Vault's KV secrets engine, version 1 or 2,
+// e.g. "secret/data/wave#oidc_client_secret".
+func readVaultSecret(spec string) ([]byte, error) {
+	i := strings.LastIndex(spec, "#")
+	if i < 1 || i == len(spec)-1 {
+		return nil, fmt.Errorf("want path#field, got %q", spec)
+	}
+	path, field := strings.Trim(spec[:i], "/"), spec[i+1:]
+	addr := os.Getenv("VAULT_ADDR")
+	if len(addr) == 0 {
+		return nil, errors.New("VAULT_ADDR must be set")
+	}
+	token, err := vaultSession.get(addr)
+	if err != nil {
+		return nil, err
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := vaultDo(http.MethodGet, addr, path, token, nil, &secret); err != nil {
+		if err == vaultError(http.StatusForbidden) { // e.g. revoked
+			vaultSession.reset()
+		}
+		return nil, err
+	}
+	data := secret.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok { // KV version 2
+		data = inner
+	}
+	v, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault secret %s has no field %s", path, field)
+	}
+	return []byte(v), nil
+}
+
+// decryptKMSSecret decrypts a base64-encoded ciphertext using AWS KMS, per
+// https://docs.aws.amazon.com/kms/latest/APIReference/API_Decrypt.html
+func decryptKMSSecret(ciphertext string) ([]byte, error) {
+	region := os.Getenv("AWS_REGION")
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_KMS_ENDPOINT")
+	if len(endpoint) == 0 {
+		endpoint = "https://kms." + region + ".amazonaws.com"
+	}
+	creds := blob.Credentials{AccessKeyID: os.Getenv("AWS_ACCESS_KEY_ID"), SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), SessionToken: os.Getenv("AWS_SESSION_TOKEN")}
+	if len(creds.AccessKeyID) == 0 || len(creds.SecretAccessKey) == 0 {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	body, err := json.Marshal(map[string]string{"CiphertextBlob": strings.TrimSpace(ciphertext)})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", kmsContentType)
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	blob.SignV4(req, body, region, "kms", creds, time.Now())
+	resp, err := kmsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Plaintext string `json:"Plaintext"`
+		Type      string `json:"__type"`
+		Message   string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("bad kms response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kms request failed: %s: %s %s", http.StatusText(resp.StatusCode), reply.Type, reply.Message)
+	}
+	return base64.StdEncoding.DecodeString(reply.Plaintext)
+}
@@ -0,0 +1,271 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestLoadSecret(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+
+	s, err := LoadSecret("plain")
+	no(err)
+	eq(s, "plain")
+
+	path := filepath.Join(t.TempDir(), "secret")
+	no(ioutil.WriteFile(path, []byte("from-file\n"), 0600))
+	s, err = LoadSecret("file:" + path)
+	no(err)
+	eq(s, "from-file")
+
+	no(os.Chmod(path, 0644))
+	_, err = LoadSecret("file:" + path)
+	ok(err != nil, "readable by others")
+
+	s, err = LoadSecret("cmd:echo from-cmd")
+	no(err)
+	eq(s, "from-cmd")
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/wave":
+			w.Write([]byte(`{"data":{"data":{"client_secret":"from-vault"}}}`))
+		case "/v1/kv/wave":
+			w.Write([]byte(`{"data":{"client_secret":"from-kv1"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "token")
+	vaultSession = &VaultSession{now: time.Now}
+
+	s, err = LoadSecret("vault:secret/data/wave#client_secret")
+	no(err)
+	eq(s, "from-vault")
+	s, err = LoadSecret("vault:kv/wave#client_secret")
+	no(err)
+	eq(s, "from-kv1")
+	_, err = LoadSecret("vault:secret/data/wave#other")
+	ok(err != nil, "missing field")
+	_, err = LoadSecret("vault:secret/data/missing#client_secret")
+	ok(err != nil, "missing secret")
+	_, err = LoadSecret("vault:secret/data/wave")
+	ok(err != nil, "no field")
+
+	t.Setenv("VAULT_TOKEN", "wrong")
+	vaultSession = &VaultSession{now: time.Now} // forget the token
+	_, err = LoadSecret("vault:secret/data/wave#client_secret")
+	ok(err != nil, "bad token")
+}
+
+// fakeVault serves a KV secret, readable with tokens it issued by logging in, which it renews up to maxRenewals times.
+type fakeVault struct {
+	tokens      map[string]bool
+	logins      int
+	renewals    int
+	maxRenewals int
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := func(token string, renewable bool) {
+		fmt.Fprintf(w, `{"auth":{"client_token":%q,"lease_duration":60,"renewable":%t}}`, token, renewable)
+	}
+	var body map[string]string
+	json.NewDecoder(r.Body).Decode(&body)
+	switch r.URL.Path {
+	case "/v1/auth/approle/login":
+		if body["role_id"] != "role" || body["secret_id"] != "secret" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	case "/v1/auth/k8s/login":
+		if body["role"] != "wave" || body["jwt"] != "jwt" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	case "/v1/auth/token/renew-self":
+		token := r.Header.Get("X-Vault-Token")
+		if !v.tokens[token] || v.renewals == v.maxRenewals {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		v.renewals++
+		auth(token, v.renewals < v.maxRenewals)
+		return
+	case "/v1/secret/data/wave":
+		if !v.tokens[r.Header.Get("X-Vault-Token")] {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"client_secret":"from-vault"}}}`))
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	v.logins++
+	token := fmt.Sprintf("token%d", v.logins)
+	v.tokens[token] = true
+	auth(token, true)
+}
+
+func TestVaultLogin(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	fake := &fakeVault{tokens: make(map[string]bool), maxRenewals: 1}
+	vault := httptest.NewServer(fake)
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "")
+	t.Setenv("VAULT_ROLE_ID", "role")
+	t.Setenv("VAULT_SECRET_ID", "secret")
+	now := time.Now()
+	vaultSession = &VaultSession{now: func() time.Time { return now }}
+
+	read := func() {
+		s, err := LoadSecret("vault:secret/data/wave#client_secret")
+		no(err)
+		eq(s, "from-vault")
+	}
+	read()
+	read()
+	eq(fake.logins, 1)
+	eq(vaultSession.token, "token1")
+
+	now = now.Add(40 * time.Second) // past half the TTL
+	read()
+	eq(fake.renewals, 1)
+	eq(fake.logins, 1)
+	eq(vaultSession.renewable, false)
+
+	now = now.Add(40 * time.Second) // cannot be renewed: logs in again
+	read()
+	eq(fake.logins, 2)
+	eq(vaultSession.token, "token2")
+
+	delete(fake.tokens, "token2") // revoked: logs in again
+	_, err := LoadSecret("vault:secret/data/wave#client_secret")
+	ok(err != nil, "revoked")
+	read()
+	eq(fake.logins, 3)
+}
+
+func TestVaultKubernetesLogin(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	fake := &fakeVault{tokens: make(map[string]bool)}
+	vault := httptest.NewServer(fake)
+	defer vault.Close()
+	jwt := filepath.Join(t.TempDir(), "token")
+	no(ioutil.WriteFile(jwt, []byte("jwt\n"), 0600))
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "")
+	t.Setenv("VAULT_ROLE_ID", "")
+	t.Setenv("VAULT_K8S_ROLE", "wave")
+	t.Setenv("VAULT_K8S_TOKEN_FILE", jwt)
+	t.Setenv("VAULT_AUTH_PATH", "/k8s/")
+	vaultSession = &VaultSession{now: time.Now}
+
+	s, err := LoadSecret("vault:secret/data/wave#client_secret")
+	no(err)
+	eq(s, "from-vault")
+	eq(fake.logins, 1)
+}
+
+func TestVaultTokenRenewal(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	renewals := 0
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			w.Write([]byte(`{"data":{"ttl":60,"renewable":true}}`))
+		case "/v1/auth/token/renew-self":
+			renewals++
+			w.Write([]byte(`{"auth":{"client_token":"token","lease_duration":60,"renewable":false}}`))
+		case "/v1/secret/data/wave":
+			w.Write([]byte(`{"data":{"data":{"client_secret":"from-vault"}}}`))
+		}
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "token")
+	now := time.Now()
+	vaultSession = &VaultSession{now: func() time.Time { return now }}
+
+	_, err := LoadSecret("vault:secret/data/wave#client_secret")
+	no(err)
+	eq(vaultSession.ttl, time.Minute)
+	now = now.Add(40 * time.Second)
+	_, err = LoadSecret("vault:secret/data/wave#client_secret")
+	no(err)
+	eq(renewals, 1)
+
+	now = now.Add(40 * time.Second) // not renewable, but not expired: used as is
+	_, err = LoadSecret("vault:secret/data/wave#client_secret")
+	no(err)
+	now = now.Add(40 * time.Second)
+	_, err = LoadSecret("vault:secret/data/wave#client_secret")
+	ok(err != nil, "expired")
+}
+
+func TestDecryptKMSSecret(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	kms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ CiphertextBlob string }
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Header.Get("X-Amz-Target") != "TrentService.Decrypt" || r.Header.Get("Content-Type") != kmsContentType ||
+			!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/kms/aws4_request") {
+			http.Error(w, `{"__type":"AccessDeniedException"}`, http.StatusBadRequest)
+			return
+		}
+		if req.CiphertextBlob != "Y2lwaGVy" {
+			http.Error(w, `{"__type":"InvalidCiphertextException","message":"bad ciphertext"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"KeyId":"key","Plaintext":%q}`, base64.StdEncoding.EncodeToString([]byte("from-kms\n")))
+	}))
+	defer kms.Close()
+	t.Setenv("AWS_KMS_ENDPOINT", kms.URL)
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	s, err := LoadSecret("kms:Y2lwaGVy")
+	no(err)
+	eq(s, "from-kms")
+	_, err = LoadSecret("kms:b3RoZXI=")
+	ok(err != nil && strings.Contains(err.Error(), "InvalidCiphertextException"), "bad ciphertext")
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+)
+
+const hstsHeader = "Strict-Transport-Security"
+
+// defaultSecurityHeaders are sent with every response unless overridden. The content security policy only forbids
+// framing by other sites, since apps are free to embed content from anywhere.
+var defaultSecurityHeaders = http.Header{
+	"Content-Security-Policy": {"frame-ancestors 'self'"},
+	hstsHeader:                {"max-age=31536000"},
+	"X-Frame-Options":         {"SAMEORIGIN"},
+	"Referrer-Policy":         {"strict-origin-when-cross-origin"},
+	"X-Content-Type-Options":  {"nosniff"},
+}
+
+// SecurityHeaders represents the security-related headers sent with every response.
+type SecurityHeaders struct {
+	Override http.Header // replaces the default values; empty values remove headers
+}
+
+// header returns the default headers, overridden.
+func (s *SecurityHeaders) header() http.Header {
+	header := defaultSecurityHeaders.Clone()
+	for k, vs := range s.Override {
+		k = http.CanonicalHeaderKey(k)
+		if len(vs) == 0 || len(vs) == 1 && len(vs[0]) == 0 {
+			header.Del(k)
+		} else {
+			header[k] = vs
+		}
+	}
+	return header
+}
+
+// wrap returns a handler that sets the security headers before h runs, so that h can still override them, e.g.
+// via custom headers for static files. HSTS is only sent over HTTPS, as browsers ignore it otherwise.
+// Safe to call on nil, which disables the headers.
+func (s *SecurityHeaders) wrap(h http.Handler) http.Handler {
+	if s == nil {
+		return h
+	}
+	security := s.header()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		for k, vs := range security {
+			if k == hstsHeader && !trustedProxies.isHTTPS(r) {
+				continue
+			}
+			header[k] = vs
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/custom" {
+			w.Header().Set("X-Frame-Options", "DENY")
+		}
+	})
+	serve := func(s *SecurityHeaders, path string, secure bool) http.Header {
+		r := httptest.NewRequest("GET", path, nil)
+		if secure {
+			r.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		s.wrap(h).ServeHTTP(w, r)
+		return w.Header()
+	}
+
+	header := serve(&SecurityHeaders{}, "/", false)
+	eq(header.Get("Content-Security-Policy"), "frame-ancestors 'self'")
+	eq(header.Get("X-Frame-Options"), "SAMEORIGIN")
+	eq(header.Get("X-Content-Type-Options"), "nosniff")
+	eq(header.Get("Referrer-Policy"), "strict-origin-when-cross-origin")
+	eq(header.Get(hstsHeader), "") // plain HTTP
+
+	header = serve(&SecurityHeaders{}, "/", true)
+	eq(header.Get(hstsHeader), "max-age=31536000")
+
+	header = serve(&SecurityHeaders{}, "/custom", false) // handler overrides
+	eq(header.Get("X-Frame-Options"), "DENY")
+
+	override := http.Header{"content-security-policy": {"default-src 'self'"}, "X-Frame-Options": {""}}
+	header = serve(&SecurityHeaders{Override: override}, "/", true)
+	eq(header.Get("Content-Security-Policy"), "default-src 'self'")
+	_, found := header["X-Frame-Options"]
+	ok(!found, "empty override removes header")
+	eq(header.Get(hstsHeader), "max-age=31536000")
+
+	header = serve(nil, "/", true)
+	eq(len(header), 0)
+}
@@ -24,7 +24,10 @@ import (
 	"net/http"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const logo = `
@@ -33,18 +36,18 @@ const logo = `
 │  └┘└┘└─└└─┘└── │ © 2021 H2O.ai, Inc.
 └────────────────┘`
 
-// Log represents key-value data for a log message.
-type Log map[string]string
-
-func echo(m Log) {
-	if j, err := json.Marshal(m); err == nil { // TODO speed up
-		log.Println("#", string(j))
-	}
-}
-
-func handleWithBaseURL(baseURL string) func(string, http.Handler) {
+func handleWithBaseURL(baseURL string, listeners []*Listener) func(string, http.Handler) {
 	return func(pattern string, handler http.Handler) {
-		http.Handle(baseURL+pattern, handler)
+		roles := routeRoles(pattern)
+		for _, l := range listeners {
+			if isHealthRoute(pattern) {
+				l.mux.Handle(baseURL+pattern, handler)
+			} else if l.serves(roles) {
+				l.mux.Handle(baseURL+pattern, l.restrict(handler))
+			} else if len(pattern) > 0 { // rather than falling through to the page routes
+				l.mux.Handle(baseURL+pattern, http.NotFoundHandler())
+			}
+		}
 	}
 }
 
@@ -63,6 +66,10 @@ func printLaunchBar(addr, baseURL string, isTLS bool) {
 	} else {
 		addr = "http://" + addr
 	}
+	if logger.jsonFormat() {
+		echo(Log{"t": "listen", "url": addr + baseURL})
+		return
+	}
 	message := "Running at " + addr + baseURL
 	bar := strings.Repeat("─", len(message)+4)
 	log.Println("# ┌" + bar + "┐")
@@ -72,91 +79,410 @@ func printLaunchBar(addr, baseURL string, isTLS bool) {
 
 // Run runs the HTTP server.
 func Run(conf ServerConf) {
-	for _, line := range strings.Split(fmt.Sprintf(logo, conf.Version, conf.BuildDate), "\n") {
-		log.Println("#", line)
+	if len(conf.LogFile) > 0 {
+		f, err := openRotatingFile(conf.LogFile, conf.LogRotation)
+		if err != nil {
+			panic(fmt.Errorf("failed opening log file: %v", err))
+		}
+		log.SetOutput(f)
+	}
+	if err := logger.setFormat(conf.LogFormat); err != nil {
+		panic(err)
+	}
+	logger.configure(conf.LogLevels)
+	if logger.jsonFormat() {
+		echo(Log{"t": "version", "version": conf.Version, "build_date": conf.BuildDate})
+	} else {
+		for _, line := range strings.Split(fmt.Sprintf(logo, conf.Version, conf.BuildDate), "\n") {
+			log.Println("#", line)
+		}
 	}
 
-	isTLS := conf.CertFile != "" && conf.KeyFile != ""
+	var err error
+	if trustedProxies, err = parseProxyList(conf.TrustedProxies); err != nil {
+		panic(err)
+	}
+	uiFilter, err := newIPFilter("UI", conf.UIAccess)
+	if err != nil {
+		panic(err)
+	}
+	apiFilter, err := newIPFilter("API", conf.APIAccess)
+	if err != nil {
+		panic(err)
+	}
+	adminFilter, err := newIPFilter("admin", conf.AdminAccess)
+	if err != nil {
+		panic(err)
+	}
+	if conf.AccessLog != nil {
+		if accessLog, err = openAccessLog(*conf.AccessLog); err != nil {
+			panic(err)
+		}
+	}
+
+	isTLS := conf.CertFile != "" && conf.KeyFile != "" || conf.Autocert != nil
 
 	printLaunchBar(conf.Listen, conf.BaseURL, isTLS)
 
 	site := newSite()
+	site.historySize = conf.PageHistory
+	if conf.PageSearch {
+		site.index = newSearchIndex()
+	}
+	site.quotas = newQuotas(Quota{conf.MaxPageSize, conf.MaxPageCards}, conf.RoutePageQuotas, conf.AppPageQuotas)
 	if len(conf.Init) > 0 {
 		initSite(site, conf.Init)
 	}
 
-	handle := handleWithBaseURL(conf.BaseURL)
+	listeners, primaryRoles, err := newListeners(conf.Listeners)
+	if err != nil {
+		panic(err)
+	}
+	var primary *Listener // TLS configured below
+	if len(primaryRoles) > 0 {
+		primary = newListener(conf.Listen, primaryRoles, nil, nil)
+		listeners = append([]*Listener{primary}, listeners...)
+	}
+	handle := handleWithBaseURL(conf.BaseURL, listeners)
+
+	if conf.Tracing != nil {
+		tracer = newTracer(*conf.Tracing)
+		go tracer.run()
+		go tracer.flushOnExit()
+		echo(Log{"t": "tracing", "endpoint": conf.Tracing.Endpoint, "sample_ratio": strconv.FormatFloat(conf.Tracing.SampleRatio, 'g', -1, 64)})
+	}
 
 	broker := newBroker(site, conf.Editable, conf.NoStore, conf.NoLog)
+	if len(conf.EditAuditLog) > 0 {
+		if broker.edits, err = openEditAudit(conf.EditAuditLog); err != nil {
+			panic(fmt.Errorf("failed opening edit audit log: %v", err))
+		}
+	}
+	if broker.errorPages, err = loadErrorPages(conf.ErrorPages); err != nil {
+		panic(err)
+	}
+	health := []HealthCheck{{"broker", broker.ping}}
+	broker.aliases = conf.RouteAliases
+	broker.appTimeout = conf.AppTimeout
+	broker.appSlowQuery = conf.AppSlowQuery
+	broker.appCircuit = conf.AppCircuit
+	broker.appLocal = conf.AppLocal
+	broker.appMessages = conf.AppMessages
+	broker.scheduler = newScheduler(broker)
+	for _, spec := range conf.AppSchedules {
+		kv := strings.SplitN(strings.TrimSpace(spec), " ", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "/") {
+			panic(fmt.Errorf("bad app schedule: want \"route cron-expression\", got %q", spec))
+		}
+		if err := broker.scheduler.add(kv[0], "", kv[1], scheduledByServer); err != nil {
+			panic(fmt.Errorf("bad app schedule %q: %v", spec, err))
+		}
+	}
+	if len(conf.AppManifest) > 0 {
+		specs, err := loadAppManifest(conf.AppManifest)
+		if err != nil {
+			panic(err)
+		}
+		broker.supervisor = newSupervisor(broker, appProcessEnv(conf.Listen, conf.BaseURL, isTLS), specs)
+	}
+	broker.queries = newQueryBuffer(conf.AppRestartQueue, conf.AppRestartWait)
+	broker.maintenance = newMaintenance(conf.MaintenanceQueue)
+	broker.coalescer = newCoalescer(conf.RouteCoalesceWindows, broker.publish)
+	broker.appWorkers = conf.AppForwardWorkers
+	broker.frameLimits = conf.FrameLimits
+	broker.backpressure = conf.Backpressure
+	if len(conf.AppBalancing) > 0 {
+		broker.appBalancing = conf.AppBalancing
+	}
+	if len(conf.AppTokens) > 0 {
+		tokens, err := loadAppTokens(conf.AppTokens, conf.AppTokenGrace)
+		if err != nil {
+			panic(err)
+		}
+		broker.appTokens = tokens
+	}
+	if len(conf.PageStore) > 0 {
+		store, err := openPageStore(conf.PageStore, conf.PageStorePassword)
+		if err != nil {
+			panic(fmt.Errorf("failed opening page store: %v", err))
+		}
+		if len(conf.PageStoreKeys) > 0 {
+			keys := make([]*PageKey, len(conf.PageStoreKeys))
+			for i, spec := range conf.PageStoreKeys {
+				if keys[i], err = loadPageKey(spec); err != nil {
+					panic(err)
+				}
+			}
+			store = newEncryptedPageStore(store, keys)
+		}
+		broker.storage = newPageStorage(store, site)
+		health = append(health, HealthCheck{"page_store", checkPageStore(store)})
+		site.loader = store.read // for pages evicted, or not preloaded
+		if err := broker.storage.restore(conf.PagePreload); err != nil {
+			panic(err)
+		}
+		go broker.storage.loadShared(broker) // once the broker runs
+		go broker.storage.run(pageStoreFlushInterval)
+		go broker.storage.listen(broker)
+	}
+	if len(conf.PageWebhooks) > 0 {
+		if broker.hooks, err = newPageHooks(conf.PageWebhooks, conf.PageWebhookSecret, conf.PageWebhookEvents); err != nil {
+			panic(err)
+		}
+	}
+	if len(conf.ClientWebhooks) > 0 {
+		if broker.clientHooks, err = newClientHooks(conf.ClientWebhooks, conf.ClientWebhookSecret, conf.ClientWebhookEvents); err != nil {
+			panic(err)
+		}
+	}
 	go broker.run()
+	if conf.AdminDashboard {
+		if conf.Auth == nil { // no admins to tell apart
+			echoWarn(Log{"t": "admin_dashboard", "error": "admin dashboard requires OIDC; disabled"})
+		} else {
+			broker.dashboard = newAdminDashboard(broker, conf.AdminUsers)
+			go broker.dashboard.run(adminDashboardInterval)
+		}
+	}
+	go broker.expirePages(time.Second)
+	go metrics.routes.run(routeStatsInterval)
+	if conf.PageGC.enabled() {
+		go broker.collectPages(conf.PageGC, pageGCInterval)
+	}
+	if conf.MaxSiteMemory > 0 {
+		go broker.evictPages(conf.MaxSiteMemory, pageEvictInterval)
+	}
 
 	if conf.Debug {
-		handle("_d/site", newDebugHandler(broker))
+		handle("_d/", adminFilter.wrap(http.StripPrefix(conf.BaseURL+"_d", newDebugServer(broker, conf.Keychain))))
+	}
+
+	var tenancy *Tenancy
+	if len(conf.Tenancy) > 0 {
+		var claim string
+		if conf.Tenancy == "claim" {
+			if conf.Auth == nil || len(conf.Auth.TenantClaim) == 0 {
+				panic("claim-based tenancy requires OIDC and a tenant claim")
+			}
+			claim = conf.Auth.TenantClaim
+		} else if conf.Auth != nil {
+			conf.Auth.TenantHost = true
+		}
+		for id, tenant := range conf.TenantKeys {
+			if !isTenantName(tenant) {
+				panic(fmt.Errorf("invalid tenant name for access key %s: %s", id, tenant))
+			}
+		}
+		tenancy = newTenancy(claim, conf.TenantKeys)
+		site.tenantPages = conf.TenantMaxPages
+		echo(Log{"t": "tenancy", "source": conf.Tenancy, "scoped_keys": strconv.Itoa(len(conf.TenantKeys))})
 	}
 
 	var auth *Auth
 
+	trustedOrigins := conf.TrustedOrigins
+	if conf.CORS != nil && conf.CORS.Credentials { // pages at these origins are trusted to make requests on behalf of users
+		trustedOrigins = append(append(Strings{}, trustedOrigins...), conf.CORS.Origins...)
+	}
+	csrf := newCSRFGuard(trustedOrigins)
+	limiter := newRateLimiter(conf.RateLimit)
+
 	if conf.Auth != nil {
+		var audit *AuditLog
+		if len(conf.AuditLog) > 0 {
+			var err error
+			if audit, err = openAuditLog(conf.AuditLog, conf.AuditQueueSize); err != nil {
+				panic(err)
+			}
+		}
+
 		var err error
-		if auth, err = newAuth(conf.Auth, conf.BaseURL, conf.BaseURL+"_auth/init", conf.BaseURL+"_auth/login"); err != nil {
+		if auth, err = newAuth(conf.Auth, audit, conf.BaseURL, conf.BaseURL+"_auth/init", conf.BaseURL+"_auth/login"); err != nil {
 			panic(fmt.Errorf("failed connecting to OIDC provider: %v", err))
 		}
-		handle("_auth/init", newLoginHandler(auth))
-		handle("_auth/callback", newAuthHandler(auth))
-		handle("_auth/logout", newLogoutHandler(auth, broker))
-		handle("_auth/refresh", newRefreshHandler(auth, conf.Keychain))
+		if conf.Auth.SkipLogin { // login page redirects straight to init, so init is public anyway.
+			handle("_auth/init", uiFilter.wrap(limiter.wrap(newLoginHandler(auth))))
+		} else {
+			handle("_auth/init", uiFilter.wrap(limiter.wrap(csrf.wrap(newLoginHandler(auth)))))
+		}
+		handle("_auth/callback", uiFilter.wrap(limiter.wrap(newAuthHandler(auth))))
+		health = append(health, HealthCheck{"auth_provider", checkAuthProvider(conf.Auth.ProviderURL)})
+		handle("_auth/logout", uiFilter.wrap(limiter.wrap(csrf.wrap(newLogoutHandler(auth, broker)))))
+		handle("_auth/refresh", uiFilter.wrap(limiter.wrap(newRefreshHandler(auth, conf.Keychain))))
 	}
 
-	handle("_s/", newSocketServer(broker, auth, conf.Editable, conf.BaseURL)) // XXX terminate sockets when logged out
+	var cert *Certificate
+	if isTLS && conf.Autocert == nil { // autocert renews certificates by itself
+		cert = &Certificate{}
+	}
+	secrets := Secrets{"", conf.PageWebhookSecret, conf.ClientWebhookSecret, conf.AccessKeySecret, conf.FileURLSecret, conf.RequestSigningSecret, conf.PageStorePassword}
+	if conf.Auth != nil {
+		secrets.ClientSecret = conf.Auth.ClientSecret
+	}
+	reload := conf.Reload
+	if reload == nil { // keep the options as is, but pick up renewed certificates
+		c := ReloadableConf{conf.RouteAliases, conf.AppMessages, conf.MaxPageSize, conf.MaxPageCards, conf.RoutePageQuotas, conf.AppPageQuotas, 0, 0, 0, conf.CertFile, conf.KeyFile, conf.LogLevels, secrets}
+		if conf.Auth != nil {
+			c.MaxLoginAttempts, c.LoginAttemptWindow, c.LoginLockout = conf.Auth.MaxLoginAttempts, conf.Auth.LoginAttemptWindow, conf.Auth.LoginLockout
+		}
+		reload = func() (ReloadableConf, error) { return c, nil }
+	}
+	fileURLs := newFileURLSigner([]byte(conf.FileURLSecret))
+	verifier := newRequestVerifier(conf.RequestSigningSecret, conf.RequestSigningWindow) // shared, so that nonces are seen by all routes
+	broker.reloader = newReloader(reload, broker, auth, cert, conf.Keychain, fileURLs, verifier, secrets)
+	broker.reloader.watch()
+	if conf.SecretRefresh > 0 {
+		go broker.reloader.refreshSecrets(conf.SecretRefresh)
+	}
+
+	limits := newConnLimits(conf.MaxConnections, conf.MaxUserConnections, conf.MaxAddrConnections) // shared by websockets and event streams
+	// XXX terminate sockets when logged out
+	handle("_s/", uiFilter.wrap(limiter.wrap(newSocketServer(broker, auth, tenancy, conf.Editable, conf.BaseURL, limits))))
 
 	fileDir := filepath.Join(conf.DataDir, "f")
-	handle("_f/", newFileServer(fileDir, conf.Keychain, auth, conf.BaseURL+"_f"))
+	fileStore, err := openFileStore(conf.FileStore, fileDir, conf.FileStoreRedirect, conf.FileStoreURLExpiry)
+	if err != nil {
+		panic(fmt.Errorf("failed opening file store: %v", err))
+	}
+	uploadPolicy := conf.Upload
+	if len(conf.UploadScanner) > 0 {
+		if uploadPolicy.Scanner, err = openUploadScanner(conf.UploadScanner); err != nil {
+			panic(err)
+		}
+	}
+	for _, s := range conf.UploadImageSizes {
+		size, err := parseImageSize(s)
+		if err != nil {
+			panic(err)
+		}
+		uploadPolicy.ImageSizes = append(uploadPolicy.ImageSizes, size)
+	}
+	health = append(health, HealthCheck{"file_store", checkFileStore(fileStore)})
+	uploads := newUploadIndex(fileStore, conf.UploadQuotas)
+	broker.uploads = uploads
+	var pageStore PageStore
+	if broker.storage != nil {
+		pageStore = broker.storage.store
+	}
+	go uploads.run(conf.UploadGC, site, pageStore, uploadGCInterval)
+	fileServer := newFileServer(fileDir, fileStore, uploads, conf.Keychain, auth, tenancy, csrf, conf.BaseURL+"_f", uploadPolicy, conf.PrivateUploads, fileURLs, newUploadProgress(broker))
+	stopTusExpiry := make(chan struct{})
+	defer close(stopTusExpiry)
+	go fileServer.tus.expire(tusExpiryInterval, stopTusExpiry)
+	handle("_f/", wrapEither(uiFilter, apiFilter, limiter.wrapWrites(conf.CORS.wrap(conf.Compression.wrap(verifier.wrapUploads(fileServer))))))
 	for _, dir := range conf.PrivateDirs {
 		prefix, src := splitDirMapping(dir)
 		echo(Log{"t": "private_dir", "source": src, "address": prefix})
-		handle(prefix, http.StripPrefix(conf.BaseURL+prefix, newDirServer(src, conf.Keychain, auth)))
+		handle(prefix, uiFilter.wrap(http.StripPrefix(conf.BaseURL+prefix, newDirServer(src, conf.Keychain, auth))))
 	}
 	for _, dir := range conf.PublicDirs {
 		prefix, src := splitDirMapping(dir)
 		echo(Log{"t": "public_dir", "source": src, "address": prefix})
-		handle(prefix, http.StripPrefix(conf.BaseURL+prefix, http.FileServer(http.Dir(src))))
+		handle(prefix, uiFilter.wrap(conf.Compression.wrap(http.StripPrefix(conf.BaseURL+prefix, servePrecompressed(http.Dir(src), newETagFileServer(http.Dir(src)))))))
 	}
 
-	handle("_c/", newCache(conf.BaseURL+"_c/", conf.Keychain, conf.MaxCacheRequestSize))
-	handle("_m/", newMultipartServer(conf.BaseURL+"_m/", conf.Keychain, auth, conf.MaxRequestSize))
+	if conf.Metrics {
+		handle("metrics", adminFilter.wrap(newMetricsServer(conf.Keychain, broker, metrics)))
+	}
+	handle("healthz", newHealthServer(conf.Keychain, nil, false))
+	handle("readyz", newHealthServer(conf.Keychain, health, true))
+	handle("_a/", adminFilter.wrap(newAdminServer(conf.BaseURL+"_a/", conf.Keychain, tenancy, broker, conf.MaxRequestSize, conf.Settings)))
+	handle("_dl/", wrapEither(uiFilter, apiFilter, limiter.wrapWrites(conf.CORS.wrap(verifier.wrap(newDownloadServer(conf.BaseURL+"_dl/", conf.Keychain, auth), conf.MaxRequestSize)))))
+	handle("_c/", apiFilter.wrap(limiter.wrap(conf.CORS.wrap(verifier.wrap(newCache(conf.BaseURL+"_c/", conf.Keychain, tenancy, conf.MaxCacheRequestSize), conf.MaxCacheRequestSize)))))
+	handle("_m/", apiFilter.wrap(limiter.wrap(conf.CORS.wrap(verifier.wrapUploads(newMultipartServer(conf.BaseURL+"_m/", conf.Keychain, auth, tenancy, conf.MaxRequestSize))))))
 
 	if conf.Proxy {
-		handle("_p/", newProxy(auth, conf.MaxProxyRequestSize, conf.MaxProxyResponseSize))
+		handle("_p/", uiFilter.wrap(newProxy(auth, conf.MaxProxyRequestSize, conf.MaxProxyResponseSize)))
 	}
 
 	if conf.IDE {
 		ide := http.StripPrefix("_ide", http.FileServer(http.Dir(path.Join(conf.WebDir, "_ide"))))
-		handle("_ide", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle("_ide", uiFilter.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if auth != nil && !auth.allow(r) {
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
 			}
 			ide.ServeHTTP(w, r)
-		}))
+		})))
+	}
+
+	if site.index != nil {
+		handle("_search", wrapEither(uiFilter, apiFilter, limiter.wrap(conf.CORS.wrap(newSearchServer(site.index, broker, conf.Keychain, auth, tenancy)))))
+	}
+
+	dataServer, err := newDataServer(conf.BaseURL+"_api/", conf.Keychain, tenancy, broker, conf.MaxRequestSize)
+	if err != nil {
+		panic(err)
 	}
+	handle("_api/", apiFilter.wrap(limiter.wrap(conf.CORS.wrap(verifier.wrap(dataServer, conf.MaxRequestSize)))))
 
-	webServer, err := newWebServer(site, broker, auth, conf.Keychain, conf.MaxRequestSize, conf.BaseURL, conf.WebDir, conf.Header)
+	webServer, err := newWebServer(site, broker, auth, tenancy, conf.Keychain, conf.MaxRequestSize, conf.BaseURL, append(append([]string{}, conf.WebRoots...), conf.WebDir), conf.Header, conf.CachePolicy, limits)
 	if err != nil {
 		panic(err)
 	}
-	handle("", webServer)
+	handle("", wrapWeb(uiFilter, apiFilter, limiter.wrapWrites(conf.CORS.wrap(conf.Compression.wrap(verifier.wrap(webServer, conf.MaxRequestSize))))))
 
-	echo(Log{"t": "listen", "address": conf.Listen, "web-dir": conf.WebDir, "base-url": conf.BaseURL})
+	echo(Log{"t": "serve", "web-dir": conf.WebDir, "base-url": conf.BaseURL})
 
-	if isTLS {
-		if err := http.ListenAndServeTLS(conf.Listen, conf.CertFile, conf.KeyFile, nil); err != nil {
-			echo(Log{"t": "listen_tls", "error": err.Error()})
+	if broker.supervisor != nil {
+		broker.supervisor.start()
+	}
+
+	if conf.Autocert != nil {
+		m, err := newAutocertManager(*conf.Autocert, conf.DataDir)
+		if err != nil {
+			panic(err)
 		}
-	} else {
-		if err := http.ListenAndServe(conf.Listen, nil); err != nil {
-			echo(Log{"t": "listen_no_tls", "error": err.Error()})
+		if len(conf.Autocert.HTTPListen) > 0 {
+			go func() {
+				if err := http.ListenAndServe(conf.Autocert.HTTPListen, m.HTTPHandler(nil)); err != nil {
+					echoError(Log{"t": "listen_autocert", "error": err.Error()})
+				}
+			}()
+		}
+		if primary != nil {
+			primary.tls = m.TLSConfig()
+		}
+	} else if isTLS {
+		if err := cert.load(conf.CertFile, conf.KeyFile); err != nil {
+			echoError(Log{"t": "listen_tls", "error": err.Error()})
+			return
+		}
+		if primary != nil {
+			primary.tls = &tls.Config{GetCertificate: cert.get}
 		}
 	}
+
+	sockets, err := systemdSockets()
+	if err != nil {
+		panic(err)
+	}
+	for _, l := range listeners { // additional listeners first, so that they claim their sockets
+		if l != primary {
+			if err := l.listen(sockets, false); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if primary != nil {
+		if err := primary.listen(sockets, true); err != nil {
+			panic(err)
+		}
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		echoError(Log{"t": "systemd", "error": err.Error()})
+	}
+	go watchdog(broker.ping)
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *Listener) {
+			l.serve(accessLog.wrap(conf.SecurityHeaders.wrap(broker.errorPages.wrap(l.mux))), conf.H2C, conf.MaxHeaderSize)
+			wg.Done()
+		}(l)
+	}
+	wg.Wait()
 	if conf.SkipCertVerification {
 		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
@@ -180,6 +506,22 @@ func readRequestWithLimit(w http.ResponseWriter, r io.ReadCloser, n int64) ([]by
 	return ioutil.ReadAll(http.MaxBytesReader(w, r, n))
 }
 
+const requestTooLarge = "request_too_large"
+
+// RequestErrorD represents the error response for a request refused for exceeding a size limit.
+type RequestErrorD struct {
+	Error string `json:"error"`
+	Limit int64  `json:"limit"` // size limit, in bytes
+}
+
+// writeRequestTooLarge replies to a request whose body exceeds limit bytes.
+func writeRequestTooLarge(w http.ResponseWriter, limit int64) {
+	b, _ := json.Marshal(RequestErrorD{Error: requestTooLarge, Limit: limit})
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write(b)
+}
+
 func isRequestTooLarge(err error) bool {
 	// HACK: net/http does not export the error
 	// https://github.com/golang/go/issues/30715
@@ -18,7 +18,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -28,44 +31,72 @@ const (
 // Site represents the website, and holds a collection of pages.
 type Site struct {
 	sync.RWMutex
-	pages map[string]*Page // url => page
-	ns    *Namespace       // buffer type namespace
+	pages       *PageMap             // url => page
+	ns          *Namespace           // buffer type namespace
+	historySize int                  // revisions to track per page; 0 disables history
+	histories   map[string]*History  // url => history
+	historyMux  sync.Mutex           // mutex for tracking histories
+	expiries    map[string]time.Time // url => expiry time, for pages with a time-to-live
+	quotas      *Quotas              // page quotas, if any
+	tenantPages int                  // max pages per tenant; 0 for no limit
+	pins        map[string]bool      // url => true, for pages exempt from garbage collection
+	gcStats     GCStats              // garbage collection statistics
+	index       *SearchIndex         // card search index, if enabled
+	evicted     map[string]bool      // url => true, for pages evicted to the page store to stay within the memory budget
+	loader      PageLoader           // reads back evicted pages, if they were saved
+	reloadMux   sync.Mutex           // serializes reloading evicted pages
+	evictStats  EvictionStats        // memory budget statistics
 }
 
 func newSite() *Site {
-	return &Site{pages: make(map[string]*Page), ns: newNamespace()}
+	return &Site{
+		pages:     newPageMap(),
+		ns:        newNamespace(),
+		histories: make(map[string]*History),
+		expiries:  make(map[string]time.Time),
+		pins:      make(map[string]bool),
+		evicted:   make(map[string]bool),
+	}
 }
 
 // at returns the page at url, else nil
 func (site *Site) at(url string) *Page {
-	site.RLock()
-	defer site.RUnlock()
-	if p, ok := site.pages[url]; ok {
+	if p, ok := site.pages.get(url); ok {
+		p.touch()
+		return p
+	}
+	if p, _ := site.reload(url); p != nil {
+		p.touch()
 		return p
 	}
 	return nil
 }
 
-// get returns the page at url, else mints a new one.
-func (site *Site) get(url string) *Page {
-	if p := site.at(url); p != nil {
-		return p
+// get returns the page at url, else mints a new one. Fails if the page was evicted, and could not be read back,
+// rather than minting an empty page, which would then be saved over the stored page.
+func (site *Site) get(url string) (*Page, error) {
+	if _, ok := site.pages.get(url); !ok {
+		if _, err := site.reload(url); err != nil {
+			return nil, err
+		}
 	}
-
-	p := newPage()
-
-	site.Lock()
-	site.pages[url] = p
-	site.Unlock()
-
-	return p
+	p := site.pages.mint(url)
+	p.touch()
+	return p, nil
 }
 
 // del deletes the page at url.
 func (site *Site) del(url string) {
+	site.pages.del(url)
 	site.Lock()
-	delete(site.pages, url)
+	delete(site.expiries, url)
+	delete(site.pins, url)
+	delete(site.evicted, url)
 	site.Unlock()
+	site.index.drop(url)
+	if site.historySize > 0 {
+		site.dropHistory(url)
+	}
 }
 
 // set overwrites a page's content.
@@ -75,62 +106,158 @@ func (site *Site) set(url string, data []byte) error {
 		return fmt.Errorf("failed unmarshaling data: %v", err)
 	}
 	if ops.P != nil {
-		site.pages[url] = loadPage(site.ns, ops.P)
+		page := loadPage(site.ns, ops.P)
+		atomic.StoreInt64(&page.size, int64(len(data)))
+		site.pages.set(url, page)
+		site.index.page(url, page)
+		site.dropHistory(url)
 	}
 	return nil
 }
 
 // patch patches a page's content.
 func (site *Site) patch(url string, data []byte) error {
+	_, err := site.update(url, data, false, "")
+	return err
+}
+
+// update patches a page's content on behalf of actor (see PageEvent), within the page's quota. If diff is set,
+// also returns the deltas equivalent to the patch, with whole-card puts reduced to changes wherever possible.
+func (site *Site) update(url string, data []byte, diff bool, actor string) ([]OpD, error) {
 	var ops OpsD
 	if err := json.Unmarshal(data, &ops); err != nil { // TODO speed up
-		return fmt.Errorf("failed unmarshaling data: %v", err)
+		return nil, fmt.Errorf("failed unmarshaling data: %v", err)
 	}
-	site.exec(url, ops)
-	return nil
+
+	var (
+		size  = int64(-1)
+		check func(page *Page) error
+	)
+	if err := site.checkTenantPages(url, ops); err != nil {
+		return nil, err
+	}
+	if quotas := site.pageQuotas(); quotas != nil {
+		if q := quotas.at(url, actor); q.enabled() {
+			check = func(page *Page) (err error) {
+				size, err = site.checkQuota(url, page, q, ops, data)
+				return err
+			}
+		}
+	}
+
+	var (
+		page   *Page
+		deltas []OpD
+		err    error
+	)
+	if site.historySize > 0 {
+		h := site.history(url)
+		h.Lock()
+		if page, deltas, err = site.exec(url, ops, diff, check); err == nil {
+			h.add(data)
+		}
+		h.Unlock()
+	} else {
+		page, deltas, err = site.exec(url, ops, diff, check)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if size >= 0 {
+		atomic.StoreInt64(&page.size, size)
+	} else {
+		atomic.AddInt64(&page.size, estimatedGrowth(ops, data))
+	}
+	return deltas, nil
 }
 
-// exec applies changes to a page's content.
-func (site *Site) exec(url string, ops OpsD) {
-	page := site.get(url)
+// exec applies changes to a page's content, and returns the page.
+// If diff is set, also returns the equivalent deltas (see update()).
+// Fails, changing nothing, if the page was evicted, and could not be read back, or if check is set, and fails
+// given the page, under the page's lock, before any change is applied.
+func (site *Site) exec(url string, ops OpsD, diff bool, check func(page *Page) error) (*Page, []OpD, error) {
+	var (
+		deltas  []OpD
+		touched map[string]bool // keys of changed cards, for reindexing
+	)
+	if site.index != nil {
+		touched = make(map[string]bool)
+	}
+	_, existed := site.pages.get(url)
+	page, err := site.get(url)
+	if err != nil {
+		return nil, nil, err
+	}
 	page.Lock()
+	for !site.pages.has(url, page) { // evicted while we waited for the lock
+		page.Unlock()
+		if page, err = site.get(url); err != nil {
+			return nil, nil, err
+		}
+		page.Lock()
+	}
+	if check != nil {
+		if err := check(page); err != nil {
+			if !existed && len(page.cards) == 0 { // minted above
+				site.pages.del(url)
+			}
+			page.Unlock()
+			return nil, nil, err
+		}
+	}
 	for _, op := range ops.D {
-		if len(op.K) > 0 {
-			if op.C != nil {
-				page.set(op.K, loadCycBuf(site.ns, op.C))
-			} else if op.F != nil {
-				page.set(op.K, loadFixBuf(site.ns, op.F))
-			} else if op.M != nil {
-				page.set(op.K, loadMapBuf(site.ns, op.M))
-			} else if op.D != nil {
-				page.cards[op.K] = loadCard(site.ns, CardD{op.D, op.B})
-			} else {
-				page.set(op.K, op.V)
+		if touched != nil && len(op.K) > 0 {
+			touched[cardKey(op.K)] = true
+		}
+		if diff && op.D != nil {
+			if prev, ok := page.cards[op.K]; ok {
+				next := loadCard(site.ns, CardD{op.D, op.B})
+				if d, ok := diffCard(op.K, prev, next); ok {
+					deltas = append(deltas, d...)
+				} else {
+					deltas = append(deltas, op)
+				}
+				page.cards[op.K] = next
+				continue
 			}
-		} else { // drop page
-			site.del(url)
+		}
+		if diff {
+			deltas = append(deltas, op)
+		}
+		if len(op.K) > 0 {
+			page.apply(site.ns, op)
+		} else { // drop page; history, if any, is retained
+			site.pages.del(url)
+			site.index.drop(url)
 			page.Unlock()
-			page = site.get(url)
+			page = site.pages.mint(url)
+			page.touch()
 			page.Lock()
 		}
 	}
-	page.cache = nil // will be re-cached on next call to site.get(url)
+	for k := range touched {
+		site.index.put(url, k, page.cards[k])
+	}
+	page.cache = nil // will be re-cached on next call to page.marshal()
 	page.Unlock()
+	return page, deltas, nil
+}
+
+// cardKey returns the key of the card addressed by k, e.g. "foo" for "foo data 1".
+func cardKey(k string) string {
+	if i := strings.Index(k, keySeparator); i >= 0 {
+		return k[:i]
+	}
+	return k
 }
 
 // urls returns a sorted slice of urls hosted by this site.
 func (site *Site) urls() []string {
-	site.RLock()
-	defer site.RUnlock()
-
-	pages := site.pages
-
-	urls := make([]string, len(pages))
-	i := 0
-	for url := range pages {
-		urls[i] = url
-		i++
-	}
+	urls := make([]string, 0, site.pages.len())
+	site.pages.each(func(url string, _ *Page) {
+		urls = append(urls, url)
+	})
 
 	sort.Strings(urls)
 	return urls
@@ -0,0 +1,127 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+const benchmarkRoutes = 10000
+
+var benchmarkPatch = []byte(`{"d":[{"k":"card","d":{"view":"markdown","box":"1 1 2 2","title":"Title","content":"Content"}}]}`)
+
+func newBenchmarkSite() (*Site, []string) {
+	site := newSite()
+	urls := make([]string, benchmarkRoutes)
+	for i := range urls {
+		urls[i] = "/route/" + strconv.Itoa(i)
+		site.patch(urls[i], benchmarkPatch)
+	}
+	return site, urls
+}
+
+func BenchmarkSiteAt(b *testing.B) {
+	site, urls := newBenchmarkSite()
+	var n uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			site.at(urls[atomic.AddUint64(&n, 1)%benchmarkRoutes])
+		}
+	})
+}
+
+func BenchmarkSitePatch(b *testing.B) {
+	site, urls := newBenchmarkSite()
+	var n uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			site.patch(urls[atomic.AddUint64(&n, 1)%benchmarkRoutes], benchmarkPatch)
+		}
+	})
+}
+
+// BenchmarkSiteChurn measures the creation and deletion of short-lived routes.
+func BenchmarkSiteChurn(b *testing.B) {
+	site := newSite()
+	var n uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			url := "/churn/" + strconv.FormatUint(atomic.AddUint64(&n, 1), 10)
+			site.patch(url, benchmarkPatch)
+			site.at(url)
+			site.del(url)
+		}
+	})
+}
+
+// benchmarkJoins is the number of clients joining a page between consecutive patches.
+const benchmarkJoins = 100
+
+func newBenchmarkPage() *Page {
+	site := newSite()
+	for i := 0; i < 50; i++ {
+		site.patch("/", []byte(`{"d":[{"k":"card`+strconv.Itoa(i)+`","d":{"view":"markdown","box":"1 1 2 2","title":"Title","content":"Content"}}]}`))
+	}
+	return site.at("/")
+}
+
+// BenchmarkPageJoin measures serving a popular page to simultaneously joining clients, using the cached marshal.
+func BenchmarkPageJoin(b *testing.B) {
+	page := newBenchmarkPage()
+	var n uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if atomic.AddUint64(&n, 1)%benchmarkJoins == 0 { // simulate a patch
+				page.Lock()
+				page.cache = nil
+				page.Unlock()
+			}
+			page.marshal()
+		}
+	})
+}
+
+// BenchmarkPageJoinUncached is the baseline for BenchmarkPageJoin, marshaling the page for every client.
+func BenchmarkPageJoinUncached(b *testing.B) {
+	page := newBenchmarkPage()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			page.RLock()
+			json.Marshal(OpsD{P: page.dump()})
+			page.RUnlock()
+		}
+	})
+}
+
+func BenchmarkBrokerPublish(b *testing.B) {
+	site, urls := newBenchmarkSite()
+	broker := newBroker(site, false, false, true)
+	go broker.run()
+	var n uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			broker.patch(urls[atomic.AddUint64(&n, 1)%benchmarkRoutes], benchmarkPatch, "")
+		}
+	})
+}
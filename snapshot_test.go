@@ -0,0 +1,101 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+)
+
+// newTestAdmin returns an admin server for a fresh broker, and a function making requests to it with an access key.
+func newTestAdmin(t *testing.T) (*AdminServer, func(method, path, body string) *httptest.ResponseRecorder) {
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, secret, hash, err := keychain.CreateAccessKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc.Add(id, hash)
+	admin := newAdminServer("/_a/", kc, nil, newBroker(newSite(), false, false, true), 1024*1024, nil)
+	return admin, func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.SetBasicAuth(id, secret)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+}
+
+func TestPageSnapshot(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	admin, request := newTestAdmin(t)
+	no(admin.broker.patch("/foo", []byte(`{"d":[{"k":"x","d":{"view":"markdown","content":"hello"}}]}`), ""))
+
+	w := request("GET", "/_a/snapshot/foo", "")
+	eq(w.Code, http.StatusOK)
+	var snapshot PageSnapshot
+	no(json.Unmarshal(w.Body.Bytes(), &snapshot))
+	eq(snapshot.Version, pageSnapshotVersion)
+	eq(snapshot.Route, "/foo")
+	ok(!snapshot.Time.IsZero(), "time")
+	eq(snapshot.Page.C["x"].D["content"], "hello")
+	eq(request("GET", "/_a/snapshot/missing", "").Code, http.StatusNotFound)
+
+	exported := w.Body.String()
+	eq(request("PUT", "/_a/snapshot/bar", exported).Code, http.StatusOK) // to another route
+	d, err := admin.broker.site.at("/bar").copy()
+	no(err)
+	eq(d.C["x"].D["content"], "hello")
+
+	no(admin.broker.patch("/foo", []byte(`{"d":[{"k":"x.content","v":"changed"}]}`), ""))
+	eq(request("PUT", "/_a/snapshot", exported).Code, http.StatusOK) // to the original route
+	d, err = admin.broker.site.at("/foo").copy()
+	no(err)
+	eq(d.C["x"].D["content"], "hello")
+}
+
+func TestPageSnapshotFormat(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	_, request := newTestAdmin(t)
+
+	for _, bad := range []string{
+		`not json`,
+		`{"route":"/foo","page":{"c":{}}}`,             // no version
+		`{"version":2,"route":"/foo","page":{"c":{}}}`, // unknown version
+		`{"version":1,"route":"/foo"}`,                 // no page
+		`{"version":1,"route":"foo","page":{"c":{}}}`,  // bad route
+		`{"version":1,"page":{"c":{"x":{"d":{}}}}}`,    // nowhere to import to
+	} {
+		w := request("PUT", "/_a/snapshot", bad)
+		ok(w.Code == http.StatusBadRequest, bad)
+	}
+	w := request("PUT", "/_a/snapshot/foo", `{"version":2,"route":"/foo","page":{"c":{}}}`)
+	ok(strings.Contains(w.Body.String(), "unsupported page snapshot version 2"), w.Body.String())
+
+	s, err := parsePageSnapshot([]byte(`{"version":1,"route":"/foo","time":"2021-06-01T00:00:00Z","page":{"c":{"x":{"d":{"view":"markdown"}}}}}`))
+	no(err)
+	eq(s.Route, "/foo")
+	eq(s.Time.Year(), 2021)
+	eq(len(s.Page.ops().D), 2) // drop page, put card
+}
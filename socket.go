@@ -15,50 +15,151 @@
 package wave
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	minBrowserProtocolVersion = 1 // oldest browser protocol version supported
+	browserProtocolVersion    = 2 // current browser protocol version; 2 added structured error replies
 )
 
 // SocketServer represents a websocket server.
 type SocketServer struct {
 	broker   *Broker
 	auth     *Auth
+	tenancy  *Tenancy
 	editable bool
 	baseURL  string
+	limits   *ConnLimits
 }
 
-func newSocketServer(broker *Broker, auth *Auth, editable bool, baseURL string) *SocketServer {
+func newSocketServer(broker *Broker, auth *Auth, tenancy *Tenancy, editable bool, baseURL string, limits *ConnLimits) *SocketServer {
 	return &SocketServer{
 		broker,
 		auth,
+		tenancy,
 		editable,
 		baseURL,
+		limits,
 	}
 }
 
 func (s *SocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, span := startSpan(withTraceParent(r.Context(), r.Header.Get(traceParentHeader)), "wave.socket.upgrade", spanServer)
+	defer span.finish()
+	span.set("client.address", getRemoteAddr(r))
+
 	session := anonymous
 	if s.auth != nil {
-		session = s.auth.identify(r)
+		if route := r.URL.Query().Get("route"); len(route) > 0 { // the page the socket is opened for
+			session = s.auth.identifyAt(r, s.broker.routeAliases().serve(resolveURL(route, s.baseURL)))
+		} else {
+			session = s.auth.identify(r)
+		}
 		if session == nil {
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
 	}
 
+	var tenant string
+	if s.tenancy != nil {
+		var err error
+		if tenant, err = s.tenancy.ofUser(r, session); err != nil {
+			echoError(Log{"t": "tenant", "addr": getRemoteAddr(r), "host": r.Host, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	addr := getRemoteAddr(r)
+	if err := s.limits.acquire(session, addr); err != nil {
+		echoWarn(Log{"t": "socket_limit", "addr": addr, "subject": session.subject, "error": err.Error()})
+		if conn, err2 := upgrader.Upgrade(w, r, nil); err2 == nil { // so that the browser can tell why
+			msg, _ := json.Marshal(OpsD{E: "too_many_connections", X: err.Error()})
+			conn.WriteMessage(websocket.TextMessage, msg)
+			conn.Close()
+		}
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		echo(Log{"t": "socket_upgrade", "err": err.Error()})
+		s.limits.release(session, addr)
+		span.fail(err)
+		echoError(Log{"t": "socket_upgrade", "addr": getRemoteAddr(r), "error": err.Error()})
+		return
+	}
+
+	version, err := browserVersion(r)
+	if err != nil {
+		s.limits.release(session, addr)
+		echoWarn(Log{"t": "socket_protocol", "addr": getRemoteAddr(r), "error": err.Error()})
+		refuse(conn, version, err)
 		return
 	}
 
-	client := newClient(getRemoteAddr(r), s.auth, session, s.broker, conn, s.editable, s.baseURL)
+	client := newClient(getRemoteAddr(r), s.auth, session, tenant, s.broker, conn, s.editable, hasCap(r, capDeltas), hasCap(r, capUploadProgress), version, s.baseURL)
+	if client.progress { // so that the client can ask for progress events for its uploads
+		if headers, err := json.Marshal(OpsD{M: &Meta{Username: session.username, Editor: s.editable, Version: browserProtocolVersion, Client: client.id}}); err == nil {
+			client.send(headers)
+		}
+	}
 	go client.flush()
-	go client.listen()
+	go func() {
+		client.listen()
+		s.limits.release(session, addr)
+	}()
 }
 
-func getRemoteAddr(r *http.Request) string {
-	if addr := r.Header.Get("X-FORWARDED-FOR"); addr != "" { // forwarded via a proxy?
-		return addr
+// browserVersion returns the browser protocol version advertised via the "v" query parameter; 1 if absent,
+// for browsers predating protocol versions.
+func browserVersion(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("v")
+	if len(s) == 0 {
+		return 1, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("invalid browser protocol version %q", s)
+	}
+	if v < minBrowserProtocolVersion || v > browserProtocolVersion {
+		return v, fmt.Errorf("unsupported browser protocol version %d: want %d to %d", v, minBrowserProtocolVersion, browserProtocolVersion)
+	}
+	return v, nil
+}
+
+// refuse replies to a browser speaking an unsupported protocol version and closes the socket.
+// Browsers older than the server are asked to reload, to pick up the server's UI; browsers newer than the server
+// are told the protocol is unsupported, e.g. if served by a newer replica during a rolling upgrade.
+func refuse(conn *websocket.Conn, version int, err error) {
+	msg := resetMsg
+	if version == 0 || version > browserProtocolVersion {
+		msg, _ = json.Marshal(OpsD{E: "unsupported_protocol", X: err.Error()})
+	}
+	conn.WriteMessage(websocket.TextMessage, msg)
+	conn.Close()
+}
+
+// hasCap returns true if the client advertised a capability via the "caps" query parameter (comma-separated).
+func hasCap(r *http.Request, capability string) bool {
+	for _, caps := range r.URL.Query()["caps"] {
+		for _, c := range strings.Split(caps, ",") {
+			if c == capability {
+				return true
+			}
+		}
 	}
-	return r.RemoteAddr
+	return false
+}
+
+// getRemoteAddr returns the IP address of the client that sent a request, as reported by trusted proxies, if any.
+func getRemoteAddr(r *http.Request) string {
+	return trustedProxies.clientAddr(r)
 }
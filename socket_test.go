@@ -0,0 +1,168 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestBrowserVersion(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+
+	v, err := browserVersion(httptest.NewRequest("GET", "/_s/?caps=deltas", nil))
+	no(err)
+	eq(v, 1)
+
+	v, err = browserVersion(httptest.NewRequest("GET", "/_s/?caps=deltas&v=2", nil))
+	no(err)
+	eq(v, 2)
+
+	v, err = browserVersion(httptest.NewRequest("GET", "/_s/?v=3", nil))
+	ok(err != nil)
+	eq(v, 3)
+
+	v, err = browserVersion(httptest.NewRequest("GET", "/_s/?v=x", nil))
+	ok(err != nil)
+	eq(v, 0)
+}
+
+func TestConnLimits(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	ok(newConnLimits(0, 0, 0) == nil, "no limits")
+	var none *ConnLimits
+	no(none.acquire(anonymous, "a"))
+	none.release(anonymous, "a")
+
+	alice, bob := &Session{subject: "alice"}, &Session{subject: "bob"}
+	l := newConnLimits(4, 2, 3)
+	no(l.acquire(alice, "a"))
+	no(l.acquire(alice, "b"))
+	ok(l.acquire(alice, "c") != nil, "per-user limit")
+	no(l.acquire(anonymous, "a"))
+	no(l.acquire(anonymous, "a"))
+	ok(l.acquire(bob, "a") != nil, "per-address limit")
+	ok(l.acquire(bob, "d") != nil, "global limit")
+
+	l.release(alice, "a")
+	no(l.acquire(bob, "d"))
+	l.release(alice, "b")
+	l.release(anonymous, "a")
+	l.release(anonymous, "a")
+	l.release(bob, "d")
+	eq(l.total, 0)
+	eq(len(l.subjects), 0)
+	eq(len(l.addrs), 0)
+}
+
+// dialSocket returns the server side of a websocket, and the peer's end.
+func dialSocket(tb testing.TB) (*websocket.Conn, *websocket.Conn, func()) {
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		conns <- conn
+	}))
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		server.Close()
+		tb.Fatal(err)
+	}
+	conn := <-conns
+	return conn, peer, func() {
+		conn.Close()
+		peer.Close()
+		server.Close()
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	conn, peer, done := dialSocket(t)
+	defer done()
+
+	read := func() string {
+		_, msg, err := peer.ReadMessage()
+		no(err)
+		return string(msg)
+	}
+	queue := make(chan []byte, 8)
+	write := func(limits FrameLimits, msgs ...string) int {
+		for _, m := range msgs[1:] {
+			queue <- []byte(m)
+		}
+		n, err := writeBatch(conn, []byte(msgs[0]), queue, limits)
+		no(err)
+		eq(len(queue), 0)
+		return n
+	}
+
+	eq(write(FrameLimits{}, "a"), 1)
+	eq(read(), "a")
+
+	eq(write(FrameLimits{}, "a", "b", "c"), 5)
+	eq(read(), "a\nb\nc")
+
+	write(FrameLimits{Messages: 2}, "a", "b", "c", "d", "e")
+	eq(read(), "a\nb")
+	eq(read(), "c\nd")
+	eq(read(), "e")
+
+	eq(write(FrameLimits{Size: 5}, "aa", "bb", "cccccc", "d"), 12)
+	eq(read(), "aa\nbb")
+	eq(read(), "cccccc") // too large on its own, but not dropped
+	eq(read(), "d")
+
+	big := strings.Repeat("x", 3000) // larger than the write buffer: streamed in fragments
+	eq(write(FrameLimits{}, big, big), 6001)
+	eq(read(), big+"\n"+big)
+}
+
+// BenchmarkWriteBatch writes batches of queued messages to a websocket, as Client.flush does.
+func BenchmarkWriteBatch(b *testing.B) {
+	conn, peer, done := dialSocket(b)
+	defer done()
+	go func() {
+		for {
+			_, r, err := peer.NextReader()
+			if err != nil {
+				return
+			}
+			io.Copy(ioutil.Discard, r)
+		}
+	}()
+
+	queue := make(chan []byte, 256)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 8; j++ {
+			queue <- benchmarkPatch
+		}
+		if _, err := writeBatch(conn, benchmarkPatch, queue, FrameLimits{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,537 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/h2oai/wave/pkg/redis"
+)
+
+const (
+	redisPagesKey       = "wave:pages"   // hash: url => marshaled page
+	redisPatchesChannel = "wave:patches" // pub/sub: "replica url patch"
+
+	pageStoreFlushInterval = 100 * time.Millisecond
+)
+
+// PageStore represents external storage for pages, shared by the replicas of a Wave server.
+type PageStore interface {
+	// load returns all stored pages, as url => marshaled page.
+	load() (map[string][]byte, error)
+	// urls returns the urls of all stored pages.
+	urls() ([]string, error)
+	// read returns the stored page at url; nil if not stored.
+	read(url string) ([]byte, error)
+	save(url string, data []byte) error
+	remove(url string) error
+	// publish broadcasts a message to all replicas.
+	publish(msg []byte) error
+	// subscribe receives messages broadcast by replicas, blocking until the subscription fails.
+	// subscribed is called once messages are being received.
+	subscribe(f func(msg []byte), subscribed func()) error
+	// ping checks that the store is reachable.
+	ping() error
+	// setPassword changes the password used for new connections, e.g. when it is rotated.
+	setPassword(password string)
+	close() error
+}
+
+// openPageStore opens a page store given its URL, currently only redis://[:password@]host[:port][/db].
+// The password, if not empty, overrides the one in the URL.
+func openPageStore(spec, password string) (PageStore, error) {
+	if strings.HasPrefix(spec, "redis://") {
+		return newRedisPageStore(spec, password)
+	}
+	return nil, fmt.Errorf("unsupported page store: %s", spec)
+}
+
+// RedisPageStore stores pages in a Redis hash, and relays patches between replicas using Redis pub/sub.
+type RedisPageStore struct {
+	opts    redis.Options
+	optsMux sync.Mutex // guards opts, read when resubscribing
+	conn    *redis.Conn
+}
+
+func newRedisPageStore(url, password string) (*RedisPageStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if len(password) > 0 {
+		opts.Password = password
+	}
+	conn, err := redis.Dial(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisPageStore{opts: opts, conn: conn}, nil
+}
+
+func (s *RedisPageStore) load() (map[string][]byte, error) {
+	reply, err := s.conn.Do("HGETALL", redisPagesKey)
+	if err != nil {
+		return nil, err
+	}
+	kvs, _ := reply.([]interface{})
+	pages := make(map[string][]byte, len(kvs)/2)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		url, _ := kvs[i].(string)
+		data, _ := kvs[i+1].(string)
+		pages[url] = []byte(data)
+	}
+	return pages, nil
+}
+
+func (s *RedisPageStore) urls() ([]string, error) {
+	reply, err := s.conn.Do("HKEYS", redisPagesKey)
+	if err != nil {
+		return nil, err
+	}
+	keys, _ := reply.([]interface{})
+	urls := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if url, ok := key.(string); ok {
+			urls = append(urls, url)
+		}
+	}
+	return urls, nil
+}
+
+func (s *RedisPageStore) read(url string) ([]byte, error) {
+	reply, err := s.conn.Do("HGET", redisPagesKey, url)
+	if err != nil {
+		return nil, err
+	}
+	if data, ok := reply.(string); ok {
+		return []byte(data), nil
+	}
+	return nil, nil
+}
+
+func (s *RedisPageStore) save(url string, data []byte) error {
+	_, err := s.conn.Do("HSET", redisPagesKey, url, string(data))
+	return err
+}
+
+func (s *RedisPageStore) remove(url string) error {
+	_, err := s.conn.Do("HDEL", redisPagesKey, url)
+	return err
+}
+
+func (s *RedisPageStore) publish(msg []byte) error {
+	_, err := s.conn.Do("PUBLISH", redisPatchesChannel, string(msg))
+	return err
+}
+
+func (s *RedisPageStore) subscribe(f func(msg []byte), subscribed func()) error {
+	s.optsMux.Lock()
+	opts := s.opts
+	s.optsMux.Unlock()
+	_, done, err := redis.Subscribe(opts, redisPatchesChannel, f)
+	if err != nil {
+		return err
+	}
+	subscribed()
+	return <-done
+}
+
+func (s *RedisPageStore) ping() error {
+	_, err := s.conn.Do("PING")
+	return err
+}
+
+func (s *RedisPageStore) setPassword(password string) {
+	s.optsMux.Lock()
+	s.opts.Password = password
+	s.optsMux.Unlock()
+	s.conn.SetPassword(password)
+}
+
+func (s *RedisPageStore) close() error {
+	return s.conn.Close()
+}
+
+// PageStorage keeps a page store in sync with the site, which acts as a write-through cache:
+// pages are read from memory, and changed pages are written to the store shortly after each change.
+// Patches are relayed to, and received from, other replicas sharing the store. Replicas that miss patches, e.g. if
+// relays are dropped, or while disconnected from the store, read the pages concerned back from the store.
+type PageStorage struct {
+	store    PageStore
+	site     *Site
+	replica  string          // unique id of this replica
+	dirty    map[string]bool // pages to write to the store
+	removed  map[string]bool // pages to remove from the store
+	resyncs  map[string]bool // pages other replicas must read back, their patches not relayed
+	dirtyMux sync.Mutex      // guards dirty, removed and resyncs
+	relays   chan []byte
+}
+
+const pageStoreRelayQueueSize = 1024
+
+// resyncPatch marks messages telling replicas to read a page back from the store, in lieu of a patch.
+var resyncPatch = []byte{}
+
+func newPageStorage(store PageStore, site *Site) *PageStorage {
+	return &PageStorage{
+		store:   store,
+		site:    site,
+		replica: uuid.New().String(),
+		dirty:   make(map[string]bool),
+		removed: make(map[string]bool),
+		resyncs: make(map[string]bool),
+		relays:  make(chan []byte, pageStoreRelayQueueSize),
+	}
+}
+
+// restore loads stored pages into the site, marshaled ahead of the first clients to watch them. If preload is set,
+// only pages at (or under) those routes are read from the store; other pages are left in the store, to be read back
+// on demand, as if evicted, and are indexed in the background if card search is enabled.
+func (s *PageStorage) restore(preload []string) error {
+	if len(preload) == 0 {
+		pages, err := s.store.load()
+		if err != nil {
+			return fmt.Errorf("failed loading pages: %v", err)
+		}
+		delete(pages, maintenanceStoreKey)
+		for url, data := range pages {
+			s.preload(url, data)
+		}
+		echo(Log{"t": "page_store_load", "pages": fmt.Sprint(len(pages))})
+		return nil
+	}
+
+	urls, err := s.store.urls()
+	if err != nil {
+		return fmt.Errorf("failed listing pages: %v", err)
+	}
+	var deferred []string
+	for _, url := range urls {
+		if url == maintenanceStoreKey {
+			continue
+		}
+		if !isPreloaded(preload, url) {
+			deferred = append(deferred, url)
+			continue
+		}
+		data, err := s.store.read(url)
+		if err != nil {
+			return fmt.Errorf("failed loading page %s: %v", url, err)
+		}
+		if data != nil { // removed since listed
+			s.preload(url, data)
+		}
+	}
+	s.site.Lock()
+	for _, url := range deferred {
+		s.site.evicted[url] = true
+	}
+	s.site.Unlock()
+	echo(Log{"t": "page_store_load", "pages": fmt.Sprint(len(urls) - len(deferred)), "deferred": fmt.Sprint(len(deferred))})
+	if s.site.index != nil && len(deferred) > 0 {
+		go s.index(deferred)
+	}
+	return nil
+}
+
+// preload loads a stored page into the site, and marshals it.
+func (s *PageStorage) preload(url string, data []byte) {
+	if err := s.site.set(url, data); err != nil {
+		echoError(Log{"t": "page_store_load", "url": url, "error": err.Error()})
+		return
+	}
+	if page, ok := s.site.pages.get(url); ok {
+		page.marshal()
+	}
+}
+
+// index adds pages left in the store to the card search index, without loading them into the site.
+// Pages read back on demand since are skipped, having been indexed then.
+func (s *PageStorage) index(urls []string) {
+	site := s.site
+	indexed := 0
+	for _, url := range urls {
+		if !site.isEvicted(url) {
+			continue
+		}
+		data, err := s.store.read(url)
+		if err != nil {
+			echoError(Log{"t": "page_store_index", "url": url, "error": err.Error()})
+			continue
+		}
+		var ops OpsD
+		if data == nil || json.Unmarshal(data, &ops) != nil || ops.P == nil {
+			continue
+		}
+		page := loadPage(site.ns, ops.P)
+		site.reloadMux.Lock() // so as not to overwrite the index of a page being read back
+		if site.isEvicted(url) {
+			site.index.page(url, page)
+			indexed++
+		}
+		site.reloadMux.Unlock()
+	}
+	echo(Log{"t": "page_store_index", "pages": fmt.Sprint(indexed)})
+}
+
+// isPreloaded returns true if url is at (or under) any of the given routes.
+func isPreloaded(preload []string, url string) bool {
+	for _, route := range preload {
+		if matchRoutePrefix(route, url) {
+			return true
+		}
+	}
+	return false
+}
+
+// share stores state under key, not a page URL, and broadcasts it to other replicas, which receive it in lieu of
+// a patch; see listen.
+func (s *PageStorage) share(key string, data []byte) {
+	if err := s.store.save(key, data); err != nil {
+		echoError(Log{"t": "page_store_write", "url": key, "error": err.Error()})
+	}
+	s.relayShared(key, data)
+}
+
+// relayShared broadcasts state under key, not a page URL, to other replicas, without storing it.
+func (s *PageStorage) relayShared(key string, data []byte) {
+	if err := s.store.publish(s.relayMsg(key, data)); err != nil {
+		echoError(Log{"t": "page_store_relay", "url": key, "error": err.Error()})
+	}
+}
+
+// loadShared applies the state shared by replicas, as stored.
+func (s *PageStorage) loadShared(b *Broker) {
+	data, err := s.store.read(maintenanceStoreKey)
+	if err != nil {
+		echoError(Log{"t": "page_store_load", "url": maintenanceStoreKey, "error": err.Error()})
+		return
+	}
+	if data != nil {
+		b.maintenanceChanged(data)
+	}
+}
+
+// mark schedules the page at url to be written to the store. Pages no longer in memory, e.g. evicted or garbage
+// collected, are left as stored; see remove. Safe to call on nil storage.
+func (s *PageStorage) mark(url string) {
+	if s == nil {
+		return
+	}
+	s.dirtyMux.Lock()
+	s.dirty[url] = true
+	s.dirtyMux.Unlock()
+}
+
+// remove schedules the page at url to be removed from the store, e.g. once deleted or expired, and other replicas
+// to be told to drop their copies. Safe to call on nil storage.
+func (s *PageStorage) remove(url string) {
+	if s == nil {
+		return
+	}
+	s.dirtyMux.Lock()
+	s.removed[url] = true
+	s.resyncs[url] = true
+	s.dirtyMux.Unlock()
+}
+
+// relay broadcasts a patch to other replicas. If the patch cannot be relayed, other replicas are told to read the
+// page back from the store instead, once written. Safe to call on nil storage.
+func (s *PageStorage) relay(url string, data []byte) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.relays <- s.relayMsg(url, data):
+	default:
+		echoError(Log{"t": "page_store_relay", "url": url, "error": "relay queue full; patch dropped, resyncing page"})
+		s.resync(url)
+	}
+}
+
+// relayMsg returns a message relaying a patch to other replicas: "replica url patch".
+func (s *PageStorage) relayMsg(url string, data []byte) []byte {
+	msg := make([]byte, 0, len(s.replica)+len(url)+len(data)+2)
+	return append(append(append(append(append(msg, s.replica...), ' '), url...), ' '), data...)
+}
+
+// resync schedules telling other replicas to read the page at url back from the store.
+func (s *PageStorage) resync(url string) {
+	s.dirtyMux.Lock()
+	s.resyncs[url] = true
+	s.dirtyMux.Unlock()
+}
+
+func (s *PageStorage) flush() {
+	s.dirtyMux.Lock()
+	dirty, removed := s.dirty, s.removed
+	s.dirty, s.removed = make(map[string]bool), make(map[string]bool)
+	s.dirtyMux.Unlock()
+
+	for url := range dirty {
+		if page, ok := s.site.pages.get(url); ok {
+			if data := page.marshal(); data != nil {
+				if err := s.store.save(url, data); err != nil {
+					echoError(Log{"t": "page_store_write", "url": url, "error": err.Error()})
+					s.mark(url) // retry
+				}
+			}
+		}
+	}
+	for url := range removed {
+		if _, ok := s.site.pages.get(url); ok || s.site.isEvicted(url) { // created again since
+			continue
+		}
+		if err := s.store.remove(url); err != nil {
+			echoError(Log{"t": "page_store_write", "url": url, "error": err.Error()})
+			s.dirtyMux.Lock()
+			s.removed[url] = true // retry
+			s.dirtyMux.Unlock()
+		}
+	}
+}
+
+// announce tells other replicas to read back pages whose patches were not relayed, once the pages are written.
+func (s *PageStorage) announce() {
+	s.dirtyMux.Lock()
+	var urls []string
+	for url := range s.resyncs {
+		if !s.dirty[url] && !s.removed[url] { // not written yet
+			urls = append(urls, url)
+			delete(s.resyncs, url)
+		}
+	}
+	s.dirtyMux.Unlock()
+
+	for _, url := range urls {
+		if err := s.store.publish(s.relayMsg(url, resyncPatch)); err != nil {
+			echoError(Log{"t": "page_store_relay", "url": url, "error": err.Error()})
+			s.resync(url) // retry
+		}
+	}
+}
+
+// run writes changed pages to the store, and relays patches to other replicas.
+func (s *PageStorage) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+			s.announce()
+		case msg := <-s.relays:
+			if err := s.store.publish(msg); err != nil {
+				echoError(Log{"t": "page_store_relay", "error": err.Error()})
+				if parts := bytes.SplitN(msg, []byte{' '}, 3); len(parts) == 3 {
+					s.resync(string(parts[1]))
+				}
+			}
+		}
+	}
+}
+
+// listen applies patches received from other replicas, re-subscribing on failure. Pages are read back from the
+// store when other replicas could not relay their patches, and, after re-subscribing, all pages, since patches
+// relayed in the meantime were missed.
+func (s *PageStorage) listen(b *Broker) {
+	for resubscribed := false; ; resubscribed = true {
+		err := s.store.subscribe(func(msg []byte) {
+			// msg: replica url patch
+			parts := bytes.SplitN(msg, []byte{' '}, 3)
+			if len(parts) != 3 || string(parts[0]) == s.replica {
+				return
+			}
+			url := string(parts[1])
+			switch url {
+			case maintenanceStoreKey:
+				b.maintenanceChanged(parts[2])
+				return
+			case announceStoreKey:
+				b.announced(parts[2])
+				return
+			}
+			if len(parts[2]) == 0 { // resyncPatch
+				s.reload(b, url)
+				return
+			}
+			b.relayed(url, parts[2])
+		}, func() {
+			if resubscribed {
+				s.reloadAll(b)
+			}
+		})
+		echoError(Log{"t": "page_store_subscribe", "error": fmt.Sprint(err)})
+		time.Sleep(time.Second)
+	}
+}
+
+// reload replaces the page at url with the stored page, if in memory or evicted; other pages are not in use.
+func (s *PageStorage) reload(b *Broker, url string) {
+	_, loaded := s.site.pages.get(url)
+	if !loaded && !s.site.isEvicted(url) {
+		return
+	}
+	data, err := s.store.read(url)
+	if err != nil {
+		echoError(Log{"t": "page_store_resync", "url": url, "error": err.Error()})
+		return
+	}
+	if !loaded && data != nil { // evicted pages are read back on demand, as stored
+		return
+	}
+	b.resynced(url, data)
+}
+
+// reloadAll replaces the pages in memory with the stored pages, except pages not yet written to the store,
+// and pages not stored, e.g. per-client pages. Stored pages not in memory are read back on demand.
+func (s *PageStorage) reloadAll(b *Broker) {
+	pages, err := s.store.load()
+	if err != nil {
+		echoError(Log{"t": "page_store_resync", "error": err.Error()})
+		return
+	}
+	if data, ok := pages[maintenanceStoreKey]; ok { // changed while unsubscribed, perhaps
+		b.maintenanceChanged(data)
+		delete(pages, maintenanceStoreKey)
+	}
+	s.site.Lock()
+	for url := range pages {
+		if _, ok := s.site.pages.get(url); !ok {
+			s.site.evicted[url] = true
+		}
+	}
+	s.site.Unlock()
+	for _, url := range s.site.urls() {
+		s.dirtyMux.Lock()
+		pending := s.dirty[url] || s.removed[url]
+		s.dirtyMux.Unlock()
+		if pending || b.isUnicast(url) {
+			continue
+		}
+		data := pages[url]
+		if page, ok := s.site.pages.get(url); ok && data != nil && bytes.Equal(page.marshal(), data) {
+			continue
+		}
+		b.resynced(url, data)
+	}
+	echo(Log{"t": "page_store_resync", "pages": fmt.Sprint(len(pages))})
+}
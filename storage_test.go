@@ -0,0 +1,130 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestRestorePreload(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	src := newSite()
+	store := &memPageStore{make(map[string][]byte)}
+	for _, url := range []string{"/home", "/dashboards/sales", "/reports"} {
+		no(src.patch(url, benchmarkPatch))
+		no(store.save(url, src.at(url).marshal()))
+	}
+
+	site := newSite()
+	site.loader = store.read
+	site.index = newSearchIndex()
+	s := newPageStorage(store, site)
+	s.store = &countingPageStore{memPageStore: store}
+	no(s.restore([]string{"/home", "/dashboards/"}))
+	eq(s.store.(*countingPageStore).reads, 2) // not preloaded pages are not read
+	for _, url := range []string{"/home", "/dashboards/sales"} {
+		page, loaded := site.pages.get(url)
+		ok(loaded, "preloaded "+url)
+		ok(page.read() != nil, "marshaled "+url)
+	}
+	_, loaded := site.pages.get("/reports")
+	ok(!loaded, "not preloaded")
+	ok(site.isEvicted("/reports"), "left in store")
+	s.index([]string{"/reports"})
+	_, loaded = site.pages.get("/reports")
+	ok(!loaded, "indexed, not loaded")
+	eq(len(site.index.search("title", func(string) bool { return true })), 3)
+	eq(site.at("/reports").cards["card"].data["title"], "Title") // read back on demand
+
+	site = newSite()
+	no(newPageStorage(store, site).restore(nil))
+	eq(site.pages.len(), 3)
+	page, _ := site.pages.get("/reports")
+	ok(page.read() != nil, "marshaled")
+}
+
+type countingPageStore struct {
+	*memPageStore
+	reads int
+}
+
+func (s *countingPageStore) load() (map[string][]byte, error) {
+	s.reads += len(s.pages)
+	return s.memPageStore.load()
+}
+
+func (s *countingPageStore) read(url string) ([]byte, error) {
+	s.reads++
+	return s.memPageStore.read(url)
+}
+
+type relayPageStore struct {
+	*memPageStore
+	published [][]byte
+}
+
+func (s *relayPageStore) publish(msg []byte) error {
+	s.published = append(s.published, msg)
+	return nil
+}
+
+func TestPageStorageSync(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	store := &relayPageStore{memPageStore: &memPageStore{make(map[string][]byte)}}
+	broker := newBroker(newSite(), false, false, true)
+	go broker.run()
+	site := broker.site
+	s := newPageStorage(store, site)
+	s.relays = make(chan []byte) // nobody relaying: patches are dropped
+
+	no(site.patch("/foo", benchmarkPatch))
+	s.mark("/foo")
+	s.relay("/foo", benchmarkPatch)
+	s.flush()
+	ok(store.pages["/foo"] != nil, "saved")
+	s.announce()
+	eq(len(store.published), 1)
+	eq(string(store.published[0]), s.replica+" /foo ") // read back /foo from the store
+
+	site.pages.del("/foo") // garbage collected
+	s.mark("/foo")
+	s.flush()
+	ok(store.pages["/foo"] != nil, "left in store for other replicas")
+
+	s.remove("/foo")
+	s.flush()
+	ok(store.pages["/foo"] == nil, "removed")
+	s.announce()
+	eq(len(store.published), 2)
+
+	// another replica changes a page, and deletes another, while this one is disconnected
+	no(site.patch("/bar", benchmarkPatch))
+	no(site.patch("/baz", benchmarkPatch))
+	other := newSite()
+	no(other.patch("/bar", benchmarkPatch))
+	no(other.patch("/bar", []byte(`{"d":[{"k":"card title","v":"Changed"}]}`)))
+	no(store.save("/bar", other.at("/bar").marshal()))
+	no(store.save("/qux", other.at("/bar").marshal()))
+	s.reloadAll(broker)
+	eq(site.at("/bar").cards["card"].data["title"], "Changed")
+	ok(site.at("/baz") == nil, "deleted")
+	ok(site.isEvicted("/qux"), "read back on demand")
+
+	delete(store.pages, "/bar")
+	s.reload(broker, "/bar")
+	ok(site.at("/bar") == nil, "deleted")
+}
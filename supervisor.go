@@ -0,0 +1,233 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	processStarting = "starting"
+	processRunning  = "running"
+	processBackoff  = "backoff" // waiting to restart after exiting
+
+	minProcessBackoff = time.Second
+	maxProcessBackoff = time.Minute
+	stableProcessRun  = time.Minute // processes running at least this long are restarted without delay
+)
+
+// AppProcessSpec represents an app process in a supervisor manifest.
+type AppProcessSpec struct {
+	Name    string            `json:"name"`
+	Route   string            `json:"route,omitempty"` // route the app registers at, for reporting
+	Command []string          `json:"command"`         // program and arguments
+	Dir     string            `json:"dir,omitempty"`   // working directory
+	Env     map[string]string `json:"env,omitempty"`   // additional environment variables
+}
+
+// AppProcessInfo represents the state of a supervised app process, as reported by the admin API.
+type AppProcessInfo struct {
+	Name       string     `json:"name"`
+	Route      string     `json:"route,omitempty"`
+	State      string     `json:"state"`
+	PID        int        `json:"pid,omitempty"`
+	Started    *time.Time `json:"started,omitempty"`
+	Restarts   int        `json:"restarts"`
+	Exit       string     `json:"exit,omitempty"` // how the process last exited
+	Registered bool       `json:"registered"`     // app registered at route?
+}
+
+// Supervisor launches app processes from a manifest, restarts them with exponential backoff when they exit,
+// and copies their output to the server log.
+type Supervisor struct {
+	sync.Mutex
+	broker    *Broker
+	env       []string // environment common to all processes
+	processes []*AppProcess
+}
+
+// AppProcess represents a supervised app process.
+type AppProcess struct {
+	spec AppProcessSpec
+	info AppProcessInfo // guarded by the supervisor's lock
+}
+
+// loadAppManifest reads a list of app processes from a JSON file.
+func loadAppManifest(path string) ([]AppProcessSpec, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading app manifest: %v", err)
+	}
+	var specs []AppProcessSpec
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return nil, fmt.Errorf("failed parsing app manifest %s: %v", path, err)
+	}
+	names := make(map[string]bool)
+	for i, spec := range specs {
+		if len(spec.Name) == 0 {
+			specs[i].Name = strconv.Itoa(i + 1)
+		}
+		if names[specs[i].Name] {
+			return nil, fmt.Errorf("bad app manifest %s: duplicate app name %s", path, specs[i].Name)
+		}
+		names[specs[i].Name] = true
+		if len(spec.Command) == 0 {
+			return nil, fmt.Errorf("bad app manifest %s: no command for app %s", path, specs[i].Name)
+		}
+	}
+	return specs, nil
+}
+
+// appProcessEnv returns the environment for app processes: the server's own, plus the Wave server's address
+// and base URL, unless already set.
+func appProcessEnv(listen, baseURL string, isTLS bool) []string {
+	env := os.Environ()
+	if _, ok := os.LookupEnv("H2O_WAVE_ADDRESS"); !ok {
+		host, port, err := net.SplitHostPort(listen)
+		if err == nil {
+			if len(host) == 0 {
+				host = "127.0.0.1"
+			}
+			scheme := "http://"
+			if isTLS {
+				scheme = "https://"
+			}
+			env = append(env, "H2O_WAVE_ADDRESS="+scheme+net.JoinHostPort(host, port))
+		}
+	}
+	if _, ok := os.LookupEnv("H2O_WAVE_BASE_URL"); !ok && baseURL != "/" {
+		env = append(env, "H2O_WAVE_BASE_URL="+baseURL)
+	}
+	return env
+}
+
+func newSupervisor(broker *Broker, env []string, specs []AppProcessSpec) *Supervisor {
+	s := &Supervisor{broker: broker, env: env}
+	for _, spec := range specs {
+		s.processes = append(s.processes, &AppProcess{spec, AppProcessInfo{Name: spec.Name, Route: spec.Route, State: processStarting}})
+	}
+	return s
+}
+
+// start launches all processes.
+func (s *Supervisor) start() {
+	for _, p := range s.processes {
+		go s.supervise(p)
+	}
+}
+
+func (s *Supervisor) supervise(p *AppProcess) {
+	backoff := minProcessBackoff
+	for {
+		started := time.Now()
+		exit := s.run(p)
+		echo(Log{"t": "app_exit", "app": p.spec.Name, "exit": exit})
+		if time.Since(started) >= stableProcessRun {
+			backoff = minProcessBackoff
+		}
+
+		s.Lock()
+		p.info.State, p.info.PID, p.info.Exit = processBackoff, 0, exit
+		s.Unlock()
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxProcessBackoff {
+			backoff = maxProcessBackoff
+		}
+
+		s.Lock()
+		p.info.Restarts++
+		s.Unlock()
+	}
+}
+
+// run runs the process to completion, returning how it exited.
+func (s *Supervisor) run(p *AppProcess) string {
+	cmd := exec.Command(p.spec.Command[0], p.spec.Command[1:]...)
+	cmd.Dir = p.spec.Dir
+	cmd.Env = append([]string{}, s.env...)
+	for k, v := range p.spec.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	configureAppProcess(cmd)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err.Error()
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err.Error()
+	}
+	if err := cmd.Start(); err != nil {
+		return err.Error()
+	}
+
+	now := time.Now().UTC()
+	s.Lock()
+	p.info.State, p.info.PID, p.info.Started = processRunning, cmd.Process.Pid, &now
+	s.Unlock()
+	echo(Log{"t": "app_start", "app": p.spec.Name, "pid": strconv.Itoa(cmd.Process.Pid)})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go copyAppOutput(&wg, p.spec.Name, "stdout", stdout)
+	go copyAppOutput(&wg, p.spec.Name, "stderr", stderr)
+	wg.Wait() // must finish reading before waiting
+
+	if err := cmd.Wait(); err != nil {
+		return err.Error()
+	}
+	return "exit status 0"
+}
+
+func copyAppOutput(wg *sync.WaitGroup, name, stream string, r io.Reader) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxMessageSize)
+	for scanner.Scan() {
+		echo(Log{"t": "app_output", "app": name, "stream": stream, "line": scanner.Text()})
+	}
+	io.Copy(ioutil.Discard, r) // drain overlong lines, if any
+}
+
+// infos returns the state of all supervised processes, sorted by name. Safe to call on a nil supervisor.
+func (s *Supervisor) infos() []AppProcessInfo {
+	infos := []AppProcessInfo{}
+	if s == nil {
+		return infos
+	}
+	s.Lock()
+	for _, p := range s.processes {
+		infos = append(infos, p.info)
+	}
+	s.Unlock()
+	for i := range infos {
+		infos[i].Registered = len(infos[i].Route) > 0 && s.broker.getApp(infos[i].Route) != nil
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
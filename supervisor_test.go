@@ -0,0 +1,112 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestLoadAppManifest(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	load := func(manifest string) ([]AppProcessSpec, error) {
+		path := filepath.Join(dir, "apps.json")
+		if err := ioutil.WriteFile(path, []byte(manifest), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return loadAppManifest(path)
+	}
+
+	specs, err := load(`[{"name":"demo","route":"/demo","command":["python","app.py"],"env":{"X":"1"}},{"command":["./tour"]}]`)
+	no(err)
+	eq(len(specs), 2)
+	eq(specs[0].Name, "demo")
+	eq(specs[0].Command, []string{"python", "app.py"})
+	eq(specs[0].Env["X"], "1")
+	eq(specs[1].Name, "2") // by position, if unnamed
+
+	for _, bad := range []string{
+		`{"command":["./tour"]}`,
+		`[{"name":"demo"}]`,
+		`[{"name":"demo","command":["a"]},{"name":"demo","command":["b"]}]`,
+		`[{"command":["a"]},{"name":"1","command":["b"]}]`,
+	} {
+		_, err := load(bad)
+		ok(err != nil, bad)
+	}
+	_, err = loadAppManifest(filepath.Join(dir, "missing.json"))
+	ok(err != nil, "missing manifest")
+}
+
+func TestAppProcessEnv(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	if _, set := os.LookupEnv("H2O_WAVE_ADDRESS"); set {
+		t.Skip("H2O_WAVE_ADDRESS set")
+	}
+	has := func(env []string, kv string) bool {
+		for _, x := range env {
+			if x == kv {
+				return true
+			}
+		}
+		return false
+	}
+	ok(has(appProcessEnv(":10101", "/", false), "H2O_WAVE_ADDRESS=http://127.0.0.1:10101"))
+	ok(has(appProcessEnv("0.0.0.0:443", "/", true), "H2O_WAVE_ADDRESS=https://0.0.0.0:443"))
+	if _, set := os.LookupEnv("H2O_WAVE_BASE_URL"); !set {
+		ok(has(appProcessEnv(":10101", "/wave/", false), "H2O_WAVE_BASE_URL=/wave/"))
+		ok(!has(appProcessEnv(":10101", "/", false), "H2O_WAVE_BASE_URL=/"), "default base URL")
+	}
+}
+
+func TestSupervisedProcess(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell")
+	}
+	broker := newBroker(newSite(), false, true, true)
+	s := newSupervisor(broker, nil, []AppProcessSpec{
+		{Name: "tour", Route: "/tour", Command: []string{sh, "-c", `test "$X" = 1 && exit 3`}, Env: map[string]string{"X": "1"}},
+		{Name: "demo", Route: "/demo", Command: []string{filepath.Join(t.TempDir(), "missing")}},
+	})
+
+	infos := s.infos()
+	eq(len(infos), 2)
+	eq(infos[0].Name, "demo") // by name
+	eq(infos[0].State, processStarting)
+
+	eq(s.run(s.processes[0]), "exit status 3")
+	info := s.processes[0].info
+	ok(info.Started != nil, "started")
+	ok(info.PID > 0, "pid")
+	ok(s.run(s.processes[1]) != "exit status 0", "failed to start")
+	ok(s.processes[1].info.Started == nil, "not started")
+
+	no(broker.addApp("", &RegisterApp{Route: "/tour", Address: "http://127.0.0.1:8000"}))
+	infos = s.infos()
+	ok(!infos[0].Registered, "demo not registered")
+	ok(infos[1].Registered, "tour registered")
+	broker.dropApp("/tour")
+
+	var none *Supervisor
+	eq(len(none.infos()), 0)
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// systemdAddress is the prefix of listener addresses that name sockets passed by systemd socket activation,
+// e.g. "systemd:wave.socket". See systemd.socket(5).
+const systemdAddress = "systemd:"
+
+// ActivatedSockets represents the listening sockets passed to the server by systemd, in order.
+type ActivatedSockets struct {
+	names     []string
+	listeners []net.Listener
+}
+
+// take returns the first unclaimed socket with the given name, or any name if empty, and claims it.
+func (s *ActivatedSockets) take(name string) net.Listener {
+	for i, ln := range s.listeners {
+		if ln != nil && (len(name) == 0 || s.names[i] == name) {
+			s.listeners[i] = nil
+			return ln
+		}
+	}
+	return nil
+}
+
+// watchdog keeps notifying systemd that the server is alive as long as check succeeds, if the service has a watchdog
+// configured (WatchdogSec=).
+func watchdog(check func(context.Context) error) {
+	interval := sdWatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval/2)
+		err := check(ctx)
+		cancel()
+		if err != nil {
+			echoError(Log{"t": "watchdog", "error": err.Error()})
+			continue // let systemd restart the server
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			echoError(Log{"t": "watchdog", "error": err.Error()})
+		}
+	}
+}
+
+// isSystemdAddress returns true if a listener address names a socket passed by systemd.
+func isSystemdAddress(address string) bool {
+	return strings.HasPrefix(address, systemdAddress)
+}
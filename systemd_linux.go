@@ -0,0 +1,96 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package wave
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const sdListenFDsStart = 3 // SD_LISTEN_FDS_START
+
+// systemdSockets returns the sockets passed by systemd socket activation, if any. The activation environment is
+// cleared, so that app processes started by the server do not mistake the sockets for their own.
+func systemdSockets() (*ActivatedSockets, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	sockets := &ActivatedSockets{}
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return sockets, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return sockets, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		fd := sdListenFDsStart + i
+		syscall.CloseOnExec(fd)
+		name := "unknown" // systemd's name for sockets without FileDescriptorName=
+		if i < len(names) && len(names[i]) > 0 {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("bad socket %s passed by systemd: %v", name, err)
+		}
+		sockets.names = append(sockets.names, name)
+		sockets.listeners = append(sockets.listeners, ln)
+	}
+	return sockets, nil
+}
+
+// sdNotify sends a state change to systemd, e.g. "READY=1"; a no-op unless started by systemd with Type=notify.
+// See sd_notify(3).
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if len(addr) == 0 {
+		return nil
+	}
+	conn, err := net.Dial("unixgram", addr) // a leading "@" denotes an abstract socket, as in systemd
+	if err != nil {
+		return fmt.Errorf("failed notifying systemd: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed notifying systemd: %v", err)
+	}
+	return nil
+}
+
+// sdWatchdogInterval returns the interval within which systemd expects watchdog notifications, or 0 if disabled.
+func sdWatchdogInterval() time.Duration {
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package wave
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestSDNotify(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	addr := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenPacket("unixgram", addr)
+	no(err)
+	defer conn.Close()
+
+	no(sdNotify("READY=1")) // no-op without NOTIFY_SOCKET
+
+	os.Setenv("NOTIFY_SOCKET", addr)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	no(sdNotify("READY=1"))
+	b := make([]byte, 64)
+	n, _, err := conn.ReadFrom(b)
+	no(err)
+	eq(string(b[:n]), "READY=1")
+}
+
+func TestActivatedSockets(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	sockets, err := systemdSockets() // not socket-activated
+	no(err)
+	eq(len(sockets.listeners), 0)
+
+	api, err := net.Listen("tcp", "127.0.0.1:0")
+	no(err)
+	defer api.Close()
+	ui, err := net.Listen("tcp", "127.0.0.1:0")
+	no(err)
+	defer ui.Close()
+	sockets = &ActivatedSockets{[]string{"api", "ui"}, []net.Listener{api, ui}}
+
+	l := newListener(systemdAddress+"api", []string{apiRole}, nil, nil)
+	no(l.listen(sockets, false))
+	ok(l.ln == api, "socket claimed by name")
+
+	l = newListener(systemdAddress+"api", []string{apiRole}, nil, nil)
+	ok(l.listen(sockets, false) != nil, "socket already claimed")
+
+	l = newListener("127.0.0.1:0", []string{uiRole}, nil, nil)
+	no(l.listen(sockets, true))
+	ok(l.ln == ui, "unclaimed socket used as fallback")
+	eq(l.address, ui.Addr().String())
+}
@@ -0,0 +1,33 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package wave
+
+import (
+	"time"
+)
+
+// systemdSockets returns no sockets on platforms without systemd.
+func systemdSockets() (*ActivatedSockets, error) {
+	return &ActivatedSockets{}, nil
+}
+
+// sdNotify is a no-op on platforms without systemd.
+func sdNotify(state string) error { return nil }
+
+// sdWatchdogInterval returns 0 on platforms without systemd.
+func sdWatchdogInterval() time.Duration { return 0 }
@@ -0,0 +1,143 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// tenantRoutePrefix prefixes the routes of each tenant's pages, i.e. /@tenant/route.
+const tenantRoutePrefix = "/@"
+
+var (
+	errNoTenant    = errors.New("could not determine tenant")
+	errWrongTenant = errors.New("session belongs to another tenant")
+)
+
+// Tenancy partitions a site between multiple tenants (e.g. organizations).
+//
+// Each tenant's pages and apps live under the tenant's private route prefix, /@tenant, and are addressed by
+// the tenant's users and API access keys without the prefix. A user's tenant is derived from an ID token claim,
+// or failing that, from the left-most label of the request's host name (e.g. "acme" for acme.example.com); with OIDC,
+// the host's tenant is bound to the session at login, and the session is rejected on other tenants' hosts.
+// API access keys are scoped to tenants explicitly; unscoped keys have access to the entire site.
+type Tenancy struct {
+	claim string            // ID token claim naming the user's tenant; if empty, use the host name.
+	keys  map[string]string // API access key ID => tenant
+}
+
+func newTenancy(claim string, keys map[string]string) *Tenancy {
+	return &Tenancy{claim, keys}
+}
+
+// tenantRoute maps a tenant's route to its route on the site.
+func tenantRoute(tenant, route string) string {
+	if len(tenant) == 0 {
+		return route
+	}
+	return tenantRoutePrefix + tenant + route
+}
+
+// splitTenantRoute splits a route on the site into its tenant, if any, and the tenant's route.
+func splitTenantRoute(route string) (string, string) {
+	if !strings.HasPrefix(route, tenantRoutePrefix) {
+		return "", route
+	}
+	rest := strings.TrimPrefix(route, tenantRoutePrefix)
+	i := strings.IndexByte(rest, '/')
+	if i < 0 {
+		return rest, "/"
+	}
+	return rest[:i], rest[i:]
+}
+
+// ofKey returns the tenant the request's API access key is scoped to, if any. Safe to call on a nil tenancy.
+func (t *Tenancy) ofKey(r *http.Request) string {
+	if t == nil {
+		return ""
+	}
+	if id, _, ok := r.BasicAuth(); ok {
+		return t.keys[id]
+	}
+	return ""
+}
+
+// of returns the tenant a request is made on behalf of: the API access key's if keyed, else the end-user's.
+// Safe to call on a nil tenancy.
+func (t *Tenancy) of(r *http.Request, keyed bool, auth *Auth) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	if keyed {
+		return t.ofKey(r), nil
+	}
+	var session *Session
+	if auth != nil {
+		session = auth.identify(r)
+	}
+	return t.ofUser(r, session)
+}
+
+// ofUser returns the tenant of the end-user making the request. Fails if a signed-in user's session was bound to
+// another tenant at login, e.g. if its cookie is replayed on another tenant's host.
+func (t *Tenancy) ofUser(r *http.Request, session *Session) (string, error) {
+	var tenant string
+	if len(t.claim) > 0 {
+		if session == nil {
+			return "", errNoTenant
+		}
+		tenant = session.tenant
+	} else {
+		tenant = hostTenant(r.Host)
+		if session != nil && session != anonymous && session.tenant != tenant {
+			return "", errWrongTenant
+		}
+	}
+	if !isTenantName(tenant) {
+		return "", errNoTenant
+	}
+	return tenant, nil
+}
+
+// hostTenant returns the tenant named by the left-most label of a host name, if any.
+func hostTenant(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	i := strings.IndexByte(host, '.')
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(host[:i])
+}
+
+// isTenantName returns true if s consists of lowercase letters, digits, '-' or '_'.
+func isTenantName(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,231 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+	"github.com/h2oai/wave/pkg/keychain"
+	"golang.org/x/oauth2"
+)
+
+// tenantKeys creates access keys scoped to the tenants acme and globex, and an unscoped key.
+type tenantKeys struct {
+	keychain *keychain.Keychain
+	tenancy  *Tenancy
+	secrets  map[string][2]string // name => id, secret
+}
+
+func newTenantKeys(t *testing.T) *tenantKeys {
+	_, _, no := assert.Assert(t)
+	kc, err := keychain.LoadKeychain(filepath.Join(t.TempDir(), "keychain"))
+	no(err)
+	k := &tenantKeys{kc, nil, make(map[string][2]string)}
+	scoped := make(map[string]string)
+	for _, name := range []string{"acme", "globex", ""} {
+		id, secret, hash, err := keychain.CreateAccessKey()
+		no(err)
+		kc.Add(id, hash)
+		k.secrets[name] = [2]string{id, secret}
+		if len(name) > 0 {
+			scoped[id] = name
+		}
+	}
+	k.tenancy = newTenancy("", scoped) // tenants of users by host name
+	return k
+}
+
+// as authorizes the request with the access key of the tenant, the unscoped key if empty.
+func (k *tenantKeys) as(r *http.Request, tenant string) *http.Request {
+	key := k.secrets[tenant]
+	r.SetBasicAuth(key[0], key[1])
+	return r
+}
+
+func TestTenantCache(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	k := newTenantKeys(t)
+	c := newCache("/_c/", k.keychain, k.tenancy, 1024)
+	serve := func(method, url, tenant, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, k.as(httptest.NewRequest(method, url, strings.NewReader(body)), tenant))
+		return w
+	}
+
+	eq(serve("PUT", "/_c/s/k", "acme", "secret").Code, http.StatusOK)
+	w := serve("GET", "/_c/s/k", "acme", "")
+	eq(w.Code, http.StatusOK)
+	eq(w.Body.String(), "secret")
+	eq(serve("GET", "/_c/s/k", "globex", "").Code, http.StatusNotFound)
+	eq(serve("GET", "/_c/s", "globex", "").Code, http.StatusNotFound)
+	eq(serve("GET", "/_c/s/k", "", "").Code, http.StatusNotFound)
+
+	serve("DELETE", "/_c/s/k", "globex", "")
+	eq(serve("GET", "/_c/s/k", "acme", "").Code, http.StatusOK)
+}
+
+func TestTenantMultipart(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	k := newTenantKeys(t)
+	s := newMultipartServer("/_m/", k.keychain, nil, k.tenancy, 1024)
+	serve := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	post := func(tenant string) int {
+		r := newUploadRequest(t, map[string]string{"frame.jpg": "jpeg"}, "image/jpeg")
+		r.URL.Path = "/_m/cam"
+		return serve(k.as(r, tenant))
+	}
+	has := func(key string) bool {
+		s.RLock()
+		defer s.RUnlock()
+		_, ok := s.sources[key]
+		return ok
+	}
+
+	eq(post("acme"), http.StatusOK)
+	ok(has("/@acme/cam"), "source scoped to tenant")
+	ok(!has("/cam"), "source not in site's namespace")
+
+	r := httptest.NewRequest("GET", "/_m/cam", nil)
+	r.Host = "globex.example.com"
+	eq(serve(r), http.StatusNotFound)
+	r = httptest.NewRequest("GET", "/_m/cam", nil)
+	r.Host = "127.0.0.1"
+	eq(serve(r), http.StatusNotFound) // no tenant
+
+	serve(k.as(httptest.NewRequest("DELETE", "/_m/cam", nil), "globex"))
+	ok(has("/@acme/cam"), "other tenant cannot delete source")
+	serve(k.as(httptest.NewRequest("DELETE", "/_m/cam", nil), "acme"))
+	ok(!has("/@acme/cam"), "tenant deletes own source")
+}
+
+func TestTenantFiles(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	k := newTenantKeys(t)
+	dir := t.TempDir()
+	store := newDiskFileStore(dir)
+	fs := newFileServer(dir, store, newUploadIndex(store, UploadQuotas{}), k.keychain, nil, k.tenancy, newCSRFGuard(nil), "/_f", UploadPolicy{}, false, newFileURLSigner(nil), nil)
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(k.as(newUploadRequest(t, map[string]string{"a.txt": "hello"}, ""), "acme"))
+	eq(w.Code, http.StatusOK)
+	var res UploadResponse
+	no(json.Unmarshal(w.Body.Bytes(), &res))
+	file := res.Files[0]
+
+	byHost := func(host string) int {
+		r := httptest.NewRequest("GET", file, nil)
+		r.Host = host
+		return serve(r).Code
+	}
+	eq(byHost("acme.example.com"), http.StatusOK)
+	eq(byHost("globex.example.com"), http.StatusNotFound)
+	eq(byHost("127.0.0.1"), http.StatusNotFound)
+	eq(serve(k.as(httptest.NewRequest("GET", file, nil), "acme")).Code, http.StatusOK)
+	eq(serve(k.as(httptest.NewRequest("GET", file, nil), "globex")).Code, http.StatusNotFound)
+	eq(serve(k.as(httptest.NewRequest("GET", file, nil), "")).Code, http.StatusOK)
+
+	sign := func(tenant string) int {
+		body, _ := json.Marshal(SignFilesRequest{Files: []string{file}})
+		return serve(k.as(httptest.NewRequest("POST", "/_f/_sign", bytes.NewReader(body)), tenant)).Code
+	}
+	eq(sign("globex"), http.StatusForbidden)
+	eq(sign("acme"), http.StatusOK)
+
+	eq(serve(k.as(httptest.NewRequest("DELETE", file, nil), "globex")).Code, http.StatusNotFound)
+	eq(byHost("acme.example.com"), http.StatusOK)
+	eq(serve(k.as(httptest.NewRequest("DELETE", file, nil), "acme")).Code, http.StatusOK)
+	eq(byHost("acme.example.com"), http.StatusNotFound)
+
+	r := newUploadRequest(t, map[string]string{"b.txt": "hello"}, "")
+	r.Host = "127.0.0.1"
+	eq(serve(r).Code, http.StatusForbidden) // users without a tenant cannot upload
+}
+
+func TestTenantSession(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	auth := newTestAuth()
+	auth.conf.TenantHost = true
+	tenancy := newTenancy("", nil)
+	login := func(host string) (*http.Cookie, int) {
+		r := httptest.NewRequest("GET", "/_login", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		newLoginHandler(auth).ServeHTTP(w, r)
+		if cookies := w.Result().Cookies(); len(cookies) > 0 {
+			return cookies[0], w.Code
+		}
+		return nil, w.Code
+	}
+
+	_, code := login("127.0.0.1")
+	eq(code, http.StatusForbidden) // no tenant to bind
+	cookie, code := login("acme.example.com")
+	eq(code, http.StatusFound)
+	session, found := auth.get(cookie.Value)
+	ok(found, "session started")
+	eq(session.tenant, "acme")
+	session.subject, session.token = "alice", &oauth2.Token{AccessToken: "alice"} // signed in at the callback
+
+	request := func(host string) *http.Request {
+		r := httptest.NewRequest("GET", "/_s/", nil)
+		r.Host = host
+		r.AddCookie(cookie)
+		return r
+	}
+	tenant, err := tenancy.ofUser(request("acme.example.com"), session)
+	no(err)
+	eq(tenant, "acme")
+	_, err = tenancy.ofUser(request("globex.example.com"), session)
+	eq(err, errWrongTenant)
+
+	sockets := newSocketServer(newBroker(newSite(), false, true, true), auth, tenancy, false, "/", nil)
+	w := httptest.NewRecorder()
+	sockets.ServeHTTP(w, request("globex.example.com"))
+	eq(w.Code, http.StatusForbidden) // cookie replayed on another tenant's host
+}
+
+func TestTenantPages(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	site := newSite()
+	site.tenantPages = 2
+	page := []byte(`{"d":[{"k":"a","d":{"view":"markdown"}}]}`)
+
+	no(site.patch("/@acme/a", page))
+	no(site.patch("/@acme/b", page))
+	eq(site.patch("/@acme/c", page), &QuotaError{"/@acme", "pages", 2, 3})
+	ok(site.at("/@acme/c") == nil, "page not created")
+	no(site.patch("/@acme/a", page))        // updates are not held to the quota
+	no(site.patch("/@acme/c", dropPageMsg)) // nor are drops
+	no(site.patch("/@globex/a", page))      // other tenants are unaffected
+	no(site.patch("/a", page))              // nor are pages outside tenants
+
+	site.del("/@acme/a")
+	no(site.patch("/@acme/c", page))
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttle tracks failed attempts per key (e.g. client address or account), and temporarily locks out
+// keys that fail too many times within a window.
+type Throttle struct {
+	sync.Mutex
+	maxAttempts int           // failures allowed per window; 0 disables throttling
+	window      time.Duration // window over which failures are counted
+	lockout     time.Duration // lockout duration once maxAttempts is exceeded
+	entries     map[string]*throttleEntry
+}
+
+type throttleEntry struct {
+	failures    int       // failures since start
+	start       time.Time // start of window
+	lockedUntil time.Time // locked out until
+}
+
+const throttlePruneThreshold = 10000
+
+func newThrottle(maxAttempts int, window, lockout time.Duration) *Throttle {
+	return &Throttle{
+		maxAttempts: maxAttempts,
+		window:      window,
+		lockout:     lockout,
+		entries:     make(map[string]*throttleEntry),
+	}
+}
+
+// locked returns true and the time remaining if the key is currently locked out.
+func (t *Throttle) locked(key string) (bool, time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	if t.maxAttempts <= 0 {
+		return false, 0
+	}
+	e, ok := t.entries[key]
+	if !ok {
+		return false, 0
+	}
+	if remaining := time.Until(e.lockedUntil); remaining > 0 {
+		return true, remaining
+	}
+	return false, 0
+}
+
+// fail records a failed attempt, and returns true if the key got locked out as a result.
+func (t *Throttle) fail(key string) bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.maxAttempts <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	e, ok := t.entries[key]
+	if !ok || now.Sub(e.start) > t.window {
+		if len(t.entries) >= throttlePruneThreshold {
+			t.prune(now)
+		}
+		e = &throttleEntry{start: now}
+		t.entries[key] = e
+	}
+	e.failures++
+	if e.failures >= t.maxAttempts {
+		e.lockedUntil = now.Add(t.lockout)
+		e.failures = 0
+		e.start = now
+		return true
+	}
+	return false
+}
+
+// configure changes the limits, e.g. when settings are reloaded; lockouts in effect are kept.
+func (t *Throttle) configure(maxAttempts int, window, lockout time.Duration) {
+	t.Lock()
+	t.maxAttempts, t.window, t.lockout = maxAttempts, window, lockout
+	t.Unlock()
+}
+
+// reset clears failed attempts for a key, e.g. after a successful attempt.
+func (t *Throttle) reset(key string) {
+	t.Lock()
+	delete(t.entries, key)
+	t.Unlock()
+}
+
+func (t *Throttle) prune(now time.Time) {
+	for k, e := range t.entries {
+		if now.Sub(e.start) > t.window && now.After(e.lockedUntil) {
+			delete(t.entries, k)
+		}
+	}
+}
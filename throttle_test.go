@@ -0,0 +1,44 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestThrottle(t *testing.T) {
+	_, ok, _ := assert.Assert(t)
+	th := newThrottle(3, time.Minute, time.Hour)
+	ok(!th.fail("a"), "first failure")
+	ok(!th.fail("a"), "second failure")
+	locked, _ := th.locked("a")
+	ok(!locked, "not locked below limit")
+	ok(th.fail("a"), "third failure locks out")
+	locked, remaining := th.locked("a")
+	ok(locked && remaining > 59*time.Minute, "locked out")
+	locked, _ = th.locked("b")
+	ok(!locked, "other keys unaffected")
+	th.reset("a")
+	locked, _ = th.locked("a")
+	ok(!locked, "reset clears lockout")
+
+	disabled := newThrottle(0, time.Minute, time.Hour)
+	for i := 0; i < 10; i++ {
+		ok(!disabled.fail("a"), "disabled throttle never locks out")
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	traceBatchSize     = 256             // spans exported per request, at most
+	traceFlushInterval = 5 * time.Second // how often spans are exported
+	traceQueueSize     = 4096            // spans waiting to be exported; spans beyond this are dropped
+
+	traceParentHeader = "traceparent" // see https://www.w3.org/TR/trace-context/
+)
+
+// Span kinds, as in OTLP.
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+// TraceConf represents the configuration for exporting traces to an OpenTelemetry collector.
+type TraceConf struct {
+	Endpoint    string  // OTLP/HTTP traces endpoint, e.g. "http://localhost:4318/v1/traces"
+	ServiceName string  // service name reported with spans
+	SampleRatio float64 // fraction of new traces to record, from 0 to 1; traces started upstream follow the caller
+}
+
+// Tracer records spans and exports them, in batches, to an OpenTelemetry collector via OTLP/HTTP (JSON).
+type Tracer struct {
+	conf    TraceConf
+	client  *http.Client
+	spans   chan *Span
+	flushes chan chan struct{} // requests to export all queued spans, closed when done
+}
+
+var tracer *Tracer // nil if tracing is disabled
+
+func newTracer(conf TraceConf) *Tracer {
+	return &Tracer{conf, &http.Client{Timeout: 10 * time.Second}, make(chan *Span, traceQueueSize), make(chan chan struct{})}
+}
+
+// Span represents a timed operation, part of a trace.
+type Span struct {
+	sync.Mutex
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte // zero for root spans
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   map[string]string
+	err     string
+}
+
+type spanKey struct{}
+
+// withSpan returns a context carrying a span, as the parent of spans started from it.
+func withSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+func spanFrom(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// withTraceParent returns a context carrying the caller's span, given a W3C traceparent header, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01". Unsampled or malformed headers are ignored.
+func withTraceParent(ctx context.Context, header string) context.Context {
+	if tracer == nil || len(header) == 0 {
+		return ctx
+	}
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || flags&1 == 0 {
+		return ctx
+	}
+	span := &Span{} // the caller's; not recorded here
+	if n, err := hex.Decode(span.traceID[:], []byte(parts[1])); err != nil || n != 16 || span.traceID == [16]byte{} {
+		return ctx
+	}
+	if n, err := hex.Decode(span.id[:], []byte(parts[2])); err != nil || n != 8 || span.id == [8]byte{} {
+		return ctx
+	}
+	return withSpan(ctx, span)
+}
+
+// startSpan starts a span, as a child of the span in ctx, if any, returning a context carrying the new span.
+// Returns a nil span if tracing is disabled, or the trace is not sampled; spans are safe to use when nil.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	span := &Span{name: name, kind: kind, start: time.Now()}
+	if parent := spanFrom(ctx); parent != nil {
+		span.traceID, span.parent = parent.traceID, parent.id
+	} else {
+		if mathrand.Float64() >= tracer.conf.SampleRatio {
+			return ctx, nil
+		}
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.id[:])
+	return withSpan(ctx, span), span
+}
+
+// set records an attribute of the span.
+func (s *Span) set(key, value string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[key] = value
+	s.Unlock()
+}
+
+// fail marks the span as failed, if err is not nil.
+func (s *Span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Lock()
+	s.err = err.Error()
+	s.Unlock()
+}
+
+// finish ends the span, and queues it for export.
+func (s *Span) finish() {
+	if s == nil || tracer == nil {
+		return
+	}
+	s.Lock()
+	s.end = time.Now()
+	s.Unlock()
+	select {
+	case tracer.spans <- s:
+	default: // exporter not keeping up
+	}
+}
+
+// traceParent returns the W3C traceparent header identifying the span in ctx, for propagation to apps; empty if none.
+func traceParent(ctx context.Context) string {
+	span := spanFrom(ctx)
+	if span == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%x-%x-01", span.traceID, span.id)
+}
+
+// run exports spans until the process exits.
+func (t *Tracer) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case span := <-t.spans:
+			if batch = append(batch, span); len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case done := <-t.flushes:
+			for n := len(t.spans); n > 0; n-- {
+				batch = append(batch, <-t.spans)
+			}
+			for len(batch) > traceBatchSize {
+				t.send(batch[:traceBatchSize])
+				batch = batch[traceBatchSize:]
+			}
+			if len(batch) > 0 {
+				t.send(batch)
+			}
+			batch = nil
+			close(done)
+			continue
+		}
+		t.send(batch)
+		batch = nil
+	}
+}
+
+// flush exports all queued spans, blocking until done.
+func (t *Tracer) flush() {
+	done := make(chan struct{})
+	t.flushes <- done
+	<-done
+}
+
+// flushOnExit exports queued spans when the process is interrupted or terminated, before exiting, so that
+// the spans of the last few seconds are not lost on shutdown.
+func (t *Tracer) flushOnExit() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	s := <-sig
+	t.flush()
+	signal.Stop(sig)
+	if p, err := os.FindProcess(os.Getpid()); err == nil && p.Signal(s) == nil { // exit as if not caught
+		time.Sleep(time.Second)
+	}
+	os.Exit(1)
+}
+
+func (t *Tracer) send(batch []*Span) {
+	if err := t.export(batch); err != nil {
+		echoError(Log{"t": "trace_export", "spans": strconv.Itoa(len(batch)), "error": err.Error()})
+	}
+}
+
+// export sends spans to the collector.
+// See https://opentelemetry.io/docs/specs/otlp/#otlphttp
+func (t *Tracer) export(spans []*Span) error {
+	b, err := json.Marshal(t.marshal(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.conf.Endpoint, contentTypeJSON, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector replied %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpAttr represents an OTLP key-value pair.
+type otlpAttr struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string                 `json:"traceId"`
+	SpanID       string                 `json:"spanId"`
+	ParentSpanID string                 `json:"parentSpanId,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         int                    `json:"kind"`
+	Start        string                 `json:"startTimeUnixNano"`
+	End          string                 `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr             `json:"attributes,omitempty"`
+	Status       map[string]interface{} `json:"status,omitempty"`
+}
+
+func otlpAttrs(attrs map[string]string) []otlpAttr {
+	var kvs []otlpAttr
+	for k, v := range attrs {
+		kvs = append(kvs, otlpAttr{k, map[string]string{"stringValue": v}})
+	}
+	return kvs
+}
+
+func (t *Tracer) marshal(spans []*Span) interface{} {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		s.Lock()
+		o := otlpSpan{
+			TraceID:    hex.EncodeToString(s.traceID[:]),
+			SpanID:     hex.EncodeToString(s.id[:]),
+			Name:       s.name,
+			Kind:       s.kind,
+			Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes: otlpAttrs(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if len(s.err) > 0 {
+			o.Status = map[string]interface{}{"code": 2, "message": s.err} // STATUS_CODE_ERROR
+		}
+		s.Unlock()
+		out[i] = o
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource":   map[string]interface{}{"attributes": otlpAttrs(map[string]string{"service.name": t.conf.ServiceName})},
+				"scopeSpans": []interface{}{map[string]interface{}{"scope": map[string]string{"name": "wave"}, "spans": out}},
+			},
+		},
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestTracing(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+
+	_, span := startSpan(context.Background(), "wave.query", spanServer)
+	ok(span == nil, "tracing disabled")
+	span.set("k", "v") // nil-safe
+	span.finish()
+
+	exported := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		var payload map[string]interface{}
+		json.Unmarshal(b, &payload)
+		exported <- payload
+	}))
+	defer collector.Close()
+
+	tracer = newTracer(TraceConf{Endpoint: collector.URL, ServiceName: "wave", SampleRatio: 1})
+	defer func() { tracer = nil }()
+
+	const caller = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx, root := startSpan(withTraceParent(context.Background(), caller), "wave.page.patch", spanServer)
+	eq(root.traceID[:2], []byte{0x4b, 0xf9})
+	ctx, child := startSpan(ctx, "wave.app.forward", spanClient)
+	eq(child.traceID, root.traceID)
+	eq(child.parent, root.id)
+	tp := traceParent(ctx)
+	ok(strings.HasPrefix(tp, "00-4bf92f3577b34da6a3ce929d0e0e4736-"), tp)
+	ok(strings.HasSuffix(tp, "-01"), tp)
+
+	_, unsampled := startSpan(withTraceParent(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"), "x", spanServer)
+	eq(unsampled.parent, [8]byte{}) // unsampled upstream is ignored; new root
+	_, bad := startSpan(withTraceParent(context.Background(), "garbage"), "x", spanServer)
+	eq(bad.parent, [8]byte{})
+
+	child.set("wave.route", "/demo")
+	child.fail(errors.New("boom"))
+	child.finish()
+	root.finish()
+	no(tracer.export([]*Span{<-tracer.spans, <-tracer.spans}))
+
+	payload := <-exported
+	rs := payload["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	spans := rs["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	eq(len(spans), 2)
+	s := spans[0].(map[string]interface{})
+	eq(s["name"], "wave.app.forward")
+	eq(s["traceId"], "4bf92f3577b34da6a3ce929d0e0e4736")
+	eq(s["status"].(map[string]interface{})["message"], "boom")
+	eq(spans[1].(map[string]interface{})["parentSpanId"], "00f067aa0ba902b7")
+
+	broker := newBroker(newSite(), false, false, true)
+	go broker.run()
+	no(broker.patch("/demo", benchmarkPatch, "test")) // untraced: no span
+	ctx, root = startSpan(context.Background(), "wave.page.patch", spanServer)
+	no(broker.tracePatch(ctx, "/demo", benchmarkPatch, "test"))
+	root.finish()
+	for len(tracer.spans) < 2 { // broadcast, finished once sent to watchers, in order
+		time.Sleep(time.Millisecond)
+	}
+	go tracer.run()
+	tracer.flush() // as on exit, without waiting for the next export
+
+	payload = <-exported
+	rs = payload["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	spans = rs["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	eq(len(spans), 2)
+	names := map[string]map[string]interface{}{}
+	for _, s := range spans {
+		names[s.(map[string]interface{})["name"].(string)] = s.(map[string]interface{})
+	}
+	ok(names["wave.broadcast"] != nil, "broadcast traced")
+	eq(names["wave.broadcast"]["parentSpanId"], names["wave.page.patch"]["spanId"])
+	eq(names["wave.broadcast"]["kind"], float64(spanInternal))
+}
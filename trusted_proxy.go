@@ -0,0 +1,140 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ProxyList lists the networks of reverse proxies and load balancers trusted to report the addresses of the clients
+// they forward requests for.
+type ProxyList []*net.IPNet
+
+// trustedProxies are the proxies trusted by the server; see getRemoteAddr.
+var trustedProxies ProxyList
+
+// parseProxyList parses a list of proxy addresses, each an IP address or a CIDR range, e.g. "10.0.0.0/8".
+func parseProxyList(specs []string) (ProxyList, error) {
+	networks, err := parseNetworks("trusted proxy", specs)
+	return ProxyList(networks), err
+}
+
+// parseNetworks parses a list of networks, each an IP address or a CIDR range; kind describes them, for errors.
+func parseNetworks(kind string, specs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if len(spec) == 0 {
+			continue
+		}
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("bad %s: want IP address or CIDR range, got %q", kind, spec)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s: want IP address or CIDR range, got %q", kind, spec)
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// containsIP returns true if the address belongs to any of the networks.
+func containsIP(networks []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trusts returns true if the address belongs to a trusted proxy.
+func (proxies ProxyList) trusts(addr string) bool {
+	return containsIP(proxies, addr)
+}
+
+// clientAddr returns the IP address of the client that sent a request. The X-Forwarded-For and X-Real-IP headers are
+// honored only if the request came from a trusted proxy, since anyone else could set them to anything. X-Forwarded-For
+// is read right to left, skipping trusted proxies, so that addresses prepended by the client itself are ignored.
+func (proxies ProxyList) clientAddr(r *http.Request) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if !proxies.trusts(addr) {
+		return addr
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break // garbled; stop at the last address known to be good
+			}
+			addr = hop
+			if !proxies.trusts(hop) {
+				break
+			}
+		}
+		return addr
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return addr
+}
+
+// forwardedHost returns the host a request was originally made to, as reported by a trusted proxy via the
+// X-Forwarded-Host header; empty if the request did not come from a trusted proxy, or the header is not set.
+func (proxies ProxyList) forwardedHost(r *http.Request) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if !proxies.trusts(addr) {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get("X-Forwarded-Host"))
+}
+
+// isHTTPS returns true if a request was made over TLS, either to the server itself, or to a trusted proxy reporting
+// the original scheme via the X-Forwarded-Proto header.
+func (proxies ProxyList) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return proxies.trusts(addr) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
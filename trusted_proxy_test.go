@@ -0,0 +1,49 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestClientAddr(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	proxies, err := parseProxyList([]string{"10.0.0.0/8", "192.168.1.1"})
+	no(err)
+
+	request := func(peer string, headers ...string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = peer
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Add(headers[i], headers[i+1])
+		}
+		return proxies.clientAddr(r)
+	}
+
+	eq(request("203.0.113.7:5000"), "203.0.113.7")
+	eq(request("203.0.113.7:5000", "X-Forwarded-For", "1.2.3.4"), "203.0.113.7") // untrusted peer
+	eq(request("10.1.2.3:5000", "X-Forwarded-For", "1.2.3.4"), "1.2.3.4")
+	eq(request("10.1.2.3:5000", "X-Forwarded-For", "6.6.6.6, 1.2.3.4, 10.0.0.2"), "1.2.3.4") // spoofed hop ignored
+	eq(request("10.1.2.3:5000", "X-Forwarded-For", "6.6.6.6", "X-Forwarded-For", "1.2.3.4"), "1.2.3.4")
+	eq(request("192.168.1.1:5000", "X-Real-IP", "1.2.3.4"), "1.2.3.4")
+	eq(request("192.168.1.2:5000", "X-Real-IP", "1.2.3.4"), "192.168.1.2")
+	eq(request("10.1.2.3:5000", "X-Forwarded-For", "garbage"), "10.1.2.3")
+
+	_, err = parseProxyList([]string{"10.0.0.0/33"})
+	ok(err != nil)
+}
@@ -193,6 +193,17 @@ interface OpsD {
   m?: { // metadata
     u: S // active user's username
     e: B // can the user edit pages?
+    c?: S // client ID, if upload progress was asked for
+  }
+  f?: { // upload progress
+    i: S // upload ID
+    r: U // bytes received
+    t: U // bytes expected; 0 if unknown
+  }
+  n?: { // notice
+    t: S // text; empty to hide
+    y?: S // type
+    s?: U // timeout, in seconds
   }
 }
 interface OpD {
@@ -296,6 +307,24 @@ export enum WaveErrorCode {
   Unknown = 1,
   /** The requested page was not found. */
   PageNotFound,
+  /** The server did not recognize the type of a message sent to it. */
+  BadMessageType,
+  /** A message sent to the server was too large. */
+  MessageTooLarge,
+  /** A message sent to the server was malformed. */
+  MalformedMessage,
+  /** The server does not speak this client's protocol version, e.g. during a rolling upgrade. */
+  UnsupportedProtocol,
+  /** The server, or this client's user or address, has too many open connections. */
+  TooManyConnections,
+  /** An app did not respond to a request in time; the page is still valid. */
+  AppTimeout,
+  /** An app is failing, and requests to it are refused for a while; the page is still valid. */
+  AppUnavailable,
+  /** An edit was rejected because it would make the page exceed its quota; the page is still valid. */
+  QuotaExceeded,
+  /** An edit was rejected because it could not be recorded in the edit audit log; the page is still valid. */
+  EditNotRecorded,
 }
 
 /** The type of an event raised by the Wave socket client. */
@@ -318,13 +347,17 @@ export enum WaveEventType {
   Page,
   /** Daemon sent some data. */
   Data,
+  /** Daemon sent a notice to show (or hide, if empty), e.g. of maintenance. */
+  Notice,
+  /** Daemon received more of an upload. */
+  Progress,
 }
 
 /** */
 export type WaveEvent = {
   t: WaveEventType.Page, page: Page
 } | {
-  t: WaveEventType.Config, username: S, editable: B
+  t: WaveEventType.Config, username: S, editable: B, clientID?: S
 } | {
   t: WaveEventType.Reset
 } | {
@@ -339,6 +372,10 @@ export type WaveEvent = {
   t: WaveEventType.Disconnect, retry: U
 } | {
   t: WaveEventType.Data
+} | {
+  t: WaveEventType.Notice, text: S, type?: S, timeout?: U
+} | {
+  t: WaveEventType.Progress, id: S, received: U, total: U
 }
 const
   connectEvent: WaveEvent = { t: WaveEventType.Connect },
@@ -379,6 +416,9 @@ export interface Wave {
   push(data: any): void
 }
 
+/** The version of the protocol spoken by this client to the Wave server. */
+export const protocolVersion = 2
+
 let guid = 0
 export const
   xid = () => `x${++guid}`,
@@ -400,8 +440,18 @@ export function unpack<T>(data: any): T {
 }
 
 const
+  maxBackoff = 16, // most seconds to wait between reconnection attempts
   errorCodes: Dict<WaveErrorCode> = {
     not_found: WaveErrorCode.PageNotFound,
+    bad_type: WaveErrorCode.BadMessageType,
+    oversized: WaveErrorCode.MessageTooLarge,
+    malformed: WaveErrorCode.MalformedMessage,
+    unsupported_protocol: WaveErrorCode.UnsupportedProtocol,
+    too_many_connections: WaveErrorCode.TooManyConnections,
+    app_timeout: WaveErrorCode.AppTimeout,
+    app_unavailable: WaveErrorCode.AppUnavailable,
+    quota_exceeded: WaveErrorCode.QuotaExceeded,
+    edit_not_recorded: WaveErrorCode.EditNotRecorded,
   },
   decodeType = (d: S): [S, S] => {
     const i = d.indexOf(':')
@@ -808,6 +858,7 @@ const
       p = protocol === 'https:' ? 'wss' : 'ws'
     return p + "://" + host + path
   },
+  withProtocolVersion = (address: S): S => address + (address.indexOf('?') < 0 ? '?' : '&') + 'v=' + protocolVersion,
   refreshRateB = box(-1) // TODO ugly; refactor
 
 export const
@@ -838,7 +889,7 @@ export const
 
           _socket = null
           _backoff *= 2
-          if (_backoff > 16) _backoff = 16
+          if (_backoff > maxBackoff) _backoff = maxBackoff
           handle({ t: WaveEventType.Disconnect, retry: _backoff })
           window.setTimeout(retry, _backoff * 1000)
         }
@@ -859,14 +910,22 @@ export const
                 const page = _page = load(msg.p)
                 handle({ t: WaveEventType.Page, page })
               } else if (msg.e) {
+                // Refused for being over the server's connection limit: wait as long as possible before retrying.
+                if (msg.e === 'too_many_connections') _backoff = maxBackoff
                 handle({ t: WaveEventType.Error, code: errorCodes[msg.e] || WaveErrorCode.Unknown })
               } else if (msg.r) {
                 handle(resetEvent)
               } else if (msg.u) {
                 handle({ t: WaveEventType.Redirect, url: msg.u })
               } else if (msg.m) {
-                const { u: username, e: editable } = msg.m
-                handle({ t: WaveEventType.Config, username, editable })
+                const { u: username, e: editable, c: clientID } = msg.m
+                handle({ t: WaveEventType.Config, username, editable, clientID })
+              } else if (msg.n) {
+                const { t: text, y: type, s: timeout } = msg.n
+                handle({ t: WaveEventType.Notice, text, type, timeout })
+              } else if (msg.f) {
+                const { i: id, r: received, t: total } = msg.f
+                handle({ t: WaveEventType.Progress, id, received, total })
               }
             } catch (error) {
               console.error(error)
@@ -911,7 +970,7 @@ export const
       if (_socket) _socket.close()
     })
 
-    reconnect(toSocketAddress(address))
+    reconnect(toSocketAddress(withProtocolVersion(address) + '&route=' + encodeURIComponent(slug))) // for the page's session timeout
 
     return { fork, push }
   }
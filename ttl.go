@@ -0,0 +1,79 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"strconv"
+	"time"
+)
+
+const pageTTLHeader = "Wave-Page-TTL"
+
+var dropPageMsg = []byte(`{"d":[{}]}`)
+
+// parseTTL parses a time-to-live, specified either as a duration (e.g. "30m") or as a number of seconds.
+func parseTTL(s string) (time.Duration, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// expire sets the time-to-live of the page at url; a zero ttl never expires the page.
+func (site *Site) expire(url string, ttl time.Duration) {
+	site.Lock()
+	defer site.Unlock()
+	if ttl <= 0 {
+		delete(site.expiries, url)
+		return
+	}
+	site.expiries[url] = time.Now().Add(ttl)
+}
+
+// sweep deletes pages that have expired as of now, and returns their urls.
+func (site *Site) sweep(now time.Time) []string {
+	var urls []string
+	site.Lock()
+	for url, expiry := range site.expiries {
+		if expiry.Before(now) {
+			urls = append(urls, url)
+			delete(site.expiries, url)
+			site.pages.del(url)
+		}
+	}
+	site.Unlock()
+	for _, url := range urls {
+		site.dropHistory(url)
+		site.index.drop(url)
+	}
+	return urls
+}
+
+// expirePages periodically removes expired pages, and notifies their watchers.
+func (b *Broker) expirePages(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, url := range b.site.sweep(now) {
+			echo(Log{"t": "page_expire", "route": url})
+			if !b.noLog {
+				logAOF(patchMarker, url, dropPageMsg)
+			}
+			b.publish <- Pub{url, b.missingPage(url), nil, nil}
+			b.hooks.firePage(pageDeleted, url, "ttl")
+			b.storage.remove(url)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestParseTTL(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	ttl, err := parseTTL("30")
+	eq(err, nil)
+	eq(ttl, 30*time.Second)
+	ttl, err = parseTTL("5m")
+	eq(err, nil)
+	eq(ttl, 5*time.Minute)
+	_, err = parseTTL("soon")
+	ok(err != nil, "bad ttl")
+}
+
+func TestPageTTL(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	site := newSite()
+	s := &WebServer{site: site, broker: newBroker(site, false, false, true), maxRequestSize: 1024, baseURL: "/"}
+	patch := func(url, ttl string) int {
+		r := httptest.NewRequest("PUT", url, strings.NewReader(`{"d":[{"k":"x","d":{"view":"markdown"}}]}`))
+		if len(ttl) > 0 {
+			r.Header.Set(pageTTLHeader, ttl)
+		}
+		w := httptest.NewRecorder()
+		s.patch(w, r)
+		return w.Code
+	}
+
+	eq(patch("/foo", "1"), http.StatusOK)
+	eq(patch("/bar", "1h"), http.StatusOK)
+	eq(patch("/baz", ""), http.StatusOK)
+	eq(patch("/bad", "soon"), http.StatusBadRequest)
+	ok(site.at("/bad") == nil, "page with bad ttl not written")
+
+	now := time.Now()
+	eq(len(site.sweep(now)), 0)
+	eq(site.sweep(now.Add(2*time.Second)), []string{"/foo"})
+	ok(site.at("/foo") == nil, "expired page deleted")
+	ok(site.at("/bar") != nil, "page not yet expired")
+	eq(len(site.sweep(now.Add(48*time.Hour))), 1) // /bar; /baz never expires
+	ok(site.at("/baz") != nil, "page without ttl kept")
+
+	eq(patch("/foo", "1"), http.StatusOK)
+	eq(patch("/foo", ""), http.StatusOK) // a patch without a ttl leaves it as is
+	eq(patch("/qux", "1"), http.StatusOK)
+	eq(patch("/qux", "0"), http.StatusOK) // 0 clears it
+	eq(site.sweep(now.Add(time.Minute)), []string{"/foo"})
+}
+
+func TestExpirePages(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	site := newSite()
+	broker := newBroker(site, false, false, true)
+	eq(site.set("/foo", []byte(`{"p":{"c":{"x":{"d":{"view":"markdown"}}}}}`)), nil)
+	site.expire("/foo", time.Nanosecond)
+	go broker.expirePages(10 * time.Millisecond)
+
+	pub := <-broker.publish // watchers are told the page is gone
+	eq(pub.route, "/foo")
+	eq(string(pub.data), string(notFoundMsg))
+	eq(site.at("/foo") == nil, true)
+}
@@ -0,0 +1,502 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	tusPrefix     = "/_tus/" // under the file server's base URL
+	tusChunkType  = "application/offset+octet-stream"
+
+	tusExpiryInterval = time.Minute // how often expired uploads are deleted
+)
+
+var errTusNotFound = errors.New("upload not found")
+
+// TusUploads represents resumable uploads, per the tus protocol (https://tus.io/protocols/resumable-upload.html),
+// with the creation, expiration and termination extensions.
+//
+// An upload is created with a POST to the file server, and its data sent in one or more PATCH requests.
+// If a PATCH is interrupted, the client uses HEAD to learn how much was received, and resumes from there.
+// Once all data is received, the file is stored like any other upload, and its path sent in the Wave-File-Path header.
+//
+// Incomplete uploads are always kept on local disk, even if completed uploads are kept in object storage, so
+// an interrupted upload must be resumed against the same server.
+type TusUploads struct {
+	dir      string    // incomplete uploads
+	store    FileStore // completed uploads
+	uploads  *UploadIndex
+	baseURL  string
+	policy   UploadPolicy
+	auth     *Auth           // to identify uploaders, for progress events
+	progress *UploadProgress // nil if not reported
+	images   *ImageVariants
+	locksMu  sync.Mutex
+	locks    map[string]*tusLock // upload ID => lock, while requests hold or wait for it
+}
+
+// tusLock serializes the requests for an upload.
+type tusLock struct {
+	sync.Mutex
+	refs int // requests holding or waiting for the lock
+}
+
+// TusUpload represents the state of a resumable upload, stored next to its data.
+type TusUpload struct {
+	ID       string      `json:"id"`
+	Length   int64       `json:"length"`
+	Filename string      `json:"filename"`
+	Type     string      `json:"type,omitempty"`    // as declared by the client
+	Expires  time.Time   `json:"expires,omitempty"` // zero if never
+	Path     string      `json:"path,omitempty"`    // path of the stored file, once complete
+	Access   *FileAccess `json:"access,omitempty"`  // who may download the stored file, and resume the upload
+}
+
+// isOwner returns true if the upload was created by the same uploader as access.
+func (u *TusUpload) isOwner(access *FileAccess) bool {
+	var uploader, want string
+	if u.Access != nil {
+		want = u.Access.Uploader
+	}
+	if access != nil {
+		uploader = access.Uploader
+	}
+	return uploader == want
+}
+
+func newTusUploads(fileDir string, store FileStore, uploads *UploadIndex, baseURL string, policy UploadPolicy, auth *Auth, progress *UploadProgress, images *ImageVariants) *TusUploads {
+	return &TusUploads{filepath.Join(fileDir, "_tus"), store, uploads, baseURL, policy, auth, progress, images, sync.Mutex{}, make(map[string]*tusLock)}
+}
+
+// isTus returns true if the request is part of a resumable upload.
+func isTus(r *http.Request, p string) bool {
+	return strings.HasPrefix(p, tusPrefix) || (p == "/" && (r.Method == http.MethodOptions || len(r.Header.Get("Tus-Resumable")) > 0))
+}
+
+// ServeHTTP serves a tus request. Access is who may download the uploaded file; only its owner, if any,
+// may resume or terminate the upload.
+func (t *TusUploads) ServeHTTP(w http.ResponseWriter, r *http.Request, p string, access *FileAccess) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if max := t.policy.maxFileSize(); max > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(max, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if v := r.Header.Get("Tus-Resumable"); v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.TrimPrefix(p, tusPrefix)
+	if p == "/" {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		t.create(w, r, access)
+		return
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	unlock := t.lock(id)
+	if unlock == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer unlock()
+
+	if u, _, err := t.load(id); err == nil && !u.isOwner(access) {
+		echoError(Log{"t": "file_upload_resumable", "id": id, "error": "not upload owner"})
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		t.head(w, id)
+	case http.MethodPatch:
+		t.patch(w, r, id)
+	case http.MethodDelete:
+		if err := t.remove(id); err != nil {
+			echoError(Log{"t": "file_upload_resumable", "id": id, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		echo(Log{"t": "file_upload_resumable", "id": id, "status": "terminated"})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (t *TusUploads) create(w http.ResponseWriter, r *http.Request, access *FileAccess) {
+	if len(r.Header.Get("Upload-Defer-Length")) > 0 {
+		http.Error(w, "deferred upload length not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "want Upload-Length", http.StatusBadRequest)
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filename := filepath.Base(filepath.Clean("/" + meta["filename"]))
+	if filename == "/" || filename == "." {
+		filename = "upload"
+	}
+
+	if max := t.policy.maxFileSize(); max > 0 && length > max {
+		writeUploadError(w, &UploadError{Code: uploadFileTooLarge, File: filename, Limit: max})
+		return
+	}
+	if err := t.policy.checkType(filename, meta["filetype"], ""); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	if err := t.uploads.allow(access, length); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	u := &TusUpload{ID: uuid.New().String(), Length: length, Filename: filename, Type: meta["filetype"], Access: access}
+	if t.policy.Expiry > 0 {
+		u.Expires = time.Now().UTC().Add(t.policy.Expiry)
+	}
+	if err := t.start(u); err != nil {
+		echoError(Log{"t": "file_upload_resumable", "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	echo(Log{"t": "file_upload_resumable", "id": u.ID, "file": filename, "length": strconv.FormatInt(length, 10)})
+
+	if length == 0 { // nothing to send
+		if err := t.complete(u); err != nil {
+			t.fail(w, u.ID, err)
+			return
+		}
+	}
+
+	t.writeState(w, u, 0)
+	w.Header().Set("Location", t.baseURL+tusPrefix+u.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (t *TusUploads) head(w http.ResponseWriter, id string) {
+	u, offset, err := t.load(id)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	t.writeState(w, u, offset)
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (t *TusUploads) patch(w http.ResponseWriter, r *http.Request, id string) {
+	if mediaType(r.Header.Get("Content-Type")) != tusChunkType {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	u, offset, err := t.load(id)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if o, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64); err != nil || o != offset || len(u.Path) > 0 {
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+	if size := t.policy.ChunkSize; size > 0 && r.ContentLength > size {
+		writeUploadError(w, &UploadError{Code: uploadChunkTooLarge, File: u.Filename, Limit: size})
+		return
+	}
+
+	// Keep whatever is received, even if the request is interrupted; the client can resume from there.
+	n := u.Length - offset
+	if size := t.policy.ChunkSize; size > 0 && size < n {
+		n = size
+	}
+	f, err := os.OpenFile(t.dataPath(id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.fail(w, id, err)
+		return
+	}
+	body := t.progress.meter(r, t.auth, id, offset, u.Length)
+	written, err := io.Copy(f, io.LimitReader(body, n))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	offset += written
+	if err != nil {
+		echoError(Log{"t": "file_upload_resumable", "id": id, "offset": strconv.FormatInt(offset, 10), "error": err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if offset == u.Length {
+		if err := t.complete(u); err != nil {
+			t.fail(w, id, err)
+			return
+		}
+	}
+	t.writeState(w, u, offset)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fail replies to a failed request, terminating the upload if the upload was rejected.
+func (t *TusUploads) fail(w http.ResponseWriter, id string, err error) {
+	echoError(Log{"t": "file_upload_resumable", "id": id, "error": err.Error()})
+	if uerr, ok := err.(*UploadError); ok {
+		t.remove(id)
+		writeUploadError(w, uerr)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+func (t *TusUploads) writeState(w http.ResponseWriter, u *TusUpload, offset int64) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if !u.Expires.IsZero() {
+		w.Header().Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+	}
+	if len(u.Path) > 0 {
+		w.Header().Set("Wave-File-Path", u.Path)
+	}
+}
+
+// complete checks a fully received upload against the upload policy, and stores it as an uploaded file.
+func (t *TusUploads) complete(u *TusUpload) error {
+	if t.policy.sniffs() {
+		sniffed, err := sniffFileType(t.dataPath(u.ID))
+		if err != nil {
+			return err
+		}
+		if err := t.policy.checkType(u.Filename, u.Type, sniffed); err != nil {
+			return err
+		}
+	}
+
+	open := func() (io.ReadCloser, error) { return os.Open(t.dataPath(u.ID)) }
+	if err := t.policy.scanFile(t.store, u.Filename, open, u.Length); err != nil {
+		return err
+	}
+
+	fileID := uuid.New().String()
+	key := path.Join(fileID, u.Filename)
+	if err := t.uploads.put(fileID, u.Access, u.Length); err != nil {
+		return err
+	}
+	if err := t.store.move(key, t.dataPath(u.ID)); err != nil {
+		t.uploads.discard(fileID)
+		return fmt.Errorf("failed storing upload %s: %v", u.ID, err)
+	}
+	t.images.deriveAll([]string{key})
+	u.Path = path.Join(t.baseURL, fileID, u.Filename)
+	if err := t.save(u); err != nil {
+		return err
+	}
+	echo(Log{"t": "file_upload_resumable", "id": u.ID, "path": u.Path, "status": "complete"})
+	return nil
+}
+
+// lock locks an upload, returning a function that unlocks it; nil if there is no such upload.
+// Locks are created for known uploads only, and dropped once no request holds or waits for them. The upload may have
+// been removed by the time the lock is acquired, so callers must load it again.
+func (t *TusUploads) lock(id string) func() {
+	t.locksMu.Lock()
+	l, ok := t.locks[id]
+	if !ok {
+		if _, err := os.Stat(t.infoPath(id)); err != nil {
+			t.locksMu.Unlock()
+			return nil
+		}
+		l = &tusLock{}
+		t.locks[id] = l
+	}
+	l.refs++
+	t.locksMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		t.locksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(t.locks, id)
+		}
+		t.locksMu.Unlock()
+	}
+}
+
+func (t *TusUploads) dataPath(id string) string { return filepath.Join(t.dir, id) }
+func (t *TusUploads) infoPath(id string) string { return filepath.Join(t.dir, id+".json") }
+
+func (t *TusUploads) start(u *TusUpload) error {
+	if err := os.MkdirAll(t.dir, 0700); err != nil {
+		return fmt.Errorf("failed creating upload dir %s: %v", t.dir, err)
+	}
+	if err := ioutil.WriteFile(t.dataPath(u.ID), nil, 0600); err != nil {
+		return fmt.Errorf("failed creating upload %s: %v", u.ID, err)
+	}
+	return t.save(u)
+}
+
+func (t *TusUploads) save(u *TusUpload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(t.infoPath(u.ID), b, 0600); err != nil {
+		return fmt.Errorf("failed saving upload %s: %v", u.ID, err)
+	}
+	return nil
+}
+
+// load returns an unexpired upload, and the number of bytes received so far.
+func (t *TusUploads) load(id string) (*TusUpload, int64, error) {
+	b, err := ioutil.ReadFile(t.infoPath(id))
+	if err != nil {
+		return nil, 0, errTusNotFound
+	}
+	var u TusUpload
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, 0, fmt.Errorf("failed loading upload %s: %v", id, err)
+	}
+	if !u.Expires.IsZero() && time.Now().After(u.Expires) {
+		return nil, 0, errTusNotFound
+	}
+	if len(u.Path) > 0 {
+		return &u, u.Length, nil
+	}
+	fi, err := os.Stat(t.dataPath(id))
+	if err != nil {
+		return nil, 0, errTusNotFound
+	}
+	return &u, fi.Size(), nil
+}
+
+// remove deletes an upload's state and received data, if incomplete.
+func (t *TusUploads) remove(id string) error {
+	if _, err := os.Stat(t.infoPath(id)); err != nil {
+		return errTusNotFound
+	}
+	os.Remove(t.dataPath(id))
+	return os.Remove(t.infoPath(id))
+}
+
+// expire periodically deletes expired uploads, until stop is closed.
+func (t *TusUploads) expire(interval time.Duration, stop <-chan struct{}) {
+	if t.policy.Expiry <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			t.collect(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (t *TusUploads) collect(now time.Time) {
+	matches, _ := filepath.Glob(filepath.Join(t.dir, "*.json"))
+	for _, m := range matches {
+		id := strings.TrimSuffix(filepath.Base(m), ".json")
+		unlock := t.lock(id)
+		if unlock == nil { // removed meanwhile
+			continue
+		}
+		if b, err := ioutil.ReadFile(m); err == nil {
+			var u TusUpload
+			if json.Unmarshal(b, &u) == nil && !u.Expires.IsZero() && now.After(u.Expires) {
+				if err := t.remove(id); err == nil {
+					echo(Log{"t": "file_upload_resumable", "id": id, "status": "expired"})
+				}
+			}
+		}
+		unlock()
+	}
+}
+
+// parseTusMetadata parses the Upload-Metadata header: comma-separated keys and base64-encoded values.
+func parseTusMetadata(s string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		kv := strings.SplitN(pair, " ", 2)
+		if len(kv) == 1 {
+			meta[kv[0]] = ""
+			continue
+		}
+		v, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %s", kv[0])
+		}
+		meta[kv[0]] = string(v)
+	}
+	return meta, nil
+}
+
+func sniffFileType(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return sniffMediaType(f)
+}
+
+// guessMediaType returns the media type implied by a file's extension, if any.
+func guessMediaType(filename string) string {
+	return mediaType(mime.TypeByExtension(filepath.Ext(filename)))
+}
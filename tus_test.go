@@ -0,0 +1,155 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func tusRequest(method, target, body string, headers ...string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for i := 0; i < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	return r
+}
+
+func serveTus(fs http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	fs.ServeHTTP(w, r)
+	return w
+}
+
+func TestTusUpload(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	store := newDiskFileStore(dir)
+	fs := newFileServer(dir, store, newUploadIndex(store, UploadQuotas{}), nil, nil, nil, newCSRFGuard(nil), "/_f", UploadPolicy{ChunkSize: 8, Expiry: time.Hour}, false, newFileURLSigner(nil), nil)
+
+	w := serveTus(fs, tusRequest("OPTIONS", "/_f/", ""))
+	eq(w.Code, http.StatusNoContent)
+	eq(w.Header().Get("Tus-Extension"), tusExtensions)
+
+	name := base64.StdEncoding.EncodeToString([]byte("../data.csv"))
+	w = serveTus(fs, tusRequest("POST", "/_f/", "", "Upload-Length", "12", "Upload-Metadata", "filename "+name))
+	eq(w.Code, http.StatusCreated)
+	location := w.Header().Get("Location")
+	ok(strings.HasPrefix(location, "/_f/_tus/"))
+	ok(len(w.Header().Get("Upload-Expires")) > 0)
+
+	patch := func(offset, body string) *httptest.ResponseRecorder {
+		return serveTus(fs, tusRequest("PATCH", location, body, "Upload-Offset", offset, "Content-Type", tusChunkType))
+	}
+
+	eq(patch("0", "0123456789ab").Code, http.StatusRequestEntityTooLarge) // exceeds chunk size
+	w = patch("0", "0123")
+	eq(w.Code, http.StatusNoContent)
+	eq(w.Header().Get("Upload-Offset"), "4")
+	eq(patch("0", "0123").Code, http.StatusConflict)
+
+	w = serveTus(fs, tusRequest("HEAD", location, ""))
+	eq(w.Code, http.StatusOK)
+	eq(w.Header().Get("Upload-Offset"), "4")
+	eq(w.Header().Get("Upload-Length"), "12")
+
+	w = patch("4", "456789ab")
+	eq(w.Code, http.StatusNoContent)
+	eq(w.Header().Get("Upload-Offset"), "12")
+	p := w.Header().Get("Wave-File-Path")
+	ok(strings.HasPrefix(p, "/_f/") && strings.HasSuffix(p, "/data.csv"), p)
+	b, err := ioutil.ReadFile(filepath.Join(dir, strings.TrimPrefix(p, "/_f/")))
+	no(err)
+	eq(string(b), "0123456789ab")
+	eq(serveTus(fs, tusRequest("HEAD", location, "")).Header().Get("Wave-File-Path"), p)
+
+	eq(serveTus(fs, tusRequest("DELETE", location, "")).Code, http.StatusNoContent)
+	eq(serveTus(fs, tusRequest("HEAD", location, "")).Code, http.StatusNotFound)
+}
+
+func TestTusUploadPolicy(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	dir := t.TempDir()
+	store := newDiskFileStore(dir)
+	fs := newFileServer(dir, store, newUploadIndex(store, UploadQuotas{}), nil, nil, nil, newCSRFGuard(nil), "/_f", UploadPolicy{MaxFileSize: 10, DenyTypes: Strings{"application/pdf"}}, false, newFileURLSigner(nil), nil)
+
+	eq(serveTus(fs, tusRequest("POST", "/_f/", "", "Upload-Length", "11")).Code, http.StatusRequestEntityTooLarge)
+	eq(serveTus(fs, tusRequest("POST", "/_f/", "", "Upload-Length", "1", "Tus-Resumable", "0.2.2")).Code, http.StatusPreconditionFailed)
+
+	w := serveTus(fs, tusRequest("POST", "/_f/", "", "Upload-Length", "9"))
+	eq(w.Code, http.StatusCreated)
+	location := w.Header().Get("Location")
+	w = serveTus(fs, tusRequest("PATCH", location, "%PDF-1.4 ", "Upload-Offset", "0", "Content-Type", tusChunkType))
+	eq(w.Code, http.StatusUnsupportedMediaType) // sniffed on completion
+	eq(serveTus(fs, tusRequest("HEAD", location, "")).Code, http.StatusNotFound)
+}
+
+func TestTusExpiry(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	dir := t.TempDir()
+	store := newDiskFileStore(dir)
+	tus := newTusUploads(dir, store, newUploadIndex(store, UploadQuotas{}), "/_f", UploadPolicy{Expiry: time.Hour}, nil, nil, nil)
+	fs := newFileServer(dir, store, newUploadIndex(store, UploadQuotas{}), nil, nil, nil, newCSRFGuard(nil), "/_f", UploadPolicy{Expiry: time.Hour}, false, newFileURLSigner(nil), nil)
+
+	w := serveTus(fs, tusRequest("POST", "/_f/", "", "Upload-Length", "4"))
+	location := w.Header().Get("Location")
+	tus.collect(time.Now())
+	eq(serveTus(fs, tusRequest("HEAD", location, "")).Code, http.StatusOK)
+	tus.collect(time.Now().Add(2 * time.Hour))
+	eq(serveTus(fs, tusRequest("HEAD", location, "")).Code, http.StatusNotFound)
+}
+
+func TestTusLocks(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	dir := t.TempDir()
+	store := newDiskFileStore(dir)
+	fs := newFileServer(dir, store, newUploadIndex(store, UploadQuotas{}), nil, nil, nil, newCSRFGuard(nil), "/_f", UploadPolicy{}, false, newFileURLSigner(nil), nil)
+	tus := fs.tus
+
+	eq(serveTus(fs, tusRequest("HEAD", "/_f/_tus/"+uuid.New().String(), "")).Code, http.StatusNotFound)
+	eq(len(tus.locks), 0) // none for unknown uploads
+
+	w := serveTus(fs, tusRequest("POST", "/_f/", "", "Upload-Length", "4"))
+	location := w.Header().Get("Location")
+	id := strings.TrimPrefix(location, "/_f/_tus/")
+
+	unlock := tus.lock(id)
+	ok(unlock != nil, "lock for known upload")
+	done := make(chan int)
+	go func() { done <- serveTus(fs, tusRequest("DELETE", location, "")).Code }()
+	for {
+		tus.locksMu.Lock()
+		refs := tus.locks[id].refs
+		tus.locksMu.Unlock()
+		if refs == 2 { // waiting for the lock
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	unlock()
+	eq(<-done, http.StatusNoContent)
+	eq(len(tus.locks), 0) // dropped once released
+	ok(tus.lock(id) == nil, "no lock for removed upload")
+}
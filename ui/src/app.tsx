@@ -13,18 +13,18 @@
 // limitations under the License.
 
 import * as Fluent from '@fluentui/react'
-import { box, WaveErrorCode, WaveEventType } from 'h2o-wave'
+import { box, on, WaveErrorCode, WaveEventType } from 'h2o-wave'
 import React from 'react'
 import { stylesheet } from 'typestyle'
 import Dialog from './dialog'
 import { LayoutPicker } from './editor'
 import { Logo } from './logo'
-import { NotificationBar } from './notification_bar'
+import { NotificationBar, notificationBarB } from './notification_bar'
 import { PageLayout } from './page'
 import { Lightbox, lightboxB } from './parts/lightbox'
 import SidePanel from './side_panel'
 import { clas, cssVar, pc } from './theme'
-import { bond, busyB, config, contentB, listen, wave } from './ui'
+import { bond, busyB, config, contentB, listen, noticeB, wave } from './ui'
 
 const
   css = stylesheet({
@@ -117,6 +117,8 @@ const
         wave.push()
       },
       init = () => {
+        // Server notices, e.g. of maintenance, stay up until dismissed or taken down, unless timed.
+        on(noticeB, n => notificationBarB(n && { text: n.text, type: n.type as NotificationBar['type'], timeout: n.timeout || -1, position: 'top-center' }))
         listen(wave.socketURL)
         window.addEventListener('hashchange', onHashChanged)
         window.addEventListener('md-link-click', onMdLinkClick)
@@ -145,7 +147,13 @@ const
             case WaveEventType.Error:
               {
                 // TODO better sadface
-                const message = e.code === WaveErrorCode.PageNotFound ? <NotFoundOverlay /> : 'Unknown Remote Error'
+                const message = e.code === WaveErrorCode.PageNotFound
+                  ? <NotFoundOverlay />
+                  : e.code === WaveErrorCode.UnsupportedProtocol
+                    ? 'This page and the server are out of sync. Reload to continue.'
+                    : e.code === WaveErrorCode.TooManyConnections
+                      ? 'Too many open connections. Close some tabs and reload to continue.'
+                      : 'Unknown Remote Error'
                 return <div className={clas(css.centerFullHeight, css.app)}>{message}</div>
               }
             case WaveEventType.Exception:
@@ -16,7 +16,7 @@ import { createEvent, fireEvent, render, waitFor } from '@testing-library/react'
 import * as T from 'h2o-wave'
 import React from 'react'
 import { FileUpload, XFileUpload } from './file_upload'
-import { wave } from './ui'
+import { config, wave } from './ui'
 
 const name = 'fileUpload'
 const fileUploadProps: FileUpload = { name }
@@ -34,6 +34,7 @@ describe('FileUpload.tsx', () => {
       open: jest.fn(),
       send: jest.fn(),
       setRequestHeader: jest.fn(),
+      addEventListener: jest.fn(),
       status,
       upload: jest.fn(),
       responseText: data ? JSON.stringify(data) : null,
@@ -42,6 +43,7 @@ describe('FileUpload.tsx', () => {
     window.XMLHttpRequest = jest.fn(() => xhrMockObj)
     // @ts-ignore
     setTimeout(() => { xhrMockObj['onreadystatechange']() }, 0)
+    return xhrMockObj
   }
 
   it('Renders data-test attr', () => {
@@ -100,6 +102,21 @@ describe('FileUpload.tsx', () => {
     await waitFor(() => expect(getByText('There was an error when uploading file.')).toBeInTheDocument(), { timeout: 1000 })
   })
 
+  it('Asks the server for upload progress, if connected with a client ID', async () => {
+    config.clientID = 'client-1'
+    const xhr = mockXhrRequest({ files: [{ name: 'file.txt' }] })
+
+    const { getByTestId, getByText } = render(<XFileUpload model={{ ...fileUploadProps, label: 'upload' }} />)
+    fireEvent.change(getByTestId(name), createChangeEvent([{ name: 'file.txt' }]))
+    fireEvent.click(getByText('upload'))
+
+    await waitFor(() => expect(getByText('Successfully uploaded files: file.txt.')).toBeInTheDocument(), { timeout: 1000 })
+    expect(xhr.setRequestHeader).toHaveBeenCalledWith('Wave-Client-ID', 'client-1')
+    expect(xhr.setRequestHeader).toHaveBeenCalledWith('Wave-Upload-ID', expect.any(String))
+    expect(xhr.addEventListener).toHaveBeenCalledWith('loadend', expect.any(Function))
+    config.clientID = ''
+  })
+
   describe('OS file browser', () => {
     it('Shows Chosen File after upload - single file', () => {
       const { getByTestId, queryByText } = render(<XFileUpload model={fileUploadProps} />)
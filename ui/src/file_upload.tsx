@@ -13,11 +13,11 @@
 // limitations under the License.
 
 import * as Fluent from '@fluentui/react'
-import { B, F, Id, S, U, xid } from 'h2o-wave'
+import { B, F, Id, on, S, U, xid } from 'h2o-wave'
 import React from 'react'
 import { stylesheet } from 'typestyle'
 import { centerMixin, clas, cssVar, dashed, padding } from './theme'
-import { wave } from './ui'
+import { config, progressB, wave } from './ui'
 
 /**
  * Create a file upload component.
@@ -143,7 +143,17 @@ export const
               setPercentComplete(0)
             }
             xhr.open("POST", wave.uploadURL)
-            xhr.upload.onprogress = e => setPercentComplete(e.loaded / e.total)
+            if (config.clientID) { // the server reports how much it has received, over the socket
+              const uploadID = xid()
+              xhr.setRequestHeader('Wave-Client-ID', config.clientID)
+              xhr.setRequestHeader('Wave-Upload-ID', uploadID)
+              const progress = on(progressB, p => {
+                if (p?.id === uploadID && p.total) setPercentComplete(p.received / p.total)
+              })
+              xhr.addEventListener('loadend', () => progress.dispose())
+            } else {
+              xhr.upload.onprogress = e => setPercentComplete(e.loaded / e.total)
+            }
             xhr.send(formData)
             xhr.onreadystatechange = () => {
               if (xhr.readyState !== XMLHttpRequest.DONE) return
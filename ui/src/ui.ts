@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-import { B, box, boxed, ChangeSet, connect, Dict, Disposable, on, Rec, S, U, Wave, WaveEvent, WaveEventType } from 'h2o-wave'
+import { B, box, boxed, ChangeSet, connect, Dict, Disposable, on, Rec, S, U, Wave, WaveErrorCode, WaveEvent, WaveEventType } from 'h2o-wave'
 import * as React from 'react'
 
 //
@@ -73,7 +73,7 @@ const
     for (const k in a) delete a[k]
   },
   baseURL = document.getElementsByTagName('body')[0].getAttribute('data-base-url') ?? '/',
-  socketURL = baseURL + '_s/',
+  socketURL = baseURL + '_s/?caps=deltas,progress',
   uploadURL = baseURL + '_f/',
   initURL = baseURL + '_auth/init',
   loginURL = baseURL + '_auth/login'
@@ -82,9 +82,12 @@ export const
   contentB = box<WaveEvent | null>(null),
   argsB = box<any>({}),
   busyB = box<B>(false),
+  noticeB = box<{ text: S, type?: S, timeout?: U } | null>(null),
+  progressB = box<{ id: S, received: U, total: U } | null>(null),
   config = {
     username: '',
     editable: false,
+    clientID: '', // for upload progress
   },
   jump = (key: any, value: any) => {
     if (value.startsWith('#')) {
@@ -114,11 +117,24 @@ export const
       window.setTimeout(() => { wait = false }, timeout)
     }
   },
+  isMessageError = (code: WaveErrorCode) => code === WaveErrorCode.BadMessageType
+    || code === WaveErrorCode.MessageTooLarge
+    || code === WaveErrorCode.MalformedMessage
+    || code === WaveErrorCode.AppTimeout
+    || code === WaveErrorCode.AppUnavailable
+    || code === WaveErrorCode.QuotaExceeded
+    || code === WaveErrorCode.EditNotRecorded,
   listen = (address: S) => {
     _wave = connect(address, e => {
       switch (e.t) {
-        case WaveEventType.Page:
         case WaveEventType.Error:
+          if (isMessageError(e.code)) { // a message was rejected or went unanswered; the page is still valid
+            console.error('message not handled by server', e.code)
+            break
+          }
+          contentB(e)
+          break
+        case WaveEventType.Page:
         case WaveEventType.Exception:
         case WaveEventType.Disconnect:
           contentB(e)
@@ -132,10 +148,17 @@ export const
         case WaveEventType.Config:
           config.username = e.username
           config.editable = e.editable
+          if (e.clientID) config.clientID = e.clientID
           break
         case WaveEventType.Data:
           busyB(false)
           break
+        case WaveEventType.Notice:
+          noticeB(e.text ? { text: e.text, type: e.type, timeout: e.timeout } : null)
+          break
+        case WaveEventType.Progress:
+          progressB({ id: e.id, received: e.received, total: e.total })
+          break
       }
     })
   },
@@ -0,0 +1,248 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UploadPolicy represents the limits on files uploaded to the server.
+//
+// A file is accepted if its type, as declared by the browser, or failing that, as guessed from its extension,
+// matches an allowed type (if any), and so does its type as sniffed from its first 512 bytes, unless too generic to
+// tell (plain text or binary), and none of its declared, guessed or sniffed types matches a denied type.
+// Types are matched exactly ("application/pdf"), or by prefix ("image/*").
+//
+// If a scanner is set, accepted files are scanned before they are stored, and rejected if a threat is found.
+type UploadPolicy struct {
+	MaxSize     int64         // maximum size of an upload request; 0 for no limit
+	MaxFileSize int64         // maximum size of each uploaded file; 0 for no limit
+	AllowTypes  Strings       // types allowed; all if empty
+	DenyTypes   Strings       // types denied
+	ChunkSize   int64         // maximum size of each part of a resumable upload; 0 for no limit
+	Expiry      time.Duration // time after which incomplete resumable uploads are deleted; 0 for never
+	Scanner     UploadScanner // content scanner; nil for none
+	Quarantine  bool          // keep rejected infected files for inspection?
+	ImageSizes  []ImageSize   // sizes of downscaled variants generated for uploaded images
+}
+
+const (
+	uploadTooLarge      = "upload_too_large"
+	uploadFileTooLarge  = "file_too_large"
+	uploadChunkTooLarge = "chunk_too_large"
+	uploadTypeDenied    = "file_type_denied"
+	uploadInfected      = "file_infected"
+	uploadScanFailed    = "scan_failed"
+	uploadQuotaExceeded = "quota_exceeded"
+)
+
+// UploadError indicates that an upload was rejected by the upload policy.
+type UploadError struct {
+	Code   string `json:"code"`
+	File   string `json:"file,omitempty"`   // offending file, if any
+	Type   string `json:"type,omitempty"`   // offending type, for denied types
+	Limit  int64  `json:"limit,omitempty"`  // size limit, for files too large and quotas exceeded
+	Threat string `json:"threat,omitempty"` // threat found, for infected files
+}
+
+func (e *UploadError) Error() string {
+	switch e.Code {
+	case uploadTooLarge:
+		return fmt.Sprintf("upload too large: want <= %d bytes", e.Limit)
+	case uploadFileTooLarge:
+		return fmt.Sprintf("file %s too large: want <= %d bytes", e.File, e.Limit)
+	case uploadChunkTooLarge:
+		return fmt.Sprintf("part of file %s too large: want <= %d bytes", e.File, e.Limit)
+	case uploadInfected:
+		return fmt.Sprintf("file %s infected: %s", e.File, e.Threat)
+	case uploadScanFailed:
+		return fmt.Sprintf("file %s could not be scanned", e.File)
+	case uploadQuotaExceeded:
+		return fmt.Sprintf("upload quota exceeded: want <= %d bytes", e.Limit)
+	}
+	return fmt.Sprintf("file %s type %s not allowed", e.File, e.Type)
+}
+
+// UploadErrorD represents the error response for a rejected upload.
+type UploadErrorD struct {
+	Error  string       `json:"error"`
+	Upload *UploadError `json:"upload"`
+}
+
+func writeUploadError(w http.ResponseWriter, err *UploadError) {
+	status := http.StatusRequestEntityTooLarge
+	switch err.Code {
+	case uploadTypeDenied:
+		status = http.StatusUnsupportedMediaType
+	case uploadInfected:
+		status = http.StatusUnprocessableEntity
+	case uploadScanFailed:
+		status = http.StatusServiceUnavailable
+	case uploadQuotaExceeded:
+		status = http.StatusInsufficientStorage
+	}
+	b, _ := json.Marshal(UploadErrorD{Error: err.Code, Upload: err})
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// limit limits the request body to the maximum upload size, returning a function that reports if the limit was
+// exceeded while reading the body.
+func (p UploadPolicy) limit(r *http.Request) func() bool {
+	if p.MaxSize <= 0 {
+		return func() bool { return false }
+	}
+	body := &uploadBody{r.Body, p.MaxSize, false}
+	r.Body = body
+	return func() bool { return body.exceeded }
+}
+
+// uploadBody represents a request body that fails once more than n bytes are read.
+type uploadBody struct {
+	io.ReadCloser
+	n        int64
+	exceeded bool
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	if b.n < 0 {
+		b.exceeded = true
+		return 0, errUploadTooLarge
+	}
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n -= int64(n)
+	if b.n < 0 {
+		b.exceeded = true
+		return n, errUploadTooLarge
+	}
+	return n, err
+}
+
+var errUploadTooLarge = errors.New("upload too large")
+
+// check checks uploaded files against the policy.
+func (p UploadPolicy) check(files []*multipart.FileHeader) error {
+	for _, file := range files {
+		if p.MaxFileSize > 0 && file.Size > p.MaxFileSize {
+			return &UploadError{Code: uploadFileTooLarge, File: file.Filename, Limit: p.MaxFileSize}
+		}
+		var sniffed string
+		if p.sniffs() {
+			f, err := file.Open()
+			if err != nil {
+				return fmt.Errorf("failed opening uploaded file: %v", err)
+			}
+			sniffed, err = sniffMediaType(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		if err := p.checkType(file.Filename, file.Header.Get("Content-Type"), sniffed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkType checks the type of a file against the policy, given its declared and sniffed types, if known.
+func (p UploadPolicy) checkType(filename, declared, sniffed string) *UploadError {
+	declared = mediaType(declared)
+	guessed := guessMediaType(filename)
+	if len(p.AllowTypes) > 0 {
+		t := declared
+		if len(t) == 0 || t == "application/octet-stream" {
+			t = guessed
+		}
+		if !matchMediaType(p.AllowTypes, t) {
+			if len(t) == 0 {
+				t = "unknown"
+			}
+			return &UploadError{Code: uploadTypeDenied, File: filename, Type: t}
+		}
+		if !isGenericMediaType(sniffed) && !matchMediaType(p.AllowTypes, sniffed) { // e.g. HTML declared as an image
+			return &UploadError{Code: uploadTypeDenied, File: filename, Type: sniffed}
+		}
+	}
+	for _, t := range []string{declared, guessed, sniffed} {
+		if len(t) > 0 && matchMediaType(p.DenyTypes, t) {
+			return &UploadError{Code: uploadTypeDenied, File: filename, Type: t}
+		}
+	}
+	return nil
+}
+
+// sniffs returns true if files must be sniffed to check their types.
+func (p UploadPolicy) sniffs() bool {
+	return len(p.AllowTypes) > 0 || len(p.DenyTypes) > 0
+}
+
+// isGenericMediaType returns true if a sniffed media type says nothing about a file's type, beyond it being text
+// or binary.
+func isGenericMediaType(t string) bool {
+	return len(t) == 0 || t == "text/plain" || t == "application/octet-stream"
+}
+
+// maxFileSize returns the maximum size of a file uploaded in parts; 0 for no limit.
+func (p UploadPolicy) maxFileSize() int64 {
+	if p.MaxFileSize > 0 && (p.MaxSize <= 0 || p.MaxFileSize < p.MaxSize) {
+		return p.MaxFileSize
+	}
+	return p.MaxSize
+}
+
+// mediaType returns the media type in a Content-Type header value, without parameters, or "" if invalid.
+func mediaType(contentType string) string {
+	if len(contentType) == 0 {
+		return ""
+	}
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return t
+}
+
+// sniffMediaType returns the media type detected from the first bytes read from r.
+func sniffMediaType(r io.Reader) (string, error) {
+	b := make([]byte, 512)
+	n, err := io.ReadFull(r, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("failed reading uploaded file: %v", err)
+	}
+	return mediaType(http.DetectContentType(b[:n])), nil
+}
+
+func matchMediaType(patterns []string, t string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "*/*" || p == t || (strings.HasSuffix(p, "/*") && strings.HasPrefix(t, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
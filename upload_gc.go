@@ -0,0 +1,330 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const uploadGCInterval = 5 * time.Minute
+
+// UploadQuotas represents the storage allowed for files uploaded by each user or app, in bytes; 0 for no limit.
+type UploadQuotas struct {
+	User int64 // per user, for uploads from the browser
+	App  int64 // per API access key, for uploads from apps
+}
+
+// UploadGCPolicy determines when uploaded files are deleted.
+// A file is orphaned if no page refers to it, i.e. no page on the site (or, if pages are stored, in the page store)
+// contains its path, and no patch sent by an app (including patches to unicast pages, which are not stored) has
+// contained its path for a while.
+type UploadGCPolicy struct {
+	IdleTimeout time.Duration // delete files orphaned for this long; 0 disables
+	DryRun      bool          // log files that would be deleted, but keep them?
+}
+
+// UploadStats represents the uploaded files tracked, and cumulative garbage collection statistics.
+type UploadStats struct {
+	Dirs         int    `json:"dirs"`          // upload directories
+	Bytes        int64  `json:"bytes"`         // bytes uploaded, excluding uploads made before tracking began
+	Runs         uint64 `json:"runs"`          // garbage collection runs
+	Deletions    uint64 `json:"deletions"`     // directories deleted (or, if dry run, that would have been deleted)
+	DeletedBytes uint64 `json:"deleted_bytes"` // bytes deleted (or, if dry run, that would have been deleted)
+	DryRun       bool   `json:"dry_run"`
+}
+
+// uploadDir represents a directory of uploaded files.
+type uploadDir struct {
+	uploader   string    // see FileAccess; empty if unknown
+	size       int64     // bytes; 0 if unknown
+	referenced time.Time // last time a page referred to the directory, or when it was created or found
+}
+
+// UploadIndex tracks uploaded files: who uploaded them, their sizes, and when pages last referred to them,
+// to enforce storage quotas and delete orphaned files.
+type UploadIndex struct {
+	sync.Mutex
+	store  FileStore
+	access *FileAccessList
+	quotas UploadQuotas
+	dirs   map[string]*uploadDir // dir => info
+	usage  map[string]int64      // uploader => bytes
+	stats  UploadStats
+}
+
+func newUploadIndex(store FileStore, quotas UploadQuotas) *UploadIndex {
+	return &UploadIndex{
+		store:  store,
+		access: newFileAccessList(store),
+		quotas: quotas,
+		dirs:   make(map[string]*uploadDir),
+		usage:  make(map[string]int64),
+	}
+}
+
+// load indexes the files in the store. Files uploaded before tracking began have no known uploader or size.
+// Reloading picks up files uploaded and deleted by other replicas sharing the store, keeping the time known
+// directories were last referenced.
+func (x *UploadIndex) load() error {
+	recorded, err := x.store.list(fileAccessDir)
+	if err != nil {
+		return err
+	}
+	dirs, err := x.store.list("")
+	if err != nil {
+		return err
+	}
+	records := make(map[string]*FileAccess, len(recorded))
+	for _, dir := range recorded {
+		if a, err := x.access.get(dir); err == nil && a != nil {
+			records[dir] = a
+		}
+	}
+	x.Lock()
+	defer x.Unlock()
+	now := time.Now()
+	found := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		if strings.HasPrefix(dir, "_") {
+			continue
+		}
+		found[dir] = true
+		referenced := now
+		if d, ok := x.dirs[dir]; ok {
+			referenced = d.referenced
+		}
+		if a, ok := records[dir]; ok {
+			x.add(dir, a.Uploader, a.Size, referenced)
+		} else if _, ok := x.dirs[dir]; !ok {
+			x.dirs[dir] = &uploadDir{referenced: referenced}
+		}
+	}
+	for dir := range x.dirs {
+		if !found[dir] {
+			x.drop(dir)
+		}
+	}
+	return nil
+}
+
+// add records a directory; must be called with the lock held.
+func (x *UploadIndex) add(dir, uploader string, size int64, referenced time.Time) {
+	x.drop(dir)
+	x.dirs[dir] = &uploadDir{uploader, size, referenced}
+	x.usage[uploader] += size
+}
+
+// drop forgets a directory; must be called with the lock held.
+func (x *UploadIndex) drop(dir string) {
+	if d, ok := x.dirs[dir]; ok {
+		x.usage[d.uploader] -= d.size
+		if x.usage[d.uploader] <= 0 {
+			delete(x.usage, d.uploader)
+		}
+		delete(x.dirs, dir)
+	}
+}
+
+// put records the uploader, access and size of a new directory of uploaded files, charging its size to the
+// uploader's quota. The check and the charge are atomic, so concurrent uploads cannot together exceed the quota;
+// if the quota would be exceeded, nothing is recorded, and the caller must remove the directory.
+func (x *UploadIndex) put(dir string, a *FileAccess, size int64) error {
+	if a == nil {
+		a = &FileAccess{}
+	}
+	record := *a
+	record.Size, record.Time = size, time.Now().UTC()
+
+	x.Lock()
+	if quota := x.quota(record.Uploader); quota > 0 && x.usage[record.Uploader]+size > quota {
+		x.Unlock()
+		return &UploadError{Code: uploadQuotaExceeded, Limit: quota}
+	}
+	x.add(dir, record.Uploader, size, record.Time)
+	x.Unlock()
+
+	if err := x.access.put(dir, &record); err != nil {
+		x.Lock()
+		x.drop(dir)
+		x.Unlock()
+		return err
+	}
+	return nil
+}
+
+// remove deletes a directory of uploaded files.
+func (x *UploadIndex) remove(dir string) error {
+	if err := x.store.remove(dir); err != nil {
+		return err
+	}
+	x.Lock()
+	x.drop(dir)
+	x.Unlock()
+	if err := x.store.remove(path.Join(imageVariantDir, dir)); err != nil {
+		return err
+	}
+	return x.access.remove(dir)
+}
+
+// discard removes a directory of uploaded files that could not be recorded.
+func (x *UploadIndex) discard(dir string) {
+	if err := x.remove(dir); err != nil {
+		echoError(Log{"t": "file_upload", "dir": dir, "error": err.Error()})
+	}
+}
+
+// quota returns the uploader's quota; 0 for no limit.
+func (x *UploadIndex) quota(uploader string) int64 {
+	if len(uploader) == 0 {
+		return 0
+	}
+	if strings.HasPrefix(uploader, appUploaderPrefix) {
+		return x.quotas.App
+	}
+	return x.quotas.User
+}
+
+// allow checks if the uploader may store size more bytes, to reject uploads early, before they are stored.
+// The quota is enforced when the upload is recorded; see put.
+func (x *UploadIndex) allow(a *FileAccess, size int64) *UploadError {
+	if a == nil {
+		return nil
+	}
+	quota := x.quota(a.Uploader)
+	if quota <= 0 {
+		return nil
+	}
+	x.Lock()
+	used := x.usage[a.Uploader]
+	x.Unlock()
+	if used+size > quota {
+		return &UploadError{Code: uploadQuotaExceeded, Limit: quota}
+	}
+	return nil
+}
+
+var fileRefPattern = regexp.MustCompile(`_f/([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})`)
+
+// reference marks the upload directories referred to in page data as referenced.
+func (x *UploadIndex) reference(data []byte, now time.Time) {
+	if x == nil || !bytes.Contains(data, []byte("_f/")) {
+		return
+	}
+	matches := fileRefPattern.FindAllSubmatch(data, -1)
+	if len(matches) == 0 {
+		return
+	}
+	x.Lock()
+	defer x.Unlock()
+	for _, m := range matches {
+		if d, ok := x.dirs[string(m[1])]; ok {
+			d.referenced = now
+		}
+	}
+}
+
+// collect deletes directories of uploaded files orphaned as per policy, and returns them.
+// If pages are stored, pages in the store are checked too: pages evicted from memory, pages not preloaded, and
+// pages from other replicas. If the store cannot be read, nothing is deleted.
+func (x *UploadIndex) collect(policy UploadGCPolicy, site *Site, store PageStore, now time.Time) []string {
+	if store != nil {
+		stored, err := store.load()
+		if err != nil {
+			echoError(Log{"t": "upload_gc", "error": "failed loading pages from page store: " + err.Error()})
+			return nil
+		}
+		for _, data := range stored {
+			x.reference(data, now)
+		}
+	}
+	site.pages.each(func(url string, page *Page) {
+		x.reference(page.marshal(), now)
+	})
+
+	idleSince := now.Add(-policy.IdleTimeout)
+	var orphans []string
+	var size uint64
+	x.Lock()
+	for dir, d := range x.dirs {
+		if d.referenced.Before(idleSince) {
+			orphans = append(orphans, dir)
+			size += uint64(d.size)
+		}
+	}
+	x.stats.Runs++
+	x.stats.Deletions += uint64(len(orphans))
+	x.stats.DeletedBytes += size
+	x.stats.DryRun = policy.DryRun
+	x.Unlock()
+
+	if policy.DryRun {
+		return orphans
+	}
+	var deleted []string
+	for _, dir := range orphans {
+		if err := x.remove(dir); err != nil {
+			echoError(Log{"t": "upload_gc", "dir": dir, "error": err.Error()})
+			continue
+		}
+		deleted = append(deleted, dir)
+	}
+	return deleted
+}
+
+// run loads the index, and periodically deletes orphaned files as per policy, if enabled.
+// If quotas are set, the index is periodically reloaded, to count files uploaded via other replicas sharing the
+// file store; quotas are otherwise enforced per replica.
+func (x *UploadIndex) run(policy UploadGCPolicy, site *Site, store PageStore, interval time.Duration) {
+	if err := x.load(); err != nil {
+		echoError(Log{"t": "upload_index", "error": err.Error()})
+	}
+	if policy.IdleTimeout <= 0 && x.quotas.User <= 0 && x.quotas.App <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if err := x.load(); err != nil {
+			echoError(Log{"t": "upload_index", "error": err.Error()})
+		}
+		if policy.IdleTimeout <= 0 {
+			continue
+		}
+		for _, dir := range x.collect(policy, site, store, now) {
+			if policy.DryRun {
+				echo(Log{"t": "upload_gc", "dir": dir, "dry_run": "true"})
+				continue
+			}
+			echo(Log{"t": "upload_gc", "dir": dir})
+		}
+	}
+}
+
+// snapshot returns a snapshot of upload statistics.
+func (x *UploadIndex) snapshot() UploadStats {
+	x.Lock()
+	defer x.Unlock()
+	stats := x.stats
+	stats.Dirs = len(x.dirs)
+	for _, n := range x.usage {
+		stats.Bytes += n
+	}
+	return stats
+}
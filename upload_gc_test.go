@@ -0,0 +1,125 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestUploadIndex(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	store := newDiskFileStore(dir)
+	x := newUploadIndex(store, UploadQuotas{User: 12, App: 100})
+
+	used, unused := uuid.New().String(), uuid.New().String()
+	for _, d := range []string{used, unused} {
+		no(store.write(d+"/a.txt", bytes.NewReader([]byte("hello!")), 6, "text/plain"))
+		no(x.put(d, &FileAccess{Uploader: "alice"}, 6))
+	}
+
+	err := x.allow(&FileAccess{Uploader: "alice"}, 1)
+	ok(err != nil)
+	eq(err.Code, uploadQuotaExceeded)
+	eq(err.Limit, int64(12))
+	ok(x.allow(&FileAccess{Uploader: "bob"}, 10) == nil)
+	ok(x.allow(&FileAccess{Uploader: "app:key"}, 100) == nil)
+	ok(x.allow(&FileAccess{Uploader: "app:key"}, 101) != nil)
+	ok(x.allow(&FileAccess{}, 1000) == nil)
+
+	w := httptest.NewRecorder()
+	writeUploadError(w, err)
+	eq(w.Code, http.StatusInsufficientStorage)
+
+	site := newSite()
+	_, perr := site.update("/demo", []byte(`{"d":[{"k":"a","d":{"view":"markdown","content":"![a](/_f/`+used+`/a.txt)"}}]}`), false, "")
+	no(perr)
+
+	later := time.Now().Add(time.Hour)
+	policy := UploadGCPolicy{IdleTimeout: 30 * time.Minute, DryRun: true}
+	eq(x.collect(policy, site, nil, later), []string{unused})
+	_, rerr := store.read(unused + "/a.txt")
+	no(rerr)
+
+	policy.DryRun = false
+	eq(x.collect(policy, site, nil, later), []string{unused})
+	_, rerr = store.read(unused + "/a.txt")
+	eq(rerr, errFileNotFound)
+	a, aerr := x.access.get(unused)
+	no(aerr)
+	ok(a == nil)
+
+	stats := x.snapshot()
+	eq(stats.Dirs, 1)
+	eq(stats.Bytes, int64(6))
+	eq(stats.Runs, uint64(2))
+	eq(stats.Deletions, uint64(2))
+	eq(stats.DeletedBytes, uint64(12))
+
+	// Unicast pages are not stored, so are referenced as they are patched.
+	x.reference([]byte(`{"d":[{"k":"a content","v":"/_f/`+used+`/a.txt"}]}`), later.Add(time.Hour))
+	eq(len(x.collect(policy, newSite(), nil, later.Add(time.Hour))), 0)
+
+	reloaded := newUploadIndex(store, UploadQuotas{User: 10})
+	no(reloaded.load())
+	eq(reloaded.snapshot().Dirs, 1)
+	ok(reloaded.allow(&FileAccess{Uploader: "alice"}, 5) != nil)
+}
+
+func TestUploadIndexSharedStores(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	dir := t.TempDir()
+	store := newDiskFileStore(dir)
+	x := newUploadIndex(store, UploadQuotas{User: 10})
+
+	// Quotas are charged as uploads are recorded.
+	stored, other := uuid.New().String(), uuid.New().String()
+	no(store.write(stored+"/a.txt", bytes.NewReader([]byte("hello!")), 6, "text/plain"))
+	no(x.put(stored, &FileAccess{Uploader: "alice"}, 6))
+	ok(x.allow(&FileAccess{Uploader: "alice"}, 4) == nil)
+	err := x.put(other, &FileAccess{Uploader: "alice"}, 6)
+	ok(err != nil)
+	eq(err.(*UploadError).Code, uploadQuotaExceeded)
+	eq(x.snapshot().Bytes, int64(6))
+
+	// Uploads recorded by other replicas are counted on reload.
+	replica := newUploadIndex(store, UploadQuotas{User: 10})
+	no(replica.load())
+	no(store.write(other+"/b.txt", bytes.NewReader([]byte("bye")), 3, "text/plain"))
+	no(replica.put(other, &FileAccess{Uploader: "alice"}, 3))
+	no(x.load())
+	eq(x.snapshot().Dirs, 2)
+	ok(x.allow(&FileAccess{Uploader: "alice"}, 2) != nil)
+
+	// Pages in the page store (evicted, not preloaded, or from other replicas) refer to files.
+	pages := &memPageStore{map[string][]byte{"/other": []byte(`{"c":{"a":{"content":"/_f/` + stored + `/a.txt"}}}`)}}
+	later := time.Now().Add(time.Hour)
+	policy := UploadGCPolicy{IdleTimeout: 30 * time.Minute}
+	eq(x.collect(policy, newSite(), pages, later), []string{other})
+	_, rerr := store.read(stored + "/a.txt")
+	no(rerr)
+
+	// Deletions by other replicas are picked up on reload.
+	no(replica.load())
+	eq(replica.snapshot().Dirs, 1)
+	eq(replica.snapshot().Bytes, int64(6))
+}
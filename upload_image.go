@@ -0,0 +1,239 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// imageVariantDir is the file store directory holding downscaled variants of uploaded images.
+	imageVariantDir = "_sizes"
+
+	// maxImagePixels is the size of the largest image downscaled, to guard against decompression bombs.
+	// Downscaling takes about 8 bytes per pixel: the decoded image, and its RGBA copy.
+	maxImagePixels = 16 * 1024 * 1024
+
+	// maxImageDerivations is the number of images downscaled at once, to bound memory and CPU use.
+	maxImageDerivations = 2
+
+	imageVariantQuality = 85 // JPEG quality
+)
+
+// ImageSize represents the bounding box of a downscaled variant of uploaded images.
+type ImageSize struct {
+	Name   string // as requested in the "size" query parameter, e.g. "256" or "640x480"
+	Width  int
+	Height int
+}
+
+// parseImageSize parses an image size of the form "256" (256x256) or "640x480".
+func parseImageSize(s string) (ImageSize, error) {
+	w, h := s, s
+	if i := strings.IndexByte(s, 'x'); i >= 0 {
+		w, h = s[:i], s[i+1:]
+	}
+	width, err := strconv.Atoi(w)
+	if err != nil || width <= 0 {
+		return ImageSize{}, fmt.Errorf("invalid image size %q: want WIDTH or WIDTHxHEIGHT", s)
+	}
+	height, err := strconv.Atoi(h)
+	if err != nil || height <= 0 {
+		return ImageSize{}, fmt.Errorf("invalid image size %q: want WIDTH or WIDTHxHEIGHT", s)
+	}
+	return ImageSize{s, width, height}, nil
+}
+
+// ImageVariants generates downscaled variants of uploaded JPEG and PNG images, e.g. thumbnails.
+// Variants preserve the image's aspect ratio, and are served by adding the "size" query parameter to the
+// file's path, e.g. /_f/<id>/photo.jpg?size=256. Images already within a size are served as-is.
+//
+// Variants are generated in the background, after the upload completes; until then, the image itself is served.
+type ImageVariants struct {
+	store   FileStore
+	sizes   []ImageSize
+	slots   chan struct{}  // one per image being downscaled
+	pending sync.WaitGroup // images yet to be downscaled
+}
+
+func newImageVariants(store FileStore, sizes []ImageSize) *ImageVariants {
+	if len(sizes) == 0 {
+		return nil
+	}
+	return &ImageVariants{store: store, sizes: sizes, slots: make(chan struct{}, maxImageDerivations)}
+}
+
+func imageVariantKey(key, size string) string {
+	dir, name := path.Split(key)
+	return path.Join(imageVariantDir, dir, size, name)
+}
+
+// isImage returns true if variants are generated for the file at key.
+func isImage(key string) bool {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
+
+// variant returns the key of the variant of the file at key, if size is one of the sizes generated.
+// The key of the file itself is returned if it is not an image, needs no downscaling, or is yet to be downscaled.
+func (v *ImageVariants) variant(key, size string) (string, bool) {
+	if v == nil {
+		return "", false
+	}
+	for _, s := range v.sizes {
+		if s.Name == size {
+			if !isImage(key) {
+				return key, true
+			}
+			variant := imageVariantKey(key, size)
+			if ok, err := v.store.exists(variant); err != nil || !ok {
+				return key, true
+			}
+			return variant, true
+		}
+	}
+	return "", false
+}
+
+// derive generates variants of the image at key, if it is an image.
+func (v *ImageVariants) derive(key string) error {
+	if v == nil || !isImage(key) {
+		return nil
+	}
+	b, err := v.store.read(key)
+	if err != nil {
+		return err
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil // not an image after all
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return fmt.Errorf("image %s too large to downscale: %dx%d", key, config.Width, config.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed decoding image %s: %v", key, err)
+	}
+	for _, s := range v.sizes {
+		w, h, ok := fitImage(config.Width, config.Height, s)
+		if !ok {
+			continue
+		}
+		var buf bytes.Buffer
+		dst := downscale(src, w, h)
+		if format == "jpeg" {
+			err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: imageVariantQuality})
+		} else {
+			err = png.Encode(&buf, dst)
+		}
+		if err != nil {
+			return fmt.Errorf("failed encoding image %s: %v", key, err)
+		}
+		variant := imageVariantKey(key, s.Name)
+		if err := v.store.write(variant, &buf, int64(buf.Len()), contentTypeOf(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deriveAll generates variants of the images at keys in the background, logging failures.
+func (v *ImageVariants) deriveAll(keys []string) {
+	if v == nil {
+		return
+	}
+	v.pending.Add(1)
+	go func() {
+		defer v.pending.Done()
+		for _, key := range keys {
+			v.slots <- struct{}{}
+			err := v.derive(key)
+			<-v.slots
+			if err != nil {
+				echoError(Log{"t": "image_variant", "key": key, "error": err.Error()})
+			}
+		}
+	}()
+}
+
+// fitImage returns the size of an image downscaled to fit in s, preserving its aspect ratio,
+// or false if the image already fits.
+func fitImage(w, h int, s ImageSize) (int, int, bool) {
+	if w <= s.Width && h <= s.Height {
+		return w, h, false
+	}
+	if w*s.Height > h*s.Width { // wider than the box
+		w, h = s.Width, h*s.Width/w
+	} else {
+		w, h = w*s.Height/h, s.Height
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h, true
+}
+
+// downscale resizes src to w x h by averaging the source pixels covered by each target pixel.
+func downscale(src image.Image, w, h int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	}
+	sw, sh := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				i := rgba.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					p := rgba.Pix[i : i+4 : i+4]
+					r, g, b, a = r+uint64(p[0]), g+uint64(p[1]), b+uint64(p[2]), a+uint64(p[3])
+					i += 4
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestParseImageSize(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	s, err := parseImageSize("256")
+	no(err)
+	eq(s, ImageSize{"256", 256, 256})
+	s, err = parseImageSize("640x480")
+	no(err)
+	eq(s, ImageSize{"640x480", 640, 480})
+	for _, bad := range []string{"", "x", "0", "640x", "ax480", "-1x2"} {
+		if _, err := parseImageSize(bad); err == nil {
+			t.Errorf("want error for %q", bad)
+		}
+	}
+
+	w, h, ok := fitImage(100, 50, ImageSize{"20", 20, 20})
+	eq([]interface{}{w, h, ok}, []interface{}{20, 10, true})
+	w, h, ok = fitImage(50, 100, ImageSize{"40x10", 40, 10})
+	eq([]interface{}{w, h, ok}, []interface{}{5, 10, true})
+	_, _, ok = fitImage(100, 50, ImageSize{"100", 100, 100})
+	eq(ok, false)
+}
+
+func TestImageVariants(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	im := image.NewNRGBA(image.Rect(0, 0, 100, 50))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 100; x++ {
+			im.Set(x, y, color.NRGBA{200, 100, 50, 255})
+		}
+	}
+	var b bytes.Buffer
+	no(png.Encode(&b, im))
+
+	dir := t.TempDir()
+	store := newDiskFileStore(dir)
+	policy := UploadPolicy{ImageSizes: []ImageSize{{"20", 20, 20}, {"200", 200, 200}}}
+	fs := newFileServer(dir, store, newUploadIndex(store, UploadQuotas{}), nil, nil, nil, newCSRFGuard(nil), "/_f", policy, false, newFileURLSigner(nil), nil)
+
+	w := httptest.NewRecorder()
+	fs.ServeHTTP(w, newUploadRequest(t, map[string]string{"a.png": b.String()}, ""))
+	eq(w.Code, http.StatusOK)
+	var res UploadResponse
+	no(json.Unmarshal(w.Body.Bytes(), &res))
+	fs.images.pending.Wait()
+
+	download := func(size string) (int, image.Image) {
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, httptest.NewRequest("GET", res.Files[0]+"?size="+size, nil))
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		eq(w.Header().Get("Content-Type"), "image/png")
+		im, err := png.Decode(w.Body)
+		no(err)
+		return w.Code, im
+	}
+
+	_, thumb := download("20")
+	ok(thumb != nil)
+	eq(thumb.Bounds(), image.Rect(0, 0, 20, 10))
+	eq(color.NRGBAModel.Convert(thumb.At(10, 5)), color.NRGBA{200, 100, 50, 255})
+
+	_, orig := download("200") // already fits
+	eq(orig.Bounds(), image.Rect(0, 0, 100, 50))
+
+	code, _ := download("30")
+	eq(code, http.StatusNotFound)
+
+	no(fs.deleteFile(res.Files[0], "/_f", ""))
+	keys, err := store.list(imageVariantDir)
+	no(err)
+	eq(len(keys), 0)
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// capUploadProgress is the capability advertised by clients that want progress events for their uploads.
+	capUploadProgress = "progress"
+
+	// uploadProgressInterval is the minimum time between progress events for an upload.
+	uploadProgressInterval = 250 * time.Millisecond
+)
+
+// Notice represents a message for a single client, e.g. upload progress.
+type Notice struct {
+	client  string // client ID
+	subject string // subject of the client's session, to avoid notifying other users
+	data    []byte
+}
+
+// UploadProgress reports the progress of uploads to the uploading clients.
+//
+// Clients that advertise the "progress" capability when connecting are sent their client ID in the initial
+// metadata message. To receive progress events for an upload, a client sends its ID in the Wave-Client-ID header,
+// and an ID of its choosing for the upload in the Wave-Upload-ID header; resumable uploads default to the tus upload ID.
+type UploadProgress struct {
+	broker *Broker
+}
+
+func newUploadProgress(broker *Broker) *UploadProgress {
+	return &UploadProgress{broker}
+}
+
+// meter returns the request body, reporting its progress to the uploading client, if any.
+// Offset and total are the bytes already received and expected in all; total is 0 if unknown.
+func (p *UploadProgress) meter(r *http.Request, auth *Auth, id string, offset, total int64) io.ReadCloser {
+	if p == nil {
+		return r.Body
+	}
+	client := r.Header.Get("Wave-Client-ID")
+	if v := r.Header.Get("Wave-Upload-ID"); len(v) > 0 {
+		id = v
+	}
+	if len(client) == 0 || len(id) == 0 {
+		return r.Body
+	}
+	session := anonymous
+	if auth != nil {
+		if session = auth.identify(r); session == nil {
+			return r.Body
+		}
+	}
+	if total < 0 { // unknown
+		total = 0
+	}
+	return &uploadMeter{r.Body, p, client, session.subject, id, offset, total, time.Time{}, false}
+}
+
+// notify sends progress to a client; progress is dropped if the broker is busy.
+func (p *UploadProgress) notify(client, subject string, progress UploadProgressD) {
+	data, err := json.Marshal(OpsD{F: &progress})
+	if err != nil {
+		return
+	}
+	select {
+	case p.broker.notices <- Notice{client, subject, data}:
+	default:
+	}
+}
+
+// uploadMeter counts the bytes read from an upload's request body.
+type uploadMeter struct {
+	io.ReadCloser
+	progress *UploadProgress
+	client   string
+	subject  string
+	id       string
+	received int64
+	total    int64
+	reported time.Time
+	done     bool
+}
+
+func (m *uploadMeter) Read(p []byte) (int, error) {
+	n, err := m.ReadCloser.Read(p)
+	m.received += int64(n)
+	final := err == io.EOF || (m.total > 0 && m.received >= m.total)
+	if m.done || (!final && time.Since(m.reported) < uploadProgressInterval) {
+		return n, err
+	}
+	total := m.total
+	if final && total <= 0 {
+		total = m.received
+	}
+	m.progress.notify(m.client, m.subject, UploadProgressD{m.id, m.received, total})
+	m.reported, m.done = time.Now(), final
+	return n, err
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestUploadProgress(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	broker := newBroker(newSite(), false, false, true)
+	go broker.run()
+	alice := newClient("test", nil, anonymous, "", broker, nil, false, false, true, browserProtocolVersion, "/")
+	bob := newClient("test", nil, anonymous, "", broker, nil, false, false, false, browserProtocolVersion, "/")
+	alice.subscribe("/demo")
+	bob.subscribe("/demo")
+	for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+		broker.clientsMux.RLock()
+		subscribed = len(broker.clients["/demo"]) == 2
+		broker.clientsMux.RUnlock()
+	}
+
+	dir := t.TempDir()
+	store := newDiskFileStore(dir)
+	fs := newFileServer(dir, store, newUploadIndex(store, UploadQuotas{}), nil, nil, nil, newCSRFGuard(nil), "/_f", UploadPolicy{}, false, newFileURLSigner(nil), newUploadProgress(broker))
+
+	upload := func(client *Client) {
+		r := newUploadRequest(t, map[string]string{"a.txt": "hello"}, "")
+		r.Header.Set("Wave-Client-ID", client.id)
+		r.Header.Set("Wave-Upload-ID", "u1")
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, r)
+		eq(w.Code, http.StatusOK)
+	}
+
+	upload(alice)
+	var last UploadProgressD
+	for done := false; !done; {
+		select {
+		case data := <-alice.data:
+			var ops OpsD
+			if err := json.Unmarshal(data, &ops); err != nil {
+				t.Fatal(err)
+			}
+			ok(ops.F != nil)
+			last = *ops.F
+			done = last.Received == last.Total
+		case <-time.After(time.Second):
+			t.Fatal("want upload progress, got none")
+		}
+	}
+	eq(last.ID, "u1")
+	ok(last.Total > 0)
+
+	upload(bob) // did not ask for progress
+	select {
+	case <-bob.data:
+		t.Fatal("want no upload progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UploadScanner represents a content scanner, e.g. an antivirus, that inspects uploaded files before they are stored.
+// Programs embedding the server can plug in their own scanner via ServerConf.Upload.Scanner.
+type UploadScanner interface {
+	// Scan inspects a file, returning the name of the threat found, if any.
+	Scan(filename string, r io.Reader, size int64) (string, error)
+}
+
+// quarantineDir is the file store directory holding infected files, if quarantined; never served.
+const quarantineDir = "_quarantine"
+
+// Time allowed to scan a file.
+const scanTimeout = 5 * time.Minute
+
+// openUploadScanner creates a scanner from a spec, one of:
+// "clamd://host:port" or "clamd:///path/to/clamd.sock" (ClamAV daemon), or "icap://host[:port]/service" (ICAP server).
+func openUploadScanner(spec string) (UploadScanner, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload scanner: %v", err)
+	}
+	switch u.Scheme {
+	case "clamd":
+		if len(u.Host) > 0 {
+			return &ClamdScanner{"tcp", u.Host}, nil
+		}
+		return &ClamdScanner{"unix", u.Path}, nil
+	case "icap":
+		if len(u.Port()) == 0 {
+			u.Host += ":1344"
+		}
+		return &ICAPScanner{u}, nil
+	}
+	return nil, fmt.Errorf("unsupported upload scanner %q: want clamd or icap", u.Scheme)
+}
+
+// scanFile scans an uploaded file, if the policy requires, quarantining it in store if infected and required.
+func (p UploadPolicy) scanFile(store FileStore, filename string, open func() (io.ReadCloser, error), size int64) error {
+	if p.Scanner == nil {
+		return nil
+	}
+	f, err := open()
+	if err != nil {
+		return err
+	}
+	threat, err := p.Scanner.Scan(filename, f, size)
+	f.Close()
+	if err != nil {
+		echoError(Log{"t": "file_scan", "file": filename, "error": err.Error()})
+		return &UploadError{Code: uploadScanFailed, File: filename}
+	}
+	if len(threat) == 0 {
+		return nil
+	}
+	echo(Log{"t": "file_scan", "file": filename, "threat": threat})
+	if p.Quarantine {
+		if f, err := open(); err == nil {
+			key := path.Join(quarantineDir, uuid.New().String(), path.Base(filename))
+			if err := store.write(key, f, size, contentTypeOf(key)); err != nil {
+				echoError(Log{"t": "file_quarantine", "file": filename, "error": err.Error()})
+			} else {
+				echo(Log{"t": "file_quarantine", "file": filename, "key": key})
+			}
+			f.Close()
+		}
+	}
+	return &UploadError{Code: uploadInfected, File: filename, Threat: threat}
+}
+
+// scan scans uploaded files, if the policy requires.
+func (p UploadPolicy) scan(store FileStore, files []*multipart.FileHeader) error {
+	for _, file := range files {
+		open := func() (io.ReadCloser, error) { return file.Open() }
+		if err := p.scanFile(store, file.Filename, open, file.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClamdScanner represents a ClamAV daemon, scanning files via its INSTREAM command.
+type ClamdScanner struct {
+	network string // "tcp" or "unix"
+	addr    string
+}
+
+const clamdChunkSize = 64 * 1024
+
+func (s *ClamdScanner) Scan(filename string, r io.Reader, size int64) (string, error) {
+	conn, err := net.DialTimeout(s.network, s.addr, 10*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("failed connecting to clamd: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(scanTimeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return "", err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed reading clamd reply: %v", err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply parses a clamd reply, e.g. "stream: OK" or "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (string, error) {
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// ICAPScanner represents an ICAP server (RFC 3507), scanning files via RESPMOD requests.
+// The server must reply 204 (No Content) to clean files.
+type ICAPScanner struct {
+	service *url.URL
+}
+
+func (s *ICAPScanner) Scan(filename string, r io.Reader, size int64) (string, error) {
+	conn, err := net.DialTimeout("tcp", s.service.Host, 10*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("failed connecting to ICAP server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(scanTimeout))
+
+	// Encapsulate the file as the body of a response to a GET request for it.
+	reqHdr := "GET /" + url.PathEscape(path.Base(filename)) + " HTTP/1.1\r\nHost: wave\r\n\r\n"
+	resHdr := "HTTP/1.1 200 OK\r\nContent-Type: " + contentTypeOf(filename) + "\r\nContent-Length: " + strconv.FormatInt(size, 10) + "\r\n\r\n"
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\n", s.service.String())
+	fmt.Fprintf(w, "Host: %s\r\n", s.service.Host)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Encapsulated: req-hdr=0, res-hdr=%d, res-body=%d\r\n\r\n", len(reqHdr), len(reqHdr)+len(resHdr))
+	w.WriteString(reqHdr)
+	w.WriteString(resHdr)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	tr := textproto.NewReader(bufio.NewReader(conn))
+	line, err := tr.ReadLine()
+	if err != nil {
+		return "", fmt.Errorf("failed reading ICAP reply: %v", err)
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "ICAP/") {
+		return "", fmt.Errorf("bad ICAP reply %q", line)
+	}
+	header, err := tr.ReadMIMEHeader()
+	if err != nil {
+		return "", fmt.Errorf("failed reading ICAP reply: %v", err)
+	}
+	switch parts[1] {
+	case "204": // unmodified
+		return "", nil
+	case "200": // modified, i.e. blocked or replaced
+		return icapThreat(header), nil
+	}
+	return "", fmt.Errorf("ICAP server replied %q", line)
+}
+
+// icapThreat returns the threat reported in an ICAP reply's headers, e.g. "Threat=Eicar-Signature;" in
+// X-Infection-Found, or the value of X-Virus-ID or X-Violations-Found.
+func icapThreat(header textproto.MIMEHeader) string {
+	if v := header.Get("X-Infection-Found"); len(v) > 0 {
+		for _, p := range strings.Split(v, ";") {
+			if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 && kv[0] == "Threat" {
+				return kv[1]
+			}
+		}
+	}
+	for _, k := range []string{"X-Virus-Id", "X-Violations-Found"} {
+		if v := strings.TrimSpace(header.Get(k)); len(v) > 0 {
+			return v
+		}
+	}
+	return "unknown"
+}
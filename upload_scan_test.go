@@ -0,0 +1,185 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// serveScanner runs a fake scanner on a local port, calling handle for each connection.
+func serveScanner(t *testing.T, handle func(net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func fakeClamd(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+	var data []byte
+	for {
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return
+		}
+		if n == 0 {
+			break
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return
+		}
+		data = append(data, chunk...)
+	}
+	if strings.Contains(string(data), "EICAR") {
+		conn.Write([]byte("stream: Win.Test.EICAR_HDB-1 FOUND\x00"))
+		return
+	}
+	conn.Write([]byte("stream: OK\x00"))
+}
+
+func fakeICAP(conn net.Conn) {
+	tr := textproto.NewReader(bufio.NewReader(conn))
+	if line, err := tr.ReadLine(); err != nil || !strings.HasPrefix(line, "RESPMOD icap://") {
+		return
+	}
+	if _, err := tr.ReadMIMEHeader(); err != nil {
+		return
+	}
+	tr.ReadMIMEHeader() // encapsulated request header
+	tr.ReadMIMEHeader() // encapsulated response header
+	var data []byte
+	for {
+		line, err := tr.ReadLine()
+		if err != nil || line == "0" {
+			break
+		}
+		chunk, _ := tr.ReadLine()
+		data = append(data, chunk...)
+	}
+	if strings.Contains(string(data), "EICAR") {
+		conn.Write([]byte("ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test-Signature;\r\nEncapsulated: null-body=0\r\n\r\n"))
+		return
+	}
+	conn.Write([]byte("ICAP/1.0 204 No Content\r\nEncapsulated: null-body=0\r\n\r\n"))
+}
+
+func TestUploadScanner(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	for _, spec := range []string{
+		"clamd://" + serveScanner(t, fakeClamd),
+		"icap://" + serveScanner(t, fakeICAP) + "/avscan",
+	} {
+		s, err := openUploadScanner(spec)
+		no(err)
+		threat, err := s.Scan("a.txt", strings.NewReader("hello"), 5)
+		no(err)
+		eq(threat, "")
+		threat, err = s.Scan("b.txt", strings.NewReader(eicar), int64(len(eicar)))
+		no(err)
+		if threat == "" {
+			t.Fatalf("%s: want threat, got none", spec)
+		}
+	}
+}
+
+func TestUploadScanPolicy(t *testing.T) {
+	eq, ok, no := assert.Assert(t)
+	scanner, err := openUploadScanner("clamd://" + serveScanner(t, fakeClamd))
+	no(err)
+
+	code, _ := upload(t, UploadPolicy{Scanner: scanner}, map[string]string{"a.txt": "hello"}, "")
+	eq(code, http.StatusOK)
+
+	code, uerr := upload(t, UploadPolicy{Scanner: scanner}, map[string]string{"a.txt": eicar}, "")
+	eq(code, http.StatusUnprocessableEntity)
+	eq(uerr.Code, uploadInfected)
+	eq(uerr.Threat, "Win.Test.EICAR_HDB-1")
+
+	unavailable, err := openUploadScanner("clamd://127.0.0.1:1")
+	no(err)
+	code, uerr = upload(t, UploadPolicy{Scanner: unavailable}, map[string]string{"a.txt": "hello"}, "")
+	eq(code, http.StatusServiceUnavailable)
+	eq(uerr.Code, uploadScanFailed)
+
+	dir := t.TempDir()
+	store := newDiskFileStore(dir)
+	fs := newFileServer(dir, store, newUploadIndex(store, UploadQuotas{}), nil, nil, nil, newCSRFGuard(nil), "/_f", UploadPolicy{Scanner: scanner, Quarantine: true}, false, newFileURLSigner(nil), nil)
+	w := httptest.NewRecorder()
+	fs.ServeHTTP(w, newUploadRequest(t, map[string]string{"a.txt": eicar}, ""))
+	eq(w.Code, http.StatusUnprocessableEntity)
+	quarantined, _ := filepath.Glob(filepath.Join(dir, quarantineDir, "*", "a.txt"))
+	eq(len(quarantined), 1)
+	b, err := ioutil.ReadFile(quarantined[0])
+	no(err)
+	eq(string(b), eicar)
+	entries, _ := ioutil.ReadDir(dir)
+	for _, e := range entries {
+		ok(e.Name() == quarantineDir, "infected file not stored")
+	}
+}
+
+type denyScanner string
+
+func (s denyScanner) Scan(filename string, r io.Reader, size int64) (string, error) {
+	if filename == string(s) {
+		return "Test.Denied", nil
+	}
+	return "", nil
+}
+
+func TestCustomUploadScanner(t *testing.T) {
+	eq, _, _ := assert.Assert(t)
+	var scanner UploadScanner = denyScanner("b.txt")
+
+	code, _ := upload(t, UploadPolicy{Scanner: scanner}, map[string]string{"a.txt": "hello"}, "")
+	eq(code, http.StatusOK)
+
+	code, uerr := upload(t, UploadPolicy{Scanner: scanner}, map[string]string{"b.txt": "hello"}, "")
+	eq(code, http.StatusUnprocessableEntity)
+	eq(uerr.Threat, "Test.Denied")
+}
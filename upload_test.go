@@ -0,0 +1,108 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func newUploadRequest(t *testing.T, files map[string]string, contentType string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range files {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="files"; filename="`+name+`"`)
+		if len(contentType) > 0 {
+			h.Set("Content-Type", contentType)
+		}
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	mw.Close()
+	r := httptest.NewRequest("POST", "/_f/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func upload(t *testing.T, policy UploadPolicy, files map[string]string, contentType string) (int, *UploadError) {
+	dir, err := ioutil.TempDir("", "wave-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := newDiskFileStore(dir)
+	fs := newFileServer(dir, store, newUploadIndex(store, UploadQuotas{}), nil, nil, nil, newCSRFGuard(nil), "/_f", policy, false, newFileURLSigner(nil), nil)
+	w := httptest.NewRecorder()
+	fs.ServeHTTP(w, newUploadRequest(t, files, contentType))
+	if w.Code == http.StatusOK {
+		return w.Code, nil
+	}
+	var d UploadErrorD
+	if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+		t.Fatalf("bad error response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, d.Upload
+}
+
+func TestUploadPolicy(t *testing.T) {
+	eq, ok, _ := assert.Assert(t)
+	pdf := "%PDF-1.4 hello"
+
+	code, _ := upload(t, UploadPolicy{}, map[string]string{"a.pdf": pdf}, "")
+	eq(code, http.StatusOK)
+
+	code, uerr := upload(t, UploadPolicy{MaxSize: 100}, map[string]string{"a.pdf": string(make([]byte, 200))}, "")
+	eq(code, http.StatusRequestEntityTooLarge)
+	eq(uerr.Code, uploadTooLarge)
+	eq(uerr.Limit, int64(100))
+
+	code, uerr = upload(t, UploadPolicy{MaxFileSize: 10}, map[string]string{"a.pdf": pdf}, "")
+	eq(code, http.StatusRequestEntityTooLarge)
+	eq(uerr.Code, uploadFileTooLarge)
+	eq(uerr.File, "a.pdf")
+
+	allowImages := UploadPolicy{AllowTypes: Strings{"image/*"}}
+	code, _ = upload(t, allowImages, map[string]string{"a.png": "png"}, "")
+	eq(code, http.StatusOK)
+	code, uerr = upload(t, allowImages, map[string]string{"a.pdf": pdf}, "")
+	eq(code, http.StatusUnsupportedMediaType)
+	eq(uerr.Type, "application/pdf")
+	code, _ = upload(t, allowImages, map[string]string{"a.bin": "png"}, "image/png; charset=binary")
+	eq(code, http.StatusOK)
+	code, uerr = upload(t, allowImages, map[string]string{"a.png": "<html><script></script></html>"}, "image/png") // sniffed
+	eq(code, http.StatusUnsupportedMediaType)
+	eq(uerr.Type, "text/html")
+
+	denyPDF := UploadPolicy{DenyTypes: Strings{"application/pdf"}}
+	code, _ = upload(t, denyPDF, map[string]string{"a.txt": "hello"}, "")
+	eq(code, http.StatusOK)
+	code, uerr = upload(t, denyPDF, map[string]string{"a.txt": pdf}, "text/plain") // sniffed
+	eq(code, http.StatusUnsupportedMediaType)
+	ok(uerr != nil)
+	eq(uerr.Code, uploadTypeDenied)
+}
@@ -17,11 +17,11 @@ package wave
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"path"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/h2oai/wave/pkg/keychain"
 )
@@ -31,38 +31,61 @@ type WebServer struct {
 	site           *Site
 	broker         *Broker
 	fs             http.Handler
+	auth           *Auth
+	tenancy        *Tenancy
 	keychain       *keychain.Keychain
 	maxRequestSize int64
 	baseURL        string
+	limits         *ConnLimits // shared with websockets, for event streams
 }
 
 const (
-	contentTypeJSON = "application/json"
-	contentTypeHTML = "text/html; charset=UTF-8"
+	contentTypeJSON   = "application/json"
+	contentTypeNDJSON = "application/x-ndjson"
+	contentTypeHTML   = "text/html; charset=UTF-8"
+
+	pageJSONExt = ".json"
+
+	indexCacheControl = "no-cache, must-revalidate"
 )
 
 func newWebServer(
 	site *Site,
 	broker *Broker,
 	auth *Auth,
+	tenancy *Tenancy,
 	keychain *keychain.Keychain,
 	maxRequestSize int64,
 	baseURL string,
-	webDir string,
+	webDirs []string, // in order of precedence
 	header http.Header,
+	cache CachePolicy,
+	limits *ConnLimits,
 ) (*WebServer, error) {
 
+	root := newOverlayFS(webDirs...)
+
 	// read default index.html page from the web root
-	indexPage, err := ioutil.ReadFile(filepath.Join(webDir, "index.html"))
+	indexPage, err := root.readFile("/index.html")
 	if err != nil {
 		return nil, fmt.Errorf("failed reading default index.html page: %v", err)
 	}
 
-	fs := handleStatic([]byte(mungeIndexPage(baseURL, string(indexPage))), http.StripPrefix(baseURL, http.FileServer(http.Dir(webDir))), header)
+	if cache == nil {
+		cache = defaultCachePolicy
+	}
+	if err := cache.validate(); err != nil {
+		return nil, err
+	}
+	indexCache := indexCacheControl
+	if value, ok := cache.match("index.html"); ok {
+		indexCache = value
+	}
+	fs := handleStatic([]byte(mungeIndexPage(baseURL, string(indexPage))), indexCache, http.StripPrefix(baseURL, cache.wrap(root, servePrecompressed(root, newETagFileServer(root)))), header)
 	if auth != nil {
 		fs = auth.wrap(fs)
 	}
-	return &WebServer{site, broker, fs, keychain, maxRequestSize, baseURL}, nil
+	return &WebServer{site, broker, fs, auth, tenancy, keychain, maxRequestSize, baseURL, limits}, nil
 }
 
 func mungeIndexPage(baseURL, html string) string {
@@ -77,26 +100,31 @@ func mungeIndexPage(baseURL, html string) string {
 func (s *WebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPatch: // writes
-		if !s.keychain.Guard(w, r) {
+		if !s.keychain.GuardRoute(w, r, keychain.WriteAccess, resolveURL(r.URL.Path, s.baseURL)) {
 			return
 		}
 		s.patch(w, r)
 	case http.MethodGet: // reads
 		switch r.Header.Get("Content-Type") {
 		case contentTypeJSON: // data
-			if !s.keychain.Guard(w, r) {
+			if !s.keychain.GuardRoute(w, r, keychain.ReadAccess, resolveURL(r.URL.Path, s.baseURL)) {
 				return
 			}
 			s.get(w, r)
 		default: // static/public assets
-			h := s.fs
-			if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-				h = serveGzipped(s.fs)
+			if s.redirect(w, r) {
+				return
+			}
+			if strings.HasSuffix(r.URL.Path, pageJSONExt) && s.getJSON(w, r) {
+				return
 			}
-			h.ServeHTTP(w, r)
+			if strings.HasSuffix(r.URL.Path, pageEventsSuffix) && s.getEvents(w, r) {
+				return
+			}
+			s.fs.ServeHTTP(w, r)
 		}
 	case http.MethodPost: // all other APIs
-		if !s.keychain.Guard(w, r) {
+		if len(bearerToken(r)) == 0 && !s.keychain.Guard(w, r) { // apps can authenticate with app tokens instead
 			return
 		}
 		s.post(w, r)
@@ -106,28 +134,144 @@ func (s *WebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *WebServer) patch(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > s.maxRequestSize { // don't bother reading
+		writeRequestTooLarge(w, s.maxRequestSize)
+		return
+	}
 	data, err := readRequestWithLimit(w, r.Body, s.maxRequestSize)
 	if err != nil {
-		echo(Log{"t": "read patch request body", "error": err.Error()})
+		echoError(Log{"t": "read patch request body", "error": err.Error()})
 		if isRequestTooLarge(err) {
-			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			writeRequestTooLarge(w, s.maxRequestSize)
 			return
 		}
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	s.broker.patch(resolveURL(r.URL.Path, s.baseURL), data)
+	url := tenantRoute(s.tenancy.ofKey(r), resolveURL(r.URL.Path, s.baseURL))
+
+	var ttl time.Duration
+	if v := r.Header.Get(pageTTLHeader); len(v) > 0 {
+		if ttl, err = parseTTL(v); err != nil {
+			echoError(Log{"t": "page_ttl", "url": url, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var pinned bool
+	if v := r.Header.Get(pagePinHeader); len(v) > 0 {
+		if pinned, err = strconv.ParseBool(v); err != nil {
+			echoError(Log{"t": "page_pin", "url": url, "error": err.Error()})
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, span := startSpan(withTraceParent(r.Context(), r.Header.Get(traceParentHeader)), "wave.page.patch", spanServer)
+	span.set("wave.route", url)
+	err = s.broker.tracePatch(ctx, url, data, keyActor(r)) // broadcasts to watchers, traced as a child span
+	span.fail(err)
+	span.finish()
+	if err != nil {
+		writePatchError(w, err)
+		return
+	}
+
+	if len(r.Header.Get(pageTTLHeader)) > 0 {
+		s.site.expire(url, ttl)
+	}
+	if len(r.Header.Get(pagePinHeader)) > 0 {
+		s.site.pin(url, pinned)
+	}
+}
+
+// keyActor identifies the API access key used to make a request, for page events.
+func keyActor(r *http.Request) string {
+	id, _, _ := r.BasicAuth()
+	return "key:" + id
 }
 
 func (s *WebServer) get(w http.ResponseWriter, r *http.Request) {
-	url := resolveURL(r.URL.Path, s.baseURL)
+	url := tenantRoute(s.tenancy.ofKey(r), resolveURL(r.URL.Path, s.baseURL))
 	page := s.site.at(url)
 	if page == nil {
 		echo(Log{"t": "page_not_found", "url": url})
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
+	s.writePage(w, url, page)
+}
+
+// getJSON serves GET /route.json, the read-only JSON representation of the page at /route, if the page exists.
+// Returns false if there is no such page, so that the request can be served as a static file instead.
+//
+// Requires an API access key allowed to read the route, or if OIDC is enabled, a valid session. Sessions cannot read per-client pages, nor,
+// unless they are admins', the admin dashboard.
+func (s *WebServer) getJSON(w http.ResponseWriter, r *http.Request) bool {
+	url := s.broker.routeAliases().serve(strings.TrimSuffix(resolveURL(r.URL.Path, s.baseURL), pageJSONExt))
+	keyed := s.keychain.AllowRoute(r, keychain.ReadAccess, url)
 
+	var session *Session
+	if s.tenancy != nil {
+		if keyed {
+			url = tenantRoute(s.tenancy.ofKey(r), url)
+		} else {
+			if s.auth != nil {
+				session = s.auth.identify(r)
+			}
+			tenant, err := s.tenancy.ofUser(r, session)
+			if err != nil {
+				return false
+			}
+			url = tenantRoute(tenant, url)
+		}
+	}
+
+	page := s.site.at(url)
+	if page == nil {
+		return false
+	}
+
+	if !keyed {
+		if session == nil && s.auth != nil {
+			session = s.auth.identify(r)
+		}
+		if session == nil || s.broker.isUnicast(url) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return true
+		}
+		if s.broker.dashboard.denies(url, session) {
+			return false // does not exist for non-admins
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	s.writePage(w, url, page)
+	return true
+}
+
+// redirect redirects requests for routes aliased by a redirect (see RouteAliases), including requests for their JSON
+// representation. Returns false if the route is not redirected.
+func (s *WebServer) redirect(w http.ResponseWriter, r *http.Request) bool {
+	route := resolveURL(r.URL.Path, s.baseURL)
+	ext := ""
+	if strings.HasSuffix(route, pageJSONExt) {
+		route, ext = strings.TrimSuffix(route, pageJSONExt), pageJSONExt
+	}
+	target, ok := s.broker.routeAliases().redirect(route)
+	if !ok {
+		return false
+	}
+	u := s.baseURL + strings.TrimPrefix(target, "/") + ext
+	if len(r.URL.RawQuery) > 0 {
+		u += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, u, http.StatusFound)
+	return true
+}
+
+func (s *WebServer) writePage(w http.ResponseWriter, url string, page *Page) {
 	data := page.marshal()
 	if data == nil {
 		echo(Log{"t": "cache_miss", "url": url})
@@ -143,34 +287,92 @@ func (s *WebServer) post(w http.ResponseWriter, r *http.Request) {
 	case contentTypeJSON: // data
 		var req AppRequest
 
+		if r.ContentLength > s.maxRequestSize { // don't bother reading
+			writeRequestTooLarge(w, s.maxRequestSize)
+			return
+		}
+
 		b, err := readRequestWithLimit(w, r.Body, s.maxRequestSize)
 		if err != nil {
-			echo(Log{"t": "read post request body", "error": err.Error()})
+			echoError(Log{"t": "read post request body", "error": err.Error()})
 			if isRequestTooLarge(err) {
-				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				writeRequestTooLarge(w, s.maxRequestSize)
 				return
 			}
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 		if err := json.Unmarshal(b, &req); err != nil {
-			echo(Log{"t": "json_unmarshal", "error": err.Error()})
+			echoError(Log{"t": "json_unmarshal", "error": err.Error()})
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
+		token := bearerToken(r)
 		if req.RegisterApp != nil {
 			q := req.RegisterApp
-			s.broker.addApp(q.Mode, q.Route, q.Address, q.KeyID, q.KeySecret)
+			q.token = token
+			if err := s.broker.addApp(s.tenancy.ofKey(r), q); err != nil {
+				echoError(Log{"t": "app_add", "route": q.Route, "host": q.Address, "error": err.Error()})
+				if err == errAppTokenRequired || err == errBadAppToken {
+					http.Error(w, err.Error(), http.StatusUnauthorized)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusBadRequest) // tell the app why it was rejected
+				return
+			}
 		} else if req.UnregisterApp != nil {
 			q := req.UnregisterApp
-			s.broker.dropApp(q.Route)
+			if err := s.broker.appTokens.check([]string{tenantRoute(s.tenancy.ofKey(r), q.Route)}, token); err != nil {
+				echoError(Log{"t": "app_drop", "route": q.Route, "host": q.Address, "error": err.Error()})
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if len(q.Address) > 0 {
+				s.broker.dropAppInstance(tenantRoute(s.tenancy.ofKey(r), q.Route), q.Address)
+			} else {
+				s.broker.dropApp(tenantRoute(s.tenancy.ofKey(r), q.Route))
+			}
+		} else if req.SendApp != nil {
+			q := req.SendApp
+			if err := s.broker.sendApp(s.tenancy.ofKey(r), q, token); err != nil {
+				echoError(Log{"t": "app_message", "from": q.From, "route": q.Route, "error": err.Error()})
+				switch err {
+				case errAppTokenRequired, errBadAppToken:
+					http.Error(w, err.Error(), http.StatusUnauthorized)
+				case errAppMessageDenied, errNoSenderApp:
+					http.Error(w, err.Error(), http.StatusForbidden)
+				case errAppUnavailable, errAppCircuitOpen, errAppMaintenance:
+					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				case errAppTimeout:
+					http.Error(w, err.Error(), http.StatusGatewayTimeout)
+				default:
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				}
+				return
+			}
+		} else if req.SetAppMode != nil {
+			q := req.SetAppMode
+			if err := s.broker.setAppMode(s.tenancy.ofKey(r), q, token); err != nil {
+				echoError(Log{"t": "app_mode", "route": q.Route, "mode": q.Mode, "error": err.Error()})
+				switch err {
+				case errAppTokenRequired, errBadAppToken:
+					http.Error(w, err.Error(), http.StatusUnauthorized)
+				case errAppUnavailable:
+					http.Error(w, err.Error(), http.StatusNotFound)
+				default:
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				}
+				return
+			}
+		} else if len(token) > 0 { // app tokens are good for managing and messaging apps only
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		}
 	default:
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	}
 }
 
-func handleStatic(indexPage []byte, fs http.Handler, extraHeader http.Header) http.Handler {
+func handleStatic(indexPage []byte, indexCache string, fs http.Handler, extraHeader http.Header) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// if the url has an extension, serve the file
 		if len(path.Ext(r.URL.Path)) > 0 {
@@ -183,16 +385,20 @@ func handleStatic(indexPage []byte, fs http.Handler, extraHeader http.Header) ht
 
 		header := w.Header()
 		header.Add("Content-Type", contentTypeHTML)
-		header.Add("Cache-Control", "no-cache, must-revalidate")
-		header.Add("Pragma", "no-cache")
+		header.Add("Cache-Control", indexCache)
+		if indexCache == indexCacheControl {
+			header.Add("Pragma", "no-cache")
+		}
 		copyHeaders(extraHeader, header)
 
 		w.Write(indexPage)
 	})
 }
 
+// copyHeaders copies headers from src to dst, replacing headers already set in dst.
 func copyHeaders(src, dst http.Header) {
 	for k, vs := range src {
+		dst.Del(k)
 		for _, v := range vs {
 			dst.Add(k, v)
 		}
@@ -0,0 +1,41 @@
+// Copyright 2020 H2O.ai, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wave
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/h2oai/wave/pkg/assert"
+)
+
+func TestWebServerRequestTooLarge(t *testing.T) {
+	eq, _, no := assert.Assert(t)
+	s := &WebServer{maxRequestSize: 8}
+	for method, serve := range map[string]http.HandlerFunc{http.MethodPatch: s.patch, http.MethodPost: s.post} {
+		r := httptest.NewRequest(method, "/foo", strings.NewReader(`{"d":[{"k":"x"}]}`))
+		r.Header.Set("Content-Type", contentTypeJSON)
+		w := httptest.NewRecorder()
+		serve(w, r)
+		eq(w.Code, http.StatusRequestEntityTooLarge)
+		eq(w.Header().Get("Content-Type"), contentTypeJSON)
+		var e RequestErrorD
+		no(json.Unmarshal(w.Body.Bytes(), &e))
+		eq(e, RequestErrorD{Error: requestTooLarge, Limit: 8})
+	}
+}